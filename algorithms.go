@@ -0,0 +1,179 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/snapcore/secboot/internal/tcg"
+)
+
+// AlgorithmPolicy defines restrictions on the cryptographic algorithms and parameters that this package is permitted to use, for
+// deployments that have compliance requirements. A policy is installed for the whole package with SetAlgorithmPolicy, and all
+// sealing and provisioning operations are validated against it. Operations that would require the use of an algorithm or
+// parameter that is not permitted by the policy fail with an AlgorithmPolicyError error.
+//
+// Zero values for any field indicate that there is no restriction.
+type AlgorithmPolicy struct {
+	// ForbiddenDigestAlgorithms lists digest algorithms that must not be used. This applies to the PCR banks selected by PCR
+	// protection profiles, and to the name algorithms of objects created or used by this package.
+	ForbiddenDigestAlgorithms []tpm2.HashAlgorithmId
+
+	// MinRSAKeyBits is the minimum permitted size of RSA keys, such as the storage root key and endorsement key. The storage
+	// root key and endorsement key are always created from the RSA-2048 templates defined in the TCG provisioning guidance,
+	// so values greater than 2048 are rejected by SetAlgorithmPolicy.
+	MinRSAKeyBits uint16
+
+	// MinECCKeyBits is the minimum permitted size of the curve for elliptic curve keys, such as the key used for authorizing
+	// PCR policy updates.
+	MinECCKeyBits int
+
+	// MinArgon2Iterations is the minimum number of iterations for the Argon2 KDF used for LUKS2 keyslots created by this
+	// package with a fixed cost.
+	MinArgon2Iterations int
+
+	// MinArgon2MemoryKiB is the minimum memory cost in KiB for the Argon2 KDF used for LUKS2 keyslots created by this
+	// package with a fixed cost.
+	MinArgon2MemoryKiB int
+}
+
+var algorithmPolicy *AlgorithmPolicy
+
+// SetAlgorithmPolicy installs the supplied algorithm policy for this package. Setting this to nil removes any restrictions. This
+// should be called before any other function in this package, and is not safe to call concurrently with other functions in this
+// package.
+//
+// If the policy doesn't permit the endorsement key and storage root key templates that this package uses, no TPM could ever be
+// provisioned under it. In this case, a AlgorithmPolicyError error is returned and the current policy is left unchanged.
+func SetAlgorithmPolicy(policy *AlgorithmPolicy) error {
+	for _, t := range []struct {
+		name     string
+		template *tpm2.Public
+	}{
+		{"endorsement key", tcg.EKTemplate},
+		{"storage root key", tcg.SRKTemplate},
+	} {
+		if err := policy.checkPublicArea(t.template); err != nil {
+			return AlgorithmPolicyError{"policy doesn't permit the " + t.name + " template: " + err.(AlgorithmPolicyError).msg}
+		}
+	}
+	algorithmPolicy = policy
+	return nil
+}
+
+func eccCurveBits(curve tpm2.ECCCurve) int {
+	switch curve {
+	case tpm2.ECCCurveNIST_P192:
+		return 192
+	case tpm2.ECCCurveNIST_P224:
+		return 224
+	case tpm2.ECCCurveNIST_P256, tpm2.ECCCurveBN_P256, tpm2.ECCCurveSM2_P256:
+		return 256
+	case tpm2.ECCCurveNIST_P384:
+		return 384
+	case tpm2.ECCCurveNIST_P521:
+		return 521
+	case tpm2.ECCCurveBN_P638:
+		return 638
+	default:
+		return 0
+	}
+}
+
+// checkDigestAlgorithm checks that the specified digest algorithm is permitted by this policy.
+func (p *AlgorithmPolicy) checkDigestAlgorithm(alg tpm2.HashAlgorithmId) error {
+	if p == nil {
+		return nil
+	}
+	for _, forbidden := range p.ForbiddenDigestAlgorithms {
+		if alg == forbidden {
+			return AlgorithmPolicyError{fmt.Sprintf("digest algorithm %v is forbidden", alg)}
+		}
+	}
+	return nil
+}
+
+// checkPCRSelection checks that none of the PCR banks in the supplied selection are forbidden by this policy.
+func (p *AlgorithmPolicy) checkPCRSelection(pcrs tpm2.PCRSelectionList) error {
+	for _, s := range pcrs {
+		if len(s.Select) == 0 {
+			continue
+		}
+		if err := p.checkDigestAlgorithm(s.Hash); err != nil {
+			return AlgorithmPolicyError{"PCR bank: " + err.(AlgorithmPolicyError).msg}
+		}
+	}
+	return nil
+}
+
+// checkPublicArea checks that the name algorithm and asymmetric key parameters of the supplied public area are permitted by
+// this policy.
+func (p *AlgorithmPolicy) checkPublicArea(pub *tpm2.Public) error {
+	if p == nil {
+		return nil
+	}
+	if err := p.checkDigestAlgorithm(pub.NameAlg); err != nil {
+		return err
+	}
+	switch pub.Type {
+	case tpm2.ObjectTypeRSA:
+		if bits := pub.Params.RSADetail().KeyBits; bits < p.MinRSAKeyBits {
+			return AlgorithmPolicyError{"RSA key size of " + strconv.Itoa(int(bits)) + " bits is too small"}
+		}
+	case tpm2.ObjectTypeECC:
+		if bits := eccCurveBits(pub.Params.ECCDetail().CurveID); bits < p.MinECCKeyBits {
+			return AlgorithmPolicyError{fmt.Sprintf("elliptic curve %v is too small", pub.Params.ECCDetail().CurveID)}
+		}
+	}
+	return nil
+}
+
+// argon2Cost returns the cost parameters to use for a LUKS2 keyslot with a fixed cost, taking in to account any minimum values
+// defined by this policy.
+func (p *AlgorithmPolicy) argon2Cost(iterations, memoryKiB int) (int, int) {
+	if p == nil {
+		return iterations, memoryKiB
+	}
+	if p.MinArgon2Iterations > iterations {
+		iterations = p.MinArgon2Iterations
+	}
+	if p.MinArgon2MemoryKiB > memoryKiB {
+		memoryKiB = p.MinArgon2MemoryKiB
+	}
+	return iterations, memoryKiB
+}
+
+// checkSealingAlgorithms checks that the storage root key, the sealed key objects and the key used for authorizing PCR policy
+// updates are permitted by the current algorithm policy.
+func checkSealingAlgorithms() error {
+	if err := algorithmPolicy.checkPublicArea(tcg.SRKTemplate); err != nil {
+		return err
+	}
+	if err := algorithmPolicy.checkPublicArea(makeSealedKeyTemplate()); err != nil {
+		return err
+	}
+	return algorithmPolicy.checkPublicArea(&tpm2.Public{
+		Type:    tpm2.ObjectTypeECC,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Params: tpm2.PublicParamsU{
+			Data: &tpm2.ECCParams{CurveID: tpm2.ECCCurveNIST_P256}}})
+}
@@ -0,0 +1,211 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// AuditEvent identifies the type of an action recorded in an audit log.
+type AuditEvent string
+
+const (
+	// AuditEventProvision is recorded when TPMConnection.EnsureProvisioned completes successfully.
+	AuditEventProvision AuditEvent = "provision"
+
+	// AuditEventSeal is recorded when one or more keys are sealed to the TPM.
+	AuditEventSeal AuditEvent = "seal"
+
+	// AuditEventReseal is recorded when the PCR protection policy of one or more keys is updated.
+	AuditEventReseal AuditEvent = "reseal"
+
+	// AuditEventRevoke is recorded when previous PCR protection policies are revoked by incrementing the PCR policy counter.
+	AuditEventRevoke AuditEvent = "revoke"
+
+	// AuditEventChangePIN is recorded when the PIN of a key is changed.
+	AuditEventChangePIN AuditEvent = "change-pin"
+)
+
+// AuditLogEntry corresponds to a single entry in an audit log.
+type AuditLogEntry struct {
+	Sequence uint64     `json:"sequence"`          // The position of this entry in the log, starting from 0
+	Time     time.Time  `json:"time"`              // The time that the action completed
+	Event    AuditEvent `json:"event"`             // The type of action
+	KeyIDs   []KeyID    `json:"key-ids,omitempty"` // The IDs of the keys affected by the action, if known
+	Details  string     `json:"details,omitempty"` // Additional human readable details about the action
+
+	// PrevHash is the SHA-256 digest of the serialized form of the previous entry, or empty for the first entry. This links the
+	// entries in to a chain, so that modification or removal of earlier entries can be detected.
+	PrevHash []byte `json:"prev-hash,omitempty"`
+}
+
+// AuditLog is an append-only, hash-chained log of security relevant actions performed on the TPM and on sealed keys, stored as a
+// sequence of JSON encoded entries in a local file. It can be associated with a TPMConnection using TPMConnection.SetAuditLog.
+//
+// The hash chain makes it possible to detect modification, insertion or removal of entries other than the most recent ones. It does
+// not protect against truncation of the log or replacement of the entire log, so callers that require this should record the
+// digest returned from AuditLog.Head somewhere that an adversary can't modify.
+type AuditLog struct {
+	path string
+}
+
+// NewAuditLog returns a new AuditLog that stores its entries in the file at the specified path. The file is created when the first
+// entry is recorded if it doesn't already exist.
+func NewAuditLog(path string) *AuditLog {
+	return &AuditLog{path: path}
+}
+
+// Path returns the path of the file that this log is stored in.
+func (l *AuditLog) Path() string {
+	return l.path
+}
+
+// readAuditLogEntries reads and verifies the chain of entries from r, returning the decoded entries and the digest of the last
+// entry.
+func readAuditLogEntries(r io.Reader) (entries []*AuditLogEntry, head []byte, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		n := len(entries)
+
+		var entry AuditLogEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, nil, AuditLogVerificationError{Sequence: n, msg: fmt.Sprintf("cannot decode entry: %v", err)}
+		}
+		if entry.Sequence != uint64(n) {
+			return nil, nil, AuditLogVerificationError{Sequence: n, msg: fmt.Sprintf("unexpected sequence number %d", entry.Sequence)}
+		}
+		if !bytes.Equal(entry.PrevHash, head) {
+			return nil, nil, AuditLogVerificationError{Sequence: n, msg: "digest of previous entry doesn't match"}
+		}
+
+		h := sha256.Sum256(line)
+		head = h[:]
+		entries = append(entries, &entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, xerrors.Errorf("cannot read audit log: %w", err)
+	}
+	return entries, head, nil
+}
+
+// Read reads and verifies all of the entries in this log. If the log doesn't exist, no entries and no error are returned. If the
+// hash chain is broken or any entry cannot be decoded, a AuditLogVerificationError error is returned.
+func (l *AuditLog) Read() ([]*AuditLogEntry, error) {
+	f, err := os.Open(l.path)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, xerrors.Errorf("cannot open audit log: %w", err)
+	}
+	defer f.Close()
+
+	entries, _, err := readAuditLogEntries(f)
+	return entries, err
+}
+
+// Head returns the SHA-256 digest of the most recent entry in this log, after verifying the hash chain. This can be recorded
+// externally in order to detect truncation or replacement of the log. If the log is empty or doesn't exist, nil is returned.
+func (l *AuditLog) Head() ([]byte, error) {
+	f, err := os.Open(l.path)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, xerrors.Errorf("cannot open audit log: %w", err)
+	}
+	defer f.Close()
+
+	_, head, err := readAuditLogEntries(f)
+	return head, err
+}
+
+// Record appends a new entry to this log. The file is locked whilst the entry is appended, so it is safe for multiple processes to
+// record entries in the same log. An entry can't be appended to a log with a broken hash chain, in which case a
+// AuditLogVerificationError error is returned.
+func (l *AuditLog) Record(event AuditEvent, keyIDs []KeyID, details string) error {
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return xerrors.Errorf("cannot open audit log: %w", err)
+	}
+	defer f.Close()
+
+	if err := lockFile(f); err != nil {
+		return xerrors.Errorf("cannot lock audit log: %w", err)
+	}
+
+	entries, head, err := readAuditLogEntries(f)
+	if err != nil {
+		return err
+	}
+
+	entry := AuditLogEntry{
+		Sequence: uint64(len(entries)),
+		Time:     time.Now().UTC(),
+		Event:    event,
+		KeyIDs:   keyIDs,
+		Details:  details,
+		PrevHash: head}
+	line, err := json.Marshal(&entry)
+	if err != nil {
+		return xerrors.Errorf("cannot encode entry: %w", err)
+	}
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return xerrors.Errorf("cannot write entry: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return xerrors.Errorf("cannot sync audit log: %w", err)
+	}
+	return nil
+}
+
+// SetAuditLog associates an audit log with this connection. When set, successful calls to EnsureProvisioned, SealKeyToTPM,
+// SealKeyToTPMMultiple, UpdateKeyPCRProtectionPolicyV0, UpdateKeyPCRProtectionPolicy, UpdateKeyPCRProtectionPolicyMultiple and
+// ChangePIN record an entry in the log. Entries are only recorded once the action has been completed, and a failure to record an
+// entry never aborts or rolls back the action. These operations return an error if the entry cannot be recorded, although the
+// action will already have been performed in this case - SealKeyToTPM and SealKeyToTPMMultiple also return the private part of
+// the key used for authorizing PCR policy updates along with the error, as it is required to update the sealed keys. Set this to
+// nil to disable audit logging.
+func (t *TPMConnection) SetAuditLog(log *AuditLog) {
+	t.auditLog = log
+}
+
+// recordAuditEvent records an entry in the audit log associated with this connection, if there is one.
+func (t *TPMConnection) recordAuditEvent(event AuditEvent, keyIDs []KeyID, details string) error {
+	if t.auditLog == nil {
+		return nil
+	}
+	if err := t.auditLog.Record(event, keyIDs, details); err != nil {
+		return xerrors.Errorf("cannot record %s event in audit log: %w", event, err)
+	}
+	return nil
+}
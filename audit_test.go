@@ -0,0 +1,181 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/snapcore/secboot"
+)
+
+func TestAuditLog(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "_TestAuditLog_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	log := NewAuditLog(filepath.Join(tmpDir, "audit.log"))
+
+	entries, err := log.Read()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Unexpected entries in new log")
+	}
+
+	id := KeyID{0x01, 0x02, 0x03}
+	if err := log.Record(AuditEventProvision, nil, "mode: full"); err != nil {
+		t.Fatalf("Record failed: %v", err)
+	}
+	if err := log.Record(AuditEventSeal, []KeyID{id}, ""); err != nil {
+		t.Fatalf("Record failed: %v", err)
+	}
+
+	entries, err = log.Read()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Unexpected number of entries: %d", len(entries))
+	}
+	if entries[0].Sequence != 0 || entries[0].Event != AuditEventProvision || entries[0].Details != "mode: full" || len(entries[0].PrevHash) != 0 {
+		t.Errorf("Unexpected first entry: %+v", entries[0])
+	}
+	if entries[1].Sequence != 1 || entries[1].Event != AuditEventSeal || len(entries[1].KeyIDs) != 1 || entries[1].KeyIDs[0] != id {
+		t.Errorf("Unexpected second entry: %+v", entries[1])
+	}
+	if entries[1].Time.IsZero() {
+		t.Errorf("Missing time")
+	}
+
+	data, err := ioutil.ReadFile(log.Path())
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	h := sha256.Sum256(bytes.TrimSuffix(lines[0], []byte("\n")))
+	if !bytes.Equal(entries[1].PrevHash, h[:]) {
+		t.Errorf("Unexpected previous entry digest")
+	}
+
+	head, err := log.Head()
+	if err != nil {
+		t.Fatalf("Head failed: %v", err)
+	}
+	h = sha256.Sum256(bytes.TrimSuffix(lines[1], []byte("\n")))
+	if !bytes.Equal(head, h[:]) {
+		t.Errorf("Unexpected head digest")
+	}
+
+	// Modify the first entry and check that the chain is broken.
+	tampered := append(bytes.Replace(lines[0], []byte("mode: full"), []byte("mode: clear"), 1), lines[1]...)
+	if err := ioutil.WriteFile(log.Path(), tampered, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	_, err = log.Read()
+	if e, ok := err.(AuditLogVerificationError); !ok || e.Sequence != 1 {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := log.Record(AuditEventReseal, nil, ""); err == nil {
+		t.Errorf("Record should fail on a log with a broken chain")
+	}
+
+	// Remove the first entry and check that the chain is broken.
+	if err := ioutil.WriteFile(log.Path(), lines[1], 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	_, err = log.Read()
+	if e, ok := err.(AuditLogVerificationError); !ok || e.Sequence != 0 {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestAuditLogTPMOperations(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	tmpDir, err := ioutil.TempDir("", "_TestAuditLogTPMOperations_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	log := NewAuditLog(filepath.Join(tmpDir, "audit.log"))
+	tpm.SetAuditLog(log)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	if err := UpdateKeyPCRProtectionPolicy(tpm, keyFile, authKey, getTestPCRProfile()); err != nil {
+		t.Fatalf("UpdateKeyPCRProtectionPolicy failed: %v", err)
+	}
+
+	if err := ChangePIN(tpm, keyFile, "", "1234"); err != nil {
+		t.Fatalf("ChangePIN failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	id, _ := k.KeyID()
+
+	entries, err := log.Read()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	expected := []AuditEvent{AuditEventProvision, AuditEventSeal, AuditEventReseal, AuditEventRevoke, AuditEventChangePIN}
+	if len(entries) != len(expected) {
+		t.Fatalf("Unexpected number of entries: %d", len(entries))
+	}
+	for i, e := range entries {
+		if e.Event != expected[i] {
+			t.Errorf("Unexpected event for entry %d: %s", i, e.Event)
+		}
+		if e.Event == AuditEventProvision {
+			continue
+		}
+		if len(e.KeyIDs) != 1 || e.KeyIDs[0] != id {
+			t.Errorf("Unexpected key IDs for entry %d: %v", i, e.KeyIDs)
+		}
+	}
+	if entries[3].Details != "PCR policy counter: 0x01810000" {
+		t.Errorf("Unexpected details for revoke entry: %s", entries[3].Details)
+	}
+}
@@ -0,0 +1,224 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// AuthType identifies the type of secret that is being requested from the user by an AuthRequestor.
+type AuthType int
+
+const (
+	// AuthTypePIN indicates that the PIN or passphrase for a TPM sealed key is being requested.
+	AuthTypePIN AuthType = iota + 1
+
+	// AuthTypeRecoveryKey indicates that a recovery key is being requested.
+	AuthTypeRecoveryKey
+)
+
+func (t AuthType) String() string {
+	switch t {
+	case AuthTypePIN:
+		return "PIN"
+	case AuthTypeRecoveryKey:
+		return "recovery key"
+	default:
+		return fmt.Sprintf("AuthType(%d)", t)
+	}
+}
+
+// ErrAuthRequestTimeout is returned from an AuthRequestor if the user doesn't respond within the requested timeout.
+var ErrAuthRequestTimeout = errors.New("the request for user authentication timed out")
+
+// AuthRequestor is an interface for requesting secrets such as PINs and recovery keys from the user. The ActivateVolume functions
+// use an AuthRequestor to prompt the user, and are responsible for the prompting loop and for enforcing retry limits. This package
+// provides implementations that use systemd-ask-password, plymouth or a terminal.
+type AuthRequestor interface {
+	// RequestAuth requests a secret of the specified type for the encrypted volume at sourceDevicePath from the user. If timeout
+	// is not zero and the user doesn't respond within it, the request should be abandoned and an error returned. The secret is
+	// returned as a byte slice rather than a string so that it can be wiped from memory once it has been used. The caller owns
+	// the returned slice, and implementations must not retain it.
+	RequestAuth(authType AuthType, sourceDevicePath string, timeout time.Duration) ([]byte, error)
+}
+
+func authPrompt(authType AuthType, sourceDevicePath string) string {
+	return "Please enter the " + authType.String() + " for disk " + sourceDevicePath + ":"
+}
+
+type systemdAuthRequestor struct{}
+
+func (systemdAuthRequestor) RequestAuth(authType AuthType, sourceDevicePath string, timeout time.Duration) ([]byte, error) {
+	args := []string{
+		"--icon", "drive-harddisk",
+		"--id", filepath.Base(os.Args[0]) + ":" + sourceDevicePath}
+	if timeout > 0 {
+		args = append(args, "--timeout", fmt.Sprintf("%d", (timeout+time.Second-1)/time.Second))
+	}
+	args = append(args, authPrompt(authType, sourceDevicePath))
+
+	cmd := exec.Command("systemd-ask-password", args...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stdin = os.Stdin
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		// systemd-ask-password doesn't indicate why it failed, but it only fails after the timeout has elapsed if it timed
+		// out.
+		if timeout > 0 && time.Since(start) >= timeout {
+			return nil, ErrAuthRequestTimeout
+		}
+		return nil, wrapExecError(cmd, err)
+	}
+	result := out.Bytes()
+	n := bytes.IndexByte(result, '\n')
+	if n < 0 {
+		wipeBytes(result)
+		return nil, xerrors.Errorf("cannot read result from systemd-ask-password: %w", io.EOF)
+	}
+	return result[:n], nil
+}
+
+// NewSystemdAuthRequestor returns an AuthRequestor that uses systemd-ask-password to request secrets from the user. This is the
+// default AuthRequestor used by the ActivateVolume functions, and is appropriate for use in the initramfs and from system services.
+func NewSystemdAuthRequestor() AuthRequestor {
+	return systemdAuthRequestor{}
+}
+
+type plymouthAuthRequestor struct{}
+
+func (plymouthAuthRequestor) RequestAuth(authType AuthType, sourceDevicePath string, timeout time.Duration) ([]byte, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, "plymouth", "ask-for-password", "--prompt", authPrompt(authType, sourceDevicePath))
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrAuthRequestTimeout
+		}
+		return nil, wrapExecError(cmd, err)
+	}
+	return bytes.TrimRight(out.Bytes(), "\n"), nil
+}
+
+// NewPlymouthAuthRequestor returns an AuthRequestor that uses plymouth to request secrets from the user, for boot environments
+// where plymouth is running but the systemd password agents are not.
+func NewPlymouthAuthRequestor() AuthRequestor {
+	return plymouthAuthRequestor{}
+}
+
+type terminalAuthRequestor struct {
+	in     *os.File
+	reader *bufio.Reader // retained between requests so that buffered input isn't lost
+	out    io.Writer
+}
+
+func (r *terminalAuthRequestor) RequestAuth(authType AuthType, sourceDevicePath string, timeout time.Duration) ([]byte, error) {
+	fmt.Fprint(r.out, authPrompt(authType, sourceDevicePath)+" ")
+	defer fmt.Fprintln(r.out)
+
+	// Disable echo if the input is a terminal. It is restored before returning, even on timeout.
+	restore, err := disableTerminalEcho(r.in)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot disable terminal echo: %w", err)
+	}
+	if restore != nil {
+		defer restore()
+	}
+
+	// Wait for input before reading rather than abandoning a blocked read on timeout, so that no read is left pending to
+	// consume input intended for something else after echo has been restored.
+	if timeout > 0 && r.reader.Buffered() == 0 {
+		ready, err := waitReadable(r.in, timeout)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot wait for input from terminal: %w", err)
+		}
+		if !ready {
+			return nil, ErrAuthRequestTimeout
+		}
+	}
+
+	line, err := r.reader.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	if err != nil {
+		wipeBytes(line)
+		return nil, xerrors.Errorf("cannot read from terminal: %w", err)
+	}
+	return bytes.TrimRight(line, "\n"), nil
+}
+
+// NewTerminalAuthRequestor returns an AuthRequestor that writes prompts to out and reads secrets from in, one per line. If in is a
+// terminal, echo is disabled whilst the secret is being entered. This is intended for interactive command line tools.
+func NewTerminalAuthRequestor(in *os.File, out io.Writer) AuthRequestor {
+	return &terminalAuthRequestor{in: in, reader: bufio.NewReader(in), out: out}
+}
+
+// authRequest is used by the ActivateVolume functions to obtain secrets. The optional reader is used for the first request only,
+// in which case a secret is read from it by reading all characters until the first newline. Subsequent requests, or the first
+// request if the reader has no more input, use the AuthRequestor. The caller owns the returned secret and should wipe it once it
+// has been used.
+type authRequest struct {
+	reader    io.Reader
+	requestor AuthRequestor
+	timeout   time.Duration
+}
+
+func newAuthRequest(reader io.Reader, options *ActivateVolumeOptions) *authRequest {
+	requestor := options.AuthRequestor
+	if requestor == nil {
+		requestor = NewSystemdAuthRequestor()
+	}
+	return &authRequest{reader: reader, requestor: requestor, timeout: options.AuthRequestTimeout}
+}
+
+func (r *authRequest) get(authType AuthType, sourceDevicePath string) ([]byte, error) {
+	if r.reader != nil {
+		scanner := bufio.NewScanner(r.reader)
+		r.reader = nil
+		switch {
+		case scanner.Scan():
+			secret := append([]byte(nil), scanner.Bytes()...)
+			wipeBytes(scanner.Bytes())
+			return secret, nil
+		case scanner.Err() != nil:
+			return nil, xerrors.Errorf("cannot obtain %s from scanner: %w", authType, scanner.Err())
+		}
+	}
+	return r.requestor.RequestAuth(authType, sourceDevicePath, r.timeout)
+}
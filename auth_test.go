@@ -0,0 +1,167 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/snapcore/secboot"
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type authSuite struct {
+	snapd_testutil.BaseTest
+}
+
+var _ = Suite(&authSuite{})
+
+func (s *authSuite) TestAuthTypeString(c *C) {
+	c.Check(AuthTypePIN.String(), Equals, "PIN")
+	c.Check(AuthTypeRecoveryKey.String(), Equals, "recovery key")
+}
+
+func (s *authSuite) TestSystemdAuthRequestor(c *C) {
+	mockSdAskPassword := snapd_testutil.MockCommand(c, "systemd-ask-password", "echo 1234")
+	s.AddCleanup(mockSdAskPassword.Restore)
+
+	pin, err := NewSystemdAuthRequestor().RequestAuth(AuthTypePIN, "/dev/sda1", 0)
+	c.Check(err, IsNil)
+	c.Check(pin, DeepEquals, []byte("1234"))
+	c.Check(mockSdAskPassword.Calls(), DeepEquals, [][]string{
+		{"systemd-ask-password", "--icon", "drive-harddisk", "--id", filepath.Base(os.Args[0]) + ":/dev/sda1",
+			"Please enter the PIN for disk /dev/sda1:"}})
+}
+
+func (s *authSuite) TestSystemdAuthRequestorWithTimeout(c *C) {
+	mockSdAskPassword := snapd_testutil.MockCommand(c, "systemd-ask-password", "echo 1234")
+	s.AddCleanup(mockSdAskPassword.Restore)
+
+	_, err := NewSystemdAuthRequestor().RequestAuth(AuthTypeRecoveryKey, "/dev/sda1", 1500*time.Millisecond)
+	c.Check(err, IsNil)
+	c.Check(mockSdAskPassword.Calls(), DeepEquals, [][]string{
+		{"systemd-ask-password", "--icon", "drive-harddisk", "--id", filepath.Base(os.Args[0]) + ":/dev/sda1",
+			"--timeout", "2", "Please enter the recovery key for disk /dev/sda1:"}})
+}
+
+func (s *authSuite) TestSystemdAuthRequestorError(c *C) {
+	mockSdAskPassword := snapd_testutil.MockCommand(c, "systemd-ask-password", "exit 1")
+	s.AddCleanup(mockSdAskPassword.Restore)
+
+	_, err := NewSystemdAuthRequestor().RequestAuth(AuthTypePIN, "/dev/sda1", 0)
+	c.Check(err, ErrorMatches, ".*/systemd-ask-password failed: exit status 1")
+}
+
+func (s *authSuite) TestSystemdAuthRequestorTimeout(c *C) {
+	mockSdAskPassword := snapd_testutil.MockCommand(c, "systemd-ask-password", "sleep 0.2; exit 1")
+	s.AddCleanup(mockSdAskPassword.Restore)
+
+	_, err := NewSystemdAuthRequestor().RequestAuth(AuthTypePIN, "/dev/sda1", 100*time.Millisecond)
+	c.Check(err, Equals, ErrAuthRequestTimeout)
+}
+
+func (s *authSuite) TestPlymouthAuthRequestor(c *C) {
+	mockPlymouth := snapd_testutil.MockCommand(c, "plymouth", "echo abcd")
+	s.AddCleanup(mockPlymouth.Restore)
+
+	key, err := NewPlymouthAuthRequestor().RequestAuth(AuthTypeRecoveryKey, "/dev/sda1", 0)
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, []byte("abcd"))
+	c.Check(mockPlymouth.Calls(), DeepEquals, [][]string{
+		{"plymouth", "ask-for-password", "--prompt", "Please enter the recovery key for disk /dev/sda1:"}})
+}
+
+func (s *authSuite) TestPlymouthAuthRequestorTimeout(c *C) {
+	mockPlymouth := snapd_testutil.MockCommand(c, "plymouth", "exec sleep 10")
+	s.AddCleanup(mockPlymouth.Restore)
+
+	_, err := NewPlymouthAuthRequestor().RequestAuth(AuthTypePIN, "/dev/sda1", 100*time.Millisecond)
+	c.Check(err, Equals, ErrAuthRequestTimeout)
+}
+
+func (s *authSuite) TestTerminalAuthRequestor(c *C) {
+	r, w, err := os.Pipe()
+	c.Assert(err, IsNil)
+	defer r.Close()
+	defer w.Close()
+
+	_, err = w.WriteString("1234\n")
+	c.Assert(err, IsNil)
+
+	var out bytes.Buffer
+	pin, err := NewTerminalAuthRequestor(r, &out).RequestAuth(AuthTypePIN, "/dev/sda1", 0)
+	c.Check(err, IsNil)
+	c.Check(pin, DeepEquals, []byte("1234"))
+	c.Check(out.String(), Equals, "Please enter the PIN for disk /dev/sda1: \n")
+}
+
+func (s *authSuite) TestTerminalAuthRequestorTimeout(c *C) {
+	r, w, err := os.Pipe()
+	c.Assert(err, IsNil)
+	defer r.Close()
+	defer w.Close()
+
+	var out bytes.Buffer
+	_, err = NewTerminalAuthRequestor(r, &out).RequestAuth(AuthTypePIN, "/dev/sda1", 100*time.Millisecond)
+	c.Check(err, Equals, ErrAuthRequestTimeout)
+}
+
+func (s *authSuite) TestTerminalAuthRequestorMultiple(c *C) {
+	r, w, err := os.Pipe()
+	c.Assert(err, IsNil)
+	defer r.Close()
+	defer w.Close()
+
+	// Both secrets are written at once, so the second one must be retained between requests.
+	_, err = w.WriteString("1234\n5678\n")
+	c.Assert(err, IsNil)
+
+	var out bytes.Buffer
+	requestor := NewTerminalAuthRequestor(r, &out)
+	pin, err := requestor.RequestAuth(AuthTypePIN, "/dev/sda1", 100*time.Millisecond)
+	c.Check(err, IsNil)
+	c.Check(pin, DeepEquals, []byte("1234"))
+	pin, err = requestor.RequestAuth(AuthTypePIN, "/dev/sda1", 100*time.Millisecond)
+	c.Check(err, IsNil)
+	c.Check(pin, DeepEquals, []byte("5678"))
+}
+
+func (s *authSuite) TestTerminalAuthRequestorAfterTimeout(c *C) {
+	r, w, err := os.Pipe()
+	c.Assert(err, IsNil)
+	defer r.Close()
+	defer w.Close()
+
+	var out bytes.Buffer
+	requestor := NewTerminalAuthRequestor(r, &out)
+	_, err = requestor.RequestAuth(AuthTypePIN, "/dev/sda1", 100*time.Millisecond)
+	c.Check(err, Equals, ErrAuthRequestTimeout)
+
+	// Input supplied after a timeout is returned from the next request rather than being consumed by an abandoned read.
+	_, err = w.WriteString("1234\n")
+	c.Assert(err, IsNil)
+	pin, err := requestor.RequestAuth(AuthTypePIN, "/dev/sda1", 100*time.Millisecond)
+	c.Check(err, IsNil)
+	c.Check(pin, DeepEquals, []byte("1234"))
+}
@@ -0,0 +1,139 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"sync"
+	"time"
+)
+
+var timeNow = time.Now
+
+// lockedSecret is a secret stored in memory that is allocated outside of the Go heap, locked so that it cannot be swapped out and
+// excluded from core dumps.
+type lockedSecret struct {
+	mem []byte
+	n   int
+}
+
+func newLockedSecret(secret []byte) (*lockedSecret, error) {
+	mem, err := allocLockedMemory(len(secret))
+	if err != nil {
+		return nil, err
+	}
+	return &lockedSecret{mem: mem, n: copy(mem, secret)}, nil
+}
+
+// bytes returns a copy of the secret, which the caller should wipe once it has been used. A copy is returned so that the caller
+// can't modify or wipe the cached secret.
+func (s *lockedSecret) bytes() []byte {
+	return append([]byte(nil), s.mem[:s.n]...)
+}
+
+func (s *lockedSecret) wipe() {
+	wipeBytes(s.mem)
+	freeLockedMemory(s.mem)
+	s.mem = nil
+	s.n = 0
+}
+
+type cachedAuth struct {
+	secret  *lockedSecret
+	expiry  time.Time
+	devices map[string]struct{} // the devices that this secret has been supplied to
+}
+
+// CachingAuthRequestor is an AuthRequestor that caches secrets obtained from the user, so that when several volumes are protected
+// by the same PIN or recovery key during a single activation run, the user only needs to be asked once. Secrets are cached per
+// AuthType in memory that is locked and excluded from core dumps, and are discarded after a configurable time.
+//
+// A cached secret is supplied once to each volume that requests it. If the same volume makes another request, the cached secret
+// is assumed to be incorrect for that volume, and the user is asked again. The secret that they supply replaces the cached one.
+//
+// Clear should be called at the end of the activation run in order to discard any cached secrets.
+type CachingAuthRequestor struct {
+	requestor AuthRequestor
+	ttl       time.Duration
+
+	mu      sync.Mutex
+	entries map[AuthType]*cachedAuth
+}
+
+// NewCachingAuthRequestor returns a new CachingAuthRequestor, which uses the supplied requestor to obtain secrets from the user.
+// Cached secrets are discarded after the time specified by ttl. If ttl is zero, cached secrets are kept until Clear is called.
+func NewCachingAuthRequestor(requestor AuthRequestor, ttl time.Duration) *CachingAuthRequestor {
+	return &CachingAuthRequestor{
+		requestor: requestor,
+		ttl:       ttl,
+		entries:   make(map[AuthType]*cachedAuth)}
+}
+
+func (r *CachingAuthRequestor) forget(authType AuthType) {
+	e, ok := r.entries[authType]
+	if !ok {
+		return
+	}
+	e.secret.wipe()
+	delete(r.entries, authType)
+}
+
+// RequestAuth implements AuthRequestor.RequestAuth.
+func (r *CachingAuthRequestor) RequestAuth(authType AuthType, sourceDevicePath string, timeout time.Duration) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.entries[authType]; ok {
+		_, supplied := e.devices[sourceDevicePath]
+		switch {
+		case r.ttl > 0 && !timeNow().Before(e.expiry):
+			r.forget(authType)
+		case !supplied:
+			e.devices[sourceDevicePath] = struct{}{}
+			return e.secret.bytes(), nil
+		}
+	}
+
+	secret, err := r.requestor.RequestAuth(authType, sourceDevicePath, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	r.forget(authType)
+	locked, err := newLockedSecret(secret)
+	if err != nil {
+		// Don't fail the request if the secret can't be cached.
+		return secret, nil
+	}
+	r.entries[authType] = &cachedAuth{
+		secret:  locked,
+		expiry:  timeNow().Add(r.ttl),
+		devices: map[string]struct{}{sourceDevicePath: {}}}
+	return secret, nil
+}
+
+// Clear discards all cached secrets, wiping the memory used to store them.
+func (r *CachingAuthRequestor) Clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for t := range r.entries {
+		r.forget(t)
+	}
+}
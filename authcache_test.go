@@ -0,0 +1,185 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/snapcore/secboot"
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type mockAuthRequest struct {
+	authType         AuthType
+	sourceDevicePath string
+}
+
+type mockAuthRequestor struct {
+	responses []string
+	requests  []mockAuthRequest
+}
+
+func (r *mockAuthRequestor) RequestAuth(authType AuthType, sourceDevicePath string, timeout time.Duration) ([]byte, error) {
+	r.requests = append(r.requests, mockAuthRequest{authType, sourceDevicePath})
+	if len(r.responses) == 0 {
+		return nil, errors.New("no response")
+	}
+	response := r.responses[0]
+	r.responses = r.responses[1:]
+	return []byte(response), nil
+}
+
+type authCacheSuite struct {
+	snapd_testutil.BaseTest
+	now time.Time
+}
+
+var _ = Suite(&authCacheSuite{})
+
+func (s *authCacheSuite) SetUpTest(c *C) {
+	s.now = time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	s.AddCleanup(MockTimeNow(func() time.Time { return s.now }))
+}
+
+func (s *authCacheSuite) TestSharedAcrossVolumes(c *C) {
+	mock := &mockAuthRequestor{responses: []string{"1234"}}
+	r := NewCachingAuthRequestor(mock, time.Minute)
+	defer r.Clear()
+
+	for _, path := range []string{"/dev/sda1", "/dev/sda2", "/dev/sdb1"} {
+		pin, err := r.RequestAuth(AuthTypePIN, path, 0)
+		c.Check(err, IsNil)
+		c.Check(pin, DeepEquals, []byte("1234"))
+	}
+	c.Check(mock.requests, DeepEquals, []mockAuthRequest{{AuthTypePIN, "/dev/sda1"}})
+}
+
+func (s *authCacheSuite) TestCachedPerAuthType(c *C) {
+	mock := &mockAuthRequestor{responses: []string{"1234", "abcd"}}
+	r := NewCachingAuthRequestor(mock, 0)
+	defer r.Clear()
+
+	pin, err := r.RequestAuth(AuthTypePIN, "/dev/sda1", 0)
+	c.Check(err, IsNil)
+	c.Check(pin, DeepEquals, []byte("1234"))
+	key, err := r.RequestAuth(AuthTypeRecoveryKey, "/dev/sda2", 0)
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, []byte("abcd"))
+	pin, err = r.RequestAuth(AuthTypePIN, "/dev/sda2", 0)
+	c.Check(err, IsNil)
+	c.Check(pin, DeepEquals, []byte("1234"))
+
+	c.Check(mock.requests, DeepEquals, []mockAuthRequest{{AuthTypePIN, "/dev/sda1"}, {AuthTypeRecoveryKey, "/dev/sda2"}})
+}
+
+func (s *authCacheSuite) TestRetryFromSameVolumeAsksAgain(c *C) {
+	mock := &mockAuthRequestor{responses: []string{"1234", "5678"}}
+	r := NewCachingAuthRequestor(mock, time.Minute)
+	defer r.Clear()
+
+	pin, err := r.RequestAuth(AuthTypePIN, "/dev/sda1", 0)
+	c.Check(err, IsNil)
+	c.Check(pin, DeepEquals, []byte("1234"))
+
+	// The cached PIN was wrong for /dev/sda2, so the user is asked again and the new PIN replaces the cached one.
+	pin, err = r.RequestAuth(AuthTypePIN, "/dev/sda2", 0)
+	c.Check(err, IsNil)
+	c.Check(pin, DeepEquals, []byte("1234"))
+	pin, err = r.RequestAuth(AuthTypePIN, "/dev/sda2", 0)
+	c.Check(err, IsNil)
+	c.Check(pin, DeepEquals, []byte("5678"))
+
+	pin, err = r.RequestAuth(AuthTypePIN, "/dev/sdb1", 0)
+	c.Check(err, IsNil)
+	c.Check(pin, DeepEquals, []byte("5678"))
+
+	c.Check(mock.requests, DeepEquals, []mockAuthRequest{{AuthTypePIN, "/dev/sda1"}, {AuthTypePIN, "/dev/sda2"}})
+}
+
+func (s *authCacheSuite) TestExpiry(c *C) {
+	mock := &mockAuthRequestor{responses: []string{"1234", "5678"}}
+	r := NewCachingAuthRequestor(mock, time.Minute)
+	defer r.Clear()
+
+	pin, err := r.RequestAuth(AuthTypePIN, "/dev/sda1", 0)
+	c.Check(err, IsNil)
+	c.Check(pin, DeepEquals, []byte("1234"))
+
+	s.now = s.now.Add(time.Minute)
+
+	pin, err = r.RequestAuth(AuthTypePIN, "/dev/sda2", 0)
+	c.Check(err, IsNil)
+	c.Check(pin, DeepEquals, []byte("5678"))
+	c.Check(mock.requests, DeepEquals, []mockAuthRequest{{AuthTypePIN, "/dev/sda1"}, {AuthTypePIN, "/dev/sda2"}})
+}
+
+func (s *authCacheSuite) TestClear(c *C) {
+	mock := &mockAuthRequestor{responses: []string{"1234", "5678"}}
+	r := NewCachingAuthRequestor(mock, 0)
+
+	_, err := r.RequestAuth(AuthTypePIN, "/dev/sda1", 0)
+	c.Check(err, IsNil)
+	r.Clear()
+
+	pin, err := r.RequestAuth(AuthTypePIN, "/dev/sda2", 0)
+	c.Check(err, IsNil)
+	c.Check(pin, DeepEquals, []byte("5678"))
+	r.Clear()
+}
+
+func (s *authCacheSuite) TestErrorNotCached(c *C) {
+	mock := &mockAuthRequestor{}
+	r := NewCachingAuthRequestor(mock, 0)
+	defer r.Clear()
+
+	_, err := r.RequestAuth(AuthTypePIN, "/dev/sda1", 0)
+	c.Check(err, ErrorMatches, "no response")
+
+	mock.responses = []string{"1234"}
+	pin, err := r.RequestAuth(AuthTypePIN, "/dev/sda2", 0)
+	c.Check(err, IsNil)
+	c.Check(pin, DeepEquals, []byte("1234"))
+}
+
+func (s *authCacheSuite) TestWipingReturnedSecretDoesNotAffectCache(c *C) {
+	mock := &mockAuthRequestor{responses: []string{"1234"}}
+	r := NewCachingAuthRequestor(mock, 0)
+	defer r.Clear()
+
+	pin, err := r.RequestAuth(AuthTypePIN, "/dev/sda1", 0)
+	c.Check(err, IsNil)
+	for i := range pin {
+		pin[i] = 0
+	}
+
+	pin, err = r.RequestAuth(AuthTypePIN, "/dev/sda2", 0)
+	c.Check(err, IsNil)
+	c.Check(pin, DeepEquals, []byte("1234"))
+	for i := range pin {
+		pin[i] = 0
+	}
+
+	pin, err = r.RequestAuth(AuthTypePIN, "/dev/sdb1", 0)
+	c.Check(err, IsNil)
+	c.Check(pin, DeepEquals, []byte("1234"))
+}
@@ -0,0 +1,349 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// Backend is the high-level interface to this package used for connecting to the TPM, provisioning it, sealing and unsealing keys
+// and activating encrypted volumes. Consumers can depend on this interface rather than on the package-level functions so that
+// they can substitute a FakeBackend in tests, rather than having to mock file paths and devices that this package uses
+// internally. The implementation returned from NewBackend calls the corresponding package-level functions.
+type Backend interface {
+	// Connect connects to the default TPM. If ekCertDataReader is not nil, the authenticity of the TPM is verified in the same way
+	// as SecureConnectToDefaultTPM, else no verification is performed as with ConnectToDefaultTPM. Passing a nil ekCertDataReader
+	// opts out of verified sessions for the returned connection (see TPMConnection.RequireVerifiedSession).
+	Connect(ekCertDataReader io.Reader, endorsementAuth []byte) (BackendConnection, error)
+
+	// ActivateVolumeWithRecoveryKey corresponds to the package-level ActivateVolumeWithRecoveryKey function.
+	ActivateVolumeWithRecoveryKey(volumeName, sourceDevicePath string, keyReader io.Reader, options *ActivateVolumeOptions) error
+
+	// DeactivateVolume corresponds to the package-level DeactivateVolume function.
+	DeactivateVolume(volumeName, sourceDevicePath string, options *DeactivateVolumeOptions) error
+}
+
+// BackendConnection is a connection to the TPM obtained from Backend.Connect.
+type BackendConnection interface {
+	// Close closes the connection to the TPM.
+	Close() error
+
+	// EnsureProvisioned corresponds to TPMConnection.EnsureProvisioned.
+	EnsureProvisioned(mode ProvisionMode, newLockoutAuth []byte) error
+
+	// SealKeyToTPMMultiple corresponds to the package-level SealKeyToTPMMultiple function.
+	SealKeyToTPMMultiple(keys []*SealKeyRequest, params *KeyCreationParams) (TPMPolicyAuthKey, error)
+
+	// UnsealFromTPM reads the sealed key object from the key data file at the specified path, and then unseals it in the same way
+	// as SealedKeyObject.UnsealFromTPMWithResult. The caller should call UnsealResult.Close once it has finished with the result.
+	UnsealFromTPM(keyPath, pin string) (*UnsealResult, error)
+
+	// ActivateVolumeWithTPMSealedKey corresponds to the package-level ActivateVolumeWithTPMSealedKey function.
+	ActivateVolumeWithTPMSealedKey(volumeName, sourceDevicePath, keyPath string, passphraseReader io.Reader, options *ActivateVolumeOptions) (bool, error)
+}
+
+type realBackend struct{}
+
+// NewBackend returns the Backend implementation that calls the package-level functions.
+func NewBackend() Backend {
+	return realBackend{}
+}
+
+func (realBackend) Connect(ekCertDataReader io.Reader, endorsementAuth []byte) (BackendConnection, error) {
+	var tpm *TPMConnection
+	var err error
+	if ekCertDataReader != nil {
+		tpm, err = SecureConnectToDefaultTPM(ekCertDataReader, endorsementAuth)
+	} else {
+		tpm, err = ConnectToDefaultTPM()
+		if err == nil {
+			tpm.RequireVerifiedSession(false)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &realBackendConnection{tpm}, nil
+}
+
+func (realBackend) ActivateVolumeWithRecoveryKey(volumeName, sourceDevicePath string, keyReader io.Reader, options *ActivateVolumeOptions) error {
+	return ActivateVolumeWithRecoveryKey(volumeName, sourceDevicePath, keyReader, options)
+}
+
+func (realBackend) DeactivateVolume(volumeName, sourceDevicePath string, options *DeactivateVolumeOptions) error {
+	return DeactivateVolume(volumeName, sourceDevicePath, options)
+}
+
+type realBackendConnection struct {
+	tpm *TPMConnection
+}
+
+func (c *realBackendConnection) Close() error {
+	return c.tpm.Close()
+}
+
+func (c *realBackendConnection) EnsureProvisioned(mode ProvisionMode, newLockoutAuth []byte) error {
+	return c.tpm.EnsureProvisioned(mode, newLockoutAuth)
+}
+
+func (c *realBackendConnection) SealKeyToTPMMultiple(keys []*SealKeyRequest, params *KeyCreationParams) (TPMPolicyAuthKey, error) {
+	return SealKeyToTPMMultiple(c.tpm, keys, params)
+}
+
+func (c *realBackendConnection) UnsealFromTPM(keyPath, pin string) (*UnsealResult, error) {
+	k, err := ReadSealedKeyObject(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return k.UnsealFromTPMWithResult(c.tpm, pin)
+}
+
+func (c *realBackendConnection) ActivateVolumeWithTPMSealedKey(volumeName, sourceDevicePath, keyPath string, passphraseReader io.Reader, options *ActivateVolumeOptions) (bool, error) {
+	return ActivateVolumeWithTPMSealedKey(c.tpm, volumeName, sourceDevicePath, keyPath, passphraseReader, options)
+}
+
+// FakeBackend is an in-memory implementation of Backend for use in tests. It doesn't access a TPM or any block devices. Sealed keys
+// are recorded in Keys rather than being written to disk, and activated volumes are recorded in Activated. The exported fields can
+// be set by the test to configure the behaviour of the fake, and inspected afterwards. A FakeBackend is safe for concurrent use
+// once it has been configured.
+type FakeBackend struct {
+	mu sync.Mutex
+
+	// ConnectErr is returned from Connect if it is not nil.
+	ConnectErr error
+
+	// Provisioned indicates whether the fake TPM has been provisioned. It is set by EnsureProvisioned. SealKeyToTPMMultiple
+	// returns ErrTPMProvisioning if this is false.
+	Provisioned bool
+
+	// Lockout indicates whether the fake TPM is in dictionary attack lockout mode. If this is true, UnsealFromTPM returns
+	// ErrTPMLockout.
+	Lockout bool
+
+	// Keys contains the sealed keys, keyed by key data file path.
+	Keys map[string][]byte
+
+	// PINs contains the PINs for sealed keys that require one, keyed by key data file path.
+	PINs map[string]string
+
+	// RecoveryKeys contains the recovery key for each volume, keyed by source device path.
+	RecoveryKeys map[string]RecoveryKey
+
+	// Activated contains the source device path of each activated volume, keyed by volume name.
+	Activated map[string]string
+}
+
+var _ Backend = (*FakeBackend)(nil)
+
+// NewFakeBackend returns a new FakeBackend with a fake TPM that has not been provisioned and no sealed keys.
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{
+		Keys:         make(map[string][]byte),
+		PINs:         make(map[string]string),
+		RecoveryKeys: make(map[string]RecoveryKey),
+		Activated:    make(map[string]string)}
+}
+
+func (b *FakeBackend) Connect(ekCertDataReader io.Reader, endorsementAuth []byte) (BackendConnection, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.ConnectErr != nil {
+		return nil, b.ConnectErr
+	}
+	return &fakeBackendConnection{b}, nil
+}
+
+func (b *FakeBackend) ActivateVolumeWithRecoveryKey(volumeName, sourceDevicePath string, keyReader io.Reader, options *ActivateVolumeOptions) error {
+	if options.RecoveryKeyTries < 0 {
+		return errors.New("invalid RecoveryKeyTries")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.activateWithRecoveryKey(volumeName, sourceDevicePath, keyReader, options.RecoveryKeyTries)
+}
+
+func (b *FakeBackend) DeactivateVolume(volumeName, sourceDevicePath string, options *DeactivateVolumeOptions) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if path, ok := b.Activated[volumeName]; !ok || path != sourceDevicePath {
+		return fmt.Errorf("cannot detach volume: %s is not an active volume for %s", volumeName, sourceDevicePath)
+	}
+	delete(b.Activated, volumeName)
+	return nil
+}
+
+func (b *FakeBackend) activateWithRecoveryKey(volumeName, sourceDevicePath string, keyReader io.Reader, tries int) error {
+	if tries == 0 {
+		return errors.New("no recovery key tries permitted")
+	}
+	if keyReader == nil {
+		return errors.New("no recovery key was supplied")
+	}
+
+	expected, ok := b.RecoveryKeys[sourceDevicePath]
+	if !ok {
+		return fmt.Errorf("no recovery key for %s", sourceDevicePath)
+	}
+
+	r := bufio.NewReader(keyReader)
+	for ; tries > 0; tries-- {
+		line, err := r.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return xerrors.Errorf("cannot obtain recovery key: %w", err)
+		}
+		key, err := ParseRecoveryKey(strings.TrimSpace(line))
+		if err != nil {
+			continue
+		}
+		if key == expected {
+			b.Activated[volumeName] = sourceDevicePath
+			return nil
+		}
+	}
+	return errors.New("cannot activate volume with recovery key")
+}
+
+type fakeBackendConnection struct {
+	b *FakeBackend
+}
+
+func (c *fakeBackendConnection) Close() error {
+	return nil
+}
+
+func (c *fakeBackendConnection) EnsureProvisioned(mode ProvisionMode, newLockoutAuth []byte) error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+
+	c.b.Provisioned = true
+	return nil
+}
+
+func (c *fakeBackendConnection) SealKeyToTPMMultiple(keys []*SealKeyRequest, params *KeyCreationParams) (TPMPolicyAuthKey, error) {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+
+	if !c.b.Provisioned {
+		return nil, ErrTPMProvisioning
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys provided")
+	}
+
+	for _, k := range keys {
+		if _, exists := c.b.Keys[k.Path]; exists {
+			return nil, xerrors.Errorf("cannot create key data file: %w", &os.PathError{Op: "open", Path: k.Path, Err: os.ErrExist})
+		}
+	}
+	for _, k := range keys {
+		c.b.Keys[k.Path] = append([]byte(nil), k.Key...)
+	}
+
+	authKey := make(TPMPolicyAuthKey, 32)
+	if _, err := rand.Read(authKey); err != nil {
+		return nil, xerrors.Errorf("cannot create auth key: %w", err)
+	}
+	return authKey, nil
+}
+
+func (c *fakeBackendConnection) unseal(keyPath, pin string) ([]byte, error) {
+	if c.b.Lockout {
+		return nil, ErrTPMLockout
+	}
+	key, ok := c.b.Keys[keyPath]
+	if !ok {
+		return nil, xerrors.Errorf("cannot open key data file: %w", &os.PathError{Op: "open", Path: keyPath, Err: os.ErrNotExist})
+	}
+	if pin != c.b.PINs[keyPath] {
+		return nil, ErrPINFail
+	}
+	return append([]byte(nil), key...), nil
+}
+
+func (c *fakeBackendConnection) UnsealFromTPM(keyPath, pin string) (*UnsealResult, error) {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+
+	key, err := c.unseal(keyPath, pin)
+	if err != nil {
+		return nil, err
+	}
+	authMode := AuthModeNone
+	if c.b.PINs[keyPath] != "" {
+		authMode = AuthModePIN
+	}
+	return &UnsealResult{
+		Key:                    NewSecretBuffer(key),
+		Location:               FileKeyLocation(keyPath),
+		AuthMode:               authMode,
+		PCRPolicyCounterHandle: tpm2.HandleNull}, nil
+}
+
+func (c *fakeBackendConnection) ActivateVolumeWithTPMSealedKey(volumeName, sourceDevicePath, keyPath string, passphraseReader io.Reader, options *ActivateVolumeOptions) (bool, error) {
+	if options.PassphraseTries < 0 {
+		return false, errors.New("invalid PassphraseTries")
+	}
+	if options.RecoveryKeyTries < 0 {
+		return false, errors.New("invalid RecoveryKeyTries")
+	}
+
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+
+	var err error
+	if c.b.PINs[keyPath] == "" {
+		_, err = c.unseal(keyPath, "")
+	} else {
+		// Read PINs from passphraseReader, one per line, in the same way as the real implementation does if it is supplied.
+		err = ErrPINFail
+		if passphraseReader != nil {
+			r := bufio.NewReader(passphraseReader)
+			for tries := options.PassphraseTries; tries > 0 && err == ErrPINFail; tries-- {
+				line, rErr := r.ReadString('\n')
+				if rErr != nil && (rErr != io.EOF || line == "") {
+					break
+				}
+				_, err = c.unseal(keyPath, strings.TrimSuffix(line, "\n"))
+			}
+		}
+	}
+	if err == nil {
+		c.b.Activated[volumeName] = sourceDevicePath
+		return true, nil
+	}
+
+	// The fake doesn't have a way to request a recovery key from the user, so the fallback always fails.
+	return false, &ActivateWithTPMSealedKeyError{err, errors.New("no recovery key was supplied")}
+}
@@ -0,0 +1,136 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	. "github.com/snapcore/secboot"
+
+	"golang.org/x/xerrors"
+)
+
+func TestFakeBackendSealAndUnseal(t *testing.T) {
+	b := NewFakeBackend()
+
+	conn, err := b.Connect(nil, nil)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer conn.Close()
+
+	keys := []*SealKeyRequest{{Key: []byte("foo"), Path: "/run/foo.sealed-key"}, {Key: []byte("bar"), Path: "/run/bar.sealed-key"}}
+
+	if _, err := conn.SealKeyToTPMMultiple(keys, &KeyCreationParams{}); err != ErrTPMProvisioning {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if err := conn.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("EnsureProvisioned failed: %v", err)
+	}
+	if !b.Provisioned {
+		t.Errorf("Fake TPM should be provisioned")
+	}
+
+	authKey, err := conn.SealKeyToTPMMultiple(keys, &KeyCreationParams{})
+	if err != nil {
+		t.Fatalf("SealKeyToTPMMultiple failed: %v", err)
+	}
+	if len(authKey) != 32 {
+		t.Errorf("Unexpected auth key length")
+	}
+	if _, err := conn.SealKeyToTPMMultiple(keys[:1], &KeyCreationParams{}); err == nil {
+		t.Errorf("SealKeyToTPMMultiple should fail for an existing key")
+	}
+
+	result, err := conn.UnsealFromTPM("/run/bar.sealed-key", "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(result.Key.Bytes(), []byte("bar")) {
+		t.Errorf("Unexpected key")
+	}
+	if result.AuthMode != AuthModeNone {
+		t.Errorf("Unexpected auth mode: %v", result.AuthMode)
+	}
+	result.Close()
+	if result.Key.Len() != 0 {
+		t.Errorf("Key was not wiped")
+	}
+
+	b.PINs["/run/bar.sealed-key"] = "1234"
+	if _, err := conn.UnsealFromTPM("/run/bar.sealed-key", "5678"); err != ErrPINFail {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	b.Lockout = true
+	if _, err := conn.UnsealFromTPM("/run/bar.sealed-key", "1234"); err != ErrTPMLockout {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestFakeBackendActivate(t *testing.T) {
+	b := NewFakeBackend()
+	b.Keys["/run/data.sealed-key"] = []byte("data")
+	b.PINs["/run/data.sealed-key"] = "1234"
+	b.RecoveryKeys["/dev/sda2"] = RecoveryKey{0x01, 0x02}
+
+	conn, err := b.Connect(nil, nil)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer conn.Close()
+
+	options := &ActivateVolumeOptions{PassphraseTries: 2, RecoveryKeyTries: 1}
+
+	success, err := conn.ActivateVolumeWithTPMSealedKey("data", "/dev/sda1", "/run/data.sealed-key", strings.NewReader("5678\n1234\n"), options)
+	if !success || err != nil {
+		t.Errorf("ActivateVolumeWithTPMSealedKey failed: %v", err)
+	}
+
+	success, err = conn.ActivateVolumeWithTPMSealedKey("data2", "/dev/sda2", "/run/data.sealed-key", strings.NewReader("5678\n"), options)
+	if success {
+		t.Errorf("ActivateVolumeWithTPMSealedKey should have failed")
+	}
+	var e *ActivateWithTPMSealedKeyError
+	if !xerrors.As(err, &e) || e.TPMErr != ErrPINFail {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if err := b.ActivateVolumeWithRecoveryKey("data2", "/dev/sda2", strings.NewReader(RecoveryKey{0x01, 0x02}.String()+"\n"), options); err != nil {
+		t.Errorf("ActivateVolumeWithRecoveryKey failed: %v", err)
+	}
+
+	if b.Activated["data"] != "/dev/sda1" || b.Activated["data2"] != "/dev/sda2" || len(b.Activated) != 2 {
+		t.Errorf("Unexpected activated volumes: %v", b.Activated)
+	}
+
+	if err := b.DeactivateVolume("data2", "/dev/sda2", nil); err != nil {
+		t.Errorf("DeactivateVolume failed: %v", err)
+	}
+	if err := b.DeactivateVolume("data2", "/dev/sda2", nil); err == nil {
+		t.Errorf("DeactivateVolume should have failed")
+	}
+	if b.Activated["data"] != "/dev/sda1" || len(b.Activated) != 1 {
+		t.Errorf("Unexpected activated volumes: %v", b.Activated)
+	}
+}
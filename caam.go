@@ -0,0 +1,121 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// caamCmdEncapsulate and caamCmdDecapsulate are the commands implemented by the CAAM blob trusted application. Both take a
+	// memory reference input in parameter 0 containing the 16-byte key modifier followed by the input data, and return the
+	// output data via a memory reference output in parameter 1.
+	caamCmdEncapsulate uint32 = 0
+	caamCmdDecapsulate uint32 = 1
+
+	// caamBlobOverhead is the size of the metadata that CAAM adds to a blob - a 32-byte encrypted blob key and a 16-byte MAC.
+	caamBlobOverhead = 48
+
+	caamKeyModifierSize = 16
+)
+
+// defaultCAAMKeyModifier is the key modifier used by CAAMProtector when one isn't specified. It is the string "secboot-fde-key"
+// padded to 16 bytes.
+var defaultCAAMKeyModifier = []byte("secboot-fde-key\x00")
+
+// CAAMProtector is a HardwareKeyProtector for NXP i.MX devices, which encapsulates keys in black blobs using the Cryptographic
+// Acceleration and Assurance Module (CAAM). Black blobs are encrypted with a blob key derived from the device-unique OTP master
+// key, which is only accessible to the CAAM, and the key inside a black blob is itself encrypted with a key that never leaves the
+// CAAM. CAAM blob operations are only available to the secure world on devices that are closed for secure boot, so this protector
+// uses a trusted application running in OP-TEE via the Linux TEE subsystem. The trusted application decapsulates the black blob
+// and decrypts the black key before returning the key.
+//
+// Neither NXP nor OP-TEE ship a trusted application that returns a decapsulated key to the normal world, so the trusted
+// application must be supplied by the platform and its UUID must be specified with the TA field. The kernel's trusted keys CAAM
+// backend (trusted.source=caam) can't be used instead, because it never exposes the key to user space and the key is required in
+// order to unlock the volume with cryptsetup. Platforms that don't have a suitable trusted application should protect keys with
+// trusted keys and a kernel keyring based activation path instead of with this protector.
+//
+// The trusted application must implement 2 commands, each taking a TEE_PARAM_TYPE_MEMREF_INPUT in parameter 0 and returning
+// the result in a TEE_PARAM_TYPE_MEMREF_OUTPUT in parameter 1. Command 0 encapsulates the key supplied in parameter 0 in a black
+// blob using the CAAM blob encapsulation protocol, and returns the blob, which is 48 bytes longer than the key. Command 1
+// decapsulates the black blob supplied in parameter 0 using the CAAM blob decapsulation protocol, and returns the key. In both
+// cases, the input data is prefixed with the 16-byte key modifier. The trusted application should fail with
+// TEE_ERROR_MAC_INVALID or TEE_ERROR_SECURITY if a blob cannot be authenticated, and must only be accessible to the normal world
+// whilst the device is in a state in which the key may be released (eg, before the OS has finished booting).
+//
+// This protector is not registered automatically. Platform-specific code for i.MX devices should register it with
+// RegisterHardwareKeyProtector so that volumes protected with it can be activated without it being known by the caller.
+type CAAMProtector struct {
+	// DevicePath is the path of the TEE device. If this is empty, /dev/tee0 is used.
+	DevicePath string
+
+	// TA is the UUID of the CAAM blob trusted application. This is required.
+	TA string
+
+	// KeyModifier is the 16-byte key modifier used when deriving the blob key, which binds blobs to a particular use. If this is
+	// empty, a default modifier is used. The same modifier must be used to decapsulate a blob as was used to encapsulate it.
+	KeyModifier []byte
+}
+
+// Protector implements HardwareKeyProtector.Protector.
+func (p *CAAMProtector) Protector() VolumeProtector {
+	return VolumeProtectorCAAM
+}
+
+func (p *CAAMProtector) invoke(cmd uint32, in []byte, outSize int) ([]byte, error) {
+	modifier := p.KeyModifier
+	if len(modifier) == 0 {
+		modifier = defaultCAAMKeyModifier
+	}
+	if len(modifier) != caamKeyModifierSize {
+		return nil, errors.New("invalid key modifier size")
+	}
+
+	if p.TA == "" {
+		return nil, errors.New("no trusted application specified")
+	}
+
+	data := make([]byte, 0, len(modifier)+len(in))
+	data = append(data, modifier...)
+	data = append(data, in...)
+	defer wipeBytes(data)
+
+	return invokeOPTEE(p.DevicePath, p.TA, cmd, data, outSize)
+}
+
+// WrapKey implements HardwareKeyProtector.WrapKey.
+func (p *CAAMProtector) WrapKey(key []byte) ([]byte, error) {
+	return p.invoke(caamCmdEncapsulate, key, len(key)+caamBlobOverhead)
+}
+
+// UnwrapKey implements HardwareKeyProtector.UnwrapKey.
+func (p *CAAMProtector) UnwrapKey(blob []byte) ([]byte, error) {
+	if len(blob) <= caamBlobOverhead {
+		return nil, xerrors.Errorf("%w (blob is too short)", ErrInvalidWrappedKey)
+	}
+	key, err := p.invoke(caamCmdDecapsulate, blob, len(blob)-caamBlobOverhead)
+	if isOPTEEInvalidWrappedKeyError(err) {
+		return nil, xerrors.Errorf("%w (%v)", ErrInvalidWrappedKey, err)
+	}
+	return key, err
+}
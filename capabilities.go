@@ -0,0 +1,225 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// TPMNVSpace describes the NV resources of a TPM. TPMs don't report the number of bytes of NV memory that remain, so these are
+// the counts reported by the TPM, from which the feasibility of defining additional resources can be estimated.
+type TPMNVSpace struct {
+	DefinedIndices           uint32 // The number of NV indices currently defined (TPM_PT_HR_NV_INDEX)
+	PersistentObjects        uint32 // The number of persistent objects currently defined (TPM_PT_HR_PERSISTENT)
+	PersistentObjectsAvail   uint32 // The estimated number of additional persistent objects that can be defined (TPM_PT_HR_PERSISTENT_AVAIL)
+	Counters                 uint32 // The number of NV counter indices currently defined (TPM_PT_NV_COUNTERS)
+	CountersAvail            uint32 // The estimated number of additional NV counter indices that can be defined (TPM_PT_NV_COUNTERS_AVAIL)
+	MaxCounters              uint32 // The maximum number of NV counter indices, or zero if there is no fixed limit (TPM_PT_NV_COUNTERS_MAX)
+	MaxIndexSize             uint32 // The maximum size of a single NV index (TPM_PT_NV_INDEX_MAX)
+	MinPersistentObjectsHint uint32 // The minimum number of persistent objects that the TPM guarantees (TPM_PT_HR_PERSISTENT_MIN)
+}
+
+// TPMLockoutStatus describes the dictionary attack protection state of a TPM.
+type TPMLockoutStatus struct {
+	InLockout       bool   // The TPM is in DA lockout mode
+	LockoutAuthSet  bool   // The authorization value for the lockout hierarchy is set
+	LockoutCounter  uint32 // The current number of authorization failures
+	MaxAuthFail     uint32 // The number of authorization failures before the TPM enters DA lockout mode
+	LockoutInterval uint32 // The number of seconds before the authorization failure count is decremented
+	LockoutRecovery uint32 // The number of seconds after a lockout hierarchy authorization failure before it can be used again
+}
+
+// TPMCapabilities describes the properties of a TPM that are relevant when deciding whether to use it for full disk encryption.
+type TPMCapabilities struct {
+	Family          string                 // The TPM family, eg, "2.0"
+	Manufacturer    tpm2.TPMManufacturer   // The TPM manufacturer
+	VendorString    string                 // The vendor specific string reported by the TPM
+	FirmwareVersion uint64                 // The firmware version of the TPM
+	ActivePCRBanks  []tpm2.HashAlgorithmId // The PCR banks with at least one PCR allocated
+	NVSpace         TPMNVSpace             // The NV resources of the TPM
+	Lockout         TPMLockoutStatus       // The dictionary attack protection state of the TPM
+}
+
+// readTPMPropertyGroup returns the properties of the TPM in the group starting at first (tpm2.PropertyFixed or tpm2.PropertyVar),
+// indexed by property.
+func readTPMPropertyGroup(tpm *tpm2.TPMContext, first tpm2.Property, sessions ...tpm2.SessionContext) (map[tpm2.Property]uint32, error) {
+	props, err := tpm.GetCapabilityTPMProperties(first, tpm2.CapabilityMaxProperties, sessions...)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[tpm2.Property]uint32)
+	for _, prop := range props {
+		if prop.Property&0xffffff00 != first {
+			continue
+		}
+		out[prop.Property] = prop.Value
+	}
+	return out, nil
+}
+
+// readTPMProperties returns all of the fixed and variable properties of the TPM, indexed by property.
+func readTPMProperties(tpm *tpm2.TPMContext, sessions ...tpm2.SessionContext) (map[tpm2.Property]uint32, error) {
+	out := make(map[tpm2.Property]uint32)
+	for _, p := range []tpm2.Property{tpm2.PropertyFixed, tpm2.PropertyVar} {
+		props, err := readTPMPropertyGroup(tpm, p, sessions...)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range props {
+			out[k] = v
+		}
+	}
+	return out, nil
+}
+
+// FixedProperties returns the fixed properties of the TPM associated with this connection (those in the TPM_PT_FIXED group,
+// such as the manufacturer, vendor strings, firmware version and implementation limits), indexed by property. These are read
+// from the TPM once and cached for the lifetime of the connection. The returned map is a copy and may be modified by the caller.
+func (t *TPMConnection) FixedProperties() (map[tpm2.Property]uint32, error) {
+	if t.fixedProperties == nil {
+		session, err := t.secretSession()
+		if err != nil {
+			return nil, err
+		}
+		props, err := readTPMPropertyGroup(t.TPMContext, tpm2.PropertyFixed, session.IncludeAttrs(tpm2.AttrAudit))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot obtain TPM properties: %w", err)
+		}
+		t.fixedProperties = props
+	}
+
+	out := make(map[tpm2.Property]uint32)
+	for k, v := range t.fixedProperties {
+		out[k] = v
+	}
+	return out, nil
+}
+
+// Capabilities returns a report of the properties of the TPM associated with this connection.
+func (t *TPMConnection) Capabilities() (*TPMCapabilities, error) {
+	session, err := t.secretSession()
+	if err != nil {
+		return nil, err
+	}
+	session = session.IncludeAttrs(tpm2.AttrAudit)
+
+	props, err := t.FixedProperties()
+	if err != nil {
+		return nil, err
+	}
+	varProps, err := readTPMPropertyGroup(t.TPMContext, tpm2.PropertyVar, session)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain TPM properties: %w", err)
+	}
+	for k, v := range varProps {
+		props[k] = v
+	}
+
+	family := props[tpm2.PropertyFamilyIndicator]
+	vendor := make([]byte, 0, 16)
+	for p := tpm2.PropertyVendorString1; p <= tpm2.PropertyVendorString4; p++ {
+		v := props[p]
+		vendor = append(vendor, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	permanent := tpm2.PermanentAttributes(props[tpm2.PropertyPermanent])
+
+	c := &TPMCapabilities{
+		Family:          string(bytes.TrimRight([]byte{byte(family >> 24), byte(family >> 16), byte(family >> 8), byte(family)}, "\x00")),
+		Manufacturer:    tpm2.TPMManufacturer(props[tpm2.PropertyManufacturer]),
+		VendorString:    string(bytes.TrimSpace(bytes.TrimRight(vendor, "\x00"))),
+		FirmwareVersion: uint64(props[tpm2.PropertyFirmwareVersion1])<<32 | uint64(props[tpm2.PropertyFirmwareVersion2]),
+		NVSpace: TPMNVSpace{
+			DefinedIndices:           props[tpm2.PropertyHRNVIndex],
+			PersistentObjects:        props[tpm2.PropertyHRPersistent],
+			PersistentObjectsAvail:   props[tpm2.PropertyHRPersistentAvail],
+			Counters:                 props[tpm2.PropertyNVCounters],
+			CountersAvail:            props[tpm2.PropertyNVCountersAvail],
+			MaxCounters:              props[tpm2.PropertyNVCountersMax],
+			MaxIndexSize:             props[tpm2.PropertyNVIndexMax],
+			MinPersistentObjectsHint: props[tpm2.PropertyHRPersistentMin]},
+		Lockout: TPMLockoutStatus{
+			InLockout:       permanent&tpm2.AttrInLockout > 0,
+			LockoutAuthSet:  permanent&tpm2.AttrLockoutAuthSet > 0,
+			LockoutCounter:  props[tpm2.PropertyLockoutCounter],
+			MaxAuthFail:     props[tpm2.PropertyMaxAuthFail],
+			LockoutInterval: props[tpm2.PropertyLockoutInterval],
+			LockoutRecovery: props[tpm2.PropertyLockoutRecovery]}}
+
+	pcrs, err := t.GetCapabilityPCRs(session)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain PCR allocation: %w", err)
+	}
+	for _, s := range pcrs {
+		if len(s.Select) > 0 {
+			c.ActivePCRBanks = append(c.ActivePCRBanks, s.Hash)
+		}
+	}
+
+	return c, nil
+}
+
+// TPMDeviceReport describes a TPM device returned from ListTPMDevices.
+type TPMDeviceReport struct {
+	*TPMDeviceInfo
+
+	// Capabilities describes the properties of the TPM. This is nil if the device couldn't be queried.
+	Capabilities *TPMCapabilities
+
+	// Err is the error that occurred when querying the device, if any. For TPM 1.2 devices, this is a TPM12DeviceError
+	// containing the details obtained from sysfs.
+	Err error
+}
+
+// ListTPMDevices returns a report for each of the TPM devices returned from EnumerateTPMDevices, containing the information
+// required to choose a device and to decide whether TPM backed full disk encryption is feasible with it. Each TPM2 device is
+// connected to without verifying its authenticity in order to obtain its properties. A failure to query an individual device
+// is recorded in the Err field of its report rather than being returned.
+func ListTPMDevices() ([]*TPMDeviceReport, error) {
+	infos, err := EnumerateTPMDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*TPMDeviceReport
+	for _, info := range infos {
+		r := &TPMDeviceReport{TPMDeviceInfo: info}
+		out = append(out, r)
+
+		if info.MajorVersion == 1 {
+			r.Err = readTPM12DeviceInfoFromSysfs(filepath.Join(sysClassTPMPath, info.Name))
+			continue
+		}
+
+		tpm, err := ConnectToTPMDevice(info.Device)
+		if err != nil {
+			r.Err = err
+			continue
+		}
+		r.Capabilities, r.Err = tpm.Capabilities()
+		tpm.Close()
+	}
+
+	return out, nil
+}
@@ -0,0 +1,138 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestTPMConnectionCapabilities(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, []byte("1234")); err != nil {
+		t.Fatalf("EnsureProvisioned failed: %v", err)
+	}
+
+	caps, err := tpm.Capabilities()
+	if err != nil {
+		t.Fatalf("Capabilities failed: %v", err)
+	}
+	if caps.Family != "2.0" {
+		t.Errorf("Unexpected family %q", caps.Family)
+	}
+	if caps.Manufacturer != tpm2.TPMManufacturerIBM {
+		t.Errorf("Unexpected manufacturer %v", caps.Manufacturer)
+	}
+	if caps.FirmwareVersion == 0 {
+		t.Errorf("Expected a non-zero firmware version")
+	}
+
+	foundSHA256 := false
+	for _, alg := range caps.ActivePCRBanks {
+		if alg == tpm2.HashAlgorithmSHA256 {
+			foundSHA256 = true
+		}
+	}
+	if !foundSHA256 {
+		t.Errorf("Expected the SHA-256 PCR bank to be active (got %v)", caps.ActivePCRBanks)
+	}
+
+	if caps.NVSpace.DefinedIndices == 0 {
+		t.Errorf("Expected the lock NV indices to be counted")
+	}
+	if caps.NVSpace.PersistentObjects < 2 {
+		t.Errorf("Expected the provisioned EK and SRK to be counted (got %d)", caps.NVSpace.PersistentObjects)
+	}
+	if caps.NVSpace.MaxIndexSize == 0 {
+		t.Errorf("Expected a non-zero maximum NV index size")
+	}
+
+	if caps.Lockout.InLockout {
+		t.Errorf("The TPM should not be in lockout mode")
+	}
+	if !caps.Lockout.LockoutAuthSet {
+		t.Errorf("Expected the lockout hierarchy authorization value to be set")
+	}
+	if caps.Lockout.MaxAuthFail != 32 || caps.Lockout.LockoutInterval != 7200 || caps.Lockout.LockoutRecovery != 86400 {
+		t.Errorf("Unexpected DA parameters %+v", caps.Lockout)
+	}
+}
+
+func TestTPMConnectionFixedProperties(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	props, err := tpm.FixedProperties()
+	if err != nil {
+		t.Fatalf("FixedProperties failed: %v", err)
+	}
+	if tpm2.TPMManufacturer(props[tpm2.PropertyManufacturer]) != tpm2.TPMManufacturerIBM {
+		t.Errorf("Unexpected manufacturer %v", props[tpm2.PropertyManufacturer])
+	}
+	if _, ok := props[tpm2.PropertyLockoutCounter]; ok {
+		t.Errorf("Variable properties should not be returned")
+	}
+
+	// The returned map should be a copy of the cached properties
+	delete(props, tpm2.PropertyManufacturer)
+	props, err = tpm.FixedProperties()
+	if err != nil {
+		t.Fatalf("FixedProperties failed: %v", err)
+	}
+	if _, ok := props[tpm2.PropertyManufacturer]; !ok {
+		t.Errorf("Cached properties were modified")
+	}
+}
+
+func TestTPMConnectionEKCertificate(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	cert, err := tpm.EKCertificate()
+	if err != nil {
+		t.Fatalf("EKCertificate failed: %v", err)
+	}
+	if !bytes.Equal(cert.Raw, testEkCert) {
+		t.Errorf("Unexpected certificate")
+	}
+
+	attrs, err := tpm.EKCertificateDeviceAttributes()
+	if err != nil {
+		t.Fatalf("EKCertificateDeviceAttributes failed: %v", err)
+	}
+	if attrs.Manufacturer != tpm2.TPMManufacturerIBM {
+		t.Errorf("Unexpected manufacturer %v", attrs.Manufacturer)
+	}
+	if attrs.Model != "FakeTPM" {
+		t.Errorf("Unexpected model %q", attrs.Model)
+	}
+	if attrs.FirmwareVersion != binary.BigEndian.Uint32([]byte{0x00, 0x01, 0x00, 0x02}) {
+		t.Errorf("Unexpected firmware version %08x", attrs.FirmwareVersion)
+	}
+}
@@ -0,0 +1,158 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+)
+
+// errTPMConnectionAbandoned is returned from commandTimeoutTcti once a command has timed out, because a late response would
+// otherwise be returned for the next command.
+var errTPMConnectionAbandoned = errors.New("the TPM connection cannot be used after a command timed out")
+
+// TPMCommandTimeouts specifies how long to wait for the TPM to respond to each command sent on a TPMConnection, in addition to any
+// timeout applied by the kernel or the TPM device. Commands are divided in to 2 classes. Commands that generate keys, clear the
+// TPM, perform self tests or allocate or free NV memory can take several seconds on some discrete TPMs and are subject to the
+// Long timeout. All other commands, including NV writes, are subject to the Short timeout. A zero value means no timeout.
+//
+// These timeouts are applied in user space, and can only make a command fail earlier than it otherwise would. They can't extend
+// the timeouts applied by the kernel's TPM driver, which are fixed by the driver (or read from the TPM) and can't be configured
+// from user space. A command that exceeds a kernel timeout fails regardless of these values.
+type TPMCommandTimeouts struct {
+	Short time.Duration
+	Long  time.Duration
+}
+
+// isLongTPMCommand indicates whether the specified command is in the class of commands that are subject to
+// TPMCommandTimeouts.Long.
+func isLongTPMCommand(code tpm2.CommandCode) bool {
+	switch code {
+	case tpm2.CommandCreatePrimary, tpm2.CommandCreate, tpm2.CommandCreateLoaded,
+		tpm2.CommandClear, tpm2.CommandSelfTest,
+		tpm2.CommandNVDefineSpace, tpm2.CommandNVUndefineSpace, tpm2.CommandNVUndefineSpaceSpecial,
+		tpm2.CommandEvictControl:
+		return true
+	default:
+		return false
+	}
+}
+
+// commandTimeoutResult is the result of reading a response from the underlying TCTI.
+type commandTimeoutResult struct {
+	n   int
+	err error
+}
+
+// commandTimeoutTcti wraps another TCTI and fails commands that the TPM doesn't respond to within the timeout for the class of
+// the command. The underlying TCTI can't be interrupted, so the read continues in the background after a timeout and the
+// connection can't be used for any more commands.
+type commandTimeoutTcti struct {
+	tcti      io.ReadWriteCloser
+	timeouts  TPMCommandTimeouts
+	cmd       tpm2.CommandCode
+	pending   bool // A command has been written and its response hasn't been read yet
+	abandoned bool
+}
+
+func (t *commandTimeoutTcti) Write(data []byte) (int, error) {
+	if t.abandoned {
+		return 0, errTPMConnectionAbandoned
+	}
+	t.cmd = 0
+	if len(data) >= 10 {
+		t.cmd = tpm2.CommandCode(binary.BigEndian.Uint32(data[6:10]))
+	}
+	t.pending = true
+	return t.tcti.Write(data)
+}
+
+// timeout returns the timeout for the most recently written command.
+func (t *commandTimeoutTcti) timeout() time.Duration {
+	if isLongTPMCommand(t.cmd) {
+		return t.timeouts.Long
+	}
+	return t.timeouts.Short
+}
+
+func (t *commandTimeoutTcti) Read(data []byte) (int, error) {
+	if t.abandoned {
+		return 0, errTPMConnectionAbandoned
+	}
+
+	timeout := t.timeout()
+	if !t.pending || timeout == 0 {
+		t.pending = false
+		return t.tcti.Read(data)
+	}
+	t.pending = false
+
+	// Read in to a separate buffer so that a read that completes after the timeout doesn't write to the caller's buffer.
+	buf := make([]byte, len(data))
+	ch := make(chan commandTimeoutResult, 1)
+	go func() {
+		n, err := t.tcti.Read(buf)
+		ch <- commandTimeoutResult{n, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-ch:
+		copy(data, buf[:r.n])
+		return r.n, r.err
+	case <-timer.C:
+		t.abandoned = true
+		return 0, TPMCommandTimeoutError{Command: t.cmd, Timeout: timeout}
+	}
+}
+
+func (t *commandTimeoutTcti) Close() error {
+	return t.tcti.Close()
+}
+
+// SetCommandTimeouts configures how long to wait for the TPM to respond to each command sent on this connection. This can be
+// used to fail early when a slow discrete TPM stops responding, eg, during provisioning, rather than relying on the timeouts
+// applied by the kernel. It can't be used to give the TPM longer than the kernel allows - see TPMCommandTimeouts.
+//
+// If a command times out, it fails with a TPMCommandTimeoutError error and the connection can't be used for any more commands,
+// because the TPM may still respond to it later. Note that the command isn't cancelled - the kernel continues to wait for the TPM
+// to respond or for its own timeout to expire, and the device remains busy until then. The connection should be closed, but
+// opening a new connection to the same device may fail (eg, /dev/tpm0 can only be opened once) or block (eg, /dev/tpmrm0
+// serializes commands) until the kernel has finished with the timed out command.
+func (t *TPMConnection) SetCommandTimeouts(timeouts TPMCommandTimeouts) {
+	if t.timeoutTcti == nil {
+		return
+	}
+	t.timeoutTcti.timeouts = timeouts
+}
+
+// CommandTimeouts returns the command timeouts for this connection, set with SetCommandTimeouts.
+func (t *TPMConnection) CommandTimeouts() TPMCommandTimeouts {
+	if t.timeoutTcti == nil {
+		return TPMCommandTimeouts{}
+	}
+	return t.timeoutTcti.timeouts
+}
@@ -0,0 +1,113 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+// slowMockTcti is a mockTcti that takes the specified time to return each response.
+type slowMockTcti struct {
+	mockTcti
+	delay time.Duration
+}
+
+func (t *slowMockTcti) Read(data []byte) (int, error) {
+	time.Sleep(t.delay)
+	return t.mockTcti.Read(data)
+}
+
+func makeMockCommand(code tpm2.CommandCode) []byte {
+	cmd := make([]byte, 10)
+	binary.BigEndian.PutUint16(cmd[0:], 0x8001)
+	binary.BigEndian.PutUint32(cmd[2:], 10)
+	binary.BigEndian.PutUint32(cmd[6:], uint32(code))
+	return cmd
+}
+
+type cmdTimeoutSuite struct{}
+
+var _ = Suite(&cmdTimeoutSuite{})
+
+func (s *cmdTimeoutSuite) TestNoTimeout(c *C) {
+	mock := &slowMockTcti{mockTcti: mockTcti{responses: [][]byte{makeMockResponse(0)}}, delay: 10 * time.Millisecond}
+	tcti := NewCommandTimeoutTcti(mock, TPMCommandTimeouts{})
+
+	_, err := tcti.Write(makeMockCommand(tpm2.CommandNVWrite))
+	c.Assert(err, IsNil)
+
+	rsp := make([]byte, 4096)
+	n, err := tcti.Read(rsp)
+	c.Assert(err, IsNil)
+	c.Check(rsp[:n], DeepEquals, makeMockResponse(0))
+}
+
+func (s *cmdTimeoutSuite) TestShortTimeout(c *C) {
+	mock := &slowMockTcti{mockTcti: mockTcti{responses: [][]byte{makeMockResponse(0)}}, delay: 100 * time.Millisecond}
+	tcti := NewCommandTimeoutTcti(mock, TPMCommandTimeouts{Short: 10 * time.Millisecond, Long: time.Second})
+
+	_, err := tcti.Write(makeMockCommand(tpm2.CommandNVWrite))
+	c.Assert(err, IsNil)
+
+	rsp := make([]byte, 4096)
+	_, err = tcti.Read(rsp)
+	c.Check(err, Equals, TPMCommandTimeoutError{Command: tpm2.CommandNVWrite, Timeout: 10 * time.Millisecond})
+
+	// The connection can't be used after a timeout.
+	_, err = tcti.Write(makeMockCommand(tpm2.CommandNVWrite))
+	c.Check(err, ErrorMatches, "the TPM connection cannot be used after a command timed out")
+}
+
+func (s *cmdTimeoutSuite) TestLongCommand(c *C) {
+	mock := &slowMockTcti{mockTcti: mockTcti{responses: [][]byte{makeMockResponse(0)}}, delay: 50 * time.Millisecond}
+	tcti := NewCommandTimeoutTcti(mock, TPMCommandTimeouts{Short: 10 * time.Millisecond, Long: 5 * time.Second})
+
+	_, err := tcti.Write(makeMockCommand(tpm2.CommandCreatePrimary))
+	c.Assert(err, IsNil)
+
+	rsp := make([]byte, 4096)
+	n, err := tcti.Read(rsp)
+	c.Assert(err, IsNil)
+	c.Check(rsp[:n], DeepEquals, makeMockResponse(0))
+}
+
+type cmdTimeoutTPMSuite struct {
+	testutil.TPMSimulatorTestBase
+}
+
+var _ = Suite(&cmdTimeoutTPMSuite{})
+
+func (s *cmdTimeoutTPMSuite) TestSetCommandTimeouts(c *C) {
+	c.Check(s.TPM.CommandTimeouts(), Equals, TPMCommandTimeouts{})
+
+	timeouts := TPMCommandTimeouts{Short: 10 * time.Second, Long: time.Minute}
+	s.TPM.SetCommandTimeouts(timeouts)
+	c.Check(s.TPM.CommandTimeouts(), Equals, timeouts)
+
+	_, err := s.TPM.GetRandom(16)
+	c.Check(err, IsNil)
+}
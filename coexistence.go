@@ -0,0 +1,195 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/snapcore/secboot/internal/tcg"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	sysClassBlockPath = "/sys/class/block"
+	devPath           = "/dev"
+
+	// bitLockerSignature is the OEM ID at offset 3 of the boot sector of a BitLocker encrypted volume.
+	bitLockerSignature = []byte("-FVE-FS-")
+)
+
+// TPMCoexistenceReport describes state that belongs to other operating systems on the same platform, and how provisioning the TPM
+// and sealing keys with this package would affect them. It is returned from CheckTPMCoexistence so that installers can warn users
+// of dual-boot systems.
+type TPMCoexistenceReport struct {
+	// BitLockerVolumes lists the block devices that contain BitLocker encrypted volumes. These are likely to be protected with keys
+	// sealed to the TPM.
+	BitLockerVolumes []string
+
+	// ForeignPersistentObjects lists the handles of persistent objects in the TPM other than the standard endorsement key and
+	// storage root key.
+	ForeignPersistentObjects []tpm2.Handle
+
+	// ForeignNVIndices lists the handles of NV indices in the owner range that were not created by this package and that are not
+	// reserved for manufacturer provisioned certificates.
+	ForeignNVIndices []tpm2.Handle
+
+	// Impacts contains human readable descriptions of how provisioning the TPM and sealing keys with this package would affect
+	// the other operating systems.
+	Impacts []string
+}
+
+// Compatible indicates whether there is no evidence of another operating system using the TPM.
+func (r *TPMCoexistenceReport) Compatible() bool {
+	return len(r.BitLockerVolumes) == 0 && len(r.ForeignPersistentObjects) == 0 && len(r.ForeignNVIndices) == 0
+}
+
+// isOwnedNVIndex indicates whether the NV index at the specified handle is one that is created by this package or is reserved
+// by the TCG for manufacturer provisioned EK certificates and platform indices.
+func isOwnedNVIndex(handle tpm2.Handle) bool {
+	switch {
+	case handle == lockNVHandle || handle == lockNVHandle+1:
+		// Legacy lock index and its associated policy data index.
+		return true
+	case handle == pcrPolicyLockNVHandle:
+		return true
+	case handle >= pcrPolicyCounterHandleRangeStart && handle <= pcrPolicyCounterHandleRangeEnd:
+		// PCR policy counters created by SealKeyToTPMMultiple.
+		return true
+	case handle >= 0x01400000 && handle < 0x01800000:
+		// Platform and TCG reserved ranges.
+		return true
+	case handle >= 0x01c00000:
+		// TCG reserved range for EK certificates and other manufacturer data.
+		return true
+	default:
+		return false
+	}
+}
+
+// findBitLockerVolumes returns the paths of block devices that contain a BitLocker encrypted volume.
+func findBitLockerVolumes() ([]string, error) {
+	entries, err := filepath.Glob(filepath.Join(sysClassBlockPath, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var volumes []string
+	for _, entry := range entries {
+		if _, err := os.Stat(filepath.Join(entry, "partition")); err != nil {
+			continue
+		}
+		path := filepath.Join(devPath, filepath.Base(entry))
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		var hdr [11]byte
+		_, err = io.ReadFull(f, hdr[:])
+		f.Close()
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(hdr[3:], bitLockerSignature) {
+			volumes = append(volumes, path)
+		}
+	}
+	return volumes, nil
+}
+
+// CheckTPMCoexistence looks for evidence that another operating system, such as Windows with BitLocker, is using the TPM, and
+// reports how provisioning the TPM with TPMConnection.EnsureProvisioned and sealing keys with this package would affect it.
+//
+// Block devices are scanned for BitLocker encrypted volumes, which requires read access to them. Devices that cannot be opened are
+// ignored.
+func CheckTPMCoexistence(tpm *TPMConnection) (*TPMCoexistenceReport, error) {
+	session := tpm.currentHmacSession().IncludeAttrs(tpm2.AttrAudit)
+
+	report := &TPMCoexistenceReport{}
+
+	volumes, err := findBitLockerVolumes()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot scan block devices: %w", err)
+	}
+	report.BitLockerVolumes = volumes
+
+	persistent, err := tpm.GetCapabilityHandles(tpm2.HandleTypePersistent.BaseHandle(), tpm2.CapabilityMaxProperties, session)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain persistent handles: %w", err)
+	}
+	srkExists := false
+	for _, h := range persistent {
+		switch h {
+		case tcg.SRKHandle:
+			srkExists = true
+		case tcg.EKHandle:
+		default:
+			report.ForeignPersistentObjects = append(report.ForeignPersistentObjects, h)
+		}
+	}
+
+	indices, err := tpm.GetCapabilityHandles(tpm2.HandleTypeNVIndex.BaseHandle(), tpm2.CapabilityMaxProperties, session)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain NV index handles: %w", err)
+	}
+	for _, h := range indices {
+		if !isOwnedNVIndex(h) {
+			report.ForeignNVIndices = append(report.ForeignNVIndices, h)
+		}
+	}
+
+	if report.Compatible() {
+		return report, nil
+	}
+
+	report.Impacts = append(report.Impacts,
+		"provisioning with ProvisionModeClear clears the TPM, which makes any keys sealed by other operating systems permanently "+
+			"unrecoverable (BitLocker volumes will require their recovery key)",
+		"provisioning with ProvisionModeFull or ProvisionModeClear changes the lockout hierarchy authorization value and disables "+
+			"owner clear, which prevents other operating systems from managing the TPM")
+
+	if srkExists {
+		srk, err := tpm.CreateResourceContextFromTPM(tcg.SRKHandle, session)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot create context for SRK: %w", err)
+		}
+		ok, err := isObjectPrimaryKeyWithTemplate(tpm.TPMContext, tpm.OwnerHandleContext(), srk, tcg.SRKTemplate, tpm.currentHmacSession())
+		if err != nil {
+			return nil, xerrors.Errorf("cannot determine if SRK is a primary key with the expected template: %w", err)
+		}
+		if !ok {
+			report.Impacts = append(report.Impacts, fmt.Sprintf("the persistent object at %v does not have the standard storage "+
+				"root key template and will be replaced, which makes keys sealed to it by other operating systems unrecoverable",
+				tcg.SRKHandle))
+		}
+	}
+
+	if len(report.ForeignNVIndices) > 0 {
+		report.Impacts = append(report.Impacts, "PCR policy counter handles passed to SealKeyToTPM must not conflict with the "+
+			"NV indices used by other operating systems, and should be in the range 0x01880000 - 0x0188ffff")
+	}
+
+	return report, nil
+}
@@ -0,0 +1,87 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+
+	. "gopkg.in/check.v1"
+)
+
+type coexistenceSuite struct{}
+
+var _ = Suite(&coexistenceSuite{})
+
+func (s *coexistenceSuite) TestFindBitLockerVolumes(c *C) {
+	dir := c.MkDir()
+	sysClassBlock := filepath.Join(dir, "sys")
+	dev := filepath.Join(dir, "dev")
+	c.Assert(os.MkdirAll(dev, 0755), IsNil)
+
+	for _, d := range []struct {
+		name      string
+		partition bool
+		data      []byte
+	}{
+		{name: "sda", data: append([]byte{0xeb, 0x58, 0x90}, []byte("-FVE-FS-")...)},
+		{name: "sda1", partition: true, data: append([]byte{0xeb, 0x58, 0x90}, []byte("-FVE-FS-")...)},
+		{name: "sda2", partition: true, data: append([]byte{0xeb, 0x58, 0x90}, []byte("NTFS    ")...)},
+		{name: "sda3", partition: true, data: []byte{0x00}},
+	} {
+		c.Assert(os.MkdirAll(filepath.Join(sysClassBlock, d.name), 0755), IsNil)
+		if d.partition {
+			c.Assert(ioutil.WriteFile(filepath.Join(sysClassBlock, d.name, "partition"), []byte("1\n"), 0644), IsNil)
+		}
+		c.Assert(ioutil.WriteFile(filepath.Join(dev, d.name), d.data, 0644), IsNil)
+	}
+
+	restore := MockBlockDevicePaths(sysClassBlock, dev)
+	defer restore()
+
+	volumes, err := FindBitLockerVolumes()
+	c.Assert(err, IsNil)
+	c.Check(volumes, DeepEquals, []string{filepath.Join(dev, "sda1")})
+}
+
+func (s *coexistenceSuite) TestIsOwnedNVIndex(c *C) {
+	for _, t := range []struct {
+		handle tpm2.Handle
+		owned  bool
+	}{
+		{handle: 0x01801100, owned: true},
+		{handle: 0x01801101, owned: true},
+		{handle: 0x01801102, owned: true},
+		{handle: 0x01880000, owned: true},
+		{handle: 0x01880001, owned: true},
+		{handle: 0x0188ffff, owned: true},
+		{handle: 0x01890000, owned: false},
+		{handle: 0x0187ffff, owned: false},
+		{handle: 0x01800001, owned: false},
+		{handle: 0x01500000, owned: true},
+		{handle: 0x01c00002, owned: true},
+	} {
+		c.Check(IsOwnedNVIndex(t.handle), Equals, t.owned, Commentf("handle: %v", t.handle))
+	}
+}
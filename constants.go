@@ -24,7 +24,12 @@ import (
 )
 
 const (
-	lockNVHandle tpm2.Handle = 0x01801100 // Legacy global NV handle for locking access to sealed key objects
+	lockNVHandle          tpm2.Handle = 0x01801100 // Legacy global NV handle for locking access to sealed key objects
+	pcrPolicyLockNVHandle tpm2.Handle = 0x01801102 // Global NV handle for recording that PCR protection policies are locked
+
+	// The block of owner NV index handles recommended for PCR policy counters
+	pcrPolicyCounterHandleRangeStart tpm2.Handle = 0x01880000
+	pcrPolicyCounterHandleRangeEnd   tpm2.Handle = 0x0188ffff
 
 	// SHA-256 is mandatory to exist on every PC-Client TPM
 	// XXX: Maybe dynamically select algorithms based on what's available on the device?
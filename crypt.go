@@ -27,28 +27,52 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/snapcore/snapd/osutil"
 
-	"golang.org/x/sys/unix"
 	"golang.org/x/xerrors"
 )
 
-const userKeyring = -4
+const defaultRunDir = "/run"
 
 var (
-	runDir                = "/run"
+	runDir                = defaultRunDir
 	systemdCryptsetupPath = "/lib/systemd/systemd-cryptsetup"
 
 	defaultKeyringPrefix = "secboot"
 )
 
+// SetStateDir sets the directory in which this package keeps runtime state, which is /run by default. This state consists of the
+// volume inventory (see VolumeStatus), recovery markers (see ReadRecoveryMarkers), the PCR protection policy lock state (see
+// LockPCRProtectionPolicies), the EK verification cache used by SecureConnectToDefaultTPMLazy, the default location of provisioning
+// checkpoints (see TPMConnection.SetProvisioningCheckpointDir) and temporary FIFOs used to pass keys to systemd-cryptsetup. Setting
+// dir to an empty string restores the default.
+//
+// None of this state is required in order to unseal keys and activate volumes. If the directory isn't writable, eg, in an initramfs
+// with a read-only root filesystem and no tmpfs mounted on /run, the ActivateVolume functions pass keys to systemd-cryptsetup using
+// an anonymous memory-backed file instead of a FIFO, and the state isn't recorded.
+func SetStateDir(dir string) {
+	if dir == "" {
+		dir = defaultRunDir
+	}
+	runDir = dir
+}
+
+// isStateNotExist indicates whether err indicates that a file in the state directory doesn't exist, which includes the case where
+// the state directory itself doesn't exist or isn't a directory.
+func isStateNotExist(err error) bool {
+	return os.IsNotExist(err) || xerrors.Is(err, syscall.ENOTDIR)
+}
+
 func keyringPrefixOrDefault(prefix string) string {
 	if prefix == "" {
 		return defaultKeyringPrefix
@@ -75,13 +99,27 @@ func (k RecoveryKey) String() string {
 //
 // The formatted version of the recovery key is designed to be able to be inputted on a numeric keypad.
 func ParseRecoveryKey(s string) (out RecoveryKey, err error) {
+	return parseRecoveryKey([]byte(s))
+}
+
+// parseRecoveryKey is the implementation of ParseRecoveryKey. It operates on a byte slice so that recovery keys obtained from the
+// user can be parsed without being copied in to a string, which can't be wiped from memory.
+func parseRecoveryKey(s []byte) (out RecoveryKey, err error) {
 	for i := 0; i < 8; i++ {
 		if len(s) < 5 {
 			return RecoveryKey{}, errors.New("incorrectly formatted: insufficient characters")
 		}
-		x, err := strconv.ParseUint(s[0:5], 10, 16)
-		if err != nil {
-			return RecoveryKey{}, xerrors.Errorf("incorrectly formatted: %w", err)
+		var x uint32
+		for _, c := range s[0:5] {
+			if c < '0' || c > '9' {
+				return RecoveryKey{}, xerrors.Errorf("incorrectly formatted: %w",
+					&strconv.NumError{Func: "ParseUint", Num: string(s[0:5]), Err: strconv.ErrSyntax})
+			}
+			x = x*10 + uint32(c-'0')
+		}
+		if x > math.MaxUint16 {
+			return RecoveryKey{}, xerrors.Errorf("incorrectly formatted: %w",
+				&strconv.NumError{Func: "ParseUint", Num: string(s[0:5]), Err: strconv.ErrRange})
 		}
 		binary.LittleEndian.PutUint16(out[i*2:], uint16(x))
 
@@ -147,7 +185,7 @@ func mkFifo() (string, func(), error) {
 	}()
 
 	fifo := filepath.Join(dir, "fifo")
-	if err := unix.Mkfifo(fifo, 0600); err != nil {
+	if err := mkfifo(fifo); err != nil {
 		return "", nil, xerrors.Errorf("cannot create FIFO: %w", err)
 	}
 
@@ -155,27 +193,24 @@ func mkFifo() (string, func(), error) {
 	return fifo, cleanup, nil
 }
 
-func activate(volumeName, sourceDevicePath string, key []byte, options []string) error {
-	fifoPath, cleanupFifo, err := mkFifo()
-	if err != nil {
-		return xerrors.Errorf("cannot create FIFO for passing key to systemd-cryptsetup: %w", err)
-	}
-	defer cleanupFifo()
-
-	cmd := exec.Command(systemdCryptsetupPath, "attach", volumeName, sourceDevicePath, fifoPath, strings.Join(options, ","))
+// startSystemdCryptsetupAttach starts systemd-cryptsetup to activate the volume at sourceDevicePath using the key file at keyFilePath,
+// and forwards its output. The returned function waits for it to exit.
+func startSystemdCryptsetupAttach(volumeName, sourceDevicePath, keyFilePath string, options []string, extraFiles []*os.File) (*exec.Cmd, func() error, error) {
+	cmd := exec.Command(systemdCryptsetupPath, "attach", volumeName, sourceDevicePath, keyFilePath, strings.Join(options, ","))
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, "SYSTEMD_LOG_TARGET=console")
+	cmd.ExtraFiles = extraFiles
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return xerrors.Errorf("cannot create stdout pipe: %w", err)
+		return nil, nil, xerrors.Errorf("cannot create stdout pipe: %w", err)
 	}
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return xerrors.Errorf("cannot create stderr pipe: %w", err)
+		return nil, nil, xerrors.Errorf("cannot create stderr pipe: %w", err)
 	}
 
 	if err := cmd.Start(); err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	done := make(chan bool, 2)
@@ -194,59 +229,71 @@ func activate(volumeName, sourceDevicePath string, key []byte, options []string)
 		done <- true
 	}()
 
-	f, err := os.OpenFile(fifoPath, os.O_WRONLY, 0)
+	wait := func() error {
+		for i := 0; i < 2; i++ {
+			<-done
+		}
+		return wrapExecError(cmd, cmd.Wait())
+	}
+	return cmd, wait, nil
+}
+
+// activateWithMemfd activates a volume by passing the key to systemd-cryptsetup in an anonymous memory-backed file, which is
+// inherited by systemd-cryptsetup as file descriptor 3. This doesn't require a writable directory.
+func activateWithMemfd(volumeName, sourceDevicePath string, key []byte, options []string) error {
+	f, err := memfdCreate(filepath.Base(os.Args[0]) + "-key")
 	if err != nil {
-		// If we fail to open the write end, the read end will be blocked in open()
-		cmd.Process.Kill()
-		return xerrors.Errorf("cannot open FIFO for passing key to systemd-cryptsetup: %w", err)
+		return xerrors.Errorf("cannot create memfd for passing key to systemd-cryptsetup: %w", err)
 	}
+	defer func() {
+		// Discard the key before closing.
+		f.Truncate(0)
+		f.Close()
+	}()
 
 	if _, err := f.Write(key); err != nil {
-		f.Close()
-		// The read end is open and blocked inside read(). Closing our write end will result in the
-		// read end returning 0 bytes (EOF) and exitting cleanly.
-		cmd.Wait()
 		return xerrors.Errorf("cannot pass key to systemd-cryptsetup: %w", err)
 	}
 
-	f.Close()
-	for i := 0; i < 2; i++ {
-		<-done
+	_, wait, err := startSystemdCryptsetupAttach(volumeName, sourceDevicePath, "/proc/self/fd/3", options, []*os.File{f})
+	if err != nil {
+		return err
 	}
-
-	return wrapExecError(cmd, cmd.Wait())
+	return wait()
 }
 
-func askPassword(sourceDevicePath, msg string) (string, error) {
-	cmd := exec.Command(
-		"systemd-ask-password",
-		"--icon", "drive-harddisk",
-		"--id", filepath.Base(os.Args[0])+":"+sourceDevicePath,
-		msg)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stdin = os.Stdin
-	if err := cmd.Run(); err != nil {
-		return "", wrapExecError(cmd, err)
+func activate(volumeName, sourceDevicePath string, key []byte, options []string) error {
+	fifoPath, cleanupFifo, err := mkFifo()
+	if err != nil {
+		// The state directory isn't usable, eg, because it is on a read-only filesystem. Pass the key using an anonymous
+		// memory-backed file instead.
+		return activateWithMemfd(volumeName, sourceDevicePath, key, options)
+	}
+	defer cleanupFifo()
+
+	cmd, wait, err := startSystemdCryptsetupAttach(volumeName, sourceDevicePath, fifoPath, options, nil)
+	if err != nil {
+		return err
 	}
-	result, err := out.ReadString('\n')
+
+	f, err := os.OpenFile(fifoPath, os.O_WRONLY, 0)
 	if err != nil {
-		return "", xerrors.Errorf("cannot read result from systemd-ask-password: %w", err)
+		// If we fail to open the write end, the read end will be blocked in open()
+		cmd.Process.Kill()
+		wait()
+		return xerrors.Errorf("cannot open FIFO for passing key to systemd-cryptsetup: %w", err)
 	}
-	return strings.TrimRight(result, "\n"), nil
-}
 
-func getPassword(sourceDevicePath, description string, reader io.Reader) (string, error) {
-	if reader != nil {
-		scanner := bufio.NewScanner(reader)
-		switch {
-		case scanner.Scan():
-			return scanner.Text(), nil
-		case scanner.Err() != nil:
-			return "", xerrors.Errorf("cannot obtain %s from scanner: %w", description, scanner.Err())
-		}
+	if _, err := f.Write(key); err != nil {
+		f.Close()
+		// The read end is open and blocked inside read(). Closing our write end will result in the
+		// read end returning 0 bytes (EOF) and exitting cleanly.
+		wait()
+		return xerrors.Errorf("cannot pass key to systemd-cryptsetup: %w", err)
 	}
-	return askPassword(sourceDevicePath, "Please enter the "+description+" for disk "+sourceDevicePath+":")
+
+	f.Close()
+	return wait()
 }
 
 // RecoveryKeyUsageReason indicates the reason that a volume had to be activated with the fallback recovery key instead of the TPM
@@ -281,7 +328,11 @@ const (
 	RecoveryKeyUsageReasonPassphraseFail
 )
 
-func activateWithRecoveryKey(volumeName, sourceDevicePath string, keyReader io.Reader, tries int, reason RecoveryKeyUsageReason, activateOptions []string, keyringPrefix string) error {
+func activateWithRecoveryKey(volumeName, sourceDevicePath, cryptDevicePath string, auth *authRequest, tries int, reason RecoveryKeyUsageReason, activateOptions []string, keyringPrefix string, readOnly bool, metrics *OperationMetrics) (err error) {
+	attempts := 0
+	phases := new(metricsPhases)
+	defer observeOperationPhasesTo(metrics, MetricsOperationActivateWithRecoveryKey, time.Now(), &err, &attempts, phases)
+
 	if tries == 0 {
 		return errors.New("no recovery key tries permitted")
 	}
@@ -289,23 +340,26 @@ func activateWithRecoveryKey(volumeName, sourceDevicePath string, keyReader io.R
 	var lastErr error
 
 	for ; tries > 0; tries-- {
+		attempts++
 		lastErr = nil
 
-		r := keyReader
-		keyReader = nil
-
-		passphrase, err := getPassword(sourceDevicePath, "recovery key", r)
+		passphrase, err := auth.get(AuthTypeRecoveryKey, sourceDevicePath)
 		if err != nil {
 			return xerrors.Errorf("cannot obtain recovery key: %w", err)
 		}
 
-		key, err := ParseRecoveryKey(passphrase)
+		key, err := parseRecoveryKey(passphrase)
+		wipeBytes(passphrase)
 		if err != nil {
 			lastErr = xerrors.Errorf("cannot decode recovery key: %w", err)
 			continue
 		}
 
-		if err := activate(volumeName, sourceDevicePath, key[:], activateOptions); err != nil {
+		start := time.Now()
+		err = activate(volumeName, cryptDevicePath, key[:], activateOptions)
+		phases.observe(MetricsPhaseCryptsetup, start)
+		if err != nil {
+			wipeBytes(key[:])
 			err = xerrors.Errorf("cannot activate volume: %w", err)
 			var e *exec.ExitError
 			if !xerrors.As(err, &e) {
@@ -327,36 +381,73 @@ func activateWithRecoveryKey(volumeName, sourceDevicePath string, keyReader io.R
 		// possessor-read.
 		//
 		// Ignore errors - we've activated the volume and so we shouldn't return an error at this point unless we close the volume again.
-		unix.AddKey("user", fmt.Sprintf("%s:%s?type=recovery&reason=%d", keyringPrefixOrDefault(keyringPrefix), sourceDevicePath, reason), key[:], userKeyring)
+		//
+		// This is skipped for read-only activations, which shouldn't leave anything behind for the boot process to act on.
+		if !readOnly {
+			addUserKey(fmt.Sprintf("%s:%s?type=recovery&reason=%d", keyringPrefixOrDefault(keyringPrefix), sourceDevicePath, reason), key[:])
+		}
+		wipeBytes(key[:])
 		break
 	}
 
 	return lastErr
 }
 
-func unsealKeyFromTPM(tpm *TPMConnection, k *SealedKeyObject, pin string) ([]byte, []byte, error) {
-	sealedKey, authPrivateKey, err := k.UnsealFromTPM(tpm, pin)
-	if err == ErrTPMProvisioning {
+func unsealKeyFromTPM(tpm *TPMConnection, k *SealedKeyObject, pin []byte, readOnly bool, phases *metricsPhases) (*UnsealResult, error) {
+	result, err := k.unsealFromTPMWithResult(tpm, pin, phases)
+	if err == ErrTPMProvisioning && !readOnly {
 		// ErrTPMProvisioning in this context might indicate that there isn't a valid persistent SRK. Have a go at creating one now and then
 		// retrying the unseal operation - if the previous SRK was evicted, the TPM owner hasn't changed and the storage hierarchy still
 		// has a null authorization value, then this will allow us to unseal the key without requiring any type of manual recovery. If the
 		// storage hierarchy has a non-null authorization value, ProvionTPM will fail. If the TPM owner has changed, ProvisionTPM might
-		// succeed, but UnsealFromTPM will fail with InvalidKeyFileError when retried.
+		// succeed, but UnsealFromTPM will fail with InvalidKeyFileError when retried. This isn't attempted for read-only activations,
+		// which must not modify the TPM.
 		if pErr := tpm.EnsureProvisioned(ProvisionModeWithoutLockout, nil); pErr == nil || pErr == ErrTPMProvisioningRequiresLockout {
-			sealedKey, authPrivateKey, err = k.UnsealFromTPM(tpm, pin)
+			result, err = k.unsealFromTPMWithResult(tpm, pin, phases)
 		}
 	}
-	return sealedKey, authPrivateKey, err
+	return result, err
 }
 
 var requiresPinErr = errors.New("no PIN tries permitted when a PIN is required")
 
-func activateWithTPMKey(tpm *TPMConnection, volumeName, sourceDevicePath, keyPath string, passphraseReader io.Reader, passphraseTries int, activateOptions []string, keyringPrefix string) error {
-	k, err := ReadSealedKeyObject(keyPath)
+func activateWithTPMKey(tpm *TPMConnection, volumeName, sourceDevicePath, cryptDevicePath string, keyLocation KeyLocation, volumeKeyLabel string, diskIdentityCheck DiskIdentityCheckMode, verityRootHash []byte, auth *authRequest, passphraseTries int, activateOptions []string, keyringPrefix string, readOnly bool, metrics *OperationMetrics) (err error) {
+	attempts := 0
+	phases := new(metricsPhases)
+	defer observeOperationPhasesTo(metrics, MetricsOperationActivate, time.Now(), &err, &attempts, phases)
+
+	k, err := ReadSealedKeyObjectFromLocation(keyLocation)
 	if err != nil {
 		return xerrors.Errorf("cannot read sealed key object: %w", err)
 	}
 
+	// Make sure that the key data file was sealed for this volume before using it.
+	if diskIdentityCheck != DiskIdentityCheckDisabled {
+		err := k.CheckDiskIdentity(sourceDevicePath)
+		switch {
+		case isDiskIdentityMismatchError(err) && diskIdentityCheck == DiskIdentityCheckWarn:
+			var keyIDs []KeyID
+			if id, ok := k.KeyID(); ok {
+				keyIDs = append(keyIDs, id)
+			}
+			tpm.notify(&SecurityEvent{Type: SecurityEventDiskIdentityMismatch, KeyIDs: keyIDs})
+		case err != nil:
+			return xerrors.Errorf("cannot verify disk identity: %w", err)
+		}
+	}
+
+	// Make sure that the running root filesystem is one that the key data file can be used with.
+	if err := k.CheckDmVerityRootHash(verityRootHash); err != nil {
+		return xerrors.Errorf("cannot verify dm-verity root hash: %w", err)
+	}
+
+	switch {
+	case k.DerivesVolumeKeys() && volumeKeyLabel == "":
+		return errors.New("a volume key label is required to activate with a sealed master secret")
+	case !k.DerivesVolumeKeys() && volumeKeyLabel != "":
+		return errors.New("a volume key label can only be used with a sealed master secret")
+	}
+
 	switch {
 	case passphraseTries == 0 && k.AuthMode2F() == AuthModePIN:
 		return requiresPinErr
@@ -364,21 +455,20 @@ func activateWithTPMKey(tpm *TPMConnection, volumeName, sourceDevicePath, keyPat
 		passphraseTries = 1
 	}
 
-	var sealedKey []byte
-	var authPrivateKey TPMPolicyAuthKey
+	var result *UnsealResult
 
 	for ; passphraseTries > 0; passphraseTries-- {
-		var pin string
+		attempts++
+		var pin []byte
 		if k.AuthMode2F() == AuthModePIN {
-			r := passphraseReader
-			passphraseReader = nil
-			pin, err = getPassword(sourceDevicePath, "PIN", r)
+			pin, err = auth.get(AuthTypePIN, sourceDevicePath)
 			if err != nil {
 				return xerrors.Errorf("cannot obtain PIN: %w", err)
 			}
 		}
 
-		sealedKey, authPrivateKey, err = unsealKeyFromTPM(tpm, k, pin)
+		result, err = unsealKeyFromTPM(tpm, k, pin, readOnly, phases)
+		wipeBytes(pin)
 		if err != nil && (err != ErrPINFail || k.AuthMode2F() != AuthModePIN) {
 			break
 		}
@@ -388,7 +478,23 @@ func activateWithTPMKey(tpm *TPMConnection, volumeName, sourceDevicePath, keyPat
 		return xerrors.Errorf("cannot unseal key: %w", err)
 	}
 
-	if err := activate(volumeName, sourceDevicePath, sealedKey, activateOptions); err != nil {
+	// Make sure that the unsealed key material is wiped from memory once it has been passed on.
+	defer result.Close()
+
+	volumeKeyBuf := result.Key
+	if k.DerivesVolumeKeys() {
+		volumeKey, err := k.data.volumeKeyDerivation.deriveKey(result.Key.Bytes(), volumeKeyLabel)
+		if err != nil {
+			return xerrors.Errorf("cannot derive volume key: %w", err)
+		}
+		volumeKeyBuf = NewSecretBuffer(volumeKey)
+		defer volumeKeyBuf.Close()
+	}
+
+	start := time.Now()
+	err = activate(volumeName, cryptDevicePath, volumeKeyBuf.Bytes(), activateOptions)
+	phases.observe(MetricsPhaseCryptsetup, start)
+	if err != nil {
 		return xerrors.Errorf("cannot activate volume: %w", err)
 	}
 
@@ -404,12 +510,21 @@ func activateWithTPMKey(tpm *TPMConnection, volumeName, sourceDevicePath, keyPat
 	// possessor-read.
 	//
 	// Ignore errors - we've activated the volume and so we shouldn't return an error at this point unless we close the volume again.
-	unix.AddKey("user", fmt.Sprintf("%s:%s?type=tpm", keyringPrefixOrDefault(keyringPrefix), sourceDevicePath), authPrivateKey, userKeyring)
+	//
+	// Read-only activations skip this, so that a maintenance environment cannot subsequently use it to update PCR policies.
+	//
+	// Note that any copy of the lockout hierarchy authorization value in the sealed key object is deliberately not added to the
+	// user keyring, as that would expose it to every process running as root for the lifetime of the boot. It can be recovered
+	// with SealedKeyObject.LockoutAuth when it is needed.
+	if readOnly {
+		return nil
+	}
+	addUserKey(fmt.Sprintf("%s:%s?type=tpm", keyringPrefixOrDefault(keyringPrefix), sourceDevicePath), result.AuthKey.Bytes())
 
 	return nil
 }
 
-func makeActivateOptions(in []string) ([]string, error) {
+func makeActivateOptions(in []string, readOnly bool) ([]string, error) {
 	var out []string
 	for _, o := range in {
 		if strings.HasPrefix(o, "tries=") {
@@ -417,6 +532,9 @@ func makeActivateOptions(in []string) ([]string, error) {
 		}
 		out = append(out, o)
 	}
+	if readOnly {
+		out = append(out, "read-only")
+	}
 	return append(out, "tries=1"), nil
 }
 
@@ -450,28 +568,184 @@ type ActivateVolumeOptions struct {
 	// options to systemd-cryptsetup.
 	ActivateOptions []string
 
+	// AuthRequestor is used to request PINs and recovery keys
+	// from the user. If this is not set, systemd-ask-password
+	// is used (see NewSystemdAuthRequestor).
+	AuthRequestor AuthRequestor
+
+	// AuthRequestTimeout specifies how long to wait for the user
+	// to respond to each request made via AuthRequestor. Zero
+	// means no timeout.
+	AuthRequestTimeout time.Duration
+
+	// ProtectorOrder specifies the order in which protectors are
+	// attempted by ActivateVolumeWithTPMSealedKey. Supported
+	// protectors are VolumeProtectorTPM and
+	// VolumeProtectorRecoveryKey, and a protector is disabled by
+	// omitting it. If this is nil, the TPM sealed key is attempted
+	// first with the recovery key as a fallback.
+	ProtectorOrder []VolumeProtector
+
 	// KeyringPrefix is the prefix used for the description of any
 	// kernel keys created during activation.
 	KeyringPrefix string
+
+	// VolumeKeyLabel is the label used to derive the key for the
+	// volume when the TPM sealed key object contains a master
+	// secret (see VolumeKeyDerivationParams). It must be set
+	// when activating with a sealed master secret, and must be
+	// empty otherwise.
+	// It is ignored by ActivateWithRecoveryKey.
+	VolumeKeyLabel string
+
+	// DiskIdentityCheck specifies how to respond if the TPM
+	// sealed key object records a disk identity (see
+	// KeyCreationParams.DiskIdentity) that the volume doesn't
+	// match. By default, activation with the TPM sealed key
+	// fails.
+	// It is ignored by ActivateWithRecoveryKey.
+	DiskIdentityCheck DiskIdentityCheckMode
+
+	// Integrity specifies the parameters of a standalone
+	// dm-integrity device beneath the encrypted volume, which is
+	// opened before the encrypted volume is activated. If this
+	// is not set, ActivateVolumeWithTPMSealedKey uses the
+	// parameters recorded in the TPM sealed key object, if
+	// there are any.
+	Integrity *IntegrityParams
+
+	// DmVerityRootHash is the dm-verity root hash of the running
+	// root filesystem, which is checked against the root hashes
+	// recorded in the TPM sealed key object, if there are any
+	// (see KeyCreationParams.DmVerityRootHashes). If this is not
+	// set, the root hash is read from the "roothash=" kernel
+	// command line parameter.
+	// It is ignored by ActivateWithRecoveryKey.
+	DmVerityRootHash []byte
+
+	// PlainCrypt specifies the parameters of a plain dm-crypt
+	// volume. The parameters recorded in the TPM sealed key
+	// object are not used, because they aren't integrity
+	// protected. Plain dm-crypt volumes cannot be activated with
+	// a recovery key, so it must not be set for
+	// ActivateWithRecoveryKey.
+	PlainCrypt *PlainCryptParams
+
+	// ReadOnly specifies that the volume should be mapped
+	// read-only, for recovery and maintenance environments that
+	// need to inspect data without changing the boot-time
+	// security state. Any standalone integrity device specified
+	// by Integrity is also opened read-only. In this mode, the
+	// TPM is not modified
+	// (a missing SRK is not recreated) and no activation data
+	// is added to the kernel keyring, so GetActivationDataFromKernel
+	// will not find anything for the volume.
+	ReadOnly bool
 }
 
-// ActivateVolumeWithTPMSealedKey attempts to activate the LUKS encrypted volume at sourceDevicePath and create a mapping with the
-// name volumeName, using the TPM sealed key object at the specified keyPath. This makes use of systemd-cryptsetup.
+// errProtectorDisabled is the error associated with a protector that was omitted from ActivateVolumeOptions.ProtectorOrder.
+var errProtectorDisabled = errors.New("protector is disabled")
+
+// protectorOrder returns the order in which protectors should be attempted by ActivateVolumeWithTPMSealedKey.
+func (o *ActivateVolumeOptions) protectorOrder() ([]VolumeProtector, error) {
+	if o.ProtectorOrder == nil {
+		return []VolumeProtector{VolumeProtectorTPM, VolumeProtectorRecoveryKey}, nil
+	}
+	if len(o.ProtectorOrder) == 0 {
+		return nil, errors.New("invalid ProtectorOrder: no protectors are enabled")
+	}
+
+	seen := make(map[VolumeProtector]bool)
+	for _, p := range o.ProtectorOrder {
+		switch p {
+		case VolumeProtectorTPM, VolumeProtectorRecoveryKey:
+		default:
+			return nil, fmt.Errorf("invalid ProtectorOrder: unsupported protector %q", p)
+		}
+		if seen[p] {
+			return nil, fmt.Errorf("invalid ProtectorOrder: duplicate protector %q", p)
+		}
+		seen[p] = true
+	}
+	return o.ProtectorOrder, nil
+}
+
+// recoveryKeyUsageReasonForTPMError returns the reason for using the recovery key after activation with a TPM sealed key failed
+// with the supplied error.
+func recoveryKeyUsageReasonForTPMError(err error) RecoveryKeyUsageReason {
+	switch {
+	case xerrors.Is(err, ErrTPMLockout):
+		return RecoveryKeyUsageReasonTPMLockout
+	case xerrors.Is(err, ErrTPMProvisioning):
+		return RecoveryKeyUsageReasonTPMProvisioningError
+	case isInvalidKeyFileError(err):
+		return RecoveryKeyUsageReasonInvalidKeyFile
+	case isDiskIdentityMismatchError(err):
+		return RecoveryKeyUsageReasonInvalidKeyFile
+	case isKeyDataUnsupportedError(err):
+		return RecoveryKeyUsageReasonInvalidKeyFile
+	case xerrors.Is(err, ErrDmVerityRootHashMismatch):
+		return RecoveryKeyUsageReasonInvalidKeyFile
+	case xerrors.Is(err, requiresPinErr):
+		return RecoveryKeyUsageReasonPassphraseFail
+	case xerrors.Is(err, ErrPINFail):
+		return RecoveryKeyUsageReasonPassphraseFail
+	case isExecError(err, systemdCryptsetupPath):
+		// systemd-cryptsetup only provides 2 exit codes - success or fail - so we don't know the reason it failed yet. If activation
+		// with the recovery key is successful, then it's safe to assume that it failed because the key unsealed from the TPM is incorrect.
+		return RecoveryKeyUsageReasonInvalidKeyFile
+	}
+	return RecoveryKeyUsageReasonUnexpectedError
+}
+
+// ActivateVolumeWithTPMSealedKey attempts to activate the LUKS or plain dm-crypt encrypted volume at sourceDevicePath and create a
+// mapping with the name volumeName, using the TPM sealed key object at the specified keyPath. This makes use of systemd-cryptsetup.
 //
-// If the TPM sealed key object has a user passphrase/PIN defined, then this function will use systemd-ask-password to request it. If passphraseReader is not
-// nil, then an attempt to read the user passphrase/PIN from this will be made instead by reading all characters until the first newline. The PassphraseTries
-// field of options defines how many attempts should be made to obtain the correct passphrase before failing.
+// If the TPM sealed key object has a user passphrase/PIN defined, then this function will use the AuthRequestor specified by the
+// AuthRequestor field of options to request it, or systemd-ask-password if that isn't set. If passphraseReader is not nil, then an
+// attempt to read the user passphrase/PIN from this will be made first by reading all characters until the first newline. The
+// PassphraseTries field of options defines how many attempts should be made to obtain the correct passphrase before failing, and the
+// AuthRequestTimeout field of options defines how long each request waits for the user to respond.
 //
 // The ActivateOptions field of options can be used to specify additional options to pass to systemd-cryptsetup.
 //
+// If the TPM sealed key object contains a master secret, the key for the volume is derived from it using the label specified by
+// the VolumeKeyLabel field of options, which must be the same label that was passed to DeriveVolumeKey when the volume was
+// created.
+//
+// If the TPM sealed key object records the identity of the disk and partitions that it was sealed for, this function verifies that
+// sourceDevicePath is one of those partitions before unsealing the key. If it isn't, activation with the TPM sealed key fails with
+// a *DiskIdentityMismatchError error, unless the DiskIdentityCheck field of options specifies otherwise.
+//
+// If the TPM sealed key object records the parameters of a standalone dm-integrity device (see KeyCreationParams.Integrity), or
+// they are supplied via the Integrity field of options, the integrity device is opened with a mapping named volumeName with a
+// "-integrity" suffix, and the encrypted volume is activated on top of it. The integrity device is closed again if activation fails.
+//
+// If the ReadOnly field of options is set, the volume is mapped read-only and this function avoids changing any boot-time
+// security state: the TPM is not modified and no activation data is added to the kernel keyring.
+//
+// If the parameters of a plain dm-crypt volume are supplied via the PlainCrypt field of options, the volume is activated as a plain
+// dm-crypt mapping using the unsealed key as the volume key, rather than as a LUKS volume. The parameters recorded in the TPM sealed
+// key object (see KeyCreationParams.PlainCrypt) are never used for this, because anyone who can modify the key data file could use
+// them to map a LUKS volume as a plain dm-crypt volume with a cipher of their choosing. Plain dm-crypt volumes have no recovery key, so there is no fallback if activation with
+// the TPM sealed key fails.
+//
 // If activation with the TPM sealed key object fails, this function will attempt to activate it with the fallback recovery key
-// instead. The fallback recovery key will be requested using systemd-ask-password. The RecoveryKeyTries field of options specifies
+// instead. The fallback recovery key will be requested using the same AuthRequestor. The RecoveryKeyTries field of options specifies
 // how many attempts should be made to activate the volume with the recovery key before failing. If this is set to 0, then no attempts
 // will be made to activate the encrypted volume with the fallback recovery key. If activation with the recovery key is successful,
 // calling GetActivationDataFromKernel will return a *RecoveryActivationData containing the recovery key and the reason that the
-// recovery key was requested.
+// recovery key was requested. A *RecoveryMarker describing the failure is also written to /run, which can be retrieved after
+// the system has booted with ReadRecoveryMarkers and removed with ClearRecoveryMarker. Neither of these are created if the ReadOnly
+// field of options is set.
 //
-// If either the PassphraseTries or RecoveryKeyTries fields of options are less than zero, an error will be returned. If the ActivateOptions
+// The ProtectorOrder field of options can be used to change the order in which the TPM sealed key and the recovery key are
+// attempted, or to disable one of them. If the recovery key is attempted before the TPM sealed key, it is treated as if it had been
+// requested with ActivateVolumeWithRecoveryKey, and no recovery marker is written if it is successful. If a protector is disabled,
+// the corresponding field of a returned *ActivateWithTPMSealedKeyError error will indicate this.
+//
+// If either the PassphraseTries or RecoveryKeyTries fields of options are less than zero, or the ProtectorOrder field of options
+// contains an unsupported or duplicate protector or is empty but not nil, an error will be returned. If the ActivateOptions
 // field of options contains the "tries=" option, then an error will be returned. This option cannot be used with this function.
 //
 // If activation with the TPM sealed key fails, a *ActivateWithTPMSealedKeyError error will be returned, even if the subsequent
@@ -483,71 +757,223 @@ type ActivateVolumeOptions struct {
 // GetActivationDataFromKernel will return a TPMPolicyAuthKey containing the private part of the key used for authorizing PCR policy
 // updates with UpdateKeyPCRProtectionPolicy.
 //
-// If the volume is successfully activated, either with the TPM sealed key or the fallback recovery key, this function returns true.
-// If it is not successfully activated, then this function returns false.
+// If the volume is successfully activated, either with the TPM sealed key or the fallback recovery key, it is recorded in the volume
+// inventory (see VolumeStatus) and this function returns true. If it is not successfully activated, then this function returns false.
 func ActivateVolumeWithTPMSealedKey(tpm *TPMConnection, volumeName, sourceDevicePath, keyPath string, passphraseReader io.Reader, options *ActivateVolumeOptions) (bool, error) {
+	return ActivateVolumeWithTPMSealedKeyAtLocation(tpm, volumeName, sourceDevicePath, FileKeyLocation(keyPath), passphraseReader, options)
+}
+
+// ActivateVolumeWithTPMSealedKeyAtLocation behaves the same as ActivateVolumeWithTPMSealedKey, but uses the TPM sealed key object
+// stored at the specified location. The value returned from keyLocation.String() is recorded as the key path in the volume
+// inventory and in recovery markers.
+func ActivateVolumeWithTPMSealedKeyAtLocation(tpm *TPMConnection, volumeName, sourceDevicePath string, keyLocation KeyLocation, passphraseReader io.Reader, options *ActivateVolumeOptions) (bool, error) {
+	result, err := ActivateVolumeWithTPMSealedKeyAtLocationWithResult(tpm, volumeName, sourceDevicePath, keyLocation, passphraseReader, options)
+	return result.Activated(), err
+}
+
+// ActivationResult describes the outcome of a call to ActivateVolumeWithTPMSealedKeyAtLocationWithResult or
+// ActivateVolumeWithRecoveryKeyWithResult, so that callers can log which protector unlocked a volume and adapt their policies to
+// the number of attempts that were needed.
+type ActivationResult struct {
+	// Volume is the volume inventory entry for the activated volume, which records the protector and keyslot that unlocked it
+	// and the TPM sealed key that was used. It is nil if the volume was not activated.
+	Volume *ActivatedVolume
+
+	// Protectors describes each protector that was attempted, in the order in which they were attempted. The Operation field
+	// of each entry is MetricsOperationActivate for the TPM sealed key and MetricsOperationActivateWithRecoveryKey for the
+	// recovery key, and the Attempts field is the number of PINs or recovery keys that were tried.
+	Protectors []OperationMetrics
+
+	Duration time.Duration // The total time taken
+}
+
+// Activated indicates whether the volume was activated.
+func (r *ActivationResult) Activated() bool {
+	return r.Volume != nil
+}
+
+// ActivateVolumeWithTPMSealedKeyAtLocationWithResult behaves the same as ActivateVolumeWithTPMSealedKeyAtLocation, but returns a
+// *ActivationResult describing which protector succeeded, how many attempts were made with each protector and how long they
+// took, rather than just whether the volume was activated. A result is returned even if an error is also returned.
+func ActivateVolumeWithTPMSealedKeyAtLocationWithResult(tpm *TPMConnection, volumeName, sourceDevicePath string, keyLocation KeyLocation, passphraseReader io.Reader, options *ActivateVolumeOptions) (*ActivationResult, error) {
+	result := new(ActivationResult)
+	defer func(start time.Time) {
+		result.Duration = time.Since(start)
+	}(time.Now())
+
 	if options.PassphraseTries < 0 {
-		return false, errors.New("invalid PassphraseTries")
+		return result, errors.New("invalid PassphraseTries")
 	}
 	if options.RecoveryKeyTries < 0 {
-		return false, errors.New("invalid RecoveryKeyTries")
+		return result, errors.New("invalid RecoveryKeyTries")
 	}
 
-	activateOptions, err := makeActivateOptions(options.ActivateOptions)
+	order, err := options.protectorOrder()
 	if err != nil {
-		return false, err
+		return result, err
 	}
 
-	if err := activateWithTPMKey(tpm, volumeName, sourceDevicePath, keyPath, passphraseReader, options.PassphraseTries, activateOptions, options.KeyringPrefix); err != nil {
-		reason := RecoveryKeyUsageReasonUnexpectedError
-		switch {
-		case xerrors.Is(err, ErrTPMLockout):
-			reason = RecoveryKeyUsageReasonTPMLockout
-		case xerrors.Is(err, ErrTPMProvisioning):
-			reason = RecoveryKeyUsageReasonTPMProvisioningError
-		case isInvalidKeyFileError(err):
-			reason = RecoveryKeyUsageReasonInvalidKeyFile
-		case xerrors.Is(err, requiresPinErr):
-			reason = RecoveryKeyUsageReasonPassphraseFail
-		case xerrors.Is(err, ErrPINFail):
-			reason = RecoveryKeyUsageReasonPassphraseFail
-		case isExecError(err, systemdCryptsetupPath):
-			// systemd-cryptsetup only provides 2 exit codes - success or fail - so we don't know the reason it failed yet. If activation
-			// with the recovery key is successful, then it's safe to assume that it failed because the key unsealed from the TPM is incorrect.
-			reason = RecoveryKeyUsageReasonInvalidKeyFile
+	activateOptions, err := makeActivateOptions(options.ActivateOptions, options.ReadOnly)
+	if err != nil {
+		return result, err
+	}
+
+	integrity := options.Integrity
+	plainCrypt := options.PlainCrypt
+	keyPath := keyLocation.String()
+	// Errors are ignored here - they will be reported when attempting to activate with the TPM sealed key.
+	k, err := ReadSealedKeyObjectFromLocation(keyLocation)
+	if err == nil {
+		if integrity == nil {
+			integrity = k.Integrity()
+		}
+	}
+	if plainCrypt != nil {
+		if err := plainCrypt.check(); err != nil {
+			return result, xerrors.Errorf("invalid plain dm-crypt parameters: %w", err)
 		}
-		rErr := activateWithRecoveryKey(volumeName, sourceDevicePath, nil, options.RecoveryKeyTries, reason, activateOptions, options.KeyringPrefix)
-		return rErr == nil, &ActivateWithTPMSealedKeyError{err, rErr}
+		activateOptions = append(plainCrypt.activateOptions(), activateOptions...)
 	}
+	cryptDevicePath, closeIntegrity, err := openIntegrityDeviceForVolume(volumeName, sourceDevicePath, integrity, options.ReadOnly)
+	if err != nil {
+		return result, err
+	}
+
+	var tpmErr error = errProtectorDisabled
+	var rErr error = errProtectorDisabled
+	for _, protector := range order {
+		switch protector {
+		case VolumeProtectorTPM:
+			var metrics OperationMetrics
+			tpmErr = activateWithTPMKey(tpm, volumeName, sourceDevicePath, cryptDevicePath, keyLocation, options.VolumeKeyLabel, options.DiskIdentityCheck, options.DmVerityRootHash, newAuthRequest(passphraseReader, options), options.PassphraseTries, activateOptions, options.KeyringPrefix, options.ReadOnly, &metrics)
+			result.Protectors = append(result.Protectors, metrics)
+			if tpmErr != nil {
+				continue
+			}
+
+			volume := newActivatedVolume(volumeName, sourceDevicePath, VolumeProtectorTPM, keyPath, k)
+			if plainCrypt == nil {
+				volume.Keyslot = 0
+			}
+			volume.ReadOnly = options.ReadOnly
+			// Ignore errors - the volume has been activated.
+			recordActivatedVolume(volume)
+			result.Volume = volume
+			return result, nil
+		case VolumeProtectorRecoveryKey:
+			if plainCrypt != nil {
+				// Plain dm-crypt volumes have no keyslots, so there is no recovery key to fall back to.
+				rErr = errors.New("cannot activate a plain dm-crypt volume with a recovery key")
+				continue
+			}
+
+			// If the TPM sealed key hasn't been tried yet, the recovery key is being used because the caller asked for it.
+			fallback := tpmErr != errProtectorDisabled
+			reason := RecoveryKeyUsageReasonRequested
+			if fallback {
+				reason = recoveryKeyUsageReasonForTPMError(tpmErr)
+			}
+			var metrics OperationMetrics
+			rErr = activateWithRecoveryKey(volumeName, sourceDevicePath, cryptDevicePath, newAuthRequest(nil, options), options.RecoveryKeyTries, reason, activateOptions, options.KeyringPrefix, options.ReadOnly, &metrics)
+			result.Protectors = append(result.Protectors, metrics)
+			if rErr != nil {
+				continue
+			}
 
-	return true, nil
+			volume := newActivatedVolume(volumeName, sourceDevicePath, VolumeProtectorRecoveryKey, keyPath, k)
+			volume.RecoveryReason = reason
+			volume.ReadOnly = options.ReadOnly
+			// Ignore errors - the volume has been activated.
+			recordActivatedVolume(volume)
+			result.Volume = volume
+			if !fallback {
+				return result, nil
+			}
+			if !options.ReadOnly {
+				writeRecoveryMarker(&RecoveryMarker{
+					VolumeName:       volumeName,
+					SourceDevicePath: sourceDevicePath,
+					KeyPath:          keyPath,
+					Reason:           reason,
+					TPMError:         tpmErr.Error(),
+					Time:             volume.Time})
+			}
+			return result, &ActivateWithTPMSealedKeyError{tpmErr, nil}
+		}
+	}
+
+	closeIntegrity()
+	return result, &ActivateWithTPMSealedKeyError{tpmErr, rErr}
 }
 
 // ActivateVolumeWithRecoveryKey attempts to activate the LUKS encrypted volume at sourceDevicePath and create a mapping with the
 // name volumeName, using the fallback recovery key. This makes use of systemd-cryptsetup.
 //
-// This function will use systemd-ask-password to request the recovery key. If keyReader is not nil, then an attempt to read the key
-// from this will be made instead by reading all characters until the first newline. The RecoveryKeyTries field of options defines how many
-// attempts should be made to activate the volume with the recovery key before failing.
+// This function will use the AuthRequestor specified by the AuthRequestor field of options to request the recovery key, or
+// systemd-ask-password if that isn't set. If keyReader is not nil, then an attempt to read the key from this will be made first by
+// reading all characters until the first newline. The RecoveryKeyTries field of options defines how many attempts should be made to
+// activate the volume with the recovery key before failing, and the AuthRequestTimeout field of options defines how long each
+// request waits for the user to respond.
 //
 // The ActivateOptions field of options can be used to specify additional options to pass to systemd-cryptsetup.
 //
+// If the ReadOnly field of options is set, the volume is mapped read-only and the recovery key is not added to the kernel keyring.
+//
+// If the Integrity field of options is set, the standalone dm-integrity device at sourceDevicePath is opened with a mapping named
+// volumeName with a "-integrity" suffix, and the encrypted volume is activated on top of it.
+//
 // If activation with the recovery key is successful, calling GetActivationDataFromKernel will return a *RecoveryActivationData
-// containing the recovery key and RecoveryKeyUsageReasonRequested as the recovery reason.
+// containing the recovery key and RecoveryKeyUsageReasonRequested as the recovery reason, and the volume is recorded in the volume
+// inventory (see VolumeStatus).
 //
 // If the RecoveryKeyTries field of options is less than zero, an error will be returned. If the ActivateOptions field of options contains the
 // "tries=" option, then an error will be returned. This option cannot be used with this function.
 func ActivateVolumeWithRecoveryKey(volumeName, sourceDevicePath string, keyReader io.Reader, options *ActivateVolumeOptions) error {
+	_, err := ActivateVolumeWithRecoveryKeyWithResult(volumeName, sourceDevicePath, keyReader, options)
+	return err
+}
+
+// ActivateVolumeWithRecoveryKeyWithResult behaves the same as ActivateVolumeWithRecoveryKey, but also returns a *ActivationResult
+// describing how many recovery keys were tried and how long activation took. A result is returned even if an error is also
+// returned.
+func ActivateVolumeWithRecoveryKeyWithResult(volumeName, sourceDevicePath string, keyReader io.Reader, options *ActivateVolumeOptions) (*ActivationResult, error) {
+	result := new(ActivationResult)
+	defer func(start time.Time) {
+		result.Duration = time.Since(start)
+	}(time.Now())
+
 	if options.RecoveryKeyTries < 0 {
-		return errors.New("invalid RecoveryKeyTries")
+		return result, errors.New("invalid RecoveryKeyTries")
+	}
+	if options.PlainCrypt != nil {
+		return result, errors.New("cannot activate a plain dm-crypt volume with a recovery key")
 	}
 
-	activateOptions, err := makeActivateOptions(options.ActivateOptions)
+	activateOptions, err := makeActivateOptions(options.ActivateOptions, options.ReadOnly)
 	if err != nil {
-		return err
+		return result, err
+	}
+
+	cryptDevicePath, closeIntegrity, err := openIntegrityDeviceForVolume(volumeName, sourceDevicePath, options.Integrity, options.ReadOnly)
+	if err != nil {
+		return result, err
+	}
+
+	var metrics OperationMetrics
+	err = activateWithRecoveryKey(volumeName, sourceDevicePath, cryptDevicePath, newAuthRequest(keyReader, options), options.RecoveryKeyTries, RecoveryKeyUsageReasonRequested, activateOptions, options.KeyringPrefix, options.ReadOnly, &metrics)
+	result.Protectors = append(result.Protectors, metrics)
+	if err != nil {
+		closeIntegrity()
+		return result, err
 	}
 
-	return activateWithRecoveryKey(volumeName, sourceDevicePath, keyReader, options.RecoveryKeyTries, RecoveryKeyUsageReasonRequested, activateOptions, options.KeyringPrefix)
+	volume := newActivatedVolume(volumeName, sourceDevicePath, VolumeProtectorRecoveryKey, "", nil)
+	volume.RecoveryReason = RecoveryKeyUsageReasonRequested
+	volume.ReadOnly = options.ReadOnly
+	// Ignore errors - the volume has been activated.
+	recordActivatedVolume(volume)
+	result.Volume = volume
+	return result, nil
 }
 
 // ActivationData corresponds to some data added to the user keyring by one of the ActivateVolume functions.
@@ -559,44 +985,25 @@ type RecoveryActivationData struct {
 	Reason RecoveryKeyUsageReason
 }
 
-// GetActivationDataFromKernel retrieves data that was added to the current user's user keyring by ActivateVolumeWithTPMSealedKey or
-// ActivateVolumeWithRecoveryKey for the specified source block device, using the prefix that was passed to either of those functions.
-// The block device path must match the path passed to one of the ActivateVolume functions. The type of data returned is dependent on
-// how the volume was activated - see the documentation for each function, If no data is found for the specified device, a
-// ErrNoActivationData error is returned.
-//
-// If remove is true, this function will unlink the key from the user's user keyring.
-func GetActivationDataFromKernel(prefix, sourceDevicePath string, remove bool) (ActivationData, error) {
-	var userKeys []int
+// activationKey describes a key that was added to the current user's user keyring by one of the ActivateVolume functions.
+type activationKey struct {
+	id     int
+	params map[string]string
+}
 
-	sz, err := unix.KeyctlBuffer(unix.KEYCTL_READ, userKeyring, nil, 0)
+// findActivationKeysInKernel finds the keys that were added to the current user's user keyring by one of the ActivateVolume
+// functions for the specified source block device.
+func findActivationKeysInKernel(prefix, sourceDevicePath string) ([]activationKey, error) {
+	userKeys, err := listUserKeyring()
 	if err != nil {
-		return nil, xerrors.Errorf("cannot determine size of user keyring payload: %w", err)
+		return nil, err
 	}
 
-	for {
-		payload := make([]byte, sz)
-		n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, userKeyring, payload, 0)
-		if err != nil {
-			return nil, xerrors.Errorf("cannot read user keyring payload: %w", err)
-		}
-
-		if n <= sz {
-			payload = payload[:n]
-
-			for len(payload) > 0 {
-				userKeys = append(userKeys, int(binary.LittleEndian.Uint32(payload)))
-				payload = payload[4:]
-			}
-			break
-		}
-
-		sz = n
-	}
+	var keys []activationKey
 
 	re := regexp.MustCompile(fmt.Sprintf(`^user;[[:digit:]]+;[[:digit:]]+;[[:xdigit:]]+;%s:([^\?]+)\??(.*)`, keyringPrefixOrDefault(prefix)))
 	for _, id := range userKeys {
-		desc, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+		desc, err := describeKey(id)
 		if err != nil {
 			continue
 		}
@@ -608,21 +1015,6 @@ func GetActivationDataFromKernel(prefix, sourceDevicePath string, remove bool) (
 			continue
 		}
 
-		sz, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
-		if err != nil {
-			return nil, xerrors.Errorf("cannot determine size of key payload: %w", err)
-		}
-		payload := make([]byte, sz)
-		_, err = unix.KeyctlBuffer(unix.KEYCTL_READ, id, payload, 0)
-		if err != nil {
-			return nil, xerrors.Errorf("cannot read key payload: %w", err)
-		}
-
-		if remove {
-			// XXX: What should we do if unlinking fails?
-			unix.KeyctlInt(unix.KEYCTL_UNLINK, id, userKeyring, 0, 0)
-		}
-
 		params := make(map[string]string)
 		if len(m) > 2 {
 			for _, p := range strings.Split(m[2], "&") {
@@ -636,34 +1028,178 @@ func GetActivationDataFromKernel(prefix, sourceDevicePath string, remove bool) (
 			}
 		}
 
-		t, ok := params["type"]
-		if !ok {
+		if _, ok := params["type"]; !ok {
 			return nil, errors.New("invalid description (no type)")
 		}
-		switch t {
-		case "tpm":
-			return TPMPolicyAuthKey(payload), nil
-		case "recovery":
-			reason, ok := params["reason"]
-			if !ok {
-				return nil, errors.New("no recovery reason")
-			}
-			n, err := strconv.Atoi(reason)
-			if err != nil {
-				return nil, xerrors.Errorf("invalid recovery reason: %w", err)
+		keys = append(keys, activationKey{id: id, params: params})
+	}
+
+	return keys, nil
+}
+
+// readActivationKeyFromKernel finds a key that was added to the current user's user keyring by one of the ActivateVolume functions
+// for the specified source block device and with one of the specified types, and returns its payload and the parameters encoded in
+// its description. If remove is true, the key is unlinked from the user's user keyring. If no key is found, a ErrNoActivationData
+// error is returned.
+func readActivationKeyFromKernel(prefix, sourceDevicePath string, remove bool, types ...string) ([]byte, map[string]string, error) {
+	keys, err := findActivationKeysInKernel(prefix, sourceDevicePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, key := range keys {
+		id := key.id
+		t := key.params["type"]
+		wanted := false
+		for _, w := range types {
+			if t == w {
+				wanted = true
+				break
 			}
-			if len(payload) != binary.Size(RecoveryKey{}) {
-				return nil, errors.New("invalid payload size")
+		}
+		if !wanted {
+			continue
+		}
+
+		payload, err := readKeyPayload(id)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if remove {
+			// XXX: What should we do if unlinking fails?
+			unlinkUserKey(id)
+		}
+
+		return payload, key.params, nil
+	}
+
+	return nil, nil, ErrNoActivationData
+}
+
+// GetActivationDataFromKernel retrieves data that was added to the current user's user keyring by ActivateVolumeWithTPMSealedKey or
+// ActivateVolumeWithRecoveryKey for the specified source block device, using the prefix that was passed to either of those functions.
+// The block device path must match the path passed to one of the ActivateVolume functions. The type of data returned is dependent on
+// how the volume was activated - see the documentation for each function, If no data is found for the specified device, a
+// ErrNoActivationData error is returned.
+//
+// If remove is true, this function will unlink the key from the user's user keyring.
+func GetActivationDataFromKernel(prefix, sourceDevicePath string, remove bool) (ActivationData, error) {
+	payload, params, err := readActivationKeyFromKernel(prefix, sourceDevicePath, remove, "tpm", "recovery")
+	if err != nil {
+		return nil, err
+	}
+
+	switch params["type"] {
+	case "tpm":
+		return TPMPolicyAuthKey(payload), nil
+	default:
+		reason, ok := params["reason"]
+		if !ok {
+			return nil, errors.New("no recovery reason")
+		}
+		n, err := strconv.Atoi(reason)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid recovery reason: %w", err)
+		}
+		if len(payload) != binary.Size(RecoveryKey{}) {
+			return nil, errors.New("invalid payload size")
+		}
+		var key RecoveryKey
+		copy(key[:], payload)
+		return &RecoveryActivationData{Key: key, Reason: RecoveryKeyUsageReason(n)}, nil
+	}
+}
+
+// wipeActivationKeysInKernel overwrites the payload of every key that was added to the current user's user keyring by one of the
+// ActivateVolume functions for the specified source block device, and then invalidates it so that it is removed from every keyring
+// that it is linked to.
+func wipeActivationKeysInKernel(prefix, sourceDevicePath string) error {
+	keys, err := findActivationKeysInKernel(prefix, sourceDevicePath)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := wipeKeyPayload(key.id); err != nil {
+			return err
+		}
+		if err := invalidateKey(key.id); err != nil {
+			// The payload has already been wiped, so just unlinking it is fine.
+			if err := unlinkUserKey(key.id); err != nil {
+				return xerrors.Errorf("cannot remove key: %w", err)
 			}
-			var key RecoveryKey
-			copy(key[:], payload)
-			return &RecoveryActivationData{Key: key, Reason: RecoveryKeyUsageReason(n)}, nil
-		default:
-			return nil, errors.New("invalid description (unhandled type)")
 		}
 	}
 
-	return nil, ErrNoActivationData
+	return nil
+}
+
+// DeactivateVolumeOptions provides options to DeactivateVolume.
+type DeactivateVolumeOptions struct {
+	// KeyringPrefix is the prefix that was used for the
+	// description of any kernel keys created during activation.
+	KeyringPrefix string
+}
+
+// DeactivateVolume removes the mapping with the name volumeName that was created by one of the ActivateVolume functions for the
+// encrypted volume at sourceDevicePath. This makes use of systemd-cryptsetup. If there is a standalone dm-integrity device beneath
+// the volume (see IntegrityParams), it is closed as well.
+//
+// The volume is also removed from the volume inventory.
+//
+// Any data that was added to the kernel keyring for sourceDevicePath when the volume was activated (the private part of the key
+// for authorizing PCR policy updates or the recovery key) is overwritten and then
+// invalidated. This happens even if the mapping cannot be removed, so that a system that is being locked doesn't retain unsealed
+// key material. Once this has completed, GetActivationDataFromKernel will return ErrNoActivationData for sourceDevicePath.
+//
+// This is intended for use cases such as locking on suspend or on logout. The dm-crypt volume key itself is wiped from memory by
+// the kernel when the mapping is removed.
+func DeactivateVolume(volumeName, sourceDevicePath string, options *DeactivateVolumeOptions) error {
+	if options == nil {
+		options = &DeactivateVolumeOptions{}
+	}
+
+	wipeErr := wipeActivationKeysInKernel(options.KeyringPrefix, sourceDevicePath)
+
+	cmd := exec.Command(systemdCryptsetupPath, "detach", volumeName)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return xerrors.Errorf("cannot detach volume: %w", osutil.OutputErr(output, err))
+	}
+
+	integrityName := integrityMappingName(volumeName)
+	if osutil.FileExists(filepath.Join(devMapperPath, integrityName)) {
+		if err := CloseIntegrityDevice(integrityName); err != nil {
+			return xerrors.Errorf("cannot close integrity device: %w", err)
+		}
+	}
+
+	if err := forgetActivatedVolume(volumeName); err != nil {
+		return xerrors.Errorf("cannot remove volume from inventory: %w", err)
+	}
+
+	if wipeErr != nil {
+		return xerrors.Errorf("cannot wipe activation data from kernel keyring: %w", wipeErr)
+	}
+	return nil
+}
+
+// testLUKS2Key checks that the supplied key unlocks the specified keyslot of the LUKS2 container at devicePath, or any keyslot if
+// slot is negative, without activating it.
+func testLUKS2Key(devicePath string, slot int, key []byte) error {
+	args := []string{"open", "--test-passphrase", "--key-file", "-"}
+	if slot >= 0 {
+		args = append(args, "--key-slot", strconv.Itoa(slot))
+	}
+	args = append(args, devicePath)
+
+	cmd := exec.Command("cryptsetup", args...)
+	cmd.Stdin = bytes.NewReader(key)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return osutil.OutputErr(output, err)
+	}
+
+	return nil
 }
 
 func setLUKS2KeyslotPreferred(devicePath string, slot int) error {
@@ -688,11 +1224,67 @@ func setLUKS2KeyslotPreferred(devicePath string, slot int) error {
 // WARNING: This function is destructive. Calling this on an existing LUKS container will make the data contained inside of it
 // irretrievable.
 func InitializeLUKS2Container(devicePath, label string, key []byte) error {
+	return InitializeLUKS2ContainerWithOptions(devicePath, label, key, nil)
+}
+
+// InitializeLUKS2ContainerOptions provides options to InitializeLUKS2ContainerWithOptions.
+type InitializeLUKS2ContainerOptions struct {
+	// Integrity specifies that the container should use authenticated encryption, with the specified integrity algorithm
+	// ("hmac-sha256" or "hmac-sha512"). In this mode, dm-crypt stores an authentication tag for each sector alongside the
+	// encrypted data in a dm-integrity device that is managed by cryptsetup, so that modification of the encrypted data is
+	// detected when it is read. The integrity parameters and key are stored in the LUKS2 header, so no additional parameters
+	// are required to activate the volume.
+	//
+	// Initializing a container with authenticated encryption wipes the whole device in order to initialize the authentication
+	// tags, which may take a long time.
+	Integrity string
+}
+
+// integrityKeySize returns the size in bits of the key for the specified LUKS2 integrity algorithm.
+func integrityKeySize(alg string) (int, error) {
+	switch alg {
+	case "hmac-sha256":
+		return 256, nil
+	case "hmac-sha512":
+		return 512, nil
+	default:
+		return 0, fmt.Errorf("unsupported integrity algorithm %q", alg)
+	}
+}
+
+// InitializeLUKS2ContainerWithOptions initializes the partition at the specified devicePath as a new LUKS2 container in the same
+// way as InitializeLUKS2Container, but with additional options. If options is nil, this is equivalent to InitializeLUKS2Container.
+//
+// WARNING: This function is destructive. Calling this on an existing LUKS container will make the data contained inside of it
+// irretrievable.
+func InitializeLUKS2ContainerWithOptions(devicePath, label string, key []byte, options *InitializeLUKS2ContainerOptions) error {
+	return initializeLUKS2Container(devicePath, label, key, options, nil)
+}
+
+// initializeLUKS2Container implements InitializeLUKS2ContainerWithOptions. The mutations that it performs are recorded in plan,
+// and are not performed if plan is a dry run.
+func initializeLUKS2Container(devicePath, label string, key []byte, options *InitializeLUKS2ContainerOptions, plan *actionPlan) error {
 	if len(key) != 64 {
 		return fmt.Errorf("expected a key length of 512-bits (got %d)", len(key)*8)
 	}
+	if options == nil {
+		options = &InitializeLUKS2ContainerOptions{}
+	}
 
-	cmd := exec.Command("cryptsetup",
+	// AES-256 with XTS block cipher mode requires 2 keys
+	keySize := 512
+	var integrityArgs []string
+	if options.Integrity != "" {
+		n, err := integrityKeySize(options.Integrity)
+		if err != nil {
+			return err
+		}
+		// The key for the integrity algorithm is appended to the encryption key
+		keySize += n
+		integrityArgs = []string{"--integrity", options.Integrity}
+	}
+
+	args := []string{
 		// batch processing, no password verification for formatting an existing LUKS container
 		"-q",
 		// formatting a new volume
@@ -702,21 +1294,44 @@ func InitializeLUKS2Container(devicePath, label string, key []byte) error {
 		// read the key from stdin
 		"--key-file", "-",
 		// use AES-256 with XTS block cipher mode (XTS requires 2 keys)
-		"--cipher", "aes-xts-plain64", "--key-size", "512",
-		// use argon2i as the KDF with minimum cost (lowest possible time and memory costs). This is done
-		// because the supplied input key has the same entropy (512-bits) as the derived key and therefore
-		// increased time or memory cost don't provide a security benefit (but does slow down unlocking).
-		"--pbkdf", "argon2i", "--pbkdf-force-iterations", "4", "--pbkdf-memory", "32",
+		"--cipher", "aes-xts-plain64", "--key-size", strconv.Itoa(keySize),
+	}
+	args = append(args, integrityArgs...)
+	args = append(args, minimumCostPBKDFArgs()...)
+	args = append(args,
 		// set LUKS2 label
 		"--label", label,
 		// device to format
 		devicePath)
-	cmd.Stdin = bytes.NewReader(key)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return osutil.OutputErr(output, err)
+	target := "device " + devicePath
+	if err := plan.perform(func() error {
+		cmd := exec.Command("cryptsetup", args...)
+		cmd.Stdin = bytes.NewReader(key)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return osutil.OutputErr(output, err)
+		}
+		return nil
+	}, PlannedAction{
+		Type:        PlannedActionDestroy,
+		Target:      target,
+		Description: "overwrite the existing header, making any data on the device irretrievable"},
+		PlannedAction{Type: PlannedActionCreate, Target: target, Description: "create a new LUKS2 header"},
+		PlannedAction{Type: PlannedActionCreate, Target: target + " keyslot 0", Description: "add the supplied key"}); err != nil {
+		return err
 	}
 
-	return setLUKS2KeyslotPreferred(devicePath, 0)
+	return plan.perform(func() error {
+		return setLUKS2KeyslotPreferred(devicePath, 0)
+	}, PlannedAction{Type: PlannedActionModify, Target: target + " keyslot 0", Description: "mark the keyslot as preferred"})
+}
+
+// minimumCostPBKDFArgs returns the cryptsetup arguments for configuring a keyslot for a key with the same entropy as the derived
+// key. This uses argon2i as the KDF with minimum cost (lowest possible time and memory costs), because increased time or memory
+// cost don't provide a security benefit (but does slow down unlocking). The cost is raised if the algorithm policy installed with
+// SetAlgorithmPolicy requires it.
+func minimumCostPBKDFArgs() []string {
+	iterations, memoryKiB := algorithmPolicy.argon2Cost(4, 32)
+	return []string{"--pbkdf", "argon2i", "--pbkdf-force-iterations", strconv.Itoa(iterations), "--pbkdf-memory", strconv.Itoa(memoryKiB)}
 }
 
 func addKeyToLUKS2Container(devicePath string, existingKey, key []byte, extraOptionArgs []string) error {
@@ -804,13 +1419,9 @@ func ChangeLUKS2KeyUsingRecoveryKey(devicePath string, recoveryKey RecoveryKey,
 		return osutil.OutputErr(output, err)
 	}
 
-	if err := addKeyToLUKS2Container(devicePath, recoveryKey[:], key, []string{
-		// use argon2i as the KDF with minimum cost (lowest possible time and memory costs). This is done
-		// because the supplied input key has the same entropy (512-bits) as the derived key and therefore
-		// increased time or memory cost don't provide a security benefit (but does slow down unlocking).
-		"--pbkdf", "argon2i", "--pbkdf-force-iterations", "4", "--pbkdf-memory", "32",
+	if err := addKeyToLUKS2Container(devicePath, recoveryKey[:], key, append(minimumCostPBKDFArgs(),
 		// always have the main key in slot 0 for now
-		"--key-slot", "0"}); err != nil {
+		"--key-slot", "0")); err != nil {
 		return err
 	}
 
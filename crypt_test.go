@@ -130,6 +130,9 @@ sed -i -e '1,1d' %[1]s
 	bt.AddCleanup(ctb.mockSdAskPassword.Restore)
 
 	sdCryptsetupBottom := `
+if [ "$1" = "detach" ]; then
+    exit 0
+fi
 key=$(xxd -p < "$4")
 if [ ! -f "%[1]s" ] || [ "$key" != "$(xxd -p < "%[1]s")" ]; then
     if [ ! -f "%[2]s" ] || [ "$key" != "$(xxd -p < "%[2]s")" ]; then
@@ -151,7 +154,7 @@ while [ $# -gt 0 ]; do
             keyfile=$2
             shift 2
             ;;
-        --type | --cipher | --key-size | --pbkdf | --pbkdf-force-iterations | --pbkdf-memory | --label | --priority | --key-slot | --iter-time)
+        --type | --cipher | --key-size | --integrity | --pbkdf | --pbkdf-force-iterations | --pbkdf-memory | --label | --priority | --key-slot | --iter-time)
             shift 2
             ;;
         -*)
@@ -392,6 +395,212 @@ func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithTPMSealedKeyNo2FA7(c *C)
 	})
 }
 
+func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithTPMSealedKeyRecordsInventory(c *C) {
+	devMapper := c.MkDir()
+	s.AddCleanup(MockDevMapperPath(devMapper))
+	c.Assert(ioutil.WriteFile(filepath.Join(devMapper, "data"), nil, 0644), IsNil)
+
+	success, err := ActivateVolumeWithTPMSealedKey(s.TPM, "data", "/dev/sda1", s.keyFile, nil, &ActivateVolumeOptions{})
+	c.Check(success, Equals, true)
+	c.Check(err, IsNil)
+
+	k, err := ReadSealedKeyObject(s.keyFile)
+	c.Assert(err, IsNil)
+
+	v, err := VolumeStatus("data")
+	c.Assert(err, IsNil)
+	c.Check(v.SourceDevicePath, Equals, "/dev/sda1")
+	c.Check(v.Protector, Equals, VolumeProtectorTPM)
+	c.Check(v.Keyslot, Equals, 0)
+	c.Check(v.RecoveryKeyUsed(), Equals, false)
+	c.Check(v.KeyPath, Equals, s.keyFile)
+	c.Check(v.PCRPolicyGeneration, Equals, k.PCRPolicyGeneration())
+	if id, ok := k.KeyID(); ok {
+		c.Check(v.KeyID, DeepEquals, &id)
+	}
+
+	_, err = GetActivationDataFromKernel("", "/dev/sda1", true)
+	c.Check(err, IsNil)
+}
+
+func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithTPMSealedKeyReadOnly(c *C) {
+	options := ActivateVolumeOptions{ReadOnly: true}
+	success, err := ActivateVolumeWithTPMSealedKey(s.TPM, "data", "/dev/sda1", s.keyFile, nil, &options)
+	c.Check(success, Equals, true)
+	c.Check(err, IsNil)
+
+	c.Assert(len(s.mockSdCryptsetup.Calls()), Equals, 1)
+	c.Assert(len(s.mockSdCryptsetup.Calls()[0]), Equals, 6)
+	c.Check(s.mockSdCryptsetup.Calls()[0][0:4], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/sda1"})
+	c.Check(s.mockSdCryptsetup.Calls()[0][5], Equals, "read-only,tries=1")
+
+	_, err = GetActivationDataFromKernel("", "/dev/sda1", true)
+	c.Check(err, Equals, ErrNoActivationData)
+}
+
+func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithTPMSealedKeyReadOnlyDoesNotProvision(c *C) {
+	// Test that ActivateVolumeWithTPMSealedKey doesn't recreate a missing SRK in read-only mode.
+	srk, err := s.TPM.CreateResourceContextFromTPM(tcg.SRKHandle)
+	c.Assert(err, IsNil)
+	_, err = s.TPM.EvictControl(s.TPM.OwnerHandleContext(), srk, srk.Handle(), nil)
+	c.Assert(err, IsNil)
+
+	options := ActivateVolumeOptions{ReadOnly: true}
+	success, err := ActivateVolumeWithTPMSealedKey(s.TPM, "data", "/dev/sda1", s.keyFile, nil, &options)
+	c.Check(success, Equals, false)
+	c.Check(err, ErrorMatches, "cannot activate with TPM sealed key \\(cannot unseal key: the TPM is not correctly provisioned\\) .*")
+
+	_, err = s.TPM.CreateResourceContextFromTPM(tcg.SRKHandle)
+	c.Check(err, NotNil)
+}
+
+func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithTPMSealedKeyPlain(c *C) {
+	options := ActivateVolumeOptions{
+		PlainCrypt: &PlainCryptParams{Cipher: "aes-xts-plain64", KeySize: len(s.tpmKey), Offset: 2048}}
+	success, err := ActivateVolumeWithTPMSealedKey(s.TPM, "data", "/dev/mtdblock2", s.keyFile, nil, &options)
+	c.Check(success, Equals, true)
+	c.Check(err, IsNil)
+
+	c.Assert(len(s.mockSdCryptsetup.Calls()), Equals, 1)
+	c.Assert(len(s.mockSdCryptsetup.Calls()[0]), Equals, 6)
+	c.Check(s.mockSdCryptsetup.Calls()[0][0:4], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/mtdblock2"})
+	c.Check(s.mockSdCryptsetup.Calls()[0][5], Equals, "plain,cipher=aes-xts-plain64,size=512,offset=2048,skip=0,hash=plain,tries=1")
+
+	s.checkTPMPolicyAuthKey(c, "", "/dev/mtdblock2")
+}
+
+func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithTPMSealedKeyPlainIgnoresKeyData(c *C) {
+	// The plain dm-crypt parameters recorded in the key data file aren't integrity protected, so they must not be used.
+	keyFile := c.MkDir() + "/keydata"
+	_, err := SealKeyToTPM(s.TPM, s.tpmKey, keyFile, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		PlainCrypt:             &PlainCryptParams{Cipher: "aes-xts-plain64", KeySize: len(s.tpmKey)}})
+	c.Assert(err, IsNil)
+
+	success, err := ActivateVolumeWithTPMSealedKey(s.TPM, "data", "/dev/sda1", keyFile, nil, nil)
+	c.Check(success, Equals, true)
+	c.Check(err, IsNil)
+
+	c.Assert(len(s.mockSdCryptsetup.Calls()), Equals, 1)
+	c.Assert(len(s.mockSdCryptsetup.Calls()[0]), Equals, 6)
+	c.Check(strings.HasPrefix(s.mockSdCryptsetup.Calls()[0][5], "plain"), Equals, false)
+}
+
+func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithTPMSealedKeyPlainInsecureCipher(c *C) {
+	for _, cipher := range []string{"cipher_null-ecb", "aes-ecb", "AES-ECB"} {
+		options := ActivateVolumeOptions{
+			PlainCrypt: &PlainCryptParams{Cipher: cipher, KeySize: len(s.tpmKey)}}
+		success, err := ActivateVolumeWithTPMSealedKey(s.TPM, "data", "/dev/mtdblock2", s.keyFile, nil, &options)
+		c.Check(success, Equals, false)
+		c.Check(err, ErrorMatches, "invalid plain dm-crypt parameters: insecure cipher \""+cipher+"\"")
+	}
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithTPMSealedKeyPlainNoRecoveryFallback(c *C) {
+	c.Assert(ioutil.WriteFile(s.keyFile, nil, 0644), IsNil)
+
+	options := ActivateVolumeOptions{
+		RecoveryKeyTries: 1,
+		PlainCrypt:       &PlainCryptParams{Cipher: "aes-xts-plain64", KeySize: len(s.tpmKey)}}
+	success, err := ActivateVolumeWithTPMSealedKey(s.TPM, "data", "/dev/mtdblock2", s.keyFile, nil, &options)
+	c.Check(success, Equals, false)
+	c.Check(err, ErrorMatches, "cannot activate with TPM sealed key \\(.*\\) and activation with recovery key failed "+
+		"\\(cannot activate a plain dm-crypt volume with a recovery key\\)")
+
+	c.Check(s.mockSdAskPassword.Calls(), HasLen, 0)
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithTPMSealedKeyRecoveryKeyFirst(c *C) {
+	c.Assert(ioutil.WriteFile(s.passwordFile, []byte(strings.Join(s.recoveryKeyAscii, "-")+"\n"), 0644), IsNil)
+
+	options := ActivateVolumeOptions{
+		RecoveryKeyTries: 1,
+		ProtectorOrder:   []VolumeProtector{VolumeProtectorRecoveryKey, VolumeProtectorTPM}}
+	success, err := ActivateVolumeWithTPMSealedKey(s.TPM, "data", "/dev/sda1", s.keyFile, nil, &options)
+	c.Check(success, Equals, true)
+	c.Check(err, IsNil)
+
+	c.Check(s.mockSdAskPassword.Calls(), HasLen, 1)
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 1)
+
+	// The recovery key was requested rather than used as a fallback, so no recovery marker is written.
+	markers, err := ReadRecoveryMarkers()
+	c.Check(err, IsNil)
+	c.Check(markers, HasLen, 0)
+
+	s.checkRecoveryActivationData(c, "", "/dev/sda1", RecoveryKeyUsageReasonRequested)
+}
+
+func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithTPMSealedKeyRecoveryKeyFirstFallsBackToTPM(c *C) {
+	c.Assert(ioutil.WriteFile(s.passwordFile, []byte("foo\n"), 0644), IsNil)
+
+	devMapper := c.MkDir()
+	s.AddCleanup(MockDevMapperPath(devMapper))
+	c.Assert(ioutil.WriteFile(filepath.Join(devMapper, "data"), nil, 0644), IsNil)
+
+	options := ActivateVolumeOptions{
+		RecoveryKeyTries: 1,
+		ProtectorOrder:   []VolumeProtector{VolumeProtectorRecoveryKey, VolumeProtectorTPM}}
+	success, err := ActivateVolumeWithTPMSealedKey(s.TPM, "data", "/dev/sda1", s.keyFile, nil, &options)
+	c.Check(success, Equals, true)
+	c.Check(err, IsNil)
+
+	c.Check(s.mockSdAskPassword.Calls(), HasLen, 1)
+
+	v, err := VolumeStatus("data")
+	c.Assert(err, IsNil)
+	c.Check(v.Protector, Equals, VolumeProtectorTPM)
+
+	s.checkTPMPolicyAuthKey(c, "", "/dev/sda1")
+}
+
+func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithTPMSealedKeyTPMDisabled(c *C) {
+	c.Assert(ioutil.WriteFile(s.passwordFile, []byte("foo\n"), 0644), IsNil)
+
+	options := ActivateVolumeOptions{
+		RecoveryKeyTries: 1,
+		ProtectorOrder:   []VolumeProtector{VolumeProtectorRecoveryKey}}
+	success, err := ActivateVolumeWithTPMSealedKey(s.TPM, "data", "/dev/sda1", s.keyFile, nil, &options)
+	c.Check(success, Equals, false)
+	c.Check(err, ErrorMatches, "cannot activate with TPM sealed key \\(protector is disabled\\) and activation with recovery key failed \\(.*\\)")
+
+	c.Check(s.mockSdAskPassword.Calls(), HasLen, 1)
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithTPMSealedKeyRecoveryKeyDisabled(c *C) {
+	c.Assert(ioutil.WriteFile(s.keyFile, nil, 0644), IsNil)
+
+	options := ActivateVolumeOptions{
+		RecoveryKeyTries: 1,
+		ProtectorOrder:   []VolumeProtector{VolumeProtectorTPM}}
+	success, err := ActivateVolumeWithTPMSealedKey(s.TPM, "data", "/dev/sda1", s.keyFile, nil, &options)
+	c.Check(success, Equals, false)
+	c.Check(err, ErrorMatches, "cannot activate with TPM sealed key \\(.*\\) and activation with recovery key failed \\(protector is disabled\\)")
+
+	c.Check(s.mockSdAskPassword.Calls(), HasLen, 0)
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithTPMSealedKeyInvalidProtectorOrder(c *C) {
+	for _, t := range []struct {
+		order []VolumeProtector
+		err   string
+	}{
+		{order: []VolumeProtector{}, err: "invalid ProtectorOrder: no protectors are enabled"},
+		{order: []VolumeProtector{VolumeProtectorEphemeral}, err: "invalid ProtectorOrder: unsupported protector \"ephemeral\""},
+		{order: []VolumeProtector{VolumeProtectorTPM, VolumeProtectorTPM}, err: "invalid ProtectorOrder: duplicate protector \"tpm\""},
+	} {
+		success, err := ActivateVolumeWithTPMSealedKey(s.TPM, "data", "/dev/sda1", s.keyFile, nil, &ActivateVolumeOptions{ProtectorOrder: t.order})
+		c.Check(success, Equals, false)
+		c.Check(err, ErrorMatches, t.err)
+	}
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+}
+
 type testActivateVolumeWithTPMSealedKeyAndPINData struct {
 	pins     []string
 	pinTries int
@@ -563,10 +772,26 @@ func (s *cryptTPMSimulatorSuite) testActivateVolumeWithTPMSealedKeyErrorHandling
 		c.Check(call[5], Equals, strings.Join(append(data.activateOptions, "tries=1"), ","))
 	}
 
+	markers, err := ReadRecoveryMarkers()
+	c.Check(err, IsNil)
+
 	if !data.success {
+		c.Check(markers, HasLen, 0)
 		return
 	}
 
+	c.Assert(markers, HasLen, 1)
+	c.Check(markers[0].VolumeName, Equals, "data")
+	c.Check(markers[0].SourceDevicePath, Equals, "/dev/sda1")
+	c.Check(markers[0].KeyPath, Equals, s.keyFile)
+	c.Check(markers[0].Reason, Equals, data.recoveryReason)
+	c.Check(markers[0].TPMError, Not(Equals), "")
+
+	c.Check(ClearRecoveryMarker("data"), IsNil)
+	markers, err = ReadRecoveryMarkers()
+	c.Check(err, IsNil)
+	c.Check(markers, HasLen, 0)
+
 	// This should be done last because it may fail in some circumstances.
 	s.checkRecoveryActivationData(c, data.keyringPrefix, "/dev/sda1", data.recoveryReason)
 }
@@ -901,6 +1126,42 @@ func (s *cryptSuite) TestActivateVolumeWithRecoveryKey7(c *C) {
 	})
 }
 
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyWithResult(c *C) {
+	c.Assert(ioutil.WriteFile(s.passwordFile, []byte("00000-00000-00000-00000-00000-00000-00000-00000\n"+strings.Join(s.recoveryKeyAscii, "-")+"\n"), 0644), IsNil)
+
+	options := ActivateVolumeOptions{RecoveryKeyTries: 2}
+	result, err := ActivateVolumeWithRecoveryKeyWithResult("data", "/dev/sda1", nil, &options)
+	c.Assert(err, IsNil)
+	c.Check(result.Activated(), Equals, true)
+	c.Check(result.Volume.Protector, Equals, VolumeProtectorRecoveryKey)
+	c.Check(result.Volume.RecoveryReason, Equals, RecoveryKeyUsageReasonRequested)
+	c.Assert(result.Protectors, HasLen, 1)
+	c.Check(result.Protectors[0].Operation, Equals, MetricsOperationActivateWithRecoveryKey)
+	c.Check(result.Protectors[0].Attempts, Equals, 2)
+	c.Check(result.Protectors[0].Err, IsNil)
+	c.Check(result.Duration >= result.Protectors[0].Duration, Equals, true)
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 2)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyUnusableStateDir(c *C) {
+	// Test that activation works when the state directory can't be used, by passing the key via a memfd.
+	stateDir := filepath.Join(s.dir, "state")
+	c.Assert(ioutil.WriteFile(stateDir, nil, 0644), IsNil)
+	SetStateDir(stateDir)
+
+	options := ActivateVolumeOptions{RecoveryKeyTries: 1}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", strings.NewReader(strings.Join(s.recoveryKeyAscii, "-")+"\n"), &options), IsNil)
+
+	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/sda1", "/proc/self/fd/3", "tries=1"})
+
+	_, err := VolumeStatus("data")
+	c.Check(err, Equals, ErrVolumeNotActivated)
+	markers, err := ReadRecoveryMarkers()
+	c.Check(err, IsNil)
+	c.Check(markers, HasLen, 0)
+}
+
 type testActivateVolumeWithRecoveryKeyUsingKeyReaderData struct {
 	tries                   int
 	recoveryKeyFileContents string
@@ -1255,6 +1516,148 @@ func (s *cryptSuite) TestInitializeLUKS2Container(c *C) {
 	})
 }
 
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithIntegrity(c *C) {
+	c.Check(InitializeLUKS2ContainerWithOptions("/dev/sda1", "data", s.tpmKey, &InitializeLUKS2ContainerOptions{Integrity: "hmac-sha256"}), IsNil)
+	c.Check(s.mockCryptsetup.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "-q", "luksFormat", "--type", "luks2", "--key-file", "-", "--cipher", "aes-xts-plain64", "--key-size", "768",
+			"--integrity", "hmac-sha256", "--pbkdf", "argon2i", "--pbkdf-force-iterations", "4", "--pbkdf-memory", "32", "--label", "data",
+			"/dev/sda1"},
+		{"cryptsetup", "config", "--priority", "prefer", "--key-slot", "0", "/dev/sda1"}})
+	key, err := ioutil.ReadFile(s.cryptsetupKey + ".1")
+	c.Assert(err, IsNil)
+	c.Check(key, DeepEquals, s.tpmKey)
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithUnsupportedIntegrity(c *C) {
+	c.Check(InitializeLUKS2ContainerWithOptions("/dev/sda1", "data", s.tpmKey, &InitializeLUKS2ContainerOptions{Integrity: "crc32c"}),
+		ErrorMatches, "unsupported integrity algorithm \"crc32c\"")
+	c.Check(s.mockCryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyAndIntegrity(c *C) {
+	mockIntegritysetup := snapd_testutil.MockCommand(c, "integritysetup", "")
+	defer mockIntegritysetup.Restore()
+
+	c.Assert(ioutil.WriteFile(s.passwordFile, []byte(strings.Join(s.recoveryKeyAscii, "-")+"\n"), 0644), IsNil)
+
+	options := ActivateVolumeOptions{RecoveryKeyTries: 1, Integrity: &IntegrityParams{Algorithm: "crc32c"}}
+	c.Assert(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", nil, &options), IsNil)
+
+	c.Check(mockIntegritysetup.Calls(), DeepEquals, [][]string{
+		{"integritysetup", "open", "--integrity", "crc32c", "/dev/sda1", "data-integrity"}})
+	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0][0:4], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/mapper/data-integrity"})
+
+	// This should be done last because it may fail in some circumstances.
+	s.checkRecoveryActivationData(c, "", "/dev/sda1", RecoveryKeyUsageReasonRequested)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyAndIntegrityClosesOnFailure(c *C) {
+	mockIntegritysetup := snapd_testutil.MockCommand(c, "integritysetup", "")
+	defer mockIntegritysetup.Restore()
+
+	c.Assert(ioutil.WriteFile(s.passwordFile, []byte("00000-00000-00000-00000-00000-00000-00000-00000\n"), 0644), IsNil)
+
+	options := ActivateVolumeOptions{RecoveryKeyTries: 1, Integrity: &IntegrityParams{Algorithm: "crc32c"}}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", nil, &options), ErrorMatches, "cannot activate volume: .*")
+
+	c.Check(mockIntegritysetup.Calls(), DeepEquals, [][]string{
+		{"integritysetup", "open", "--integrity", "crc32c", "/dev/sda1", "data-integrity"},
+		{"integritysetup", "close", "data-integrity"}})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyAndIntegrityReadOnly(c *C) {
+	mockIntegritysetup := snapd_testutil.MockCommand(c, "integritysetup", "")
+	defer mockIntegritysetup.Restore()
+
+	c.Assert(ioutil.WriteFile(s.passwordFile, []byte(strings.Join(s.recoveryKeyAscii, "-")+"\n"), 0644), IsNil)
+
+	options := ActivateVolumeOptions{RecoveryKeyTries: 1, Integrity: &IntegrityParams{Algorithm: "crc32c"}, ReadOnly: true}
+	c.Assert(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", nil, &options), IsNil)
+
+	c.Check(mockIntegritysetup.Calls(), DeepEquals, [][]string{
+		{"integritysetup", "open", "--integrity", "crc32c", "--readonly", "/dev/sda1", "data-integrity"}})
+	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0][5], Equals, "read-only,tries=1")
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyRecordsInventory(c *C) {
+	devMapper := c.MkDir()
+	s.AddCleanup(MockDevMapperPath(devMapper))
+	c.Assert(ioutil.WriteFile(filepath.Join(devMapper, "data"), nil, 0644), IsNil)
+
+	c.Assert(ioutil.WriteFile(s.passwordFile, []byte(strings.Join(s.recoveryKeyAscii, "-")+"\n"), 0644), IsNil)
+
+	options := ActivateVolumeOptions{RecoveryKeyTries: 1}
+	c.Assert(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", nil, &options), IsNil)
+
+	v, err := VolumeStatus("data")
+	c.Assert(err, IsNil)
+	c.Check(v.Protector, Equals, VolumeProtectorRecoveryKey)
+	c.Check(v.Keyslot, Equals, KeyslotUnknown)
+	c.Check(v.RecoveryKeyUsed(), Equals, true)
+	c.Check(v.RecoveryReason, Equals, RecoveryKeyUsageReasonRequested)
+
+	// This should be done last because it may fail in some circumstances.
+	s.checkRecoveryActivationData(c, "", "/dev/sda1", RecoveryKeyUsageReasonRequested)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyReadOnly(c *C) {
+	c.Assert(ioutil.WriteFile(s.passwordFile, []byte(strings.Join(s.recoveryKeyAscii, "-")+"\n"), 0644), IsNil)
+
+	options := ActivateVolumeOptions{RecoveryKeyTries: 1, ReadOnly: true}
+	c.Assert(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", nil, &options), IsNil)
+
+	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0][5], Equals, "read-only,tries=1")
+
+	_, err := GetActivationDataFromKernel("", "/dev/sda1", true)
+	c.Check(err, Equals, ErrNoActivationData)
+}
+
+func (s *cryptSuite) TestClearRecoveryMarkerNoMarker(c *C) {
+	c.Check(ClearRecoveryMarker("data"), IsNil)
+}
+
+func (s *cryptSuite) TestDeactivateVolume(c *C) {
+	c.Assert(ioutil.WriteFile(s.passwordFile, []byte(strings.Join(s.recoveryKeyAscii, "-")+"\n"), 0644), IsNil)
+
+	options := ActivateVolumeOptions{RecoveryKeyTries: 1, KeyringPrefix: "test"}
+	c.Assert(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", nil, &options), IsNil)
+	c.Check(filepath.Join(s.dir, "secboot", "volumes", "data"), snapd_testutil.FilePresent)
+
+	c.Check(DeactivateVolume("data", "/dev/sda1", &DeactivateVolumeOptions{KeyringPrefix: "test"}), IsNil)
+	c.Check(filepath.Join(s.dir, "secboot", "volumes", "data"), snapd_testutil.FileAbsent)
+
+	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 2)
+	c.Check(s.mockSdCryptsetup.Calls()[1], DeepEquals, []string{"systemd-cryptsetup", "detach", "data"})
+
+	_, err := GetActivationDataFromKernel("test", "/dev/sda1", false)
+	c.Check(err, Equals, ErrNoActivationData)
+}
+
+func (s *cryptSuite) TestDeactivateVolumeWithIntegrity(c *C) {
+	mockIntegritysetup := snapd_testutil.MockCommand(c, "integritysetup", "")
+	defer mockIntegritysetup.Restore()
+
+	devMapper := c.MkDir()
+	restore := MockDevMapperPath(devMapper)
+	defer restore()
+	c.Assert(ioutil.WriteFile(filepath.Join(devMapper, "data-integrity"), nil, 0644), IsNil)
+
+	c.Check(DeactivateVolume("data", "/dev/sda1", nil), IsNil)
+
+	c.Check(s.mockSdCryptsetup.Calls(), DeepEquals, [][]string{{"systemd-cryptsetup", "detach", "data"}})
+	c.Check(mockIntegritysetup.Calls(), DeepEquals, [][]string{{"integritysetup", "close", "data-integrity"}})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyPlain(c *C) {
+	options := ActivateVolumeOptions{RecoveryKeyTries: 1, PlainCrypt: &PlainCryptParams{Cipher: "aes-xts-plain64", KeySize: 64}}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/mtdblock2", nil, &options), ErrorMatches,
+		"cannot activate a plain dm-crypt volume with a recovery key")
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+}
+
 func (s *cryptSuite) TestInitializeLUKS2ContainerInvalidKeySize(c *C) {
 	c.Check(InitializeLUKS2Container("/dev/sda1", "data", s.tpmKey[0:32]), ErrorMatches, "expected a key length of 512-bits \\(got 256\\)")
 }
@@ -0,0 +1,405 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+
+	"golang.org/x/xerrors"
+)
+
+// policyAuthDelegation is an authorization for an intermediate key to sign PCR policies on behalf of the dynamic authorization
+// policy key of a sealed key object. The dynamic authorization policy key signs a delegated policy, computed by
+// computeDelegatedPolicy, which can only be satisfied by a PCR policy that is signed by the intermediate key. If maxPolicyCount is
+// not zero, the delegated policy can also only be satisfied whilst the PCR policy counter has a value that is not greater than it.
+type policyAuthDelegation struct {
+	intermediateKey *tpm2.Public
+	maxPolicyCount  uint64
+	signature       *tpm2.Signature
+}
+
+// policyAuthDelegationRaw is the on-disk form of policyAuthDelegation.
+type policyAuthDelegationRaw struct {
+	IntermediateKey *tpm2.Public
+	MaxPolicyCount  uint64
+	Signature       *tpm2.Signature
+}
+
+func makePolicyAuthDelegationRaw(d *policyAuthDelegation) *policyAuthDelegationRaw {
+	return &policyAuthDelegationRaw{
+		IntermediateKey: d.intermediateKey,
+		MaxPolicyCount:  d.maxPolicyCount,
+		Signature:       d.signature}
+}
+
+func (d *policyAuthDelegationRaw) data() *policyAuthDelegation {
+	return &policyAuthDelegation{
+		intermediateKey: d.IntermediateKey,
+		maxPolicyCount:  d.MaxPolicyCount,
+		signature:       d.Signature}
+}
+
+// computeDelegatedPolicy computes the policy digest that is signed by the dynamic authorization policy key in order to authorize
+// an intermediate key. This asserts that a PCR policy has been signed by the intermediate key (using the same policy ref as PCR
+// policies signed directly by the dynamic authorization policy key), and optionally that the PCR policy counter has a value that
+// is not greater than maxPolicyCount, so that the authorization expires once the PCR policy counter has been incremented past it.
+func computeDelegatedPolicy(alg tpm2.HashAlgorithmId, pcrPolicyRef tpm2.Nonce, intermediateKeyName, counterName tpm2.Name, maxPolicyCount uint64) (tpm2.Digest, error) {
+	trial, err := tpm2.ComputeAuthPolicy(alg)
+	if err != nil {
+		return nil, err
+	}
+	trial.PolicyAuthorize(pcrPolicyRef, intermediateKeyName)
+	if maxPolicyCount > 0 {
+		operandB := make([]byte, 8)
+		binary.BigEndian.PutUint64(operandB, maxPolicyCount)
+		trial.PolicyNV(counterName, operandB, 0, tpm2.OpUnsignedLE)
+	}
+	return trial.GetDigest(), nil
+}
+
+// executeDelegatedPolicyAuthorization executes the assertions corresponding to the delegated policy computed by
+// computeDelegatedPolicy, on a policy session in which the PCR policy signed by the intermediate key has already been satisfied.
+// On success, it returns the resulting session digest, which must then be authorized by the dynamic authorization policy key.
+func executeDelegatedPolicyAuthorization(tpm *tpm2.TPMContext, policySession tpm2.SessionContext, dynamicInput *dynamicPolicyData, pcrPolicyRef tpm2.Nonce,
+	policyCounter tpm2.ResourceContext, extraSessions ...tpm2.SessionContext) (tpm2.Digest, error) {
+	delegation := dynamicInput.delegation
+
+	intermediateKeyPublic := delegation.intermediateKey
+	if intermediateKeyPublic == nil || !intermediateKeyPublic.NameAlg.Supported() {
+		return nil, dynamicPolicyDataError{errors.New("public area of intermediate PCR policy signing key has an unsupported name algorithm")}
+	}
+	intermediateKey, err := tpm.LoadExternal(nil, intermediateKeyPublic, tpm2.HandleOwner, extraSessions...)
+	if err != nil {
+		if tpm2.IsTPMParameterError(err, tpm2.AnyErrorCode, tpm2.CommandLoadExternal, 2) {
+			return nil, dynamicPolicyDataError{errors.New("public area of intermediate PCR policy signing key is invalid")}
+		}
+		return nil, xerrors.Errorf("cannot load public area for intermediate PCR policy signing key: %w", err)
+	}
+	defer tpm.FlushContext(intermediateKey)
+
+	h := intermediateKeyPublic.NameAlg.NewHash()
+	h.Write(dynamicInput.authorizedPolicy)
+	h.Write(pcrPolicyRef)
+
+	ticket, err := tpm.VerifySignature(intermediateKey, h.Sum(nil), dynamicInput.authorizedPolicySignature, extraSessions...)
+	if err != nil {
+		if tpm2.IsTPMParameterError(err, tpm2.AnyErrorCode, tpm2.CommandVerifySignature, 2) {
+			return nil, dynamicPolicyDataError{errors.New("cannot verify PCR policy signature")}
+		}
+		return nil, xerrors.Errorf("cannot verify PCR policy signature: %w", err)
+	}
+
+	if err := tpm.PolicyAuthorize(policySession, dynamicInput.authorizedPolicy, pcrPolicyRef, intermediateKey.Name(), ticket, extraSessions...); err != nil {
+		if tpm2.IsTPMParameterError(err, tpm2.ErrorValue, tpm2.CommandPolicyAuthorize, 1) {
+			return nil, dynamicPolicyDataError{errors.New("the PCR policy is invalid")}
+		}
+		return nil, xerrors.Errorf("PCR policy check failed: %w", err)
+	}
+
+	if delegation.maxPolicyCount > 0 {
+		if policyCounter == nil {
+			return nil, dynamicPolicyDataError{errors.New("PCR policy authorization delegation requires a PCR policy counter")}
+		}
+		operandB := make([]byte, 8)
+		binary.BigEndian.PutUint64(operandB, delegation.maxPolicyCount)
+		if err := tpm.PolicyNV(policyCounter, policyCounter, policySession, operandB, 0, tpm2.OpUnsignedLE, nil, extraSessions...); err != nil {
+			if tpm2.IsTPMError(err, tpm2.ErrorPolicy, tpm2.CommandPolicyNV) {
+				return nil, dynamicPolicyDataError{errors.New("the PCR policy authorization delegation has expired")}
+			}
+			return nil, xerrors.Errorf("PCR policy authorization delegation expiry check failed: %w", err)
+		}
+	}
+
+	digest, err := tpm.PolicyGetDigest(policySession, extraSessions...)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain current session digest: %w", err)
+	}
+	return digest, nil
+}
+
+// PolicyAuthDelegation authorizes an intermediate key to sign PCR policies for a family of related sealed key objects on behalf of
+// the key returned from SealKeyToTPM, which is referred to here as the root key. This allows the root key to be kept offline, with
+// only the intermediate key being present on the infrastructure that computes PCR policies. A PolicyAuthDelegation is created with
+// NewPolicyAuthDelegation and is used with UpdateKeyPCRProtectionPolicyWithDelegation.
+//
+// A delegation is scoped to sealed key objects that share the same root key and PCR policy counter. It can optionally expire once
+// the PCR policy counter is incremented past a specified value, which happens whenever the PCR policy is updated with the root key
+// by UpdateKeyPCRProtectionPolicy.
+type PolicyAuthDelegation struct {
+	policyAuthDelegation
+	pcrPolicyCounterName tpm2.Name // Name of the PCR policy counter that the delegation is scoped to, or empty
+	sessionAlg           tpm2.HashAlgorithmId
+}
+
+// PolicyAuthDelegationParams provides parameters to NewPolicyAuthDelegation.
+type PolicyAuthDelegationParams struct {
+	// PCRPolicyCounterNameAlg is the name algorithm of the PCR policy counter of the sealed key objects, which is required to
+	// compute its name without access to the TPM. See the PCRPolicyCounterNameAlg field of KeyCreationParams. If this is not set,
+	// tpm2.HashAlgorithmSHA256 is used.
+	PCRPolicyCounterNameAlg tpm2.HashAlgorithmId
+
+	// MaxPCRPolicyCount is the maximum value of the PCR policy counter for which the delegation is valid. Zero means that the
+	// delegation doesn't expire. This can only be set for sealed key objects that have a PCR policy counter.
+	MaxPCRPolicyCount uint64
+}
+
+// NewPolicyAuthDelegation creates an authorization for the supplied intermediate key to sign PCR policies for the supplied sealed
+// key object and any other sealed key objects that are related to it. The private part of the root key returned from SealKeyToTPM
+// must be supplied via the rootKey argument. This does not require access to the TPM, so it can be performed offline. The
+// intermediate key must be from elliptic.P256.
+//
+// Delegation is only supported for version 3 and later key data files.
+func NewPolicyAuthDelegation(k *SealedKeyObject, rootKey TPMPolicyAuthKey, intermediateKey *ecdsa.PublicKey, params *PolicyAuthDelegationParams) (*PolicyAuthDelegation, error) {
+	if k.data.version < 3 {
+		return nil, errors.New("PCR policy authorization delegation requires a version 3 or later key data file")
+	}
+	if intermediateKey == nil || intermediateKey.Curve != elliptic.P256() {
+		return nil, errors.New("intermediate key must be from elliptic.P256")
+	}
+	if params == nil {
+		params = &PolicyAuthDelegationParams{}
+	}
+
+	rootPublic := k.data.staticPolicyData.authPublicKey
+	root, err := createECDSAPrivateKeyFromTPM(rootPublic, tpm2.ECCParameter(rootKey))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create root key: %w", err)
+	}
+	if x, y := root.Curve.ScalarBaseMult(rootKey); x.Cmp(root.X) != 0 || y.Cmp(root.Y) != 0 {
+		return nil, errors.New("root key does not correspond to the sealed key object")
+	}
+	rootName, err := rootPublic.Name()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute name of root key: %w", err)
+	}
+
+	var counterName tpm2.Name
+	if handle := k.data.staticPolicyData.pcrPolicyCounterHandle; handle != tpm2.HandleNull {
+		nameAlg := params.PCRPolicyCounterNameAlg
+		if nameAlg == tpm2.HashAlgorithmId(0) || nameAlg == tpm2.HashAlgorithmNull {
+			nameAlg = tpm2.HashAlgorithmSHA256
+		}
+		counterName, err = computePcrPolicyCounterName(handle, nameAlg, rootName)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute name of PCR policy counter: %w", err)
+		}
+	} else if params.MaxPCRPolicyCount > 0 {
+		return nil, errors.New("cannot set MaxPCRPolicyCount for a sealed key object without a PCR policy counter")
+	}
+
+	intermediatePublic := createTPMPublicAreaForECDSAKey(intermediateKey)
+	intermediateName, err := intermediatePublic.Name()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute name of intermediate key: %w", err)
+	}
+
+	pcrPolicyRef := computePcrPolicyRefFromCounterName(counterName)
+	sessionAlg := k.data.keyPublic.NameAlg
+	delegatedPolicy, err := computeDelegatedPolicy(sessionAlg, pcrPolicyRef, intermediateName, counterName, params.MaxPCRPolicyCount)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute delegated policy: %w", err)
+	}
+
+	h := rootPublic.NameAlg.NewHash()
+	h.Write(delegatedPolicy)
+	h.Write(pcrPolicyRef)
+
+	sigR, sigS, err := ecdsa.Sign(rand.Reader, root, h.Sum(nil))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot sign delegated policy: %w", err)
+	}
+
+	return &PolicyAuthDelegation{
+		policyAuthDelegation: policyAuthDelegation{
+			intermediateKey: intermediatePublic,
+			maxPolicyCount:  params.MaxPCRPolicyCount,
+			signature: &tpm2.Signature{
+				SigAlg: tpm2.SigSchemeAlgECDSA,
+				Signature: tpm2.SignatureU{
+					Data: &tpm2.SignatureECDSA{
+						Hash:       rootPublic.NameAlg,
+						SignatureR: sigR.Bytes(),
+						SignatureS: sigS.Bytes()}}}},
+		pcrPolicyCounterName: counterName,
+		sessionAlg:           sessionAlg}, nil
+}
+
+// policyAuthDelegationFileRaw is the serialized form of PolicyAuthDelegation.
+type policyAuthDelegationFileRaw struct {
+	Delegation           policyAuthDelegationRaw
+	PCRPolicyCounterName tpm2.Name
+	SessionAlg           tpm2.HashAlgorithmId
+}
+
+// MarshalBinary serializes this delegation so that it can be transferred from the system that holds the root key to the system
+// that holds the intermediate key.
+func (d *PolicyAuthDelegation) MarshalBinary() ([]byte, error) {
+	return mu.MarshalToBytes(policyAuthDelegationFileRaw{
+		Delegation:           *makePolicyAuthDelegationRaw(&d.policyAuthDelegation),
+		PCRPolicyCounterName: d.pcrPolicyCounterName,
+		SessionAlg:           d.sessionAlg})
+}
+
+// UnmarshalBinary deserializes a delegation that was serialized with MarshalBinary.
+func (d *PolicyAuthDelegation) UnmarshalBinary(data []byte) error {
+	var raw policyAuthDelegationFileRaw
+	if _, err := mu.UnmarshalFromBytes(data, &raw); err != nil {
+		return xerrors.Errorf("cannot unmarshal delegation: %w", err)
+	}
+	*d = PolicyAuthDelegation{
+		policyAuthDelegation: *raw.Delegation.data(),
+		pcrPolicyCounterName: raw.PCRPolicyCounterName,
+		sessionAlg:           raw.SessionAlg}
+	return nil
+}
+
+// UpdateKeyPCRProtectionPolicyWithDelegation updates the PCR protection policy for the related sealed keys at the paths specified
+// by the keyPaths argument to the profile defined by the pcrProfile argument, using an intermediate key that has been authorized by
+// the supplied delegation. The private part of the intermediate key must be supplied via the intermediateKey argument.
+//
+// Because the PCR policy counter can only be incremented with the root key, updating the PCR policy with an intermediate key does
+// not revoke the previous PCR policy. Previous policies can be revoked by updating the PCR policy with the root key with
+// UpdateKeyPCRProtectionPolicyMultiple, which also expires any delegation with a MaxPCRPolicyCount lower than the new value of the
+// counter.
+//
+// If any file cannot be opened, a wrapped *os.PathError error will be returned. If any file cannot be deserialized correctly,
+// validation of a file fails or the delegation is not valid for the sealed keys, a InvalidKeyFileError error will be returned.
+//
+// On success, each sealed key data file is updated atomically with an updated authorization policy that includes a PCR policy
+// computed from the supplied PCRProtectionProfile and signed by the intermediate key.
+func UpdateKeyPCRProtectionPolicyWithDelegation(tpmConn *TPMConnection, keyPaths []string, delegation *PolicyAuthDelegation, intermediateKey *ecdsa.PrivateKey,
+	pcrProfile *PCRProtectionProfile) error {
+	tpm := tpmConn.TPMContext
+	session, err := tpmConn.secretSession()
+	if err != nil {
+		return err
+	}
+
+	if len(keyPaths) == 0 {
+		return errors.New("no key files supplied")
+	}
+	if delegation == nil {
+		return errors.New("no delegation supplied")
+	}
+	if intermediateKey == nil {
+		return errors.New("no intermediate key supplied")
+	}
+	intermediateName, err := createTPMPublicAreaForECDSAKey(&intermediateKey.PublicKey).Name()
+	if err != nil {
+		return xerrors.Errorf("cannot compute name of intermediate key: %w", err)
+	}
+	delegatedName, err := delegation.intermediateKey.Name()
+	if err != nil {
+		return xerrors.Errorf("cannot compute name of delegated key: %w", err)
+	}
+	if !bytes.Equal(intermediateName, delegatedName) {
+		return errors.New("intermediate key does not correspond to the delegation")
+	}
+
+	var datas []*keyData
+	var pcrPolicyCounterPub *tpm2.NVPublic
+	for i, p := range keyPaths {
+		keyFile, err := os.Open(p)
+		if err != nil {
+			return xerrors.Errorf("cannot open key data file: %w", err)
+		}
+		defer keyFile.Close()
+
+		data, _, counterPub, err := decodeAndValidateKeyData(tpm, keyFile, nil, session)
+		if err != nil {
+			if isKeyFileError(err) {
+				return InvalidKeyFileError{err.Error() + " (" + p + ")"}
+			}
+			return xerrors.Errorf("cannot read and validate key data file: %w", err)
+		}
+		if data.version < 3 {
+			return InvalidKeyFileError{"PCR policy authorization delegation requires a version 3 or later key data file (" + p + ")"}
+		}
+		if i == 0 {
+			pcrPolicyCounterPub = counterPub
+		} else if !bytes.Equal(data.keyPublic.AuthPolicy, datas[0].keyPublic.AuthPolicy) {
+			return InvalidKeyFileError{"key data file " + p + " is not a related key file"}
+		}
+		datas = append(datas, data)
+	}
+
+	var counterName tpm2.Name
+	var policyCount uint64
+	if pcrPolicyCounterPub != nil {
+		counterName, err = pcrPolicyCounterPub.Name()
+		if err != nil {
+			return xerrors.Errorf("cannot compute name of PCR policy counter: %w", err)
+		}
+		// The counter can't be incremented with the intermediate key, so the new PCR policy uses the current value.
+		policyCount, err = readPcrPolicyCounter(tpm, datas[0].version, pcrPolicyCounterPub, nil, session)
+		if err != nil {
+			return xerrors.Errorf("cannot read PCR policy counter: %w", err)
+		}
+		if delegation.maxPolicyCount > 0 && policyCount > delegation.maxPolicyCount {
+			return InvalidKeyFileError{"the PCR policy authorization delegation has expired"}
+		}
+	}
+	if !bytes.Equal(counterName, delegation.pcrPolicyCounterName) || delegation.sessionAlg != datas[0].keyPublic.NameAlg {
+		return InvalidKeyFileError{"the PCR policy authorization delegation is not valid for the supplied key data files"}
+	}
+
+	if pcrProfile == nil {
+		pcrProfile = &PCRProtectionProfile{}
+	}
+	policyData, err := computeSealedKeyDynamicAuthPolicyWithCount(tpm, datas[0].version, datas[0].keyPublic.NameAlg, delegation.intermediateKey.NameAlg,
+		intermediateKey, counterName, policyCount, pcrProfile, session)
+	if err != nil {
+		return xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
+	}
+	d := delegation.policyAuthDelegation
+	policyData.delegation = &d
+
+	var keyIDs []KeyID
+	for i, data := range datas {
+		data.dynamicPolicyData = policyData
+		data.tpmFirmwareInfo = tpmConn.firmwareInfo
+		if data.identity == nil {
+			identity, err := newKeyIdentity()
+			if err != nil {
+				return xerrors.Errorf("cannot create key identity: %w", err)
+			}
+			data.identity = identity
+		} else {
+			data.identity.Generation++
+		}
+
+		if err := data.writeToFileAtomic(keyPaths[i]); err != nil {
+			return xerrors.Errorf("cannot write key data file: %v", err)
+		}
+		keyIDs = append(keyIDs, data.keyIDs()...)
+	}
+
+	return tpmConn.recordAuditEvent(AuditEventReseal, keyIDs, fmt.Sprintf("delegated to key %x", delegatedName))
+}
@@ -0,0 +1,168 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/snapcore/secboot"
+)
+
+func TestPolicyAuthDelegation(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestPolicyAuthDelegation_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	rootKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	delegate := func(t *testing.T, maxCount uint64) *PolicyAuthDelegation {
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		d, err := NewPolicyAuthDelegation(k, rootKey, &intermediateKey.PublicKey, &PolicyAuthDelegationParams{MaxPCRPolicyCount: maxCount})
+		if err != nil {
+			t.Fatalf("NewPolicyAuthDelegation failed: %v", err)
+		}
+
+		// Make sure that the delegation survives being transferred to another system.
+		b, err := d.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary failed: %v", err)
+		}
+		var out PolicyAuthDelegation
+		if err := out.UnmarshalBinary(b); err != nil {
+			t.Fatalf("UnmarshalBinary failed: %v", err)
+		}
+		return &out
+	}
+
+	unseal := func(t *testing.T) {
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("Unexpected unsealed key")
+		}
+	}
+
+	readCounter := func(t *testing.T) uint64 {
+		index, err := tpm.CreateResourceContextFromTPM(0x01810000)
+		if err != nil {
+			t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+		}
+		c, err := tpm.NVReadCounter(index, index, nil)
+		if err != nil {
+			t.Fatalf("NVReadCounter failed: %v", err)
+		}
+		return c
+	}
+
+	t.Run("NoExpiry", func(t *testing.T) {
+		d := delegate(t, 0)
+		if err := UpdateKeyPCRProtectionPolicyWithDelegation(tpm, []string{keyFile}, d, intermediateKey, getTestPCRProfile()); err != nil {
+			t.Fatalf("UpdateKeyPCRProtectionPolicyWithDelegation failed: %v", err)
+		}
+		unseal(t)
+
+		// Updating the policy with the root key replaces the delegated policy.
+		if err := UpdateKeyPCRProtectionPolicy(tpm, keyFile, rootKey, getTestPCRProfile()); err != nil {
+			t.Fatalf("UpdateKeyPCRProtectionPolicy failed: %v", err)
+		}
+		unseal(t)
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		d := delegate(t, readCounter(t))
+		if err := UpdateKeyPCRProtectionPolicyWithDelegation(tpm, []string{keyFile}, d, intermediateKey, getTestPCRProfile()); err != nil {
+			t.Fatalf("UpdateKeyPCRProtectionPolicyWithDelegation failed: %v", err)
+		}
+		unseal(t)
+
+		if err := UpdateKeyPCRProtectionPolicy(tpm, keyFile, rootKey, getTestPCRProfile()); err != nil {
+			t.Fatalf("UpdateKeyPCRProtectionPolicy failed: %v", err)
+		}
+		err := UpdateKeyPCRProtectionPolicyWithDelegation(tpm, []string{keyFile}, d, intermediateKey, getTestPCRProfile())
+		if _, ok := err.(InvalidKeyFileError); !ok || err.Error() != "invalid key data file: the PCR policy authorization delegation has expired" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("WrongIntermediateKey", func(t *testing.T) {
+		d := delegate(t, 0)
+		otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+		err = UpdateKeyPCRProtectionPolicyWithDelegation(tpm, []string{keyFile}, d, otherKey, getTestPCRProfile())
+		if err == nil || err.Error() != "intermediate key does not correspond to the delegation" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("WrongRootKey", func(t *testing.T) {
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+		_, err = NewPolicyAuthDelegation(k, otherKey.D.Bytes(), &intermediateKey.PublicKey, nil)
+		if err == nil || err.Error() != "root key does not correspond to the sealed key object" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
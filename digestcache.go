@@ -0,0 +1,238 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/osutil/sys"
+
+	"golang.org/x/xerrors"
+)
+
+// EFIImageDigestCache is a cache of PE image digests, used to avoid re-hashing large images each time that a PCR profile is
+// computed. Entries are keyed by the identity of the file that an image is read from and the digest algorithm. The identity of a
+// file includes its device, inode, size and modification time, so an entry is not used after the file is modified or replaced.
+//
+// Images are only cached if their identity can be determined. This is the case for FileEFIImage, SnapFileEFIImage, HTTPEFIImage
+// and ZBootPayloadEFIImage wrapping any of these. Other implementations of EFIImage are always hashed.
+//
+// A EFIImageDigestCache is safe for concurrent use.
+type EFIImageDigestCache struct {
+	path string
+	key  []byte
+
+	mu      sync.Mutex
+	entries map[string]tpm2.Digest
+	dirty   bool
+}
+
+// NewEFIImageDigestCache returns a new, empty EFIImageDigestCache that is only held in memory.
+func NewEFIImageDigestCache() *EFIImageDigestCache {
+	return &EFIImageDigestCache{entries: make(map[string]tpm2.Digest)}
+}
+
+// efiImageDigestCacheFile is the on-disk form of a persistent EFIImageDigestCache.
+type efiImageDigestCacheFile struct {
+	Entries map[string]tpm2.Digest `json:"entries"`
+	HMAC    []byte                 `json:"hmac"`
+}
+
+// computeEFIImageDigestCacheHMAC computes the HMAC-SHA256 of the supplied entries with the supplied key. The entries are encoded as
+// JSON first, which sorts them by key so that the encoding is deterministic.
+func computeEFIImageDigestCacheHMAC(key []byte, entries map[string]tpm2.Digest) ([]byte, error) {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil), nil
+}
+
+// LoadEFIImageDigestCache loads a persistent EFIImageDigestCache from the file at the specified path. If the file does not exist,
+// an empty cache is returned. Changes to the returned cache are written back to the same path by Save.
+//
+// The cache file is authenticated with a HMAC-SHA256 computed using the supplied key, so that its entries can't be modified by
+// anyone who doesn't know the key in order to influence the computed PCR profiles. The key should be a random secret of at least
+// 32 bytes that is not stored alongside the cache file. If the cache file fails authentication, an error is returned. The caller
+// can then start again with an empty cache by removing the file.
+func LoadEFIImageDigestCache(path string, key []byte) (*EFIImageDigestCache, error) {
+	if len(key) == 0 {
+		return nil, errors.New("no key provided")
+	}
+
+	c := NewEFIImageDigestCache()
+	c.path = path
+	c.key = append([]byte(nil), key...)
+
+	f, err := os.Open(path)
+	switch {
+	case os.IsNotExist(err):
+		return c, nil
+	case err != nil:
+		return nil, xerrors.Errorf("cannot open cache file: %w", err)
+	}
+	defer f.Close()
+
+	var data efiImageDigestCacheFile
+	if err := json.NewDecoder(f).Decode(&data); err != nil {
+		return nil, xerrors.Errorf("cannot decode cache file: %w", err)
+	}
+	expected, err := computeEFIImageDigestCacheHMAC(c.key, data.Entries)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute HMAC: %w", err)
+	}
+	if !hmac.Equal(data.HMAC, expected) {
+		return nil, errors.New("cannot authenticate cache file")
+	}
+	if data.Entries != nil {
+		c.entries = data.Entries
+	}
+
+	return c, nil
+}
+
+// Save atomically writes the contents of this cache to the path that it was loaded from, if it has been modified. It does nothing
+// for a cache created with NewEFIImageDigestCache.
+func (c *EFIImageDigestCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.path == "" || !c.dirty {
+		return nil
+	}
+
+	f, err := osutil.NewAtomicFile(c.path, 0600, 0, sys.UserID(osutil.NoChown), sys.GroupID(osutil.NoChown))
+	if err != nil {
+		return xerrors.Errorf("cannot create new atomic file: %w", err)
+	}
+	defer f.Cancel()
+
+	mac, err := computeEFIImageDigestCacheHMAC(c.key, c.entries)
+	if err != nil {
+		return xerrors.Errorf("cannot compute HMAC: %w", err)
+	}
+	if err := json.NewEncoder(f).Encode(&efiImageDigestCacheFile{Entries: c.entries, HMAC: mac}); err != nil {
+		return xerrors.Errorf("cannot write to temporary file: %w", err)
+	}
+
+	if err := f.Commit(); err != nil {
+		return xerrors.Errorf("cannot atomically replace file: %w", err)
+	}
+
+	c.dirty = false
+	return nil
+}
+
+func (c *EFIImageDigestCache) get(key string) (tpm2.Digest, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.entries[key]
+	return d, ok
+}
+
+func (c *EFIImageDigestCache) put(key string, digest tpm2.Digest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = digest
+	c.dirty = true
+}
+
+// fileIdentity returns a string that identifies the current version of the file at the specified path.
+func fileIdentity(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	dev, ino, ok := fileDeviceAndInode(fi)
+	if !ok {
+		return "", fmt.Errorf("cannot obtain identity of %s", path)
+	}
+	return fmt.Sprintf("%s:%d:%d:%d:%d", path, dev, ino, fi.Size(), fi.ModTime().UnixNano()), nil
+}
+
+// efiImageIdentity returns a string that identifies the contents of the supplied image, for use as a cache key. It returns false if
+// the identity of the image can't be determined.
+func efiImageIdentity(image EFIImage) (string, bool) {
+	switch i := image.(type) {
+	case FileEFIImage:
+		id, err := fileIdentity(string(i))
+		if err != nil {
+			return "", false
+		}
+		return "file:" + id, true
+	case SnapFileEFIImage:
+		id, err := fileIdentity(i.Path)
+		if err != nil {
+			return "", false
+		}
+		return "snap:" + id + ":" + i.FileName, true
+	case *HTTPEFIImage:
+		// The contents of the image are pinned by its digest.
+		return fmt.Sprintf("http:%s:%d:%x", i.URL, i.DigestAlg, i.Digest), true
+	case ZBootPayloadEFIImage:
+		id, ok := efiImageIdentity(i.Image)
+		if !ok {
+			return "", false
+		}
+		return id + ":zboot-payload", true
+	default:
+		return "", false
+	}
+}
+
+// computePeImageDigestWithCache computes a hash of a PE image as computePeImageDigest does, using the supplied cache to avoid
+// re-hashing images that have already been hashed. If cache is nil, the image is always hashed.
+func computePeImageDigestWithCache(cache *EFIImageDigestCache, alg tpm2.HashAlgorithmId, image EFIImage) (tpm2.Digest, error) {
+	if cache == nil {
+		return computePeImageDigest(alg, image)
+	}
+
+	id, ok := efiImageIdentity(image)
+	if !ok {
+		return computePeImageDigest(alg, image)
+	}
+	key := fmt.Sprintf("%s/%d", id, alg)
+
+	if digest, ok := cache.get(key); ok {
+		return digest, nil
+	}
+
+	digest, err := computePeImageDigest(alg, image)
+	if err != nil {
+		return nil, err
+	}
+	cache.put(key, digest)
+	return digest, nil
+}
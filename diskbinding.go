@@ -0,0 +1,275 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/tcglog-parser"
+
+	"golang.org/x/xerrors"
+)
+
+const defaultLogicalBlockSize = 512
+
+var gptHeaderSignature = []byte("EFI PART")
+
+// gptHeader corresponds to the fields of the GPT header that are used to locate the partition entries.
+type gptHeader struct {
+	Signature                [8]byte
+	Revision                 uint32
+	HeaderSize               uint32
+	HeaderCRC32              uint32
+	Reserved                 uint32
+	MyLBA                    uint64
+	AlternateLBA             uint64
+	FirstUsableLBA           uint64
+	LastUsableLBA            uint64
+	DiskGUID                 tcglog.EFIGUID
+	PartitionEntryLBA        uint64
+	NumberOfPartitionEntries uint32
+	SizeOfPartitionEntry     uint32
+}
+
+// gptPartitionEntryHeader corresponds to the fields at the start of a GPT partition entry.
+type gptPartitionEntryHeader struct {
+	PartitionTypeGUID   tcglog.EFIGUID
+	UniquePartitionGUID tcglog.EFIGUID
+}
+
+// DiskIdentity identifies a GPT partitioned disk and the partitions on it that a sealed key is intended to unlock. It is
+// recorded in the key data file so that a key data file presented for a different disk (eg, because a disk image containing it
+// has been cloned to another device without being reprovisioned) can be detected before it is used.
+type DiskIdentity struct {
+	DiskGUID       tcglog.EFIGUID
+	PartitionGUIDs []tcglog.EFIGUID
+}
+
+// hasPartition indicates whether the partition with the specified GUID is one of the partitions in this identity.
+func (d *DiskIdentity) hasPartition(guid tcglog.EFIGUID) bool {
+	for _, p := range d.PartitionGUIDs {
+		if p == guid {
+			return true
+		}
+	}
+	return false
+}
+
+// diskIdentityRaw is the on-disk form of DiskIdentity, with each GUID encoded as 16 bytes in the EFI_GUID byte order.
+type diskIdentityRaw struct {
+	DiskGUID       []byte
+	PartitionGUIDs [][]byte
+}
+
+func encodeEFIGUID(guid tcglog.EFIGUID) []byte {
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, guid)
+	return b.Bytes()
+}
+
+func decodeEFIGUID(b []byte) (out tcglog.EFIGUID, err error) {
+	if len(b) != 16 {
+		return out, fmt.Errorf("invalid GUID length %d", len(b))
+	}
+	err = binary.Read(bytes.NewReader(b), binary.LittleEndian, &out)
+	return out, err
+}
+
+func makeDiskIdentityRaw(d *DiskIdentity) *diskIdentityRaw {
+	raw := &diskIdentityRaw{DiskGUID: encodeEFIGUID(d.DiskGUID)}
+	for _, p := range d.PartitionGUIDs {
+		raw.PartitionGUIDs = append(raw.PartitionGUIDs, encodeEFIGUID(p))
+	}
+	return raw
+}
+
+func (r *diskIdentityRaw) data() (*DiskIdentity, error) {
+	guid, err := decodeEFIGUID(r.DiskGUID)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid disk GUID: %w", err)
+	}
+	out := &DiskIdentity{DiskGUID: guid}
+	for _, p := range r.PartitionGUIDs {
+		guid, err := decodeEFIGUID(p)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid partition GUID: %w", err)
+		}
+		out.PartitionGUIDs = append(out.PartitionGUIDs, guid)
+	}
+	return out, nil
+}
+
+// partitionDiskAndNumber returns the path of the disk that contains the partition block device at the specified path, along with
+// the partition number and the logical block size of the disk.
+func partitionDiskAndNumber(path string) (disk string, partition int, blockSize int64, err error) {
+	dev, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", 0, 0, xerrors.Errorf("cannot resolve device path: %w", err)
+	}
+	sysPath := filepath.Join(sysClassBlockPath, filepath.Base(dev))
+
+	b, err := ioutil.ReadFile(filepath.Join(sysPath, "partition"))
+	switch {
+	case os.IsNotExist(err):
+		return "", 0, 0, fmt.Errorf("%s is not a partition", path)
+	case err != nil:
+		return "", 0, 0, xerrors.Errorf("cannot determine partition number: %w", err)
+	}
+	partition, err = strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || partition < 1 {
+		return "", 0, 0, fmt.Errorf("invalid partition number for %s", path)
+	}
+
+	// The sysfs entry for a partition is a child of the entry for the disk that contains it.
+	sysPath, err = filepath.EvalSymlinks(sysPath)
+	if err != nil {
+		return "", 0, 0, xerrors.Errorf("cannot resolve sysfs path: %w", err)
+	}
+	name := filepath.Base(filepath.Dir(sysPath))
+
+	blockSize = defaultLogicalBlockSize
+	if b, err := ioutil.ReadFile(filepath.Join(sysClassBlockPath, name, "queue", "logical_block_size")); err == nil {
+		if n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err == nil && n > 0 {
+			blockSize = n
+		}
+	}
+
+	return filepath.Join(devPath, name), partition, blockSize, nil
+}
+
+// readGPTIdentity reads the disk GUID and the unique GUID of the specified partition from the primary GPT header and partition
+// table of the disk read from r.
+func readGPTIdentity(r io.ReaderAt, blockSize int64, partition int) (disk, part tcglog.EFIGUID, err error) {
+	var hdr gptHeader
+	if err := binary.Read(io.NewSectionReader(r, blockSize, blockSize), binary.LittleEndian, &hdr); err != nil {
+		return disk, part, xerrors.Errorf("cannot read GPT header: %w", err)
+	}
+	if !bytes.Equal(hdr.Signature[:], gptHeaderSignature) {
+		return disk, part, errors.New("disk does not have a GPT")
+	}
+	if uint32(partition) > hdr.NumberOfPartitionEntries {
+		return disk, part, fmt.Errorf("partition %d is not in the GPT", partition)
+	}
+	if hdr.SizeOfPartitionEntry < 128 {
+		return disk, part, errors.New("invalid GPT partition entry size")
+	}
+
+	offset := int64(hdr.PartitionEntryLBA)*blockSize + int64(partition-1)*int64(hdr.SizeOfPartitionEntry)
+	var entry gptPartitionEntryHeader
+	if err := binary.Read(io.NewSectionReader(r, offset, int64(hdr.SizeOfPartitionEntry)), binary.LittleEndian, &entry); err != nil {
+		return disk, part, xerrors.Errorf("cannot read GPT partition entry: %w", err)
+	}
+	if entry.PartitionTypeGUID == (tcglog.EFIGUID{}) {
+		return disk, part, fmt.Errorf("GPT partition entry %d is unused", partition)
+	}
+
+	return hdr.DiskGUID, entry.UniquePartitionGUID, nil
+}
+
+// readPartitionGPTIdentity returns the disk GUID and the unique partition GUID of the partition block device at the specified
+// path.
+func readPartitionGPTIdentity(path string) (disk, part tcglog.EFIGUID, err error) {
+	diskPath, partition, blockSize, err := partitionDiskAndNumber(path)
+	if err != nil {
+		return disk, part, err
+	}
+
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return disk, part, xerrors.Errorf("cannot open disk: %w", err)
+	}
+	defer f.Close()
+
+	return readGPTIdentity(f, blockSize, partition)
+}
+
+// ReadDiskIdentity reads the GPT disk GUID and the unique partition GUIDs of the partition block devices at the specified paths,
+// so that they can be recorded in a sealed key data file by setting the DiskIdentity field of KeyCreationParams. All of the
+// partitions must be on the same disk. This requires read access to the disk that contains them.
+func ReadDiskIdentity(partitionDevicePaths ...string) (*DiskIdentity, error) {
+	if len(partitionDevicePaths) == 0 {
+		return nil, errors.New("no partitions supplied")
+	}
+
+	var out *DiskIdentity
+	for _, path := range partitionDevicePaths {
+		disk, part, err := readPartitionGPTIdentity(path)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read GPT identity of %s: %w", path, err)
+		}
+		switch {
+		case out == nil:
+			out = &DiskIdentity{DiskGUID: disk}
+		case out.DiskGUID != disk:
+			return nil, fmt.Errorf("%s is on a different disk", path)
+		}
+		out.PartitionGUIDs = append(out.PartitionGUIDs, part)
+	}
+	return out, nil
+}
+
+// DiskIdentity returns the identity of the disk and partitions that this sealed key object was sealed for, or nil if none was
+// recorded.
+func (k *SealedKeyObject) DiskIdentity() *DiskIdentity {
+	return k.data.diskIdentity
+}
+
+// CheckDiskIdentity verifies that the partition block device at the specified path is one of the partitions that this sealed key
+// object was sealed for, on the same disk. If no disk identity was recorded in the key data file, this returns nil. If the
+// partition doesn't match, a *DiskIdentityMismatchError error is returned.
+func (k *SealedKeyObject) CheckDiskIdentity(partitionDevicePath string) error {
+	if k.data.diskIdentity == nil {
+		return nil
+	}
+
+	disk, part, err := readPartitionGPTIdentity(partitionDevicePath)
+	if err != nil {
+		return xerrors.Errorf("cannot read GPT identity of %s: %w", partitionDevicePath, err)
+	}
+	if disk != k.data.diskIdentity.DiskGUID || !k.data.diskIdentity.hasPartition(part) {
+		return &DiskIdentityMismatchError{Path: partitionDevicePath, DiskGUID: disk, PartitionGUID: part}
+	}
+	return nil
+}
+
+// DiskIdentityCheckMode specifies how activation responds to a sealed key object that was sealed for a different disk or partition.
+type DiskIdentityCheckMode int
+
+const (
+	// DiskIdentityCheckEnforce causes activation with the sealed key to fail if the volume isn't one of the partitions that it was
+	// sealed for. This is the default.
+	DiskIdentityCheckEnforce DiskIdentityCheckMode = iota
+
+	// DiskIdentityCheckWarn causes a SecurityEventDiskIdentityMismatch event to be delivered if the volume isn't one of the
+	// partitions that the sealed key was sealed for, but activation continues.
+	DiskIdentityCheckWarn
+
+	// DiskIdentityCheckDisabled disables the check.
+	DiskIdentityCheckDisabled
+)
@@ -0,0 +1,182 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/tcglog-parser"
+	. "github.com/snapcore/secboot"
+
+	. "gopkg.in/check.v1"
+)
+
+var (
+	testDiskGUID       = tcglog.MakeEFIGUID(0x5c9f5a0d, 0x6e0b, 0x4b6e, 0x9b3d, [...]uint8{0x10, 0x2a, 0x4f, 0x6c, 0x81, 0x3e})
+	testPartitionGUIDs = []tcglog.EFIGUID{
+		tcglog.MakeEFIGUID(0xc12a7328, 0xf81f, 0x11d2, 0xba4b, [...]uint8{0x00, 0xa0, 0xc9, 0x3e, 0xc9, 0x3b}),
+		tcglog.MakeEFIGUID(0x0fc63daf, 0x8483, 0x4772, 0x8e79, [...]uint8{0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4})}
+	testPartitionTypeGUID = tcglog.MakeEFIGUID(0x0fc63daf, 0x8483, 0x4772, 0x8e79, [...]uint8{0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4})
+)
+
+// makeMockGPTDisk creates a mock sysfs tree and /dev directory containing a disk "sda" with a GPT and the specified partitions.
+func makeMockGPTDisk(t interface{ Fatalf(string, ...interface{}) }, dir string, diskGUID tcglog.EFIGUID, partitions []tcglog.EFIGUID) (sysClassBlock, dev string) {
+	sysClassBlock = filepath.Join(dir, "sys", "class", "block")
+	devices := filepath.Join(dir, "sys", "devices")
+	dev = filepath.Join(dir, "dev")
+	for _, d := range []string{sysClassBlock, filepath.Join(devices, "sda", "queue"), dev} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(devices, "sda", "queue", "logical_block_size"), []byte("512\n"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(devices, "sda"), filepath.Join(sysClassBlock, "sda")); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+
+	img := make([]byte, 34*512)
+	hdr := new(bytes.Buffer)
+	hdr.Write([]byte("EFI PART"))
+	binary.Write(hdr, binary.LittleEndian, struct {
+		Revision, HeaderSize, HeaderCRC32, Reserved  uint32
+		MyLBA, AlternateLBA, FirstUsable, LastUsable uint64
+		DiskGUID                                     tcglog.EFIGUID
+		PartitionEntryLBA                            uint64
+		NumEntries, EntrySize                        uint32
+	}{Revision: 0x10000, HeaderSize: 92, MyLBA: 1, DiskGUID: diskGUID, PartitionEntryLBA: 2, NumEntries: 128, EntrySize: 128})
+	copy(img[512:], hdr.Bytes())
+
+	for i, p := range partitions {
+		entry := new(bytes.Buffer)
+		binary.Write(entry, binary.LittleEndian, testPartitionTypeGUID)
+		binary.Write(entry, binary.LittleEndian, p)
+		copy(img[1024+i*128:], entry.Bytes())
+
+		name := "sda" + string('1'+rune(i))
+		if err := os.MkdirAll(filepath.Join(devices, "sda", name), 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(devices, "sda", name, "partition"), []byte(string('1'+rune(i))+"\n"), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		if err := os.Symlink(filepath.Join(devices, "sda", name), filepath.Join(sysClassBlock, name)); err != nil {
+			t.Fatalf("Symlink failed: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dev, name), nil, 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dev, "sda"), img, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return sysClassBlock, dev
+}
+
+type diskIdentitySuite struct{}
+
+var _ = Suite(&diskIdentitySuite{})
+
+func (s *diskIdentitySuite) TestReadDiskIdentity(c *C) {
+	sysClassBlock, dev := makeMockGPTDisk(c, c.MkDir(), testDiskGUID, testPartitionGUIDs)
+	restore := MockBlockDevicePaths(sysClassBlock, dev)
+	defer restore()
+
+	identity, err := ReadDiskIdentity(filepath.Join(dev, "sda2"))
+	c.Assert(err, IsNil)
+	c.Check(identity, DeepEquals, &DiskIdentity{DiskGUID: testDiskGUID, PartitionGUIDs: testPartitionGUIDs[1:]})
+
+	identity, err = ReadDiskIdentity(filepath.Join(dev, "sda1"), filepath.Join(dev, "sda2"))
+	c.Assert(err, IsNil)
+	c.Check(identity, DeepEquals, &DiskIdentity{DiskGUID: testDiskGUID, PartitionGUIDs: testPartitionGUIDs})
+}
+
+func (s *diskIdentitySuite) TestReadDiskIdentityNotPartition(c *C) {
+	sysClassBlock, dev := makeMockGPTDisk(c, c.MkDir(), testDiskGUID, testPartitionGUIDs)
+	restore := MockBlockDevicePaths(sysClassBlock, dev)
+	defer restore()
+
+	_, err := ReadDiskIdentity(filepath.Join(dev, "sda"))
+	c.Check(err, ErrorMatches, "cannot read GPT identity of .*/sda: .*/sda is not a partition")
+}
+
+func (s *diskIdentitySuite) TestReadDiskIdentityNoGPT(c *C) {
+	sysClassBlock, dev := makeMockGPTDisk(c, c.MkDir(), testDiskGUID, testPartitionGUIDs)
+	restore := MockBlockDevicePaths(sysClassBlock, dev)
+	defer restore()
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dev, "sda"), make([]byte, 34*512), 0644), IsNil)
+
+	_, err := ReadDiskIdentity(filepath.Join(dev, "sda1"))
+	c.Check(err, ErrorMatches, "cannot read GPT identity of .*/sda1: disk does not have a GPT")
+}
+
+func TestCheckDiskIdentity(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestCheckDiskIdentity_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	sysClassBlock, dev := makeMockGPTDisk(t, tmpDir, testDiskGUID, testPartitionGUIDs)
+	restore := MockBlockDevicePaths(sysClassBlock, dev)
+	defer restore()
+
+	identity, err := ReadDiskIdentity(filepath.Join(dev, "sda2"))
+	if err != nil {
+		t.Fatalf("ReadDiskIdentity failed: %v", err)
+	}
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	if _, err := SealKeyToTPMWithOptions(tpm, []*SealKeyRequest{{Key: make([]byte, 32), Path: keyFile}},
+		WithDiskIdentity(identity)); err != nil {
+		t.Fatalf("SealKeyToTPMWithOptions failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if k.DiskIdentity() == nil || k.DiskIdentity().DiskGUID != testDiskGUID {
+		t.Errorf("Unexpected disk identity: %v", k.DiskIdentity())
+	}
+
+	if err := k.CheckDiskIdentity(filepath.Join(dev, "sda2")); err != nil {
+		t.Errorf("CheckDiskIdentity failed: %v", err)
+	}
+	err = k.CheckDiskIdentity(filepath.Join(dev, "sda1"))
+	if e, ok := err.(*DiskIdentityMismatchError); !ok || e.PartitionGUID != testPartitionGUIDs[0] {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
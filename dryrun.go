@@ -0,0 +1,191 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// PlannedActionType describes how a PlannedAction affects its target.
+type PlannedActionType string
+
+const (
+	PlannedActionCreate  PlannedActionType = "create"
+	PlannedActionModify  PlannedActionType = "modify"
+	PlannedActionDestroy PlannedActionType = "destroy"
+)
+
+// PlannedAction describes a single mutation that an operation would perform. It is returned from the Plan* functions, which
+// perform a dry run of the corresponding operation without modifying anything.
+type PlannedAction struct {
+	Type        PlannedActionType
+	Target      string // The affected TPM object, NV index, hierarchy, keyslot or file
+	Description string // A human readable description of the action
+}
+
+func persistentHandleTarget(handle tpm2.Handle) string {
+	return fmt.Sprintf("persistent object 0x%08x", handle)
+}
+
+func nvIndexTarget(handle tpm2.Handle) string {
+	return fmt.Sprintf("NV index 0x%08x", handle)
+}
+
+func fileTarget(path string) string {
+	return "file " + path
+}
+
+// actionPlan records the mutations performed by an operation. When dryRun is true, the mutations are recorded without being
+// performed, so that the Plan* functions follow the same code path as the operations that they describe. A nil *actionPlan
+// performs every mutation without recording it.
+type actionPlan struct {
+	dryRun  bool
+	cleared bool // A dry run has cleared the TPM, so the TPM state that it observes is stale
+	actions []PlannedAction
+}
+
+func (p *actionPlan) isDryRun() bool {
+	return p != nil && p.dryRun
+}
+
+func (p *actionPlan) isCleared() bool {
+	return p != nil && p.cleared
+}
+
+// perform records the supplied actions and then calls fn to perform them, unless this is a dry run.
+func (p *actionPlan) perform(fn func() error, actions ...PlannedAction) error {
+	if p == nil {
+		return fn()
+	}
+	p.actions = append(p.actions, actions...)
+	if p.dryRun {
+		return nil
+	}
+	return fn()
+}
+
+// planClear records the persistent objects and NV indices that would be destroyed by clearing the TPM.
+func (p *actionPlan) planClear(t *TPMConnection, session tpm2.SessionContext) error {
+	persistent, err := t.GetCapabilityHandles(tpm2.HandleTypePersistent.BaseHandle(), tpm2.CapabilityMaxProperties, session)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain persistent handles: %w", err)
+	}
+	for _, h := range persistent {
+		if h >= 0x81800000 {
+			// Platform persistent objects aren't affected by TPM2_Clear.
+			continue
+		}
+		p.actions = append(p.actions, PlannedAction{
+			Type:        PlannedActionDestroy,
+			Target:      persistentHandleTarget(h),
+			Description: "evicted by clearing the TPM"})
+	}
+
+	indices, err := t.GetCapabilityHandles(tpm2.HandleTypeNVIndex.BaseHandle(), tpm2.CapabilityMaxProperties, session)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain NV index handles: %w", err)
+	}
+	for _, h := range indices {
+		index, err := t.CreateResourceContextFromTPM(h, session)
+		if err != nil {
+			return xerrors.Errorf("cannot create context for NV index 0x%08x: %w", h, err)
+		}
+		pub, _, err := t.NVReadPublic(index, session)
+		if err != nil {
+			return xerrors.Errorf("cannot read public area of NV index 0x%08x: %w", h, err)
+		}
+		if pub.Attrs&tpm2.AttrNVPlatformCreate > 0 {
+			// Indices created by the platform aren't affected by TPM2_Clear.
+			continue
+		}
+		p.actions = append(p.actions, PlannedAction{
+			Type:        PlannedActionDestroy,
+			Target:      nvIndexTarget(h),
+			Description: "undefined by clearing the TPM"})
+	}
+
+	p.cleared = true
+	return nil
+}
+
+// PlanProvisioning performs a dry run of TPMConnection.EnsureProvisioned with the specified mode, returning the actions that it
+// would perform without modifying the TPM. The dry run follows the same code path as EnsureProvisioned, including any provisioning
+// checkpoint left by an interrupted call. When mode is ProvisionModeClear (as used when resetting a device to factory settings),
+// the returned actions include every persistent object and NV index that would be destroyed by clearing the TPM.
+//
+// The checks that EnsureProvisioned performs before modifying the TPM are performed here as well, and return the same errors. If
+// mode is ProvisionModeWithoutLockout and the lockout hierarchy is required to fully provision the TPM, the actions are returned
+// along with a ErrTPMProvisioningRequiresLockout error, as EnsureProvisioned performs them before returning this error. Errors
+// that EnsureProvisioned could only detect by attempting the actions, such as authorization failures, are not reported.
+func (t *TPMConnection) PlanProvisioning(mode ProvisionMode) ([]PlannedAction, error) {
+	plan := &actionPlan{dryRun: true}
+	if err := t.runWithHierarchyAuth(func() error {
+		return t.ensureProvisioned(mode, nil, plan)
+	}); err != nil {
+		if err == ErrTPMProvisioningRequiresLockout {
+			return plan.actions, err
+		}
+		return nil, err
+	}
+	return plan.actions, nil
+}
+
+// keyLocationTarget returns the PlannedAction target for the specified key data location.
+func keyLocationTarget(location KeyLocation) string {
+	if path, ok := location.(FileKeyLocation); ok {
+		return fileTarget(string(path))
+	}
+	return "key data at " + location.String()
+}
+
+// PlanUpdateKeyPCRProtectionPolicy performs a dry run of UpdateKeyPCRProtectionPolicy and UpdateKeyPCRProtectionPolicyMultiple for
+// the key data files at the specified paths, returning the actions that they would perform without modifying the files or the TPM.
+// The files are validated in the same way, except that the PCR policy update key isn't required and so a new PCR policy isn't
+// computed.
+//
+// If any file cannot be opened, a wrapped *os.PathError error will be returned. If any file cannot be deserialized correctly or
+// validation of a file fails, a InvalidKeyFileError error will be returned.
+func PlanUpdateKeyPCRProtectionPolicy(tpm *TPMConnection, keyPaths []string) ([]PlannedAction, error) {
+	plan := &actionPlan{dryRun: true}
+	if err := updateKeyPCRProtectionPolicyCommon(tpm, fileKeyLocations(keyPaths), nil, nil, plan); err != nil {
+		return nil, err
+	}
+	return plan.actions, nil
+}
+
+// PlanInitializeLUKS2Container performs a dry run of InitializeLUKS2Container for the device at the specified path, returning the
+// actions that it would perform without modifying the device.
+func PlanInitializeLUKS2Container(devicePath string) ([]PlannedAction, error) {
+	if _, err := os.Stat(devicePath); err != nil {
+		return nil, xerrors.Errorf("cannot stat device: %w", err)
+	}
+
+	plan := &actionPlan{dryRun: true}
+	// The key isn't used during a dry run.
+	if err := initializeLUKS2Container(devicePath, "", make([]byte, 64), nil, plan); err != nil {
+		return nil, err
+	}
+	return plan.actions, nil
+}
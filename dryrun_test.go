@@ -0,0 +1,140 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io/ioutil"
+	"math/rand"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type dryRunSuite struct {
+	testutil.TPMSimulatorTestBase
+}
+
+var _ = Suite(&dryRunSuite{})
+
+func (s *dryRunSuite) srkName(c *C) tpm2.Name {
+	srk, err := s.TPM.CreateResourceContextFromTPM(tcg.SRKHandle)
+	c.Assert(err, IsNil)
+	return srk.Name()
+}
+
+func (s *dryRunSuite) TestPlanProvisioningUnprovisioned(c *C) {
+	// The lockout hierarchy hasn't been configured, so EnsureProvisioned would return an error after creating the primary keys.
+	actions, err := s.TPM.PlanProvisioning(ProvisionModeWithoutLockout)
+	c.Assert(err, Equals, ErrTPMProvisioningRequiresLockout)
+	c.Check(actions, DeepEquals, []PlannedAction{
+		{Type: PlannedActionCreate, Target: "persistent object 0x81010001", Description: "create and persist a new endorsement key"},
+		{Type: PlannedActionCreate, Target: "persistent object 0x81000001", Description: "create and persist a new storage root key"},
+	})
+
+	_, err = s.TPM.CreateResourceContextFromTPM(tcg.SRKHandle)
+	c.Check(tpm2.IsResourceUnavailableError(err, tcg.SRKHandle), Equals, true)
+}
+
+func (s *dryRunSuite) TestPlanProvisioningFull(c *C) {
+	c.Assert(s.TPM.EnsureProvisioned(ProvisionModeFull, nil), IsNil)
+	name := s.srkName(c)
+
+	actions, err := s.TPM.PlanProvisioning(ProvisionModeFull)
+	c.Assert(err, IsNil)
+	c.Assert(actions, HasLen, 7)
+	c.Check(actions[0], DeepEquals, PlannedAction{Type: PlannedActionDestroy, Target: "persistent object 0x81010001", Description: "evict the existing object"})
+	c.Check(actions[2], DeepEquals, PlannedAction{Type: PlannedActionDestroy, Target: "persistent object 0x81000001", Description: "evict the existing object"})
+	for _, a := range actions[4:] {
+		c.Check(a.Type, Equals, PlannedActionModify)
+		c.Check(a.Target, Equals, "lockout hierarchy")
+	}
+
+	c.Check(s.srkName(c), DeepEquals, name)
+}
+
+func (s *dryRunSuite) TestPlanProvisioningClear(c *C) {
+	c.Assert(s.TPM.EnsureProvisioned(ProvisionModeWithoutLockout, nil), IsNil)
+	name := s.srkName(c)
+
+	actions, err := s.TPM.PlanProvisioning(ProvisionModeClear)
+	c.Assert(err, IsNil)
+
+	var destroyed []string
+	for _, a := range actions {
+		if a.Type == PlannedActionDestroy {
+			destroyed = append(destroyed, a.Target)
+		}
+	}
+	c.Check(destroyed, DeepEquals, []string{"persistent object 0x81000001", "persistent object 0x81010001"})
+
+	c.Check(s.srkName(c), DeepEquals, name)
+}
+
+func (s *dryRunSuite) TestPlanProvisioningClearRequiresPPI(c *C) {
+	c.Assert(s.TPM.EnsureProvisioned(ProvisionModeFull, nil), IsNil)
+	_, err := s.TPM.PlanProvisioning(ProvisionModeClear)
+	c.Check(err, Equals, ErrTPMClearRequiresPPI)
+}
+
+func (s *dryRunSuite) TestPlanUpdateKeyPCRProtectionPolicy(c *C) {
+	c.Assert(s.TPM.EnsureProvisioned(ProvisionModeFull, nil), IsNil)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+	keyFile := c.MkDir() + "/keydata"
+
+	_, err := SealKeyToTPM(s.TPM, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x0181fff0})
+	c.Assert(err, IsNil)
+	policyCounter, err := s.TPM.CreateResourceContextFromTPM(0x0181fff0)
+	c.Assert(err, IsNil)
+	s.AddCleanupNVSpace(c, s.TPM.OwnerHandleContext(), policyCounter)
+
+	before, err := ioutil.ReadFile(keyFile)
+	c.Assert(err, IsNil)
+
+	actions, err := PlanUpdateKeyPCRProtectionPolicy(s.TPM, []string{keyFile})
+	c.Assert(err, IsNil)
+	c.Check(actions, DeepEquals, []PlannedAction{
+		{Type: PlannedActionModify, Target: "file " + keyFile, Description: "atomically replace with an updated PCR policy"},
+		{Type: PlannedActionModify, Target: "NV index 0x0181fff0", Description: "increment the PCR policy counter to revoke the previous PCR policy"},
+	})
+
+	after, err := ioutil.ReadFile(keyFile)
+	c.Assert(err, IsNil)
+	c.Check(after, DeepEquals, before)
+}
+
+func (s *dryRunSuite) TestPlanInitializeLUKS2Container(c *C) {
+	devicePath := c.MkDir() + "/device"
+	c.Assert(ioutil.WriteFile(devicePath, nil, 0600), IsNil)
+
+	actions, err := PlanInitializeLUKS2Container(devicePath)
+	c.Assert(err, IsNil)
+	c.Check(actions, DeepEquals, []PlannedAction{
+		{Type: PlannedActionDestroy, Target: "device " + devicePath, Description: "overwrite the existing header, making any data on the device irretrievable"},
+		{Type: PlannedActionCreate, Target: "device " + devicePath, Description: "create a new LUKS2 header"},
+		{Type: PlannedActionCreate, Target: "device " + devicePath + " keyslot 0", Description: "add the supplied key"},
+		{Type: PlannedActionModify, Target: "device " + devicePath + " keyslot 0", Description: "mark the keyslot as preferred"},
+	})
+}
@@ -20,10 +20,20 @@
 package secboot
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/snapcore/snapd/snap"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/snapcore/snapd/httputil"
+
+	"golang.org/x/xerrors"
 )
 
 const (
@@ -94,6 +104,79 @@ func (p FileEFIImage) Open() (interface {
 	return &fileEFIImageHandle{File: f, size: fi.Size()}, nil
 }
 
+type bytesEFIImageHandle struct {
+	*bytes.Reader
+}
+
+func (h *bytesEFIImageHandle) Close() error {
+	return nil
+}
+
+// HTTPEFIImage corresponds to a binary that is fetched over HTTP or HTTPS (eg, by a device that uses network boot), and that is
+// loaded, verified and executed before ExitBootServices. Because the remote image could change between being fetched here and being
+// fetched by the device, it must be pinned with the digest specified by the DigestAlg and Digest fields. Open will return an error
+// if the fetched image does not match. The image is only fetched once, and is cached in memory for subsequent calls to Open.
+type HTTPEFIImage struct {
+	URL       string
+	DigestAlg tpm2.HashAlgorithmId
+	Digest    tpm2.Digest
+	Client    *http.Client // The client used to fetch the image. A default client is used if this is nil
+
+	data []byte
+}
+
+func (i *HTTPEFIImage) String() string {
+	return i.URL
+}
+
+func (i *HTTPEFIImage) fetch() ([]byte, error) {
+	if !i.DigestAlg.Supported() {
+		return nil, errors.New("unsupported digest algorithm")
+	}
+
+	client := i.Client
+	if client == nil {
+		client = httputil.NewHTTPClient(&httputil.ClientOptions{Timeout: 30 * time.Second})
+	}
+
+	resp, err := client.Get(i.URL)
+	if err != nil {
+		return nil, xerrors.Errorf("GET request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET request failed: %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read body: %w", err)
+	}
+
+	h := i.DigestAlg.NewHash()
+	h.Write(data)
+	if !bytes.Equal(h.Sum(nil), i.Digest) {
+		return nil, fmt.Errorf("digest of image fetched from %s doesn't match the expected digest", i.URL)
+	}
+
+	return data, nil
+}
+
+func (i *HTTPEFIImage) Open() (interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}, error) {
+	if i.data == nil {
+		data, err := i.fetch()
+		if err != nil {
+			return nil, xerrors.Errorf("cannot fetch image: %w", err)
+		}
+		i.data = data
+	}
+	return &bytesEFIImageHandle{bytes.NewReader(i.data)}, nil
+}
+
 // EFIImageLoadEventSource corresponds to the source of a EFIImageLoadEvent.
 type EFIImageLoadEventSource int
 
@@ -115,3 +198,71 @@ type EFIImageLoadEvent struct {
 	Image  EFIImage                // The image
 	Next   []*EFIImageLoadEvent    // A list of possible subsequent EFIImageLoadEvents
 }
+
+// EFIShimAlternateBootPaths describes the additional images that shim can load during boots that don't follow the normal boot
+// path, for AddEFIShimAlternateBootPaths.
+type EFIShimAlternateBootPaths struct {
+	// Fallback is shim's fallback image (eg, fbx64.efi), which shim loads when it is executed from the removable media path
+	// without a boot entry. The fallback image restores the boot entries and then loads shim again via the firmware.
+	Fallback EFIImage
+
+	// MokManager is shim's MokManager image (eg, mmx64.efi), which shim loads when there is a pending MOK change request. The
+	// user can continue booting from MokManager without rebooting.
+	MokManager EFIImage
+}
+
+// AddEFIShimAlternateBootPaths extends the supplied EFI image load sequences in place, so that the PCR profiles computed from them
+// with AddEFIBootManagerProfile and AddEFISecureBootPolicyProfile are also valid for boots that go through shim's fallback image or
+// MokManager. For every event in the sequences that loads shim, the following alternative paths are added to its list of subsequent
+// events. If paths.MokManager is set, a path is added where shim loads MokManager, which then continues to any of the original
+// subsequent images. If paths.Fallback is set, a path is added where shim loads the fallback image, which then loads the same shim
+// image via the firmware, which then continues to any of the original subsequent images.
+//
+// Without this, the first boot after the boot entries are restored by the fallback image, or the boot following a MOK change
+// request, won't be able to unseal keys sealed with a PCR policy that was computed only for the normal boot path.
+func AddEFIShimAlternateBootPaths(sequences []*EFIImageLoadEvent, paths *EFIShimAlternateBootPaths) error {
+	visited := make(map[*EFIImageLoadEvent]bool)
+
+	var visit func(events []*EFIImageLoadEvent) error
+	visit = func(events []*EFIImageLoadEvent) error {
+		for _, e := range events {
+			if visited[e] {
+				continue
+			}
+			visited[e] = true
+
+			next := e.Next
+			if err := visit(next); err != nil {
+				return err
+			}
+
+			isShim, err := func() (bool, error) {
+				r, err := e.Image.Open()
+				if err != nil {
+					return false, xerrors.Errorf("cannot open image: %w", err)
+				}
+				defer r.Close()
+				return isShimExecutable(r)
+			}()
+			if err != nil {
+				return xerrors.Errorf("cannot determine type of %s: %w", e.Image, err)
+			}
+			if !isShim {
+				continue
+			}
+
+			if paths.MokManager != nil {
+				e.Next = append(e.Next, &EFIImageLoadEvent{Source: Shim, Image: paths.MokManager, Next: next})
+			}
+			if paths.Fallback != nil {
+				e.Next = append(e.Next, &EFIImageLoadEvent{
+					Source: Shim,
+					Image:  paths.Fallback,
+					Next:   []*EFIImageLoadEvent{{Source: Firmware, Image: e.Image, Next: next}}})
+			}
+		}
+		return nil
+	}
+
+	return visit(sequences)
+}
@@ -0,0 +1,86 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	"os"
+	"testing"
+
+	"github.com/snapcore/secboot/efi"
+)
+
+func TestComputePeImageDigest(t *testing.T) {
+	for _, data := range []struct {
+		desc   string
+		alg    crypto.Hash
+		path   string
+		digest []byte
+	}{
+		{
+			desc:   "SignedShimSHA256",
+			alg:    crypto.SHA256,
+			path:   "../testdata/mockshim1.efi.signed.1",
+			digest: decodeHexStringT(t, "1d91795a82b24a61c5b5f4b5843062fd10fc42e2d403c5a65f811014df231c9f"),
+		},
+		{
+			desc:   "SignedGrubSHA256",
+			alg:    crypto.SHA256,
+			path:   "../testdata/mockgrub1.efi.signed.shim",
+			digest: decodeHexStringT(t, "5a03ecd3cc4caf9eabc8d7295772c0b74e2998d1631bbde372acbf2ffad4031a"),
+		},
+		{
+			desc:   "SignedShimSHA1",
+			alg:    crypto.SHA1,
+			path:   "../testdata/mockshim1.efi.signed.1",
+			digest: decodeHexStringT(t, "2e65c395448b8fcfce99f0421bb396f7a66cc207"),
+		},
+		{
+			desc:   "UnsignedKernelSHA256",
+			alg:    crypto.SHA256,
+			path:   "../testdata/mockkernel1.efi",
+			digest: decodeHexStringT(t, "d74047a878cab6614ffc3569e6aff636470773c8b73dfb4288c54742e6c85945"),
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			f, err := os.Open(data.path)
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			defer f.Close()
+
+			fi, err := f.Stat()
+			if err != nil {
+				t.Fatalf("Stat failed: %v", err)
+			}
+
+			d, err := efi.ComputePeImageDigest(data.alg, f, fi.Size())
+			if err != nil {
+				t.Fatalf("ComputePeImageDigest failed: %v", err)
+			}
+			if !bytes.Equal(d, data.digest) {
+				t.Errorf("Unexpected digest (got %x)", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package efi provides functions for decoding and computing updates to EFI signature databases, and for computing Authenticode
+// digests of PE images. These are the same routines that secboot uses to compute secure boot policy profiles, and are exposed so
+// that signing infrastructure and audit tools can reuse them.
+package efi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/canonical/tcglog-parser"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	WinCertTypePKCSSignedData uint16 = 0x0002 // WIN_CERT_TYPE_PKCS_SIGNED_DATA
+	WinCertTypeEfiGuid        uint16 = 0x0EF1 // WIN_CERT_TYPE_EFI_GUID
+)
+
+var (
+	GlobalVariableGuid        = tcglog.MakeEFIGUID(0x8be4df61, 0x93ca, 0x11d2, 0xaa0d, [...]uint8{0x00, 0xe0, 0x98, 0x03, 0x2b, 0x8c}) // EFI_GLOBAL_VARIABLE
+	ImageSecurityDatabaseGuid = tcglog.MakeEFIGUID(0xd719b2cb, 0x3d3a, 0x4596, 0xa3bc, [...]uint8{0xda, 0xd0, 0x0e, 0x67, 0x65, 0x6f}) // EFI_IMAGE_SECURITY_DATABASE_GUID
+
+	CertX509Guid      = tcglog.MakeEFIGUID(0xa5c059a1, 0x94e4, 0x4aa7, 0x87b5, [...]uint8{0xab, 0x15, 0x5c, 0x2b, 0xf0, 0x72}) // EFI_CERT_X509_GUID
+	CertSHA1Guid      = tcglog.MakeEFIGUID(0x826ca512, 0xcf10, 0x4ac9, 0xb187, [...]uint8{0xbe, 0x01, 0x49, 0x66, 0x31, 0xbd}) // EFI_CERT_SHA1_GUID
+	CertSHA256Guid    = tcglog.MakeEFIGUID(0xc1c41626, 0x504c, 0x4092, 0xaca9, [...]uint8{0x41, 0xf9, 0x36, 0x93, 0x43, 0x28}) // EFI_CERT_SHA256_GUID
+	CertTypePkcs7Guid = tcglog.MakeEFIGUID(0x4aafd29d, 0x68df, 0x49ee, 0x8aa9, [...]uint8{0x34, 0x7d, 0x37, 0x56, 0x65, 0xa7}) // EFI_CERT_TYPE_PKCS7_GUID
+)
+
+// WinCertificate is an interface type corresponding to implementations of WIN_CERTIFICATE.
+type WinCertificate interface {
+	CertificateType() uint16 // The value of WIN_CERTIFICATE.wCertificateType
+}
+
+// WinCertificateUefiGuid corresponds to the WIN_CERTIFICATE_UEFI_GUID type.
+type WinCertificateUefiGuid struct {
+	CertType tcglog.EFIGUID // CertType
+	Data     []byte         // CertData
+}
+
+func (c *WinCertificateUefiGuid) CertificateType() uint16 {
+	return WinCertTypeEfiGuid
+}
+
+// WinCertificateAuthenticode corresponds to an Authenticode signature, which is a WIN_CERTIFICATE with a wCertificateType of
+// WIN_CERT_TYPE_PKCS_SIGNED_DATA.
+type WinCertificateAuthenticode struct {
+	Data []byte // The DER encoded PKCS#7 SignedData
+}
+
+func (c *WinCertificateAuthenticode) CertificateType() uint16 {
+	return WinCertTypePKCSSignedData
+}
+
+// DecodeWinCertificate decodes the WIN_CERTIFICATE implementation from r. Currently supported types are WIN_CERT_TYPE_PKCS_SIGNED_DATA
+// and WIN_CERT_TYPE_EFI_GUID. On success, the number of bytes read from r is also returned.
+func DecodeWinCertificate(r io.Reader) (cert WinCertificate, length int, err error) {
+	var hdr struct {
+		Length          uint32
+		Revision        uint16
+		CertificateType uint16
+	}
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, 0, xerrors.Errorf("cannot read WIN_CERTIFICATE header fields: %w", err)
+	}
+	if hdr.Revision != 0x200 {
+		return nil, 0, fmt.Errorf("invalid wRevision value (0x%04x)", hdr.Revision)
+	}
+
+	switch hdr.CertificateType {
+	case WinCertTypePKCSSignedData:
+		out := &WinCertificateAuthenticode{}
+		out.Data = make([]byte, int(hdr.Length)-binary.Size(hdr))
+		if _, err := io.ReadFull(r, out.Data); err != nil {
+			return nil, 0, xerrors.Errorf("cannot read WIN_CERTIFICATE.bCertificate: %w", err)
+		}
+		return out, int(hdr.Length), nil
+	case WinCertTypeEfiGuid:
+		out := &WinCertificateUefiGuid{}
+		if _, err := io.ReadFull(r, out.CertType[:]); err != nil {
+			return nil, 0, xerrors.Errorf("cannot read WIN_CERTIFICATE_UEFI_GUID.CertType: %w", err)
+		}
+		out.Data = make([]byte, int(hdr.Length)-binary.Size(hdr)-binary.Size(out.CertType))
+		if _, err := io.ReadFull(r, out.Data); err != nil {
+			return nil, 0, xerrors.Errorf("cannot read WIN_CERTIFICATE_UEFI_GUID.CertData: %w", err)
+		}
+		return out, int(hdr.Length), nil
+	default:
+		return nil, 0, fmt.Errorf("cannot decode unrecognized type (0x%04x)", hdr.CertificateType)
+	}
+}
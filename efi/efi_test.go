@@ -0,0 +1,142 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"encoding/hex"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/canonical/tcglog-parser"
+	"github.com/snapcore/secboot/efi"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+func decodeHexStringT(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("DecodeHexString failed: %v", err)
+	}
+	return b
+}
+
+func TestDecodeWinCertificate(t *testing.T) {
+	for _, data := range []struct {
+		desc            string
+		path            string
+		offset          int64
+		expectedType    uint16
+		efiGuidCertType tcglog.EFIGUID
+	}{
+		{
+			desc:            "AuthenticatedVariable",
+			path:            "../testdata/updates1/dbx/MS-2016-08-08.bin",
+			offset:          16,
+			expectedType:    efi.WinCertTypeEfiGuid,
+			efiGuidCertType: efi.CertTypePkcs7Guid,
+		},
+		// TODO: Add test with signed EFI executable
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			f, err := os.Open(data.path)
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			defer f.Close()
+
+			f.Seek(data.offset, io.SeekStart)
+
+			cert, _, err := efi.DecodeWinCertificate(f)
+			if err != nil {
+				t.Fatalf("DecodeWinCertificate failed: %v", err)
+			}
+
+			certType := cert.CertificateType()
+			if certType != data.expectedType {
+				t.Errorf("Unexpected type: %v", certType)
+			}
+
+			switch certType {
+			case efi.WinCertTypePKCSSignedData:
+			case efi.WinCertTypeEfiGuid:
+				c := cert.(*efi.WinCertificateUefiGuid)
+				if c.CertType != data.efiGuidCertType {
+					t.Errorf("Unexpected WIN_CERTIFICATE_UEFI_GUID type: %v", c.CertType)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeVariableAuthentication(t *testing.T) {
+	for _, data := range []struct {
+		desc     string
+		path     string
+		enhanced bool
+	}{
+		{
+			desc: "Auth2",
+			path: "../testdata/updates2/db/1.bin",
+		},
+		{
+			desc:     "Auth3",
+			path:     "../testdata/updates6/db/1.bin",
+			enhanced: true,
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			f, err := os.Open(data.path)
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			defer f.Close()
+
+			auth, err := efi.DecodeVariableAuthentication(f)
+			if err != nil {
+				t.Fatalf("DecodeVariableAuthentication failed: %v", err)
+			}
+			if auth.Enhanced != data.enhanced {
+				t.Errorf("Unexpected descriptor type")
+			}
+			if len(auth.Timestamp) != 16 {
+				t.Errorf("Unexpected timestamp length")
+			}
+			if auth.NewCert != nil {
+				t.Errorf("Unexpected new certificate")
+			}
+			if auth.SigningCert.CertType != efi.CertTypePkcs7Guid {
+				t.Errorf("Unexpected signing certificate type: %v", auth.SigningCert.CertType)
+			}
+
+			// Both updates contain the same signature database, which should immediately follow the descriptor.
+			sigs, err := efi.DecodeSignatureDatabase(f)
+			if err != nil {
+				t.Fatalf("DecodeSignatureDatabase failed: %v", err)
+			}
+			if len(sigs) != 1 || sigs[0].Type != efi.CertX509Guid {
+				t.Errorf("Unexpected signature database contents")
+			}
+		})
+	}
+}
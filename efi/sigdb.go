@@ -0,0 +1,302 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/canonical/tcglog-parser"
+
+	"golang.org/x/xerrors"
+)
+
+// signatureListIterator provides a mechanism to iterate over a set of EFI_SIGNATURE_LIST entries in a EFI signature database.
+type signatureListIterator struct {
+	r io.ReadSeeker
+}
+
+// nextSignatureList returns the SignatureType, SignatureHeader and EFI_SIGNATURE_DATA entries associated with the next
+// EFI_SIGNATURE_LIST.
+func (d *signatureListIterator) nextSignatureList() (tcglog.EFIGUID, []byte, [][]byte, error) {
+	start, _ := d.r.Seek(0, io.SeekCurrent)
+
+	// Decode EFI_SIGNATURE_LIST.SignatureType
+	var signatureType tcglog.EFIGUID
+	if _, err := io.ReadFull(d.r, signatureType[:]); err != nil {
+		if err == io.EOF {
+			return tcglog.EFIGUID{}, nil, nil, err
+		}
+		return tcglog.EFIGUID{}, nil, nil, xerrors.Errorf("cannot read EFI_SIGNATURE_LIST.SignatureType: %w", err)
+	}
+
+	// Decode EFI_SIGNATURE_LIST.SignatureListSize, which indicates the size of the entire EFI_SIGNATURE_LIST,
+	// including all of the EFI_SIGNATURE_DATA entries.
+	var signatureListSize uint32
+	if err := binary.Read(d.r, binary.LittleEndian, &signatureListSize); err != nil {
+		return tcglog.EFIGUID{}, nil, nil, xerrors.Errorf("cannot read EFI_SIGNATURE_LIST.SignatureListSize: %w", err)
+	}
+
+	// Decode EFI_SIGNATURE_LIST.SignatureHeaderSize, which indicates the size of the optional header data between
+	// the core EFI_SIGNATURE_LIST fields and the EFI_SIGNATURE_DATA entries.
+	// Always zero for the signature types we care about.
+	var signatureHeaderSize uint32
+	if err := binary.Read(d.r, binary.LittleEndian, &signatureHeaderSize); err != nil {
+		return tcglog.EFIGUID{}, nil, nil, xerrors.Errorf("cannot read EFI_SIGNATURE_LIST.SignatureHeaderSize: %w", err)
+	}
+
+	// Decode EFI_SIGNATURE_LIST.SignatureSize, which indicates the size of each EFI_SIGNATURE_DATA entry.
+	var signatureSize uint32
+	if err := binary.Read(d.r, binary.LittleEndian, &signatureSize); err != nil {
+		return tcglog.EFIGUID{}, nil, nil, xerrors.Errorf("cannot read EFI_SIGNATURE_LIST.SignatureSize: %w", err)
+	}
+	if signatureSize < 16 {
+		return tcglog.EFIGUID{}, nil, nil, errors.New("EFI_SIGNATURE_LIST.SignatureSize is invalid")
+	}
+
+	signatureHeader := make([]byte, signatureHeaderSize)
+	if _, err := io.ReadFull(d.r, signatureHeader); err != nil {
+		return tcglog.EFIGUID{}, nil, nil, xerrors.Errorf("cannot read EFI_SIGNATURE_LIST.SignatureHeader: %w", err)
+	}
+
+	// Calculate the number of EFI_SIGNATURE_DATA entries
+	endOfHeader, _ := d.r.Seek(0, io.SeekCurrent)
+	signatureDataSize := int64(signatureListSize) - endOfHeader + start
+	if signatureDataSize%int64(signatureSize) != 0 {
+		return tcglog.EFIGUID{}, nil, nil, errors.New("EFI_SIGNATURE_LIST has inconsistent SignatureListSize, SignatureHeaderSize and SignatureSize fields")
+	}
+	numOfSignatures := signatureDataSize / int64(signatureSize)
+
+	var signatures [][]byte
+
+	// Iterate over each EFI_SIGNATURE_DATA entry
+	for i := int64(0); i < numOfSignatures; i++ {
+		signature := make([]byte, signatureSize)
+		if _, err := io.ReadFull(d.r, signature); err != nil {
+			return tcglog.EFIGUID{}, nil, nil, xerrors.Errorf("cannot read EFI_SIGNATURE_DATA entry at index %d: %w", i, err)
+		}
+		signatures = append(signatures, signature)
+	}
+
+	return signatureType, signatureHeader, signatures, nil
+}
+
+// SignatureData corresponds to a EFI_SIGNATURE_DATA entry from a EFI signature database, with the inclusion of the SignatureType
+// field of the EFI_SIGNATURE_LIST that the the signature was obtained from.
+type SignatureData struct {
+	Type  tcglog.EFIGUID // The SignatureType of the EFI_SIGNATURE_LIST
+	Owner tcglog.EFIGUID // SignatureOwner
+	Data  []byte         // SignatureData
+}
+
+// Encode encodes the EFI_SIGNATURE_DATA entry corresponding to this signature to w.
+func (e *SignatureData) Encode(w io.Writer) error {
+	if _, err := w.Write(e.Owner[:]); err != nil {
+		return fmt.Errorf("cannot write signature owner: %v", err)
+	}
+	if _, err := w.Write(e.Data); err != nil {
+		return fmt.Errorf("cannot write signature data: %v", err)
+	}
+	return nil
+}
+
+// DecodeSignatureDatabase parses a EFI signature database from r and returns a list of SignatureData structures corresponding to
+// all of the EFI_SIGNATURE_DATA entries.
+func DecodeSignatureDatabase(r io.ReadSeeker) ([]*SignatureData, error) {
+	var out []*SignatureData
+
+	iter := &signatureListIterator{r}
+	for i := 0; ; i++ {
+		sigType, _, sigs, err := iter.nextSignatureList()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, xerrors.Errorf("cannot obtain signature list at %d: %w", i, err)
+		}
+
+		for j, sig := range sigs {
+			sr := bytes.NewReader(sig)
+
+			// Decode EFI_SIGNATURE_DATA.SignatureOwner
+			var signatureOwner tcglog.EFIGUID
+			if _, err := io.ReadFull(sr, signatureOwner[:]); err != nil {
+				return nil, xerrors.Errorf("cannot decode EFI_SIGNATURE_DATA.SignatureOwner for signature at index %d in list index %d: %w", j, i, err)
+			}
+
+			data, err := ioutil.ReadAll(sr)
+			if err != nil {
+				return nil, xerrors.Errorf("cannot obtain EFI_SIGNATURE_DATA.SignatureData for signature at index %d in list index %d: %w", j, i, err)
+			}
+
+			out = append(out, &SignatureData{Type: sigType, Owner: signatureOwner, Data: data})
+		}
+	}
+
+	return out, nil
+}
+
+// DbUpdateQuirkMode specifies how ComputeDbUpdate determines whether a signature in an update is already present in a signature
+// database.
+type DbUpdateQuirkMode int
+
+const (
+	// DbUpdateQuirkModeNone computes signature database updates in accordance with the UEFI specification, where 2
+	// EFI_SIGNATURE_DATA entries are only considered to be duplicates if all fields are identical.
+	DbUpdateQuirkModeNone DbUpdateQuirkMode = iota
+
+	// DbUpdateQuirkModeDedupIgnoresOwner computes signature database updates for firmware that doesn't consider 2
+	// EFI_SIGNATURE_DATA entries where only the SignatureOwner fields differ to be unique.
+	DbUpdateQuirkModeDedupIgnoresOwner
+)
+
+// signatureDbIndex is an index of the EFI_SIGNATURE_DATA entries in a EFI signature database, used by ComputeDbUpdate to determine
+// whether a signature is already present without having to scan the whole database for every signature in an update.
+type signatureDbIndex map[string]struct{}
+
+// signatureDbIndexKey returns the key for the supplied EFI_SIGNATURE_DATA entry in a signatureDbIndex created with the specified
+// quirk mode.
+func signatureDbIndexKey(sigType tcglog.EFIGUID, sig []byte, quirkMode DbUpdateQuirkMode) string {
+	if quirkMode == DbUpdateQuirkModeDedupIgnoresOwner {
+		// Skip EFI_SIGNATURE_DATA.SignatureOwner
+		sig = sig[16:]
+	}
+	return string(sigType[:]) + string(sig)
+}
+
+// newSignatureDbIndex creates an index of all of the EFI_SIGNATURE_DATA entries in the EFI signature database read from r.
+func newSignatureDbIndex(r io.ReadSeeker, quirkMode DbUpdateQuirkMode) (signatureDbIndex, error) {
+	index := make(signatureDbIndex)
+
+	iter := &signatureListIterator{r}
+	for i := 0; ; i++ {
+		sigType, _, sigs, err := iter.nextSignatureList()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, xerrors.Errorf("cannot obtain signature list at index %d: %w", i, err)
+		}
+		for _, sig := range sigs {
+			index[signatureDbIndexKey(sigType, sig, quirkMode)] = struct{}{}
+		}
+	}
+
+	return index, nil
+}
+
+func (i signatureDbIndex) contains(sigType tcglog.EFIGUID, sig []byte, quirkMode DbUpdateQuirkMode) bool {
+	_, ok := i[signatureDbIndexKey(sigType, sig, quirkMode)]
+	return ok
+}
+
+// ComputeDbUpdate appends the EFI signature database update supplied via update to the signature database supplied via orig, filtering
+// out EFI_SIGNATURE_DATA entries that are already in orig and then returning the result. The update can begin with either a
+// EFI_VARIABLE_AUTHENTICATION_2 or a EFI_VARIABLE_AUTHENTICATION_3 descriptor, which is not verified.
+func ComputeDbUpdate(orig io.ReaderAt, update io.ReadSeeker, quirkMode DbUpdateQuirkMode) ([]byte, error) {
+	if _, err := DecodeVariableAuthentication(update); err != nil {
+		return nil, xerrors.Errorf("cannot decode authentication descriptor from update: %w", err)
+	}
+
+	origIndex, err := newSignatureDbIndex(io.NewSectionReader(orig, 0, (1<<63)-1), quirkMode)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot index target: %w", err)
+	}
+
+	filteredUpdate := new(bytes.Buffer)
+
+	updateIter := &signatureListIterator{update}
+	for i := 0; ; i++ {
+		updateSigType, updateSigHeader, updateSigs, err := updateIter.nextSignatureList()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, xerrors.Errorf("cannot obtain signature list from update at index %d: %w", i, err)
+		}
+
+		var newSigs bytes.Buffer
+		var updateSigSize int
+
+		for _, updateSig := range updateSigs {
+			// Signatures are only compared with the original database and not with other signatures from the same update.
+			if !origIndex.contains(updateSigType, updateSig, quirkMode) {
+				updateSigSize = len(updateSig)
+				if _, err := newSigs.Write(updateSig); err != nil {
+					return nil, xerrors.Errorf("cannot write new signature to temporary buffer: %w", err)
+				}
+			}
+		}
+
+		if newSigs.Len() == 0 {
+			continue
+		}
+
+		// This EFI_SIGNATURE_LIST has new signatures, so encode them to filteredSrc
+
+		// Encode EFI_SIGNATURE_LIST.SignatureType
+		if err := binary.Write(filteredUpdate, binary.LittleEndian, updateSigType); err != nil {
+			return nil, xerrors.Errorf("cannot encode new EFI_SIGNATURE_LIST.SignatureType: %w", err)
+		}
+
+		// Calculate and encode EFI_SIGNATURE_LIST.SignatureListSize. This includes EFI_SIGNATURE_LIST.SignatureType (16 bytes),
+		// EFI_SIGNATURE_LIST.SignatureListSize (4 bytes), EFI_SIGNATURE_LIST.SignatureHeaderSize (4 bytes),
+		// EFI_SIGNATURE_LIST.SignatureSize (4 bytes), EFI_SIGNATURE_LIST.SignatureHeader and EFI_SIGNATURE_LIST.Signatures.
+		signatureListSize := uint32(binary.Size(tcglog.EFIGUID{})) + 12 + uint32(len(updateSigHeader)) + uint32(newSigs.Len())
+		if err := binary.Write(filteredUpdate, binary.LittleEndian, uint32(signatureListSize)); err != nil {
+			return nil, xerrors.Errorf("cannot write new EFI_SIGNATURE_LIST.SignatureListSize: %w", err)
+		}
+
+		// Encode EFI_SIGNATURE_LIST.SignatureHeaderSize
+		if err := binary.Write(filteredUpdate, binary.LittleEndian, uint32(len(updateSigHeader))); err != nil {
+			return nil, xerrors.Errorf("cannot write new EFI_SIGNATURE_LIST.SignatureHeaderSize: %w", err)
+		}
+
+		// Encode EFI_SIGNATURE_LIST.SignatureSize
+		if err := binary.Write(filteredUpdate, binary.LittleEndian, uint32(updateSigSize)); err != nil {
+			return nil, xerrors.Errorf("cannot write new EFI_SIGNATURE_LIST.SignatureSize: %w", err)
+		}
+
+		// Write EFI_SIGNATURE_LIST.SignatureHeader
+		if _, err := filteredUpdate.Write(updateSigHeader); err != nil {
+			return nil, xerrors.Errorf("cannot write new EFI_SIGNATURE_LIST.SignatureHeader: %w", err)
+		}
+
+		// Write the saved EFI_SIGNATURE_DATA entries for this list
+		if _, err := filteredUpdate.ReadFrom(&newSigs); err != nil {
+			return nil, xerrors.Errorf("cannot write new EFI_SIGNATURE_DATA entries: %w", err)
+		}
+	}
+
+	res := new(bytes.Buffer)
+
+	if _, err := res.ReadFrom(io.NewSectionReader(orig, 0, (1<<63)-1)); err != nil {
+		return nil, xerrors.Errorf("cannot write original database to target: %w", err)
+	}
+	if _, err := res.ReadFrom(filteredUpdate); err != nil {
+		return nil, xerrors.Errorf("cannot write filtered update to target: %w", err)
+	}
+
+	return res.Bytes(), nil
+}
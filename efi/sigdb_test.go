@@ -0,0 +1,389 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/sha1"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/canonical/tcglog-parser"
+	"github.com/snapcore/secboot/efi"
+)
+
+func TestDecodeSignatureDatabase(t *testing.T) {
+	var (
+		microsoftOwnerGuid = tcglog.MakeEFIGUID(0x77fa9abd, 0x0359, 0x4d32, 0xbd60, [...]uint8{0x28, 0xf4, 0xe7, 0x8f, 0x78, 0x4b})
+
+		microsoftRootCAName = "CN=Microsoft Root Certificate Authority 2010,O=Microsoft Corporation,L=Redmond,ST=Washington,C=US"
+		microsoftPCASubject = "CN=Microsoft Windows Production PCA 2011,O=Microsoft Corporation,L=Redmond,ST=Washington,C=US"
+		microsoftPCASerial  = decodeHexStringT(t, "61077656000000000008")
+
+		microsoftThirdPartyRootCAName = "CN=Microsoft Corporation Third Party Marketplace Root,O=Microsoft Corporation,L=Redmond,ST=Washington,C=US"
+		microsoftCASubject            = "CN=Microsoft Corporation UEFI CA 2011,O=Microsoft Corporation,L=Redmond,ST=Washington,C=US"
+		microsoftCASerial             = decodeHexStringT(t, "6108d3c4000000000004")
+
+		testOwnerGuid = tcglog.MakeEFIGUID(0xd1b37b32, 0x172d, 0x4d2a, 0x909f, [...]uint8{0xc7, 0x80, 0x81, 0x50, 0x17, 0x86})
+	)
+
+	type certId struct {
+		issuer  string
+		subject string
+		serial  []byte
+		owner   tcglog.EFIGUID
+	}
+	for _, data := range []struct {
+		desc       string
+		path       string
+		certs      []certId
+		signatures int
+	}{
+		{
+			desc: "db1",
+			path: "../testdata/efivars1/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
+			certs: []certId{
+				{
+					issuer:  microsoftRootCAName,
+					subject: microsoftPCASubject,
+					serial:  microsoftPCASerial,
+					owner:   microsoftOwnerGuid,
+				},
+				{
+					issuer:  microsoftThirdPartyRootCAName,
+					subject: microsoftCASubject,
+					serial:  microsoftCASerial,
+					owner:   microsoftOwnerGuid,
+				},
+			},
+			signatures: 2,
+		},
+		{
+			desc: "db2",
+			path: "../testdata/efivars2/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
+			certs: []certId{
+				{
+					issuer:  microsoftRootCAName,
+					subject: microsoftPCASubject,
+					serial:  microsoftPCASerial,
+					owner:   microsoftOwnerGuid,
+				},
+				{
+					issuer:  microsoftThirdPartyRootCAName,
+					subject: microsoftCASubject,
+					serial:  microsoftCASerial,
+					owner:   microsoftOwnerGuid,
+				},
+				{
+					issuer:  "CN=Test Key Exchange Key",
+					subject: "CN=Test UEFI CA",
+					serial:  decodeHexStringT(t, "01"),
+					owner:   testOwnerGuid,
+				},
+			},
+			signatures: 3,
+		},
+		{
+			desc: "db3",
+			path: "../testdata/efivars3/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
+			certs: []certId{
+				{
+					issuer:  microsoftRootCAName,
+					subject: microsoftPCASubject,
+					serial:  microsoftPCASerial,
+					owner:   microsoftOwnerGuid,
+				},
+				{
+					issuer:  microsoftThirdPartyRootCAName,
+					subject: microsoftCASubject,
+					serial:  microsoftCASerial,
+					owner:   microsoftOwnerGuid,
+				},
+				{
+					issuer:  "CN=Test Key Exchange Key",
+					subject: "CN=Test UEFI CA",
+					serial:  decodeHexStringT(t, "01"),
+					owner:   testOwnerGuid,
+				},
+				{
+					issuer:  "CN=Test Key Exchange Key",
+					subject: "CN=Test UEFI CA 2",
+					serial:  decodeHexStringT(t, "02"),
+					owner:   testOwnerGuid,
+				},
+			},
+			signatures: 4,
+		},
+		{
+			desc: "dbx1",
+			path: "../testdata/efivars1/dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
+			certs: []certId{
+				{
+					issuer:  microsoftRootCAName,
+					subject: "CN=Microsoft Windows PCA 2010,O=Microsoft Corporation,L=Redmond,ST=Washington,C=US",
+					serial:  decodeHexStringT(t, "610c6a19000000000004"),
+					owner:   tcglog.MakeEFIGUID(0x00000000, 0x0000, 0x0000, 0x0000, [...]uint8{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}),
+				},
+			},
+			signatures: 78,
+		},
+		{
+			desc:       "dbx2",
+			path:       "../testdata/efivars2/dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
+			signatures: 1,
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			d, err := ioutil.ReadFile(data.path)
+			if err != nil {
+				t.Fatalf("ReadFile failed: %v", err)
+			}
+
+			signatures, err := efi.DecodeSignatureDatabase(bytes.NewReader(d[4:]))
+			if err != nil {
+				t.Fatalf("DecodeSignatureDatabase failed: %v", err)
+			}
+			if len(signatures) != data.signatures {
+				t.Fatalf("Unexpected number of signatures (got %d, expected %d)", len(signatures), data.signatures)
+			}
+			i := 0
+			for _, sig := range signatures {
+				if sig.Type != efi.CertX509Guid {
+					continue
+				}
+
+				c, err := x509.ParseCertificate(sig.Data)
+				if err != nil {
+					t.Errorf("ParseCertificate failed: %v", err)
+				}
+
+				if sig.Owner != data.certs[i].owner {
+					t.Errorf("Unexpected owner (got %s, expected %s)", sig.Owner, data.certs[i].owner)
+				}
+				if c.Issuer.String() != data.certs[i].issuer {
+					t.Errorf("Unexpected issuer: %s", c.Issuer)
+				}
+				if c.Subject.String() != data.certs[i].subject {
+					t.Errorf("Unexpected subject: %s", c.Subject.String())
+				}
+				if !bytes.Equal(c.SerialNumber.Bytes(), data.certs[i].serial) {
+					t.Errorf("Unexpected serial number (got %x, expected %x)", c.SerialNumber.Bytes(), data.certs[i].serial)
+				}
+				i++
+			}
+		})
+	}
+}
+
+func TestComputeDbUpdate(t *testing.T) {
+	for _, data := range []struct {
+		desc          string
+		orig          string
+		update        string
+		quirkMode     efi.DbUpdateQuirkMode
+		sha1hash      []byte
+		newSignatures int
+	}{
+		{
+			desc:          "AppendOneCertToDb",
+			orig:          "../testdata/efivars3/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
+			update:        "../testdata/updates2/db/1.bin",
+			quirkMode:     efi.DbUpdateQuirkModeNone,
+			sha1hash:      decodeHexStringT(t, "12669d032dd0c15a157a7af0df7b86f2e174344b"),
+			newSignatures: 1,
+		},
+		{
+			desc:          "AppendOneCertToDbAuth3",
+			orig:          "../testdata/efivars3/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
+			update:        "../testdata/updates6/db/1.bin",
+			quirkMode:     efi.DbUpdateQuirkModeNone,
+			sha1hash:      decodeHexStringT(t, "12669d032dd0c15a157a7af0df7b86f2e174344b"),
+			newSignatures: 1,
+		},
+		{
+			desc:      "AppendExistingCertToDb",
+			orig:      "../testdata/efivars5/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
+			update:    "../testdata/updates2/db/1.bin",
+			quirkMode: efi.DbUpdateQuirkModeNone,
+			sha1hash:  decodeHexStringT(t, "12669d032dd0c15a157a7af0df7b86f2e174344b"),
+		},
+		{
+			desc:          "AppendMsDbxUpdate/1",
+			orig:          "../testdata/efivars2/dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
+			update:        "../testdata/updates1/dbx/MS-2016-08-08.bin",
+			quirkMode:     efi.DbUpdateQuirkModeNone,
+			sha1hash:      decodeHexStringT(t, "96f7dc104ee34a0ce8425aac20f29e2b2aba9d7e"),
+			newSignatures: 77,
+		},
+		{
+			desc:          "AppendMsDbxUpdate/2",
+			orig:          "../testdata/efivars2/dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
+			update:        "../testdata/updates1/dbx/MS-2016-08-08.bin",
+			quirkMode:     efi.DbUpdateQuirkModeDedupIgnoresOwner,
+			sha1hash:      decodeHexStringT(t, "96f7dc104ee34a0ce8425aac20f29e2b2aba9d7e"),
+			newSignatures: 77,
+		},
+		{
+			desc:          "AppendDbxUpdateWithDuplicateSignatures/1",
+			orig:          "../testdata/efivars4/dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
+			update:        "../testdata/updates3/dbx/1.bin",
+			quirkMode:     efi.DbUpdateQuirkModeNone,
+			sha1hash:      decodeHexStringT(t, "b49564b2daee39b01b524bef75cf9cde2c3a2a0d"),
+			newSignatures: 2,
+		},
+		{
+			desc:          "AppendDbxUpdateWithDuplicateSignatures/2",
+			orig:          "../testdata/efivars4/dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
+			update:        "../testdata/updates3/dbx/1.bin",
+			quirkMode:     efi.DbUpdateQuirkModeDedupIgnoresOwner,
+			sha1hash:      decodeHexStringT(t, "d2af590925046adc61b250a71f00b7b38d0eb3d1"),
+			newSignatures: 1,
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			orig, err := os.Open(data.orig)
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			defer orig.Close()
+			origReader := io.NewSectionReader(orig, 4, (1<<63)-5)
+			origSignatures, err := efi.DecodeSignatureDatabase(origReader)
+			if err != nil {
+				t.Errorf("DecodeSignatureDatabase failed: %v", err)
+			}
+
+			update, err := os.Open(data.update)
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			defer update.Close()
+
+			db, err := efi.ComputeDbUpdate(origReader, update, data.quirkMode)
+			if err != nil {
+				t.Fatalf("ComputeDbUpdate failed: %v", err)
+			}
+
+			// Ensure that an append was performed (ie, the original contents are unmofified)
+			origReader.Seek(0, io.SeekStart)
+			origDb, err := ioutil.ReadAll(origReader)
+			if err != nil {
+				t.Fatalf("ReadAll failed: %v", err)
+			}
+
+			if !bytes.Equal(origDb, db[:len(origDb)]) {
+				t.Errorf("ComputeDbUpdate didn't perform an append")
+			}
+
+			// Ensure that the result is well formed
+			signatures, err := efi.DecodeSignatureDatabase(bytes.NewReader(db))
+			if err != nil {
+				t.Errorf("DecodeSignatureDatabase failed: %v", err)
+			}
+
+			// Check we got the expected number of new signatures
+			if (len(signatures) - len(origSignatures)) != data.newSignatures {
+				t.Errorf("Incorrect number of new signatures (got %d, expected %d)", len(signatures)-len(origSignatures), data.newSignatures)
+			}
+
+			// Lastly, verify the contents against a known good digest
+			h := crypto.SHA1.New()
+			var attrs uint32
+			if err := binary.Read(orig, binary.LittleEndian, &attrs); err != nil {
+				t.Fatalf("binary.Read failed: %v", err)
+			}
+			if err := binary.Write(h, binary.LittleEndian, attrs); err != nil {
+				t.Fatalf("binary.Write failed: %v", err)
+			}
+			h.Write(db)
+
+			if !bytes.Equal(data.sha1hash, h.Sum(nil)) {
+				t.Errorf("Unexpected updated contents (sha1 got %x, expected %x)", h.Sum(nil), data.sha1hash)
+			}
+		})
+	}
+}
+
+// makeSyntheticSha256SignatureList creates an EFI_SIGNATURE_LIST containing n distinct EFI_CERT_SHA256 signatures.
+func makeSyntheticSha256SignatureList(n int) []byte {
+	var (
+		efiCertSha256Guid = tcglog.MakeEFIGUID(0xc1c41626, 0x504c, 0x4092, 0xaca9, [...]uint8{0x41, 0xf9, 0x36, 0x93, 0x43, 0x28})
+		testOwnerGuid     = tcglog.MakeEFIGUID(0xd1b37b32, 0x172d, 0x4d2a, 0x909f, [...]uint8{0xc7, 0x80, 0x81, 0x50, 0x17, 0x86})
+	)
+
+	const sigSize = 16 + 32
+
+	w := new(bytes.Buffer)
+	w.Write(efiCertSha256Guid[:])
+	binary.Write(w, binary.LittleEndian, uint32(28+(n*sigSize)))
+	binary.Write(w, binary.LittleEndian, uint32(0))
+	binary.Write(w, binary.LittleEndian, uint32(sigSize))
+	for i := 0; i < n; i++ {
+		w.Write(testOwnerGuid[:])
+		h := crypto.SHA256.New()
+		binary.Write(h, binary.LittleEndian, uint32(i))
+		w.Write(h.Sum(nil))
+	}
+	return w.Bytes()
+}
+
+func benchmarkComputeDbUpdate(b *testing.B, orig []byte, updatePath string, quirkMode efi.DbUpdateQuirkMode) {
+	update, err := ioutil.ReadFile(updatePath)
+	if err != nil {
+		b.Fatalf("ReadFile failed: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := efi.ComputeDbUpdate(bytes.NewReader(orig), bytes.NewReader(update), quirkMode); err != nil {
+			b.Fatalf("ComputeDbUpdate failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkComputeDbUpdate(b *testing.B) {
+	dbx, err := ioutil.ReadFile("../testdata/efivars2/dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f")
+	if err != nil {
+		b.Fatalf("ReadFile failed: %v", err)
+	}
+	// Skip over the 4-byte attribute field
+	dbx = dbx[4:]
+
+	largeDbx := append(append([]byte(nil), dbx...), makeSyntheticSha256SignatureList(5000)...)
+
+	for _, data := range []struct {
+		desc      string
+		orig      []byte
+		quirkMode efi.DbUpdateQuirkMode
+	}{
+		{desc: "MsDbxUpdate/1", orig: dbx, quirkMode: efi.DbUpdateQuirkModeNone},
+		{desc: "MsDbxUpdate/2", orig: dbx, quirkMode: efi.DbUpdateQuirkModeDedupIgnoresOwner},
+		{desc: "MsDbxUpdateLargeDbx/1", orig: largeDbx, quirkMode: efi.DbUpdateQuirkModeNone},
+		{desc: "MsDbxUpdateLargeDbx/2", orig: largeDbx, quirkMode: efi.DbUpdateQuirkModeDedupIgnoresOwner},
+	} {
+		b.Run(data.desc, func(b *testing.B) {
+			benchmarkComputeDbUpdate(b, data.orig, "../testdata/updates1/dbx/MS-2016-08-08.bin", data.quirkMode)
+		})
+	}
+}
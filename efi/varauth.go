@@ -0,0 +1,151 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	variableAuthentication3TimestampType uint8 = 1 // EFI_VARIABLE_AUTHENTICATION_3_TIMESTAMP_TYPE
+	variableAuthentication3NonceType     uint8 = 2 // EFI_VARIABLE_AUTHENTICATION_3_NONCE_TYPE
+
+	variableEnhancedAuthFlagUpdateCert uint32 = 0x1 // EFI_VARIABLE_ENHANCED_AUTH_FLAG_UPDATE_CERT
+)
+
+// VariableAuthentication corresponds to the authentication descriptor at the start of a signed EFI variable update, which is
+// either a EFI_VARIABLE_AUTHENTICATION_2 or a EFI_VARIABLE_AUTHENTICATION_3 structure.
+type VariableAuthentication struct {
+	Enhanced    bool                    // The descriptor is EFI_VARIABLE_AUTHENTICATION_3
+	Timestamp   []byte                  // The EFI_TIME associated with a time-based descriptor
+	Nonce       []byte                  // The nonce associated with a nonce-based EFI_VARIABLE_AUTHENTICATION_3 descriptor
+	NewCert     *WinCertificateUefiGuid // The new certificate associated with a EFI_VARIABLE_AUTHENTICATION_3 descriptor, if any
+	SigningCert *WinCertificateUefiGuid // The signature of the update
+}
+
+// decodeWinCertificateUefiGuidPkcs7 decodes a WIN_CERTIFICATE_UEFI_GUID from r, and checks that it contains a PKCS#7 signature.
+func decodeWinCertificateUefiGuidPkcs7(r io.Reader) (*WinCertificateUefiGuid, error) {
+	c, _, err := DecodeWinCertificate(r)
+	if err != nil {
+		return nil, err
+	}
+	if c.CertificateType() != WinCertTypeEfiGuid {
+		return nil, fmt.Errorf("invalid Hdr.wCertificateType (0x%04x)", c.CertificateType())
+	}
+	cert := c.(*WinCertificateUefiGuid)
+	if cert.CertType != CertTypePkcs7Guid {
+		return nil, fmt.Errorf("invalid CertType (%s)", cert.CertType)
+	}
+	return cert, nil
+}
+
+// DecodeVariableAuthentication decodes the authentication descriptor at the start of the signed EFI variable update read from
+// r, leaving r positioned at the start of the new variable contents.
+//
+// The descriptor format is determined by the variable attributes passed to SetVariable, which aren't part of the update. A
+// EFI_VARIABLE_AUTHENTICATION_2 descriptor begins with a EFI_TIME structure, and a EFI_VARIABLE_AUTHENTICATION_3 descriptor
+// begins with a version field of 1 followed by a type field of 1 or 2. These can be distinguished because the corresponding
+// EFI_TIME would have a year of 257 or 513.
+func DecodeVariableAuthentication(r io.ReadSeeker) (*VariableAuthentication, error) {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	var hdr struct {
+		Version      uint8
+		Type         uint8
+		MetadataSize uint32
+		Flags        uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, xerrors.Errorf("cannot read descriptor header: %w", err)
+	}
+
+	if hdr.Version != 1 || (hdr.Type != variableAuthentication3TimestampType && hdr.Type != variableAuthentication3NonceType) {
+		// EFI_VARIABLE_AUTHENTICATION_2
+		if _, err := r.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		auth := &VariableAuthentication{Timestamp: make([]byte, 16)}
+		if _, err := io.ReadFull(r, auth.Timestamp); err != nil {
+			return nil, xerrors.Errorf("cannot read EFI_VARIABLE_AUTHENTICATION_2.TimeStamp field: %w", err)
+		}
+		auth.SigningCert, err = decodeWinCertificateUefiGuidPkcs7(r)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decode EFI_VARIABLE_AUTHENTICATION_2.AuthInfo field: %w", err)
+		}
+		return auth, nil
+	}
+
+	// EFI_VARIABLE_AUTHENTICATION_3
+	auth := &VariableAuthentication{Enhanced: true}
+
+	switch hdr.Type {
+	case variableAuthentication3TimestampType:
+		auth.Timestamp = make([]byte, 16)
+		if _, err := io.ReadFull(r, auth.Timestamp); err != nil {
+			return nil, xerrors.Errorf("cannot read EFI_VARIABLE_AUTHENTICATION_3 timestamp: %w", err)
+		}
+	case variableAuthentication3NonceType:
+		var nonceSize uint32
+		if err := binary.Read(r, binary.LittleEndian, &nonceSize); err != nil {
+			return nil, xerrors.Errorf("cannot read EFI_VARIABLE_AUTHENTICATION_3_NONCE.NonceSize field: %w", err)
+		}
+		if nonceSize > hdr.MetadataSize {
+			return nil, errors.New("invalid EFI_VARIABLE_AUTHENTICATION_3_NONCE.NonceSize field")
+		}
+		auth.Nonce = make([]byte, nonceSize)
+		if _, err := io.ReadFull(r, auth.Nonce); err != nil {
+			return nil, xerrors.Errorf("cannot read EFI_VARIABLE_AUTHENTICATION_3_NONCE.Nonce field: %w", err)
+		}
+	}
+
+	if hdr.Flags&variableEnhancedAuthFlagUpdateCert > 0 {
+		auth.NewCert, err = decodeWinCertificateUefiGuidPkcs7(r)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decode EFI_VARIABLE_AUTHENTICATION_3 NewCert: %w", err)
+		}
+	}
+
+	auth.SigningCert, err = decodeWinCertificateUefiGuidPkcs7(r)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode EFI_VARIABLE_AUTHENTICATION_3 SigningCert: %w", err)
+	}
+
+	// EFI_VARIABLE_AUTHENTICATION_3.MetadataSize covers everything up to the new variable contents.
+	end, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if end-start > int64(hdr.MetadataSize) {
+		return nil, errors.New("invalid EFI_VARIABLE_AUTHENTICATION_3.MetadataSize field")
+	}
+	if _, err := r.Seek(start+int64(hdr.MetadataSize), io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return auth, nil
+}
@@ -0,0 +1,156 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+
+	. "gopkg.in/check.v1"
+)
+
+type efiSuite struct{}
+
+var _ = Suite(&efiSuite{})
+
+func (s *efiSuite) TestHTTPEFIImage(c *C) {
+	data, err := ioutil.ReadFile("testdata/mockshim1.efi.signed.1")
+	c.Assert(err, IsNil)
+
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	digest := sha256.Sum256(data)
+	image := &HTTPEFIImage{URL: srv.URL + "/shimx64.efi", DigestAlg: tpm2.HashAlgorithmSHA256, Digest: digest[:]}
+	c.Check(image.String(), Equals, srv.URL+"/shimx64.efi")
+
+	for i := 0; i < 2; i++ {
+		r, err := image.Open()
+		c.Assert(err, IsNil)
+		c.Check(r.Size(), Equals, int64(len(data)))
+		buf := make([]byte, len(data))
+		_, err = r.ReadAt(buf, 0)
+		c.Check(err, IsNil)
+		c.Check(buf, DeepEquals, data)
+		c.Check(r.Close(), IsNil)
+	}
+
+	// The image should only be fetched once.
+	c.Check(requests, Equals, 1)
+}
+
+func (s *efiSuite) TestHTTPEFIImageDigestMismatch(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("foo"))
+	}))
+	defer srv.Close()
+
+	image := &HTTPEFIImage{URL: srv.URL, DigestAlg: tpm2.HashAlgorithmSHA256, Digest: make(tpm2.Digest, 32)}
+	_, err := image.Open()
+	c.Check(err, ErrorMatches, "cannot fetch image: digest of image fetched from "+srv.URL+" doesn't match the expected digest")
+}
+
+func (s *efiSuite) TestHTTPEFIImageNotFound(c *C) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	image := &HTTPEFIImage{URL: srv.URL, DigestAlg: tpm2.HashAlgorithmSHA256, Digest: make(tpm2.Digest, 32)}
+	_, err := image.Open()
+	c.Check(err, ErrorMatches, "cannot fetch image: GET request failed: 404 Not Found")
+}
+
+func (s *efiSuite) TestAddEFIShimAlternateBootPaths(c *C) {
+	kernel := &EFIImageLoadEvent{Source: Shim, Image: FileEFIImage("testdata/mockkernel1.efi.signed.shim")}
+	grub := &EFIImageLoadEvent{Source: Shim, Image: FileEFIImage("testdata/mockgrub1.efi.signed.shim"), Next: []*EFIImageLoadEvent{kernel}}
+	shim := &EFIImageLoadEvent{Source: Firmware, Image: FileEFIImage("testdata/mockshim1.efi.signed.1"), Next: []*EFIImageLoadEvent{grub}}
+
+	fallback := FileEFIImage("fbx64.efi")
+	mokManager := FileEFIImage("mmx64.efi")
+
+	c.Assert(AddEFIShimAlternateBootPaths([]*EFIImageLoadEvent{shim}, &EFIShimAlternateBootPaths{Fallback: fallback, MokManager: mokManager}), IsNil)
+
+	c.Check(shim.Next, DeepEquals, []*EFIImageLoadEvent{
+		grub,
+		{Source: Shim, Image: mokManager, Next: []*EFIImageLoadEvent{grub}},
+		{Source: Shim, Image: fallback, Next: []*EFIImageLoadEvent{
+			{Source: Firmware, Image: shim.Image, Next: []*EFIImageLoadEvent{grub}}}}})
+	c.Check(grub.Next, DeepEquals, []*EFIImageLoadEvent{kernel})
+	c.Check(kernel.Next, IsNil)
+}
+
+func (s *efiSuite) makeZBootImage(c *C, compressionType string, payload []byte) EFIImage {
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	_, err := w.Write(payload)
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	hdr := make([]byte, 64)
+	copy(hdr, "MZ")
+	copy(hdr[4:], "zimg")
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(hdr)))
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(compressed.Len()))
+	copy(hdr[24:], compressionType)
+
+	path := filepath.Join(c.MkDir(), "vmlinuz.efi")
+	c.Assert(ioutil.WriteFile(path, append(hdr, compressed.Bytes()...), 0644), IsNil)
+	return FileEFIImage(path)
+}
+
+func (s *efiSuite) TestZBootPayloadEFIImage(c *C) {
+	kernel, err := ioutil.ReadFile("testdata/mockkernel1.efi.signed.2")
+	c.Assert(err, IsNil)
+
+	image := ZBootPayloadEFIImage{Image: s.makeZBootImage(c, "gzip", kernel)}
+	r, err := image.Open()
+	c.Assert(err, IsNil)
+	defer r.Close()
+
+	c.Check(r.Size(), Equals, int64(len(kernel)))
+	buf := make([]byte, len(kernel))
+	_, err = r.ReadAt(buf, 0)
+	c.Check(err, IsNil)
+	c.Check(buf, DeepEquals, kernel)
+}
+
+func (s *efiSuite) TestZBootPayloadEFIImageUnsupportedCompression(c *C) {
+	image := ZBootPayloadEFIImage{Image: s.makeZBootImage(c, "zstd", []byte("foo"))}
+	_, err := image.Open()
+	c.Check(err, ErrorMatches, "unsupported compression type \"zstd\"")
+}
+
+func (s *efiSuite) TestZBootPayloadEFIImageNotZBoot(c *C) {
+	image := ZBootPayloadEFIImage{Image: FileEFIImage("testdata/mockkernel1.efi.signed.2")}
+	_, err := image.Open()
+	c.Check(err, ErrorMatches, "not a EFI zboot image")
+}
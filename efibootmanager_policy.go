@@ -20,25 +20,17 @@
 package secboot
 
 import (
-	"encoding/binary"
 	"errors"
-	"fmt"
-	"hash"
-	"io"
-	"os"
-	"sort"
 
 	"github.com/canonical/go-tpm2"
 	"github.com/canonical/tcglog-parser"
-	"github.com/snapcore/secboot/internal/efi"
-	"github.com/snapcore/secboot/internal/pe1.14"
+	sbefi "github.com/snapcore/secboot/efi"
 
 	"golang.org/x/xerrors"
 )
 
 // computePeImageDigest computes a hash of a PE image in accordance with the "Windows Authenticode Portable Executable Signature
-// Format" specification. This function interprets the byte stream of the raw headers in some places, the layout of which are
-// defined in the "PE Format" specification (https://docs.microsoft.com/en-us/windows/win32/debug/pe-format)
+// Format" specification. See efi.ComputePeImageDigest.
 func computePeImageDigest(alg tpm2.HashAlgorithmId, image EFIImage) (tpm2.Digest, error) {
 	r, err := image.Open()
 	if err != nil {
@@ -46,158 +38,16 @@ func computePeImageDigest(alg tpm2.HashAlgorithmId, image EFIImage) (tpm2.Digest
 	}
 	defer r.Close()
 
-	var dosheader [96]byte
-	if _, err := r.ReadAt(dosheader[0:], 0); err != nil {
-		return nil, err
-	}
-
-	var coffHeaderOffset int64
-	if dosheader[0] == 'M' && dosheader[1] == 'Z' {
-		signoff := int64(binary.LittleEndian.Uint32(dosheader[0x3c:]))
-		var sign [4]byte
-		r.ReadAt(sign[:], signoff)
-		if !(sign[0] == 'P' && sign[1] == 'E' && sign[2] == 0 && sign[3] == 0) {
-			return nil, fmt.Errorf("invalid PE COFF file signature: %v", sign)
-		}
-		coffHeaderOffset = signoff + 4
-	}
-
-	p, err := pe.NewFile(r)
-	if err != nil {
-		return nil, xerrors.Errorf("cannot decode PE binary: %w", err)
-	}
-
-	var isPe32Plus bool
-	var sizeOfHeaders int64
-	var dd []pe.DataDirectory
-	switch oh := p.OptionalHeader.(type) {
-	case *pe.OptionalHeader32:
-		sizeOfHeaders = int64(oh.SizeOfHeaders)
-		dd = oh.DataDirectory[0:oh.NumberOfRvaAndSizes]
-	case *pe.OptionalHeader64:
-		isPe32Plus = true
-		sizeOfHeaders = int64(oh.SizeOfHeaders)
-		dd = oh.DataDirectory[0:oh.NumberOfRvaAndSizes]
-	default:
-		return nil, errors.New("PE binary doesn't contain an optional header")
-	}
-
-	// 1) Load the image header in to memory.
-	hr := io.NewSectionReader(r, 0, sizeOfHeaders)
-
-	// 2) Initialize a hash algorithm context.
-	h := alg.NewHash()
-
-	// 3) Hash the image header from its base to immediately before the start of the checksum address in the optional header.
-	// This includes the DOS header, 4-byte PE signature, COFF header, and the first 64 bytes of the optional header.
-	b := make([]byte, int(coffHeaderOffset)+binary.Size(p.FileHeader)+64)
-	if _, err := hr.Read(b); err != nil {
-		return nil, xerrors.Errorf("cannot read from image to start to checksum: %w", err)
-	}
-	h.Write(b)
-
-	// 4) Skip over the checksum, which is a 4-byte field.
-	hr.Seek(4, io.SeekCurrent)
-
-	var certTable *pe.DataDirectory
-
-	if len(dd) > certTableIndex {
-		// 5) Hash everything from the end of the checksum field to immediately before the start of the Certificate Table entry in the
-		// optional header data directory.
-		// This is 60 bytes for PE32 format binaries, or 76 bytes for PE32+ format binaries.
-		sz := 60
-		if isPe32Plus {
-			sz = 76
-		}
-		b = make([]byte, sz)
-		if _, err := hr.Read(b); err != nil {
-			return nil, xerrors.Errorf("cannot read from checksum to certificate table data directory entry: %w", err)
-		}
-		h.Write(b)
-
-		// 6) Get the Attribute Certificate Table address and size from the Certificate Table entry.
-		certTable = &dd[certTableIndex]
-	}
-
-	// 7) Exclude the Certificate Table entry from the calculation and hash	everything from the end of the Certificate Table entry
-	// to the end of image header, including the Section Table. The Certificate Table entry is 8 bytes long.
-	if certTable != nil {
-		hr.Seek(8, io.SeekCurrent)
-	}
-
-	chunkedHashAll := func(r io.Reader, h hash.Hash) error {
-		b := make([]byte, 4096)
-		for {
-			n, err := r.Read(b)
-			h.Write(b[:n])
-
-			if err == io.EOF {
-				return nil
-			}
-			if err != nil {
-				return err
-			}
-		}
-	}
-
-	if err := chunkedHashAll(hr, h); err != nil {
-		return nil, xerrors.Errorf("cannot hash remainder of headers and section table: %w", err)
-	}
-
-	// 8) Create a counter called sumOfBytesHashed, which is not part of the signature. Set this counter to the SizeOfHeaders field.
-	sumOfBytesHashed := sizeOfHeaders
-
-	// 9) Build a temporary table of pointers to all of the section headers in the image. Do not include any section headers in the
-	// table whose Size field is zero.
-	var sections []*pe.SectionHeader
-	for _, section := range p.Sections {
-		if section.Size == 0 {
-			continue
-		}
-		sections = append(sections, &section.SectionHeader)
-	}
-
-	// 10) Using the Offset field in the referenced SectionHeader structure as a key, arrange the table's elements in ascending order.
-	// In other words, sort the section headers in ascending order according to the disk-file offset of the sections.
-	sort.Slice(sections, func(i, j int) bool { return sections[i].Offset < sections[j].Offset })
-
-	for _, section := range sections {
-		// 11) Walk through the sorted table, load the corresponding section into memory, and hash the entire section. Use the
-		// Size field in the SectionHeader structure to determine the amount of data to hash.
-		sr := io.NewSectionReader(r, int64(section.Offset), int64(section.Size))
-		if err := chunkedHashAll(sr, h); err != nil {
-			return nil, xerrors.Errorf("cannot hash section %s: %w", section.Name, err)
-		}
-
-		// 12) Add the section’s Size value to sumOfBytesHashed.
-		sumOfBytesHashed += int64(section.Size)
-
-		// 13) Repeat steps 11 and 12 for all of the sections in the sorted table.
-	}
-
-	// 14) Create a value called fileSize, which is not part of the signature. Set this value to the image’s file size. If fileSize is
-	// greater than sumOfBytesHashed, the file contains extra data that must be added to the hash. This data begins at the
-	// sumOfBytesHashed file offset, and its length is:
-	// fileSize – (certTable.Size + sumOfBytesHashed)
-	fileSize := r.Size()
-
-	if fileSize > sumOfBytesHashed {
-		var certSize int64
-		if certTable != nil {
-			certSize = int64(certTable.Size)
-		}
-
-		if fileSize < (sumOfBytesHashed + certSize) {
-			return nil, errors.New("image too short")
-		}
+	return sbefi.ComputePeImageDigest(alg.GetHash(), r, r.Size())
+}
 
-		sr := io.NewSectionReader(r, sumOfBytesHashed, fileSize-sumOfBytesHashed-certSize)
-		if err := chunkedHashAll(sr, h); err != nil {
-			return nil, xerrors.Errorf("cannot hash extra data: %w", err)
-		}
+// countEFIImageLoadEvents returns the total number of image loads in the supplied image load sequences, counting images that
+// appear in more than one sequence once for each occurrence.
+func countEFIImageLoadEvents(events []*EFIImageLoadEvent) (n int) {
+	for _, e := range events {
+		n += 1 + countEFIImageLoadEvents(e.Next)
 	}
-
-	return h.Sum(nil), nil
+	return
 }
 
 type bootManagerCodePolicyGenBranch struct {
@@ -213,8 +63,9 @@ func (n *bootManagerCodePolicyGenBranch) branch() *bootManagerCodePolicyGenBranc
 
 // bmLoadEventAndBranch binds together a EFIImageLoadEvent and the branch that the event needs to be applied to.
 type bmLoadEventAndBranch struct {
-	event  *EFIImageLoadEvent
-	branch *bootManagerCodePolicyGenBranch
+	event   *EFIImageLoadEvent
+	branch  *bootManagerCodePolicyGenBranch
+	initial bool // This event is the first in a load sequence
 }
 
 // EFIBootManagerProfileParams provide the arguments to AddEFIBootManagerProfile.
@@ -226,6 +77,23 @@ type EFIBootManagerProfileParams struct {
 
 	// LoadSequences is a list of EFI image load sequences for which to compute PCR digests for.
 	LoadSequences []*EFIImageLoadEvent
+
+	// DigestCache is an optional cache of image digests. If this is set, the digests of images that have already been hashed
+	// are obtained from the cache rather than computed again, and newly computed digests are added to it. The caller is responsible
+	// for calling EFIImageDigestCache.Save in order to persist any new entries.
+	DigestCache *EFIImageDigestCache
+
+	// TPM is an optional connection to the TPM. If this is set, the TCG event log cached on it is used rather than reading and
+	// parsing the log again. See TPMConnection.EventLog.
+	TPM *TPMConnection
+
+	// Snapshot is an optional snapshot of a system, captured with CaptureSystemSnapshot. If this is set, the profile is computed
+	// from the TCG event log in the snapshot rather than from the current system, and TPM is ignored.
+	Snapshot *SystemSnapshot
+
+	// Progress is an optional callback used to report the progress of the profile computation, which is dominated by the
+	// time taken to compute the digest of each image.
+	Progress ProgressFunc
 }
 
 // AddEFIBootManagerProfile adds the UEFI boot manager code and boot attempts profile to the provided PCR protection profile, in order
@@ -253,14 +121,12 @@ type EFIBootManagerProfileParams struct {
 // even if they fail. The generated PCR policy will not be satisfied if the platform firmware performs boot attempts that fail,
 // even if the successful boot attempt is of a sequence of binaries included in this PCR profile.
 func AddEFIBootManagerProfile(profile *PCRProtectionProfile, params *EFIBootManagerProfileParams) error {
+	params.Progress.report("reading TCG event log", 0)
+
 	// Load event log
-	eventLog, err := os.Open(efi.EventLogPath)
+	log, err := params.Snapshot.readEventLog(params.TPM)
 	if err != nil {
-		return xerrors.Errorf("cannot open TCG event log: %w", err)
-	}
-	log, err := tcglog.ParseLog(eventLog, &tcglog.LogOptions{})
-	if err != nil {
-		return xerrors.Errorf("cannot parse TCG event log: %w", err)
+		return err
 	}
 
 	if !log.Algorithms.Contains(tcglog.AlgorithmId(params.PCRAlgorithm)) {
@@ -272,12 +138,27 @@ func AddEFIBootManagerProfile(profile *PCRProtectionProfile, params *EFIBootMana
 	// Replay the event log until we see the transition from "pre-OS" to "OS-present". The event log may contain measurements
 	// for system preparation applications, and spec-compliant firmware should measure a EV_EFI_ACTION “Calling EFI Application
 	// from Boot Option” event before the EV_SEPARATOR event, but not all firmware does this.
+	//
+	// Some firmware (eg, U-Boot) measures the initial OS image when it is loaded, before the transition to OS-present. In this
+	// case, the events recorded after it up to the transition to OS-present are extended after the digest of the first image in
+	// each load sequence.
+	platform := detectEFIPlatform(log.Events)
+	osImageLoaded := false
+	var pendingDigests tpm2.DigestList
 	for _, event := range log.Events {
 		if event.PCRIndex != bootManagerCodePCR {
 			continue
 		}
 
-		profile.ExtendPCR(params.PCRAlgorithm, bootManagerCodePCR, tpm2.Digest(event.Digests[tcglog.AlgorithmId(params.PCRAlgorithm)]))
+		digest := tpm2.Digest(event.Digests[tcglog.AlgorithmId(params.PCRAlgorithm)])
+		switch {
+		case osImageLoaded:
+			pendingDigests = append(pendingDigests, digest)
+		case platform.imageLoadPrecedesSeparators && platform.isImageLoadEvent(event):
+			osImageLoaded = true
+		default:
+			profile.ExtendPCR(params.PCRAlgorithm, bootManagerCodePCR, digest)
+		}
 		if event.EventType == tcglog.EventTypeSeparator {
 			break
 		}
@@ -290,24 +171,35 @@ func AddEFIBootManagerProfile(profile *PCRProtectionProfile, params *EFIBootMana
 	var nextLoadEvents []*bmLoadEventAndBranch
 
 	if len(params.LoadSequences) == 1 {
-		loadEvents = append(loadEvents, &bmLoadEventAndBranch{event: params.LoadSequences[0], branch: &root})
+		loadEvents = append(loadEvents, &bmLoadEventAndBranch{event: params.LoadSequences[0], branch: &root, initial: true})
 	} else {
 		for _, e := range params.LoadSequences {
 			branch := root.branch()
 			allBranches = append(allBranches, branch)
-			loadEvents = append(loadEvents, &bmLoadEventAndBranch{event: e, branch: branch})
+			loadEvents = append(loadEvents, &bmLoadEventAndBranch{event: e, branch: branch, initial: true})
 		}
 	}
 
+	totalImages := countEFIImageLoadEvents(params.LoadSequences)
+	processedImages := 0
+
 	for len(loadEvents) > 0 {
 		e := loadEvents[0]
 		loadEvents = loadEvents[1:]
 
-		digest, err := computePeImageDigest(params.PCRAlgorithm, e.event.Image)
+		params.Progress.reportStep("computing image digests", processedImages, totalImages, 10, 100)
+		processedImages++
+
+		digest, err := computePeImageDigestWithCache(params.DigestCache, params.PCRAlgorithm, e.event.Image)
 		if err != nil {
 			return err
 		}
 		e.branch.profile.ExtendPCR(params.PCRAlgorithm, bootManagerCodePCR, digest)
+		if e.initial {
+			for _, d := range pendingDigests {
+				e.branch.profile.ExtendPCR(params.PCRAlgorithm, bootManagerCodePCR, d)
+			}
+		}
 
 		if len(e.event.Next) == 1 {
 			nextLoadEvents = append(nextLoadEvents, &bmLoadEventAndBranch{event: e.event.Next[0], branch: e.branch})
@@ -335,5 +227,6 @@ func AddEFIBootManagerProfile(profile *PCRProtectionProfile, params *EFIBootMana
 		b.profile.AddProfileOR(b.branches...)
 	}
 
+	params.Progress.report("done", 100)
 	return nil
 }
@@ -20,6 +20,11 @@
 package secboot_test
 
 import (
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
 	"github.com/canonical/go-tpm2"
 	. "github.com/snapcore/secboot"
 	"github.com/snapcore/secboot/internal/testutil"
@@ -76,6 +81,98 @@ func (s *efiBootManagerPolicySuite) TestComputePeImageDigest4(c *C) {
 	})
 }
 
+func (s *efiBootManagerPolicySuite) TestComputePeImageDigestWithCache(c *C) {
+	dir := c.MkDir()
+	cachePath := filepath.Join(dir, "cache")
+	imagePath := filepath.Join(dir, "image")
+	cacheKey := make([]byte, 32)
+	rand.Read(cacheKey)
+
+	data, err := ioutil.ReadFile("testdata/mockshim1.efi.signed.1")
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(imagePath, data, 0644), IsNil)
+
+	cache, err := LoadEFIImageDigestCache(cachePath, cacheKey)
+	c.Assert(err, IsNil)
+	c.Check(cache.Entries(), HasLen, 0)
+
+	expected := testutil.DecodeHexString(c, "1d91795a82b24a61c5b5f4b5843062fd10fc42e2d403c5a65f811014df231c9f")
+	d, err := ComputePeImageDigestWithCache(cache, tpm2.HashAlgorithmSHA256, FileEFIImage(imagePath))
+	c.Assert(err, IsNil)
+	c.Check(d, DeepEquals, expected)
+	c.Check(cache.Entries(), HasLen, 1)
+	c.Check(cache.Save(), IsNil)
+
+	// Reload the cache and make sure that the cached entry is used.
+	cache, err = LoadEFIImageDigestCache(cachePath, cacheKey)
+	c.Assert(err, IsNil)
+	c.Assert(cache.Entries(), HasLen, 1)
+	for k := range cache.Entries() {
+		cache.Entries()[k] = make(tpm2.Digest, 32)
+	}
+	d, err = ComputePeImageDigestWithCache(cache, tpm2.HashAlgorithmSHA256, FileEFIImage(imagePath))
+	c.Assert(err, IsNil)
+	c.Check(d, DeepEquals, make(tpm2.Digest, 32))
+
+	// Using a different algorithm should create a new entry.
+	d, err = ComputePeImageDigestWithCache(cache, tpm2.HashAlgorithmSHA1, FileEFIImage(imagePath))
+	c.Assert(err, IsNil)
+	c.Check(d, DeepEquals, testutil.DecodeHexString(c, "2e65c395448b8fcfce99f0421bb396f7a66cc207"))
+	c.Check(cache.Entries(), HasLen, 2)
+
+	// Replacing the image should invalidate the cached entries.
+	data, err = ioutil.ReadFile("testdata/mockgrub1.efi.signed.shim")
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(imagePath, data, 0644), IsNil)
+	d, err = ComputePeImageDigestWithCache(cache, tpm2.HashAlgorithmSHA256, FileEFIImage(imagePath))
+	c.Assert(err, IsNil)
+	c.Check(d, DeepEquals, testutil.DecodeHexString(c, "5a03ecd3cc4caf9eabc8d7295772c0b74e2998d1631bbde372acbf2ffad4031a"))
+	c.Check(cache.Entries(), HasLen, 3)
+}
+
+func (s *efiBootManagerPolicySuite) TestLoadEFIImageDigestCacheNotAuthentic(c *C) {
+	dir := c.MkDir()
+	cachePath := filepath.Join(dir, "cache")
+	cacheKey := make([]byte, 32)
+	rand.Read(cacheKey)
+
+	cache, err := LoadEFIImageDigestCache(cachePath, cacheKey)
+	c.Assert(err, IsNil)
+	_, err = ComputePeImageDigestWithCache(cache, tpm2.HashAlgorithmSHA256, FileEFIImage("testdata/mockshim1.efi.signed.1"))
+	c.Assert(err, IsNil)
+	c.Assert(cache.Save(), IsNil)
+
+	// Loading the cache with a different key should fail.
+	otherKey := make([]byte, 32)
+	rand.Read(otherKey)
+	_, err = LoadEFIImageDigestCache(cachePath, otherKey)
+	c.Check(err, ErrorMatches, "cannot authenticate cache file")
+
+	// Modifying an entry without updating the HMAC should cause authentication to fail.
+	var file struct {
+		Entries map[string]tpm2.Digest `json:"entries"`
+		HMAC    []byte                 `json:"hmac"`
+	}
+	data, err := ioutil.ReadFile(cachePath)
+	c.Assert(err, IsNil)
+	c.Assert(json.Unmarshal(data, &file), IsNil)
+	c.Assert(file.Entries, HasLen, 1)
+	for k := range file.Entries {
+		file.Entries[k] = make(tpm2.Digest, 32)
+	}
+	data, err = json.Marshal(&file)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(cachePath, data, 0600), IsNil)
+	_, err = LoadEFIImageDigestCache(cachePath, cacheKey)
+	c.Check(err, ErrorMatches, "cannot authenticate cache file")
+}
+
+func (s *efiBootManagerPolicySuite) TestComputePeImageDigestWithNilCache(c *C) {
+	d, err := ComputePeImageDigestWithCache(nil, tpm2.HashAlgorithmSHA256, FileEFIImage("testdata/mockshim1.efi.signed.1"))
+	c.Assert(err, IsNil)
+	c.Check(d, DeepEquals, testutil.DecodeHexString(c, "1d91795a82b24a61c5b5f4b5843062fd10fc42e2d403c5a65f811014df231c9f"))
+}
+
 type testAddEFIBootManagerProfileData struct {
 	initial *PCRProtectionProfile
 	params  *EFIBootManagerProfileParams
@@ -109,6 +206,50 @@ func (s *efiBootManagerPolicySuite) testAddEFIBootManagerProfile(c *C, data *tes
 	}
 }
 
+type testProgressEvent struct {
+	stage   string
+	percent int
+}
+
+func (s *efiBootManagerPolicySuite) TestAddEFIBootManagerProfileProgress(c *C) {
+	restoreEventLogPath := testutil.MockEventLogPath("testdata/eventlog1.bin")
+	defer restoreEventLogPath()
+
+	var events []testProgressEvent
+	c.Check(AddEFIBootManagerProfile(NewPCRProtectionProfile(), &EFIBootManagerProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		LoadSequences: []*EFIImageLoadEvent{
+			{
+				Image: FileEFIImage("testdata/mockshim1.efi.signed.1"),
+				Next: []*EFIImageLoadEvent{
+					{
+						Image: FileEFIImage("testdata/mockgrub1.efi.signed.shim"),
+						Next: []*EFIImageLoadEvent{
+							{
+								Image: FileEFIImage("testdata/mockkernel1.efi.signed.shim"),
+							},
+							{
+								Image: FileEFIImage("testdata/mockkernel2.efi.signed.shim"),
+							},
+						},
+					},
+				},
+			},
+		},
+		Progress: func(stage string, percent int) {
+			events = append(events, testProgressEvent{stage, percent})
+		},
+	}), IsNil)
+	c.Check(events, DeepEquals, []testProgressEvent{
+		{"reading TCG event log", 0},
+		{"computing image digests", 10},
+		{"computing image digests", 32},
+		{"computing image digests", 55},
+		{"computing image digests", 77},
+		{"done", 100},
+	})
+}
+
 func (s *efiBootManagerPolicySuite) TestAddEFIBootManagerProfile1(c *C) {
 	s.testAddEFIBootManagerProfile(c, &testAddEFIBootManagerProfileData{
 		params: &EFIBootManagerProfileParams{
@@ -0,0 +1,113 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/canonical/tcglog-parser"
+)
+
+// efiPlatform describes the conventions used by the firmware that produced a TCG event log, for the parts of the "TCG PC Client
+// Platform Firmware Profile Specification" that are open to interpretation and that the boot manager and secure boot policy
+// profiles depend on. EDK2 based firmware is used on most x86 devices and on ARM servers (SystemReady SR and ES), and U-Boot is
+// used on many ARM boards (SystemReady IR), where Ubuntu Core commonly runs with a firmware TPM.
+type efiPlatform struct {
+	name string
+
+	// imageLoadPrecedesSeparators indicates that the firmware measures the initial OS image to PCR 4 and its verification to PCR 7
+	// when it is loaded, before measuring the EV_SEPARATOR events that mark the transition to OS-present. U-Boot measures the
+	// separators when the image is started, whereas EDK2 measures them before loading it.
+	imageLoadPrecedesSeparators bool
+
+	// secureBootSeparatorDeferred indicates that the EV_SEPARATOR event in PCR 7 is measured along with those for the other PCRs
+	// at the transition to OS-present, rather than immediately after the secure boot configuration. In this case, it follows the
+	// verification of any image loaded before the transition.
+	secureBootSeparatorDeferred bool
+
+	// absentSecureBootMeasured indicates that the firmware measures the SecureBoot variable with empty data if it doesn't exist,
+	// rather than always creating it. U-Boot doesn't create the variable until a platform key is enrolled.
+	absentSecureBootMeasured bool
+}
+
+func (p *efiPlatform) String() string {
+	return p.name
+}
+
+// isOSPresentTransition determines whether the supplied event marks the transition from pre-OS to OS-present. All platforms
+// measure EV_SEPARATOR events to PCRs 0-7 here, but the one for PCR 7 may be measured earlier (see secureBootSeparatorDeferred),
+// so it isn't considered.
+func (p *efiPlatform) isOSPresentTransition(event *tcglog.Event) bool {
+	return event.EventType == tcglog.EventTypeSeparator && event.PCRIndex != secureBootPCR
+}
+
+// isSecureBootSeparator determines whether the supplied event is the EV_SEPARATOR event in PCR 7.
+func (p *efiPlatform) isSecureBootSeparator(event *tcglog.Event) bool {
+	return event.EventType == tcglog.EventTypeSeparator && event.PCRIndex == secureBootPCR
+}
+
+// isImageLoadEvent determines whether the supplied event corresponds to the boot manager loading an EFI application. Both EDK2
+// and U-Boot record EV_EFI_BOOT_SERVICES_APPLICATION events in PCR 4 for these. Drivers are measured with other event types.
+func (p *efiPlatform) isImageLoadEvent(event *tcglog.Event) bool {
+	return event.PCRIndex == bootManagerCodePCR && event.EventType == tcglog.EventTypeEFIBootServicesApplication
+}
+
+// secureBootEnabled determines whether secure boot is enabled from the data of a measurement of the SecureBoot variable.
+func (p *efiPlatform) secureBootEnabled(data []byte) (bool, error) {
+	switch {
+	case len(data) == 0 && p.absentSecureBootMeasured:
+		return false, nil
+	case len(data) != 1:
+		return false, fmt.Errorf("invalid SecureBoot variable size (%d bytes) for %s firmware", len(data), p)
+	default:
+		return data[0] != 0x00, nil
+	}
+}
+
+var (
+	efiPlatformEDK2  = &efiPlatform{name: "EDK2"}
+	efiPlatformUBoot = &efiPlatform{name: "U-Boot", imageLoadPrecedesSeparators: true, secureBootSeparatorDeferred: true, absentSecureBootMeasured: true}
+)
+
+// uBootVersionPrefix is the prefix of the version string that U-Boot measures to PCR 0 as the EV_S_CRTM_VERSION event (see
+// tcg2_measure_pre_boot in U-Boot's lib/tpm_tcg2.c). The version string is ASCII and NULL terminated, whereas EDK2 measures a
+// UCS-2 firmware version string.
+const uBootVersionPrefix = "U-Boot "
+
+// isUBootCRTMVersionEvent determines whether an event with the supplied PCR index, type and data is the EV_S_CRTM_VERSION event
+// measured by U-Boot.
+func isUBootCRTMVersionEvent(pcr tcglog.PCRIndex, eventType tcglog.EventType, data []byte) bool {
+	return pcr == 0 && eventType == tcglog.EventTypeSCRTMVersion && bytes.HasPrefix(data, []byte(uBootVersionPrefix))
+}
+
+// detectEFIPlatform determines the conventions used by the firmware that produced the supplied events. U-Boot is identified by
+// the version string it measures as the S-CRTM version. Everything else is assumed to be EDK2 based.
+func detectEFIPlatform(events []*tcglog.Event) *efiPlatform {
+	for _, e := range events {
+		if efiPlatformEDK2.isOSPresentTransition(e) {
+			break
+		}
+		if isUBootCRTMVersionEvent(e.PCRIndex, e.EventType, e.Data.Bytes()) {
+			return efiPlatformUBoot
+		}
+	}
+	return efiPlatformEDK2
+}
@@ -0,0 +1,103 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/canonical/tcglog-parser"
+	. "github.com/snapcore/secboot"
+)
+
+func TestDetectEFIPlatform(t *testing.T) {
+	for _, data := range []struct {
+		desc     string
+		logPath  string
+		expected string
+	}{
+		{
+			desc:     "OVMF",
+			logPath:  "testdata/eventlog1.bin",
+			expected: "EDK2",
+		},
+		{
+			desc:     "OVMFSecureBootDisabled",
+			logPath:  "testdata/eventlog3.bin",
+			expected: "EDK2",
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			f, err := os.Open(data.logPath)
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			defer f.Close()
+
+			log, err := tcglog.ParseLog(f, &tcglog.LogOptions{})
+			if err != nil {
+				t.Fatalf("ParseLog failed: %v", err)
+			}
+
+			if platform := DetectEFIPlatform(log.Events); platform != data.expected {
+				t.Errorf("Unexpected platform: %s", platform)
+			}
+		})
+	}
+}
+
+func TestIsUBootCRTMVersionEvent(t *testing.T) {
+	for _, data := range []struct {
+		desc      string
+		pcr       tcglog.PCRIndex
+		eventType tcglog.EventType
+		data      []byte
+		expected  bool
+	}{
+		{
+			desc:      "UBoot",
+			eventType: tcglog.EventTypeSCRTMVersion,
+			data:      []byte("U-Boot 2023.01 (Jan 09 2023 - 12:00:00 +0000)\x00"),
+			expected:  true,
+		},
+		{
+			desc:      "EDK2",
+			eventType: tcglog.EventTypeSCRTMVersion,
+			data:      []byte("0\x00.\x000\x00\x00\x00"),
+		},
+		{
+			desc:      "WrongPCR",
+			pcr:       4,
+			eventType: tcglog.EventTypeSCRTMVersion,
+			data:      []byte("U-Boot 2023.01\x00"),
+		},
+		{
+			desc:      "WrongType",
+			eventType: tcglog.EventTypePostCode,
+			data:      []byte("U-Boot 2023.01\x00"),
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			if IsUBootCRTMVersionEvent(data.pcr, data.eventType, data.data) != data.expected {
+				t.Errorf("Unexpected result")
+			}
+		})
+	}
+}
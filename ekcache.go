@@ -0,0 +1,231 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/truststore"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/osutil/sys"
+)
+
+// ekVerificationCacheEntry is the on-disk format of a cached EK certificate verification result.
+type ekVerificationCacheEntry struct {
+	EKName           tpm2.Name            `json:"ek-name,omitempty"` // Name of the persistent EK that the result applies to
+	CertDataDigest   []byte               `json:"cert-data-digest"`  // SHA-256 digest of the serialized ekCertData that was verified
+	TrustDigest      []byte               `json:"trust-digest"`      // SHA-256 digest of the trusted roots and verification profile
+	Chain            [][]byte             `json:"chain"`             // The DER encoded verified chain, starting with the EK certificate
+	DeviceAttributes *TPMDeviceAttributes `json:"device-attributes"`
+}
+
+// ekVerificationCache caches the result of verifying EK certificate data in a file, so that the chain building and TCG specific
+// checks don't have to be repeated. The cache file isn't authenticated, so a cached chain is never trusted on its own - its
+// signatures, validity periods and trust anchor are checked against the currently trusted roots on every lookup. Only the
+// certificate verification is cached - the TPM is still required to prove that it is the device for which the cached EK
+// certificate was issued on each connection. A nil *ekVerificationCache doesn't cache anything.
+type ekVerificationCache struct {
+	path   string
+	ekName tpm2.Name // If set, entries are only valid for the persistent EK with this name
+}
+
+var ekVerificationCacheDir string
+
+// SetEKVerificationCacheDir sets a directory in which the result of verifying EK certificate data is cached persistently, so that
+// SecureConnectToDefaultTPM and SecureConnectToDefaultTPMLazy don't need to repeat the X.509 certificate chain verification on
+// every boot. Cached results are keyed by the name of the TPM's persistent endorsement key, the supplied certificate data, the
+// trusted root certificates and the verification profile, and are discarded if any of these change. The cache isn't authenticated,
+// so the signatures and validity periods of a cached chain are checked again on each use, and the chain must still terminate at a
+// currently trusted root. Only the certificate verification is cached - the TPM is still required to prove that it is the device
+// for which the cached EK certificate was issued on each connection.
+//
+// The directory should only be writable by root. Passing an empty string disables the persistent cache, which is the default.
+func SetEKVerificationCacheDir(dir string) {
+	ekVerificationCacheDir = dir
+}
+
+// ekVerificationCachePath returns the path of the cache used by SecureConnectToDefaultTPMLazy, which lasts for the current boot.
+func ekVerificationCachePath() string {
+	return filepath.Join(runDir, "secboot", "ek-verification")
+}
+
+func computeEKCertDataDigest(data *ekCertData) []byte {
+	b, err := mu.MarshalToBytes(data)
+	if err != nil {
+		return nil
+	}
+	h := sha256.Sum256(b)
+	return h[:]
+}
+
+// computeEKTrustDigest computes a digest of the root certificates that EK certificates are verified against and of the supplied
+// verification profile, so that cached results are discarded if the set of trusted roots or the profile changes.
+func computeEKTrustDigest(profile *EKVerificationProfile) []byte {
+	h := sha256.New()
+	if profile == nil {
+		h.Write([]byte("built-in"))
+		for _, r := range truststore.RootCAHashes {
+			h.Write(r)
+		}
+	} else {
+		b, _ := json.Marshal(struct {
+			Name                     string
+			Manufacturers            []tpm2.TPMManufacturer
+			DeviceAttributesOptional bool
+			EKUsageOptional          bool
+			VirtualOnly              bool
+		}{profile.Name, profile.Manufacturers, profile.DeviceAttributesOptional, profile.EKUsageOptional, profile.VirtualOnly})
+		h.Write([]byte("profile"))
+		h.Write(b)
+		for _, r := range profile.Roots {
+			d := sha256.Sum256(r.Raw)
+			h.Write(d[:])
+		}
+	}
+	return h.Sum(nil)
+}
+
+// checkCachedEKCertChain checks that a chain read from the cache is still valid: that each certificate is signed by the next one
+// and is within its validity period, and that the last certificate is a currently trusted root.
+func checkCachedEKCertChain(chain []*x509.Certificate, profile *EKVerificationProfile, now time.Time) bool {
+	for i, cert := range chain {
+		if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return false
+		}
+		if i == len(chain)-1 {
+			break
+		}
+		if err := cert.CheckSignatureFrom(chain[i+1]); err != nil {
+			return false
+		}
+	}
+
+	root := chain[len(chain)-1]
+	if profile != nil {
+		return profile.isRoot(root)
+	}
+	return isCertificateTrustedCA(root)
+}
+
+// lookup returns the cached verification result for the supplied certificate data and verification profile, if there is one and
+// it is still valid.
+func (c *ekVerificationCache) lookup(data *ekCertData, profile *EKVerificationProfile) ([]*x509.Certificate, *TPMDeviceAttributes, bool) {
+	if c == nil {
+		return nil, nil, false
+	}
+
+	f, err := os.Open(c.path)
+	if err != nil {
+		return nil, nil, false
+	}
+	defer f.Close()
+
+	var entry ekVerificationCacheEntry
+	if err := json.NewDecoder(f).Decode(&entry); err != nil {
+		return nil, nil, false
+	}
+	if len(c.ekName) > 0 && !bytes.Equal(entry.EKName, c.ekName) {
+		// The EK has changed since this result was cached.
+		return nil, nil, false
+	}
+	digest := computeEKCertDataDigest(data)
+	if digest == nil || !bytes.Equal(entry.CertDataDigest, digest) || len(entry.Chain) == 0 {
+		return nil, nil, false
+	}
+	if !bytes.Equal(entry.TrustDigest, computeEKTrustDigest(profile)) {
+		// The trusted roots or verification profile have changed since this result was cached.
+		return nil, nil, false
+	}
+	if !bytes.Equal(entry.Chain[0], data.Cert) {
+		return nil, nil, false
+	}
+
+	var chain []*x509.Certificate
+	for _, der := range entry.Chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, nil, false
+		}
+		chain = append(chain, cert)
+	}
+	if !checkCachedEKCertChain(chain, profile, time.Now()) {
+		return nil, nil, false
+	}
+	return chain, entry.DeviceAttributes, true
+}
+
+// store records the result of successfully verifying the supplied certificate data. Errors are ignored, because the cache is
+// only an optimization.
+func (c *ekVerificationCache) store(data *ekCertData, profile *EKVerificationProfile, chain []*x509.Certificate, attrs *TPMDeviceAttributes) {
+	if c == nil {
+		return
+	}
+
+	digest := computeEKCertDataDigest(data)
+	if digest == nil {
+		return
+	}
+	entry := ekVerificationCacheEntry{EKName: c.ekName, CertDataDigest: digest, TrustDigest: computeEKTrustDigest(profile), DeviceAttributes: attrs}
+	for _, cert := range chain {
+		entry.Chain = append(entry.Chain, cert.Raw)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return
+	}
+	f, err := osutil.NewAtomicFile(c.path, 0600, 0, sys.UserID(osutil.NoChown), sys.GroupID(osutil.NoChown))
+	if err != nil {
+		return
+	}
+	defer f.Cancel()
+
+	if err := json.NewEncoder(f).Encode(&entry); err != nil {
+		return
+	}
+	f.Commit()
+}
+
+// ekVerificationCacheAt returns a cache stored at the specified path for the EK of the TPM associated with this connection, or
+// nil if the TPM doesn't have a persistent EK.
+func (t *TPMConnection) ekVerificationCacheAt(path string) *ekVerificationCache {
+	ek, err := t.CreateResourceContextFromTPM(tcg.EKHandle)
+	if err != nil {
+		return nil
+	}
+	return &ekVerificationCache{path: path, ekName: ek.Name()}
+}
+
+// persistentEKVerificationCache returns the persistent cache configured with SetEKVerificationCacheDir for the EK of the TPM
+// associated with this connection, or nil if there isn't a persistent cache or the TPM doesn't have a persistent EK.
+func (t *TPMConnection) persistentEKVerificationCache() *ekVerificationCache {
+	if ekVerificationCacheDir == "" {
+		return nil
+	}
+	return t.ekVerificationCacheAt(filepath.Join(ekVerificationCacheDir, "ek-verification"))
+}
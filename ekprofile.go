@@ -0,0 +1,174 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"sync"
+
+	"github.com/canonical/go-tpm2"
+)
+
+// EKVerificationProfile describes how to verify the EK certificate of a class of TPMs whose certificates aren't issued by one of
+// the TPM manufacturers trusted by default, such as the virtual TPMs provided by cloud platforms. These are signed by CAs
+// operated by the cloud provider, and their layout often doesn't follow the "TCG EK Credential Profile" specification.
+//
+// A profile is selected by SecureConnectToDefaultTPM and the other secure connection functions based on the TPM manufacturer
+// property, once it has been registered with RegisterEKVerificationProfile. Note that this property is reported by the TPM
+// itself, so a profile only changes which roots are trusted and which requirements are relaxed. An EK certificate must still
+// chain to one of the profile's roots, and the TPM must still prove that it has the corresponding private key.
+type EKVerificationProfile struct {
+	// Name is a human readable name for this profile.
+	Name string
+
+	// Manufacturers contains the TPM manufacturer property values that this profile applies to.
+	Manufacturers []tpm2.TPMManufacturer
+
+	// Roots contains the root CA certificates that EK certificates must chain to. These are used instead of the built-in TPM
+	// manufacturer root CAs.
+	Roots []*x509.Certificate
+
+	// DeviceAttributesOptional indicates that the EK certificate doesn't need to contain the TPM manufacturer, model and firmware
+	// version in its subject alternative name. If it doesn't, TPMConnection.VerifiedDeviceAttributes will return nil.
+	DeviceAttributesOptional bool
+
+	// EKUsageOptional indicates that the certificate chain doesn't need to assert the tcg-kp-EKCertificate extended key usage.
+	EKUsageOptional bool
+
+	// VirtualOnly indicates that this profile only applies to TPMs that TPMConnection.Environment classifies as virtual. This
+	// must be set when the manufacturer property is shared with physical TPMs, such as Microsoft's which is reported by both the
+	// Azure virtual TPM and the Pluton security processor.
+	VirtualOnly bool
+}
+
+func (p *EKVerificationProfile) isRoot(cert *x509.Certificate) bool {
+	for _, r := range p.Roots {
+		if bytes.Equal(r.Raw, cert.Raw) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *EKVerificationProfile) appliesTo(manufacturer tpm2.TPMManufacturer, isVirtual func() bool) bool {
+	for _, m := range p.Manufacturers {
+		if m == manufacturer {
+			return !p.VirtualOnly || isVirtual()
+		}
+	}
+	return false
+}
+
+// GCEEKVerificationProfile returns a profile for the virtual TPMs provided to Google Compute Engine shielded and confidential VMs.
+// Their EK certificates don't contain the TCG device attributes or extended key usage. The roots are published by Google and must
+// be supplied by the caller, as they aren't shipped with this package.
+func GCEEKVerificationProfile(roots ...*x509.Certificate) *EKVerificationProfile {
+	return &EKVerificationProfile{
+		Name:                     "gce",
+		Manufacturers:            []tpm2.TPMManufacturer{tpmManufacturerGOOG},
+		Roots:                    roots,
+		DeviceAttributesOptional: true,
+		EKUsageOptional:          true}
+}
+
+// AzureEKVerificationProfile returns a profile for the virtual TPMs provided to Azure trusted launch and confidential VMs. Their
+// EK certificates are issued by the Azure virtual TPM CA, and don't assert the TCG extended key usage. The roots are published by
+// Microsoft and must be supplied by the caller, as they aren't shipped with this package.
+//
+// The Azure virtual TPM reports Microsoft's manufacturer property, which is shared with the Pluton security processor found in
+// physical devices. The profile is therefore only used for TPMs that are classified as virtual, and Pluton EK certificates continue
+// to be verified against the built-in TPM manufacturer roots.
+func AzureEKVerificationProfile(roots ...*x509.Certificate) *EKVerificationProfile {
+	return &EKVerificationProfile{
+		Name:                     "azure",
+		Manufacturers:            []tpm2.TPMManufacturer{tpmManufacturerMSFT},
+		Roots:                    roots,
+		DeviceAttributesOptional: true,
+		EKUsageOptional:          true,
+		VirtualOnly:              true}
+}
+
+// AWSEKVerificationProfile returns a profile for the NitroTPM virtual TPMs provided to Amazon EC2 instances. The roots are
+// published by Amazon and must be supplied by the caller, as they aren't shipped with this package.
+func AWSEKVerificationProfile(roots ...*x509.Certificate) *EKVerificationProfile {
+	return &EKVerificationProfile{
+		Name:                     "aws",
+		Manufacturers:            []tpm2.TPMManufacturer{tpmManufacturerAMZN},
+		Roots:                    roots,
+		DeviceAttributesOptional: true,
+		EKUsageOptional:          true}
+}
+
+var (
+	ekVerificationProfilesMu sync.Mutex
+	ekVerificationProfiles   []*EKVerificationProfile
+)
+
+// RegisterEKVerificationProfile registers the supplied profile so that it is used to verify the EK certificate of TPMs with a
+// matching manufacturer property. If more than one registered profile applies to a TPM, the most recently registered one is used.
+// Profiles must not be modified once they have been registered. An error is returned if the profile doesn't contain any roots, as
+// no EK certificate could be verified with it.
+func RegisterEKVerificationProfile(profile *EKVerificationProfile) error {
+	if len(profile.Roots) == 0 {
+		return fmt.Errorf("EK verification profile %q has no root certificates", profile.Name)
+	}
+	ekVerificationProfilesMu.Lock()
+	defer ekVerificationProfilesMu.Unlock()
+	ekVerificationProfiles = append(ekVerificationProfiles, profile)
+	return nil
+}
+
+// UnregisterEKVerificationProfile removes a profile that was registered with RegisterEKVerificationProfile.
+func UnregisterEKVerificationProfile(profile *EKVerificationProfile) {
+	ekVerificationProfilesMu.Lock()
+	defer ekVerificationProfilesMu.Unlock()
+	for i, p := range ekVerificationProfiles {
+		if p == profile {
+			ekVerificationProfiles = append(ekVerificationProfiles[:i], ekVerificationProfiles[i+1:]...)
+			return
+		}
+	}
+}
+
+// lookupEKVerificationProfile returns the registered profile that applies to a TPM with the specified manufacturer, or nil if
+// there isn't one, in which case the built-in TPM manufacturer roots should be used. The isVirtual callback is only called for
+// profiles that are restricted to virtual TPMs.
+func lookupEKVerificationProfile(manufacturer tpm2.TPMManufacturer, isVirtual func() bool) *EKVerificationProfile {
+	ekVerificationProfilesMu.Lock()
+	defer ekVerificationProfilesMu.Unlock()
+	for i := len(ekVerificationProfiles) - 1; i >= 0; i-- {
+		if ekVerificationProfiles[i].appliesTo(manufacturer, isVirtual) {
+			return ekVerificationProfiles[i]
+		}
+	}
+	return nil
+}
+
+// EKCertificateVerifyFunc is a callback used to build and verify the certificate chain for an endorsement key certificate, in place
+// of the built-in call to x509.Certificate.Verify. It is supplied via SecureConnectOptions. The opts argument contains the roots and
+// intermediates that would be used by the built-in verification. The callback should return the verified candidate chains in the
+// same form as x509.Certificate.Verify, each starting with cert. It may use a different set of roots, or apply additional checks
+// such as checking for revocation with CRLs or OCSP.
+//
+// The TCG specific requirements for EK certificates (the key algorithm, basic constraints, key usage, TPM device attributes and
+// extended key usage) are still checked by this package.
+type EKCertificateVerifyFunc func(cert *x509.Certificate, opts x509.VerifyOptions) ([][]*x509.Certificate, error)
@@ -0,0 +1,67 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	. "github.com/snapcore/secboot"
+)
+
+func TestRegisterEKVerificationProfileNoRoots(t *testing.T) {
+	if err := RegisterEKVerificationProfile(GCEEKVerificationProfile()); err == nil {
+		t.Errorf("RegisterEKVerificationProfile should fail for a profile without roots")
+	}
+}
+
+func TestLookupEKVerificationProfile(t *testing.T) {
+	root := &x509.Certificate{}
+	azure := AzureEKVerificationProfile(root)
+	gce := GCEEKVerificationProfile(root)
+	for _, p := range []*EKVerificationProfile{azure, gce} {
+		if err := RegisterEKVerificationProfile(p); err != nil {
+			t.Fatalf("RegisterEKVerificationProfile failed: %v", err)
+		}
+		defer UnregisterEKVerificationProfile(p)
+	}
+
+	for _, data := range []struct {
+		desc         string
+		manufacturer tpm2.TPMManufacturer
+		virtual      bool
+		expected     *EKVerificationProfile
+	}{
+		{desc: "AzureVirtual", manufacturer: 0x4d534654, virtual: true, expected: azure},
+		// Pluton reports the same manufacturer as the Azure virtual TPM.
+		{desc: "Pluton", manufacturer: 0x4d534654, expected: nil},
+		{desc: "GCE", manufacturer: 0x474f4f47, expected: gce},
+		{desc: "Other", manufacturer: tpm2.TPMManufacturerINTC, virtual: true, expected: nil},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			profile := LookupEKVerificationProfile(data.manufacturer, func() bool { return data.virtual })
+			if profile != data.expected {
+				t.Errorf("Unexpected profile: %v", profile)
+			}
+		})
+	}
+}
@@ -0,0 +1,561 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	"github.com/snapcore/secboot/internal/tcg"
+
+	"golang.org/x/xerrors"
+)
+
+// enrolmentBundleVersion is the current version of the enrolment bundle format.
+const enrolmentBundleVersion = 1
+
+// enrolmentAKTemplate is the template of the transient attestation key that is used to sign the quote in an enrolment bundle. It
+// is a restricted signing key so that it can only be used to sign structures generated by the TPM.
+var enrolmentAKTemplate = tpm2.Public{
+	Type:    tpm2.ObjectTypeECC,
+	NameAlg: tpm2.HashAlgorithmSHA256,
+	Attrs: tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrSensitiveDataOrigin | tpm2.AttrUserWithAuth | tpm2.AttrRestricted |
+		tpm2.AttrSign,
+	Params: tpm2.PublicParamsU{
+		Data: &tpm2.ECCParams{
+			Symmetric: tpm2.SymDefObject{Algorithm: tpm2.SymObjectAlgorithmNull},
+			Scheme: tpm2.ECCScheme{
+				Scheme:  tpm2.ECCSchemeECDSA,
+				Details: tpm2.AsymSchemeU{Data: &tpm2.SigSchemeECDSA{HashAlg: tpm2.HashAlgorithmSHA256}}},
+			CurveID: tpm2.ECCCurveNIST_P256,
+			KDF:     tpm2.KDFScheme{Scheme: tpm2.KDFAlgorithmNull}}},
+	Unique: tpm2.PublicIDU{Data: &tpm2.ECCPoint{}}}
+
+// EnrolmentBundleParams contains the parameters for CreateEnrolmentBundle.
+type EnrolmentBundleParams struct {
+	// Nonce is a fresh value supplied by the server that will verify the bundle, in order to prove that the bundle was
+	// created after the nonce was issued.
+	Nonce []byte
+
+	// KeyLocations contains the locations of the sealed key data to describe in the bundle.
+	KeyLocations []KeyLocation
+
+	// PCRs is the selection of PCRs to include in the quote. It may be empty.
+	PCRs tpm2.PCRSelectionList
+}
+
+// EnrolmentProvisioningStatus describes the provisioning state of a TPM at the time that an enrolment bundle was created.
+type EnrolmentProvisioningStatus struct {
+	SRKPresent         bool `json:"srk-present"`          // A persistent object exists at the standard SRK handle
+	EKPresent          bool `json:"ek-present"`           // A persistent object exists at the standard EK handle
+	LockoutAuthSet     bool `json:"lockout-auth-set"`     // The lockout hierarchy has an authorization value
+	OwnerAuthSet       bool `json:"owner-auth-set"`       // The storage hierarchy has an authorization value
+	EndorsementAuthSet bool `json:"endorsement-auth-set"` // The endorsement hierarchy has an authorization value
+	DisableClear       bool `json:"disable-clear"`        // Clearing the TPM with the lockout hierarchy is disabled
+	InLockout          bool `json:"in-lockout"`           // The TPM is in dictionary attack lockout mode
+	PrimaryKeysValid   bool `json:"primary-keys-valid"`   // The primary keys passed TPMConnection.VerifyPrimaryKeys
+	WeakPrimaryKey     bool `json:"weak-primary-key"`     // The SRK or EK is affected by a known key generation weakness
+}
+
+// EnrolmentKeyInfo describes a sealed key in an enrolment bundle.
+type EnrolmentKeyInfo struct {
+	Location               string                `json:"location"`                  // The location of the key data
+	Version                uint32                `json:"version"`                   // The key data version
+	KeyID                  *KeyID                `json:"key-id,omitempty"`          // The unique ID of the key, if recorded
+	PCRPolicyGeneration    uint64                `json:"pcr-policy-generation"`     // The generation of the PCR policy
+	PCRPolicyCounterHandle tpm2.Handle           `json:"pcr-policy-counter-handle"` // The handle of the PCR policy counter
+	AuthMode               AuthMode              `json:"auth-mode"`                 // The 2nd-factor authentication type
+	PCRs                   tpm2.PCRSelectionList `json:"pcrs"`                      // The PCRs that the current PCR policy is bound to
+	Role                   string                `json:"role,omitempty"`            // The role from the key metadata
+	Label                  string                `json:"label,omitempty"`           // The label from the key metadata
+	Error                  string                `json:"error,omitempty"`           // Set if the key data could not be read
+}
+
+// EnrolmentBundle contains the information required by a device management server to attest and inventory a device that uses
+// secboot. It is created by CreateEnrolmentBundle and checked by VerifyEnrolmentBundle. It is serialized with encoding/json.
+type EnrolmentBundle struct {
+	Version      int                         `json:"version"`
+	EKCertChain  [][]byte                    `json:"ek-cert-chain"` // DER encoded EK certificate, followed by its parents
+	Provisioning EnrolmentProvisioningStatus `json:"provisioning"`
+	Keys         []EnrolmentKeyInfo          `json:"keys"`
+	PCRValues    tpm2.PCRValues              `json:"pcr-values"`
+	AKPublic     []byte                      `json:"ak-public"` // Marshalled TPMT_PUBLIC of the attestation key
+
+	// Quote is the marshalled TPMS_ATTEST structure that was signed by the attestation key. Its extra data is the SHA-256
+	// digest of the nonce followed by the JSON encoding of this bundle with Quote and QuoteSignature cleared.
+	Quote          []byte `json:"quote"`
+	QuoteSignature []byte `json:"quote-signature"` // Marshalled TPMT_SIGNATURE
+}
+
+// digest computes the value that is used as the qualifying data for the quote in this bundle.
+func (b *EnrolmentBundle) digest(nonce []byte) (tpm2.Digest, error) {
+	body := *b
+	body.Quote = nil
+	body.QuoteSignature = nil
+
+	data, err := json.Marshal(&body)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	h.Write(nonce)
+	h.Write(data)
+	return h.Sum(nil), nil
+}
+
+func readEnrolmentProvisioningStatus(tpm *TPMConnection) (*EnrolmentProvisioningStatus, error) {
+	session := tpm.currentHmacSession().IncludeAttrs(tpm2.AttrAudit)
+
+	status := &EnrolmentProvisioningStatus{}
+
+	persistent, err := tpm.GetCapabilityHandles(tpm2.HandleTypePersistent.BaseHandle(), tpm2.CapabilityMaxProperties, session)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain persistent handles: %w", err)
+	}
+	for _, h := range persistent {
+		switch h {
+		case tcg.SRKHandle:
+			status.SRKPresent = true
+		case tcg.EKHandle:
+			status.EKPresent = true
+		}
+	}
+
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1, session)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot fetch permanent properties: %w", err)
+	}
+	if props[0].Property != tpm2.PropertyPermanent {
+		return nil, errors.New("TPM returned value for the wrong property")
+	}
+	attrs := tpm2.PermanentAttributes(props[0].Value)
+	status.LockoutAuthSet = attrs&tpm2.AttrLockoutAuthSet > 0
+	status.OwnerAuthSet = attrs&tpm2.AttrOwnerAuthSet > 0
+	status.EndorsementAuthSet = attrs&tpm2.AttrEndorsementAuthSet > 0
+	status.DisableClear = attrs&tpm2.AttrDisableClear > 0
+	status.InLockout = attrs&tpm2.AttrInLockout > 0
+
+	switch err := tpm.VerifyPrimaryKeys(); {
+	case err == nil:
+		status.PrimaryKeysValid = true
+	case err == ErrTPMProvisioning:
+	case isWeakKeyError(err):
+		status.WeakPrimaryKey = true
+	default:
+		return nil, xerrors.Errorf("cannot verify primary keys: %w", err)
+	}
+
+	return status, nil
+}
+
+func makeEnrolmentKeyInfo(location KeyLocation) EnrolmentKeyInfo {
+	info := EnrolmentKeyInfo{Location: location.String()}
+
+	k, err := ReadSealedKeyObjectFromLocation(location)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+
+	info.Version = k.Version()
+	if id, ok := k.KeyID(); ok {
+		info.KeyID = &id
+	}
+	info.PCRPolicyGeneration = k.PCRPolicyGeneration()
+	info.PCRPolicyCounterHandle = k.PCRPolicyCounterHandle()
+	info.AuthMode = k.AuthMode2F()
+	info.PCRs = k.data.dynamicPolicyData.pcrSelection
+	metadata := k.Metadata()
+	info.Role = metadata.Role
+	info.Label = metadata.Label
+	return info
+}
+
+// CreateEnrolmentBundle creates a signed enrolment bundle for the device associated with the supplied TPM connection, which can
+// be sent to a device management server and checked there with VerifyEnrolmentBundle.
+//
+// The bundle contains the EK certificate chain, the provisioning status of the TPM, a description of each of the sealed keys
+// identified by params.KeyLocations, and the current values of the PCRs selected by params.PCRs. Keys that cannot be read are
+// described with an error rather than causing this function to fail. The bundle is signed by a TPM quote, made with a transient
+// restricted signing key created in the endorsement hierarchy. The quote binds the contents of the bundle and the server supplied
+// nonce. The server proves that this key is resident on the TPM that the EK certificate was issued for by sending back a
+// challenge, which must be answered with ActivateEnrolmentChallenge.
+//
+// If the connection was created with one of the SecureConnectToTPM functions, the verified EK certificate chain is included.
+// Otherwise, only the EK certificate stored in the TPM is included, and the server must be able to obtain the intermediate
+// certificates itself.
+//
+// If the endorsement hierarchy has an authorization value, it must be set with TPMConnection.EndorsementHandleContext().SetAuthValue
+// or supplied by a callback registered with TPMConnection.SetHierarchyAuthCallback. If it is incorrect, an AuthFailError error
+// will be returned.
+func CreateEnrolmentBundle(tpm *TPMConnection, params *EnrolmentBundleParams) (*EnrolmentBundle, error) {
+	if params == nil {
+		params = &EnrolmentBundleParams{}
+	}
+
+	bundle := &EnrolmentBundle{Version: enrolmentBundleVersion}
+
+	if chain := tpm.VerifiedEKCertChain(); len(chain) > 0 {
+		for _, c := range chain {
+			bundle.EKCertChain = append(bundle.EKCertChain, c.Raw)
+		}
+	} else {
+		cert, err := readEkCertFromTPM(tpm.TPMContext)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read EK certificate: %w", err)
+		}
+		bundle.EKCertChain = [][]byte{cert}
+	}
+
+	status, err := readEnrolmentProvisioningStatus(tpm)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot determine provisioning status: %w", err)
+	}
+	bundle.Provisioning = *status
+
+	for _, l := range params.KeyLocations {
+		bundle.Keys = append(bundle.Keys, makeEnrolmentKeyInfo(l))
+	}
+
+	if len(params.PCRs) > 0 {
+		_, values, err := tpm.PCRRead(params.PCRs)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read PCR values: %w", err)
+		}
+		bundle.PCRValues = values
+	}
+
+	var ak tpm2.ResourceContext
+	var akPublic *tpm2.Public
+	if err := tpm.runWithHierarchyAuth(func() error {
+		var err error
+		ak, akPublic, _, _, _, err = tpm.CreatePrimary(tpm.EndorsementHandleContext(), nil, &enrolmentAKTemplate, nil, nil,
+			tpm.currentHmacSession())
+		switch {
+		case isAuthFailError(err, tpm2.CommandCreatePrimary, 1):
+			return AuthFailError{tpm2.HandleEndorsement}
+		case err != nil:
+			return xerrors.Errorf("cannot create attestation key: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	defer tpm.FlushContext(ak)
+
+	bundle.AKPublic, err = mu.MarshalToBytes(akPublic)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot marshal attestation key public area: %w", err)
+	}
+
+	qualifyingData, err := bundle.digest(params.Nonce)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute bundle digest: %w", err)
+	}
+
+	quoted, signature, err := tpm.Quote(ak, tpm2.Data(qualifyingData), nil, params.PCRs, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain quote: %w", err)
+	}
+	attest, err := quoted.Decode()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode quote: %w", err)
+	}
+
+	bundle.Quote, err = mu.MarshalToBytes(attest)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot marshal quote: %w", err)
+	}
+	bundle.QuoteSignature, err = mu.MarshalToBytes(signature)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot marshal quote signature: %w", err)
+	}
+
+	return bundle, nil
+}
+
+// EnrolmentChallenge is created by VerifyEnrolmentBundle on the server side and sent to the device, which must respond with the
+// value returned from ActivateEnrolmentChallenge. It is serialized with encoding/json.
+type EnrolmentChallenge struct {
+	CredentialBlob []byte `json:"credential-blob"` // The TPM2B_ID_OBJECT containing the encrypted credential, without the size field
+	Secret         []byte `json:"secret"`          // The TPM2B_ENCRYPTED_SECRET containing the encrypted seed, without the size field
+}
+
+// EnrolmentVerification contains the server side state for an enrolment bundle that is awaiting the device's response to an
+// EnrolmentChallenge.
+type EnrolmentVerification struct {
+	chain      []*x509.Certificate
+	credential []byte
+}
+
+// Complete checks the response returned from ActivateEnrolmentChallenge on the device. This proves that the attestation key that
+// signed the quote in the enrolment bundle is resident on the same TPM as the EK that the EK certificate was issued for. On
+// success, the verified EK certificate chain is returned, with the EK certificate first.
+func (v *EnrolmentVerification) Complete(response []byte) ([]*x509.Certificate, error) {
+	if subtle.ConstantTimeCompare(response, v.credential) != 1 {
+		return nil, errors.New("invalid response to enrolment challenge")
+	}
+	return v.chain, nil
+}
+
+// makeEnrolmentCredential is a software implementation of TPM2_MakeCredential for the standard RSA EK template. It protects the
+// supplied credential so that it can only be recovered with TPM2_ActivateCredential by the TPM that holds the private part of
+// ekPub, and only if the object with the specified name is loaded on the same TPM.
+func makeEnrolmentCredential(ekPub *rsa.PublicKey, name tpm2.Name, credential []byte) (*EnrolmentChallenge, error) {
+	nameAlg := tcg.EKTemplate.NameAlg
+	symmetric := tcg.EKTemplate.Params.RSADetail().Symmetric
+	if symmetric.Algorithm != tpm2.SymObjectAlgorithmAES || symmetric.Mode.Sym() != tpm2.SymModeCFB {
+		return nil, errors.New("unsupported EK symmetric algorithm")
+	}
+
+	seed := make([]byte, nameAlg.Size())
+	if _, err := rand.Read(seed); err != nil {
+		return nil, xerrors.Errorf("cannot obtain seed: %w", err)
+	}
+	secret, err := rsa.EncryptOAEP(nameAlg.NewHash(), rand.Reader, ekPub, seed, []byte("IDENTITY\x00"))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot encrypt seed: %w", err)
+	}
+
+	// Encrypt the credential, which is marshalled as a TPM2B_DIGEST.
+	symKey := kdfa(nameAlg, seed, "STORAGE", name, nil, int(symmetric.KeyBits.Sym()))
+	block, err := aes.NewCipher(symKey)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create cipher: %w", err)
+	}
+	encIdentity, err := mu.MarshalToBytes(tpm2.Digest(credential))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot marshal credential: %w", err)
+	}
+	cipher.NewCFBEncrypter(block, make([]byte, aes.BlockSize)).XORKeyStream(encIdentity, encIdentity)
+
+	// Compute the outer HMAC.
+	hmacKey := kdfa(nameAlg, seed, "INTEGRITY", nil, nil, nameAlg.Size()*8)
+	h := hmac.New(nameAlg.NewHash, hmacKey)
+	h.Write(encIdentity)
+	h.Write(name)
+
+	blob, err := mu.MarshalToBytes(tpm2.Digest(h.Sum(nil)))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot marshal integrity HMAC: %w", err)
+	}
+
+	return &EnrolmentChallenge{CredentialBlob: append(blob, encIdentity...), Secret: secret}, nil
+}
+
+// ActivateEnrolmentChallenge responds to an EnrolmentChallenge created by VerifyEnrolmentBundle for a bundle that was created by
+// CreateEnrolmentBundle on the device associated with the supplied TPM connection. The returned value must be sent back to the
+// server, which checks it with EnrolmentVerification.Complete.
+//
+// The attestation key is recreated from the endorsement hierarchy, and the EK is used to decrypt the challenge with
+// TPM2_ActivateCredential, which only succeeds if both keys are resident on the TPM that the challenge was created for. If the
+// endorsement hierarchy has an authorization value, it must be set with TPMConnection.EndorsementHandleContext().SetAuthValue or
+// supplied by a callback registered with TPMConnection.SetHierarchyAuthFunc. If it is incorrect, an AuthFailError error will be
+// returned.
+func ActivateEnrolmentChallenge(tpm *TPMConnection, challenge *EnrolmentChallenge) ([]byte, error) {
+	session, err := tpm.secretSession()
+	if err != nil {
+		return nil, err
+	}
+
+	var credential []byte
+	if err := tpm.runWithHierarchyAuth(func() error {
+		ak, _, _, _, _, err := tpm.CreatePrimary(tpm.EndorsementHandleContext(), nil, &enrolmentAKTemplate, nil, nil, session)
+		switch {
+		case isAuthFailError(err, tpm2.CommandCreatePrimary, 1):
+			return AuthFailError{tpm2.HandleEndorsement}
+		case err != nil:
+			return xerrors.Errorf("cannot create attestation key: %w", err)
+		}
+		defer tpm.FlushContext(ak)
+
+		ek, err := tpm.CreateResourceContextFromTPM(tcg.EKHandle)
+		switch {
+		case tpm2.IsResourceUnavailableError(err, tcg.EKHandle):
+			ek, err = createTransientEk(tpm.TPMContext)
+			if err != nil {
+				return xerrors.Errorf("cannot create transient EK: %w", err)
+			}
+			defer tpm.FlushContext(ek)
+		case err != nil:
+			return xerrors.Errorf("cannot create context for EK: %w", err)
+		}
+
+		// The standard EK template requires knowledge of the endorsement hierarchy authorization value.
+		policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, tcg.EKTemplate.NameAlg)
+		if err != nil {
+			return xerrors.Errorf("cannot start policy session: %w", err)
+		}
+		defer tpm.FlushContext(policySession)
+		if _, _, err := tpm.PolicySecret(tpm.EndorsementHandleContext(), policySession, nil, nil, 0, session); err != nil {
+			if isAuthFailError(err, tpm2.CommandPolicySecret, 1) {
+				return AuthFailError{tpm2.HandleEndorsement}
+			}
+			return xerrors.Errorf("cannot execute PolicySecret assertion: %w", err)
+		}
+
+		credential, err = tpm.ActivateCredential(ak, ek, tpm2.IDObjectRaw(challenge.CredentialBlob), tpm2.EncryptedSecret(challenge.Secret),
+			session.IncludeAttrs(tpm2.AttrContinueSession|tpm2.AttrResponseEncrypt), policySession)
+		if err != nil {
+			return xerrors.Errorf("cannot activate credential: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return credential, nil
+}
+
+// VerifyEnrolmentBundle checks an enrolment bundle created by CreateEnrolmentBundle on the server side, using the supplied nonce
+// which must be the one that was provided to the device. The EK certificate chain in the bundle is verified against the supplied
+// root certificates, with any additional certificates in the bundle used as intermediates. The quote signature is verified against
+// the attestation key in the bundle, and the quote is checked to bind the contents of the bundle, the nonce and the PCR values.
+//
+// The attestation key is created by the device and is not certified by the EK, so these checks alone don't prove that the quote
+// was made by the TPM identified by the EK certificate. On success, this function returns an EnrolmentChallenge, which protects a
+// fresh credential with the EK public key from the verified EK certificate and binds it to the name of the attestation key
+// (equivalent to TPM2_MakeCredential). The challenge must be sent to the device and answered with ActivateEnrolmentChallenge, and
+// the response must be checked with the returned EnrolmentVerification before the bundle is trusted. Only then is the verified EK
+// certificate chain made available.
+func VerifyEnrolmentBundle(bundle *EnrolmentBundle, roots *x509.CertPool, nonce []byte) (*EnrolmentVerification, *EnrolmentChallenge, error) {
+	if bundle.Version != enrolmentBundleVersion {
+		return nil, nil, fmt.Errorf("unsupported bundle version %d", bundle.Version)
+	}
+
+	// Verify the EK certificate chain.
+	if len(bundle.EKCertChain) == 0 {
+		return nil, nil, errors.New("no EK certificate")
+	}
+	ekCert, err := x509.ParseCertificate(bundle.EKCertChain[0])
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot parse EK certificate: %w", err)
+	}
+	intermediates := x509.NewCertPool()
+	for i, data := range bundle.EKCertChain[1:] {
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("cannot parse EK parent certificate %d: %w", i, err)
+		}
+		intermediates.AddCert(cert)
+	}
+	chains, err := ekCert.Verify(x509.VerifyOptions{
+		Intermediates: intermediates,
+		Roots:         roots,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot verify EK certificate: %w", err)
+	}
+
+	// Check the attestation key.
+	var akPublic *tpm2.Public
+	if _, err := mu.UnmarshalFromBytes(bundle.AKPublic, &akPublic); err != nil {
+		return nil, nil, xerrors.Errorf("cannot unmarshal attestation key public area: %w", err)
+	}
+	required := tpm2.AttrFixedTPM | tpm2.AttrRestricted | tpm2.AttrSign
+	if akPublic.Attrs&required != required {
+		return nil, nil, errors.New("attestation key is not a restricted signing key")
+	}
+	akKey, err := createECDSAPublicKeyFromTPM(akPublic)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot obtain attestation public key: %w", err)
+	}
+
+	// Verify the quote signature.
+	var signature *tpm2.Signature
+	if _, err := mu.UnmarshalFromBytes(bundle.QuoteSignature, &signature); err != nil {
+		return nil, nil, xerrors.Errorf("cannot unmarshal quote signature: %w", err)
+	}
+	if signature.SigAlg != tpm2.SigSchemeAlgECDSA {
+		return nil, nil, errors.New("unexpected quote signature algorithm")
+	}
+	sigHash := signature.Signature.ECDSA().Hash
+	if !sigHash.Supported() {
+		return nil, nil, errors.New("unsupported quote signature digest algorithm")
+	}
+	h := sigHash.NewHash()
+	h.Write(bundle.Quote)
+	if !ecdsa.Verify(akKey, h.Sum(nil), new(big.Int).SetBytes(signature.Signature.ECDSA().SignatureR),
+		new(big.Int).SetBytes(signature.Signature.ECDSA().SignatureS)) {
+		return nil, nil, errors.New("invalid quote signature")
+	}
+
+	// Check that the quote binds the bundle contents and nonce.
+	var attest *tpm2.Attest
+	if _, err := mu.UnmarshalFromBytes(bundle.Quote, &attest); err != nil {
+		return nil, nil, xerrors.Errorf("cannot unmarshal quote: %w", err)
+	}
+	if attest.Magic != tpm2.TPMGeneratedValue || attest.Type != tpm2.TagAttestQuote {
+		return nil, nil, errors.New("quote is not a TPM generated quote structure")
+	}
+	expected, err := bundle.digest(nonce)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot compute bundle digest: %w", err)
+	}
+	if !bytes.Equal(attest.ExtraData, expected) {
+		return nil, nil, errors.New("quote does not match the bundle contents or nonce")
+	}
+
+	// Check the PCR values against the quote.
+	quote := attest.Attested.Quote()
+	pcrDigest, err := tpm2.ComputePCRDigest(akPublic.NameAlg, quote.PCRSelect, bundle.PCRValues)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot compute PCR digest: %w", err)
+	}
+	if !bytes.Equal(quote.PCRDigest, pcrDigest) {
+		return nil, nil, errors.New("PCR values do not match the quote")
+	}
+
+	// Create a challenge that can only be answered by the TPM that holds the EK, and only if the attestation key is resident on
+	// the same TPM.
+	ekPub, ok := chains[0][0].PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, nil, errors.New("unsupported EK public key type")
+	}
+	akName, err := akPublic.Name()
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot compute attestation key name: %w", err)
+	}
+	credential := make([]byte, 32)
+	if _, err := rand.Read(credential); err != nil {
+		return nil, nil, xerrors.Errorf("cannot obtain credential: %w", err)
+	}
+	challenge, err := makeEnrolmentCredential(ekPub, akName, credential)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot create enrolment challenge: %w", err)
+	}
+
+	return &EnrolmentVerification{chain: chains[0], credential: credential}, challenge, nil
+}
@@ -0,0 +1,185 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	. "github.com/snapcore/secboot"
+)
+
+func createEnrolmentBundleForTesting(t *testing.T, tpm *TPMConnection, nonce []byte) *EnrolmentBundle {
+	bundle, err := CreateEnrolmentBundle(tpm, &EnrolmentBundleParams{
+		Nonce:        nonce,
+		KeyLocations: []KeyLocation{FileKeyLocation("testdata/keyfile-does-not-exist")},
+		PCRs:         tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7, 12}}}})
+	if err != nil {
+		t.Fatalf("CreateEnrolmentBundle failed: %v", err)
+	}
+
+	// Round-trip through JSON as the server would receive it.
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var out *EnrolmentBundle
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	return out
+}
+
+func enrolmentRootsForTesting() *x509.CertPool {
+	roots := x509.NewCertPool()
+	caCert, _ := x509.ParseCertificate(testCACert)
+	roots.AddCert(caCert)
+	return roots
+}
+
+func TestCreateAndVerifyEnrolmentBundle(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	nonce := []byte("1234567890abcdef")
+	bundle := createEnrolmentBundleForTesting(t, tpm, nonce)
+
+	if len(bundle.Keys) != 1 {
+		t.Fatalf("Unexpected number of keys (%d)", len(bundle.Keys))
+	}
+	if bundle.Keys[0].Location != "testdata/keyfile-does-not-exist" {
+		t.Errorf("Unexpected key location %q", bundle.Keys[0].Location)
+	}
+	if bundle.Keys[0].Error == "" {
+		t.Errorf("Expected an error for a missing key")
+	}
+
+	verification, challenge, err := VerifyEnrolmentBundle(bundle, enrolmentRootsForTesting(), nonce)
+	if err != nil {
+		t.Fatalf("VerifyEnrolmentBundle failed: %v", err)
+	}
+
+	response, err := ActivateEnrolmentChallenge(tpm, challenge)
+	if err != nil {
+		t.Fatalf("ActivateEnrolmentChallenge failed: %v", err)
+	}
+
+	chain, err := verification.Complete(response)
+	if err != nil {
+		t.Fatalf("Complete failed: %v", err)
+	}
+	if !bytes.Equal(chain[0].Raw, testEkCert) {
+		t.Errorf("Unexpected EK certificate")
+	}
+}
+
+func TestVerifyEnrolmentBundleWrongResponse(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	nonce := []byte("1234567890abcdef")
+	bundle := createEnrolmentBundleForTesting(t, tpm, nonce)
+
+	verification, _, err := VerifyEnrolmentBundle(bundle, enrolmentRootsForTesting(), nonce)
+	if err != nil {
+		t.Fatalf("VerifyEnrolmentBundle failed: %v", err)
+	}
+
+	// A bundle forged with an attestation key that isn't resident on the TPM can't produce the correct response.
+	if _, err := verification.Complete(make([]byte, 32)); err == nil || err.Error() != "invalid response to enrolment challenge" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestActivateEnrolmentChallengeTampered(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	nonce := []byte("1234567890abcdef")
+	bundle := createEnrolmentBundleForTesting(t, tpm, nonce)
+
+	_, challenge, err := VerifyEnrolmentBundle(bundle, enrolmentRootsForTesting(), nonce)
+	if err != nil {
+		t.Fatalf("VerifyEnrolmentBundle failed: %v", err)
+	}
+	// The TPM must refuse to activate a credential that fails the integrity check.
+	challenge.CredentialBlob[len(challenge.CredentialBlob)-1] ^= 0xff
+
+	if _, err := ActivateEnrolmentChallenge(tpm, challenge); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestVerifyEnrolmentBundleWrongNonce(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	bundle := createEnrolmentBundleForTesting(t, tpm, []byte("1234567890abcdef"))
+
+	_, _, err := VerifyEnrolmentBundle(bundle, enrolmentRootsForTesting(), []byte("fedcba0987654321"))
+	if err == nil || err.Error() != "quote does not match the bundle contents or nonce" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestVerifyEnrolmentBundleTampered(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	nonce := []byte("1234567890abcdef")
+	bundle := createEnrolmentBundleForTesting(t, tpm, nonce)
+	bundle.Provisioning.LockoutAuthSet = !bundle.Provisioning.LockoutAuthSet
+
+	_, _, err := VerifyEnrolmentBundle(bundle, enrolmentRootsForTesting(), nonce)
+	if err == nil || err.Error() != "quote does not match the bundle contents or nonce" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestVerifyEnrolmentBundleTamperedPCRValues(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	nonce := []byte("1234567890abcdef")
+	bundle := createEnrolmentBundleForTesting(t, tpm, nonce)
+	digest := bundle.PCRValues[tpm2.HashAlgorithmSHA256][7]
+	digest[0] ^= 0xff
+
+	_, _, err := VerifyEnrolmentBundle(bundle, enrolmentRootsForTesting(), nonce)
+	if err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestVerifyEnrolmentBundleUntrustedRoot(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	nonce := []byte("1234567890abcdef")
+	bundle := createEnrolmentBundleForTesting(t, tpm, nonce)
+
+	if _, _, err := VerifyEnrolmentBundle(bundle, x509.NewCertPool(), nonce); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
@@ -0,0 +1,281 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+
+	"golang.org/x/xerrors"
+)
+
+// TPMEnvironmentClass classifies the environment that a TPM is running in.
+type TPMEnvironmentClass int
+
+const (
+	// TPMEnvironmentPhysical indicates that the TPM appears to be a discrete or firmware TPM on physical hardware.
+	TPMEnvironmentPhysical TPMEnvironmentClass = iota
+
+	// TPMEnvironmentVirtual indicates that the TPM is a virtual TPM provided by a hypervisor, such as a cloud vTPM or swtpm
+	// attached to a QEMU guest. Virtual TPMs generally don't have an EK certificate issued by a TPM manufacturer, and their
+	// security depends on the hypervisor.
+	TPMEnvironmentVirtual
+
+	// TPMEnvironmentSoftware indicates that the TPM is a software TPM or simulator that doesn't appear to be attached to a
+	// virtual machine firmware.
+	TPMEnvironmentSoftware
+)
+
+func (c TPMEnvironmentClass) String() string {
+	switch c {
+	case TPMEnvironmentPhysical:
+		return "physical"
+	case TPMEnvironmentVirtual:
+		return "virtual"
+	case TPMEnvironmentSoftware:
+		return "software"
+	default:
+		return fmt.Sprintf("%d", int(c))
+	}
+}
+
+// ConfidentialComputingTechnology identifies a confidential computing technology that protects a virtual machine from its
+// hypervisor.
+type ConfidentialComputingTechnology string
+
+const (
+	// ConfidentialComputingTDX indicates that the system is an Intel TDX trust domain.
+	ConfidentialComputingTDX ConfidentialComputingTechnology = "tdx"
+
+	// ConfidentialComputingSEVSNP indicates that the system is an AMD SEV-SNP guest.
+	ConfidentialComputingSEVSNP ConfidentialComputingTechnology = "sev-snp"
+)
+
+// TPMEnvironment describes the environment that a TPM is running in, as determined by TPMConnection.Environment. The
+// classification is heuristic and is based on information that can be spoofed by a malicious hypervisor, so it should be used to
+// adjust expectations (eg, whether an EK certificate chain issued by a TPM manufacturer should be present) rather than as a basis
+// for trusting the TPM.
+type TPMEnvironment struct {
+	Class TPMEnvironmentClass
+
+	// ConfidentialComputing identifies the confidential computing technology that the virtual machine is protected by, if any.
+	// Note that a vTPM provided to a confidential virtual machine is only isolated from the host if it is implemented inside the
+	// trust boundary (eg, in a TD partition or SVSM), which can't be determined here.
+	ConfidentialComputing ConfidentialComputingTechnology
+
+	Manufacturer tpm2.TPMManufacturer // The TPM manufacturer property
+	VendorString string               // The TPM vendor string properties
+
+	// Indicators contains a human readable description of each piece of evidence that contributed to the classification.
+	Indicators []string
+}
+
+// ExpectsManufacturerEKCertChain indicates whether the TPM is expected to have an EK certificate that chains to one of the
+// built-in TPM manufacturer root CA certificates, and can therefore be verified by SecureConnectToDefaultTPM. This is false for
+// virtual and software TPMs, whose EK certificate (if there is one) is issued by the hypervisor or cloud provider.
+func (e *TPMEnvironment) ExpectsManufacturerEKCertChain() bool {
+	return e.Class == TPMEnvironmentPhysical
+}
+
+// Well known TCG vendor IDs of virtual TPM implementations.
+const (
+	tpmManufacturerMSFT tpm2.TPMManufacturer = 0x4d534654 // Microsoft (Hyper-V, Azure and Pluton)
+	tpmManufacturerGOOG tpm2.TPMManufacturer = 0x474f4f47 // Google (Compute Engine shielded VMs)
+	tpmManufacturerAMZN tpm2.TPMManufacturer = 0x414d5a4e // Amazon (NitroTPM)
+)
+
+// virtualTPMManufacturers are the TCG vendor IDs that are only used by virtual TPM implementations. Microsoft isn't included,
+// because its vendor ID is also used by the Pluton security processor in physical devices. Hyper-V and Azure virtual machines
+// are identified by their firmware measurements instead.
+var virtualTPMManufacturers = map[tpm2.TPMManufacturer]string{
+	tpmManufacturerGOOG: "Google",
+	tpmManufacturerAMZN: "Amazon",
+}
+
+// virtualFirmwareMarkers are strings that appear in measurements of the platform firmware of virtual machines.
+var virtualFirmwareMarkers = []string{"OVMF", "QEMU", "Hyper-V", "Google", "Amazon EC2", "VMware", "VirtualBox"}
+
+// confidentialComputingDevices maps the names of guest devices in /dev to the confidential computing technology that they
+// indicate.
+var confidentialComputingDevices = []struct {
+	name string
+	tech ConfidentialComputingTechnology
+}{
+	{"tdx_guest", ConfidentialComputingTDX},
+	{"sev-guest", ConfidentialComputingSEVSNP},
+}
+
+// tpmEnvironmentInfo contains the evidence used to classify a TPM environment.
+type tpmEnvironmentInfo struct {
+	manufacturer          tpm2.TPMManufacturer
+	vendorString          string
+	firmwareMarkers       []string
+	confidentialComputing ConfidentialComputingTechnology
+}
+
+// classifyTPMEnvironment classifies a TPM environment from the supplied evidence.
+func classifyTPMEnvironment(info *tpmEnvironmentInfo) *TPMEnvironment {
+	env := &TPMEnvironment{
+		Class:                 TPMEnvironmentPhysical,
+		ConfidentialComputing: info.confidentialComputing,
+		Manufacturer:          info.manufacturer,
+		VendorString:          info.vendorString}
+
+	software := info.manufacturer == tpm2.TPMManufacturerIBM && strings.Contains(info.vendorString, "SW")
+	if software {
+		env.Indicators = append(env.Indicators, fmt.Sprintf("TPM vendor string %q indicates a software TPM", info.vendorString))
+	}
+
+	virtual := false
+	if name, ok := virtualTPMManufacturers[info.manufacturer]; ok {
+		virtual = true
+		env.Indicators = append(env.Indicators, fmt.Sprintf("TPM manufacturer %s provides virtual TPMs", name))
+	}
+	for _, m := range info.firmwareMarkers {
+		virtual = true
+		env.Indicators = append(env.Indicators, fmt.Sprintf("platform firmware measurements contain %q", m))
+	}
+	if info.confidentialComputing != "" {
+		virtual = true
+		env.Indicators = append(env.Indicators, fmt.Sprintf("system is a %s guest", info.confidentialComputing))
+	}
+
+	switch {
+	case virtual:
+		env.Class = TPMEnvironmentVirtual
+	case software:
+		env.Class = TPMEnvironmentSoftware
+	}
+	return env
+}
+
+// readTPMVendorString obtains the vendor string properties from the TPM.
+func readTPMVendorString(tpm *tpm2.TPMContext, sessions ...tpm2.SessionContext) (string, error) {
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyVendorString1, 4, sessions...)
+	if err != nil {
+		return "", err
+	}
+
+	var s []byte
+	for _, p := range props {
+		if p.Property < tpm2.PropertyVendorString1 || p.Property > tpm2.PropertyVendorString4 {
+			break
+		}
+		s = append(s, byte(p.Value>>24), byte(p.Value>>16), byte(p.Value>>8), byte(p.Value))
+	}
+	return strings.TrimSpace(string(bytes.TrimRight(s, "\x00"))), nil
+}
+
+// findVirtualFirmwareMarkers returns the virtualFirmwareMarkers that appear in the platform firmware measurements in the
+// supplied log, either as ASCII or UTF-16 strings.
+func findVirtualFirmwareMarkers(log *tcglog.Log) (out []string) {
+	seen := make(map[string]bool)
+	for _, event := range log.Events {
+		if event.PCRIndex != 0 {
+			continue
+		}
+		data := event.Data.Bytes()
+		for _, m := range virtualFirmwareMarkers {
+			if seen[m] {
+				continue
+			}
+			var m16 bytes.Buffer
+			for _, c := range utf16.Encode([]rune(m)) {
+				m16.Write([]byte{byte(c), byte(c >> 8)})
+			}
+			if bytes.Contains(data, []byte(m)) || bytes.Contains(data, m16.Bytes()) {
+				seen[m] = true
+				out = append(out, m)
+			}
+		}
+	}
+	return out
+}
+
+// detectConfidentialComputing returns the confidential computing technology that the current system is protected by, based on
+// the presence of the corresponding guest devices.
+func detectConfidentialComputing() ConfidentialComputingTechnology {
+	for _, d := range confidentialComputingDevices {
+		if _, err := os.Stat(filepath.Join(devPath, d.name)); err == nil {
+			return d.tech
+		}
+	}
+	return ""
+}
+
+// virtualTPMEKCertHint returns a hint to append to EK certificate verification errors if the TPM's properties indicate that it
+// is a virtual or software TPM, which isn't expected to have an EK certificate chain issued by a TPM manufacturer.
+func virtualTPMEKCertHint(tpm *tpm2.TPMContext) string {
+	info, err := readTPMFirmwareInfo(tpm)
+	if err != nil {
+		return ""
+	}
+	vendorString, err := readTPMVendorString(tpm)
+	if err != nil {
+		return ""
+	}
+	env := classifyTPMEnvironment(&tpmEnvironmentInfo{manufacturer: info.Manufacturer, vendorString: vendorString})
+	if env.ExpectsManufacturerEKCertChain() {
+		return ""
+	}
+	return fmt.Sprintf(" (the TPM appears to be a %s TPM, which doesn't have an EK certificate chain issued by a TPM manufacturer)", env.Class)
+}
+
+// Environment classifies the environment that the TPM associated with this connection is running in, using the TPM manufacturer
+// and vendor string properties, markers in the platform firmware measurements in the TCG event log and the presence of
+// confidential computing guest devices. A missing or invalid event log is not an error - it just provides no evidence.
+//
+// Callers can use this to adjust their trust decisions. In particular, virtual TPMs don't have an EK certificate chain issued by
+// a TPM manufacturer, so SecureConnectToDefaultTPM is expected to fail with an EKCertVerificationError error for these (see
+// TPMEnvironment.ExpectsManufacturerEKCertChain).
+func (t *TPMConnection) Environment() (*TPMEnvironment, error) {
+	var info tpmEnvironmentInfo
+
+	if t.firmwareInfo != nil {
+		info.manufacturer = t.firmwareInfo.Manufacturer
+	} else {
+		firmwareInfo, err := readTPMFirmwareInfo(t.TPMContext)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot determine TPM manufacturer: %w", err)
+		}
+		info.manufacturer = firmwareInfo.Manufacturer
+	}
+
+	vendorString, err := readTPMVendorString(t.TPMContext)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain TPM vendor string: %w", err)
+	}
+	info.vendorString = vendorString
+
+	if log, err := t.EventLog(); err == nil {
+		info.firmwareMarkers = findVirtualFirmwareMarkers(log)
+	}
+
+	info.confidentialComputing = detectConfidentialComputing()
+
+	return classifyTPMEnvironment(&info), nil
+}
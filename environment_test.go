@@ -0,0 +1,115 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestClassifyTPMEnvironment(t *testing.T) {
+	for _, data := range []struct {
+		desc         string
+		manufacturer tpm2.TPMManufacturer
+		vendorString string
+		markers      []string
+		cc           ConfidentialComputingTechnology
+		class        TPMEnvironmentClass
+		indicators   int
+	}{
+		{
+			desc:         "Physical",
+			manufacturer: tpm2.TPMManufacturerINTC,
+			vendorString: "Intel",
+			class:        TPMEnvironmentPhysical,
+		},
+		{
+			desc:         "Simulator",
+			manufacturer: tpm2.TPMManufacturerIBM,
+			vendorString: "SW  TPM",
+			class:        TPMEnvironmentSoftware,
+			indicators:   1,
+		},
+		{
+			desc:         "SwtpmUnderQEMU",
+			manufacturer: tpm2.TPMManufacturerIBM,
+			vendorString: "SW  TPM",
+			markers:      []string{"OVMF"},
+			class:        TPMEnvironmentVirtual,
+			indicators:   2,
+		},
+		{
+			desc:         "HyperV",
+			manufacturer: tpm2.TPMManufacturer(0x4d534654),
+			markers:      []string{"Hyper-V"},
+			class:        TPMEnvironmentVirtual,
+			indicators:   1,
+		},
+		{
+			desc:         "Pluton",
+			manufacturer: tpm2.TPMManufacturer(0x4d534654),
+			class:        TPMEnvironmentPhysical,
+		},
+		{
+			desc:         "TDX",
+			manufacturer: tpm2.TPMManufacturer(0x474f4f47),
+			cc:           ConfidentialComputingTDX,
+			class:        TPMEnvironmentVirtual,
+			indicators:   2,
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			env := ClassifyTPMEnvironment(data.manufacturer, data.vendorString, data.markers, data.cc)
+			if env.Class != data.class {
+				t.Errorf("Unexpected class %v", env.Class)
+			}
+			if env.ConfidentialComputing != data.cc {
+				t.Errorf("Unexpected confidential computing technology %q", env.ConfidentialComputing)
+			}
+			if len(env.Indicators) != data.indicators {
+				t.Errorf("Unexpected indicators %q", env.Indicators)
+			}
+			if env.ExpectsManufacturerEKCertChain() != (data.class == TPMEnvironmentPhysical) {
+				t.Errorf("Unexpected EK certificate chain expectation")
+			}
+		})
+	}
+}
+
+func TestTPMConnectionEnvironment(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	env, err := tpm.Environment()
+	if err != nil {
+		t.Fatalf("Environment failed: %v", err)
+	}
+	if env.Manufacturer != tpm2.TPMManufacturerIBM {
+		t.Errorf("Unexpected manufacturer %v", env.Manufacturer)
+	}
+	if env.Class == TPMEnvironmentPhysical {
+		t.Errorf("The simulator should not be classified as a physical TPM")
+	}
+	if env.ExpectsManufacturerEKCertChain() {
+		t.Errorf("The simulator should not be expected to have a manufacturer EK certificate chain")
+	}
+}
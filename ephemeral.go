@@ -0,0 +1,96 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto/rand"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	defaultEphemeralCipher  = "aes-xts-plain64"
+	defaultEphemeralKeySize = 64
+)
+
+// EphemeralVolumeOptions provides options to ActivateVolumeWithEphemeralKey.
+type EphemeralVolumeOptions struct {
+	// Cipher is the cipher specification for the volume. If this
+	// is empty, "aes-xts-plain64" is used.
+	Cipher string
+
+	// KeySize is the size of the random volume key in bytes. If
+	// this is zero, a 64 byte key is used.
+	KeySize int
+
+	// ActivateOptions provides a mechanism to pass additional
+	// options to systemd-cryptsetup, such as "tmp=ext4" or
+	// "swap" to create a new filesystem or swap area on the
+	// volume once it is activated.
+	ActivateOptions []string
+}
+
+// ActivateVolumeWithEphemeralKey activates the block device at sourceDevicePath as a plain dm-crypt volume and creates a mapping
+// with the name volumeName, using a random key that is generated by this function. The key is never sealed or written anywhere,
+// and it is wiped from memory once the volume has been activated, so the contents of the volume are unrecoverable once the mapping
+// is removed. This is intended for scratch volumes such as /tmp or swap, which should be reinitialized on every boot. This makes
+// use of systemd-cryptsetup.
+//
+// The activated volume is recorded in the volume inventory in the same way as volumes activated by the other ActivateVolume
+// functions, with the VolumeProtectorEphemeral protector.
+//
+// WARNING: Any data on the block device at sourceDevicePath will be irretrievable after calling this function.
+func ActivateVolumeWithEphemeralKey(volumeName, sourceDevicePath string, options *EphemeralVolumeOptions) error {
+	if options == nil {
+		options = &EphemeralVolumeOptions{}
+	}
+
+	params := PlainCryptParams{Cipher: options.Cipher, KeySize: options.KeySize}
+	if params.Cipher == "" {
+		params.Cipher = defaultEphemeralCipher
+	}
+	if params.KeySize == 0 {
+		params.KeySize = defaultEphemeralKeySize
+	}
+	if err := params.check(); err != nil {
+		return xerrors.Errorf("invalid options: %w", err)
+	}
+
+	activateOptions, err := makeActivateOptions(options.ActivateOptions, false)
+	if err != nil {
+		return err
+	}
+	activateOptions = append(params.activateOptions(), activateOptions...)
+
+	key := make([]byte, params.KeySize)
+	keyBuf := NewSecretBuffer(key)
+	defer keyBuf.Close()
+	if _, err := rand.Read(key); err != nil {
+		return xerrors.Errorf("cannot obtain random key: %w", err)
+	}
+
+	if err := activate(volumeName, sourceDevicePath, keyBuf.Bytes(), activateOptions); err != nil {
+		return xerrors.Errorf("cannot activate volume: %w", err)
+	}
+
+	// Ignore errors - we've activated the volume and so we shouldn't return an error at this point unless we close the volume again.
+	recordActivatedVolume(newActivatedVolume(volumeName, sourceDevicePath, VolumeProtectorEphemeral, "", nil))
+	return nil
+}
@@ -0,0 +1,108 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	. "github.com/snapcore/secboot"
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type ephemeralSuite struct {
+	snapd_testutil.BaseTest
+	dir              string
+	keySizeFile      string
+	mockSdCryptsetup *snapd_testutil.MockCmd
+}
+
+var _ = Suite(&ephemeralSuite{})
+
+func (s *ephemeralSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.AddCleanup(MockRunDir(s.dir))
+
+	// The mock systemd-cryptsetup records the size of the key that it was passed.
+	s.keySizeFile = filepath.Join(s.dir, "keysize")
+	s.mockSdCryptsetup = snapd_testutil.MockCommand(c, c.MkDir()+"/systemd-cryptsetup", fmt.Sprintf(`
+if [ "$1" = "attach" ]; then
+    wc -c < "$4" | tr -d ' ' > %s
+fi
+`, s.keySizeFile))
+	s.AddCleanup(s.mockSdCryptsetup.Restore)
+	s.AddCleanup(MockSystemdCryptsetupPath(s.mockSdCryptsetup.Exe()))
+}
+
+func (s *ephemeralSuite) checkInventoryEntry(c *C, volumeName, sourceDevicePath string) {
+	devMapper := c.MkDir()
+	restore := MockDevMapperPath(devMapper)
+	defer restore()
+	c.Assert(ioutil.WriteFile(filepath.Join(devMapper, volumeName), nil, 0644), IsNil)
+
+	v, err := VolumeStatus(volumeName)
+	c.Assert(err, IsNil)
+	c.Check(v.VolumeName, Equals, volumeName)
+	c.Check(v.SourceDevicePath, Equals, sourceDevicePath)
+	c.Check(v.Protector, Equals, VolumeProtectorEphemeral)
+	c.Check(v.Keyslot, Equals, KeyslotUnknown)
+	c.Check(v.RecoveryKeyUsed(), Equals, false)
+	c.Check(v.KeyPath, Equals, "")
+	c.Check(v.KeyID, IsNil)
+}
+
+func (s *ephemeralSuite) TestActivateVolumeWithEphemeralKey(c *C) {
+	c.Check(ActivateVolumeWithEphemeralKey("scratch", "/dev/sda3", nil), IsNil)
+
+	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0][0:4], DeepEquals, []string{"systemd-cryptsetup", "attach", "scratch", "/dev/sda3"})
+	c.Check(s.mockSdCryptsetup.Calls()[0][5], Equals, "plain,cipher=aes-xts-plain64,size=512,offset=0,skip=0,hash=plain,tries=1")
+
+	size, err := ioutil.ReadFile(s.keySizeFile)
+	c.Check(err, IsNil)
+	c.Check(string(size), Equals, "64\n")
+
+	s.checkInventoryEntry(c, "scratch", "/dev/sda3")
+}
+
+func (s *ephemeralSuite) TestActivateVolumeWithEphemeralKeyOptions(c *C) {
+	c.Check(ActivateVolumeWithEphemeralKey("swap", "/dev/sda4", &EphemeralVolumeOptions{
+		Cipher:          "aes-cbc-essiv:sha256",
+		KeySize:         32,
+		ActivateOptions: []string{"swap"}}), IsNil)
+
+	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0][5], Equals, "plain,cipher=aes-cbc-essiv:sha256,size=256,offset=0,skip=0,hash=plain,swap,tries=1")
+
+	size, err := ioutil.ReadFile(s.keySizeFile)
+	c.Check(err, IsNil)
+	c.Check(string(size), Equals, "32\n")
+
+	s.checkInventoryEntry(c, "swap", "/dev/sda4")
+}
+
+func (s *ephemeralSuite) TestActivateVolumeWithEphemeralKeyInvalidCipher(c *C) {
+	c.Check(ActivateVolumeWithEphemeralKey("scratch", "/dev/sda3", &EphemeralVolumeOptions{Cipher: "aes,foo"}), ErrorMatches,
+		"invalid options: invalid cipher \"aes,foo\"")
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+}
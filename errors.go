@@ -22,8 +22,10 @@ package secboot
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
 
 	"golang.org/x/xerrors"
 )
@@ -51,12 +53,67 @@ var (
 	// ErrPINFail is returned from SealedKeyObject.UnsealFromTPM if the provided PIN is incorrect.
 	ErrPINFail = errors.New("the provided PIN is incorrect")
 
+	// ErrTPMIdentityMismatch is returned from SealedKeyObject.UnsealFromTPM if the sealed key object is bound to an endorsement key
+	// and the TPM cannot prove that it is the device that holds that endorsement key.
+	ErrTPMIdentityMismatch = errors.New("the sealed key object is bound to a different TPM")
+
+	// ErrNoVerifiedSession is returned from any function that transfers secrets to or from the TPM if TPMConnection.RequireVerifiedSession
+	// has been enabled and the connection doesn't have a session that is salted with a value protected by a verified endorsement key.
+	// It is also returned when sealing or unsealing a key that is bound to an endorsement key without such a session.
+	ErrNoVerifiedSession = errors.New("no session salted with a verified endorsement key is available for parameter encryption")
+
+	// ErrTPMSelfTestIncomplete is returned from ConnectToDefaultTPM or SecureConnectToDefaultTPM if self test on connect is
+	// enabled with SetSelfTestOnConnect and the TPM did not complete its self test in a reasonable time.
+	ErrTPMSelfTestIncomplete = errors.New("the TPM has not completed its self test")
+
 	// ErrNoTPM2Device is returned from ConnectToDefaultTPM or SecureConnectToDefaultTPM if no TPM2 device is avaiable.
 	ErrNoTPM2Device = errors.New("no TPM2 device is available")
 
 	// ErrNoActivationData is returned from GetActivationDataFromKernel if no activation data was found in the user keyring for
 	// the specified block device.
 	ErrNoActivationData = errors.New("no activation data found for the specified device")
+
+	// ErrNoLockoutAuth is returned from SealedKeyObject.LockoutAuth and SealedKeyObject.LockoutAuthWithRecoveryKey if there is
+	// no stored copy of the lockout hierarchy authorization value.
+	ErrNoLockoutAuth = errors.New("no lockout hierarchy authorization value is stored")
+
+	// ErrLockoutAuthUnwrap is returned from SealedKeyObject.LockoutAuth, SealedKeyObject.LockoutAuthWithRecoveryKey and
+	// SealedKeyObject.RewrapLockoutAuth if the stored copy of the lockout hierarchy authorization value cannot be decrypted with
+	// the supplied key.
+	ErrLockoutAuthUnwrap = errors.New("cannot decrypt the stored lockout hierarchy authorization value")
+
+	// ErrVolumeNotActivated is returned from VolumeStatus if the specified volume isn't recorded in the volume inventory as being
+	// activated.
+	ErrVolumeNotActivated = errors.New("the volume has not been activated")
+
+	// ErrNoRecoveryMarker is returned from ResealAfterRecovery if there is no recovery marker for the specified volume.
+	ErrNoRecoveryMarker = errors.New("no recovery marker found for the specified volume")
+
+	// ErrNoScheduledReseal is returned from CompleteScheduledReseal and AbortScheduledReseal if there is no scheduled reseal
+	// recorded in the specified state file.
+	ErrNoScheduledReseal = errors.New("no scheduled reseal found")
+
+	// ErrNoMatchingTPMDevice is returned from ConnectToTPMDeviceForKey if none of the TPM devices on the system match the
+	// binding recorded in a sealed key object.
+	ErrNoMatchingTPMDevice = errors.New("no TPM device matches the device that the key was sealed with")
+
+	// ErrDmVerityRootHashMismatch is returned from SealedKeyObject.CheckDmVerityRootHash, and from ActivateVolumeWithTPMSealedKey
+	// (wrapped in a *ActivateWithTPMSealedKeyError), if the dm-verity root hash of the running root filesystem isn't one of the
+	// root hashes recorded in a sealed key data file.
+	ErrDmVerityRootHashMismatch = errors.New("the dm-verity root hash is not one of the root hashes that the key was sealed for")
+
+	// ErrPCRProtectionPoliciesNotLocked is returned from VerifyPCRProtectionPoliciesLock and RearmPCRProtectionPoliciesLock if
+	// LockPCRProtectionPolicies hasn't been called during the current boot.
+	ErrPCRProtectionPoliciesNotLocked = errors.New("PCR protection policies have not been locked")
+
+	// ErrPCRProtectionPoliciesLockLost is returned from VerifyPCRProtectionPoliciesLock, and from any function that unseals a key
+	// from the TPM, if PCR protection policies were locked with LockPCRProtectionPolicies but the TPM has been restarted or reset
+	// since, eg, because the system resumed from hibernation.
+	ErrPCRProtectionPoliciesLockLost = errors.New("the TPM has been restarted or reset since PCR protection policies were locked")
+
+	// ErrKeyDataUpgradeRequiresReseal is returned from UpgradeKeyData if the key data files are a version that can only be
+	// upgraded by resealing the keys, and no TPM connection or KeyCreationParams were supplied.
+	ErrKeyDataUpgradeRequiresReseal = errors.New("the key data can only be upgraded by resealing it")
 )
 
 // TPMResourceExistsError is returned from any function that creates a persistent TPM resource if a resource already exists
@@ -69,6 +126,19 @@ func (e TPMResourceExistsError) Error() string {
 	return fmt.Sprintf("a resource already exists on the TPM at handle %v", e.Handle)
 }
 
+// InsufficientNVSpaceError is returned from TPMConnection.CheckNVSpace, and from any function that creates persistent TPM
+// resources, if the TPM reports that it doesn't have enough NV resources available for the resources that would be created.
+// It is returned before any resource is created.
+type InsufficientNVSpaceError struct {
+	Resource  string // The type of resource, eg, "persistent objects" or "NV counters"
+	Required  uint32 // The number of additional resources required
+	Available uint32 // The number of additional resources that the TPM reports are available
+}
+
+func (e InsufficientNVSpaceError) Error() string {
+	return fmt.Sprintf("insufficient NV space on the TPM: %d additional %s required but only %d available", e.Required, e.Resource, e.Available)
+}
+
 // AuthFailError is returned when an authorization check fails. The provided handle indicates the resource for which authorization
 // failed. Whilst the error normally indicates that the provided authorization value is incorrect, it may also be returned
 // for other reasons that would cause a HMAC check failure, such as a communication failure between the host CPU and the TPM
@@ -130,6 +200,45 @@ func isInvalidKeyFileError(err error) bool {
 	return xerrors.As(err, &e)
 }
 
+// KeyDataUnsupportedError is returned from ReadSealedKeyObject and the other functions that read key data if the key data was
+// created by a newer version of secboot, either because it is a newer version of the key data format or because it requires
+// features that this version doesn't support. The key data is not modified.
+type KeyDataUnsupportedError struct {
+	Version         uint32          // The version of the key data format
+	MissingFeatures KeyDataFeatures // The features required by the key data that aren't supported
+}
+
+func (e *KeyDataUnsupportedError) Error() string {
+	if e.MissingFeatures != 0 {
+		return fmt.Sprintf("key data was created by a newer version of secboot: features %v required", e.MissingFeatures)
+	}
+	return fmt.Sprintf("key data was created by a newer version of secboot: version %d required", e.Version)
+}
+
+func isKeyDataUnsupportedError(err error) bool {
+	var e *KeyDataUnsupportedError
+	return xerrors.As(err, &e)
+}
+
+// DiskIdentityMismatchError is returned from SealedKeyObject.CheckDiskIdentity, and from ActivateVolumeWithTPMSealedKey (wrapped
+// in a *ActivateWithTPMSealedKeyError), if a partition isn't one of the partitions recorded in a sealed key data file. This can
+// happen if a disk image containing the key data file was cloned to another disk without being reprovisioned.
+type DiskIdentityMismatchError struct {
+	Path          string         // The path of the partition block device
+	DiskGUID      tcglog.EFIGUID // The GUID of the disk that contains the partition
+	PartitionGUID tcglog.EFIGUID // The unique GUID of the partition
+}
+
+func (e *DiskIdentityMismatchError) Error() string {
+	return fmt.Sprintf("partition %s (GUID %v on disk %v) is not one of the partitions that the key was sealed for", e.Path,
+		e.PartitionGUID, e.DiskGUID)
+}
+
+func isDiskIdentityMismatchError(err error) bool {
+	var e *DiskIdentityMismatchError
+	return xerrors.As(err, &e)
+}
+
 // ActivateWithTPMSealedKeyError is returned from ActivateVolumeWithTPMSealedKey if activation with the TPM protected key failed.
 type ActivateWithTPMSealedKeyError struct {
 	// TPMErr details the error that occurred during activation with the TPM sealed key.
@@ -146,3 +255,180 @@ func (e *ActivateWithTPMSealedKeyError) Error() string {
 	}
 	return fmt.Sprintf("cannot activate with TPM sealed key (%v) but activation with recovery key was successful", e.TPMErr)
 }
+
+// ActivateWithHardwareProtectedKeyError is returned from ActivateVolumeWithHardwareProtectedKey if activation with the key
+// protected by a HardwareKeyProtector fails.
+type ActivateWithHardwareProtectedKeyError struct {
+	// ProtectorErr details the error that occurred during activation with the protected key.
+	ProtectorErr error
+
+	// RecoveryKeyUsageErr details the error that occurred during activation with the fallback recovery key, if activation with
+	// the recovery key was also unsuccessful.
+	RecoveryKeyUsageErr error
+}
+
+func (e *ActivateWithHardwareProtectedKeyError) Error() string {
+	if e.RecoveryKeyUsageErr != nil {
+		return fmt.Sprintf("cannot activate with protected key (%v) and activation with recovery key failed (%v)", e.ProtectorErr, e.RecoveryKeyUsageErr)
+	}
+	return fmt.Sprintf("cannot activate with protected key (%v) but activation with recovery key was successful", e.ProtectorErr)
+}
+
+// TransactionError is returned from Transaction.Run if a step of the transaction fails.
+type TransactionError struct {
+	// Step is the name of the step that failed.
+	Step string
+
+	// Err details the error returned from the step.
+	Err error
+
+	// RollbackErr details the error that occurred when rolling back the completed steps, if the rollback was unsuccessful.
+	// In this case, the journal is retained and the rollback can be retried with Transaction.Rollback.
+	RollbackErr error
+}
+
+func (e *TransactionError) Error() string {
+	if e.RollbackErr != nil {
+		return fmt.Sprintf("transaction step %q failed (%v) and rollback failed (%v)", e.Step, e.Err, e.RollbackErr)
+	}
+	return fmt.Sprintf("transaction step %q failed (%v) and was rolled back", e.Step, e.Err)
+}
+
+func (e *TransactionError) Unwrap() error {
+	return e.Err
+}
+
+// AlgorithmPolicyError is returned from any function that would need to use a cryptographic algorithm or parameter that is not
+// permitted by the algorithm policy installed with SetAlgorithmPolicy.
+type AlgorithmPolicyError struct {
+	msg string
+}
+
+func (e AlgorithmPolicyError) Error() string {
+	return fmt.Sprintf("operation not permitted by the algorithm policy: %s", e.msg)
+}
+
+// UnapprovedTPMError is returned from any function that provisions a TPM or seals keys with it if the TPM is not permitted by the
+// TPM manufacturer policy installed with SetTPMManufacturerPolicy.
+type UnapprovedTPMError struct {
+	Manufacturer    tpm2.TPMManufacturer // The manufacturer reported by the TPM
+	FirmwareVersion uint64               // The firmware version reported by the TPM
+	msg             string
+}
+
+func (e UnapprovedTPMError) Error() string {
+	return fmt.Sprintf("the TPM (manufacturer %v, firmware version %#x) is not permitted by the TPM manufacturer policy: %s",
+		e.Manufacturer, e.FirmwareVersion, e.msg)
+}
+
+// WeakKeyError is returned from any function that would use a key in the TPM that is affected by a known key generation weakness,
+// such as the flawed RSA key generation in some Infineon TPMs (CVE-2017-15361).
+type WeakKeyError struct {
+	Handle tpm2.Handle // The handle of the affected key
+}
+
+func (e WeakKeyError) Error() string {
+	return fmt.Sprintf("the key at handle %v is affected by a known key generation weakness", e.Handle)
+}
+
+func isWeakKeyError(err error) bool {
+	var e WeakKeyError
+	return xerrors.As(err, &e)
+}
+
+// TPMFirmwareChangedError is returned from SealedKeyObject.CheckTPMFirmware if the manufacturer or firmware version of the TPM differs
+// from the one recorded when the key was sealed or its PCR policy was last updated. Firmware versions are encoded with
+// TPM_PT_FIRMWARE_VERSION_1 in the most significant 32 bits and TPM_PT_FIRMWARE_VERSION_2 in the least significant 32 bits.
+type TPMFirmwareChangedError struct {
+	SealedManufacturer     tpm2.TPMManufacturer
+	SealedFirmwareVersion  uint64
+	CurrentManufacturer    tpm2.TPMManufacturer
+	CurrentFirmwareVersion uint64
+}
+
+func (e TPMFirmwareChangedError) Error() string {
+	return fmt.Sprintf("the TPM has changed since the key was sealed (manufacturer %v, firmware version %#x -> manufacturer %v, "+
+		"firmware version %#x): the key must be resealed before the next reboot", e.SealedManufacturer, e.SealedFirmwareVersion,
+		e.CurrentManufacturer, e.CurrentFirmwareVersion)
+}
+
+// TPMSelfTestError is returned from ConnectToDefaultTPM or SecureConnectToDefaultTPM if self test on connect is enabled with
+// SetSelfTestOnConnect and the TPM reports that its self test failed.
+type TPMSelfTestError struct {
+	ResponseCode tpm2.ResponseCode // The result returned from TPM2_GetTestResult
+}
+
+func (e TPMSelfTestError) Error() string {
+	if e.ResponseCode == rcFailure {
+		return "the TPM is in failure mode"
+	}
+	return fmt.Sprintf("the TPM self test failed with response code %#x", uint32(e.ResponseCode))
+}
+
+// TPMCommandTimeoutError is returned from any function that sends a command to the TPM if the TPM doesn't respond within the
+// timeout configured with TPMConnection.SetCommandTimeouts. It may be wrapped by go-tpm2. The connection can't be used for any
+// more commands once this has occurred.
+type TPMCommandTimeoutError struct {
+	Command tpm2.CommandCode
+	Timeout time.Duration
+}
+
+func (e TPMCommandTimeoutError) Error() string {
+	return fmt.Sprintf("the TPM did not respond to command %v within %v", e.Command, e.Timeout)
+}
+
+// TPM12DeviceError is returned from ConnectToDefaultTPM or SecureConnectToDefaultTPM if the only TPM device is a TPM 1.2 device,
+// which is not supported. It wraps ErrNoTPM2Device, so callers that only need to know that there is no usable TPM can test for
+// that with xerrors.Is. The fields are obtained from sysfs where available.
+type TPM12DeviceError struct {
+	Manufacturer    string
+	TCGVersion      string
+	FirmwareVersion string
+}
+
+func (e TPM12DeviceError) Error() string {
+	return fmt.Sprintf("%v (found a TPM %s device)", ErrNoTPM2Device, e.TCGVersion)
+}
+
+func (e TPM12DeviceError) Unwrap() error {
+	return ErrNoTPM2Device
+}
+
+// SignatureDbUpdateRejectedError is returned from AddEFISecureBootPolicyProfile if a pending EFI signature database update in one
+// of the supplied keystore directories would be rejected by the firmware when sbkeysync tries to apply it, because its
+// authentication header can't be verified against the current platform key or KEK database. No profile can be computed in this
+// case, as the update will never apply.
+type SignatureDbUpdateRejectedError struct {
+	Path string // The path of the rejected update
+	Db   string // The name of the signature database that the update applies to
+	msg  string
+}
+
+func (e SignatureDbUpdateRejectedError) Error() string {
+	return fmt.Sprintf("the update %s to %s would be rejected by the firmware: %s", e.Path, e.Db, e.msg)
+}
+
+// SecureBootPolicyBranchLimitError is returned from AddEFISecureBootPolicyProfile if the computed profile would contain more
+// branches than permitted by EFISecureBootPolicyProfileParams.MaxBranches. The limit is enforced while the profile is being
+// computed, in which case Stats.Branches is the number of branches when the computation was stopped rather than the number of
+// branches in the complete profile.
+type SecureBootPolicyBranchLimitError struct {
+	Stats EFISecureBootPolicyProfileStats
+	Limit int
+}
+
+func (e SecureBootPolicyBranchLimitError) Error() string {
+	return fmt.Sprintf("too many branches in secure boot policy profile: %d branches from %d signature database updates × %d load "+
+		"paths exceeds the limit of %d", e.Stats.Branches, e.Stats.SignatureDbUpdates, e.Stats.LoadPaths, e.Limit)
+}
+
+// AuditLogVerificationError is returned from AuditLog.Read, AuditLog.Head and AuditLog.Record if an entry in the audit log cannot
+// be decoded or if the hash chain is broken, which indicates that the log has been modified.
+type AuditLogVerificationError struct {
+	Sequence int // The sequence number of the first entry that failed verification
+	msg      string
+}
+
+func (e AuditLogVerificationError) Error() string {
+	return fmt.Sprintf("cannot verify audit log entry %d: %s", e.Sequence, e.msg)
+}
@@ -0,0 +1,77 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"os"
+
+	"github.com/canonical/tcglog-parser"
+	"github.com/snapcore/secboot/internal/efi"
+
+	"golang.org/x/xerrors"
+)
+
+// readEventLog reads and parses the TCG event log for the current boot.
+func readEventLog() (*tcglog.Log, error) {
+	f, err := os.Open(efi.EventLogPath)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot open TCG event log: %w", err)
+	}
+	defer f.Close()
+
+	log, err := tcglog.ParseLog(f, &tcglog.LogOptions{})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot parse TCG event log: %w", err)
+	}
+	return log, nil
+}
+
+// readEventLogWithCache returns the TCG event log for the current boot, from the cache associated with the supplied connection if
+// it isn't nil.
+func readEventLogWithCache(tpm *TPMConnection) (*tcglog.Log, error) {
+	if tpm == nil {
+		return readEventLog()
+	}
+	return tpm.EventLog()
+}
+
+// EventLog returns the parsed TCG event log for the current boot. The event log is only read and parsed the first time that this is
+// called, and the result is cached on this connection for subsequent calls, until InvalidateEventLog is called. The returned log is
+// shared between callers and must not be modified.
+func (t *TPMConnection) EventLog() (*tcglog.Log, error) {
+	if t.eventLog != nil && t.eventLogPath == efi.EventLogPath {
+		return t.eventLog, nil
+	}
+
+	log, err := readEventLog()
+	if err != nil {
+		return nil, err
+	}
+	t.eventLog = log
+	t.eventLogPath = efi.EventLogPath
+	return log, nil
+}
+
+// InvalidateEventLog discards the TCG event log cached by EventLog, so that it is read and parsed again on the next call. This
+// should be called if the caller has performed an action that results in new events being appended to the log.
+func (t *TPMConnection) InvalidateEventLog() {
+	t.eventLog = nil
+	t.eventLogPath = ""
+}
@@ -0,0 +1,71 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+func TestTPMConnectionEventLog(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	restoreEventLogPath := testutil.MockEventLogPath("testdata/eventlog1.bin")
+	defer restoreEventLogPath()
+
+	log1, err := tpm.EventLog()
+	if err != nil {
+		t.Fatalf("EventLog failed: %v", err)
+	}
+	if !log1.Algorithms.Contains(tcglog.AlgorithmId(tpm2.HashAlgorithmSHA256)) {
+		t.Errorf("Unexpected algorithms: %v", log1.Algorithms)
+	}
+
+	log2, err := tpm.EventLog()
+	if err != nil {
+		t.Fatalf("EventLog failed: %v", err)
+	}
+	if log2 != log1 {
+		t.Errorf("EventLog should have returned the cached log")
+	}
+
+	tpm.InvalidateEventLog()
+	log3, err := tpm.EventLog()
+	if err != nil {
+		t.Fatalf("EventLog failed: %v", err)
+	}
+	if log3 == log1 {
+		t.Errorf("EventLog should have parsed the log again after InvalidateEventLog")
+	}
+	if len(log3.Events) != len(log1.Events) {
+		t.Errorf("Unexpected number of events (%d)", len(log3.Events))
+	}
+
+	restoreEventLogPath2 := testutil.MockEventLogPath("testdata/nonexistent")
+	defer restoreEventLogPath2()
+	if _, err := tpm.EventLog(); err == nil {
+		t.Errorf("EventLog should have failed after the event log path changed")
+	}
+}
@@ -0,0 +1,124 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"github.com/canonical/go-tpm2"
+)
+
+// SecurityEventType identifies the type of a SecurityEvent.
+type SecurityEventType int
+
+const (
+	// SecurityEventLockout indicates that the TPM's dictionary attack protection has been triggered, either by an operation that
+	// found the TPM to already be in lockout mode or by an authorization failure that caused it to enter lockout mode. Operations
+	// that require authorization with a PIN will fail until the lockout recovery time has elapsed or the lockout is reset.
+	SecurityEventLockout SecurityEventType = iota + 1
+
+	// SecurityEventDACounterIncremented indicates that an incorrect PIN was supplied, causing the TPM's dictionary attack counter to
+	// be incremented.
+	SecurityEventDACounterIncremented
+
+	// SecurityEventUnsealBlocked indicates that a key could not be unsealed because access to it has been blocked by the legacy
+	// lock NV index, which is used by version 0 key data files.
+	SecurityEventUnsealBlocked
+
+	// SecurityEventPCRPolicyRevoked indicates that previous PCR protection policies for one or more keys were revoked by
+	// incrementing the associated PCR policy counter.
+	SecurityEventPCRPolicyRevoked
+
+	// SecurityEventDiskIdentityMismatch indicates that a key data file was used to activate a volume that isn't one of the
+	// partitions that it was sealed for, and activation continued because DiskIdentityCheckWarn was specified.
+	SecurityEventDiskIdentityMismatch
+)
+
+// SecurityEvent describes a security relevant event that occurred during an operation.
+type SecurityEvent struct {
+	Type SecurityEventType
+
+	// KeyIDs contains the IDs of the keys associated with this event, where known. Key IDs are only recorded in version 3 and
+	// later key data files.
+	KeyIDs []KeyID
+
+	// LockoutCounter and MaxAuthFail are the values of the TPM's dictionary attack counter and the number of authorization
+	// failures before lockout mode is entered. These are only set for SecurityEventLockout and SecurityEventDACounterIncremented.
+	LockoutCounter uint32
+	MaxAuthFail    uint32
+}
+
+// SecurityEventSink is implemented by types that want to be notified of security relevant events, so that they can raise alerts
+// or record telemetry. It can be associated with a TPMConnection using TPMConnection.SetSecurityEventSink.
+//
+// HandleSecurityEvent is called synchronously from the operation that triggered the event, so it shouldn't block. It can't
+// influence the result of the operation.
+type SecurityEventSink interface {
+	HandleSecurityEvent(event *SecurityEvent)
+}
+
+// SetSecurityEventSink sets the sink that is notified of security relevant events that occur during operations that use this
+// connection. Set this to nil to disable notifications.
+func (t *TPMConnection) SetSecurityEventSink(sink SecurityEventSink) {
+	t.eventSink = sink
+}
+
+// notify delivers the supplied event to the security event sink associated with this connection, if there is one.
+func (t *TPMConnection) notify(event *SecurityEvent) {
+	if t.eventSink == nil {
+		return
+	}
+	t.eventSink.HandleSecurityEvent(event)
+}
+
+// notifyDAState reads the current state of the TPM's dictionary attack protection and delivers a SecurityEventLockout event if the
+// TPM is in lockout mode. If pinFail is true, a SecurityEventDACounterIncremented event is delivered first.
+func (t *TPMConnection) notifyDAState(keyIDs []KeyID, pinFail bool) {
+	if t.eventSink == nil {
+		return
+	}
+
+	var counter, maxAuthFail uint32
+	if props, err := t.GetCapabilityTPMProperties(tpm2.PropertyLockoutCounter, 2); err == nil && len(props) == 2 &&
+		props[0].Property == tpm2.PropertyLockoutCounter && props[1].Property == tpm2.PropertyMaxAuthFail {
+		counter = props[0].Value
+		maxAuthFail = props[1].Value
+	}
+
+	if pinFail {
+		t.notify(&SecurityEvent{Type: SecurityEventDACounterIncremented, KeyIDs: keyIDs, LockoutCounter: counter, MaxAuthFail: maxAuthFail})
+	}
+
+	props, err := t.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
+	if err != nil || len(props) == 0 || props[0].Property != tpm2.PropertyPermanent {
+		return
+	}
+	if tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrInLockout > 0 {
+		t.notify(&SecurityEvent{Type: SecurityEventLockout, KeyIDs: keyIDs, LockoutCounter: counter, MaxAuthFail: maxAuthFail})
+	}
+}
+
+// notifyForError delivers the events associated with an error returned from an operation that authorizes with a PIN.
+func (t *TPMConnection) notifyForError(keyIDs []KeyID, err error) {
+	switch err {
+	case ErrTPMLockout:
+		t.notifyDAState(keyIDs, false)
+	case ErrPINFail:
+		t.notifyDAState(keyIDs, true)
+	}
+}
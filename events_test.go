@@ -0,0 +1,127 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"math/rand"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type mockSecurityEventSink struct {
+	events []*SecurityEvent
+}
+
+func (s *mockSecurityEventSink) HandleSecurityEvent(event *SecurityEvent) {
+	s.events = append(s.events, event)
+}
+
+type eventsSuite struct {
+	testutil.TPMSimulatorTestBase
+	key     []byte
+	authKey TPMPolicyAuthKey
+	keyFile string
+	sink    *mockSecurityEventSink
+}
+
+var _ = Suite(&eventsSuite{})
+
+func (s *eventsSuite) SetUpSuite(c *C) {
+	s.key = make([]byte, 64)
+	rand.Read(s.key)
+}
+
+func (s *eventsSuite) SetUpTest(c *C) {
+	s.TPMSimulatorTestBase.SetUpTest(c)
+	c.Assert(s.TPM.EnsureProvisioned(ProvisionModeFull, nil), IsNil)
+	s.ResetTPMSimulator(c)
+
+	s.keyFile = c.MkDir() + "/keydata"
+
+	pcrPolicyCounterHandle := tpm2.Handle(0x0181fff0)
+	authKey, err := SealKeyToTPM(s.TPM, s.key, s.keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: pcrPolicyCounterHandle})
+	c.Assert(err, IsNil)
+	s.authKey = authKey
+	policyCounter, err := s.TPM.CreateResourceContextFromTPM(pcrPolicyCounterHandle)
+	c.Assert(err, IsNil)
+	s.AddCleanupNVSpace(c, s.TPM.OwnerHandleContext(), policyCounter)
+
+	s.sink = new(mockSecurityEventSink)
+	s.TPM.SetSecurityEventSink(s.sink)
+}
+
+func (s *eventsSuite) keyID(c *C) KeyID {
+	k, err := ReadSealedKeyObject(s.keyFile)
+	c.Assert(err, IsNil)
+	id, ok := k.KeyID()
+	c.Assert(ok, Equals, true)
+	return id
+}
+
+func (s *eventsSuite) TestDACounterIncremented(c *C) {
+	c.Assert(ChangePIN(s.TPM, s.keyFile, "", "1234"), IsNil)
+	c.Check(s.sink.events, HasLen, 0)
+
+	k, err := ReadSealedKeyObject(s.keyFile)
+	c.Assert(err, IsNil)
+	_, _, err = k.UnsealFromTPM(s.TPM, "5678")
+	c.Check(err, Equals, ErrPINFail)
+
+	c.Assert(s.sink.events, HasLen, 1)
+	c.Check(s.sink.events[0].Type, Equals, SecurityEventDACounterIncremented)
+	c.Check(s.sink.events[0].KeyIDs, DeepEquals, []KeyID{s.keyID(c)})
+	c.Check(s.sink.events[0].LockoutCounter, Equals, uint32(1))
+	c.Check(s.sink.events[0].MaxAuthFail, Not(Equals), uint32(0))
+}
+
+func (s *eventsSuite) TestLockout(c *C) {
+	// Put the TPM in DA lockout mode
+	c.Assert(s.TPM.DictionaryAttackParameters(s.TPM.LockoutHandleContext(), 0, 7200, 86400, nil), IsNil)
+
+	k, err := ReadSealedKeyObject(s.keyFile)
+	c.Assert(err, IsNil)
+	_, _, err = k.UnsealFromTPM(s.TPM, "")
+	c.Check(err, Equals, ErrTPMLockout)
+
+	c.Assert(s.sink.events, HasLen, 1)
+	c.Check(s.sink.events[0].Type, Equals, SecurityEventLockout)
+	c.Check(s.sink.events[0].KeyIDs, DeepEquals, []KeyID{s.keyID(c)})
+}
+
+func (s *eventsSuite) TestPCRPolicyRevoked(c *C) {
+	c.Assert(UpdateKeyPCRProtectionPolicy(s.TPM, s.keyFile, s.authKey, getTestPCRProfile()), IsNil)
+
+	c.Assert(s.sink.events, HasLen, 1)
+	c.Check(s.sink.events[0].Type, Equals, SecurityEventPCRPolicyRevoked)
+	c.Check(s.sink.events[0].KeyIDs, DeepEquals, []KeyID{s.keyID(c)})
+}
+
+func (s *eventsSuite) TestNoEventsOnSuccess(c *C) {
+	k, err := ReadSealedKeyObject(s.keyFile)
+	c.Assert(err, IsNil)
+	key, _, err := k.UnsealFromTPM(s.TPM, "")
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, s.key)
+	c.Check(s.sink.events, HasLen, 0)
+}
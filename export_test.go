@@ -23,48 +23,54 @@ import (
 	"bytes"
 	"crypto/ecdsa"
 	"fmt"
+	"io"
 	"os"
+	"time"
 
 	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
 	"github.com/canonical/tcglog-parser"
+	sbefi "github.com/snapcore/secboot/efi"
+	"github.com/snapcore/secboot/internal/efi"
 )
 
 // Export constants for testing
 const (
-	CurrentMetadataVersion                = currentMetadataVersion
-	LockNVHandle                          = lockNVHandle
-	SigDbUpdateQuirkModeNone              = sigDbUpdateQuirkModeNone
-	SigDbUpdateQuirkModeDedupIgnoresOwner = sigDbUpdateQuirkModeDedupIgnoresOwner
+	CurrentMetadataVersion = currentMetadataVersion
+	LockNVHandle           = lockNVHandle
 )
 
 // Export variables and unexported functions for testing
 var (
-	ComputeDbUpdate                          = computeDbUpdate
 	ComputeDynamicPolicy                     = computeDynamicPolicy
 	CreatePcrPolicyCounter                   = createPcrPolicyCounter
 	ComputePcrPolicyCounterAuthPolicies      = computePcrPolicyCounterAuthPolicies
 	ComputePcrPolicyRefFromCounterContext    = computePcrPolicyRefFromCounterContext
 	ComputePcrPolicyRefFromCounterName       = computePcrPolicyRefFromCounterName
 	ComputePeImageDigest                     = computePeImageDigest
+	ComputePeImageDigestWithCache            = computePeImageDigestWithCache
 	ComputePolicyORData                      = computePolicyORData
 	ComputeSnapModelDigest                   = computeSnapModelDigest
 	ComputeStaticPolicy                      = computeStaticPolicy
 	CreateTPMPublicAreaForECDSAKey           = createTPMPublicAreaForECDSAKey
-	DecodeSecureBootDb                       = decodeSecureBootDb
-	DecodeWinCertificate                     = decodeWinCertificate
-	EFICertTypePkcs7Guid                     = efiCertTypePkcs7Guid
-	EFICertX509Guid                          = efiCertX509Guid
+	FindBitLockerVolumes                     = findBitLockerVolumes
+	HkdfSHA256                               = hkdfSHA256
 	ExecutePolicySession                     = executePolicySession
 	IdentifyInitialOSLaunchVerificationEvent = identifyInitialOSLaunchVerificationEvent
 	IncrementPcrPolicyCounter                = incrementPcrPolicyCounter
+	IsUBootCRTMVersionEvent                  = isUBootCRTMVersionEvent
 	IsDynamicPolicyDataError                 = isDynamicPolicyDataError
+	IsROCAVulnerableModulus                  = isROCAVulnerableModulus
 	IsStaticPolicyDataError                  = isStaticPolicyDataError
 	LockNVIndex1Attrs                        = lockNVIndex1Attrs
+	LookupEKVerificationProfile              = lookupEKVerificationProfile
+	LookupTPMQuirks                          = lookupTPMQuirks
 	PerformPinChange                         = performPinChange
 	ReadPcrPolicyCounter                     = readPcrPolicyCounter
 	ReadShimVendorCert                       = readShimVendorCert
-	WinCertTypePKCSSignedData                = winCertTypePKCSSignedData
-	WinCertTypeEfiGuid                       = winCertTypeEfiGuid
+	ReadTPM12DeviceInfo                      = readTPM12DeviceInfo
+	TPMDeviceTypeAndKernelName               = tpmDeviceTypeAndKernelName
+	WriteRecoveryMarker                      = writeRecoveryMarker
 )
 
 // Alias some unexported types for testing. These are required in order to pass these between functions in tests, or to access
@@ -95,28 +101,12 @@ func (d *DynamicPolicyData) AuthorizedPolicySignature() *tpm2.Signature {
 	return d.authorizedPolicySignature
 }
 
-type EFISignatureData = efiSignatureData
-
-func (s *EFISignatureData) SignatureType() tcglog.EFIGUID {
-	return s.signatureType
-}
-
-func (s *EFISignatureData) Owner() tcglog.EFIGUID {
-	return s.owner
-}
-
-func (s *EFISignatureData) Data() []byte {
-	return s.data
-}
-
 type SecureBootVerificationEvent = secureBootVerificationEvent
 
 func (e *SecureBootVerificationEvent) MeasuredInPreOS() bool {
 	return e.measuredInPreOS
 }
 
-type SigDbUpdateQuirkMode = sigDbUpdateQuirkMode
-
 type StaticPolicyData = staticPolicyData
 
 func (d *StaticPolicyData) AuthPublicKey() *tpm2.Public {
@@ -135,14 +125,6 @@ func (d *StaticPolicyData) V0PinIndexAuthPolicies() tpm2.DigestList {
 	return d.v0PinIndexAuthPolicies
 }
 
-type WinCertificateAuthenticode = winCertificateAuthenticode
-type WinCertificateUefiGuid = winCertificateUefiGuid
-
-// Export some helpers for testing.
-func GetWinCertificateType(cert winCertificate) uint16 {
-	return cert.wCertificateType()
-}
-
 type MockPolicyPCRParam struct {
 	PCR     int
 	Alg     tpm2.HashAlgorithmId
@@ -184,6 +166,45 @@ func MakeMockPolicyPCRValuesFull(params []MockPolicyPCRParam) (out []tpm2.PCRVal
 	return
 }
 
+func MockBlockDevicePaths(sysClassBlock, dev string) (restore func()) {
+	origSysClassBlockPath := sysClassBlockPath
+	origDevPath := devPath
+	sysClassBlockPath = sysClassBlock
+	devPath = dev
+	return func() {
+		sysClassBlockPath = origSysClassBlockPath
+		devPath = origDevPath
+	}
+}
+
+func MockDevMapperPath(path string) (restore func()) {
+	origDevMapperPath := devMapperPath
+	devMapperPath = path
+	return func() {
+		devMapperPath = origDevMapperPath
+	}
+}
+
+func MockProcCmdlinePath(path string) (restore func()) {
+	origProcCmdlinePath := procCmdlinePath
+	procCmdlinePath = path
+	return func() {
+		procCmdlinePath = origProcCmdlinePath
+	}
+}
+
+const PCRPolicyLockNVHandle = pcrPolicyLockNVHandle
+
+var IsOwnedNVIndex = isOwnedNVIndex
+
+func MockBootIDPath(path string) (restore func()) {
+	orig := bootIDPath
+	bootIDPath = path
+	return func() {
+		bootIDPath = orig
+	}
+}
+
 func MockRunDir(path string) (restore func()) {
 	origRunDir := runDir
 	runDir = path
@@ -200,6 +221,101 @@ func MockSystemdCryptsetupPath(path string) (restore func()) {
 	}
 }
 
+func MockTPMSysfsPath(path string) (restore func()) {
+	origTPMSysfsPath := tpmSysfsPath
+	tpmSysfsPath = path
+	return func() {
+		tpmSysfsPath = origTPMSysfsPath
+	}
+}
+
+func MockSysClassTPMPath(path string) (restore func()) {
+	origSysClassTPMPath := sysClassTPMPath
+	sysClassTPMPath = path
+	return func() {
+		sysClassTPMPath = origSysClassTPMPath
+	}
+}
+
+func MockTimeNow(fn func() time.Time) (restore func()) {
+	origTimeNow := timeNow
+	timeNow = fn
+	return func() {
+		timeNow = origTimeNow
+	}
+}
+
+func MockTimeSleep(fn func(time.Duration)) (restore func()) {
+	origTimeSleep := timeSleep
+	timeSleep = fn
+	return func() {
+		timeSleep = origTimeSleep
+	}
+}
+
+// CheckSignatureDbUpdatesAreAuthorized checks the updates at the specified paths, which are keyed by the name of the database
+// that they apply to, applying them in the order KEK, db, dbx.
+func CheckSignatureDbUpdatesAreAuthorized(updates map[string]string) error {
+	var list []*secureBootDbUpdate
+	for _, db := range []string{"KEK", "db", "dbx"} {
+		if path, ok := updates[db]; ok {
+			list = append(list, &secureBootDbUpdate{db: db, path: path})
+		}
+	}
+	return checkSignatureDbUpdatesAreAuthorized(efi.EFIVarsPath, list)
+}
+
+// ReadShimVendorDbs returns the variable name and signatures associated with the vendor certificate or vendor_db read from the shim
+// executable accessed via r, and the signatures from its vendor_dbx.
+func ReadShimVendorDbs(r io.ReaderAt) (dbName string, dbSigs [][]byte, dbxSigs [][]byte, err error) {
+	db, dbx, err := readShimVendorDbs(r)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	for _, sig := range db.signatures {
+		dbSigs = append(dbSigs, sig.Data)
+	}
+	for _, sig := range dbx.signatures {
+		dbxSigs = append(dbxSigs, sig.Data)
+	}
+	return db.unicodeName, dbSigs, dbxSigs, nil
+}
+
+// ShimDbxContainsImageDigest indicates whether a vendor_dbx containing the supplied signatures forbids an image with the supplied
+// SHA-1 and SHA-256 Authenticode digests.
+func ShimDbxContainsImageDigest(sigs []*sbefi.SignatureData, sha1, sha256 []byte) bool {
+	dbx := &secureBootDb{variableName: shimGuid, unicodeName: shimVendorDbxName, signatures: sigs}
+	return dbx.containsImageDigest(&peImageDigests{sha1: sha1, sha256: sha256})
+}
+
+func (t *TPMConnection) MockHmacSessionEkName(name tpm2.Name) (restore func()) {
+	orig := t.hmacSessionEkName
+	t.hmacSessionEkName = name
+	return func() {
+		t.hmacSessionEkName = orig
+	}
+}
+
+func (t *TPMConnection) MockUnverified() (restore func()) {
+	orig := t.verifiedEkCertChain
+	t.verifiedEkCertChain = nil
+	return func() {
+		t.verifiedEkCertChain = orig
+	}
+}
+
+func DetectEFIPlatform(events []*tcglog.Event) string {
+	return detectEFIPlatform(events).String()
+}
+
+func NewTestingRetryTcti(tcti io.ReadWriteCloser) io.ReadWriteCloser {
+	return &testingRetryTcti{tcti: tcti}
+}
+
+func NewCommandTimeoutTcti(tcti io.ReadWriteCloser, timeouts TPMCommandTimeouts) io.ReadWriteCloser {
+	return &commandTimeoutTcti{tcti: tcti, timeouts: timeouts}
+}
+
 func NewDynamicPolicyComputeParams(key *ecdsa.PrivateKey, signAlg tpm2.HashAlgorithmId, pcrs tpm2.PCRSelectionList,
 	pcrDigests tpm2.DigestList, policyCounterName tpm2.Name, policyCount uint64) *dynamicPolicyComputeParams {
 	return &dynamicPolicyComputeParams{
@@ -247,3 +363,103 @@ func ValidateKeyDataFile(tpm *tpm2.TPMContext, keyFile string, authPrivateKey TP
 	_, _, _, err = decodeAndValidateKeyData(tpm, kf, authPrivateKey, session)
 	return err
 }
+
+// WriteKeyDataWithRequiredFeatures rewrites the key data file at path so that it records the supplied required features, as
+// though it was created by a newer version that supports them.
+func WriteKeyDataWithRequiredFeatures(path string, features KeyDataFeatures) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := decodeKeyData(f)
+	if err != nil {
+		return err
+	}
+	b, err := mu.MarshalToBytes(features)
+	if err != nil {
+		return err
+	}
+	data.unknownExtensions = append(data.unknownExtensions, keyDataExtensionRaw{Type: keyDataExtensionRequiredFeatures, Data: b})
+	return data.writeToFileAtomic(path)
+}
+
+// WriteKeyDataWithVersion rewrites the key data file at src to dst using the on-disk format of the specified version, as though
+// it was written by an older version of this package. This only changes the on-disk format - the sealed key object is unchanged.
+func WriteKeyDataWithVersion(src, dst string, version uint32) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := decodeKeyData(f)
+	if err != nil {
+		return err
+	}
+	data.version = version
+	return data.writeToFileAtomic(dst)
+}
+
+func (k *SealedKeyObject) AuthorizedPCRPolicy() tpm2.Digest {
+	return k.data.dynamicPolicyData.authorizedPolicy
+}
+
+func (k *SealedKeyObject) SealedObjectName() (tpm2.Name, error) {
+	return k.data.keyPublic.Name()
+}
+
+func (k *SealedKeyObject) SetTPMFirmwareVersion(version uint64) {
+	k.data.tpmFirmwareInfo.FirmwareVersion = version
+}
+
+func (c *EFIImageDigestCache) Entries() map[string]tpm2.Digest {
+	return c.entries
+}
+
+func ClassifyTPMEnvironment(manufacturer tpm2.TPMManufacturer, vendorString string, firmwareMarkers []string, cc ConfidentialComputingTechnology) *TPMEnvironment {
+	return classifyTPMEnvironment(&tpmEnvironmentInfo{
+		manufacturer:          manufacturer,
+		vendorString:          vendorString,
+		firmwareMarkers:       firmwareMarkers,
+		confidentialComputing: cc})
+}
+
+type SignatureDbUpdate struct {
+	Db   string
+	Path string
+}
+
+// SignatureDbCache provides access to the signature database cache shared between the branches of a secure boot profile.
+type SignatureDbCache struct {
+	gen *secureBootPolicyGen
+}
+
+func NewSignatureDbCache(efivarsPath string, updates []SignatureDbUpdate) *SignatureDbCache {
+	gen := &secureBootPolicyGen{efivarsPath: efivarsPath}
+	for _, u := range updates {
+		gen.sigDbUpdates = append(gen.sigDbUpdates, &secureBootDbUpdate{db: u.Db, path: u.Path})
+	}
+	return &SignatureDbCache{gen: gen}
+}
+
+func (c *SignatureDbCache) Contents(name, filename string, level int, quirkMode sbefi.DbUpdateQuirkMode) ([]byte, error) {
+	e, err := c.gen.signatureDbContents(name, filename, level, quirkMode)
+	if err != nil {
+		return nil, err
+	}
+	return e.data, nil
+}
+
+func (c *SignatureDbCache) Signatures(name, filename string, level int, quirkMode sbefi.DbUpdateQuirkMode) ([]*sbefi.SignatureData, error) {
+	e, err := c.gen.signatureDbContents(name, filename, level, quirkMode)
+	if err != nil {
+		return nil, err
+	}
+	db, err := e.decode(efiImageSecurityDatabaseGuid, name)
+	if err != nil {
+		return nil, err
+	}
+	return db.signatures, nil
+}
@@ -0,0 +1,94 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// maxHierarchyAuthTries is the maximum number of times that an operation is attempted with authorization values obtained from a
+// HierarchyAuthFunc. The owner and endorsement hierarchies aren't subject to dictionary attack protection, so authorization
+// failures for them don't increment the TPM's dictionary attack counter. This limit just avoids prompting the user indefinitely.
+const maxHierarchyAuthTries = 3
+
+// HierarchyAuthFunc is a callback used to obtain the authorization value for the specified hierarchy (tpm2.HandleOwner or
+// tpm2.HandleEndorsement), for example by prompting the user. It is called when an operation fails because the authorization
+// value currently set for the hierarchy is incorrect, with the number of times that it has already been called for the current
+// operation. Returning an error aborts the operation.
+type HierarchyAuthFunc func(hierarchy tpm2.Handle, attempt int) ([]byte, error)
+
+// SetHierarchyAuth sets the authorization value used for the specified hierarchy (tpm2.HandleOwner, tpm2.HandleEndorsement or
+// tpm2.HandleLockout) by all subsequent operations on this connection. This is required when the TPM is owned by other software
+// that has set authorization values for these hierarchies. This is equivalent to calling SetAuthValue on the corresponding
+// hierarchy ResourceContext.
+func (t *TPMConnection) SetHierarchyAuth(hierarchy tpm2.Handle, auth []byte) error {
+	switch hierarchy {
+	case tpm2.HandleOwner:
+		t.OwnerHandleContext().SetAuthValue(auth)
+	case tpm2.HandleEndorsement:
+		t.EndorsementHandleContext().SetAuthValue(auth)
+	case tpm2.HandleLockout:
+		t.LockoutHandleContext().SetAuthValue(auth)
+	default:
+		return fmt.Errorf("invalid hierarchy %v", hierarchy)
+	}
+	return nil
+}
+
+// SetHierarchyAuthFunc sets a callback used to obtain the authorization value for the owner or endorsement hierarchy when an
+// operation on this connection fails with a AuthFailError for one of those hierarchies. The value obtained from the callback is
+// set on the connection, as if it was supplied with SetHierarchyAuth, and the operation is attempted again. The operations that
+// support this are TPMConnection.EnsureProvisioned, SealKeyToTPMMultiple and the functions that use it, and
+// SealedKeyObject.UnsealFromTPMWithAudit.
+//
+// The callback is not used for the lockout hierarchy, because a single authorization failure for it prevents it from being used
+// until the lockout recovery time has expired. Set fn to nil to remove a callback that was previously set.
+func (t *TPMConnection) SetHierarchyAuthFunc(fn HierarchyAuthFunc) {
+	t.hierarchyAuthFn = fn
+}
+
+// runWithHierarchyAuth runs the supplied function, and if it fails with a AuthFailError for the owner or endorsement hierarchy
+// and a HierarchyAuthFunc has been set, obtains a new authorization value from it and runs the function again. The supplied
+// function must be safe to run again after failing with an authorization error.
+func (t *TPMConnection) runWithHierarchyAuth(fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+
+		var e AuthFailError
+		if t.hierarchyAuthFn == nil || !xerrors.As(err, &e) || attempt >= maxHierarchyAuthTries-1 {
+			return err
+		}
+		if e.Handle != tpm2.HandleOwner && e.Handle != tpm2.HandleEndorsement {
+			return err
+		}
+
+		auth, cbErr := t.hierarchyAuthFn(e.Handle, attempt)
+		if cbErr != nil {
+			return xerrors.Errorf("cannot obtain authorization value for %v: %w", e.Handle, cbErr)
+		}
+		if err := t.SetHierarchyAuth(e.Handle, auth); err != nil {
+			return err
+		}
+	}
+}
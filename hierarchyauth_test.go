@@ -0,0 +1,121 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+
+	"golang.org/x/xerrors"
+)
+
+func TestSealKeyToTPMWithHierarchyAuthFunc(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	setHierarchyAuthForTest(t, tpm, tpm.OwnerHandleContext())
+	defer func() {
+		tpm.OwnerHandleContext().SetAuthValue(testAuth)
+		resetHierarchyAuth(t, tpm, tpm.OwnerHandleContext())
+	}()
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	run := func(t *testing.T, fn HierarchyAuthFunc) error {
+		tpm.OwnerHandleContext().SetAuthValue(nil)
+		tpm.SetHierarchyAuthFunc(fn)
+		defer tpm.SetHierarchyAuthFunc(nil)
+
+		tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMWithHierarchyAuthFunc_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		_, err = SealKeyToTPM(tpm, key, tmpDir+"/keydata", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: tpm2.HandleNull})
+		return err
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		var calls int
+		if err := run(t, func(hierarchy tpm2.Handle, attempt int) ([]byte, error) {
+			if hierarchy != tpm2.HandleOwner {
+				t.Errorf("Unexpected hierarchy %v", hierarchy)
+			}
+			if attempt != calls {
+				t.Errorf("Unexpected attempt %d", attempt)
+			}
+			calls++
+			if calls == 1 {
+				return []byte("1234"), nil
+			}
+			return testAuth, nil
+		}); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+		if calls != 2 {
+			t.Errorf("Unexpected number of calls: %d", calls)
+		}
+	})
+
+	t.Run("TooManyAttempts", func(t *testing.T) {
+		var calls int
+		err := run(t, func(hierarchy tpm2.Handle, attempt int) ([]byte, error) {
+			calls++
+			return nil, nil
+		})
+		if e, ok := err.(AuthFailError); !ok || e.Handle != tpm2.HandleOwner {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if calls != 2 {
+			t.Errorf("Unexpected number of calls: %d", calls)
+		}
+	})
+
+	t.Run("CallbackError", func(t *testing.T) {
+		errCancelled := errors.New("cancelled")
+		err := run(t, func(hierarchy tpm2.Handle, attempt int) ([]byte, error) {
+			return nil, errCancelled
+		})
+		if !xerrors.Is(err, errCancelled) {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
+func TestSetHierarchyAuth(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.SetHierarchyAuth(tpm2.HandlePlatform, nil); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
@@ -0,0 +1,314 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/canonical/go-tpm2/mu"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	hardwareKeyDataHeader  uint32 = 0x55534b57
+	hardwareKeyDataVersion uint32 = 1
+)
+
+// ErrInvalidWrappedKey is returned from HardwareKeyProtector.UnwrapKey implementations (possibly wrapped) when the hardware
+// rejects the wrapped key, either because it has been modified or because it was wrapped on a different device.
+var ErrInvalidWrappedKey = errors.New("the wrapped key is invalid or was created by a different device")
+
+// HardwareKeyProtector is implemented by roots of trust other than the TPM that can protect keys by wrapping them with a
+// device-unique hardware key which never leaves the device, such as a trusted application running in ARM TrustZone. Keys
+// protected in this way are stored in the same locations as TPM sealed key objects (see KeyLocation), and volumes can be activated
+// with them using ActivateVolumeWithHardwareProtectedKey.
+type HardwareKeyProtector interface {
+	// Protector returns the identifier of this protector. This is recorded in key data files created by
+	// SealKeyWithHardwareProtector and in the volume inventory.
+	Protector() VolumeProtector
+
+	// WrapKey wraps the supplied key with the device-unique hardware key.
+	WrapKey(key []byte) ([]byte, error)
+
+	// UnwrapKey unwraps a key that was previously wrapped by WrapKey on the same device. If the hardware rejects the wrapped key,
+	// the returned error should wrap ErrInvalidWrappedKey.
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+var (
+	hardwareKeyProtectorsMu sync.Mutex
+	hardwareKeyProtectors   = make(map[VolumeProtector]HardwareKeyProtector)
+)
+
+// RegisterHardwareKeyProtector registers the supplied protector so that it is selected automatically for key data files that
+// were created by it, when UnsealKeyWithHardwareProtector or ActivateVolumeWithHardwareProtectedKey are called without a
+// protector. This is intended to be called by platform-specific code during initialization, for platforms where the protector
+// isn't known by the code that activates volumes. Registering a protector replaces any existing protector with the same identifier.
+func RegisterHardwareKeyProtector(protector HardwareKeyProtector) {
+	hardwareKeyProtectorsMu.Lock()
+	defer hardwareKeyProtectorsMu.Unlock()
+	hardwareKeyProtectors[protector.Protector()] = protector
+}
+
+// UnregisterHardwareKeyProtector removes the protector with the specified identifier that was registered with
+// RegisterHardwareKeyProtector.
+func UnregisterHardwareKeyProtector(name VolumeProtector) {
+	hardwareKeyProtectorsMu.Lock()
+	defer hardwareKeyProtectorsMu.Unlock()
+	delete(hardwareKeyProtectors, name)
+}
+
+func registeredHardwareKeyProtector(name VolumeProtector) HardwareKeyProtector {
+	hardwareKeyProtectorsMu.Lock()
+	defer hardwareKeyProtectorsMu.Unlock()
+	return hardwareKeyProtectors[name]
+}
+
+// hardwareKeyData is the on-disk format of a key that is protected by a HardwareKeyProtector.
+type hardwareKeyData struct {
+	Protector  []byte
+	WrappedKey []byte
+}
+
+func (d *hardwareKeyData) write(w io.Writer) error {
+	_, err := mu.MarshalToWriter(w, hardwareKeyDataHeader, hardwareKeyDataVersion, d)
+	return err
+}
+
+func decodeHardwareKeyData(r io.Reader) (*hardwareKeyData, error) {
+	var header uint32
+	var version uint32
+	var d hardwareKeyData
+	if _, err := mu.UnmarshalFromReader(r, &header, &version); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal header: %w", err)
+	}
+	if header != hardwareKeyDataHeader {
+		return nil, fmt.Errorf("unexpected header (%d)", header)
+	}
+	if version != hardwareKeyDataVersion {
+		return nil, fmt.Errorf("unexpected version number (%d)", version)
+	}
+	if _, err := mu.UnmarshalFromReader(r, &d); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal key data: %w", err)
+	}
+	return &d, nil
+}
+
+// SealKeyWithHardwareProtector wraps the supplied key with protector and atomically writes the result to location, from where it
+// can be unsealed again with UnsealKeyWithHardwareProtector or used to activate a volume with
+// ActivateVolumeWithHardwareProtectedKey. The wrapped key can only be unwrapped on the same device.
+func SealKeyWithHardwareProtector(protector HardwareKeyProtector, key []byte, location KeyLocation) (err error) {
+	defer observeOperation(MetricsOperationSeal, time.Now(), &err)
+
+	if len(key) == 0 {
+		return errors.New("no key supplied")
+	}
+
+	wrapped, err := protector.WrapKey(key)
+	if err != nil {
+		return xerrors.Errorf("cannot wrap key: %w", err)
+	}
+
+	data := &hardwareKeyData{Protector: []byte(protector.Protector()), WrappedKey: wrapped}
+	if err := location.WriteAtomic(data.write); err != nil {
+		return xerrors.Errorf("cannot write key data: %w", err)
+	}
+	return nil
+}
+
+// UnsealKeyWithHardwareProtector reads the key data created by SealKeyWithHardwareProtector from location and unwraps the key
+// with protector. If protector is nil, the protector registered with RegisterHardwareKeyProtector for the identifier recorded in
+// the key data is used.
+//
+// If the key data cannot be decoded, or it was created by a different protector, or the hardware rejects the wrapped key, an
+// InvalidKeyFileError error will be returned. If protector is nil and no protector is registered for the key data, an
+// InvalidKeyFileError error will also be returned.
+func UnsealKeyWithHardwareProtector(protector HardwareKeyProtector, location KeyLocation) (key []byte, err error) {
+	defer observeOperation(MetricsOperationUnseal, time.Now(), &err)
+
+	r, err := location.Open()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot open key data: %w", err)
+	}
+	defer r.Close()
+
+	// Read the whole file so that a truncated file is detected as an invalid file rather than an I/O error.
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read key data: %w", err)
+	}
+
+	data, err := decodeHardwareKeyData(bytes.NewReader(b))
+	if err != nil {
+		return nil, InvalidKeyFileError{err.Error()}
+	}
+	if protector == nil {
+		protector = registeredHardwareKeyProtector(VolumeProtector(data.Protector))
+		if protector == nil {
+			return nil, InvalidKeyFileError{fmt.Sprintf("no protector is registered for %q", string(data.Protector))}
+		}
+	}
+	if VolumeProtector(data.Protector) != protector.Protector() {
+		return nil, InvalidKeyFileError{fmt.Sprintf("key data was created by the %q protector", string(data.Protector))}
+	}
+
+	key, err = protector.UnwrapKey(data.WrappedKey)
+	switch {
+	case xerrors.Is(err, ErrInvalidWrappedKey):
+		return nil, InvalidKeyFileError{err.Error()}
+	case err != nil:
+		return nil, xerrors.Errorf("cannot unwrap key: %w", err)
+	}
+	return key, nil
+}
+
+// readHardwareKeyProtectorName returns the identifier of the protector that created the key data at location.
+func readHardwareKeyProtectorName(location KeyLocation) (VolumeProtector, error) {
+	r, err := location.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	data, err := decodeHardwareKeyData(r)
+	if err != nil {
+		return "", err
+	}
+	return VolumeProtector(data.Protector), nil
+}
+
+func activateWithHardwareProtectedKey(protector HardwareKeyProtector, volumeName, cryptDevicePath string, keyLocation KeyLocation, activateOptions []string) (p VolumeProtector, err error) {
+	phases := new(metricsPhases)
+	defer observeOperationPhases(MetricsOperationActivate, time.Now(), &err, nil, phases)
+
+	// Errors from reading the protector name are ignored here - they will be reported by UnsealKeyWithHardwareProtector.
+	if protector != nil {
+		p = protector.Protector()
+	} else if name, err := readHardwareKeyProtectorName(keyLocation); err == nil {
+		p = name
+	}
+
+	key, err := UnsealKeyWithHardwareProtector(protector, keyLocation)
+	if err != nil {
+		return p, xerrors.Errorf("cannot unseal key: %w", err)
+	}
+	keyBuf := NewSecretBuffer(key)
+	defer keyBuf.Close()
+
+	start := time.Now()
+	err = activate(volumeName, cryptDevicePath, keyBuf.Bytes(), activateOptions)
+	phases.observe(MetricsPhaseCryptsetup, start)
+	if err != nil {
+		return p, xerrors.Errorf("cannot activate volume: %w", err)
+	}
+	return p, nil
+}
+
+// ActivateVolumeWithHardwareProtectedKey attempts to activate the LUKS or plain dm-crypt encrypted volume at sourceDevicePath and
+// create a mapping with the name volumeName, using the key protected by protector that is stored at keyLocation (see
+// SealKeyWithHardwareProtector). This makes use of systemd-cryptsetup. If protector is nil, the protector registered with
+// RegisterHardwareKeyProtector for the identifier recorded in the key data is used.
+//
+// The ActivateOptions, RecoveryKeyTries, AuthRequestor, AuthRequestTimeout, KeyringPrefix, Integrity, PlainCrypt and ReadOnly
+// fields of options behave in the same way as they do for ActivateVolumeWithTPMSealedKey. The other fields are ignored, and the
+// protector is always attempted before the recovery key.
+//
+// If activation with the protected key fails, this function will attempt to activate the volume with the fallback recovery key
+// instead, and a *ActivateWithHardwareProtectedKeyError error will be returned even if this is successful. A recovery marker is
+// written in the same way as ActivateVolumeWithTPMSealedKey does.
+//
+// If the volume is successfully activated, it is recorded in the volume inventory with the protector's identifier and this function
+// returns true. If it is not successfully activated, then this function returns false.
+func ActivateVolumeWithHardwareProtectedKey(protector HardwareKeyProtector, volumeName, sourceDevicePath string, keyLocation KeyLocation, options *ActivateVolumeOptions) (bool, error) {
+	if options.RecoveryKeyTries < 0 {
+		return false, errors.New("invalid RecoveryKeyTries")
+	}
+
+	activateOptions, err := makeActivateOptions(options.ActivateOptions, options.ReadOnly)
+	if err != nil {
+		return false, err
+	}
+
+	plainCrypt := options.PlainCrypt
+	if plainCrypt != nil {
+		if err := plainCrypt.check(); err != nil {
+			return false, xerrors.Errorf("invalid plain dm-crypt parameters: %w", err)
+		}
+		activateOptions = append(plainCrypt.activateOptions(), activateOptions...)
+	}
+	cryptDevicePath, closeIntegrity, err := openIntegrityDeviceForVolume(volumeName, sourceDevicePath, options.Integrity, options.ReadOnly)
+	if err != nil {
+		return false, err
+	}
+
+	keyPath := keyLocation.String()
+
+	name, protectorErr := activateWithHardwareProtectedKey(protector, volumeName, cryptDevicePath, keyLocation, activateOptions)
+	if protectorErr == nil {
+		volume := newActivatedVolume(volumeName, sourceDevicePath, name, "", nil)
+		volume.KeyPath = keyPath
+		if plainCrypt == nil {
+			volume.Keyslot = 0
+		}
+		volume.ReadOnly = options.ReadOnly
+		// Ignore errors - the volume has been activated.
+		recordActivatedVolume(volume)
+		return true, nil
+	}
+
+	if plainCrypt != nil {
+		// Plain dm-crypt volumes have no keyslots, so there is no recovery key to fall back to.
+		closeIntegrity()
+		return false, &ActivateWithHardwareProtectedKeyError{protectorErr, errors.New("cannot activate a plain dm-crypt volume with a recovery key")}
+	}
+
+	reason := RecoveryKeyUsageReasonUnexpectedError
+	if isInvalidKeyFileError(protectorErr) || isExecError(protectorErr, systemdCryptsetupPath) {
+		reason = RecoveryKeyUsageReasonInvalidKeyFile
+	}
+	if rErr := activateWithRecoveryKey(volumeName, sourceDevicePath, cryptDevicePath, newAuthRequest(nil, options), options.RecoveryKeyTries, reason, activateOptions, options.KeyringPrefix, options.ReadOnly, nil); rErr != nil {
+		closeIntegrity()
+		return false, &ActivateWithHardwareProtectedKeyError{protectorErr, rErr}
+	}
+
+	volume := newActivatedVolume(volumeName, sourceDevicePath, VolumeProtectorRecoveryKey, "", nil)
+	volume.KeyPath = keyPath
+	volume.RecoveryReason = reason
+	volume.ReadOnly = options.ReadOnly
+	// Ignore errors - the volume has been activated.
+	recordActivatedVolume(volume)
+	if !options.ReadOnly {
+		writeRecoveryMarker(&RecoveryMarker{
+			VolumeName:       volumeName,
+			SourceDevicePath: sourceDevicePath,
+			KeyPath:          keyPath,
+			Reason:           reason,
+			TPMError:         protectorErr.Error(),
+			Time:             volume.Time})
+	}
+	return true, &ActivateWithHardwareProtectedKeyError{protectorErr, nil}
+}
@@ -0,0 +1,259 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	. "github.com/snapcore/secboot"
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	"golang.org/x/xerrors"
+
+	. "gopkg.in/check.v1"
+)
+
+// mockHardwareKeyProtector is a HardwareKeyProtector that wraps keys with AES-GCM using a per-instance device key.
+type mockHardwareKeyProtector struct {
+	name      VolumeProtector
+	deviceKey []byte
+}
+
+func newMockHardwareKeyProtector(c *C, name VolumeProtector) *mockHardwareKeyProtector {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	c.Assert(err, IsNil)
+	return &mockHardwareKeyProtector{name: name, deviceKey: key}
+}
+
+func (p *mockHardwareKeyProtector) aead() cipher.AEAD {
+	b, err := aes.NewCipher(p.deviceKey)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+func (p *mockHardwareKeyProtector) Protector() VolumeProtector {
+	return p.name
+}
+
+func (p *mockHardwareKeyProtector) WrapKey(key []byte) ([]byte, error) {
+	aead := p.aead()
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func (p *mockHardwareKeyProtector) UnwrapKey(wrapped []byte) ([]byte, error) {
+	aead := p.aead()
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrInvalidWrappedKey
+	}
+	key, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, xerrors.Errorf("%w (%v)", ErrInvalidWrappedKey, err)
+	}
+	return key, nil
+}
+
+type hwKeySuite struct {
+	snapd_testutil.BaseTest
+	dir              string
+	keyFile          string
+	mockSdCryptsetup *snapd_testutil.MockCmd
+}
+
+var _ = Suite(&hwKeySuite{})
+
+func (s *hwKeySuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.AddCleanup(MockRunDir(s.dir))
+
+	// The mock systemd-cryptsetup records the key that it was passed.
+	s.keyFile = filepath.Join(s.dir, "key")
+	s.mockSdCryptsetup = snapd_testutil.MockCommand(c, c.MkDir()+"/systemd-cryptsetup", fmt.Sprintf(`
+if [ "$1" = "attach" ]; then
+    cat "$4" > %s
+fi
+`, s.keyFile))
+	s.AddCleanup(s.mockSdCryptsetup.Restore)
+	s.AddCleanup(MockSystemdCryptsetupPath(s.mockSdCryptsetup.Exe()))
+}
+
+func (s *hwKeySuite) TestSealAndUnseal(c *C) {
+	protector := newMockHardwareKeyProtector(c, "mock")
+	location := &memoryKeyLocation{name: "key"}
+
+	key := []byte("1234567890123456789012345678901234567890123456789012345678901234")
+	c.Assert(SealKeyWithHardwareProtector(protector, key, location), IsNil)
+
+	unsealed, err := UnsealKeyWithHardwareProtector(protector, location)
+	c.Check(err, IsNil)
+	c.Check(unsealed, DeepEquals, key)
+}
+
+func (s *hwKeySuite) TestUnsealOnDifferentDevice(c *C) {
+	location := &memoryKeyLocation{name: "key"}
+	c.Assert(SealKeyWithHardwareProtector(newMockHardwareKeyProtector(c, "mock"), []byte("foo"), location), IsNil)
+
+	_, err := UnsealKeyWithHardwareProtector(newMockHardwareKeyProtector(c, "mock"), location)
+	c.Check(err, ErrorMatches, "invalid key data file: the wrapped key is invalid or was created by a different device .*")
+	c.Check(err, FitsTypeOf, InvalidKeyFileError{})
+}
+
+func (s *hwKeySuite) TestUnsealWithDifferentProtector(c *C) {
+	location := &memoryKeyLocation{name: "key"}
+	c.Assert(SealKeyWithHardwareProtector(newMockHardwareKeyProtector(c, "mock"), []byte("foo"), location), IsNil)
+
+	_, err := UnsealKeyWithHardwareProtector(newMockHardwareKeyProtector(c, "other"), location)
+	c.Check(err, ErrorMatches, "invalid key data file: key data was created by the \"mock\" protector")
+}
+
+func (s *hwKeySuite) TestUnsealInvalidData(c *C) {
+	location := &memoryKeyLocation{name: "key", data: []byte("foo")}
+
+	_, err := UnsealKeyWithHardwareProtector(newMockHardwareKeyProtector(c, "mock"), location)
+	c.Check(err, ErrorMatches, "invalid key data file: cannot unmarshal header: .*")
+}
+
+func (s *hwKeySuite) TestActivateVolume(c *C) {
+	protector := newMockHardwareKeyProtector(c, "mock")
+	location := &memoryKeyLocation{name: "key"}
+	key := []byte("1234567890123456789012345678901234567890123456789012345678901234")
+	c.Assert(SealKeyWithHardwareProtector(protector, key, location), IsNil)
+
+	success, err := ActivateVolumeWithHardwareProtectedKey(protector, "data", "/dev/sda1", location, &ActivateVolumeOptions{})
+	c.Check(err, IsNil)
+	c.Check(success, Equals, true)
+
+	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0][0:4], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/sda1"})
+	c.Check(s.mockSdCryptsetup.Calls()[0][5], Equals, "tries=1")
+
+	activatedKey, err := ioutil.ReadFile(s.keyFile)
+	c.Check(err, IsNil)
+	c.Check(activatedKey, DeepEquals, key)
+
+	devMapper := c.MkDir()
+	restore := MockDevMapperPath(devMapper)
+	defer restore()
+	c.Assert(ioutil.WriteFile(filepath.Join(devMapper, "data"), nil, 0644), IsNil)
+
+	v, err := VolumeStatus("data")
+	c.Assert(err, IsNil)
+	c.Check(v.Protector, Equals, VolumeProtector("mock"))
+	c.Check(v.Keyslot, Equals, 0)
+	c.Check(v.KeyPath, Equals, "memory:key")
+	c.Check(v.RecoveryKeyUsed(), Equals, false)
+}
+
+func (s *hwKeySuite) TestActivateVolumeNoRecoveryKeyTries(c *C) {
+	location := &memoryKeyLocation{name: "key"}
+	c.Assert(SealKeyWithHardwareProtector(newMockHardwareKeyProtector(c, "mock"), []byte("foo"), location), IsNil)
+
+	success, err := ActivateVolumeWithHardwareProtectedKey(newMockHardwareKeyProtector(c, "mock"), "data", "/dev/sda1", location, &ActivateVolumeOptions{})
+	c.Check(success, Equals, false)
+	c.Assert(err, FitsTypeOf, &ActivateWithHardwareProtectedKeyError{})
+	c.Check(err.(*ActivateWithHardwareProtectedKeyError).ProtectorErr, ErrorMatches, "cannot unseal key: invalid key data file: .*")
+	c.Check(err.(*ActivateWithHardwareProtectedKeyError).RecoveryKeyUsageErr, ErrorMatches, "no recovery key tries permitted")
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *hwKeySuite) TestUnsealWithRegisteredProtector(c *C) {
+	protector := newMockHardwareKeyProtector(c, "mock")
+	RegisterHardwareKeyProtector(protector)
+	defer UnregisterHardwareKeyProtector("mock")
+
+	location := &memoryKeyLocation{name: "key"}
+	c.Assert(SealKeyWithHardwareProtector(protector, []byte("foo"), location), IsNil)
+
+	key, err := UnsealKeyWithHardwareProtector(nil, location)
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, []byte("foo"))
+}
+
+func (s *hwKeySuite) TestUnsealWithNoRegisteredProtector(c *C) {
+	location := &memoryKeyLocation{name: "key"}
+	c.Assert(SealKeyWithHardwareProtector(newMockHardwareKeyProtector(c, "mock"), []byte("foo"), location), IsNil)
+
+	_, err := UnsealKeyWithHardwareProtector(nil, location)
+	c.Check(err, ErrorMatches, "invalid key data file: no protector is registered for \"mock\"")
+}
+
+func (s *hwKeySuite) TestActivateVolumeWithRegisteredProtector(c *C) {
+	protector := newMockHardwareKeyProtector(c, "mock")
+	RegisterHardwareKeyProtector(protector)
+	defer UnregisterHardwareKeyProtector("mock")
+
+	location := &memoryKeyLocation{name: "key"}
+	key := []byte("1234567890123456789012345678901234567890123456789012345678901234")
+	c.Assert(SealKeyWithHardwareProtector(protector, key, location), IsNil)
+
+	success, err := ActivateVolumeWithHardwareProtectedKey(nil, "data", "/dev/sda1", location, &ActivateVolumeOptions{})
+	c.Check(err, IsNil)
+	c.Check(success, Equals, true)
+
+	activatedKey, err := ioutil.ReadFile(s.keyFile)
+	c.Check(err, IsNil)
+	c.Check(activatedKey, DeepEquals, key)
+
+	devMapper := c.MkDir()
+	restore := MockDevMapperPath(devMapper)
+	defer restore()
+	c.Assert(ioutil.WriteFile(filepath.Join(devMapper, "data"), nil, 0644), IsNil)
+
+	v, err := VolumeStatus("data")
+	c.Assert(err, IsNil)
+	c.Check(v.Protector, Equals, VolumeProtector("mock"))
+}
+
+func (s *hwKeySuite) TestCAAMProtectorInvalidKeyModifier(c *C) {
+	protector := &CAAMProtector{KeyModifier: []byte("foo")}
+	c.Check(protector.Protector(), Equals, VolumeProtectorCAAM)
+
+	_, err := protector.WrapKey([]byte("foo"))
+	c.Check(err, ErrorMatches, "invalid key modifier size")
+}
+
+func (s *hwKeySuite) TestOPTEEProtectorNoTA(c *C) {
+	protector := &OPTEEProtector{}
+	c.Check(protector.Protector(), Equals, VolumeProtectorOPTEE)
+
+	_, err := protector.WrapKey([]byte("foo"))
+	c.Check(err, ErrorMatches, "no trusted application specified")
+}
+
+func (s *hwKeySuite) TestCAAMProtectorNoTA(c *C) {
+	protector := &CAAMProtector{}
+	_, err := protector.WrapKey([]byte("foo"))
+	c.Check(err, ErrorMatches, "no trusted application specified")
+}
@@ -0,0 +1,138 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"math/big"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	"github.com/snapcore/secboot/internal/tcg"
+
+	"golang.org/x/xerrors"
+)
+
+// makeImportableSealedKeyTemplate returns the template for a sealed key object that is created outside of the TPM and imported
+// in to it with TPM2_Import, which requires fixedTPM and fixedParent to be clear.
+func makeImportableSealedKeyTemplate() *tpm2.Public {
+	template := makeSealedKeyTemplate()
+	template.Attrs &^= tpm2.AttrFixedTPM | tpm2.AttrFixedParent
+	return template
+}
+
+// createImportableSealedObject creates a sealed data object containing the supplied data and authorization value outside of the
+// TPM, using the supplied template, and wraps it so that it can only be imported with TPM2_Import as a child of the storage root
+// key with the supplied public area. It returns the duplication blob, the public area of the object and the seed that was used to
+// protect the duplication blob, encrypted with the storage root key.
+//
+// Only the outer wrapper defined in section 23.3.2 ("Outer Duplication Wrapper") of part 1 of the TPM Library specification is
+// applied, as it is sufficient to protect the object in transit to the TPM.
+func createImportableSealedObject(srkPublic, template *tpm2.Public, data []byte, authValue tpm2.Auth) (tpm2.Private, *tpm2.Public, tpm2.EncryptedSecret, error) {
+	// The storage root key must be the one created from the standard template, which this is specific to.
+	if srkPublic.Type != tpm2.ObjectTypeRSA || srkPublic.NameAlg != tpm2.HashAlgorithmSHA256 {
+		return nil, nil, nil, errors.New("unsupported storage root key")
+	}
+	srkSymmetric, _ := mu.MarshalToBytes(srkPublic.Params.RSADetail().Symmetric)
+	expectedSymmetric, _ := mu.MarshalToBytes(tcg.SRKTemplate.Params.RSADetail().Symmetric)
+	if !bytes.Equal(srkSymmetric, expectedSymmetric) {
+		return nil, nil, nil, errors.New("unsupported storage root key symmetric algorithm")
+	}
+	srkHash := srkPublic.NameAlg.GetHash()
+
+	// Create the sensitive area, and compute the unique field of the public area from it.
+	seedValue := make([]byte, template.NameAlg.Size())
+	if _, err := rand.Read(seedValue); err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot obtain seed value: %w", err)
+	}
+	sensitive := &tpm2.Sensitive{
+		Type:      template.Type,
+		AuthValue: authValue,
+		SeedValue: seedValue,
+		Sensitive: tpm2.SensitiveCompositeU{Data: tpm2.SensitiveData(data)}}
+
+	h := template.NameAlg.NewHash()
+	h.Write(seedValue)
+	h.Write(data)
+
+	public := *template
+	public.Unique = tpm2.PublicIDU{Data: tpm2.Digest(h.Sum(nil))}
+	name, err := public.Name()
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot compute name: %w", err)
+	}
+
+	// Create the seed for the outer wrapper, and encrypt it with the storage root key.
+	seed := make([]byte, srkHash.Size())
+	if _, err := rand.Read(seed); err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot obtain seed: %w", err)
+	}
+	defer wipeBytes(seed)
+
+	exponent := int(srkPublic.Params.RSADetail().Exponent)
+	if exponent == 0 {
+		exponent = 65537
+	}
+	srkKey := &rsa.PublicKey{N: new(big.Int).SetBytes(srkPublic.Unique.RSA()), E: exponent}
+	symSeed, err := rsa.EncryptOAEP(srkHash.New(), rand.Reader, srkKey, seed, []byte("DUPLICATE\x00"))
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot encrypt seed: %w", err)
+	}
+
+	// Marshal the sensitive area as a TPM2B_SENSITIVE, and encrypt it with the symmetric key derived from the seed.
+	sensitiveBytes, err := mu.MarshalToBytes(sensitive)
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot marshal sensitive area: %w", err)
+	}
+	dupSensitive := make([]byte, 2+len(sensitiveBytes))
+	binary.BigEndian.PutUint16(dupSensitive, uint16(len(sensitiveBytes)))
+	copy(dupSensitive[2:], sensitiveBytes)
+	wipeBytes(sensitiveBytes)
+
+	symKey := kdfa(srkPublic.NameAlg, seed, "STORAGE", name, nil, 128)
+	defer wipeBytes(symKey)
+	block, err := aes.NewCipher(symKey)
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot create cipher: %w", err)
+	}
+	cipher.NewCFBEncrypter(block, make([]byte, aes.BlockSize)).XORKeyStream(dupSensitive, dupSensitive)
+
+	// Compute the integrity HMAC over the encrypted sensitive area and the name of the object.
+	hmacKey := kdfa(srkPublic.NameAlg, seed, "INTEGRITY", nil, nil, srkHash.Size()*8)
+	defer wipeBytes(hmacKey)
+	mac := hmac.New(srkHash.New, hmacKey)
+	mac.Write(dupSensitive)
+	mac.Write(name)
+	outerHMAC := mac.Sum(nil)
+
+	duplicate := make(tpm2.Private, 2, 2+len(outerHMAC)+len(dupSensitive))
+	binary.BigEndian.PutUint16(duplicate, uint16(len(outerHMAC)))
+	duplicate = append(duplicate, outerHMAC...)
+	duplicate = append(duplicate, dupSensitive...)
+
+	return duplicate, &public, symSeed, nil
+}
@@ -0,0 +1,160 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/snapd/osutil"
+
+	"golang.org/x/xerrors"
+)
+
+var devMapperPath = "/dev/mapper"
+
+// IntegrityParams describes a standalone dm-integrity device that sits beneath the dm-crypt device for an encrypted volume. The
+// integrity device stores a checksum for each sector of the encrypted data, so that corruption of the underlying storage is
+// detected when the data is read rather than being silently decrypted to garbage.
+//
+// Only unkeyed checksum algorithms are supported for standalone integrity devices, so they don't provide tamper-evidence on their
+// own. For tamper-evidence as well as confidentiality, use LUKS2 authenticated encryption instead by setting the Integrity field
+// of InitializeLUKS2ContainerOptions, which requires no additional parameters at activation time.
+type IntegrityParams struct {
+	Algorithm string // The checksum algorithm, eg "crc32c" or "sha256"
+}
+
+// integrityParamsRaw is the on-disk form of IntegrityParams.
+type integrityParamsRaw struct {
+	Algorithm []byte
+}
+
+func makeIntegrityParamsRaw(p *IntegrityParams) *integrityParamsRaw {
+	return &integrityParamsRaw{Algorithm: []byte(p.Algorithm)}
+}
+
+func (r *integrityParamsRaw) data() *IntegrityParams {
+	return &IntegrityParams{Algorithm: string(r.Algorithm)}
+}
+
+func (p *IntegrityParams) check() error {
+	switch p.Algorithm {
+	case "crc32", "crc32c", "sha1", "sha256":
+		return nil
+	case "":
+		return errors.New("no integrity algorithm specified")
+	default:
+		if strings.HasPrefix(p.Algorithm, "hmac-") {
+			return errors.New("keyed integrity algorithms are only supported with LUKS2 authenticated encryption")
+		}
+		return fmt.Errorf("unsupported integrity algorithm %q", p.Algorithm)
+	}
+}
+
+// integrityMappingName returns the name of the device mapper mapping for the integrity device beneath the volume with the
+// specified name.
+func integrityMappingName(volumeName string) string {
+	return volumeName + "-integrity"
+}
+
+// FormatIntegrityDevice initializes the partition at the specified devicePath as a new standalone dm-integrity device with the
+// supplied parameters. The integrity device must then be opened with OpenIntegrityDevice so that a LUKS2 container can be created
+// on it with InitializeLUKS2Container. The same parameters should be recorded in the sealed key data file for the volume by setting
+// the Integrity field of KeyCreationParams, so that ActivateVolumeWithTPMSealedKey can open the integrity device before activating
+// the encrypted volume.
+//
+// On failure, this will return an error containing the output of the integritysetup command.
+//
+// WARNING: This function is destructive. Calling this on a partition that contains data will make the data irretrievable.
+func FormatIntegrityDevice(devicePath string, params *IntegrityParams) error {
+	if params == nil {
+		return errors.New("no IntegrityParams provided")
+	}
+	if err := params.check(); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("integritysetup", "format", "--batch-mode", "--integrity", params.Algorithm, devicePath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return osutil.OutputErr(output, err)
+	}
+	return nil
+}
+
+// OpenIntegrityDevice opens the standalone dm-integrity device at the specified devicePath and creates a mapping with the name
+// volumeName, using the supplied parameters. On success, the path of the mapped device is returned.
+func OpenIntegrityDevice(devicePath, volumeName string, params *IntegrityParams) (string, error) {
+	return openIntegrityDevice(devicePath, volumeName, params, false)
+}
+
+func openIntegrityDevice(devicePath, volumeName string, params *IntegrityParams, readOnly bool) (string, error) {
+	if params == nil {
+		return "", errors.New("no IntegrityParams provided")
+	}
+	if err := params.check(); err != nil {
+		return "", err
+	}
+
+	args := []string{"open", "--integrity", params.Algorithm}
+	if readOnly {
+		args = append(args, "--readonly")
+	}
+	args = append(args, devicePath, volumeName)
+	cmd := exec.Command("integritysetup", args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", osutil.OutputErr(output, err)
+	}
+	return filepath.Join(devMapperPath, volumeName), nil
+}
+
+// CloseIntegrityDevice removes the mapping with the name volumeName that was created by OpenIntegrityDevice.
+func CloseIntegrityDevice(volumeName string) error {
+	cmd := exec.Command("integritysetup", "close", volumeName)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return osutil.OutputErr(output, err)
+	}
+	return nil
+}
+
+// openIntegrityDeviceForVolume opens the standalone dm-integrity device beneath the volume with the specified name, if params is
+// not nil. If readOnly is true, the integrity device is opened read-only so that the underlying storage isn't modified, eg, by
+// journal replay. It returns the path of the device on which the encrypted volume should be activated, and a function to close
+// the integrity device again if activation fails.
+func openIntegrityDeviceForVolume(volumeName, sourceDevicePath string, params *IntegrityParams, readOnly bool) (string, func(), error) {
+	if params == nil {
+		return sourceDevicePath, func() {}, nil
+	}
+
+	name := integrityMappingName(volumeName)
+	path, err := openIntegrityDevice(sourceDevicePath, name, params, readOnly)
+	if err != nil {
+		return "", nil, xerrors.Errorf("cannot open integrity device: %w", err)
+	}
+	return path, func() { CloseIntegrityDevice(name) }, nil
+}
+
+// Integrity returns the parameters of the standalone dm-integrity device beneath the volume that this sealed key object is for,
+// or nil if none were recorded.
+func (k *SealedKeyObject) Integrity() *IntegrityParams {
+	return k.data.integrity
+}
@@ -0,0 +1,64 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	. "github.com/snapcore/secboot"
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type integritySuite struct {
+	snapd_testutil.BaseTest
+	mockIntegritysetup *snapd_testutil.MockCmd
+}
+
+var _ = Suite(&integritySuite{})
+
+func (s *integritySuite) SetUpTest(c *C) {
+	s.mockIntegritysetup = snapd_testutil.MockCommand(c, "integritysetup", "")
+	s.AddCleanup(s.mockIntegritysetup.Restore)
+}
+
+func (s *integritySuite) TestFormatIntegrityDevice(c *C) {
+	c.Check(FormatIntegrityDevice("/dev/sda1", &IntegrityParams{Algorithm: "sha256"}), IsNil)
+	c.Check(s.mockIntegritysetup.Calls(), DeepEquals, [][]string{
+		{"integritysetup", "format", "--batch-mode", "--integrity", "sha256", "/dev/sda1"}})
+}
+
+func (s *integritySuite) TestFormatIntegrityDeviceKeyedAlgorithm(c *C) {
+	c.Check(FormatIntegrityDevice("/dev/sda1", &IntegrityParams{Algorithm: "hmac-sha256"}), ErrorMatches,
+		"keyed integrity algorithms are only supported with LUKS2 authenticated encryption")
+	c.Check(s.mockIntegritysetup.Calls(), HasLen, 0)
+}
+
+func (s *integritySuite) TestOpenIntegrityDevice(c *C) {
+	path, err := OpenIntegrityDevice("/dev/sda1", "data-integrity", &IntegrityParams{Algorithm: "crc32c"})
+	c.Check(err, IsNil)
+	c.Check(path, Equals, "/dev/mapper/data-integrity")
+	c.Check(s.mockIntegritysetup.Calls(), DeepEquals, [][]string{
+		{"integritysetup", "open", "--integrity", "crc32c", "/dev/sda1", "data-integrity"}})
+}
+
+func (s *integritySuite) TestCloseIntegrityDevice(c *C) {
+	c.Check(CloseIntegrityDevice("data-integrity"), IsNil)
+	c.Check(s.mockIntegritysetup.Calls(), DeepEquals, [][]string{{"integritysetup", "close", "data-integrity"}})
+}
@@ -22,6 +22,7 @@ package compattest
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 
 	"github.com/canonical/go-tpm2"
@@ -126,3 +127,26 @@ func (s *compatTestV0Suite) TestUnsealAfterLock(c *C) {
 	s.replayPCRSequenceFromFile(c, s.absPath("pcrSequence.1"))
 	s.testUnsealErrorMatchesCommon(c, "invalid key data file: cannot complete authorization policy assertions: cannot complete OR assertions: current session digest not found in policy data")
 }
+
+func (s *compatTestV0Suite) TestUpgradeKeyData(c *C) {
+	// Verify that a v0 key data file can be upgraded by resealing it, and that the upgraded file can be
+	// unsealed with the new policy auth key.
+	s.replayPCRSequenceFromFile(c, s.absPath("pcrSequence.1"))
+
+	profile := secboot.NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7)
+	authPrivateKey, err := secboot.UpgradeKeyData(s.TPM, []string{s.absPath("key")}, "", &secboot.KeyCreationParams{PCRProfile: profile, PCRPolicyCounterHandle: 0x01810001})
+	c.Assert(err, IsNil)
+
+	k, err := secboot.ReadSealedKeyObject(s.absPath("key"))
+	c.Assert(err, IsNil)
+	c.Check(k.NeedsUpgrade(), Equals, false)
+	c.Check(k.PCRPolicyCounterHandle(), Equals, tpm2.Handle(0x01810001))
+
+	key, authKey, err := k.UnsealFromTPM(s.TPM, "")
+	c.Check(err, IsNil)
+
+	expectedKey, err := ioutil.ReadFile(s.absPath("clearKey"))
+	c.Assert(err, IsNil)
+	c.Check(key, DeepEquals, expectedKey)
+	c.Check(authKey, DeepEquals, authPrivateKey)
+}
@@ -0,0 +1,337 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package optee is a minimal client for trusted applications running in OP-TEE, using the Linux TEE subsystem (/dev/teeN). It
+// implements the subset of the GlobalPlatform TEE client API that secboot needs without depending on libteec.
+package optee
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/xerrors"
+)
+
+// Definitions from include/uapi/linux/tee.h
+const (
+	teeIocVersion      = 0x800ca400 // _IOR(TEE_IOC_MAGIC, TEE_IOC_BASE + 0, struct tee_ioctl_version_data)
+	teeIocShmAlloc     = 0xc010a401 // _IOWR(TEE_IOC_MAGIC, TEE_IOC_BASE + 1, struct tee_ioctl_shm_alloc_data)
+	teeIocOpenSession  = 0x8010a402 // _IOR(TEE_IOC_MAGIC, TEE_IOC_BASE + 2, struct tee_ioctl_buf_data)
+	teeIocInvoke       = 0x8010a403 // _IOR(TEE_IOC_MAGIC, TEE_IOC_BASE + 3, struct tee_ioctl_buf_data)
+	teeIocCloseSession = 0x8004a405 // _IOR(TEE_IOC_MAGIC, TEE_IOC_BASE + 5, struct tee_ioctl_close_session_arg)
+
+	teeImplIDOPTEE = 1
+	teeGenCapGP    = 1 << 0
+
+	teeIoctlLoginPublic = 0
+
+	teeIoctlParamAttrTypeNone         = 0
+	teeIoctlParamAttrTypeMemrefInput  = 5
+	teeIoctlParamAttrTypeMemrefOutput = 6
+
+	numParams = 4
+)
+
+// Return codes defined by the GlobalPlatform TEE client API specification.
+const (
+	ResultSuccess        uint32 = 0x00000000
+	ResultItemNotFound   uint32 = 0xffff0008
+	ResultSecurity       uint32 = 0xffff000f
+	ResultShortBuffer    uint32 = 0xffff0010
+	ResultMACInvalid     uint32 = 0xffff3071
+	ResultTargetDead     uint32 = 0xffff3024
+	ResultCommunication  uint32 = 0xffff000e
+	ResultAccessDenied   uint32 = 0xffff0001
+	ResultBadParameters  uint32 = 0xffff0006
+	ResultOutOfMemory    uint32 = 0xffff000c
+	ResultNotImplemented uint32 = 0xffff0009
+)
+
+// Return origins defined by the GlobalPlatform TEE client API specification.
+const (
+	OriginAPI        uint32 = 1
+	OriginComms      uint32 = 2
+	OriginTEE        uint32 = 3
+	OriginTrustedApp uint32 = 4
+)
+
+type versionData struct {
+	implID   uint32
+	implCaps uint32
+	genCaps  uint32
+}
+
+type shmAllocData struct {
+	size  uint64
+	flags uint32
+	id    int32
+}
+
+type bufData struct {
+	bufPtr uint64
+	bufLen uint64
+}
+
+type param struct {
+	attr uint64
+	a    uint64
+	b    uint64
+	c    uint64
+}
+
+type openSessionArg struct {
+	uuid      [16]byte
+	clntUUID  [16]byte
+	clntLogin uint32
+	cancelID  uint32
+	session   uint32
+	ret       uint32
+	retOrigin uint32
+	numParams uint32
+	params    [numParams]param
+}
+
+type invokeArg struct {
+	function  uint32
+	session   uint32
+	cancelID  uint32
+	ret       uint32
+	retOrigin uint32
+	numParams uint32
+	params    [numParams]param
+}
+
+type closeSessionArg struct {
+	session uint32
+}
+
+// Error is returned from OpenSession and Session.Invoke when the TEE or the trusted application returns an error.
+type Error struct {
+	Code   uint32 // The TEEC_Result code
+	Origin uint32 // The origin of the error
+}
+
+func (e *Error) Error() string {
+	var origin string
+	switch e.Origin {
+	case OriginAPI:
+		origin = "API"
+	case OriginComms:
+		origin = "communication stack"
+	case OriginTEE:
+		origin = "TEE"
+	case OriginTrustedApp:
+		origin = "trusted application"
+	default:
+		origin = fmt.Sprintf("origin %d", e.Origin)
+	}
+	return fmt.Sprintf("%s returned error %#08x", origin, e.Code)
+}
+
+// UUID is the identifier of a trusted application.
+type UUID [16]byte
+
+// ParseUUID parses a UUID in its canonical string form, eg, "8aaaf200-2450-11e4-abe2-0002a5d5c51b".
+func ParseUUID(s string) (out UUID, err error) {
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return UUID{}, errors.New("invalid UUID format")
+	}
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil {
+		return UUID{}, xerrors.Errorf("invalid UUID: %w", err)
+	}
+	copy(out[:], b)
+	return out, nil
+}
+
+func (u UUID) String() string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// Context corresponds to an open TEE device.
+type Context struct {
+	f *os.File
+}
+
+// Open opens the TEE device at the specified path, and checks that it is an OP-TEE device that implements the GlobalPlatform
+// client API.
+func Open(path string) (*Context, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var version versionData
+	if _, err := ioctl(f.Fd(), teeIocVersion, unsafe.Pointer(&version)); err != nil {
+		f.Close()
+		return nil, xerrors.Errorf("cannot obtain TEE version: %w", err)
+	}
+	if version.implID != teeImplIDOPTEE {
+		f.Close()
+		return nil, fmt.Errorf("unsupported TEE implementation %d", version.implID)
+	}
+	if version.genCaps&teeGenCapGP == 0 {
+		f.Close()
+		return nil, errors.New("TEE does not implement the GlobalPlatform client API")
+	}
+
+	return &Context{f}, nil
+}
+
+// Close closes the TEE device.
+func (c *Context) Close() error {
+	return c.f.Close()
+}
+
+// sharedMemory corresponds to a buffer that is shared with the TEE.
+type sharedMemory struct {
+	id   int32
+	fd   int
+	data []byte
+}
+
+func (c *Context) allocSharedMemory(size int) (*sharedMemory, error) {
+	if size == 0 {
+		// The TEE subsystem doesn't permit zero sized allocations.
+		size = 1
+	}
+
+	data := shmAllocData{size: uint64(size)}
+	fd, err := ioctl(c.f.Fd(), teeIocShmAlloc, unsafe.Pointer(&data))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot allocate shared memory: %w", err)
+	}
+
+	m, err := mmapShared(fd, size)
+	if err != nil {
+		closeFd(fd)
+		return nil, xerrors.Errorf("cannot map shared memory: %w", err)
+	}
+
+	return &sharedMemory{id: data.id, fd: fd, data: m}, nil
+}
+
+func (m *sharedMemory) free() {
+	// Don't leave any secrets behind in the shared buffer.
+	for i := range m.data {
+		m.data[i] = 0
+	}
+	munmap(m.data)
+	closeFd(m.fd)
+}
+
+// Session corresponds to a session with a trusted application.
+type Session struct {
+	ctx *Context
+	id  uint32
+}
+
+// OpenSession opens a session with the trusted application identified by uuid, using the public login method.
+func (c *Context) OpenSession(uuid UUID) (*Session, error) {
+	// The argument is referenced from bufData by address, so allocate it on the heap and keep it alive for the duration of
+	// the ioctl.
+	arg := &openSessionArg{uuid: uuid, clntLogin: teeIoctlLoginPublic, numParams: numParams}
+	buf := bufData{bufPtr: uint64(uintptr(unsafe.Pointer(arg))), bufLen: uint64(unsafe.Sizeof(*arg))}
+	_, err := ioctl(c.f.Fd(), teeIocOpenSession, unsafe.Pointer(&buf))
+	runtime.KeepAlive(arg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot open session: %w", err)
+	}
+	if arg.ret != ResultSuccess {
+		return nil, &Error{Code: arg.ret, Origin: arg.retOrigin}
+	}
+	return &Session{ctx: c, id: arg.session}, nil
+}
+
+// Close closes this session.
+func (s *Session) Close() error {
+	arg := closeSessionArg{session: s.id}
+	if _, err := ioctl(s.ctx.f.Fd(), teeIocCloseSession, unsafe.Pointer(&arg)); err != nil {
+		return xerrors.Errorf("cannot close session: %w", err)
+	}
+	return nil
+}
+
+// InvokeWithBuffers invokes the specified command of the trusted application, with the contents of in as a memory reference
+// input in the first parameter and an output buffer of outSize bytes as a memory reference output in the second parameter. The
+// contents of the output buffer are returned on success.
+//
+// If the trusted application indicates that the output buffer is too small, the command is invoked again with an output buffer
+// of the size that it requested.
+func (s *Session) InvokeWithBuffers(cmd uint32, in []byte, outSize int) ([]byte, error) {
+	for retried := false; ; retried = true {
+		out, required, err := s.invokeWithBuffers(cmd, in, outSize)
+		if err != nil {
+			var e *Error
+			if xerrors.As(err, &e) && e.Code == ResultShortBuffer && !retried && required > outSize {
+				outSize = required
+				continue
+			}
+			return nil, err
+		}
+		return out, nil
+	}
+}
+
+func (s *Session) invokeWithBuffers(cmd uint32, in []byte, outSize int) ([]byte, int, error) {
+	inShm, err := s.ctx.allocSharedMemory(len(in))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer inShm.free()
+	copy(inShm.data, in)
+
+	outShm, err := s.ctx.allocSharedMemory(outSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer outShm.free()
+
+	arg := &invokeArg{function: cmd, session: s.id, numParams: numParams}
+	arg.params[0] = param{attr: teeIoctlParamAttrTypeMemrefInput, a: 0, b: uint64(len(in)), c: uint64(inShm.id)}
+	arg.params[1] = param{attr: teeIoctlParamAttrTypeMemrefOutput, a: 0, b: uint64(outSize), c: uint64(outShm.id)}
+	arg.params[2].attr = teeIoctlParamAttrTypeNone
+	arg.params[3].attr = teeIoctlParamAttrTypeNone
+
+	buf := bufData{bufPtr: uint64(uintptr(unsafe.Pointer(arg))), bufLen: uint64(unsafe.Sizeof(*arg))}
+	_, err = ioctl(s.ctx.f.Fd(), teeIocInvoke, unsafe.Pointer(&buf))
+	runtime.KeepAlive(arg)
+	if err != nil {
+		return nil, 0, xerrors.Errorf("cannot invoke command: %w", err)
+	}
+
+	// The TEE updates the size of the output memory reference with the number of bytes written, or the required size if the
+	// buffer is too small.
+	n := int(arg.params[1].b)
+	if arg.ret != ResultSuccess {
+		return nil, n, &Error{Code: arg.ret, Origin: arg.retOrigin}
+	}
+	if n > outSize {
+		return nil, 0, errors.New("invalid output size")
+	}
+
+	out := make([]byte, n)
+	copy(out, outShm.data)
+	return out, n, nil
+}
@@ -0,0 +1,46 @@
+//go:build !linux
+// +build !linux
+
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package optee
+
+import (
+	"errors"
+	"unsafe"
+)
+
+var errNotSupported = errors.New("the TEE subsystem is only supported on Linux")
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) (int, error) {
+	return 0, errNotSupported
+}
+
+func mmapShared(fd, size int) ([]byte, error) {
+	return nil, errNotSupported
+}
+
+func munmap(data []byte) error {
+	return errNotSupported
+}
+
+func closeFd(fd int) error {
+	return errNotSupported
+}
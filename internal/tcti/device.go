@@ -0,0 +1,67 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tcti
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/canonical/go-tpm2"
+)
+
+// Device corresponds to a TPM device that can be opened to obtain a TCTI.
+type Device interface {
+	Open() (io.ReadWriteCloser, error)
+	String() string
+}
+
+// CharDevice corresponds to a TPM character device, such as /dev/tpm0 or /dev/tpmrm0 on Linux.
+type CharDevice struct {
+	Path string
+}
+
+func (d CharDevice) Open() (io.ReadWriteCloser, error) {
+	return tpm2.OpenTPMDevice(d.Path)
+}
+
+func (d CharDevice) String() string {
+	return d.Path
+}
+
+// SimulatorDevice corresponds to a TPM simulator that implements the Microsoft TPM2 simulator interface, accessed over TCP.
+type SimulatorDevice struct {
+	Host string // The host name or address of the simulator. An empty string means the local host
+	Port uint   // The port number of the TPM command interface. The platform interface is at the following port
+}
+
+func (d SimulatorDevice) Open() (io.ReadWriteCloser, error) {
+	return tpm2.OpenMssim(d.Host, d.Port, d.Port+1)
+}
+
+func (d SimulatorDevice) String() string {
+	host := d.Host
+	if host == "" {
+		host = "localhost"
+	}
+	return fmt.Sprintf("mssim:%s:%d", host, d.Port)
+}
+
+// DefaultDevice is the default TPM device for the current platform.
+var DefaultDevice = newDefaultDevice()
@@ -0,0 +1,43 @@
+//go:build !windows
+// +build !windows
+
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tcti
+
+import (
+	"errors"
+	"io"
+)
+
+func newDefaultDevice() Device {
+	return CharDevice{Path: tpmPath}
+}
+
+// TBSDevice corresponds to the TPM Base Services interface on Windows. It is not supported on this platform.
+type TBSDevice struct{}
+
+func (d TBSDevice) Open() (io.ReadWriteCloser, error) {
+	return nil, errors.New("TPM Base Services is not supported on this platform")
+}
+
+func (d TBSDevice) String() string {
+	return "tbs"
+}
@@ -0,0 +1,123 @@
+//go:build windows
+// +build windows
+
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tcti
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	tbsContextVersionTwo     = 2      // TBS_CONTEXT_VERSION_TWO
+	tbsContextIncludeTPM20   = 1 << 2 // includeTpm20 flag in TBS_CONTEXT_PARAMS2
+	tbsCommandLocalityZero   = 0      // TBS_COMMAND_LOCALITY_ZERO
+	tbsCommandPriorityNormal = 200    // TBS_COMMAND_PRIORITY_NORMAL
+	tbsSuccess               = 0      // TBS_SUCCESS
+)
+
+var (
+	modtbs                 = syscall.NewLazyDLL("tbs.dll")
+	procTbsiContextCreate  = modtbs.NewProc("Tbsi_Context_Create")
+	procTbsipSubmitCommand = modtbs.NewProc("Tbsip_Submit_Command")
+	procTbsipContextClose  = modtbs.NewProc("Tbsip_Context_Close")
+)
+
+// tbsContextParams2 corresponds to the TBS_CONTEXT_PARAMS2 type.
+type tbsContextParams2 struct {
+	version uint32
+	flags   uint32
+}
+
+func newDefaultDevice() Device {
+	return TBSDevice{}
+}
+
+// TBSDevice corresponds to the TPM Base Services interface on Windows.
+type TBSDevice struct{}
+
+func (d TBSDevice) Open() (io.ReadWriteCloser, error) {
+	if err := modtbs.Load(); err != nil {
+		return nil, err
+	}
+
+	params := tbsContextParams2{version: tbsContextVersionTwo, flags: tbsContextIncludeTPM20}
+	var context uintptr
+	if rc, _, _ := procTbsiContextCreate.Call(uintptr(unsafe.Pointer(&params)), uintptr(unsafe.Pointer(&context))); rc != tbsSuccess {
+		return nil, fmt.Errorf("cannot create TBS context: 0x%08x", rc)
+	}
+	return &tbsTcti{context: context}, nil
+}
+
+func (d TBSDevice) String() string {
+	return "tbs"
+}
+
+// tbsTcti is a TCTI that submits commands using the TPM Base Services interface on Windows. Commands are submitted when they are
+// written, and the response is buffered until it is read.
+type tbsTcti struct {
+	context uintptr
+	rsp     *bytes.Reader
+}
+
+func (t *tbsTcti) Write(data []byte) (int, error) {
+	if t.context == 0 {
+		return 0, errors.New("TBS context is closed")
+	}
+	if len(data) == 0 {
+		return 0, errors.New("empty command")
+	}
+
+	rsp := make([]byte, maxPacketSize)
+	rspLen := uint32(len(rsp))
+	if rc, _, _ := procTbsipSubmitCommand.Call(t.context, tbsCommandLocalityZero, tbsCommandPriorityNormal,
+		uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), uintptr(unsafe.Pointer(&rsp[0])),
+		uintptr(unsafe.Pointer(&rspLen))); rc != tbsSuccess {
+		t.rsp = nil
+		return 0, fmt.Errorf("cannot submit command: 0x%08x", rc)
+	}
+	t.rsp = bytes.NewReader(rsp[:rspLen])
+	return len(data), nil
+}
+
+func (t *tbsTcti) Read(data []byte) (int, error) {
+	if t.rsp == nil {
+		return 0, io.EOF
+	}
+	return t.rsp.Read(data)
+}
+
+func (t *tbsTcti) Close() error {
+	if t.context == 0 {
+		return nil
+	}
+	rc, _, _ := procTbsipContextClose.Call(t.context)
+	t.context = 0
+	if rc != tbsSuccess {
+		return fmt.Errorf("cannot close TBS context: 0x%08x", rc)
+	}
+	return nil
+}
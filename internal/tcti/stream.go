@@ -0,0 +1,122 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tcti
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	headerSize    = 10   // Size of the TPM command and response headers
+	maxPacketSize = 4096 // Maximum size of a TPM command or response
+)
+
+// readPacket reads a single TPM command or response from the supplied stream, using the size field of its header to determine its
+// length.
+func readPacket(r io.Reader) ([]byte, error) {
+	hdr := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(hdr[2:6])
+	if size < headerSize || size > maxPacketSize {
+		return nil, fmt.Errorf("invalid packet size (%d bytes)", size)
+	}
+
+	packet := make([]byte, size)
+	copy(packet, hdr)
+	if _, err := io.ReadFull(r, packet[headerSize:]); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// Stream is a TCTI that sends TPM commands to and receives responses from a TPM over an arbitrary stream, such as a SSH channel
+// to a remote device. Commands and responses are transferred unmodified, and the size field of the response header is used to
+// delimit responses. The remote end of the stream is expected to pass each command to a TPM and write back its response - see
+// Serve.
+type Stream struct {
+	stream io.ReadWriteCloser
+	rsp    *bytes.Reader
+}
+
+// NewStream returns a new TCTI for communicating with a TPM over the supplied stream. The stream is closed when the returned TCTI
+// is closed.
+func NewStream(stream io.ReadWriteCloser) *Stream {
+	return &Stream{stream: stream}
+}
+
+func (s *Stream) Write(data []byte) (int, error) {
+	s.rsp = nil
+	return s.stream.Write(data)
+}
+
+func (s *Stream) Read(data []byte) (int, error) {
+	if s.rsp == nil {
+		rsp, err := readPacket(s.stream)
+		if err != nil {
+			return 0, err
+		}
+		s.rsp = bytes.NewReader(rsp)
+	}
+	n, err := s.rsp.Read(data)
+	if s.rsp.Len() == 0 {
+		s.rsp = nil
+	}
+	return n, err
+}
+
+func (s *Stream) Close() error {
+	return s.stream.Close()
+}
+
+// Serve reads TPM commands from the supplied stream, submits them to the TPM via the supplied device TCTI, and then writes the
+// responses back to the stream. This is the remote end of a connection established with NewStream. It returns nil when the stream
+// is closed by the other end.
+func Serve(stream io.ReadWriter, device io.ReadWriter) error {
+	for {
+		cmd, err := readPacket(stream)
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return xerrors.Errorf("cannot read command: %w", err)
+		}
+
+		if _, err := device.Write(cmd); err != nil {
+			return xerrors.Errorf("cannot submit command: %w", err)
+		}
+		rsp := make([]byte, maxPacketSize)
+		n, err := device.Read(rsp)
+		if err != nil {
+			return xerrors.Errorf("cannot read response: %w", err)
+		}
+
+		if _, err := stream.Write(rsp[:n]); err != nil {
+			return xerrors.Errorf("cannot write response: %w", err)
+		}
+	}
+}
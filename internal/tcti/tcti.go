@@ -21,8 +21,6 @@ package tcti
 
 import (
 	"io"
-
-	"github.com/canonical/go-tpm2"
 )
 
 const (
@@ -30,7 +28,8 @@ const (
 	tpmPath = "/dev/tpm0"
 )
 
-// OpenDefaultTcti connects to the default TPM character device. This can be overridden for tests to connect to a simulator device.
+// OpenDefaultTcti connects to the default TPM device for the current platform. This can be overridden for tests to connect to a
+// simulator device.
 var OpenDefault = func() (io.ReadWriteCloser, error) {
-	return tpm2.OpenTPMDevice(tpmPath)
+	return DefaultDevice.Open()
 }
@@ -0,0 +1,240 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/osutil/sys"
+
+	"golang.org/x/xerrors"
+)
+
+// VolumeProtector identifies the mechanism that was used to unlock an activated volume.
+type VolumeProtector string
+
+const (
+	// VolumeProtectorTPM indicates that a volume was unlocked with a TPM sealed key.
+	VolumeProtectorTPM VolumeProtector = "tpm"
+
+	// VolumeProtectorRecoveryKey indicates that a volume was unlocked with a recovery key.
+	VolumeProtectorRecoveryKey VolumeProtector = "recovery-key"
+
+	// VolumeProtectorEphemeral indicates that a volume was activated with a random key that was generated at activation time and
+	// never stored.
+	VolumeProtectorEphemeral VolumeProtector = "ephemeral"
+
+	// VolumeProtectorOPTEE indicates that a volume was unlocked with a key that was wrapped by a trusted application running in
+	// OP-TEE (see OPTEEProtector).
+	VolumeProtectorOPTEE VolumeProtector = "optee"
+
+	// VolumeProtectorCAAM indicates that a volume was unlocked with a key that was encapsulated in a CAAM blob on an NXP i.MX
+	// device (see CAAMProtector).
+	VolumeProtectorCAAM VolumeProtector = "caam"
+)
+
+// KeyslotUnknown is the value of ActivatedVolume.Keyslot when the keyslot that unlocked a volume isn't known or when the volume
+// has no keyslots.
+const KeyslotUnknown = -1
+
+// ActivatedVolume describes a volume that was activated by one of the ActivateVolume functions, as recorded in the volume
+// inventory.
+type ActivatedVolume struct {
+	VolumeName       string          `json:"volume-name"`        // The name of the device mapper mapping
+	SourceDevicePath string          `json:"source-device-path"` // The path of the encrypted block device
+	Protector        VolumeProtector `json:"protector"`          // The mechanism that was used to unlock the volume
+
+	// Keyslot is the LUKS2 keyslot that unlocked the volume. The TPM sealed key is always in keyslot 0 (see
+	// InitializeLUKS2Container and ChangeLUKS2KeyUsingRecoveryKey), but the keyslot used by the recovery key isn't known, so this
+	// is KeyslotUnknown for volumes unlocked with a recovery key and for plain dm-crypt and ephemeral volumes.
+	Keyslot int `json:"keyslot"`
+
+	// RecoveryReason is the reason that the recovery key was used, if the volume was unlocked with a recovery key.
+	RecoveryReason RecoveryKeyUsageReason `json:"recovery-reason,omitempty"`
+
+	KeyPath             string `json:"key-path,omitempty"`              // The path of the TPM sealed key data file, if one was used
+	KeyID               *KeyID `json:"key-id,omitempty"`                // The ID of the TPM sealed key, if it has one
+	PCRPolicyGeneration uint64 `json:"pcr-policy-generation,omitempty"` // The PCR policy generation of the TPM sealed key, if known
+
+	ReadOnly bool      `json:"read-only,omitempty"` // Whether the volume was mapped read-only
+	Time     time.Time `json:"time"`                // The time that the volume was activated
+}
+
+// RecoveryKeyUsed indicates whether the volume was unlocked with a recovery key.
+func (v *ActivatedVolume) RecoveryKeyUsed() bool {
+	return v.Protector == VolumeProtectorRecoveryKey
+}
+
+// newActivatedVolume returns a new inventory entry for a volume that has just been activated. If k is not nil, the entry records
+// details of the TPM sealed key object from keyPath.
+func newActivatedVolume(volumeName, sourceDevicePath string, protector VolumeProtector, keyPath string, k *SealedKeyObject) *ActivatedVolume {
+	v := &ActivatedVolume{
+		VolumeName:       volumeName,
+		SourceDevicePath: sourceDevicePath,
+		Protector:        protector,
+		Keyslot:          KeyslotUnknown,
+		Time:             time.Now()}
+	if k != nil {
+		v.KeyPath = keyPath
+		if id, ok := k.KeyID(); ok {
+			v.KeyID = &id
+		}
+		v.PCRPolicyGeneration = k.PCRPolicyGeneration()
+	}
+	return v
+}
+
+// volumeInventoryDir returns the directory in which the volume inventory is kept. It lives in /run so that it doesn't persist
+// across reboots.
+func volumeInventoryDir() string {
+	return filepath.Join(runDir, "secboot", "volumes")
+}
+
+// checkVolumeName verifies that the supplied volume name is safe to use as the name of a file in the volume inventory or recovery
+// marker directories, so that a file can't be created or removed outside of these.
+func checkVolumeName(volumeName string) error {
+	if volumeName == "" || volumeName == "." || strings.ContainsRune(volumeName, filepath.Separator) || strings.Contains(volumeName, "..") {
+		return fmt.Errorf("invalid volume name %q", volumeName)
+	}
+	return nil
+}
+
+// recordActivatedVolume adds the supplied entry to the volume inventory, replacing any existing entry for the same volume name.
+func recordActivatedVolume(entry *ActivatedVolume) error {
+	if err := checkVolumeName(entry.VolumeName); err != nil {
+		return err
+	}
+
+	dir := volumeInventoryDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return xerrors.Errorf("cannot create inventory directory: %w", err)
+	}
+
+	f, err := osutil.NewAtomicFile(filepath.Join(dir, entry.VolumeName), 0600, 0, sys.UserID(osutil.NoChown), sys.GroupID(osutil.NoChown))
+	if err != nil {
+		return xerrors.Errorf("cannot create new atomic file: %w", err)
+	}
+	defer f.Cancel()
+
+	if err := json.NewEncoder(f).Encode(entry); err != nil {
+		return xerrors.Errorf("cannot write to temporary file: %w", err)
+	}
+
+	if err := f.Commit(); err != nil {
+		return xerrors.Errorf("cannot atomically replace file: %w", err)
+	}
+	return nil
+}
+
+// forgetActivatedVolume removes the entry for the volume with the specified name from the volume inventory, if there is one.
+func forgetActivatedVolume(volumeName string) error {
+	if err := checkVolumeName(volumeName); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(volumeInventoryDir(), volumeName)); err != nil && !isStateNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// readActivatedVolume reads the entry for the volume with the specified name from the volume inventory. If the volume's device
+// mapper mapping no longer exists, the stale entry is ignored and ErrVolumeNotActivated is returned.
+func readActivatedVolume(volumeName string) (*ActivatedVolume, error) {
+	if err := checkVolumeName(volumeName); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(volumeInventoryDir(), volumeName))
+	switch {
+	case isStateNotExist(err):
+		return nil, ErrVolumeNotActivated
+	case err != nil:
+		return nil, err
+	}
+	defer f.Close()
+
+	var v ActivatedVolume
+	if err := json.NewDecoder(f).Decode(&v); err != nil {
+		return nil, xerrors.Errorf("cannot decode inventory entry: %w", err)
+	}
+	if v.VolumeName != volumeName {
+		return nil, fmt.Errorf("inventory entry has unexpected volume name %q", v.VolumeName)
+	}
+
+	// The mapping may have been removed without using DeactivateVolume.
+	if !osutil.FileExists(filepath.Join(devMapperPath, volumeName)) {
+		return nil, ErrVolumeNotActivated
+	}
+
+	return &v, nil
+}
+
+// VolumeStatus returns the inventory entry for the volume with the specified name, which describes how the volume was activated.
+// If the volume wasn't activated by one of the ActivateVolume functions or it has since been deactivated, a ErrVolumeNotActivated
+// error is returned.
+func VolumeStatus(volumeName string) (*ActivatedVolume, error) {
+	v, err := readActivatedVolume(volumeName)
+	if err != nil {
+		if err == ErrVolumeNotActivated {
+			return nil, err
+		}
+		return nil, xerrors.Errorf("cannot read inventory entry for %s: %w", volumeName, err)
+	}
+	return v, nil
+}
+
+// ListActivatedVolumes returns the inventory entries for all of the volumes that are currently activated by one of the
+// ActivateVolume functions, sorted by volume name.
+func ListActivatedVolumes() ([]*ActivatedVolume, error) {
+	dir, err := os.Open(volumeInventoryDir())
+	switch {
+	case isStateNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, xerrors.Errorf("cannot open inventory directory: %w", err)
+	}
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read inventory directory: %w", err)
+	}
+	sort.Strings(names)
+
+	var out []*ActivatedVolume
+	for _, name := range names {
+		v, err := readActivatedVolume(name)
+		switch {
+		case err == ErrVolumeNotActivated:
+			continue
+		case err != nil:
+			return nil, xerrors.Errorf("cannot read inventory entry for %s: %w", name, err)
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
@@ -0,0 +1,124 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/snapcore/secboot"
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type inventorySuite struct {
+	snapd_testutil.BaseTest
+	devMapper        string
+	mockSdCryptsetup *snapd_testutil.MockCmd
+}
+
+var _ = Suite(&inventorySuite{})
+
+func (s *inventorySuite) SetUpTest(c *C) {
+	s.AddCleanup(MockRunDir(c.MkDir()))
+	s.devMapper = c.MkDir()
+	s.AddCleanup(MockDevMapperPath(s.devMapper))
+
+	s.mockSdCryptsetup = snapd_testutil.MockCommand(c, c.MkDir()+"/systemd-cryptsetup", `
+if [ "$1" = "attach" ]; then
+    cat "$4" > /dev/null
+fi
+`)
+	s.AddCleanup(s.mockSdCryptsetup.Restore)
+	s.AddCleanup(MockSystemdCryptsetupPath(s.mockSdCryptsetup.Exe()))
+}
+
+func (s *inventorySuite) activate(c *C, volumeName, sourceDevicePath string) {
+	c.Assert(ActivateVolumeWithEphemeralKey(volumeName, sourceDevicePath, nil), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.devMapper, volumeName), nil, 0644), IsNil)
+}
+
+func (s *inventorySuite) TestListActivatedVolumesEmpty(c *C) {
+	volumes, err := ListActivatedVolumes()
+	c.Check(err, IsNil)
+	c.Check(volumes, HasLen, 0)
+}
+
+func (s *inventorySuite) TestListActivatedVolumes(c *C) {
+	s.activate(c, "swap", "/dev/sda4")
+	s.activate(c, "scratch", "/dev/sda3")
+
+	volumes, err := ListActivatedVolumes()
+	c.Assert(err, IsNil)
+	c.Assert(volumes, HasLen, 2)
+	c.Check(volumes[0].VolumeName, Equals, "scratch")
+	c.Check(volumes[0].SourceDevicePath, Equals, "/dev/sda3")
+	c.Check(volumes[1].VolumeName, Equals, "swap")
+	c.Check(volumes[1].SourceDevicePath, Equals, "/dev/sda4")
+}
+
+func (s *inventorySuite) TestListActivatedVolumesIgnoresStale(c *C) {
+	s.activate(c, "swap", "/dev/sda4")
+	s.activate(c, "scratch", "/dev/sda3")
+
+	// Simulate the mapping being removed without DeactivateVolume.
+	c.Assert(os.Remove(filepath.Join(s.devMapper, "swap")), IsNil)
+
+	volumes, err := ListActivatedVolumes()
+	c.Assert(err, IsNil)
+	c.Assert(volumes, HasLen, 1)
+	c.Check(volumes[0].VolumeName, Equals, "scratch")
+
+	_, err = VolumeStatus("swap")
+	c.Check(err, Equals, ErrVolumeNotActivated)
+}
+
+func (s *inventorySuite) TestVolumeStatus(c *C) {
+	s.activate(c, "scratch", "/dev/sda3")
+
+	v, err := VolumeStatus("scratch")
+	c.Assert(err, IsNil)
+	c.Check(v.VolumeName, Equals, "scratch")
+	c.Check(v.Protector, Equals, VolumeProtectorEphemeral)
+	c.Check(v.Time.IsZero(), Equals, false)
+}
+
+func (s *inventorySuite) TestVolumeStatusNotActivated(c *C) {
+	_, err := VolumeStatus("data")
+	c.Check(err, Equals, ErrVolumeNotActivated)
+}
+
+func (s *inventorySuite) TestVolumeStatusInvalidName(c *C) {
+	for _, name := range []string{"", ".", "..", "../volumes/data", "data/../x"} {
+		_, err := VolumeStatus(name)
+		c.Check(err, ErrorMatches, "cannot read inventory entry for .*: invalid volume name .*")
+		c.Check(ClearRecoveryMarker(name), ErrorMatches, "invalid volume name .*")
+	}
+}
+
+func (s *inventorySuite) TestVolumeStatusAfterDeactivate(c *C) {
+	s.activate(c, "scratch", "/dev/sda3")
+	c.Check(DeactivateVolume("scratch", "/dev/sda3", nil), IsNil)
+
+	_, err := VolumeStatus("scratch")
+	c.Check(err, Equals, ErrVolumeNotActivated)
+}
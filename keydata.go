@@ -23,20 +23,23 @@ import (
 	"bytes"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
+	"math"
 	"math/big"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/canonical/go-tpm2"
 	"github.com/canonical/go-tpm2/mu"
 	"github.com/snapcore/secboot/internal/tcg"
-	"github.com/snapcore/snapd/osutil"
-	"github.com/snapcore/snapd/osutil/sys"
 
 	"golang.org/x/xerrors"
 
@@ -44,7 +47,7 @@ import (
 )
 
 const (
-	currentMetadataVersion    uint32 = 1
+	currentMetadataVersion    uint32 = 3
 	keyDataHeader             uint32 = 0x55534b24
 	keyPolicyUpdateDataHeader uint32 = 0x55534b50
 )
@@ -60,11 +63,20 @@ const (
 // TPMPolicyAuthKey corresponds to the private part of the key used for signing updates to the authorization policy for a sealed key.
 type TPMPolicyAuthKey []byte
 
+// sealedData is the sensitive data sealed inside the TPM object for version 1 key files.
 type sealedData struct {
 	Key            []byte
 	AuthPrivateKey TPMPolicyAuthKey
 }
 
+// sealedData_v2 is the sensitive data sealed inside the TPM object for version 2 key files. EKName is the name of the endorsement
+// key that the sealed key object is bound to, or empty if the key is not bound to a specific endorsement key.
+type sealedData_v2 struct {
+	Key            []byte
+	AuthPrivateKey TPMPolicyAuthKey
+	EKName         tpm2.Name
+}
+
 type afSplitDataRawHdr struct {
 	Stripes uint32
 	HashAlg tpm2.HashAlgorithmId
@@ -248,15 +260,634 @@ type keyDataRaw_v1 struct {
 	DynamicPolicyData *dynamicPolicyDataRaw_v0
 }
 
+// keyDataExtensionType identifies the type of an extension in a version 3 or later key data file.
+type keyDataExtensionType uint32
+
+const (
+	// keyDataExtensionTPMFirmwareInfo is an extension containing the manufacturer and firmware version of the TPM at the time
+	// that the key was sealed or its PCR policy was last updated, encoded as tpmFirmwareInfo.
+	keyDataExtensionTPMFirmwareInfo keyDataExtensionType = 1
+
+	// keyDataExtensionMetadata is an extension containing caller supplied metadata about the key, encoded as keyMetadataRaw.
+	keyDataExtensionMetadata keyDataExtensionType = 2
+
+	// keyDataExtensionIdentity is an extension containing the unique ID of the key and the generation number of its PCR policy,
+	// encoded as keyIdentityRaw.
+	keyDataExtensionIdentity keyDataExtensionType = 3
+
+	// keyDataExtensionLockoutAuth is an extension containing copies of the lockout hierarchy authorization value, each wrapped
+	// with a different secret, encoded as a list of wrappedLockoutAuth.
+	keyDataExtensionLockoutAuth keyDataExtensionType = 4
+
+	// keyDataExtensionPolicyAuthDelegation is an extension containing the authorization for the intermediate key that signed
+	// the current PCR policy, encoded as policyAuthDelegationRaw.
+	keyDataExtensionPolicyAuthDelegation keyDataExtensionType = 5
+
+	// keyDataExtensionPCRPolicyRevocationMode is an extension recording whether the key was sealed with support for PCR policy
+	// revocation, encoded as a PCRPolicyRevocationMode.
+	keyDataExtensionPCRPolicyRevocationMode keyDataExtensionType = 6
+
+	// keyDataExtensionVolumeKeyDerivation is an extension indicating that the sealed key is a master secret from which the keys
+	// for individual volumes are derived, encoded as volumeKeyDerivation.
+	keyDataExtensionVolumeKeyDerivation keyDataExtensionType = 7
+
+	// keyDataExtensionDiskIdentity is an extension containing the GUIDs of the disk and partitions that the key was sealed for,
+	// encoded as diskIdentityRaw.
+	keyDataExtensionDiskIdentity keyDataExtensionType = 8
+
+	// keyDataExtensionIntegrity is an extension containing the parameters of the standalone dm-integrity device beneath the
+	// volume, encoded as integrityParamsRaw.
+	keyDataExtensionIntegrity keyDataExtensionType = 9
+
+	// keyDataExtensionDmVerityRootHashes is an extension containing the dm-verity root hashes of the root filesystems that the
+	// key may be used with, encoded as a list of byte slices.
+	keyDataExtensionDmVerityRootHashes keyDataExtensionType = 10
+
+	// keyDataExtensionPlainCrypt is an extension containing the parameters of the plain dm-crypt volume that the key is for,
+	// encoded as plainCryptParamsRaw.
+	keyDataExtensionPlainCrypt keyDataExtensionType = 11
+
+	// keyDataExtensionRequiredFeatures is an extension containing the features that a version of secboot must support in order
+	// to use the key data file, encoded as KeyDataFeatures.
+	keyDataExtensionRequiredFeatures keyDataExtensionType = 12
+
+	// keyDataExtensionTPMDeviceBinding is an extension identifying the TPM device that the key was sealed with, encoded as
+	// tpmDeviceBindingRaw.
+	keyDataExtensionTPMDeviceBinding keyDataExtensionType = 13
+
+	// keyDataExtensionImportSymSeed is an extension containing the seed used to protect a sealed key object that was created
+	// outside of the TPM, encrypted with the storage root key. It indicates that the private area of the sealed key object is a
+	// duplication blob that must be imported with TPM2_Import before it can be loaded.
+	keyDataExtensionImportSymSeed keyDataExtensionType = 14
+)
+
+// KeyDataFeatures is a set of optional features of a key data file that change how it must be interpreted. Key data files
+// record the features that they require, and versions of secboot that don't support all of them refuse to use the file with a
+// *KeyDataUnsupportedError error rather than misinterpreting it.
+type KeyDataFeatures uint64
+
+const (
+	// KeyDataFeaturePolicyAuthDelegation indicates that the PCR policy is signed by an intermediate key.
+	KeyDataFeaturePolicyAuthDelegation KeyDataFeatures = 1 << iota
+
+	// KeyDataFeatureVolumeKeyDerivation indicates that the sealed key is a master secret from which volume keys are derived.
+	KeyDataFeatureVolumeKeyDerivation
+
+	// KeyDataFeatureDiskIdentity indicates that the key is bound to specific disk and partition GUIDs.
+	KeyDataFeatureDiskIdentity
+
+	// KeyDataFeatureIntegrity indicates that the volume is on top of a standalone dm-integrity device.
+	KeyDataFeatureIntegrity
+
+	// KeyDataFeatureDmVerityRootHashes indicates that the key is bound to dm-verity root hashes.
+	KeyDataFeatureDmVerityRootHashes
+
+	// KeyDataFeaturePlainCrypt indicates that the key is for a plain dm-crypt volume.
+	KeyDataFeaturePlainCrypt
+
+	// KeyDataFeatureImportable indicates that the sealed key object was created outside of the TPM and must be imported before
+	// it can be loaded.
+	KeyDataFeatureImportable
+)
+
+// supportedKeyDataFeatures is the set of features that this version of secboot supports.
+const supportedKeyDataFeatures = KeyDataFeaturePolicyAuthDelegation | KeyDataFeatureVolumeKeyDerivation | KeyDataFeatureDiskIdentity |
+	KeyDataFeatureIntegrity | KeyDataFeatureDmVerityRootHashes | KeyDataFeaturePlainCrypt | KeyDataFeatureImportable
+
+var keyDataFeatureNames = []struct {
+	feature KeyDataFeatures
+	name    string
+}{
+	{KeyDataFeaturePolicyAuthDelegation, "policy-auth-delegation"},
+	{KeyDataFeatureVolumeKeyDerivation, "volume-key-derivation"},
+	{KeyDataFeatureDiskIdentity, "disk-identity"},
+	{KeyDataFeatureIntegrity, "integrity"},
+	{KeyDataFeatureDmVerityRootHashes, "dm-verity-root-hashes"},
+	{KeyDataFeaturePlainCrypt, "plain-crypt"},
+	{KeyDataFeatureImportable, "importable"},
+}
+
+func (f KeyDataFeatures) String() string {
+	var names []string
+	for _, n := range keyDataFeatureNames {
+		if f&n.feature > 0 {
+			names = append(names, n.name)
+			f &^= n.feature
+		}
+	}
+	if f != 0 {
+		names = append(names, fmt.Sprintf("unknown(%#x)", uint64(f)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// SupportedKeyDataFeatures returns the set of key data features supported by this version of secboot.
+func SupportedKeyDataFeatures() KeyDataFeatures {
+	return supportedKeyDataFeatures
+}
+
+// SupportedKeyDataVersion returns the latest key data file version supported by this version of secboot.
+func SupportedKeyDataVersion() uint32 {
+	return currentMetadataVersion
+}
+
+// PCRPolicyRevocationMode describes whether PCR policies for a sealed key can be revoked.
+type PCRPolicyRevocationMode uint8
+
+const (
+	// PCRPolicyRevocationCounter indicates that the key has a NV counter which is incremented in order to revoke previous PCR
+	// policies each time that the PCR policy is updated.
+	PCRPolicyRevocationCounter PCRPolicyRevocationMode = iota + 1
+
+	// PCRPolicyRevocationNone indicates that the key was sealed without a NV counter. Every PCR policy created for the key remains
+	// valid for the lifetime of the key data file, and previous policies can only be revoked by sealing a new key and discarding
+	// the existing one (eg, by reinstalling).
+	PCRPolicyRevocationNone
+)
+
+func (m PCRPolicyRevocationMode) String() string {
+	switch m {
+	case PCRPolicyRevocationCounter:
+		return "counter"
+	case PCRPolicyRevocationNone:
+		return "none"
+	default:
+		return fmt.Sprintf("PCRPolicyRevocationMode(%d)", m)
+	}
+}
+
+// KeyID is the unique identifier of a sealed key, generated randomly when the key is sealed.
+type KeyID [16]byte
+
+func (id KeyID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id KeyID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *KeyID) UnmarshalText(text []byte) error {
+	if hex.DecodedLen(len(text)) != len(id) {
+		return fmt.Errorf("invalid key ID length (%d)", len(text))
+	}
+	_, err := hex.Decode(id[:], text)
+	return err
+}
+
+// keyIdentity contains the unique ID of a sealed key and the generation number of its PCR policy.
+type keyIdentity struct {
+	ID         KeyID
+	Generation uint64 // Starts at 1 when the key is sealed and is incremented on every PCR policy update
+}
+
+// keyIdentityRaw is the on-disk form of keyIdentity.
+type keyIdentityRaw struct {
+	ID         []byte
+	Generation uint64
+}
+
+func (i *keyIdentityRaw) data() (*keyIdentity, error) {
+	var id KeyID
+	if len(i.ID) != len(id) {
+		return nil, fmt.Errorf("invalid key ID length (%d)", len(i.ID))
+	}
+	copy(id[:], i.ID)
+	return &keyIdentity{ID: id, Generation: i.Generation}, nil
+}
+
+func newKeyIdentity() (*keyIdentity, error) {
+	var id KeyID
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, xerrors.Errorf("cannot obtain random bytes: %w", err)
+	}
+	return &keyIdentity{ID: id, Generation: 1}, nil
+}
+
+// KeyMetadata contains optional metadata that can be stored in a sealed key data file in order to help management tools identify
+// keys without having to maintain records elsewhere. The metadata is stored in the clear and is not integrity protected by the TPM,
+// so it must not contain secrets and must not be used to make security decisions.
+type KeyMetadata struct {
+	Role         string    // The role of the key (eg, "run", "recovery")
+	Label        string    // A human readable label for the key
+	CreationTime time.Time // The time that the key was sealed
+	CallerData   []byte    // Opaque data supplied by the caller
+}
+
+// maxKeyDataFieldSize is the maximum size of a variable length byte field in a key data file, including each extension.
+const maxKeyDataFieldSize = math.MaxUint16
+
+// check returns an error if this metadata is too large to be recorded in a key data file.
+func (m *KeyMetadata) check() error {
+	for _, f := range []struct {
+		name string
+		size int
+	}{
+		{"role", len(m.Role)},
+		{"label", len(m.Label)},
+		{"caller data", len(m.CallerData)},
+	} {
+		if f.size > maxKeyDataFieldSize {
+			return fmt.Errorf("%s is too large (%d bytes, maximum is %d)", f.name, f.size, maxKeyDataFieldSize)
+		}
+	}
+	// The encoded metadata is stored in a single extension. Each field has a 2 byte size prefix, and the creation time is 8 bytes.
+	if size := 2 + len(m.Role) + 2 + len(m.Label) + 8 + 2 + len(m.CallerData); size > maxKeyDataFieldSize {
+		return fmt.Errorf("encoded metadata is too large (%d bytes, maximum is %d)", size, maxKeyDataFieldSize)
+	}
+	return nil
+}
+
+// checkDmVerityRootHashes returns an error if the supplied dm-verity root hashes are too large to be recorded in a key data file.
+func checkDmVerityRootHashes(rootHashes [][]byte) error {
+	// The encoded list has a 4 byte length prefix, and each hash has a 2 byte size prefix.
+	size := 4
+	for _, h := range rootHashes {
+		if len(h) > maxKeyDataFieldSize {
+			return fmt.Errorf("root hash is too large (%d bytes, maximum is %d)", len(h), maxKeyDataFieldSize)
+		}
+		size += 2 + len(h)
+	}
+	if size > maxKeyDataFieldSize {
+		return fmt.Errorf("encoded root hashes are too large (%d bytes, maximum is %d)", size, maxKeyDataFieldSize)
+	}
+	return nil
+}
+
+// keyMetadataRaw is the on-disk form of KeyMetadata.
+type keyMetadataRaw struct {
+	Role         []byte
+	Label        []byte
+	CreationTime uint64 // Seconds since the UNIX epoch, or zero if not set
+	CallerData   []byte
+}
+
+func makeKeyMetadataRaw(m *KeyMetadata) *keyMetadataRaw {
+	raw := &keyMetadataRaw{
+		Role:       []byte(m.Role),
+		Label:      []byte(m.Label),
+		CallerData: m.CallerData}
+	if !m.CreationTime.IsZero() {
+		raw.CreationTime = uint64(m.CreationTime.Unix())
+	}
+	return raw
+}
+
+func (m *keyMetadataRaw) data() *KeyMetadata {
+	out := &KeyMetadata{
+		Role:       string(m.Role),
+		Label:      string(m.Label),
+		CallerData: m.CallerData}
+	if m.CreationTime != 0 {
+		out.CreationTime = time.Unix(int64(m.CreationTime), 0)
+	}
+	return out
+}
+
+// keyDataExtensionRaw is an optional extension in a version 3 or later key data file.
+type keyDataExtensionRaw struct {
+	Type keyDataExtensionType
+	Data []byte
+}
+
+// keyDataRaw_v3 is version 3 of the on-disk format of keyDataRaw. It adds a list of extensions to version 1 for metadata that
+// isn't required in order to execute the authorization policy.
+type keyDataRaw_v3 struct {
+	KeyPrivate        tpm2.Private
+	KeyPublic         *tpm2.Public
+	AuthModeHint      AuthMode
+	StaticPolicyData  *staticPolicyDataRaw_v1
+	DynamicPolicyData *dynamicPolicyDataRaw_v0
+	Extensions        []keyDataExtensionRaw
+}
+
 // keyData corresponds to the part of a sealed key object that contains the TPM sealed object and associated metadata required
 // for executing authorization policy assertions.
 type keyData struct {
-	version           uint32
-	keyPrivate        tpm2.Private
-	keyPublic         *tpm2.Public
-	authModeHint      AuthMode
+	version      uint32
+	keyPrivate   tpm2.Private
+	keyPublic    *tpm2.Public
+	authModeHint AuthMode
+
+	// importSymSeed is the seed used to protect the private area of a sealed key object that was created outside of the TPM,
+	// encrypted with the storage root key. If this is set, keyPrivate is a duplication blob that must be imported with
+	// TPM2_Import before the object can be loaded. This is only recorded for version 3 and later.
+	importSymSeed tpm2.EncryptedSecret
+
 	staticPolicyData  *staticPolicyData
 	dynamicPolicyData *dynamicPolicyData
+
+	// tpmFirmwareInfo is the manufacturer and firmware version of the TPM at the time that the key was sealed or its PCR policy
+	// was last updated. This is only recorded for version 3 and later.
+	tpmFirmwareInfo *tpmFirmwareInfo
+
+	// metadata is the caller supplied metadata for the key. This is only recorded for version 3 and later.
+	metadata *KeyMetadata
+
+	// identity is the unique ID and PCR policy generation number of the key. This is only recorded for version 3 and later.
+	identity *keyIdentity
+
+	// lockoutAuth contains wrapped copies of the lockout hierarchy authorization value. This is only recorded for version 3 and
+	// later.
+	lockoutAuth []wrappedLockoutAuth
+
+	// revocationMode is the PCR policy revocation mode that the key was sealed with. This is only recorded for version 3 and later
+	// key data files created with support for it, and is zero otherwise.
+	revocationMode PCRPolicyRevocationMode
+
+	// volumeKeyDerivation indicates that the sealed key is a master secret from which volume keys are derived. This is only
+	// recorded for version 3 and later.
+	volumeKeyDerivation *volumeKeyDerivation
+
+	// diskIdentity identifies the disk and partitions that the key was sealed for. This is only recorded for version 3 and later.
+	diskIdentity *DiskIdentity
+
+	// integrity contains the parameters of the standalone dm-integrity device beneath the volume. This is only recorded for
+	// version 3 and later.
+	integrity *IntegrityParams
+
+	// verityRootHashes contains the dm-verity root hashes of the root filesystems that the key may be used with. This is only
+	// recorded for version 3 and later.
+	verityRootHashes [][]byte
+
+	// plainCrypt contains the parameters of the plain dm-crypt volume that the key is for. This is only recorded for version 3
+	// and later.
+	plainCrypt *PlainCryptParams
+
+	// deviceBinding identifies the TPM device that the key was sealed with. This is only recorded for version 3 and later.
+	deviceBinding *TPMDeviceBinding
+
+	// requiredFeatures contains the features recorded in a key data file that was read. It is only used to detect files that
+	// can't be used by this version - the features recorded when a file is written are computed from its contents.
+	requiredFeatures KeyDataFeatures
+
+	// unknownExtensions contains extensions read from a key data file that aren't understood by this version, so that they are
+	// preserved when the key data file is updated.
+	unknownExtensions []keyDataExtensionRaw
+}
+
+// features returns the features required to use this key data.
+func (d *keyData) features() (out KeyDataFeatures) {
+	if d.dynamicPolicyData != nil && d.dynamicPolicyData.delegation != nil {
+		out |= KeyDataFeaturePolicyAuthDelegation
+	}
+	if d.volumeKeyDerivation != nil {
+		out |= KeyDataFeatureVolumeKeyDerivation
+	}
+	if d.diskIdentity != nil {
+		out |= KeyDataFeatureDiskIdentity
+	}
+	if d.integrity != nil {
+		out |= KeyDataFeatureIntegrity
+	}
+	if len(d.verityRootHashes) > 0 {
+		out |= KeyDataFeatureDmVerityRootHashes
+	}
+	if d.plainCrypt != nil {
+		out |= KeyDataFeaturePlainCrypt
+	}
+	if d.importSymSeed != nil {
+		out |= KeyDataFeatureImportable
+	}
+	return out
+}
+
+// checkSupported returns a *KeyDataUnsupportedError error if this key data was read from a file that is a newer version or that
+// requires features that this version of secboot doesn't support.
+func (d *keyData) checkSupported() error {
+	if d.version > currentMetadataVersion {
+		return &KeyDataUnsupportedError{Version: d.version}
+	}
+	if missing := d.requiredFeatures &^ supportedKeyDataFeatures; missing != 0 {
+		return &KeyDataUnsupportedError{Version: d.version, MissingFeatures: missing}
+	}
+	return nil
+}
+
+// keyIDs returns the ID of this key as a slice, or nil if it doesn't have one.
+func (d *keyData) keyIDs() []KeyID {
+	if d.identity == nil {
+		return nil
+	}
+	return []KeyID{d.identity.ID}
+}
+
+// extensions returns the extensions to serialize for a version 3 or later key data file.
+// appendKeyDataExtension marshals the supplied value and appends it to the supplied extensions as an extension of the specified
+// type. An error is returned if the marshalled value is too large to be stored in an extension.
+func appendKeyDataExtension(extensions []keyDataExtensionRaw, t keyDataExtensionType, desc string, v interface{}) ([]keyDataExtensionRaw, error) {
+	b, err := mu.MarshalToBytes(v)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot marshal %s: %w", desc, err)
+	}
+	if len(b) > maxKeyDataFieldSize {
+		return nil, fmt.Errorf("%s is too large (%d bytes, maximum is %d)", desc, len(b), maxKeyDataFieldSize)
+	}
+	return append(extensions, keyDataExtensionRaw{Type: t, Data: b}), nil
+}
+
+// extensions returns the extensions to record in a version 3 or later key data file.
+func (d *keyData) extensions() (out []keyDataExtensionRaw, err error) {
+	if features := d.features(); features != 0 {
+		if out, err = appendKeyDataExtension(out, keyDataExtensionRequiredFeatures, "required features", features); err != nil {
+			return nil, err
+		}
+	}
+	if d.tpmFirmwareInfo != nil {
+		if out, err = appendKeyDataExtension(out, keyDataExtensionTPMFirmwareInfo, "TPM firmware info", d.tpmFirmwareInfo); err != nil {
+			return nil, err
+		}
+	}
+	if d.metadata != nil {
+		if out, err = appendKeyDataExtension(out, keyDataExtensionMetadata, "key metadata", makeKeyMetadataRaw(d.metadata)); err != nil {
+			return nil, err
+		}
+	}
+	if d.identity != nil {
+		if out, err = appendKeyDataExtension(out, keyDataExtensionIdentity, "key identity", keyIdentityRaw{ID: d.identity.ID[:], Generation: d.identity.Generation}); err != nil {
+			return nil, err
+		}
+	}
+	if len(d.lockoutAuth) > 0 {
+		if out, err = appendKeyDataExtension(out, keyDataExtensionLockoutAuth, "lockout authorization", d.lockoutAuth); err != nil {
+			return nil, err
+		}
+	}
+	if d.dynamicPolicyData != nil && d.dynamicPolicyData.delegation != nil {
+		if out, err = appendKeyDataExtension(out, keyDataExtensionPolicyAuthDelegation, "policy authorization delegation", makePolicyAuthDelegationRaw(d.dynamicPolicyData.delegation)); err != nil {
+			return nil, err
+		}
+	}
+	if d.revocationMode != 0 {
+		if out, err = appendKeyDataExtension(out, keyDataExtensionPCRPolicyRevocationMode, "PCR policy revocation mode", d.revocationMode); err != nil {
+			return nil, err
+		}
+	}
+	if d.volumeKeyDerivation != nil {
+		if out, err = appendKeyDataExtension(out, keyDataExtensionVolumeKeyDerivation, "volume key derivation parameters", d.volumeKeyDerivation); err != nil {
+			return nil, err
+		}
+	}
+	if d.diskIdentity != nil {
+		if out, err = appendKeyDataExtension(out, keyDataExtensionDiskIdentity, "disk identity", makeDiskIdentityRaw(d.diskIdentity)); err != nil {
+			return nil, err
+		}
+	}
+	if d.integrity != nil {
+		if out, err = appendKeyDataExtension(out, keyDataExtensionIntegrity, "integrity parameters", makeIntegrityParamsRaw(d.integrity)); err != nil {
+			return nil, err
+		}
+	}
+	if len(d.verityRootHashes) > 0 {
+		if out, err = appendKeyDataExtension(out, keyDataExtensionDmVerityRootHashes, "dm-verity root hashes", d.verityRootHashes); err != nil {
+			return nil, err
+		}
+	}
+	if d.plainCrypt != nil {
+		if out, err = appendKeyDataExtension(out, keyDataExtensionPlainCrypt, "plain dm-crypt parameters", makePlainCryptParamsRaw(d.plainCrypt)); err != nil {
+			return nil, err
+		}
+	}
+	if d.deviceBinding != nil {
+		if out, err = appendKeyDataExtension(out, keyDataExtensionTPMDeviceBinding, "TPM device binding", makeTPMDeviceBindingRaw(d.deviceBinding)); err != nil {
+			return nil, err
+		}
+	}
+	if d.importSymSeed != nil {
+		if out, err = appendKeyDataExtension(out, keyDataExtensionImportSymSeed, "import seed", d.importSymSeed); err != nil {
+			return nil, err
+		}
+	}
+	return append(out, d.unknownExtensions...), nil
+}
+
+// setExtensions decodes the extensions read from a version 3 or later key data file.
+func (d *keyData) setExtensions(extensions []keyDataExtensionRaw) error {
+	// Check the required features first, and don't attempt to interpret any other extensions if they aren't supported.
+	for _, e := range extensions {
+		if e.Type != keyDataExtensionRequiredFeatures {
+			continue
+		}
+		if _, err := mu.UnmarshalFromBytes(e.Data, &d.requiredFeatures); err != nil {
+			return xerrors.Errorf("cannot unmarshal required features: %w", err)
+		}
+		if d.requiredFeatures&^supportedKeyDataFeatures != 0 {
+			return nil
+		}
+	}
+
+	for _, e := range extensions {
+		switch e.Type {
+		case keyDataExtensionRequiredFeatures:
+			// Already handled above. This is recomputed when the file is written.
+		case keyDataExtensionTPMFirmwareInfo:
+			var info *tpmFirmwareInfo
+			if _, err := mu.UnmarshalFromBytes(e.Data, &info); err != nil {
+				return xerrors.Errorf("cannot unmarshal TPM firmware info: %w", err)
+			}
+			d.tpmFirmwareInfo = info
+		case keyDataExtensionMetadata:
+			var raw keyMetadataRaw
+			if _, err := mu.UnmarshalFromBytes(e.Data, &raw); err != nil {
+				return xerrors.Errorf("cannot unmarshal key metadata: %w", err)
+			}
+			d.metadata = raw.data()
+		case keyDataExtensionIdentity:
+			var raw keyIdentityRaw
+			if _, err := mu.UnmarshalFromBytes(e.Data, &raw); err != nil {
+				return xerrors.Errorf("cannot unmarshal key identity: %w", err)
+			}
+			identity, err := raw.data()
+			if err != nil {
+				return xerrors.Errorf("invalid key identity: %w", err)
+			}
+			d.identity = identity
+		case keyDataExtensionLockoutAuth:
+			var lockoutAuth []wrappedLockoutAuth
+			if _, err := mu.UnmarshalFromBytes(e.Data, &lockoutAuth); err != nil {
+				return xerrors.Errorf("cannot unmarshal lockout authorization: %w", err)
+			}
+			d.lockoutAuth = lockoutAuth
+		case keyDataExtensionPolicyAuthDelegation:
+			var raw policyAuthDelegationRaw
+			if _, err := mu.UnmarshalFromBytes(e.Data, &raw); err != nil {
+				return xerrors.Errorf("cannot unmarshal policy authorization delegation: %w", err)
+			}
+			if d.dynamicPolicyData == nil {
+				return errors.New("policy authorization delegation without dynamic policy data")
+			}
+			d.dynamicPolicyData.delegation = raw.data()
+		case keyDataExtensionPCRPolicyRevocationMode:
+			var mode PCRPolicyRevocationMode
+			if _, err := mu.UnmarshalFromBytes(e.Data, &mode); err != nil {
+				return xerrors.Errorf("cannot unmarshal PCR policy revocation mode: %w", err)
+			}
+			switch mode {
+			case PCRPolicyRevocationCounter, PCRPolicyRevocationNone:
+			default:
+				return fmt.Errorf("invalid PCR policy revocation mode %d", mode)
+			}
+			d.revocationMode = mode
+		case keyDataExtensionVolumeKeyDerivation:
+			var derivation *volumeKeyDerivation
+			if _, err := mu.UnmarshalFromBytes(e.Data, &derivation); err != nil {
+				return xerrors.Errorf("cannot unmarshal volume key derivation parameters: %w", err)
+			}
+			if derivation.KeySize == 0 || derivation.KeySize > maxVolumeKeySize {
+				return fmt.Errorf("invalid volume key size %d", derivation.KeySize)
+			}
+			d.volumeKeyDerivation = derivation
+		case keyDataExtensionDiskIdentity:
+			var raw diskIdentityRaw
+			if _, err := mu.UnmarshalFromBytes(e.Data, &raw); err != nil {
+				return xerrors.Errorf("cannot unmarshal disk identity: %w", err)
+			}
+			identity, err := raw.data()
+			if err != nil {
+				return xerrors.Errorf("invalid disk identity: %w", err)
+			}
+			d.diskIdentity = identity
+		case keyDataExtensionIntegrity:
+			var raw integrityParamsRaw
+			if _, err := mu.UnmarshalFromBytes(e.Data, &raw); err != nil {
+				return xerrors.Errorf("cannot unmarshal integrity parameters: %w", err)
+			}
+			d.integrity = raw.data()
+		case keyDataExtensionDmVerityRootHashes:
+			var rootHashes [][]byte
+			if _, err := mu.UnmarshalFromBytes(e.Data, &rootHashes); err != nil {
+				return xerrors.Errorf("cannot unmarshal dm-verity root hashes: %w", err)
+			}
+			d.verityRootHashes = rootHashes
+		case keyDataExtensionPlainCrypt:
+			var raw plainCryptParamsRaw
+			if _, err := mu.UnmarshalFromBytes(e.Data, &raw); err != nil {
+				return xerrors.Errorf("cannot unmarshal plain dm-crypt parameters: %w", err)
+			}
+			d.plainCrypt = raw.data()
+		case keyDataExtensionTPMDeviceBinding:
+			var raw tpmDeviceBindingRaw
+			if _, err := mu.UnmarshalFromBytes(e.Data, &raw); err != nil {
+				return xerrors.Errorf("cannot unmarshal TPM device binding: %w", err)
+			}
+			d.deviceBinding = raw.data()
+		case keyDataExtensionImportSymSeed:
+			var seed tpm2.EncryptedSecret
+			if _, err := mu.UnmarshalFromBytes(e.Data, &seed); err != nil {
+				return xerrors.Errorf("cannot unmarshal import seed: %w", err)
+			}
+			if len(seed) == 0 {
+				return errors.New("invalid import seed")
+			}
+			d.importSymSeed = seed
+		default:
+			d.unknownExtensions = append(d.unknownExtensions, e)
+		}
+	}
+	return nil
 }
 
 func (d *keyData) Marshal(w io.Writer) error {
@@ -275,16 +906,35 @@ func (d *keyData) Marshal(w io.Writer) error {
 		if _, err := mu.MarshalToWriter(w, raw); err != nil {
 			return xerrors.Errorf("cannot marshal raw data: %w", err)
 		}
-	case 1:
+	case 1, 2, 3:
 		var tmpW bytes.Buffer
-		raw := keyDataRaw_v1{
-			KeyPrivate:        d.keyPrivate,
-			KeyPublic:         d.keyPublic,
-			AuthModeHint:      d.authModeHint,
-			StaticPolicyData:  makeStaticPolicyDataRaw_v1(d.staticPolicyData),
-			DynamicPolicyData: makeDynamicPolicyDataRaw_v0(d.dynamicPolicyData)}
-		if _, err := mu.MarshalToWriter(&tmpW, raw); err != nil {
-			return xerrors.Errorf("cannot marshal raw data: %w", err)
+		switch d.version {
+		case 1, 2:
+			// Version 2 only changes the format of the sealed data, so the on-disk format is the same as version 1.
+			raw := keyDataRaw_v1{
+				KeyPrivate:        d.keyPrivate,
+				KeyPublic:         d.keyPublic,
+				AuthModeHint:      d.authModeHint,
+				StaticPolicyData:  makeStaticPolicyDataRaw_v1(d.staticPolicyData),
+				DynamicPolicyData: makeDynamicPolicyDataRaw_v0(d.dynamicPolicyData)}
+			if _, err := mu.MarshalToWriter(&tmpW, raw); err != nil {
+				return xerrors.Errorf("cannot marshal raw data: %w", err)
+			}
+		default:
+			extensions, err := d.extensions()
+			if err != nil {
+				return xerrors.Errorf("cannot encode extensions: %w", err)
+			}
+			raw := keyDataRaw_v3{
+				KeyPrivate:        d.keyPrivate,
+				KeyPublic:         d.keyPublic,
+				AuthModeHint:      d.authModeHint,
+				StaticPolicyData:  makeStaticPolicyDataRaw_v1(d.staticPolicyData),
+				DynamicPolicyData: makeDynamicPolicyDataRaw_v0(d.dynamicPolicyData),
+				Extensions:        extensions}
+			if _, err := mu.MarshalToWriter(&tmpW, raw); err != nil {
+				return xerrors.Errorf("cannot marshal raw data: %w", err)
+			}
 		}
 		splitData, err := makeAfSplitData(tmpW.Bytes(), 128*1024, tpm2.HashAlgorithmSHA256)
 		if err != nil {
@@ -318,7 +968,7 @@ func (d *keyData) Unmarshal(r mu.Reader) error {
 			authModeHint:      raw.AuthModeHint,
 			staticPolicyData:  raw.StaticPolicyData.data(),
 			dynamicPolicyData: raw.DynamicPolicyData.data()}
-	case 1:
+	case 1, 2, 3:
 		var splitData afSplitDataRaw
 		if _, err := mu.UnmarshalFromReader(r, &splitData); err != nil {
 			return xerrors.Errorf("cannot unmarshal split data: %w", err)
@@ -329,23 +979,67 @@ func (d *keyData) Unmarshal(r mu.Reader) error {
 			return xerrors.Errorf("cannot merge data: %w", err)
 		}
 
-		var raw keyDataRaw_v1
-		if _, err := mu.UnmarshalFromBytes(merged, &raw); err != nil {
-			return xerrors.Errorf("cannot unmarshal data: %w", err)
+		switch version {
+		case 1, 2:
+			var raw keyDataRaw_v1
+			if _, err := mu.UnmarshalFromBytes(merged, &raw); err != nil {
+				return xerrors.Errorf("cannot unmarshal data: %w", err)
+			}
+			*d = keyData{
+				version:           version,
+				keyPrivate:        raw.KeyPrivate,
+				keyPublic:         raw.KeyPublic,
+				authModeHint:      raw.AuthModeHint,
+				staticPolicyData:  raw.StaticPolicyData.data(),
+				dynamicPolicyData: raw.DynamicPolicyData.data()}
+		default:
+			var raw keyDataRaw_v3
+			if _, err := mu.UnmarshalFromBytes(merged, &raw); err != nil {
+				return xerrors.Errorf("cannot unmarshal data: %w", err)
+			}
+			*d = keyData{
+				version:           version,
+				keyPrivate:        raw.KeyPrivate,
+				keyPublic:         raw.KeyPublic,
+				authModeHint:      raw.AuthModeHint,
+				staticPolicyData:  raw.StaticPolicyData.data(),
+				dynamicPolicyData: raw.DynamicPolicyData.data()}
+			if err := d.setExtensions(raw.Extensions); err != nil {
+				return xerrors.Errorf("cannot decode extensions: %w", err)
+			}
 		}
-		*d = keyData{
-			version:           version,
-			keyPrivate:        raw.KeyPrivate,
-			keyPublic:         raw.KeyPublic,
-			authModeHint:      raw.AuthModeHint,
-			staticPolicyData:  raw.StaticPolicyData.data(),
-			dynamicPolicyData: raw.DynamicPolicyData.data()}
 	default:
-		return fmt.Errorf("unexpected version number (%d)", version)
+		// This is a file created by a newer version of secboot. Record the version so that decodeKeyData can return a useful
+		// error rather than trying to interpret the rest of the data.
+		*d = keyData{version: version}
 	}
 	return nil
 }
 
+// loadablePrivate returns the private area of the TPM sealed object associated with this keyData in a form that can be loaded as
+// a child of the storage root key. If the object was created outside of the TPM, this imports it with TPM2_Import.
+func (d *keyData) loadablePrivate(tpm *tpm2.TPMContext, srkContext tpm2.ResourceContext, session tpm2.SessionContext) (tpm2.Private, error) {
+	if d.importSymSeed == nil {
+		return d.keyPrivate, nil
+	}
+
+	priv, err := tpm.Import(srkContext, nil, d.keyPublic, d.keyPrivate, d.importSymSeed, &tpm2.SymDefObject{Algorithm: tpm2.SymObjectAlgorithmNull}, session)
+	if err != nil {
+		invalidObject := false
+		switch {
+		case tpm2.IsTPMParameterError(err, tpm2.AnyErrorCode, tpm2.CommandImport, tpm2.AnyParameterIndex):
+			invalidObject = true
+		case tpm2.IsTPMError(err, tpm2.ErrorSensitive, tpm2.CommandImport):
+			invalidObject = true
+		}
+		if invalidObject {
+			return nil, keyFileError{errors.New("cannot import sealed key object in to TPM: bad sealed key object or TPM owner changed")}
+		}
+		return nil, xerrors.Errorf("cannot import sealed key object in to TPM: %w", err)
+	}
+	return priv, nil
+}
+
 // load loads the TPM sealed object associated with this keyData in to the storage hierarchy of the TPM, and returns the newly
 // created tpm2.ResourceContext.
 func (d *keyData) load(tpm *tpm2.TPMContext, session tpm2.SessionContext) (tpm2.ResourceContext, error) {
@@ -354,7 +1048,12 @@ func (d *keyData) load(tpm *tpm2.TPMContext, session tpm2.SessionContext) (tpm2.
 		return nil, xerrors.Errorf("cannot create context for SRK: %w", err)
 	}
 
-	keyContext, err := tpm.Load(srkContext, d.keyPrivate, d.keyPublic, session)
+	keyPrivate, err := d.loadablePrivate(tpm, srkContext, session)
+	if err != nil {
+		return nil, err
+	}
+
+	keyContext, err := tpm.Load(srkContext, keyPrivate, d.keyPublic, session)
 	if err != nil {
 		invalidObject := false
 		switch {
@@ -380,6 +1079,9 @@ func (d *keyData) validate(tpm *tpm2.TPMContext, authKey crypto.PrivateKey, sess
 	}
 
 	sealedKeyTemplate := makeSealedKeyTemplate()
+	if d.importSymSeed != nil {
+		sealedKeyTemplate = makeImportableSealedKeyTemplate()
+	}
 
 	keyPublic := d.keyPublic
 
@@ -401,21 +1103,10 @@ func (d *keyData) validate(tpm *tpm2.TPMContext, authKey crypto.PrivateKey, sess
 
 	var legacyLockIndexName tpm2.Name
 	if d.version == 0 {
-		index, err := tpm.CreateResourceContextFromTPM(lockNVHandle, session.IncludeAttrs(tpm2.AttrAudit))
+		var err error
+		legacyLockIndexName, err = readLegacyLockNVIndexName(tpm, session)
 		if err != nil {
-			if tpm2.IsResourceUnavailableError(err, lockNVHandle) {
-				return nil, keyFileError{errors.New("lock NV index is unavailable")}
-			}
-			return nil, xerrors.Errorf("cannot create context for lock NV index: %w", err)
-		}
-		indexPub, _, err := tpm.NVReadPublic(index, session.IncludeAttrs(tpm2.AttrAudit))
-		if err != nil {
-			return nil, xerrors.Errorf("cannot read public area of lock NV index: %w", err)
-		}
-		indexPub.Attrs &^= tpm2.AttrNVReadLocked
-		legacyLockIndexName, err = indexPub.Name()
-		if err != nil {
-			return nil, xerrors.Errorf("cannot compute name of lock NV index: %w", err)
+			return nil, err
 		}
 	}
 
@@ -427,6 +1118,10 @@ func (d *keyData) validate(tpm *tpm2.TPMContext, authKey crypto.PrivateKey, sess
 	if (pcrPolicyCounterHandle != tpm2.HandleNull || d.version == 0) && pcrPolicyCounterHandle.Type() != tpm2.HandleTypeNVIndex {
 		return nil, keyFileError{errors.New("PCR policy counter handle is invalid")}
 	}
+	// The recorded revocation mode isn't integrity protected, so make sure it is consistent with the static policy.
+	if d.revocationMode != 0 && d.revocationMode != pcrPolicyRevocationModeForHandle(pcrPolicyCounterHandle) {
+		return nil, keyFileError{errors.New("PCR policy revocation mode is inconsistent with the PCR policy counter handle")}
+	}
 
 	var pcrPolicyCounter tpm2.ResourceContext
 	if pcrPolicyCounterHandle != tpm2.HandleNull {
@@ -501,6 +1196,15 @@ func (d *keyData) validate(tpm *tpm2.TPMContext, authKey crypto.PrivateKey, sess
 		}
 	}
 
+	// For v1 metadata and later, validate that the PCR policy counter was created and initialized by createPcrPolicyCounter. The
+	// name of the counter is also bound to the static authorization policy via the PCR policy ref, so a counter that fails these
+	// checks would also fail the policy check during unsealing, but this detects it earlier with a more useful error.
+	if d.version > 0 && pcrPolicyCounterPub != nil {
+		if err := validatePcrPolicyCounter(pcrPolicyCounterPub, authKeyName); err != nil {
+			return nil, keyFileError{err}
+		}
+	}
+
 	// For v0 metadata, validate that the OR policy digests for the PCR policy counter match the public area of the index.
 	if d.version == 0 {
 		pcrPolicyCounterAuthPolicies := d.staticPolicyData.v0PinIndexAuthPolicies
@@ -561,21 +1265,12 @@ func (d *keyData) write(w io.Writer) error {
 
 // writeToFileAtomic serializes keyData and writes it atomically to the file at the specified path.
 func (d *keyData) writeToFileAtomic(dest string) error {
-	f, err := osutil.NewAtomicFile(dest, 0600, 0, sys.UserID(osutil.NoChown), sys.GroupID(osutil.NoChown))
-	if err != nil {
-		return xerrors.Errorf("cannot create new atomic file: %w", err)
-	}
-	defer f.Cancel()
-
-	if err := d.write(f); err != nil {
-		return xerrors.Errorf("cannot write to temporary file: %w", err)
-	}
-
-	if err := f.Commit(); err != nil {
-		return xerrors.Errorf("cannot atomically replace file: %w", err)
-	}
+	return d.writeToLocation(FileKeyLocation(dest))
+}
 
-	return nil
+// writeToLocation serializes keyData and writes it atomically to the specified location.
+func (d *keyData) writeToLocation(dest KeyLocation) error {
+	return dest.WriteAtomic(d.write)
 }
 
 // decodeKeyData deserializes keyData from the provided io.Reader.
@@ -592,6 +1287,9 @@ func decodeKeyData(r io.Reader) (*keyData, error) {
 	if _, err := mu.UnmarshalFromReader(r, &d); err != nil {
 		return nil, xerrors.Errorf("cannot unmarshal data: %w", err)
 	}
+	if err := d.checkSupported(); err != nil {
+		return nil, err
+	}
 
 	return &d, nil
 }
@@ -659,10 +1357,19 @@ func decodeAndValidateKeyData(tpm *tpm2.TPMContext, keyFile io.Reader, authData
 	return data, authKey, pcrPolicyCounterPub, nil
 }
 
+// pcrPolicyRevocationModeForHandle returns the PCR policy revocation mode for a key with the specified PCR policy counter handle.
+func pcrPolicyRevocationModeForHandle(handle tpm2.Handle) PCRPolicyRevocationMode {
+	if handle == tpm2.HandleNull {
+		return PCRPolicyRevocationNone
+	}
+	return PCRPolicyRevocationCounter
+}
+
 // SealedKeyObject corresponds to a sealed key data file and exists to provide access to some read only operations on the underlying
 // file without having to read and deserialize the key data file more than once.
 type SealedKeyObject struct {
-	data *keyData
+	data     *keyData
+	location KeyLocation // The location that the key data was read from, if known
 }
 
 // Version returns the version number that this sealed key object was created with.
@@ -681,12 +1388,102 @@ func (k *SealedKeyObject) PCRPolicyCounterHandle() tpm2.Handle {
 	return k.data.staticPolicyData.pcrPolicyCounterHandle
 }
 
+// PCRPolicyRevocationMode indicates whether PCR policies for this sealed key object can be revoked. Keys sealed without a PCR
+// policy counter return PCRPolicyRevocationNone, in which case every PCR policy that has been created for the key remains usable
+// for the lifetime of the key data file. For key data files that don't record the mode explicitly, it is derived from the PCR
+// policy counter handle.
+func (k *SealedKeyObject) PCRPolicyRevocationMode() PCRPolicyRevocationMode {
+	if k.data.revocationMode != 0 {
+		return k.data.revocationMode
+	}
+	return pcrPolicyRevocationModeForHandle(k.data.staticPolicyData.pcrPolicyCounterHandle)
+}
+
+// IsPCRBound indicates whether the current PCR protection policy for this sealed key object binds it to any PCR values. This
+// returns false for keys created with SealKeyToTPMWithoutPCRBinding or with an empty PCR protection profile, which can be
+// unsealed regardless of the software running on the device.
+func (k *SealedKeyObject) IsPCRBound() bool {
+	for _, s := range k.data.dynamicPolicyData.pcrSelection {
+		if len(s.Select) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Metadata returns the metadata stored in this sealed key object. If no metadata was stored, the zero value is returned. Metadata
+// is only stored in version 3 and later key data files.
+func (k *SealedKeyObject) Metadata() KeyMetadata {
+	if k.data.metadata == nil {
+		return KeyMetadata{}
+	}
+	return *k.data.metadata
+}
+
+// KeyID returns the unique identifier of this sealed key object, and false if none was recorded. Key IDs are only stored in
+// version 3 and later key data files.
+func (k *SealedKeyObject) KeyID() (KeyID, bool) {
+	if k.data.identity == nil {
+		return KeyID{}, false
+	}
+	return k.data.identity.ID, true
+}
+
+// RequiredFeatures returns the set of features that a version of secboot must support in order to use this sealed key object.
+func (k *SealedKeyObject) RequiredFeatures() KeyDataFeatures {
+	return k.data.features()
+}
+
+// PCRPolicyGeneration returns the generation number of the PCR policy for this sealed key object. This is 1 for a newly sealed
+// key and is incremented every time that the PCR policy is updated, so it can be used to determine whether a key has been updated
+// to an expected policy. Zero is returned if no generation number was recorded, which is the case for key data files earlier than
+// version 3.
+func (k *SealedKeyObject) PCRPolicyGeneration() uint64 {
+	if k.data.identity == nil {
+		return 0
+	}
+	return k.data.identity.Generation
+}
+
+// CheckTPMFirmware determines whether the TPM associated with the supplied connection has a different manufacturer or firmware
+// version to the one that was recorded when this key was sealed or its PCR policy was last updated. On some devices, a TPM firmware
+// update clears the TPM or resets its primary seeds, which makes the sealed key permanently unrecoverable. A firmware update may
+// also change the value of PCR 0 on the next boot.
+//
+// If a change is detected, a TPMFirmwareChangedError error will be returned. In this case, the caller should update the PCR
+// protection policy for the key (or re-provision the TPM and reseal the key if the TPM has been cleared) before the next reboot.
+//
+// The TPM firmware version is only recorded for version 3 and later key data files. For earlier versions, this function always
+// returns nil.
+func (k *SealedKeyObject) CheckTPMFirmware(tpm *TPMConnection) error {
+	sealed := k.data.tpmFirmwareInfo
+	if sealed == nil {
+		return nil
+	}
+	current := tpm.firmwareInfo
+	if current.Manufacturer == sealed.Manufacturer && current.FirmwareVersion == sealed.FirmwareVersion {
+		return nil
+	}
+	return TPMFirmwareChangedError{
+		SealedManufacturer:     sealed.Manufacturer,
+		SealedFirmwareVersion:  sealed.FirmwareVersion,
+		CurrentManufacturer:    current.Manufacturer,
+		CurrentFirmwareVersion: current.FirmwareVersion}
+}
+
 // ReadSealedKeyObject loads a sealed key data file created by SealKeyToTPM from the specified path. If the file cannot be opened,
 // a wrapped *os.PathError error is returned. If the key data file cannot be deserialized successfully, a InvalidKeyFileError error
 // will be returned.
 func ReadSealedKeyObject(path string) (*SealedKeyObject, error) {
+	return ReadSealedKeyObjectFromLocation(FileKeyLocation(path))
+}
+
+// ReadSealedKeyObjectFromLocation loads sealed key data created by SealKeyToTPMMultiple from the specified location. If the key
+// data cannot be opened, the error returned from KeyLocation.Open is returned wrapped. If the key data cannot be deserialized
+// successfully, a InvalidKeyFileError error will be returned.
+func ReadSealedKeyObjectFromLocation(location KeyLocation) (*SealedKeyObject, error) {
 	// Open the key data file
-	f, err := os.Open(path)
+	f, err := location.Open()
 	if err != nil {
 		return nil, xerrors.Errorf("cannot open key data file: %w", err)
 	}
@@ -694,8 +1491,48 @@ func ReadSealedKeyObject(path string) (*SealedKeyObject, error) {
 
 	data, err := decodeKeyData(f)
 	if err != nil {
+		var e *KeyDataUnsupportedError
+		if xerrors.As(err, &e) {
+			return nil, e
+		}
 		return nil, InvalidKeyFileError{err.Error()}
 	}
 
-	return &SealedKeyObject{data: data}, nil
+	return &SealedKeyObject{data: data, location: location}, nil
+}
+
+// SetKeyMetadata replaces the metadata stored in the sealed key data file at the specified path. If the CreationTime field of
+// metadata is the zero value, the creation time already recorded in the file is preserved. This doesn't require access to the TPM.
+//
+// If the file cannot be opened, a wrapped *os.PathError error will be returned. If the key data file cannot be deserialized
+// successfully, or if it is a version that doesn't support metadata (earlier than version 3), a InvalidKeyFileError error will be
+// returned.
+func SetKeyMetadata(path string, metadata *KeyMetadata) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return xerrors.Errorf("cannot open key data file: %w", err)
+	}
+	defer f.Close()
+
+	data, err := decodeKeyData(f)
+	if err != nil {
+		return InvalidKeyFileError{err.Error()}
+	}
+	if data.version < 3 {
+		return InvalidKeyFileError{fmt.Sprintf("key data file version %d does not support metadata", data.version)}
+	}
+	if err := metadata.check(); err != nil {
+		return xerrors.Errorf("invalid metadata: %w", err)
+	}
+
+	m := *metadata
+	if m.CreationTime.IsZero() && data.metadata != nil {
+		m.CreationTime = data.metadata.CreationTime
+	}
+	data.metadata = &m
+
+	if err := data.writeToFileAtomic(path); err != nil {
+		return xerrors.Errorf("cannot write key data file: %w", err)
+	}
+	return nil
 }
@@ -0,0 +1,166 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/canonical/tcglog-parser"
+
+	"golang.org/x/xerrors"
+)
+
+// DefaultKeyDataSearchDirs are the directories scanned by FindKeyData and FindKeyDataForDevice when KeyDataSearchOptions.Dirs
+// is nil. These are the conventional locations of sealed key data files on the ESP and the boot partitions of Ubuntu Core
+// systems.
+var DefaultKeyDataSearchDirs = []string{
+	"/run/mnt/ubuntu-boot/device/fde",
+	"/run/mnt/ubuntu-seed/device/fde",
+	"/boot/efi/device/fde",
+}
+
+// KeyDataSearchOptions specifies where FindKeyData and FindKeyDataForDevice look for sealed key data.
+type KeyDataSearchOptions struct {
+	// Dirs are the directories to scan. Every regular file in each directory is checked, and files that don't contain sealed
+	// key data are ignored. Directories that don't exist are ignored. If this is nil, DefaultKeyDataSearchDirs is used.
+	Dirs []string
+
+	// Paths are additional key data files to check.
+	Paths []string
+
+	// Locations are additional locations to check, such as a RawKeyLocation for platforms that store key data outside of a
+	// filesystem.
+	Locations []KeyLocation
+
+	// IncludeUnbound indicates that key data that doesn't have a disk identity (see KeyCreationParams.DiskIdentity) should be
+	// returned as well, as it could belong to any volume.
+	IncludeUnbound bool
+}
+
+// KeyDataCandidate describes sealed key data found by FindKeyData or FindKeyDataForDevice.
+type KeyDataCandidate struct {
+	Location KeyLocation      // Where the key data was found
+	Key      *SealedKeyObject // The decoded key data
+	Metadata KeyMetadata      // The metadata recorded in the key data
+
+	// Bound indicates that the key data has a disk identity that contains the volume. If this is false, the key data has no
+	// disk identity and was only returned because KeyDataSearchOptions.IncludeUnbound was set.
+	Bound bool
+}
+
+func (o *KeyDataSearchOptions) locations() ([]KeyLocation, error) {
+	dirs := o.Dirs
+	if dirs == nil {
+		dirs = DefaultKeyDataSearchDirs
+	}
+
+	var out []KeyLocation
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return nil, xerrors.Errorf("cannot read directory %s: %w", dir, err)
+		}
+		for _, e := range entries {
+			if !e.Mode().IsRegular() {
+				continue
+			}
+			out = append(out, FileKeyLocation(filepath.Join(dir, e.Name())))
+		}
+	}
+	out = append(out, fileKeyLocations(o.Paths)...)
+	out = append(out, o.Locations...)
+	return out, nil
+}
+
+func findKeyData(opts *KeyDataSearchOptions, matches func(identity *DiskIdentity) bool) ([]*KeyDataCandidate, error) {
+	if opts == nil {
+		opts = &KeyDataSearchOptions{}
+	}
+
+	locations, err := opts.locations()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*KeyDataCandidate
+	seen := make(map[string]bool)
+	for _, location := range locations {
+		if seen[location.String()] {
+			continue
+		}
+		seen[location.String()] = true
+
+		k, err := ReadSealedKeyObjectFromLocation(location)
+		if err != nil {
+			// Ignore anything that isn't readable sealed key data - the search directories may contain other files.
+			continue
+		}
+
+		c := &KeyDataCandidate{Location: location, Key: k, Metadata: k.Metadata()}
+		switch identity := k.DiskIdentity(); {
+		case identity == nil && opts.IncludeUnbound:
+		case identity == nil:
+			continue
+		case matches(identity):
+			c.Bound = true
+		default:
+			continue
+		}
+		out = append(out, c)
+	}
+
+	// Return key data that is bound to the volume first.
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Bound && !out[j].Bound
+	})
+	return out, nil
+}
+
+// FindKeyData searches for sealed key data for the volume with the specified unique GPT partition GUID, in the locations
+// described by opts. If opts is nil, the directories in DefaultKeyDataSearchDirs are searched. Key data belongs to a volume if
+// its disk identity (see KeyCreationParams.DiskIdentity) contains the volume's partition GUID. Key data that is bound to the
+// volume is returned first, followed by key data without a disk identity if KeyDataSearchOptions.IncludeUnbound is set. Files
+// and locations that can't be read or don't contain sealed key data are skipped.
+//
+// Key data stored in LUKS2 tokens with LUKS2TokenKeyLocation is not searched.
+func FindKeyData(partitionGUID tcglog.EFIGUID, opts *KeyDataSearchOptions) ([]*KeyDataCandidate, error) {
+	return findKeyData(opts, func(identity *DiskIdentity) bool {
+		return identity.hasPartition(partitionGUID)
+	})
+}
+
+// FindKeyDataForDevice is like FindKeyData, but reads the GPT identity of the partition block device at the specified path, and
+// only considers key data to be bound to it if its disk identity contains both the disk GUID and the partition GUID. This
+// requires read access to the disk that contains the partition.
+func FindKeyDataForDevice(partitionDevicePath string, opts *KeyDataSearchOptions) ([]*KeyDataCandidate, error) {
+	disk, part, err := readPartitionGPTIdentity(partitionDevicePath)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read GPT identity of %s: %w", partitionDevicePath, err)
+	}
+	return findKeyData(opts, func(identity *DiskIdentity) bool {
+		return identity.DiskGUID == disk && identity.hasPartition(part)
+	})
+}
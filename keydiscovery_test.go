@@ -0,0 +1,125 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/snapcore/secboot"
+)
+
+func TestFindKeyData(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestFindKeyData_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	sysClassBlock, dev := makeMockGPTDisk(t, tmpDir, testDiskGUID, testPartitionGUIDs)
+	restore := MockBlockDevicePaths(sysClassBlock, dev)
+	defer restore()
+
+	keyDir := filepath.Join(tmpDir, "fde")
+	if err := os.Mkdir(keyDir, 0700); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+
+	seal := func(name string, partitionPaths ...string) string {
+		var opts []SealKeyOption
+		if len(partitionPaths) > 0 {
+			identity, err := ReadDiskIdentity(partitionPaths...)
+			if err != nil {
+				t.Fatalf("ReadDiskIdentity failed: %v", err)
+			}
+			opts = append(opts, WithDiskIdentity(identity))
+		}
+		path := filepath.Join(keyDir, name)
+		if _, err := SealKeyToTPMWithOptions(tpm, []*SealKeyRequest{{Key: make([]byte, 32), Path: path}}, opts...); err != nil {
+			t.Fatalf("SealKeyToTPMWithOptions failed: %v", err)
+		}
+		return path
+	}
+
+	sda2Key := seal("data.sealed-key", filepath.Join(dev, "sda2"))
+	seal("other.sealed-key", filepath.Join(dev, "sda1"))
+	unboundKey := seal("unbound.sealed-key")
+	if err := ioutil.WriteFile(filepath.Join(keyDir, "README"), []byte("not key data"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	checkPaths := func(t *testing.T, candidates []*KeyDataCandidate, expected ...string) {
+		if len(candidates) != len(expected) {
+			t.Fatalf("Unexpected number of candidates: %d", len(candidates))
+		}
+		for i, c := range candidates {
+			if c.Location.String() != expected[i] {
+				t.Errorf("Unexpected candidate %d: %s", i, c.Location)
+			}
+			if c.Key == nil {
+				t.Errorf("Candidate %d has no key", i)
+			}
+			if c.Bound != (c.Key.DiskIdentity() != nil) {
+				t.Errorf("Candidate %d has an unexpected Bound value", i)
+			}
+		}
+	}
+
+	t.Run("ByPartitionGUID", func(t *testing.T) {
+		candidates, err := FindKeyData(testPartitionGUIDs[1], &KeyDataSearchOptions{Dirs: []string{keyDir, filepath.Join(tmpDir, "missing")}})
+		if err != nil {
+			t.Fatalf("FindKeyData failed: %v", err)
+		}
+		checkPaths(t, candidates, sda2Key)
+	})
+
+	t.Run("IncludeUnbound", func(t *testing.T) {
+		candidates, err := FindKeyData(testPartitionGUIDs[1], &KeyDataSearchOptions{Dirs: []string{keyDir}, IncludeUnbound: true})
+		if err != nil {
+			t.Fatalf("FindKeyData failed: %v", err)
+		}
+		checkPaths(t, candidates, sda2Key, unboundKey)
+	})
+
+	t.Run("ExplicitPaths", func(t *testing.T) {
+		candidates, err := FindKeyData(testPartitionGUIDs[1], &KeyDataSearchOptions{Dirs: []string{}, Paths: []string{unboundKey, sda2Key}})
+		if err != nil {
+			t.Fatalf("FindKeyData failed: %v", err)
+		}
+		checkPaths(t, candidates, sda2Key)
+	})
+
+	t.Run("ForDevice", func(t *testing.T) {
+		candidates, err := FindKeyDataForDevice(filepath.Join(dev, "sda2"), &KeyDataSearchOptions{Dirs: []string{keyDir}})
+		if err != nil {
+			t.Fatalf("FindKeyDataForDevice failed: %v", err)
+		}
+		checkPaths(t, candidates, sda2Key)
+	})
+}
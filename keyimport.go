@@ -0,0 +1,164 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+
+	"golang.org/x/xerrors"
+)
+
+// KeyDataFormatDescriptor describes the layout of key data files written by a derivative of this package that uses the same
+// underlying format with a different header and version numbering, so that they can be imported with ImportKeyData. The sealed
+// key objects and authorization policies in the imported files must be compatible with the equivalent version of this package's
+// format, as they are used unmodified.
+type KeyDataFormatDescriptor struct {
+	// Name is a human readable name for the format, used in error messages.
+	Name string
+
+	// Header is the value that the derivative uses in place of the header at the start of a key data file.
+	Header uint32
+
+	// Versions maps the version numbers used by the derivative to the equivalent version of this package's format. Files with a
+	// version that isn't listed are rejected.
+	Versions map[uint32]uint32
+
+	// Extensions maps the extension types used by the derivative to the equivalent extension type in this package's format,
+	// for files that correspond to version 3 or later. Extensions with a type that isn't listed are discarded. If this is nil,
+	// the extension types are assumed to be the same as this package's.
+	Extensions map[uint32]uint32
+}
+
+// translate reads key data in the format described by this descriptor from r, and returns the equivalent key data in this
+// package's format.
+func (f *KeyDataFormatDescriptor) translate(r io.Reader) ([]byte, error) {
+	var header, version uint32
+	if _, err := mu.UnmarshalFromReader(r, &header, &version); err != nil {
+		return nil, InvalidKeyFileError{fmt.Sprintf("cannot unmarshal header: %v", err)}
+	}
+	if header != f.Header {
+		return nil, InvalidKeyFileError{fmt.Sprintf("unexpected header for %s key data (%d)", f.Name, header)}
+	}
+	nativeVersion, ok := f.Versions[version]
+	if !ok {
+		return nil, InvalidKeyFileError{fmt.Sprintf("unsupported %s key data version (%d)", f.Name, version)}
+	}
+
+	if nativeVersion < 3 || f.Extensions == nil {
+		rest, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read key data: %w", err)
+		}
+		b, err := mu.MarshalToBytes(keyDataHeader, nativeVersion)
+		if err != nil {
+			return nil, err
+		}
+		return append(b, rest...), nil
+	}
+
+	var splitData afSplitDataRaw
+	if _, err := mu.UnmarshalFromReader(r, &splitData); err != nil {
+		return nil, InvalidKeyFileError{fmt.Sprintf("cannot unmarshal split data: %v", err)}
+	}
+	merged, err := splitData.data().merge()
+	if err != nil {
+		return nil, InvalidKeyFileError{fmt.Sprintf("cannot merge data: %v", err)}
+	}
+	var raw keyDataRaw_v3
+	if _, err := mu.UnmarshalFromBytes(merged, &raw); err != nil {
+		return nil, InvalidKeyFileError{fmt.Sprintf("cannot unmarshal data: %v", err)}
+	}
+
+	var extensions []keyDataExtensionRaw
+	for _, e := range raw.Extensions {
+		t, ok := f.Extensions[uint32(e.Type)]
+		if !ok {
+			continue
+		}
+		extensions = append(extensions, keyDataExtensionRaw{Type: keyDataExtensionType(t), Data: e.Data})
+	}
+	raw.Extensions = extensions
+
+	b, err := mu.MarshalToBytes(raw)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot marshal data: %w", err)
+	}
+	split, err := makeAfSplitData(b, 128*1024, tpm2.HashAlgorithmSHA256)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot split data: %w", err)
+	}
+	return mu.MarshalToBytes(keyDataHeader, nativeVersion, makeAfSplitDataRaw(split))
+}
+
+// ImportKeyData reads key data written by a derivative of this package from r, using the supplied descriptor of its format. The
+// returned SealedKeyObject can be used in the same way as one read with ReadSealedKeyObject. If the key data cannot be
+// translated or deserialized successfully, a InvalidKeyFileError error will be returned. If it corresponds to a version of this
+// package's format that isn't supported, a *KeyDataUnsupportedError error will be returned.
+func ImportKeyData(r io.Reader, format *KeyDataFormatDescriptor) (*SealedKeyObject, error) {
+	if format == nil {
+		return nil, errors.New("no format descriptor supplied")
+	}
+
+	b, err := format.translate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := decodeKeyData(bytes.NewReader(b))
+	if err != nil {
+		var e *KeyDataUnsupportedError
+		if xerrors.As(err, &e) {
+			return nil, e
+		}
+		return nil, InvalidKeyFileError{err.Error()}
+	}
+
+	return &SealedKeyObject{data: data}, nil
+}
+
+// ImportKeyDataFile imports the key data file at src written by a derivative of this package using the supplied descriptor of
+// its format (see ImportKeyData), and writes it atomically to dest in this package's format. The version of the written file
+// is the equivalent version of this package's format, which can be upgraded afterwards with UpgradeKeyData. The source file
+// is not modified.
+func ImportKeyDataFile(src, dest string, format *KeyDataFormatDescriptor) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return xerrors.Errorf("cannot open key data file: %w", err)
+	}
+	defer f.Close()
+
+	k, err := ImportKeyData(f, format)
+	if err != nil {
+		return err
+	}
+
+	if err := k.data.writeToFileAtomic(dest); err != nil {
+		return xerrors.Errorf("cannot write key data file: %w", err)
+	}
+	return nil
+}
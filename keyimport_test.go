@@ -0,0 +1,161 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/snapcore/secboot"
+)
+
+func TestImportKeyData(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestImportKeyData_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: 0x01810000,
+		Metadata:               &KeyMetadata{Role: "run", Label: "test"}}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	// Create a file in the format of a fictional derivative that uses a different header and version numbering.
+	native, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	foreign := make([]byte, len(native))
+	copy(foreign, native)
+	binary.BigEndian.PutUint32(foreign[0:], 0x464f524b)
+	binary.BigEndian.PutUint32(foreign[4:], 7)
+
+	format := &KeyDataFormatDescriptor{
+		Name:     "fork",
+		Header:   0x464f524b,
+		Versions: map[uint32]uint32{7: 3}}
+
+	t.Run("Import", func(t *testing.T) {
+		k, err := ImportKeyData(bytes.NewReader(foreign), format)
+		if err != nil {
+			t.Fatalf("ImportKeyData failed: %v", err)
+		}
+		if k.Version() != 3 {
+			t.Errorf("Unexpected version %d", k.Version())
+		}
+		if k.Metadata().Role != "run" || k.Metadata().Label != "test" {
+			t.Errorf("Unexpected metadata: %v", k.Metadata())
+		}
+
+		unsealed, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(unsealed, key) {
+			t.Errorf("Unexpected key")
+		}
+	})
+
+	t.Run("DiscardUnmappedExtensions", func(t *testing.T) {
+		format := *format
+		format.Extensions = map[uint32]uint32{}
+
+		k, err := ImportKeyData(bytes.NewReader(foreign), &format)
+		if err != nil {
+			t.Fatalf("ImportKeyData failed: %v", err)
+		}
+		if k.Metadata().Role != "" {
+			t.Errorf("Metadata should have been discarded: %v", k.Metadata())
+		}
+
+		unsealed, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(unsealed, key) {
+			t.Errorf("Unexpected key")
+		}
+	})
+
+	t.Run("WrongHeader", func(t *testing.T) {
+		_, err := ImportKeyData(bytes.NewReader(native), format)
+		if _, ok := err.(InvalidKeyFileError); !ok {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("UnsupportedVersion", func(t *testing.T) {
+		format := *format
+		format.Versions = map[uint32]uint32{6: 3}
+
+		_, err := ImportKeyData(bytes.NewReader(foreign), &format)
+		if _, ok := err.(InvalidKeyFileError); !ok {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("File", func(t *testing.T) {
+		src := filepath.Join(tmpDir, "keydata.fork")
+		if err := ioutil.WriteFile(src, foreign, 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		dest := filepath.Join(tmpDir, "keydata.imported")
+
+		if err := ImportKeyDataFile(src, dest, format); err != nil {
+			t.Fatalf("ImportKeyDataFile failed: %v", err)
+		}
+
+		k, err := ReadSealedKeyObject(dest)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		if k.Metadata().Label != "test" {
+			t.Errorf("Unexpected metadata: %v", k.Metadata())
+		}
+
+		after, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if !bytes.Equal(after, foreign) {
+			t.Errorf("Source file should not have been modified")
+		}
+	})
+}
@@ -0,0 +1,89 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"io"
+	"os"
+
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/osutil/sys"
+
+	"golang.org/x/xerrors"
+)
+
+// KeyLocation describes where a sealed key data file is stored. This permits key data to be stored somewhere other than in a file on
+// a filesystem, eg, on platforms without a FAT ESP where the key data must be stored in a raw MTD region or partition.
+//
+// FileKeyLocation is the implementation used by the functions in this package that accept a path. LUKS2TokenKeyLocation stores
+// key data in the LUKS2 header of the volume, and RawPartitionKeyLocation stores it in an unformatted partition.
+type KeyLocation interface {
+	// String returns a description of this location, which is used in error messages and recorded in the volume inventory and
+	// in recovery markers.
+	String() string
+
+	// Open opens the key data at this location for reading. If there is no key data at this location, an error for which
+	// os.IsNotExist returns true should be returned.
+	Open() (io.ReadCloser, error)
+
+	// WriteAtomic replaces the key data at this location with the data written to the io.Writer passed to the supplied callback.
+	// The existing key data must only be replaced if the callback returns without an error, and the replacement must be atomic
+	// so that either the old or the new key data can be read back if it is interrupted.
+	WriteAtomic(fn func(w io.Writer) error) error
+}
+
+// FileKeyLocation is a KeyLocation that corresponds to a regular file at the specified path.
+type FileKeyLocation string
+
+func (l FileKeyLocation) String() string {
+	return string(l)
+}
+
+// Open implements KeyLocation.Open.
+func (l FileKeyLocation) Open() (io.ReadCloser, error) {
+	return os.Open(string(l))
+}
+
+// WriteAtomic implements KeyLocation.WriteAtomic.
+func (l FileKeyLocation) WriteAtomic(fn func(w io.Writer) error) error {
+	f, err := osutil.NewAtomicFile(string(l), 0600, 0, sys.UserID(osutil.NoChown), sys.GroupID(osutil.NoChown))
+	if err != nil {
+		return xerrors.Errorf("cannot create new atomic file: %w", err)
+	}
+	defer f.Cancel()
+
+	if err := fn(f); err != nil {
+		return xerrors.Errorf("cannot write to temporary file: %w", err)
+	}
+
+	if err := f.Commit(); err != nil {
+		return xerrors.Errorf("cannot atomically replace file: %w", err)
+	}
+
+	return nil
+}
+
+func fileKeyLocations(paths []string) []KeyLocation {
+	var out []KeyLocation
+	for _, p := range paths {
+		out = append(out, FileKeyLocation(p))
+	}
+	return out
+}
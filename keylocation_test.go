@@ -0,0 +1,123 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+// memoryKeyLocation is a KeyLocation that stores key data in memory.
+type memoryKeyLocation struct {
+	name string
+	data []byte
+}
+
+func (l *memoryKeyLocation) String() string {
+	return "memory:" + l.name
+}
+
+func (l *memoryKeyLocation) Open() (io.ReadCloser, error) {
+	if l.data == nil {
+		return nil, &os.PathError{Op: "open", Path: l.String(), Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(l.data)), nil
+}
+
+func (l *memoryKeyLocation) WriteAtomic(fn func(w io.Writer) error) error {
+	var b bytes.Buffer
+	if err := fn(&b); err != nil {
+		return err
+	}
+	l.data = b.Bytes()
+	return nil
+}
+
+type keyLocationSuite struct {
+	testutil.TPMSimulatorTestBase
+}
+
+var _ = Suite(&keyLocationSuite{})
+
+func (s *keyLocationSuite) SetUpTest(c *C) {
+	s.TPMSimulatorTestBase.SetUpTest(c)
+	c.Assert(s.TPM.EnsureProvisioned(ProvisionModeFull, nil), IsNil)
+	s.ResetTPMSimulator(c)
+}
+
+func (s *keyLocationSuite) TestFileKeyLocation(c *C) {
+	path := filepath.Join(c.MkDir(), "keydata")
+	location := FileKeyLocation(path)
+	c.Check(location.String(), Equals, path)
+
+	_, err := location.Open()
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	c.Check(location.WriteAtomic(func(w io.Writer) error {
+		_, err := w.Write([]byte("foo"))
+		return err
+	}), IsNil)
+
+	r, err := location.Open()
+	c.Assert(err, IsNil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Check(err, IsNil)
+	c.Check(data, DeepEquals, []byte("foo"))
+}
+
+func (s *keyLocationSuite) TestSealAndUnsealAtLocation(c *C) {
+	key := make([]byte, 32)
+	location := &memoryKeyLocation{name: "key"}
+
+	authKey, err := SealKeyToTPMMultiple(s.TPM, []*SealKeyRequest{{Key: key, Location: location}},
+		&KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+	c.Check(location.data, NotNil)
+
+	k, err := ReadSealedKeyObjectFromLocation(location)
+	c.Assert(err, IsNil)
+	unsealedKey, _, err := k.UnsealFromTPM(s.TPM, "")
+	c.Check(err, IsNil)
+	c.Check(unsealedKey, DeepEquals, key)
+
+	orig := location.data
+	c.Check(UpdateKeyPCRProtectionPolicyAtLocations(s.TPM, []KeyLocation{location}, authKey, getTestPCRProfile()), IsNil)
+	c.Check(location.data, Not(DeepEquals), orig)
+
+	c.Check(ChangePINAtLocation(s.TPM, location, "", "1234"), IsNil)
+	k, err = ReadSealedKeyObjectFromLocation(location)
+	c.Assert(err, IsNil)
+	c.Check(k.AuthMode2F(), Equals, AuthModePIN)
+}
+
+func (s *keyLocationSuite) TestReadSealedKeyObjectFromLocationMissing(c *C) {
+	_, err := ReadSealedKeyObjectFromLocation(&memoryKeyLocation{name: "missing"})
+	c.Check(err, ErrorMatches, "cannot open key data file: open memory:missing: file does not exist")
+}
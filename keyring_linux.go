@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+const userKeyring = -4
+
+// addUserKey adds a key with the specified description and payload to the calling user's user keyring.
+func addUserKey(description string, payload []byte) error {
+	_, err := unix.AddKey("user", description, payload, userKeyring)
+	return err
+}
+
+// listUserKeyring returns the IDs of the keys linked to the calling user's user keyring.
+func listUserKeyring() ([]int, error) {
+	sz, err := unix.KeyctlBuffer(unix.KEYCTL_READ, userKeyring, nil, 0)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot determine size of user keyring payload: %w", err)
+	}
+
+	for {
+		payload := make([]byte, sz)
+		n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, userKeyring, payload, 0)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read user keyring payload: %w", err)
+		}
+
+		if n <= sz {
+			payload = payload[:n]
+
+			var ids []int
+			for len(payload) > 0 {
+				ids = append(ids, int(binary.LittleEndian.Uint32(payload)))
+				payload = payload[4:]
+			}
+			return ids, nil
+		}
+
+		sz = n
+	}
+}
+
+// describeKey returns the description of the key with the specified ID.
+func describeKey(id int) (string, error) {
+	return unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+}
+
+// readKeyPayload returns the payload of the key with the specified ID.
+func readKeyPayload(id int) ([]byte, error) {
+	sz, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot determine size of key payload: %w", err)
+	}
+	payload := make([]byte, sz)
+	if _, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, payload, 0); err != nil {
+		return nil, xerrors.Errorf("cannot read key payload: %w", err)
+	}
+	return payload, nil
+}
+
+// wipeKeyPayload overwrites the payload of the key with the specified ID with zeros.
+func wipeKeyPayload(id int) error {
+	sz, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return xerrors.Errorf("cannot determine size of key payload: %w", err)
+	}
+	if _, err := unix.KeyctlBuffer(unix.KEYCTL_UPDATE, id, make([]byte, sz), 0); err != nil {
+		return xerrors.Errorf("cannot overwrite key payload: %w", err)
+	}
+	return nil
+}
+
+// invalidateKey invalidates the key with the specified ID, so that it is removed from every keyring that it is linked to.
+func invalidateKey(id int) error {
+	_, err := unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+	return err
+}
+
+// unlinkUserKey unlinks the key with the specified ID from the calling user's user keyring.
+func unlinkUserKey(id int) error {
+	_, err := unix.KeyctlInt(unix.KEYCTL_UNLINK, id, userKeyring, 0, 0)
+	return err
+}
@@ -0,0 +1,58 @@
+//go:build !linux
+// +build !linux
+
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+)
+
+// errNoKernelKeyring is returned from the kernel keyring functions on platforms other than Linux.
+var errNoKernelKeyring = errors.New("the kernel keyring is only supported on Linux")
+
+func addUserKey(description string, payload []byte) error {
+	return errNoKernelKeyring
+}
+
+func listUserKeyring() ([]int, error) {
+	return nil, errNoKernelKeyring
+}
+
+func describeKey(id int) (string, error) {
+	return "", errNoKernelKeyring
+}
+
+func readKeyPayload(id int) ([]byte, error) {
+	return nil, errNoKernelKeyring
+}
+
+func wipeKeyPayload(id int) error {
+	return errNoKernelKeyring
+}
+
+func invalidateKey(id int) error {
+	return errNoKernelKeyring
+}
+
+func unlinkUserKey(id int) error {
+	return errNoKernelKeyring
+}
@@ -0,0 +1,93 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+
+	"golang.org/x/xerrors"
+)
+
+// minFormatUpgradableVersion is the earliest key data version that can be upgraded to the current version without resealing.
+// Versions 0 and 1 use a different format for the data sealed inside the TPM object, whereas later versions only differ in the
+// on-disk format.
+const minFormatUpgradableVersion = 2
+
+// NeedsUpgrade indicates whether this sealed key object was read from a key data file that is older than the latest version
+// supported by this package. See UpgradeKeyData.
+func (k *SealedKeyObject) NeedsUpgrade() bool {
+	return k.data.version < currentMetadataVersion
+}
+
+// UpgradeKeyData upgrades the related sealed key data files at the specified paths to the latest version supported by this
+// package. Every version of the key data format written by this package can still be read and used without upgrading, but
+// features that require a newer version (such as metadata) are unavailable for older files.
+//
+// If all of the files are version 2 or later, they are rewritten atomically in the latest on-disk format without using the TPM,
+// and the tpm, pin and params arguments are ignored. Upgrading a file in this way doesn't change the sealed key object or its
+// authorization policy, so a partially completed upgrade leaves every file usable.
+//
+// Files older than version 2 can only be upgraded by unsealing each key and sealing it again, which is performed in the same way
+// as RotatePolicyAuthKey, except that the existing key for authorizing PCR policy updates is retained for version 1 files unless
+// the AuthKey field of params is set. This requires a TPM connection, the current PIN, and params containing the PCR protection
+// profile and a new PCR policy counter handle for the new keys. If tpm or params is nil, ErrKeyDataUpgradeRequiresReseal is
+// returned. Version 0 files use a different type of key for authorizing PCR policy updates, so a new one is always created for
+// them. When the keys are resealed, the private part of the key for authorizing PCR policy updates for the new keys is returned,
+// and this must be used for subsequent PCR policy updates.
+//
+// If all of the files are already the latest version, this does nothing.
+func UpgradeKeyData(tpm *TPMConnection, keyPaths []string, pin string, params *KeyCreationParams) (TPMPolicyAuthKey, error) {
+	if len(keyPaths) == 0 {
+		return nil, errors.New("no key files supplied")
+	}
+
+	var datas []*keyData
+	minVersion := currentMetadataVersion
+	for _, p := range keyPaths {
+		k, err := ReadSealedKeyObject(p)
+		if err != nil {
+			return nil, err
+		}
+		datas = append(datas, k.data)
+		if k.data.version < minVersion {
+			minVersion = k.data.version
+		}
+	}
+
+	switch {
+	case minVersion == currentMetadataVersion:
+		return nil, nil
+	case minVersion >= minFormatUpgradableVersion:
+		for i, data := range datas {
+			if data.version == currentMetadataVersion {
+				continue
+			}
+			data.version = currentMetadataVersion
+			if err := data.writeToFileAtomic(keyPaths[i]); err != nil {
+				return nil, xerrors.Errorf("cannot write upgraded key data file %s: %w", keyPaths[i], err)
+			}
+		}
+		return nil, nil
+	case tpm == nil || params == nil:
+		return nil, ErrKeyDataUpgradeRequiresReseal
+	}
+
+	return resealKeyFiles(tpm, keyPaths, pin, nil, params, true)
+}
@@ -0,0 +1,312 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/snapcore/secboot"
+)
+
+func TestKeyDataFormatCompatibility(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestKeyDataFormatCompatibility_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	// Write the key data in the on-disk format of every version that this package has written, and check that each one can
+	// still be read.
+	for v := uint32(0); v <= CurrentMetadataVersion; v++ {
+		path := filepath.Join(tmpDir, fmt.Sprintf("keydata.v%d", v))
+		if err := WriteKeyDataWithVersion(keyFile, path, v); err != nil {
+			t.Fatalf("WriteKeyDataWithVersion(%d) failed: %v", v, err)
+		}
+
+		k, err := ReadSealedKeyObject(path)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed for version %d: %v", v, err)
+		}
+		if k.Version() != v {
+			t.Errorf("Unexpected version %d", k.Version())
+		}
+		if k.NeedsUpgrade() != (v < CurrentMetadataVersion) {
+			t.Errorf("Unexpected NeedsUpgrade result for version %d", v)
+		}
+		if k.PCRPolicyCounterHandle() != 0x01810000 {
+			t.Errorf("Unexpected PCR policy counter handle for version %d: %v", v, k.PCRPolicyCounterHandle())
+		}
+
+		if v < 2 {
+			// The sealed data has a different format in these versions, so the key can't be unsealed.
+			continue
+		}
+		unsealed, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed for version %d: %v", v, err)
+		}
+		if !bytes.Equal(unsealed, key) {
+			t.Errorf("Unexpected key for version %d", v)
+		}
+	}
+}
+
+func TestUpgradeKeyData(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestUpgradeKeyData_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keys := [][]byte{make([]byte, 32), make([]byte, 32)}
+	rand.Read(keys[0])
+	rand.Read(keys[1])
+	keyFiles := []string{filepath.Join(tmpDir, "keydata1"), filepath.Join(tmpDir, "keydata2")}
+
+	if _, err := SealKeyToTPMMultiple(tpm, []*SealKeyRequest{{Key: keys[0], Path: keyFiles[0]}, {Key: keys[1], Path: keyFiles[1]}},
+		&KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPMMultiple failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFiles[0])
+
+	t.Run("Current", func(t *testing.T) {
+		before, err := ioutil.ReadFile(keyFiles[0])
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		authKey, err := UpgradeKeyData(nil, keyFiles[:1], "", nil)
+		if err != nil {
+			t.Fatalf("UpgradeKeyData failed: %v", err)
+		}
+		if authKey != nil {
+			t.Errorf("Unexpected auth key")
+		}
+		after, err := ioutil.ReadFile(keyFiles[0])
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if !bytes.Equal(after, before) {
+			t.Errorf("Key data file should not have been modified")
+		}
+	})
+
+	t.Run("FormatOnly", func(t *testing.T) {
+		// Only downgrade the first file, to check that a set containing files with different versions is handled.
+		if err := WriteKeyDataWithVersion(keyFiles[0], keyFiles[0], 2); err != nil {
+			t.Fatalf("WriteKeyDataWithVersion failed: %v", err)
+		}
+
+		if _, err := UpgradeKeyData(nil, keyFiles, "", nil); err != nil {
+			t.Fatalf("UpgradeKeyData failed: %v", err)
+		}
+
+		for i, path := range keyFiles {
+			k, err := ReadSealedKeyObject(path)
+			if err != nil {
+				t.Fatalf("ReadSealedKeyObject failed: %v", err)
+			}
+			if k.Version() != CurrentMetadataVersion {
+				t.Errorf("Unexpected version %d", k.Version())
+			}
+			unsealed, _, err := k.UnsealFromTPM(tpm, "")
+			if err != nil {
+				t.Fatalf("UnsealFromTPM failed: %v", err)
+			}
+			if !bytes.Equal(unsealed, keys[i]) {
+				t.Errorf("Unexpected key")
+			}
+		}
+	})
+
+	t.Run("RequiresReseal", func(t *testing.T) {
+		path := filepath.Join(tmpDir, "keydata.v1")
+		if err := WriteKeyDataWithVersion(keyFiles[0], path, 1); err != nil {
+			t.Fatalf("WriteKeyDataWithVersion failed: %v", err)
+		}
+
+		if _, err := UpgradeKeyData(nil, []string{path}, "", nil); err != ErrKeyDataUpgradeRequiresReseal {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		k, err := ReadSealedKeyObject(path)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		if k.Version() != 1 {
+			t.Errorf("Key data file should not have been modified")
+		}
+	})
+}
+
+// keyDataFixtures are key data files written in each historical on-disk format, see testdata/README.
+var keyDataFixtures = []struct {
+	path    string
+	version uint32
+}{
+	{path: "testdata/keydata/v0", version: 0},
+	{path: "testdata/keydata/v1", version: 1},
+	{path: "testdata/keydata/v2", version: 2},
+}
+
+func copyKeyDataFixture(t *testing.T, src, dir string) string {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	dst := filepath.Join(dir, filepath.Base(src))
+	if err := ioutil.WriteFile(dst, data, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return dst
+}
+
+func TestReadKeyDataFixtures(t *testing.T) {
+	for _, data := range keyDataFixtures {
+		t.Run(filepath.Base(data.path), func(t *testing.T) {
+			k, err := ReadSealedKeyObject(data.path)
+			if err != nil {
+				t.Fatalf("ReadSealedKeyObject failed: %v", err)
+			}
+			if k.Version() != data.version {
+				t.Errorf("Unexpected version %d", k.Version())
+			}
+			if !k.NeedsUpgrade() {
+				t.Errorf("Key data should need upgrading")
+			}
+			if k.PCRPolicyCounterHandle() != 0x01801000 {
+				t.Errorf("Unexpected PCR policy counter handle: %v", k.PCRPolicyCounterHandle())
+			}
+			if k.AuthMode2F() != AuthModeNone {
+				t.Errorf("Unexpected auth mode: %v", k.AuthMode2F())
+			}
+		})
+	}
+}
+
+func TestUpgradeKeyDataFixtures(t *testing.T) {
+	for _, data := range keyDataFixtures {
+		t.Run(filepath.Base(data.path), func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "_TestUpgradeKeyDataFixtures_")
+			if err != nil {
+				t.Fatalf("Creating temporary directory failed: %v", err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			path := copyKeyDataFixture(t, data.path, tmpDir)
+
+			before, err := ReadSealedKeyObject(path)
+			if err != nil {
+				t.Fatalf("ReadSealedKeyObject failed: %v", err)
+			}
+			origData, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("ReadFile failed: %v", err)
+			}
+
+			_, err = UpgradeKeyData(nil, []string{path}, "", nil)
+			if data.version < 2 {
+				// These versions can only be upgraded by resealing, which is tested with a real TPM in
+				// internal/compattest.
+				if err != ErrKeyDataUpgradeRequiresReseal {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				after, err := ioutil.ReadFile(path)
+				if err != nil {
+					t.Fatalf("ReadFile failed: %v", err)
+				}
+				if !bytes.Equal(after, origData) {
+					t.Errorf("Key data file should not have been modified")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("UpgradeKeyData failed: %v", err)
+			}
+
+			after, err := ReadSealedKeyObject(path)
+			if err != nil {
+				t.Fatalf("ReadSealedKeyObject failed: %v", err)
+			}
+			if after.Version() != CurrentMetadataVersion {
+				t.Errorf("Unexpected version %d", after.Version())
+			}
+			if after.NeedsUpgrade() {
+				t.Errorf("Key data shouldn't need upgrading")
+			}
+			if after.PCRPolicyCounterHandle() != before.PCRPolicyCounterHandle() {
+				t.Errorf("Unexpected PCR policy counter handle: %v", after.PCRPolicyCounterHandle())
+			}
+			if !bytes.Equal(after.AuthorizedPCRPolicy(), before.AuthorizedPCRPolicy()) {
+				t.Errorf("Authorized PCR policy should not have changed")
+			}
+		})
+	}
+
+	t.Run("Mixed", func(t *testing.T) {
+		// A set containing a file that requires resealing should not be partially upgraded.
+		tmpDir, err := ioutil.TempDir("", "_TestUpgradeKeyDataFixtures_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		paths := []string{copyKeyDataFixture(t, "testdata/keydata/v2", tmpDir), copyKeyDataFixture(t, "testdata/keydata/v1", tmpDir)}
+
+		if _, err := UpgradeKeyData(nil, paths, "", nil); err != ErrKeyDataUpgradeRequiresReseal {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		k, err := ReadSealedKeyObject(paths[0])
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		if k.Version() != 2 {
+			t.Errorf("Key data file should not have been modified")
+		}
+	})
+}
@@ -0,0 +1,293 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// pcrPolicyLockNVIndexSize is the size of the data stored in the PCR policy lock NV index: the TPM's reset count, the
+	// SHA-256 digest of the kernel's boot ID and a bitmap of the blocked PCRs.
+	pcrPolicyLockNVIndexSize = 4 + sha256.Size + 4
+
+	// pcrPolicyLockNVIndexAttrs are the attributes of the PCR policy lock NV index. The index is read locked once the lock
+	// state has been written, and TPMA_NV_READ_STCLEAR means that the read lock is removed by the same events that remove the
+	// PCR fence - TPM2_Startup(TPM_SU_CLEAR) after a TPM reset or restart - but not by a resume from suspend.
+	pcrPolicyLockNVIndexAttrs = tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA |
+		tpm2.AttrNVReadStClear)
+)
+
+var bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// pcrPolicyLockState records that PCR protection policies were blocked by LockPCRProtectionPolicies. It is stored in the PCR
+// policy lock NV index along with the TPM's reset count and the kernel's boot ID at the time.
+type pcrPolicyLockState struct {
+	PCRs       []int
+	ResetCount uint32
+	BootID     []byte
+}
+
+func readBootIDDigest() ([]byte, error) {
+	id, err := ioutil.ReadFile(bootIDPath)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(bytes.TrimSpace(id))
+	return h[:], nil
+}
+
+func (s *pcrPolicyLockState) marshal() ([]byte, error) {
+	var pcrs uint32
+	for _, pcr := range s.PCRs {
+		if pcr < 0 || pcr > 31 {
+			return nil, fmt.Errorf("invalid PCR %d", pcr)
+		}
+		pcrs |= 1 << uint(pcr)
+	}
+	if len(s.BootID) != sha256.Size {
+		return nil, errors.New("invalid boot ID digest")
+	}
+
+	b := make([]byte, pcrPolicyLockNVIndexSize)
+	binary.BigEndian.PutUint32(b, s.ResetCount)
+	copy(b[4:], s.BootID)
+	binary.BigEndian.PutUint32(b[4+sha256.Size:], pcrs)
+	return b, nil
+}
+
+func unmarshalPCRPolicyLockState(b []byte) (*pcrPolicyLockState, error) {
+	if len(b) != pcrPolicyLockNVIndexSize {
+		return nil, errors.New("invalid size")
+	}
+	state := &pcrPolicyLockState{
+		ResetCount: binary.BigEndian.Uint32(b),
+		BootID:     b[4 : 4+sha256.Size]}
+	pcrs := binary.BigEndian.Uint32(b[4+sha256.Size:])
+	for i := 0; i < 32; i++ {
+		if pcrs&(1<<uint(i)) != 0 {
+			state.PCRs = append(state.PCRs, i)
+		}
+	}
+	return state, nil
+}
+
+// readPCRPolicyLockNVIndex returns the PCR policy lock NV index and its public area, or a nil context if it isn't defined.
+func readPCRPolicyLockNVIndex(tpm *TPMConnection) (tpm2.ResourceContext, *tpm2.NVPublic, error) {
+	session := tpm.currentHmacSession()
+
+	index, err := tpm.CreateResourceContextFromTPM(pcrPolicyLockNVHandle, session.IncludeAttrs(tpm2.AttrAudit))
+	switch {
+	case tpm2.IsResourceUnavailableError(err, pcrPolicyLockNVHandle):
+		return nil, nil, nil
+	case err != nil:
+		return nil, nil, xerrors.Errorf("cannot create context: %w", err)
+	}
+
+	pub, _, err := tpm.NVReadPublic(index, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot read public area: %w", err)
+	}
+	if pub.Attrs&^(tpm2.AttrNVWritten|tpm2.AttrNVReadLocked) != pcrPolicyLockNVIndexAttrs || pub.Size != pcrPolicyLockNVIndexSize {
+		return nil, nil, fmt.Errorf("unexpected NV index at handle %v", pcrPolicyLockNVHandle)
+	}
+	return index, pub, nil
+}
+
+// ensurePCRPolicyLockNVIndex returns the PCR policy lock NV index, defining it first if necessary. Defining the index requires
+// knowledge of the authorization value for the storage hierarchy.
+func ensurePCRPolicyLockNVIndex(tpm *TPMConnection) (tpm2.ResourceContext, error) {
+	index, _, err := readPCRPolicyLockNVIndex(tpm)
+	switch {
+	case err != nil:
+		return nil, err
+	case index != nil:
+		return index, nil
+	}
+
+	public := tpm2.NVPublic{
+		Index:   pcrPolicyLockNVHandle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   pcrPolicyLockNVIndexAttrs,
+		Size:    pcrPolicyLockNVIndexSize}
+	if err := tpm.CheckNVSpace(&NVSpaceRequirements{Indices: []*tpm2.NVPublic{&public}}); err != nil {
+		return nil, err
+	}
+	if err := tpm.runWithHierarchyAuth(func() error {
+		var err error
+		index, err = tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &public, tpm.currentHmacSession())
+		switch {
+		case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+			return AuthFailError{tpm2.HandleOwner}
+		case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+			return TPMResourceExistsError{pcrPolicyLockNVHandle}
+		}
+		return err
+	}); err != nil {
+		return nil, xerrors.Errorf("cannot define NV index: %w", err)
+	}
+	return index, nil
+}
+
+// blockPCRProtectionPoliciesAndRecord blocks PCR protection policies for the specified PCRs and records the lock state in the PCR
+// policy lock NV index, which is then read locked.
+func blockPCRProtectionPoliciesAndRecord(tpm *TPMConnection, pcrs []int) error {
+	bootID, err := readBootIDDigest()
+	if err != nil {
+		return xerrors.Errorf("cannot read boot ID: %w", err)
+	}
+
+	index, err := ensurePCRPolicyLockNVIndex(tpm)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain PCR policy lock NV index: %w", err)
+	}
+
+	if err := BlockPCRProtectionPolicies(tpm, pcrs); err != nil {
+		return err
+	}
+
+	info, err := tpm.ReadClock()
+	if err != nil {
+		return xerrors.Errorf("cannot read TPM clock: %w", err)
+	}
+
+	data, err := (&pcrPolicyLockState{PCRs: pcrs, ResetCount: info.ClockInfo.ResetCount, BootID: bootID}).marshal()
+	if err != nil {
+		return xerrors.Errorf("cannot encode lock state: %w", err)
+	}
+
+	session := tpm.currentHmacSession()
+	if err := tpm.NVWrite(index, index, data, 0, session); err != nil {
+		return xerrors.Errorf("cannot record lock state: %w", err)
+	}
+	if err := tpm.NVReadLock(index, index, session); err != nil {
+		return xerrors.Errorf("cannot set read lock on PCR policy lock NV index: %w", err)
+	}
+	return nil
+}
+
+// checkPCRPolicyLock returns ErrPCRProtectionPoliciesLockLost if PCR protection policies were locked with
+// LockPCRProtectionPolicies during the current boot and the fence has been removed since. It returns the recorded lock state if
+// the lock was armed during the current boot, or nil if it wasn't.
+//
+// The lock state is kept in the PCR policy lock NV index rather than on a filesystem. If the index is read locked, the lock was
+// armed since the last TPM2_Startup(TPM_SU_CLEAR) and the fence is still in place. If it isn't read locked but contains state for
+// the current boot, the TPM has been restarted or reset since the lock was armed, for example, because the system resumed from
+// hibernation. A resume from suspend-to-RAM increments the TPM's restart count but preserves the PCR values, so the restart count
+// is deliberately not used.
+func checkPCRPolicyLock(tpm *TPMConnection) (*pcrPolicyLockState, error) {
+	index, pub, err := readPCRPolicyLockNVIndex(tpm)
+	switch {
+	case err != nil:
+		return nil, xerrors.Errorf("cannot read PCR policy lock NV index: %w", err)
+	case index == nil || pub.Attrs&tpm2.AttrNVWritten == 0:
+		// The lock has never been armed.
+		return nil, nil
+	case pub.Attrs&tpm2.AttrNVReadLocked != 0:
+		// The state can't be read, but this means that the lock was armed during this boot and the fence is still in place.
+		return &pcrPolicyLockState{}, nil
+	}
+
+	data, err := tpm.NVRead(index, index, pcrPolicyLockNVIndexSize, 0, tpm.currentHmacSession())
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read lock state: %w", err)
+	}
+	state, err := unmarshalPCRPolicyLockState(data)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode lock state: %w", err)
+	}
+
+	bootID, err := readBootIDDigest()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read boot ID: %w", err)
+	}
+	if !bytes.Equal(state.BootID, bootID) {
+		// The lock was armed during a previous boot.
+		return nil, nil
+	}
+
+	// The lock was armed during this boot, but the read lock has been removed.
+	return state, ErrPCRProtectionPoliciesLockLost
+}
+
+// LockPCRProtectionPolicies behaves the same as BlockPCRProtectionPolicies, but also records in a NV index that PCR protection
+// policies have been blocked, and then read locks the index until the next TPM2_Startup(TPM_SU_CLEAR). This is used to detect when
+// the fence has been removed by a TPM restart or reset whilst the OS is running, as happens when the system hibernates
+// (suspend-to-disk) and resumes. The lock survives a resume from suspend-to-RAM, as does the fence.
+//
+// The NV index is defined at handle 0x01801102 by the first call to this function, which requires knowledge of the authorization
+// value for the storage hierarchy. If the provided authorization value is incorrect and a callback has been set with
+// TPMConnection.SetHierarchyAuthFunc, a new value is requested from it. Otherwise, a AuthFailError error will be returned.
+//
+// Once this has been called, SealedKeyObject.UnsealFromTPM and ActivateVolumeWithTPMSealedKey will refuse to unseal keys with a
+// ErrPCRProtectionPoliciesLockLost error if the TPM has been restarted or reset since, because the OS believes that access to
+// sealed keys is locked but the PCR values may have returned to values that satisfy the PCR policies of those keys. The lock can
+// be checked with VerifyPCRProtectionPoliciesLock and re-armed after resume with RearmPCRProtectionPoliciesLock.
+func LockPCRProtectionPolicies(tpm *TPMConnection, pcrs []int) error {
+	return blockPCRProtectionPoliciesAndRecord(tpm, pcrs)
+}
+
+// VerifyPCRProtectionPoliciesLock checks that PCR protection policies are still blocked after a previous call to
+// LockPCRProtectionPolicies. If LockPCRProtectionPolicies hasn't been called, a ErrPCRProtectionPoliciesNotLocked error is
+// returned. If the TPM has been restarted or reset since LockPCRProtectionPolicies was called, for example, because the system
+// resumed from hibernation, a ErrPCRProtectionPoliciesLockLost error is returned.
+func VerifyPCRProtectionPoliciesLock(tpm *TPMConnection) error {
+	state, err := checkPCRPolicyLock(tpm)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return ErrPCRProtectionPoliciesNotLocked
+	}
+	return nil
+}
+
+// RearmPCRProtectionPoliciesLock re-blocks PCR protection policies for the PCRs that were passed to a previous call to
+// LockPCRProtectionPolicies if the TPM has been restarted or reset since, and records the new lock state. This should be called
+// by the OS as early as possible after resuming from hibernation. It returns true if the lock had been lost and was re-armed, or
+// false if it was still in place.
+//
+// If LockPCRProtectionPolicies hasn't been called, a ErrPCRProtectionPoliciesNotLocked error is returned.
+func RearmPCRProtectionPoliciesLock(tpm *TPMConnection) (bool, error) {
+	state, err := checkPCRPolicyLock(tpm)
+	switch {
+	case err == ErrPCRProtectionPoliciesLockLost:
+	case err != nil:
+		return false, err
+	case state == nil:
+		return false, ErrPCRProtectionPoliciesNotLocked
+	default:
+		return false, nil
+	}
+
+	if err := blockPCRProtectionPoliciesAndRecord(tpm, state.PCRs); err != nil {
+		return false, xerrors.Errorf("cannot re-arm lock: %w", err)
+	}
+	return true, nil
+}
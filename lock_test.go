@@ -0,0 +1,209 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+// mockBootIDForTesting mocks the kernel's boot ID, and returns a function to change it (to simulate a reboot) and a function to
+// restore it.
+func mockBootIDForTesting(t *testing.T) (setBootID func(string), restore func()) {
+	dir, err := ioutil.TempDir("", "_TestPCRProtectionPoliciesLock_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	path := filepath.Join(dir, "boot_id")
+	setBootID = func(id string) {
+		if err := ioutil.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	setBootID("1b0f4d87-bd7a-4e1e-a48f-6dfa2a8e4c1a")
+	restoreBootID := MockBootIDPath(path)
+	return setBootID, func() {
+		restoreBootID()
+		os.RemoveAll(dir)
+	}
+}
+
+func undefinePCRPolicyLockNVIndex(t *testing.T, tpm *TPMConnection) {
+	index, err := tpm.CreateResourceContextFromTPM(PCRPolicyLockNVHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, PCRPolicyLockNVHandle):
+		return
+	case err != nil:
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, nil); err != nil {
+		t.Errorf("NVUndefineSpace failed: %v", err)
+	}
+}
+
+func TestVerifyPCRProtectionPoliciesLockNotLocked(t *testing.T) {
+	_, restore := mockBootIDForTesting(t)
+	defer restore()
+
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+	undefinePCRPolicyLockNVIndex(t, tpm)
+
+	if err := VerifyPCRProtectionPoliciesLock(tpm); err != ErrPCRProtectionPoliciesNotLocked {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := RearmPCRProtectionPoliciesLock(tpm); err != ErrPCRProtectionPoliciesNotLocked {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestLockPCRProtectionPolicies(t *testing.T) {
+	_, restore := mockBootIDForTesting(t)
+	defer restore()
+
+	tpm, tcti := openTPMSimulatorForTesting(t)
+	defer func() {
+		tpm, _ = resetTPMSimulator(t, tpm, tcti)
+		undefinePCRPolicyLockNVIndex(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	if err := LockPCRProtectionPolicies(tpm, []int{7}); err != nil {
+		t.Fatalf("LockPCRProtectionPolicies failed: %v", err)
+	}
+	if err := VerifyPCRProtectionPoliciesLock(tpm); err != nil {
+		t.Errorf("VerifyPCRProtectionPoliciesLock failed: %v", err)
+	}
+	rearmed, err := RearmPCRProtectionPoliciesLock(tpm)
+	if err != nil {
+		t.Errorf("RearmPCRProtectionPoliciesLock failed: %v", err)
+	}
+	if rearmed {
+		t.Errorf("RearmPCRProtectionPoliciesLock should not have re-armed the lock")
+	}
+}
+
+func TestPCRProtectionPoliciesLockLostAfterTPMReset(t *testing.T) {
+	_, restore := mockBootIDForTesting(t)
+	defer restore()
+
+	tpm, tcti := openTPMSimulatorForTesting(t)
+	defer func() {
+		tpm, _ = resetTPMSimulator(t, tpm, tcti)
+		undefinePCRPolicyLockNVIndex(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("EnsureProvisioned failed: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestPCRProtectionPoliciesLockLostAfterTPMReset_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	keyFile := tmpDir + "/keydata"
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x0181fff0}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer func() { undefineKeyNVSpace(t, tpm, keyFile) }()
+
+	if err := LockPCRProtectionPolicies(tpm, []int{7}); err != nil {
+		t.Fatalf("LockPCRProtectionPolicies failed: %v", err)
+	}
+
+	// Simulate the TPM being reset whilst the OS believes that access to sealed keys is locked, which removes the fence.
+	tpm, tcti = resetTPMSimulator(t, tpm, tcti)
+
+	if err := VerifyPCRProtectionPoliciesLock(tpm); err != ErrPCRProtectionPoliciesLockLost {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if _, _, err := k.UnsealFromTPM(tpm, ""); err != ErrPCRProtectionPoliciesLockLost {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	rearmed, err := RearmPCRProtectionPoliciesLock(tpm)
+	if err != nil {
+		t.Fatalf("RearmPCRProtectionPoliciesLock failed: %v", err)
+	}
+	if !rearmed {
+		t.Errorf("RearmPCRProtectionPoliciesLock should have re-armed the lock")
+	}
+	if err := VerifyPCRProtectionPoliciesLock(tpm); err != nil {
+		t.Errorf("VerifyPCRProtectionPoliciesLock failed: %v", err)
+	}
+
+	// The fence is back in place, so unsealing fails because the PCR policy can't be satisfied.
+	if _, _, err := k.UnsealFromTPM(tpm, ""); err == nil {
+		t.Errorf("UnsealFromTPM should have failed")
+	} else if _, ok := err.(InvalidKeyFileError); !ok {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestPCRProtectionPoliciesLockFromPreviousBoot(t *testing.T) {
+	setBootID, restore := mockBootIDForTesting(t)
+	defer restore()
+
+	tpm, tcti := openTPMSimulatorForTesting(t)
+	defer func() {
+		tpm, _ = resetTPMSimulator(t, tpm, tcti)
+		undefinePCRPolicyLockNVIndex(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	if err := LockPCRProtectionPolicies(tpm, []int{7}); err != nil {
+		t.Fatalf("LockPCRProtectionPolicies failed: %v", err)
+	}
+
+	// Simulate a reboot. The lock state recorded in the NV index belongs to the previous boot, so the lock isn't armed.
+	tpm, tcti = resetTPMSimulator(t, tpm, tcti)
+	setBootID("9a4c2e0b-5f3d-4a57-8e8e-0c6f7d1d2b3e")
+
+	if err := VerifyPCRProtectionPoliciesLock(tpm); err != ErrPCRProtectionPoliciesNotLocked {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := RearmPCRProtectionPoliciesLock(tpm); err != ErrPCRProtectionPoliciesNotLocked {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if err := LockPCRProtectionPolicies(tpm, []int{7}); err != nil {
+		t.Fatalf("LockPCRProtectionPolicies failed: %v", err)
+	}
+	if err := VerifyPCRProtectionPoliciesLock(tpm); err != nil {
+		t.Errorf("VerifyPCRProtectionPoliciesLock failed: %v", err)
+	}
+}
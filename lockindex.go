@@ -0,0 +1,112 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	errLegacyLockNVIndexUnavailable = errors.New("lock NV index is unavailable")
+	errLegacyLockNVIndexBadAttrs    = errors.New("lock NV index has unexpected attributes")
+)
+
+// LegacyLockNVIndexStatus describes the state of the global lock NV index that is required by key data files with v0 metadata.
+type LegacyLockNVIndexStatus int
+
+const (
+	// LegacyLockNVIndexOK indicates that the lock NV index exists and appears to have been created by this package.
+	LegacyLockNVIndexOK LegacyLockNVIndexStatus = iota
+
+	// LegacyLockNVIndexMissing indicates that the lock NV index does not exist, eg, because the TPM has been cleared.
+	LegacyLockNVIndexMissing
+
+	// LegacyLockNVIndexInvalid indicates that an NV index exists at the lock NV index handle, but it was not created by this
+	// package.
+	LegacyLockNVIndexInvalid
+)
+
+func (s LegacyLockNVIndexStatus) String() string {
+	switch s {
+	case LegacyLockNVIndexOK:
+		return "ok"
+	case LegacyLockNVIndexMissing:
+		return "missing"
+	case LegacyLockNVIndexInvalid:
+		return "invalid"
+	default:
+		return "unknown"
+	}
+}
+
+// readLegacyLockNVIndexName reads the public area of the lock NV index that is required by key data files with v0 metadata,
+// checks that it looks like it was created by this package and returns its name.
+func readLegacyLockNVIndexName(tpm *tpm2.TPMContext, session tpm2.SessionContext) (tpm2.Name, error) {
+	index, err := tpm.CreateResourceContextFromTPM(lockNVHandle, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		if tpm2.IsResourceUnavailableError(err, lockNVHandle) {
+			return nil, keyFileError{errLegacyLockNVIndexUnavailable}
+		}
+		return nil, xerrors.Errorf("cannot create context for lock NV index: %w", err)
+	}
+	indexPub, _, err := tpm.NVReadPublic(index, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read public area of lock NV index: %w", err)
+	}
+	indexPub.Attrs &^= tpm2.AttrNVReadLocked
+	// The lock index was initialized when it was created, using an authorization policy that could only be satisfied before
+	// it was written. Make sure that it has the expected attributes and has been written, else it may have been created by
+	// someone else.
+	if indexPub.Attrs&^tpm2.AttrNVWritten != lockNVIndex1Attrs || indexPub.Attrs&tpm2.AttrNVWritten == 0 {
+		return nil, keyFileError{errLegacyLockNVIndexBadAttrs}
+	}
+	name, err := indexPub.Name()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute name of lock NV index: %w", err)
+	}
+	return name, nil
+}
+
+// CheckLegacyLockNVIndex reports the state of the global lock NV index that is required in order to unseal keys from key data
+// files with v0 metadata. Key data files with newer metadata versions do not depend on this index.
+//
+// If the index is missing or invalid, it is not possible to recreate it in a way that makes existing v0 key data files usable
+// again. The index was initialized with an authorization policy that could only be satisfied by the code that created it, so an
+// index with the same name cannot be created again, and the authorization policy of each v0 sealed key object is bound to the
+// name of the original index and cannot be changed without unsealing the key. In this case, the affected volumes must be
+// activated with their recovery keys (eg, with ActivateVolumeWithRecoveryKey), and new keys must be sealed with SealKeyToTPM or
+// SealKeyToTPMMultiple, which do not require the lock NV index. This function permits an installer or recovery tool to detect
+// this condition and guide the user through recovery before the next boot, rather than only discovering it when unsealing fails.
+func CheckLegacyLockNVIndex(tpm *TPMConnection) (LegacyLockNVIndexStatus, error) {
+	_, err := readLegacyLockNVIndexName(tpm.TPMContext, tpm.currentHmacSession())
+	switch {
+	case xerrors.Is(err, errLegacyLockNVIndexUnavailable):
+		return LegacyLockNVIndexMissing, nil
+	case xerrors.Is(err, errLegacyLockNVIndexBadAttrs):
+		return LegacyLockNVIndexInvalid, nil
+	case err != nil:
+		return LegacyLockNVIndexInvalid, err
+	}
+	return LegacyLockNVIndexOK, nil
+}
@@ -0,0 +1,89 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type lockIndexSuite struct {
+	testutil.TPMSimulatorTestBase
+}
+
+var _ = Suite(&lockIndexSuite{})
+
+func (s *lockIndexSuite) TestCheckLegacyLockNVIndexMissing(c *C) {
+	status, err := CheckLegacyLockNVIndex(s.TPM)
+	c.Check(err, IsNil)
+	c.Check(status, Equals, LegacyLockNVIndexMissing)
+}
+
+func (s *lockIndexSuite) TestCheckLegacyLockNVIndexOK(c *C) {
+	trial, err := tpm2.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+	trial.PolicyCommandCode(tpm2.CommandNVWrite)
+	trial.PolicyNvWritten(false)
+
+	public := tpm2.NVPublic{
+		Index:      LockNVHandle,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		Attrs:      LockNVIndex1Attrs,
+		AuthPolicy: trial.GetDigest(),
+		Size:       0}
+	index, err := s.TPM.NVDefineSpace(s.TPM.OwnerHandleContext(), nil, &public, nil)
+	c.Assert(err, IsNil)
+	s.AddCleanupNVSpace(c, s.TPM.OwnerHandleContext(), index)
+
+	// Check that an index which hasn't been written is rejected.
+	status, err := CheckLegacyLockNVIndex(s.TPM)
+	c.Check(err, IsNil)
+	c.Check(status, Equals, LegacyLockNVIndexInvalid)
+
+	policySession, err := s.TPM.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+	defer s.TPM.FlushContext(policySession)
+	c.Assert(s.TPM.PolicyCommandCode(policySession, tpm2.CommandNVWrite), IsNil)
+	c.Assert(s.TPM.PolicyNvWritten(policySession, false), IsNil)
+	c.Assert(s.TPM.NVWrite(index, index, nil, 0, policySession), IsNil)
+
+	status, err = CheckLegacyLockNVIndex(s.TPM)
+	c.Check(err, IsNil)
+	c.Check(status, Equals, LegacyLockNVIndexOK)
+}
+
+func (s *lockIndexSuite) TestCheckLegacyLockNVIndexInvalid(c *C) {
+	public := tpm2.NVPublic{
+		Index:   LockNVHandle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8}
+	index, err := s.TPM.NVDefineSpace(s.TPM.OwnerHandleContext(), nil, &public, nil)
+	c.Assert(err, IsNil)
+	s.AddCleanupNVSpace(c, s.TPM.OwnerHandleContext(), index)
+	c.Assert(s.TPM.NVWrite(index, index, make([]byte, 8), 0, nil), IsNil)
+
+	status, err := CheckLegacyLockNVIndex(s.TPM)
+	c.Check(err, IsNil)
+	c.Check(status, Equals, LegacyLockNVIndexInvalid)
+}
@@ -0,0 +1,211 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+
+	"golang.org/x/xerrors"
+)
+
+// lockoutAuthWrappingKeyLabel is used to derive the key used to wrap the lockout hierarchy authorization value from the secret that
+// it is wrapped with, so that the secret is never used directly as an encryption key.
+var lockoutAuthWrappingKeyLabel = []byte("LOCKOUT-AUTH-WRAPPING-KEY")
+
+// lockoutAuthWrapType indicates the secret that a copy of the lockout hierarchy authorization value is wrapped with.
+type lockoutAuthWrapType uint8
+
+const (
+	// lockoutAuthWrapSealedKey indicates a copy wrapped with the key sealed inside the key data file.
+	lockoutAuthWrapSealedKey lockoutAuthWrapType = iota + 1
+
+	// lockoutAuthWrapRecoveryKey indicates a copy wrapped with the fallback recovery key.
+	lockoutAuthWrapRecoveryKey
+)
+
+// wrappedLockoutAuth is a copy of the lockout hierarchy authorization value, encrypted with AES-256-GCM using a key derived from
+// the secret indicated by Type. It is stored in the keyDataExtensionLockoutAuth extension of version 3 and later key data files.
+type wrappedLockoutAuth struct {
+	Type       lockoutAuthWrapType
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// newLockoutAuthAEAD creates an AES-256-GCM instance with a key derived from the supplied secret.
+func newLockoutAuthAEAD(secret []byte) (cipher.AEAD, error) {
+	h := hmac.New(sha256.New, secret)
+	h.Write(lockoutAuthWrappingKeyLabel)
+	key := h.Sum(nil)
+	defer wipeBytes(key)
+
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create cipher: %w", err)
+	}
+	return cipher.NewGCM(b)
+}
+
+// wrapLockoutAuth encrypts the supplied lockout hierarchy authorization value with a key derived from secret.
+func wrapLockoutAuth(t lockoutAuthWrapType, secret, auth []byte) (*wrappedLockoutAuth, error) {
+	aead, err := newLockoutAuthAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, xerrors.Errorf("cannot obtain nonce: %w", err)
+	}
+
+	return &wrappedLockoutAuth{
+		Type:       t,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, auth, []byte{byte(t)})}, nil
+}
+
+// unwrap decrypts this copy of the lockout hierarchy authorization value with a key derived from secret.
+func (w *wrappedLockoutAuth) unwrap(secret []byte) ([]byte, error) {
+	aead, err := newLockoutAuthAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(w.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce length (%d)", len(w.Nonce))
+	}
+	return aead.Open(nil, w.Nonce, w.Ciphertext, []byte{byte(w.Type)})
+}
+
+// LockoutAuthParams specifies how the authorization value for the TPM's lockout hierarchy should be stored in newly created key data
+// files, so that it can be recovered in the field in order to reset the TPM's dictionary attack counter without having to manage
+// it separately.
+type LockoutAuthParams struct {
+	// Auth is the current authorization value for the lockout hierarchy, as set by TPMConnection.EnsureProvisioned.
+	Auth []byte
+
+	// RecoveryKey is an optional fallback recovery key with which to store an additional copy of Auth, so that it can be recovered
+	// with SealedKeyObject.LockoutAuthWithRecoveryKey if the sealed key can no longer be unsealed.
+	RecoveryKey *RecoveryKey
+}
+
+// wrapForKey creates the copies of the lockout hierarchy authorization value to store in the key data file for the
+// supplied key.
+func (p *LockoutAuthParams) wrapForKey(key []byte) ([]wrappedLockoutAuth, error) {
+	if p == nil {
+		return nil, nil
+	}
+
+	w, err := wrapLockoutAuth(lockoutAuthWrapSealedKey, key, p.Auth)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot wrap with sealed key: %w", err)
+	}
+	out := []wrappedLockoutAuth{*w}
+
+	if p.RecoveryKey != nil {
+		w, err := wrapLockoutAuth(lockoutAuthWrapRecoveryKey, p.RecoveryKey[:], p.Auth)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot wrap with recovery key: %w", err)
+		}
+		out = append(out, *w)
+	}
+
+	return out, nil
+}
+
+// HasLockoutAuth indicates whether this sealed key object contains a copy of the lockout hierarchy authorization value. This is
+// only stored in version 3 and later key data files when the key was sealed with LockoutAuthParams.
+func (k *SealedKeyObject) HasLockoutAuth() bool {
+	return len(k.data.lockoutAuth) > 0
+}
+
+func (k *SealedKeyObject) unwrapLockoutAuth(t lockoutAuthWrapType, secret []byte) ([]byte, error) {
+	for _, w := range k.data.lockoutAuth {
+		if w.Type != t {
+			continue
+		}
+		auth, err := w.unwrap(secret)
+		if err != nil {
+			return nil, ErrLockoutAuthUnwrap
+		}
+		return auth, nil
+	}
+	return nil, ErrNoLockoutAuth
+}
+
+// RewrapLockoutAuth replaces the copies of the lockout hierarchy authorization value stored in this sealed key object with ones
+// created from params, and writes the updated key data to the specified location. This should be used after the lockout hierarchy
+// authorization value is changed, eg, by TPMConnection.EnsureProvisioned, so that the stored copies don't become stale. If params
+// is nil, the stored copies are removed.
+//
+// The key argument must be the key returned from SealedKeyObject.UnsealFromTPM, as the new copies are wrapped with it. If this
+// sealed key object already contains a copy that is wrapped with the sealed key, the supplied key is checked against it and a
+// ErrLockoutAuthUnwrap error is returned if it is incorrect.
+//
+// Copies of the lockout hierarchy authorization value can only be stored in version 3 and later key data files.
+func (k *SealedKeyObject) RewrapLockoutAuth(location KeyLocation, key []byte, params *LockoutAuthParams) error {
+	if k.data.version < 3 {
+		return fmt.Errorf("cannot store the lockout hierarchy authorization value in a version %d key data file", k.data.version)
+	}
+
+	switch auth, err := k.unwrapLockoutAuth(lockoutAuthWrapSealedKey, key); {
+	case err == nil:
+		wipeBytes(auth)
+	case err != ErrNoLockoutAuth:
+		return err
+	}
+
+	lockoutAuth, err := params.wrapForKey(key)
+	if err != nil {
+		return xerrors.Errorf("cannot wrap lockout hierarchy authorization value: %w", err)
+	}
+
+	data := *k.data
+	data.lockoutAuth = lockoutAuth
+	if err := data.writeToLocation(location); err != nil {
+		return xerrors.Errorf("cannot write key data: %w", err)
+	}
+	k.data.lockoutAuth = lockoutAuth
+	return nil
+}
+
+// LockoutAuth recovers the lockout hierarchy authorization value stored in this sealed key object, using the key returned from
+// SealedKeyObject.UnsealFromTPM. The returned value can be supplied to TPMConnection.SetHierarchyAuth in order to use the lockout
+// hierarchy, eg, to reset the TPM's dictionary attack counter.
+//
+// If this sealed key object does not contain a copy of the lockout hierarchy authorization value, a ErrNoLockoutAuth error will be
+// returned. If the supplied key is not the one that was sealed, a ErrLockoutAuthUnwrap error will be returned.
+func (k *SealedKeyObject) LockoutAuth(key []byte) ([]byte, error) {
+	return k.unwrapLockoutAuth(lockoutAuthWrapSealedKey, key)
+}
+
+// LockoutAuthWithRecoveryKey recovers the lockout hierarchy authorization value stored in this sealed key object, using the
+// fallback recovery key supplied via the RecoveryKey field of LockoutAuthParams when the key was sealed. This can be used after
+// activating a volume with the recovery key, with the key obtained from GetActivationDataFromKernel.
+//
+// If this sealed key object does not contain a copy of the lockout hierarchy authorization value that was stored with a recovery
+// key, a ErrNoLockoutAuth error will be returned. If the supplied recovery key is incorrect, a ErrLockoutAuthUnwrap error will be
+// returned.
+func (k *SealedKeyObject) LockoutAuthWithRecoveryKey(key RecoveryKey) ([]byte, error) {
+	return k.unwrapLockoutAuth(lockoutAuthWrapRecoveryKey, key[:])
+}
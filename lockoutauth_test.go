@@ -0,0 +1,139 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestLockoutAuthInKeyData(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestLockoutAuthInKeyData_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+	var recoveryKey RecoveryKey
+	rand.Read(recoveryKey[:])
+
+	params := &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		LockoutAuth:            &LockoutAuthParams{Auth: testAuth, RecoveryKey: &recoveryKey}}
+	if _, err := SealKeyToTPM(tpm, key, tmpDir+"/keydata", params); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	if _, err := SealKeyToTPM(tpm, key, tmpDir+"/keydata2", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: tpm2.HandleNull}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(tmpDir + "/keydata")
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if !k.HasLockoutAuth() {
+		t.Errorf("Expected key data to contain the lockout auth")
+	}
+
+	t.Run("SealedKey", func(t *testing.T) {
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		auth, err := k.LockoutAuth(unsealedKey)
+		if err != nil {
+			t.Fatalf("LockoutAuth failed: %v", err)
+		}
+		if !bytes.Equal(auth, testAuth) {
+			t.Errorf("Unexpected lockout auth value")
+		}
+	})
+
+	t.Run("RecoveryKey", func(t *testing.T) {
+		auth, err := k.LockoutAuthWithRecoveryKey(recoveryKey)
+		if err != nil {
+			t.Fatalf("LockoutAuthWithRecoveryKey failed: %v", err)
+		}
+		if !bytes.Equal(auth, testAuth) {
+			t.Errorf("Unexpected lockout auth value")
+		}
+	})
+
+	t.Run("WrongKey", func(t *testing.T) {
+		if _, err := k.LockoutAuthWithRecoveryKey(RecoveryKey{}); err != ErrLockoutAuthUnwrap {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Rewrap", func(t *testing.T) {
+		newAuth := []byte("5678")
+		if err := k.RewrapLockoutAuth(FileKeyLocation(tmpDir+"/keydata"), key, &LockoutAuthParams{Auth: newAuth}); err != nil {
+			t.Fatalf("RewrapLockoutAuth failed: %v", err)
+		}
+
+		k, err := ReadSealedKeyObject(tmpDir + "/keydata")
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		auth, err := k.LockoutAuth(key)
+		if err != nil {
+			t.Fatalf("LockoutAuth failed: %v", err)
+		}
+		if !bytes.Equal(auth, newAuth) {
+			t.Errorf("Unexpected lockout auth value")
+		}
+		if _, err := k.LockoutAuthWithRecoveryKey(recoveryKey); err != ErrNoLockoutAuth {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if err := k.RewrapLockoutAuth(FileKeyLocation(tmpDir+"/keydata"), make([]byte, len(key)), nil); err != ErrLockoutAuthUnwrap {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("NoLockoutAuth", func(t *testing.T) {
+		k, err := ReadSealedKeyObject(tmpDir + "/keydata2")
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		if k.HasLockoutAuth() {
+			t.Errorf("Unexpected lockout auth")
+		}
+		if _, err := k.LockoutAuth(key); err != ErrNoLockoutAuth {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,126 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/snapcore/snapd/osutil"
+
+	"golang.org/x/xerrors"
+)
+
+// luks2TokenKeyDataType is the LUKS2 token type used for tokens that contain sealed key data.
+const luks2TokenKeyDataType = "secboot-tpm-keydata"
+
+// luks2KeyDataToken is the JSON representation of a LUKS2 token that contains sealed key data.
+type luks2KeyDataToken struct {
+	Type     string   `json:"type"`
+	Keyslots []string `json:"keyslots"`
+	KeyData  []byte   `json:"secboot_keydata"`
+}
+
+// LUKS2TokenKeyLocation is a KeyLocation that stores key data in a token in the LUKS2 header of the encrypted volume that the key
+// is for, so that the key data doesn't need to be stored on a separate filesystem. The token is associated with the specified
+// keyslot, which should be the keyslot that the sealed key unlocks.
+//
+// The token is read and written with cryptsetup. Updates to the LUKS2 header are atomic, so either the old or the new key data can
+// be read back if a write is interrupted.
+type LUKS2TokenKeyLocation struct {
+	DevicePath string // The path of the LUKS2 container
+	TokenID    int    // The ID of the token that contains the key data
+	Keyslot    int    // The keyslot that the token is associated with
+}
+
+// NewLUKS2TokenKeyLocation returns a new LUKS2TokenKeyLocation for the token with the specified ID in the LUKS2 container at the
+// specified path, associated with the specified keyslot.
+func NewLUKS2TokenKeyLocation(devicePath string, tokenID, keyslot int) *LUKS2TokenKeyLocation {
+	return &LUKS2TokenKeyLocation{DevicePath: devicePath, TokenID: tokenID, Keyslot: keyslot}
+}
+
+func (l *LUKS2TokenKeyLocation) String() string {
+	return fmt.Sprintf("%s:token%d", l.DevicePath, l.TokenID)
+}
+
+// Open implements KeyLocation.Open.
+func (l *LUKS2TokenKeyLocation) Open() (io.ReadCloser, error) {
+	cmd := exec.Command("cryptsetup", "luksDump", "--dump-json-metadata", l.DevicePath)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read LUKS2 header: %w", osutil.OutputErr(output, err))
+	}
+
+	var metadata struct {
+		Tokens map[string]json.RawMessage `json:"tokens"`
+	}
+	if err := json.Unmarshal(output, &metadata); err != nil {
+		return nil, xerrors.Errorf("cannot decode LUKS2 header: %w", err)
+	}
+
+	raw, ok := metadata.Tokens[strconv.Itoa(l.TokenID)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: l.String(), Err: os.ErrNotExist}
+	}
+
+	var token luks2KeyDataToken
+	if err := json.Unmarshal(raw, &token); err != nil {
+		return nil, xerrors.Errorf("cannot decode LUKS2 token: %w", err)
+	}
+	if token.Type != luks2TokenKeyDataType {
+		return nil, fmt.Errorf("LUKS2 token %d has unexpected type %q", l.TokenID, token.Type)
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(token.KeyData)), nil
+}
+
+// WriteAtomic implements KeyLocation.WriteAtomic.
+func (l *LUKS2TokenKeyLocation) WriteAtomic(fn func(w io.Writer) error) error {
+	if l.TokenID < 0 || l.Keyslot < 0 {
+		return fmt.Errorf("invalid LUKS2 token location %s", l)
+	}
+
+	var b bytes.Buffer
+	if err := fn(&b); err != nil {
+		return xerrors.Errorf("cannot write key data: %w", err)
+	}
+
+	token, err := json.Marshal(&luks2KeyDataToken{
+		Type:     luks2TokenKeyDataType,
+		Keyslots: []string{strconv.Itoa(l.Keyslot)},
+		KeyData:  b.Bytes()})
+	if err != nil {
+		return xerrors.Errorf("cannot encode LUKS2 token: %w", err)
+	}
+
+	cmd := exec.Command("cryptsetup", "token", "import", "--token-id", strconv.Itoa(l.TokenID), "--token-replace", l.DevicePath)
+	cmd.Stdin = bytes.NewReader(token)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return xerrors.Errorf("cannot import LUKS2 token: %w", osutil.OutputErr(output, err))
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/snapcore/secboot"
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+// luks2TokenCryptsetupBottom implements just enough of cryptsetup to store a single token with ID 3.
+const luks2TokenCryptsetupBottom = `
+case "$1" in
+luksDump)
+	if [ -f %[1]s ]; then
+		printf '{"tokens":{"3":'
+		cat %[1]s
+		printf '}}'
+	else
+		echo '{"tokens":{}}'
+	fi
+	;;
+token)
+	cat > %[1]s
+	;;
+esac
+`
+
+type luks2TokenKeyLocationSuite struct {
+	tokenPath      string
+	mockCryptsetup *snapd_testutil.MockCmd
+}
+
+var _ = Suite(&luks2TokenKeyLocationSuite{})
+
+func (s *luks2TokenKeyLocationSuite) SetUpTest(c *C) {
+	s.tokenPath = filepath.Join(c.MkDir(), "token")
+	s.mockCryptsetup = snapd_testutil.MockCommand(c, "cryptsetup", fmt.Sprintf(luks2TokenCryptsetupBottom, s.tokenPath))
+}
+
+func (s *luks2TokenKeyLocationSuite) TearDownTest(c *C) {
+	s.mockCryptsetup.Restore()
+}
+
+func (s *luks2TokenKeyLocationSuite) TestString(c *C) {
+	c.Check(NewLUKS2TokenKeyLocation("/dev/sda1", 3, 0).String(), Equals, "/dev/sda1:token3")
+}
+
+func (s *luks2TokenKeyLocationSuite) TestOpenMissing(c *C) {
+	_, err := NewLUKS2TokenKeyLocation("/dev/sda1", 3, 0).Open()
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *luks2TokenKeyLocationSuite) TestWriteAndRead(c *C) {
+	l := NewLUKS2TokenKeyLocation("/dev/sda1", 3, 1)
+	c.Assert(l.WriteAtomic(func(w io.Writer) error {
+		_, err := io.WriteString(w, "foo")
+		return err
+	}), IsNil)
+
+	r, err := l.Open()
+	c.Assert(err, IsNil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "foo")
+
+	token, err := ioutil.ReadFile(s.tokenPath)
+	c.Assert(err, IsNil)
+	c.Check(string(token), Equals, `{"type":"secboot-tpm-keydata","keyslots":["1"],"secboot_keydata":"Zm9v"}`)
+
+	c.Check(s.mockCryptsetup.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "token", "import", "--token-id", "3", "--token-replace", "/dev/sda1"},
+		{"cryptsetup", "luksDump", "--dump-json-metadata", "/dev/sda1"}})
+}
+
+func (s *luks2TokenKeyLocationSuite) TestWriteCallbackError(c *C) {
+	l := NewLUKS2TokenKeyLocation("/dev/sda1", 3, 1)
+	c.Check(l.WriteAtomic(func(w io.Writer) error {
+		return io.ErrUnexpectedEOF
+	}), ErrorMatches, "cannot write key data: unexpected EOF")
+	c.Check(s.mockCryptsetup.Calls(), HasLen, 0)
+}
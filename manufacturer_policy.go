@@ -0,0 +1,134 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/snapcore/secboot/internal/tcg"
+
+	"golang.org/x/xerrors"
+)
+
+// TPMManufacturerRule matches TPMs from a specific manufacturer, optionally restricted to a range of firmware versions. Firmware
+// versions are encoded in the same way as TPMCapabilities.FirmwareVersion.
+type TPMManufacturerRule struct {
+	Manufacturer       tpm2.TPMManufacturer
+	MinFirmwareVersion uint64 // The minimum firmware version matched by this rule, inclusive. Zero means no lower bound.
+	MaxFirmwareVersion uint64 // The maximum firmware version matched by this rule, inclusive. Zero means no upper bound.
+}
+
+func (r *TPMManufacturerRule) matches(manufacturer tpm2.TPMManufacturer, firmwareVersion uint64) bool {
+	if r.Manufacturer != manufacturer {
+		return false
+	}
+	if r.MinFirmwareVersion != 0 && firmwareVersion < r.MinFirmwareVersion {
+		return false
+	}
+	if r.MaxFirmwareVersion != 0 && firmwareVersion > r.MaxFirmwareVersion {
+		return false
+	}
+	return true
+}
+
+// TPMManufacturerPolicy defines which TPMs this package is permitted to provision and seal keys with, for deployments that
+// only trust TPMs from specific manufacturers or want to exclude firmware versions with known vulnerabilities. A policy is
+// installed for the whole package with SetTPMManufacturerPolicy. Provisioning and sealing operations on a TPM that isn't
+// permitted by the policy fail with an UnapprovedTPMError error before any changes are made to the TPM.
+//
+// The policy is evaluated against the manufacturer and firmware version properties reported by the TPM. If the TPM has an EK
+// certificate, the manufacturer in the TPM device attributes of the certificate must also match the one reported by the TPM. The
+// certificate is only permitted to omit the device attributes if it was verified with an EKVerificationProfile that doesn't require
+// them. Errors that occur when reading or parsing the certificate are returned. Note that the properties are reported by the TPM itself, and the certificate is only authenticated for connections
+// created with SecureConnectToDefaultTPM or one of the other secure connection functions.
+type TPMManufacturerPolicy struct {
+	// Allowed lists the TPMs that are permitted. If this is empty, all TPMs that aren't listed in Denied are permitted.
+	Allowed []TPMManufacturerRule
+
+	// Denied lists the TPMs that are not permitted. This takes precedence over Allowed.
+	Denied []TPMManufacturerRule
+}
+
+var tpmManufacturerPolicy *TPMManufacturerPolicy
+
+// SetTPMManufacturerPolicy installs the supplied TPM manufacturer policy for this package. Setting this to nil removes any
+// restrictions. This should be called before any other function in this package, and is not safe to call concurrently with
+// other functions in this package.
+func SetTPMManufacturerPolicy(policy *TPMManufacturerPolicy) {
+	tpmManufacturerPolicy = policy
+}
+
+// check checks that a TPM with the specified manufacturer and firmware version is permitted by this policy.
+func (p *TPMManufacturerPolicy) check(manufacturer tpm2.TPMManufacturer, firmwareVersion uint64) error {
+	if p == nil {
+		return nil
+	}
+	for _, r := range p.Denied {
+		if r.matches(manufacturer, firmwareVersion) {
+			return UnapprovedTPMError{Manufacturer: manufacturer, FirmwareVersion: firmwareVersion, msg: "the TPM is on the deny list"}
+		}
+	}
+	if len(p.Allowed) == 0 {
+		return nil
+	}
+	for _, r := range p.Allowed {
+		if r.matches(manufacturer, firmwareVersion) {
+			return nil
+		}
+	}
+	return UnapprovedTPMError{Manufacturer: manufacturer, FirmwareVersion: firmwareVersion, msg: "the TPM is not on the allow list"}
+}
+
+// checkManufacturerPolicy checks that the TPM associated with this connection is permitted by the current TPM manufacturer
+// policy.
+func (t *TPMConnection) checkManufacturerPolicy() error {
+	if tpmManufacturerPolicy == nil {
+		return nil
+	}
+
+	props, err := t.FixedProperties()
+	if err != nil {
+		return err
+	}
+	manufacturer := tpm2.TPMManufacturer(props[tpm2.PropertyManufacturer])
+	firmwareVersion := uint64(props[tpm2.PropertyFirmwareVersion1])<<32 | uint64(props[tpm2.PropertyFirmwareVersion2])
+
+	if err := tpmManufacturerPolicy.check(manufacturer, firmwareVersion); err != nil {
+		return err
+	}
+
+	// Virtual TPMs often don't have an EK certificate, so only check the device attributes if there is one. A certificate without
+	// device attributes is only accepted if it was verified with a profile that doesn't require them.
+	attrs, err := t.EKCertificateDeviceAttributes()
+	switch {
+	case tpm2.IsResourceUnavailableError(err, tcg.EKCertHandle):
+		return nil
+	case err == errNoTPMDeviceAttributes && t.verifiedEkCertChain != nil:
+		return nil
+	case err != nil:
+		return xerrors.Errorf("cannot obtain TPM device attributes from endorsement key certificate: %w", err)
+	}
+	if attrs.Manufacturer != manufacturer {
+		return UnapprovedTPMError{Manufacturer: manufacturer, FirmwareVersion: firmwareVersion,
+			msg: fmt.Sprintf("the EK certificate was issued for a TPM from a different manufacturer (%v)", attrs.Manufacturer)}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto/rand"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type manufacturerPolicySuite struct {
+	testutil.TPMSimulatorTestBase
+}
+
+var _ = Suite(&manufacturerPolicySuite{})
+
+func (s *manufacturerPolicySuite) SetUpTest(c *C) {
+	s.TPMSimulatorTestBase.SetUpTest(c)
+	s.AddCleanup(func() { SetTPMManufacturerPolicy(nil) })
+}
+
+func (s *manufacturerPolicySuite) firmwareVersion(c *C) uint64 {
+	caps, err := s.TPM.Capabilities()
+	c.Assert(err, IsNil)
+	return caps.FirmwareVersion
+}
+
+func (s *manufacturerPolicySuite) TestProvisionAllowed(c *C) {
+	SetTPMManufacturerPolicy(&TPMManufacturerPolicy{
+		Allowed: []TPMManufacturerRule{{Manufacturer: tpm2.TPMManufacturerINTC}, {Manufacturer: tpm2.TPMManufacturerIBM}}})
+	c.Check(s.TPM.EnsureProvisioned(ProvisionModeFull, nil), IsNil)
+}
+
+func (s *manufacturerPolicySuite) TestProvisionNotAllowed(c *C) {
+	SetTPMManufacturerPolicy(&TPMManufacturerPolicy{
+		Allowed: []TPMManufacturerRule{{Manufacturer: tpm2.TPMManufacturerINTC}}})
+	err := s.TPM.EnsureProvisioned(ProvisionModeFull, nil)
+	c.Assert(err, FitsTypeOf, UnapprovedTPMError{})
+	c.Check(err.(UnapprovedTPMError).Manufacturer, Equals, tpm2.TPMManufacturerIBM)
+	c.Check(err, ErrorMatches, "the TPM \\(manufacturer .*\\) is not permitted by the TPM manufacturer policy: the TPM is not on the allow list")
+
+	_, err = s.TPM.CreateResourceContextFromTPM(0x81010001)
+	c.Check(err, NotNil)
+}
+
+func (s *manufacturerPolicySuite) TestProvisionDenied(c *C) {
+	fw := s.firmwareVersion(c)
+	SetTPMManufacturerPolicy(&TPMManufacturerPolicy{
+		Allowed: []TPMManufacturerRule{{Manufacturer: tpm2.TPMManufacturerIBM}},
+		Denied:  []TPMManufacturerRule{{Manufacturer: tpm2.TPMManufacturerIBM, MinFirmwareVersion: fw, MaxFirmwareVersion: fw}}})
+	err := s.TPM.EnsureProvisioned(ProvisionModeFull, nil)
+	c.Assert(err, FitsTypeOf, UnapprovedTPMError{})
+	c.Check(err.(UnapprovedTPMError).FirmwareVersion, Equals, fw)
+	c.Check(err, ErrorMatches, ".*: the TPM is on the deny list")
+}
+
+func (s *manufacturerPolicySuite) TestProvisionDeniedOtherFirmwareVersion(c *C) {
+	fw := s.firmwareVersion(c)
+	SetTPMManufacturerPolicy(&TPMManufacturerPolicy{
+		Denied: []TPMManufacturerRule{{Manufacturer: tpm2.TPMManufacturerIBM, MaxFirmwareVersion: fw - 1}}})
+	c.Check(s.TPM.EnsureProvisioned(ProvisionModeFull, nil), IsNil)
+}
+
+func (s *manufacturerPolicySuite) TestSealNotAllowed(c *C) {
+	c.Assert(s.TPM.EnsureProvisioned(ProvisionModeFull, nil), IsNil)
+
+	SetTPMManufacturerPolicy(&TPMManufacturerPolicy{
+		Denied: []TPMManufacturerRule{{Manufacturer: tpm2.TPMManufacturerIBM}}})
+
+	key := make([]byte, 64)
+	rand.Read(key)
+	keyFile := c.MkDir() + "/keydata"
+
+	_, err := SealKeyToTPM(s.TPM, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x0181fff0})
+	c.Check(err, FitsTypeOf, UnapprovedTPMError{})
+
+	_, err = os.Stat(keyFile)
+	c.Check(os.IsNotExist(err), Equals, true)
+	_, err = s.TPM.CreateResourceContextFromTPM(0x0181fff0)
+	c.Check(err, NotNil)
+}
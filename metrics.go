@@ -0,0 +1,200 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"sync"
+	"time"
+)
+
+// MetricsOperation identifies an operation reported to a MetricsSink.
+type MetricsOperation string
+
+const (
+	// MetricsOperationConnect corresponds to ConnectToDefaultTPM and SecureConnectToDefaultTPM.
+	MetricsOperationConnect MetricsOperation = "connect"
+
+	// MetricsOperationProvision corresponds to TPMConnection.EnsureProvisioned.
+	MetricsOperationProvision MetricsOperation = "provision"
+
+	// MetricsOperationSeal corresponds to SealKeyToTPM, SealKeyToTPMMultiple and the other functions for sealing keys.
+	MetricsOperationSeal MetricsOperation = "seal"
+
+	// MetricsOperationUnseal corresponds to SealedKeyObject.UnsealFromTPM and SealedKeyObject.UnsealFromTPMWithAudit.
+	MetricsOperationUnseal MetricsOperation = "unseal"
+
+	// MetricsOperationActivate corresponds to the attempt to activate a volume with a TPM sealed key from
+	// ActivateVolumeWithTPMSealedKey, excluding any subsequent fallback to the recovery key.
+	MetricsOperationActivate MetricsOperation = "activate"
+
+	// MetricsOperationActivateWithRecoveryKey corresponds to an attempt to activate a volume with the recovery key, either from
+	// ActivateVolumeWithRecoveryKey or as a fallback from ActivateVolumeWithTPMSealedKey.
+	MetricsOperationActivateWithRecoveryKey MetricsOperation = "activate-with-recovery-key"
+)
+
+// MetricsPhase identifies a phase of an operation reported to a MetricsSink. The time taken to connect to the TPM is reported
+// separately as a MetricsOperationConnect operation.
+type MetricsPhase string
+
+const (
+	// MetricsPhaseLoad corresponds to loading the sealed key object in to the TPM.
+	MetricsPhaseLoad MetricsPhase = "load"
+
+	// MetricsPhasePolicySession corresponds to starting a policy session and executing the authorization policy assertions
+	// for a sealed key object.
+	MetricsPhasePolicySession MetricsPhase = "policy-session"
+
+	// MetricsPhaseUnseal corresponds to the TPM2_Unseal command.
+	MetricsPhaseUnseal MetricsPhase = "unseal"
+
+	// MetricsPhaseCryptsetup corresponds to running systemd-cryptsetup to open the LUKS2 keyslot with the unsealed key and set
+	// up the dm-crypt device. The time is dominated by the keyslot KDF.
+	//
+	// Opening the keyslot and setting up the dm-crypt device can't be reported as separate phases. Both happen inside a single
+	// crypt_activate_by_passphrase call in the systemd-cryptsetup process, which doesn't report when the keyslot has been
+	// opened. Timing the keyslot separately would require unlocking it a second time (eg, with cryptsetup open
+	// --test-passphrase), which would double the cost of the KDF and distort the measurement that it is meant to provide.
+	MetricsPhaseCryptsetup MetricsPhase = "cryptsetup"
+)
+
+// PhaseMetrics describes the time spent in a single phase of an operation. If an operation makes more than one attempt, this is
+// the total time spent in the phase across all attempts.
+type PhaseMetrics struct {
+	Phase    MetricsPhase
+	Duration time.Duration
+}
+
+// OperationMetrics describes the duration and outcome of a single operation.
+type OperationMetrics struct {
+	Operation MetricsOperation
+	Duration  time.Duration
+	Err       error // The error returned from the operation, or nil if it succeeded
+
+	// Attempts is the number of attempts made during the operation. This is greater than 1 for activation operations that
+	// retry after an incorrect PIN or recovery key was supplied, and is 1 for all other operations.
+	Attempts int
+
+	// Phases contains the time spent in each of the phases of the operation that were reached, in the order in which they
+	// were first entered. This is only reported for unseal and activation operations.
+	Phases []PhaseMetrics
+}
+
+// MetricsSink is implemented by types that collect metrics about the operations performed by this package. It is called
+// synchronously when each operation completes, so it shouldn't block.
+type MetricsSink interface {
+	ObserveOperation(metrics *OperationMetrics)
+}
+
+var (
+	metricsSinkMu sync.RWMutex
+	metricsSink   MetricsSink
+)
+
+// SetMetricsSink installs the supplied sink for collecting metrics about the operations performed by this package. Setting this to
+// nil disables metrics collection. It is safe to call this concurrently with other functions in this package. Operations that
+// complete whilst the sink is being replaced are reported to either the old or the new sink.
+func SetMetricsSink(sink MetricsSink) {
+	metricsSinkMu.Lock()
+	defer metricsSinkMu.Unlock()
+	metricsSink = sink
+}
+
+func currentMetricsSink() MetricsSink {
+	metricsSinkMu.RLock()
+	defer metricsSinkMu.RUnlock()
+	return metricsSink
+}
+
+// observeOperation reports an operation that started at the specified time and completed with the error pointed to by err to the
+// installed metrics sink, if there is one. It is intended to be deferred at the start of an operation with a named error result.
+func observeOperation(op MetricsOperation, start time.Time, err *error) {
+	observeOperationAttempts(op, start, err, nil)
+}
+
+// observeOperationAttempts is a variant of observeOperation for operations that can make more than one attempt. The number of
+// attempts is read from the variable pointed to by attempts when the operation completes.
+func observeOperationAttempts(op MetricsOperation, start time.Time, err *error, attempts *int) {
+	observeOperationPhases(op, start, err, attempts, nil)
+}
+
+// observeOperationPhases is a variant of observeOperationAttempts for operations that record the time spent in each of their
+// phases in phases.
+func observeOperationPhases(op MetricsOperation, start time.Time, err *error, attempts *int, phases *metricsPhases) {
+	observeOperationPhasesTo(nil, op, start, err, attempts, phases)
+}
+
+// observeOperationPhasesTo is a variant of observeOperationPhases that also stores the metrics for the operation in out, if it
+// isn't nil. This happens regardless of whether a metrics sink is installed.
+func observeOperationPhasesTo(out *OperationMetrics, op MetricsOperation, start time.Time, err *error, attempts *int, phases *metricsPhases) {
+	sink := currentMetricsSink()
+	if sink == nil && out == nil {
+		return
+	}
+	n := 1
+	if attempts != nil {
+		n = *attempts
+	}
+	var p []PhaseMetrics
+	if phases != nil {
+		p = phases.phases
+	}
+	m := OperationMetrics{Operation: op, Duration: time.Since(start), Err: *err, Attempts: n, Phases: p}
+	if out != nil {
+		*out = m
+	}
+	if sink != nil {
+		sink.ObserveOperation(&m)
+	}
+}
+
+// metricsPhases accumulates the time spent in each phase of an operation. A nil *metricsPhases discards everything.
+type metricsPhases struct {
+	phases []PhaseMetrics
+}
+
+// add adds d to the time spent in the specified phase.
+func (p *metricsPhases) add(phase MetricsPhase, d time.Duration) {
+	if p == nil {
+		return
+	}
+	for i := range p.phases {
+		if p.phases[i].Phase == phase {
+			p.phases[i].Duration += d
+			return
+		}
+	}
+	p.phases = append(p.phases, PhaseMetrics{Phase: phase, Duration: d})
+}
+
+// observe adds the time elapsed since start to the time spent in the specified phase. It is intended to be called when a phase
+// completes.
+func (p *metricsPhases) observe(phase MetricsPhase, start time.Time) {
+	p.add(phase, time.Since(start))
+}
+
+// merge adds the time spent in each phase recorded in other.
+func (p *metricsPhases) merge(other *metricsPhases) {
+	if other == nil {
+		return
+	}
+	for _, m := range other.phases {
+		p.add(m.Phase, m.Duration)
+	}
+}
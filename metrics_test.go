@@ -0,0 +1,177 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+type mockMetricsSink struct {
+	metrics []*OperationMetrics
+}
+
+func (s *mockMetricsSink) ObserveOperation(metrics *OperationMetrics) {
+	s.metrics = append(s.metrics, metrics)
+}
+
+func TestMetricsSink(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	sink := new(mockMetricsSink)
+	SetMetricsSink(sink)
+	defer SetMetricsSink(nil)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestMetricsSink_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: tpm2.HandleNull}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if _, _, err := k.UnsealFromTPM(tpm, ""); err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if _, _, err := k.UnsealFromTPM(tpm, "1234"); err != ErrPINFail {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	expected := []struct {
+		op     MetricsOperation
+		failed bool
+	}{
+		{op: MetricsOperationProvision},
+		{op: MetricsOperationSeal},
+		{op: MetricsOperationUnseal},
+		{op: MetricsOperationUnseal, failed: true},
+	}
+	if len(sink.metrics) != len(expected) {
+		t.Fatalf("Unexpected number of metrics: %d", len(sink.metrics))
+	}
+	for i, m := range sink.metrics {
+		if m.Operation != expected[i].op {
+			t.Errorf("Unexpected operation %d: %s", i, m.Operation)
+		}
+		if (m.Err != nil) != expected[i].failed {
+			t.Errorf("Unexpected error for operation %d: %v", i, m.Err)
+		}
+		if m.Duration <= 0 {
+			t.Errorf("Unexpected duration for operation %d: %v", i, m.Duration)
+		}
+		if m.Attempts != 1 {
+			t.Errorf("Unexpected attempts for operation %d: %d", i, m.Attempts)
+		}
+	}
+	if sink.metrics[3].Err != ErrPINFail {
+		t.Errorf("Unexpected error: %v", sink.metrics[3].Err)
+	}
+
+	expectedPhases := []MetricsPhase{MetricsPhaseLoad, MetricsPhasePolicySession, MetricsPhaseUnseal}
+	for _, m := range sink.metrics {
+		if m.Operation != MetricsOperationUnseal {
+			if len(m.Phases) > 0 {
+				t.Errorf("Unexpected phases for operation %s: %v", m.Operation, m.Phases)
+			}
+			continue
+		}
+		if len(m.Phases) != len(expectedPhases) {
+			t.Errorf("Unexpected number of phases: %d", len(m.Phases))
+			continue
+		}
+		var total time.Duration
+		for i, p := range m.Phases {
+			if p.Phase != expectedPhases[i] {
+				t.Errorf("Unexpected phase %d: %s", i, p.Phase)
+			}
+			if p.Duration <= 0 {
+				t.Errorf("Unexpected duration for phase %s: %v", p.Phase, p.Duration)
+			}
+			total += p.Duration
+		}
+		if total > m.Duration {
+			t.Errorf("Phases take longer than the operation (%v > %v)", total, m.Duration)
+		}
+	}
+}
+
+type countingMetricsSink struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (s *countingMetricsSink) ObserveOperation(metrics *OperationMetrics) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.n++
+}
+
+func TestSetMetricsSinkConcurrent(t *testing.T) {
+	defer SetMetricsSink(nil)
+
+	sink := new(countingMetricsSink)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			SetMetricsSink(sink)
+		}()
+		go func() {
+			defer wg.Done()
+			// This fails immediately without using the TPM, but is still reported to the sink.
+			SealKeyToTPMMultiple(new(TPMConnection), nil, nil)
+		}()
+	}
+	wg.Wait()
+
+	SetMetricsSink(sink)
+	SealKeyToTPMMultiple(new(TPMConnection), nil, nil)
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.n == 0 {
+		t.Errorf("No operations were observed")
+	}
+}
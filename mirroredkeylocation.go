@@ -0,0 +1,201 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// MirroredKeyLocation is a KeyLocation that stores identical copies of key data at several other locations, in order to protect
+// against corruption of a single copy, eg, because of a bad sector on cheap eMMC storage.
+//
+// When reading, each copy is read and validated. If the copies differ, the valid copy with the highest PCR policy generation is
+// used (or the first valid copy if they have the same generation). Copies that are corrupt or stale are then repaired in the
+// background by replacing them with the selected copy, unless NoRepair is set. Wait can be used to wait for the repair to complete.
+//
+// When writing, the key data is written to every copy in turn.
+type MirroredKeyLocation struct {
+	Copies []KeyLocation
+
+	// NoRepair disables the repair of corrupt or stale copies when reading, eg, for use in read-only environments.
+	NoRepair bool
+
+	// repairLock serializes Open, WriteAtomic and Wait. Without it, a call to repair.Add in Open could race with a call to
+	// repair.Wait, and a repair started by Open with data that it read before a concurrent WriteAtomic could overwrite the
+	// newly written data.
+	repairLock sync.Mutex
+	repair     sync.WaitGroup
+
+	mu        sync.Mutex
+	repairErr error
+}
+
+// NewMirroredFileKeyLocation returns a new MirroredKeyLocation that stores copies of key data in regular files at the specified
+// paths.
+func NewMirroredFileKeyLocation(paths ...string) *MirroredKeyLocation {
+	return &MirroredKeyLocation{Copies: fileKeyLocations(paths)}
+}
+
+func (l *MirroredKeyLocation) String() string {
+	var s []string
+	for _, c := range l.Copies {
+		s = append(s, c.String())
+	}
+	return strings.Join(s, ",")
+}
+
+type mirroredKeyDataCopy struct {
+	location   KeyLocation
+	data       []byte
+	generation uint64
+	err        error
+}
+
+func readMirroredKeyDataCopy(location KeyLocation) *mirroredKeyDataCopy {
+	c := &mirroredKeyDataCopy{location: location}
+
+	r, err := location.Open()
+	if err != nil {
+		c.err = xerrors.Errorf("cannot open %s: %w", location, err)
+		return c
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		c.err = xerrors.Errorf("cannot read %s: %w", location, err)
+		return c
+	}
+
+	kd, err := decodeKeyData(bytes.NewReader(data))
+	if err != nil {
+		c.err = InvalidKeyFileError{fmt.Sprintf("%v (%s)", err, location)}
+		return c
+	}
+
+	c.data = data
+	if kd.identity != nil {
+		c.generation = kd.identity.Generation
+	}
+	return c
+}
+
+// Open implements KeyLocation.Open.
+func (l *MirroredKeyLocation) Open() (io.ReadCloser, error) {
+	if len(l.Copies) == 0 {
+		return nil, errors.New("no copies")
+	}
+
+	l.repairLock.Lock()
+	defer l.repairLock.Unlock()
+
+	var copies []*mirroredKeyDataCopy
+	var selected *mirroredKeyDataCopy
+	for _, location := range l.Copies {
+		c := readMirroredKeyDataCopy(location)
+		copies = append(copies, c)
+		if c.err != nil {
+			continue
+		}
+		if selected == nil || c.generation > selected.generation {
+			selected = c
+		}
+	}
+	if selected == nil {
+		// Return the error associated with the first copy.
+		return nil, copies[0].err
+	}
+
+	var stale []KeyLocation
+	for _, c := range copies {
+		if !bytes.Equal(c.data, selected.data) {
+			stale = append(stale, c.location)
+		}
+	}
+	if len(stale) > 0 && !l.NoRepair {
+		l.repair.Add(1)
+		go func() {
+			defer l.repair.Done()
+			err := writeMirroredKeyData(stale, selected.data)
+
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.repairErr = err
+		}()
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(selected.data)), nil
+}
+
+func writeMirroredKeyData(locations []KeyLocation, data []byte) error {
+	var errs []string
+	for _, location := range locations {
+		if err := location.WriteAtomic(func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		}); err != nil {
+			errs = append(errs, fmt.Sprintf("cannot write %s: %v", location, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// WriteAtomic implements KeyLocation.WriteAtomic. The key data is written to every copy, even if writing one of them fails.
+func (l *MirroredKeyLocation) WriteAtomic(fn func(w io.Writer) error) error {
+	if len(l.Copies) == 0 {
+		return errors.New("no copies")
+	}
+
+	var buf bytes.Buffer
+	if err := fn(&buf); err != nil {
+		return err
+	}
+
+	// Don't race with a repair started by Open.
+	l.repairLock.Lock()
+	defer l.repairLock.Unlock()
+	l.repair.Wait()
+	return writeMirroredKeyData(l.Copies, buf.Bytes())
+}
+
+// Wait waits for any repair of corrupt or stale copies started by Open to complete, and returns the error from the most recent
+// repair, if there was one.
+func (l *MirroredKeyLocation) Wait() error {
+	l.repairLock.Lock()
+	l.repair.Wait()
+	l.repairLock.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.repairErr
+	l.repairErr = nil
+	return err
+}
@@ -0,0 +1,172 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type mirroredKeyLocationSuite struct {
+	testutil.TPMSimulatorTestBase
+	key     []byte
+	authKey TPMPolicyAuthKey
+	paths   []string
+}
+
+var _ = Suite(&mirroredKeyLocationSuite{})
+
+func (s *mirroredKeyLocationSuite) SetUpTest(c *C) {
+	s.TPMSimulatorTestBase.SetUpTest(c)
+	c.Assert(s.TPM.EnsureProvisioned(ProvisionModeFull, nil), IsNil)
+	s.ResetTPMSimulator(c)
+
+	dir := c.MkDir()
+	s.paths = []string{filepath.Join(dir, "keydata"), filepath.Join(dir, "keydata.mirror")}
+	s.key = make([]byte, 32)
+
+	authKey, err := SealKeyToTPMMultiple(s.TPM, []*SealKeyRequest{{Key: s.key, Location: NewMirroredFileKeyLocation(s.paths...)}},
+		&KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+	s.authKey = authKey
+}
+
+func (s *mirroredKeyLocationSuite) checkUnseal(c *C, location KeyLocation) {
+	k, err := ReadSealedKeyObjectFromLocation(location)
+	c.Assert(err, IsNil)
+	key, _, err := k.UnsealFromTPM(s.TPM, "")
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, s.key)
+}
+
+func (s *mirroredKeyLocationSuite) checkCopiesIdentical(c *C) {
+	data, err := ioutil.ReadFile(s.paths[0])
+	c.Assert(err, IsNil)
+	c.Check(s.paths[1], snapd_testutil.FileEquals, data)
+}
+
+func (s *mirroredKeyLocationSuite) TestString(c *C) {
+	c.Check(NewMirroredFileKeyLocation("/a", "/b").String(), Equals, "/a,/b")
+}
+
+func (s *mirroredKeyLocationSuite) TestWrite(c *C) {
+	s.checkCopiesIdentical(c)
+	location := NewMirroredFileKeyLocation(s.paths...)
+	s.checkUnseal(c, location)
+	c.Check(location.Wait(), IsNil)
+}
+
+func (s *mirroredKeyLocationSuite) testRepair(c *C, corruptIndex int) {
+	c.Assert(ioutil.WriteFile(s.paths[corruptIndex], []byte("garbage"), 0600), IsNil)
+
+	location := NewMirroredFileKeyLocation(s.paths...)
+	s.checkUnseal(c, location)
+	c.Check(location.Wait(), IsNil)
+	s.checkCopiesIdentical(c)
+}
+
+func (s *mirroredKeyLocationSuite) TestRepairCorruptFirstCopy(c *C) {
+	s.testRepair(c, 0)
+}
+
+func (s *mirroredKeyLocationSuite) TestRepairCorruptSecondCopy(c *C) {
+	s.testRepair(c, 1)
+}
+
+func (s *mirroredKeyLocationSuite) TestRepairMissingCopy(c *C) {
+	c.Assert(os.Remove(s.paths[0]), IsNil)
+
+	location := NewMirroredFileKeyLocation(s.paths...)
+	s.checkUnseal(c, location)
+	c.Check(location.Wait(), IsNil)
+	s.checkCopiesIdentical(c)
+}
+
+func (s *mirroredKeyLocationSuite) TestRepairStaleCopy(c *C) {
+	// Update only the second copy, so that the first one is stale.
+	c.Assert(UpdateKeyPCRProtectionPolicy(s.TPM, s.paths[1], s.authKey, getTestPCRProfile()), IsNil)
+	updated, err := ioutil.ReadFile(s.paths[1])
+	c.Assert(err, IsNil)
+
+	location := NewMirroredFileKeyLocation(s.paths...)
+	s.checkUnseal(c, location)
+	c.Check(location.Wait(), IsNil)
+	c.Check(s.paths[0], snapd_testutil.FileEquals, updated)
+}
+
+func (s *mirroredKeyLocationSuite) TestConcurrentOpenAndWrite(c *C) {
+	c.Assert(ioutil.WriteFile(s.paths[0], []byte("garbage"), 0600), IsNil)
+	data, err := ioutil.ReadFile(s.paths[1])
+	c.Assert(err, IsNil)
+
+	location := NewMirroredFileKeyLocation(s.paths...)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if r, err := location.Open(); err == nil {
+				r.Close()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			location.WriteAtomic(func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			})
+		}()
+	}
+	wg.Wait()
+
+	c.Check(location.Wait(), IsNil)
+	s.checkCopiesIdentical(c)
+	c.Check(s.paths[0], snapd_testutil.FileEquals, data)
+}
+
+func (s *mirroredKeyLocationSuite) TestNoRepair(c *C) {
+	c.Assert(ioutil.WriteFile(s.paths[0], []byte("garbage"), 0600), IsNil)
+
+	location := NewMirroredFileKeyLocation(s.paths...)
+	location.NoRepair = true
+	s.checkUnseal(c, location)
+	c.Check(location.Wait(), IsNil)
+	c.Check(s.paths[0], snapd_testutil.FileEquals, "garbage")
+}
+
+func (s *mirroredKeyLocationSuite) TestAllCopiesCorrupt(c *C) {
+	for _, p := range s.paths {
+		c.Assert(ioutil.WriteFile(p, []byte("garbage"), 0600), IsNil)
+	}
+
+	_, err := ReadSealedKeyObjectFromLocation(NewMirroredFileKeyLocation(s.paths...))
+	c.Check(err, ErrorMatches, "cannot open key data file: invalid key data file: .* \\(.*/keydata\\)")
+}
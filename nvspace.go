@@ -0,0 +1,123 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// NVSpaceRequirements describes the persistent TPM resources that an operation will create, for TPMConnection.CheckNVSpace.
+type NVSpaceRequirements struct {
+	// PersistentHandles are the handles at which persistent objects will be created. Handles that are already occupied don't
+	// consume any additional NV space, because the existing object is evicted first.
+	PersistentHandles []tpm2.Handle
+
+	// CounterHandles are the handles at which NV counter indices will be defined. These must not already be defined.
+	CounterHandles []tpm2.Handle
+
+	// Indices are the public areas of the ordinary (non-counter) NV indices that will be defined, such as the PCR policy lock
+	// index. These must not already be defined.
+	Indices []*tpm2.NVPublic
+}
+
+// isTPMResourceDefined indicates whether there is a persistent object or NV index at the specified handle.
+func isTPMResourceDefined(tpm *tpm2.TPMContext, handle tpm2.Handle, sessions ...tpm2.SessionContext) (bool, error) {
+	_, err := tpm.CreateResourceContextFromTPM(handle, sessions...)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+// CheckNVSpace verifies that the TPM has enough NV resources available for the persistent resources described by req to be
+// created, so that an operation can be refused before it starts rather than failing part way through.
+//
+// TPMs don't report the amount of NV memory that remains, so this uses the estimated number of additional persistent objects
+// (TPM_PT_HR_PERSISTENT_AVAIL) and NV counter indices (TPM_PT_NV_COUNTERS_AVAIL) reported by the TPM. If the TPM reports that
+// there is no fixed limit on the number of NV counter indices, counters aren't checked. There is no equivalent estimate for
+// ordinary NV indices, so these are only checked against the maximum size of a single index (TPM_PT_NV_INDEX_MAX).
+//
+// If there are insufficient resources, a InsufficientNVSpaceError error is returned. If any of the counter handles or ordinary
+// NV indices is already defined, a TPMResourceExistsError error is returned.
+func (t *TPMConnection) CheckNVSpace(req *NVSpaceRequirements) error {
+	session, err := t.secretSession()
+	if err != nil {
+		return err
+	}
+	session = session.IncludeAttrs(tpm2.AttrAudit)
+
+	props, err := readTPMProperties(t.TPMContext, session)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain TPM properties: %w", err)
+	}
+
+	var persistent uint32
+	for _, h := range req.PersistentHandles {
+		occupied, err := isTPMResourceDefined(t.TPMContext, h, session)
+		if err != nil {
+			return xerrors.Errorf("cannot determine if persistent handle %v is occupied: %w", h, err)
+		}
+		if !occupied {
+			persistent++
+		}
+	}
+	if avail := props[tpm2.PropertyHRPersistentAvail]; persistent > avail {
+		return InsufficientNVSpaceError{Resource: "persistent objects", Required: persistent, Available: avail}
+	}
+
+	for _, h := range req.CounterHandles {
+		occupied, err := isTPMResourceDefined(t.TPMContext, h, session)
+		if err != nil {
+			return xerrors.Errorf("cannot determine if NV index %v is defined: %w", h, err)
+		}
+		if occupied {
+			return TPMResourceExistsError{h}
+		}
+	}
+	counters := uint32(len(req.CounterHandles))
+	// A TPM that reports no maximum and no available counters has no fixed limit.
+	if props[tpm2.PropertyNVCountersMax] != 0 || props[tpm2.PropertyNVCountersAvail] != 0 {
+		if avail := props[tpm2.PropertyNVCountersAvail]; counters > avail {
+			return InsufficientNVSpaceError{Resource: "NV counters", Required: counters, Available: avail}
+		}
+	}
+
+	for _, pub := range req.Indices {
+		occupied, err := isTPMResourceDefined(t.TPMContext, pub.Index, session)
+		if err != nil {
+			return xerrors.Errorf("cannot determine if NV index %v is defined: %w", pub.Index, err)
+		}
+		if occupied {
+			return TPMResourceExistsError{pub.Index}
+		}
+		if max := props[tpm2.PropertyNVIndexMax]; uint32(pub.Size) > max {
+			return fmt.Errorf("NV index %v requires %d bytes but the TPM only supports indices of up to %d bytes", pub.Index, pub.Size, max)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type nvSpaceSuite struct {
+	testutil.TPMSimulatorTestBase
+}
+
+var _ = Suite(&nvSpaceSuite{})
+
+func (s *nvSpaceSuite) TestCheckNVSpace(c *C) {
+	c.Check(s.TPM.CheckNVSpace(&NVSpaceRequirements{
+		PersistentHandles: []tpm2.Handle{tcg.EKHandle, tcg.SRKHandle},
+		CounterHandles:    []tpm2.Handle{0x0181fff0}}), IsNil)
+}
+
+func (s *nvSpaceSuite) TestCheckNVSpaceInsufficientPersistent(c *C) {
+	var handles []tpm2.Handle
+	for i := 0; i < 1000; i++ {
+		handles = append(handles, tpm2.Handle(0x81000100+i))
+	}
+
+	err := s.TPM.CheckNVSpace(&NVSpaceRequirements{PersistentHandles: handles})
+	c.Assert(err, FitsTypeOf, InsufficientNVSpaceError{})
+	c.Check(err.(InsufficientNVSpaceError).Resource, Equals, "persistent objects")
+	c.Check(err.(InsufficientNVSpaceError).Required, Equals, uint32(1000))
+	c.Check(err, ErrorMatches, "insufficient NV space on the TPM: 1000 additional persistent objects required but only [0-9]+ available")
+}
+
+func (s *nvSpaceSuite) TestCheckNVSpaceOccupiedPersistentHandles(c *C) {
+	c.Assert(s.TPM.EnsureProvisioned(ProvisionModeFull, nil), IsNil)
+
+	props, err := s.TPM.GetCapabilityTPMProperties(tpm2.PropertyHRPersistentAvail, 1)
+	c.Assert(err, IsNil)
+	c.Assert(props, HasLen, 1)
+
+	// Handles that are already occupied don't need any additional space.
+	handles := []tpm2.Handle{tcg.EKHandle, tcg.SRKHandle}
+	for i := uint32(0); i < props[0].Value; i++ {
+		handles = append(handles, tpm2.Handle(0x81000100+i))
+	}
+	c.Check(s.TPM.CheckNVSpace(&NVSpaceRequirements{PersistentHandles: handles}), IsNil)
+}
+
+func (s *nvSpaceSuite) TestCheckNVSpaceCounterDefined(c *C) {
+	public := tpm2.NVPublic{
+		Index:   0x0181fff0,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8}
+	index, err := s.TPM.NVDefineSpace(s.TPM.OwnerHandleContext(), nil, &public, nil)
+	c.Assert(err, IsNil)
+	s.AddCleanupNVSpace(c, s.TPM.OwnerHandleContext(), index)
+
+	c.Check(s.TPM.CheckNVSpace(&NVSpaceRequirements{CounterHandles: []tpm2.Handle{0x0181fff0}}), Equals, TPMResourceExistsError{0x0181fff0})
+}
+
+func (s *nvSpaceSuite) TestCheckNVSpaceIndexDefined(c *C) {
+	public := tpm2.NVPublic{
+		Index:   0x0181fff0,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8}
+	index, err := s.TPM.NVDefineSpace(s.TPM.OwnerHandleContext(), nil, &public, nil)
+	c.Assert(err, IsNil)
+	s.AddCleanupNVSpace(c, s.TPM.OwnerHandleContext(), index)
+
+	c.Check(s.TPM.CheckNVSpace(&NVSpaceRequirements{Indices: []*tpm2.NVPublic{&public}}), Equals, TPMResourceExistsError{0x0181fff0})
+}
+
+func (s *nvSpaceSuite) TestCheckNVSpaceIndexTooLarge(c *C) {
+	public := tpm2.NVPublic{
+		Index:   0x0181fff0,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    0xffff}
+	c.Check(s.TPM.CheckNVSpace(&NVSpaceRequirements{Indices: []*tpm2.NVPublic{&public}}), ErrorMatches,
+		"NV index 0x0181fff0 requires 65535 bytes but the TPM only supports indices of up to [0-9]+ bytes")
+}
@@ -0,0 +1,128 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+
+	"github.com/snapcore/secboot/internal/optee"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	defaultOPTEEDevicePath = "/dev/tee0"
+
+	// opteeCmdWrapKey and opteeCmdUnwrapKey are the commands implemented by the key wrapping trusted application. Both take the
+	// input data as a memory reference input in parameter 0 and return the output data via a memory reference output in
+	// parameter 1.
+	opteeCmdWrapKey   uint32 = 0
+	opteeCmdUnwrapKey uint32 = 1
+
+	// opteeWrapOverhead is the expected size of the metadata that the trusted application adds to a wrapped key (a nonce and an
+	// authentication tag). The trusted application can request a larger buffer if it needs one.
+	opteeWrapOverhead = 64
+)
+
+// OPTEEProtector is a HardwareKeyProtector for ARM devices that don't have a TPM but do have TrustZone. It uses a trusted
+// application running in OP-TEE to wrap and unwrap keys with a key derived from the device-unique hardware key, which is only
+// accessible to the secure world. The trusted application is accessed via the Linux TEE subsystem.
+//
+// OP-TEE doesn't ship a key wrapping trusted application, so the trusted application must be supplied by the platform and its
+// UUID must be specified with the TA field. It must implement 2 commands, each taking a TEE_PARAM_TYPE_MEMREF_INPUT in parameter 0
+// and returning the result in a TEE_PARAM_TYPE_MEMREF_OUTPUT in parameter 1. Command 0 wraps the key supplied in parameter 0 and
+// returns the wrapped key, which is expected to be no more than 64 bytes longer than the key. Command 1 unwraps the wrapped key
+// supplied in parameter 0 and returns the key. If the output buffer is too small, the trusted application should fail with
+// TEE_ERROR_SHORT_BUFFER and update the size of parameter 1 to the required size. Wrapped keys must be authenticated, and the
+// trusted application should fail with TEE_ERROR_MAC_INVALID or TEE_ERROR_SECURITY if they are rejected.
+//
+// Unlike keys sealed to the TPM, wrapped keys aren't bound to the state of the boot - this protector doesn't measure anything or
+// lock access to keys once they have been unwrapped. Any code that runs in the normal world and can open the TEE device can
+// unwrap a key for the lifetime of the boot, unless the trusted application implements its own restrictions, eg, by refusing to
+// unwrap keys after the OS has signalled that the early boot environment has been left, or by binding wrapped keys to the
+// measurements recorded by the secure world. The security of keys protected with this protector therefore depends on the trusted
+// application and on restricting access to the TEE device.
+type OPTEEProtector struct {
+	// DevicePath is the path of the TEE device. If this is empty, /dev/tee0 is used.
+	DevicePath string
+
+	// TA is the UUID of the key wrapping trusted application. This is required.
+	TA string
+}
+
+// Protector implements HardwareKeyProtector.Protector.
+func (p *OPTEEProtector) Protector() VolumeProtector {
+	return VolumeProtectorOPTEE
+}
+
+// invokeOPTEE invokes the specified command of the trusted application identified by ta, via the TEE device at path. The input
+// data is passed as a memory reference in parameter 0 and the output data is returned via a memory reference in parameter 1.
+func invokeOPTEE(path, ta string, cmd uint32, in []byte, outSize int) ([]byte, error) {
+	if path == "" {
+		path = defaultOPTEEDevicePath
+	}
+
+	uuid, err := optee.ParseUUID(ta)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid trusted application UUID: %w", err)
+	}
+
+	ctx, err := optee.Open(path)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot open TEE device: %w", err)
+	}
+	defer ctx.Close()
+
+	session, err := ctx.OpenSession(uuid)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot open session with trusted application %s: %w", uuid, err)
+	}
+	defer session.Close()
+
+	return session.InvokeWithBuffers(cmd, in, outSize)
+}
+
+func (p *OPTEEProtector) invoke(cmd uint32, in []byte, outSize int) ([]byte, error) {
+	if p.TA == "" {
+		return nil, errors.New("no trusted application specified")
+	}
+	return invokeOPTEE(p.DevicePath, p.TA, cmd, in, outSize)
+}
+
+// isOPTEEInvalidWrappedKeyError indicates whether err is an error from a trusted application that indicates that it rejected the
+// supplied wrapped key.
+func isOPTEEInvalidWrappedKeyError(err error) bool {
+	var e *optee.Error
+	return xerrors.As(err, &e) && e.Origin == optee.OriginTrustedApp && (e.Code == optee.ResultMACInvalid || e.Code == optee.ResultSecurity)
+}
+
+// WrapKey implements HardwareKeyProtector.WrapKey.
+func (p *OPTEEProtector) WrapKey(key []byte) ([]byte, error) {
+	return p.invoke(opteeCmdWrapKey, key, len(key)+opteeWrapOverhead)
+}
+
+// UnwrapKey implements HardwareKeyProtector.UnwrapKey.
+func (p *OPTEEProtector) UnwrapKey(wrapped []byte) ([]byte, error) {
+	key, err := p.invoke(opteeCmdUnwrapKey, wrapped, len(wrapped))
+	if isOPTEEInvalidWrappedKeyError(err) {
+		return nil, xerrors.Errorf("%w (%v)", ErrInvalidWrappedKey, err)
+	}
+	return key, err
+}
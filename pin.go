@@ -20,8 +20,6 @@
 package secboot
 
 import (
-	"os"
-
 	"github.com/canonical/go-tpm2"
 	"github.com/snapcore/secboot/internal/tcg"
 
@@ -129,9 +127,14 @@ func performPinChange(tpm *tpm2.TPMContext, keyPrivate tpm2.Private, keyPublic *
 	}
 	defer tpm.FlushContext(key)
 
-	key.SetAuthValue([]byte(oldPIN))
+	oldAuthValue := []byte(oldPIN)
+	defer wipeBytes(oldAuthValue)
+	key.SetAuthValue(oldAuthValue)
+
+	newAuthValue := []byte(newPIN)
+	defer wipeBytes(newAuthValue)
 
-	newKeyPrivate, err := tpm.ObjectChangeAuth(key, srk, []byte(newPIN), session.IncludeAttrs(tpm2.AttrCommandEncrypt))
+	newKeyPrivate, err := tpm.ObjectChangeAuth(key, srk, newAuthValue, session.IncludeAttrs(tpm2.AttrCommandEncrypt))
 	if err != nil {
 		return nil, xerrors.Errorf("cannot change sealed key object authorization value: %w", err)
 	}
@@ -149,7 +152,24 @@ func performPinChange(tpm *tpm2.TPMContext, keyPrivate tpm2.Private, keyPublic *
 // If the supplied key data file fails validation checks, an InvalidKeyFileError error will be returned.
 //
 // If oldPIN is incorrect, then a ErrPINFail error will be returned and the TPM's dictionary attack counter will be incremented.
+//
+// If TPMConnection.RequireVerifiedSession is enabled and the connection doesn't have a verified session, a ErrNoVerifiedSession
+// error will be returned.
+//
+// If the key data file was created with WithImportable, the updated sealed key object is protected by the storage root key of
+// the TPM and is no longer imported when it is loaded.
 func ChangePIN(tpm *TPMConnection, path string, oldPIN, newPIN string) error {
+	return ChangePINAtLocation(tpm, FileKeyLocation(path), oldPIN, newPIN)
+}
+
+// ChangePINAtLocation behaves the same as ChangePIN, but changes the PIN for the sealed key data stored at the specified location.
+// If the key data cannot be opened, the error returned from KeyLocation.Open is returned wrapped.
+func ChangePINAtLocation(tpm *TPMConnection, location KeyLocation, oldPIN, newPIN string) (err error) {
+	var keyIDs []KeyID
+	defer func() {
+		tpm.notifyForError(keyIDs, err)
+	}()
+
 	// Check if the TPM is in lockout mode
 	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
 	if err != nil {
@@ -160,39 +180,62 @@ func ChangePIN(tpm *TPMConnection, path string, oldPIN, newPIN string) error {
 		return ErrTPMLockout
 	}
 
+	session, err := tpm.secretSession()
+	if err != nil {
+		return err
+	}
+
 	// Open the key data file
-	keyFile, err := os.Open(path)
+	keyFile, err := location.Open()
 	if err != nil {
 		return xerrors.Errorf("cannot open key data file: %w", err)
 	}
 	defer keyFile.Close()
 
 	// Read and validate the key data file
-	data, _, pcrPolicyCounterPub, err := decodeAndValidateKeyData(tpm.TPMContext, keyFile, nil, tpm.HmacSession())
+	data, _, pcrPolicyCounterPub, err := decodeAndValidateKeyData(tpm.TPMContext, keyFile, nil, session)
 	if err != nil {
 		if isKeyFileError(err) {
 			return InvalidKeyFileError{err.Error()}
 		}
 		return xerrors.Errorf("cannot read and validate key data file: %w", err)
 	}
+	keyIDs = data.keyIDs()
 
 	// Change the PIN
 	if data.version == 0 {
-		if err := performPinChangeV0(tpm.TPMContext, pcrPolicyCounterPub, data.staticPolicyData.v0PinIndexAuthPolicies, oldPIN, newPIN, tpm.HmacSession()); err != nil {
+		if err := performPinChangeV0(tpm.TPMContext, pcrPolicyCounterPub, data.staticPolicyData.v0PinIndexAuthPolicies, oldPIN, newPIN, session); err != nil {
 			if isAuthFailError(err, tpm2.CommandNVChangeAuth, 1) {
 				return ErrPINFail
 			}
 			return err
 		}
 	} else {
-		newKeyPrivate, err := performPinChange(tpm.TPMContext, data.keyPrivate, data.keyPublic, oldPIN, newPIN, tpm.HmacSession())
+		keyPrivate := data.keyPrivate
+		if data.importSymSeed != nil {
+			srk, err := tpm.CreateResourceContextFromTPM(tcg.SRKHandle)
+			if err != nil {
+				return xerrors.Errorf("cannot create context for SRK: %w", err)
+			}
+			keyPrivate, err = data.loadablePrivate(tpm.TPMContext, srk, session)
+			if err != nil {
+				if isKeyFileError(err) {
+					return InvalidKeyFileError{err.Error()}
+				}
+				return err
+			}
+		}
+		newKeyPrivate, err := performPinChange(tpm.TPMContext, keyPrivate, data.keyPublic, oldPIN, newPIN, session)
 		if err != nil {
 			if isAuthFailError(err, tpm2.CommandObjectChangeAuth, 1) {
 				return ErrPINFail
 			}
 			return err
 		}
+		// The new private area is protected by the storage root key rather than being a duplication blob, so the sealed key
+		// object no longer needs to be imported.
 		data.keyPrivate = newKeyPrivate
+		data.importSymSeed = nil
 	}
 
 	// Update the metadata and write a new key data file
@@ -204,12 +247,12 @@ func ChangePIN(tpm *TPMConnection, path string, oldPIN, newPIN string) error {
 	}
 
 	if origAuthModeHint == data.authModeHint && data.version == 0 {
-		return nil
+		return tpm.recordAuditEvent(AuditEventChangePIN, keyIDs, "")
 	}
 
-	if err := data.writeToFileAtomic(path); err != nil {
+	if err := data.writeToLocation(location); err != nil {
 		return xerrors.Errorf("cannot write key data file: %v", err)
 	}
 
-	return nil
+	return tpm.recordAuditEvent(AuditEventChangePIN, keyIDs, "")
 }
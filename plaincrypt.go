@@ -0,0 +1,109 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// PlainCryptParams describes a plain dm-crypt volume. Plain dm-crypt volumes have no on-disk header, so the encryption parameters
+// must be supplied at activation time. This is useful on embedded systems with raw NAND-backed block devices, where a LUKS header
+// is undesirable.
+//
+// Plain dm-crypt volumes have no keyslots, so the sealed key is used directly as the volume key and there is no fallback recovery
+// key.
+type PlainCryptParams struct {
+	Cipher  string // The cipher specification, eg "aes-xts-plain64"
+	KeySize int    // The size of the volume key in bytes
+	Offset  uint64 // The offset of the start of the encrypted data on the device, in 512-byte sectors
+	Skip    uint64 // The number of 512-byte sectors to skip at the start of the IV calculation
+}
+
+// plainCryptParamsRaw is the on-disk form of PlainCryptParams.
+type plainCryptParamsRaw struct {
+	Cipher  []byte
+	KeySize uint16
+	Offset  uint64
+	Skip    uint64
+}
+
+func makePlainCryptParamsRaw(p *PlainCryptParams) *plainCryptParamsRaw {
+	return &plainCryptParamsRaw{
+		Cipher:  []byte(p.Cipher),
+		KeySize: uint16(p.KeySize),
+		Offset:  p.Offset,
+		Skip:    p.Skip}
+}
+
+func (r *plainCryptParamsRaw) data() *PlainCryptParams {
+	return &PlainCryptParams{
+		Cipher:  string(r.Cipher),
+		KeySize: int(r.KeySize),
+		Offset:  r.Offset,
+		Skip:    r.Skip}
+}
+
+// isInsecurePlainCryptCipher indicates whether the supplied cipher specification uses the null cipher, which doesn't encrypt
+// anything, or ECB mode, which leaks patterns in the plaintext.
+func isInsecurePlainCryptCipher(cipher string) bool {
+	for i, c := range strings.Split(strings.ToLower(cipher), "-") {
+		switch {
+		case i == 0 && (c == "cipher_null" || c == "null"):
+			return true
+		case c == "ecb":
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PlainCryptParams) check() error {
+	switch {
+	case p.Cipher == "":
+		return errors.New("no cipher specified")
+	case strings.ContainsAny(p.Cipher, ", "):
+		return fmt.Errorf("invalid cipher %q", p.Cipher)
+	case isInsecurePlainCryptCipher(p.Cipher):
+		return fmt.Errorf("insecure cipher %q", p.Cipher)
+	case p.KeySize <= 0 || p.KeySize > 128:
+		return fmt.Errorf("invalid key size %d", p.KeySize)
+	}
+	return nil
+}
+
+// activateOptions returns the systemd-cryptsetup options required to activate a plain dm-crypt volume with these parameters. The
+// key is passed to systemd-cryptsetup as a key file, and "hash=plain" ensures that it is used as the volume key without hashing.
+func (p *PlainCryptParams) activateOptions() []string {
+	return []string{
+		"plain",
+		"cipher=" + p.Cipher,
+		fmt.Sprintf("size=%d", p.KeySize*8),
+		fmt.Sprintf("offset=%d", p.Offset),
+		fmt.Sprintf("skip=%d", p.Skip),
+		"hash=plain"}
+}
+
+// PlainCrypt returns the parameters of the plain dm-crypt volume that this sealed key object is for, or nil if the volume is a LUKS
+// volume. These parameters aren't integrity protected, so they are informational only and are never used for activation.
+func (k *SealedKeyObject) PlainCrypt() *PlainCryptParams {
+	return k.data.plainCrypt
+}
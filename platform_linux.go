@@ -0,0 +1,124 @@
+//go:build linux
+// +build linux
+
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+// mkfifo creates a FIFO at the specified path that is only accessible by the current user.
+func mkfifo(path string) error {
+	return unix.Mkfifo(path, 0600)
+}
+
+// memfdCreate creates an anonymous memory-backed file with the specified name, which is closed on exec.
+func memfdCreate(name string) (*os.File, error) {
+	fd, err := unix.MemfdCreate(name, unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "memfd:"+name), nil
+}
+
+// disableTerminalEcho disables echo if the supplied file is a terminal, and returns a function that restores it. If the file
+// isn't a terminal, it does nothing and returns a nil function.
+func disableTerminalEcho(f *os.File) (restore func(), err error) {
+	fd := int(f.Fd())
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, nil
+	}
+	noEcho := *termios
+	noEcho.Lflag &^= unix.ECHO
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &noEcho); err != nil {
+		return nil, err
+	}
+	return func() { unix.IoctlSetTermios(fd, unix.TCSETS, termios) }, nil
+}
+
+// waitReadable waits for up to the specified timeout for the supplied file to become readable, and indicates whether it did.
+func waitReadable(f *os.File, timeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false, nil
+		}
+		fds := []unix.PollFd{{Fd: int32(f.Fd()), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, int((remaining+time.Millisecond-1)/time.Millisecond))
+		switch {
+		case err == unix.EINTR:
+			continue
+		case err != nil:
+			return false, err
+		case n > 0:
+			// This includes POLLHUP and POLLERR, in which case the subsequent read returns the error.
+			return true, nil
+		}
+	}
+}
+
+// lockFile acquires an exclusive lock on the supplied file, which is released when it is closed.
+func lockFile(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_EX)
+}
+
+// fileDeviceAndInode returns the device and inode numbers of the supplied file.
+func fileDeviceAndInode(fi os.FileInfo) (dev, ino uint64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(st.Dev), st.Ino, true
+}
+
+// allocLockedMemory allocates a buffer of at least the specified size outside of the Go heap, which is locked so that it cannot be
+// swapped out and excluded from core dumps. It must be freed with freeLockedMemory.
+func allocLockedMemory(size int) ([]byte, error) {
+	n := unix.Getpagesize()
+	for n < size {
+		n += unix.Getpagesize()
+	}
+	mem, err := unix.Mmap(-1, 0, n, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot allocate memory: %w", err)
+	}
+	if err := unix.Mlock(mem); err != nil {
+		unix.Munmap(mem)
+		return nil, xerrors.Errorf("cannot lock memory: %w", err)
+	}
+	// Not all kernels support this, so ignore errors.
+	unix.Madvise(mem, unix.MADV_DONTDUMP)
+	return mem, nil
+}
+
+// freeLockedMemory frees a buffer allocated with allocLockedMemory.
+func freeLockedMemory(mem []byte) {
+	unix.Munlock(mem)
+	unix.Munmap(mem)
+}
@@ -0,0 +1,62 @@
+//go:build !linux
+// +build !linux
+
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// errUnsupportedPlatform is returned from functions that depend on Linux specific interfaces on other platforms.
+var errUnsupportedPlatform = errors.New("not supported on this platform")
+
+func mkfifo(path string) error {
+	return errUnsupportedPlatform
+}
+
+func memfdCreate(name string) (*os.File, error) {
+	return nil, errUnsupportedPlatform
+}
+
+func disableTerminalEcho(f *os.File) (restore func(), err error) {
+	return nil, errUnsupportedPlatform
+}
+
+func waitReadable(f *os.File, timeout time.Duration) (bool, error) {
+	return false, errUnsupportedPlatform
+}
+
+func lockFile(f *os.File) error {
+	return errUnsupportedPlatform
+}
+
+func fileDeviceAndInode(fi os.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
+
+func allocLockedMemory(size int) ([]byte, error) {
+	return nil, errUnsupportedPlatform
+}
+
+func freeLockedMemory(mem []byte) {}
@@ -20,6 +20,7 @@
 package secboot
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rand"
@@ -35,6 +36,10 @@ import (
 var (
 	// lockNVIndex1Attrs are the attributes for the first global lock NV index.
 	lockNVIndex1Attrs = tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA | tpm2.AttrNVReadStClear)
+
+	// pcrPolicyCounterAttrs are the attributes for a PCR policy counter created by createPcrPolicyCounter, before it is
+	// initialized.
+	pcrPolicyCounterAttrs = tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA)
 )
 
 // dynamicPolicyComputeParams provides the parameters to computeDynamicPolicy.
@@ -66,6 +71,11 @@ type dynamicPolicyData struct {
 	policyCount               uint64
 	authorizedPolicy          tpm2.Digest
 	authorizedPolicySignature *tpm2.Signature
+
+	// delegation is set when authorizedPolicySignature was created by an intermediate key that was authorized by the
+	// dynamic authorization policy key. This isn't part of the on-disk format of dynamicPolicyData - it is stored in a
+	// separate extension in version 3 and later key data files.
+	delegation *policyAuthDelegation
 }
 
 // dynamicPolicyDataRaw_v0 is version 0 of the on-disk format of dynamicPolicyData.
@@ -329,11 +339,19 @@ func readPcrPolicyCounter(tpm *tpm2.TPMContext, version uint32, nvPublic *tpm2.N
 // implementing dynamic authorization policy revocation.
 //
 // The NV index will be created with attributes that allow anyone to read the index, and an authorization policy that permits
-// TPM2_NV_Increment with a signed authorization policy.
-func createPcrPolicyCounter(tpm *tpm2.TPMContext, handle tpm2.Handle, updateKeyName tpm2.Name, hmacSession tpm2.SessionContext) (*tpm2.NVPublic, error) {
-	nameAlg := tpm2.HashAlgorithmSHA256
-
-	authPolicies, _ := computePcrPolicyCounterAuthPolicies(nameAlg, updateKeyName)
+// TPM2_NV_Increment with a signed authorization policy. The only other branch of the authorization policy requires
+// TPM2_PolicyNvWritten(false), which permits the index to be initialized here without any authorization but can never be
+// satisfied once it has been written. If the handle is already in use, then NVDefineSpace fails rather than the existing index
+// being used, so an index that has been pre-created or pre-written by someone else can never be associated with a new key.
+// See validatePcrPolicyCounter for the checks performed on the index when it is used subsequently.
+//
+// The name and authorization policy of the index are computed with nameAlg. The functions that operate on the index afterwards use
+// the name algorithm from its public area, so any digest algorithm supported by the TPM can be used.
+func createPcrPolicyCounter(tpm *tpm2.TPMContext, handle tpm2.Handle, nameAlg tpm2.HashAlgorithmId, updateKeyName tpm2.Name, hmacSession tpm2.SessionContext) (*tpm2.NVPublic, error) {
+	authPolicies, err := computePcrPolicyCounterAuthPolicies(nameAlg, updateKeyName)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute authorization policies: %w", err)
+	}
 
 	trial, _ := tpm2.ComputeAuthPolicy(nameAlg)
 	trial.PolicyOR(authPolicies)
@@ -342,7 +360,7 @@ func createPcrPolicyCounter(tpm *tpm2.TPMContext, handle tpm2.Handle, updateKeyN
 	public := &tpm2.NVPublic{
 		Index:      handle,
 		NameAlg:    nameAlg,
-		Attrs:      tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Attrs:      pcrPolicyCounterAttrs,
 		AuthPolicy: trial.GetDigest(),
 		Size:       8}
 
@@ -390,6 +408,53 @@ func createPcrPolicyCounter(tpm *tpm2.TPMContext, handle tpm2.Handle, updateKeyN
 	return public, nil
 }
 
+// computePcrPolicyCounterName computes the name of a PCR policy counter created and initialized by createPcrPolicyCounter, without
+// access to the TPM.
+func computePcrPolicyCounterName(handle tpm2.Handle, nameAlg tpm2.HashAlgorithmId, updateKeyName tpm2.Name) (tpm2.Name, error) {
+	authPolicies, err := computePcrPolicyCounterAuthPolicies(nameAlg, updateKeyName)
+	if err != nil {
+		return nil, err
+	}
+	trial, _ := tpm2.ComputeAuthPolicy(nameAlg)
+	trial.PolicyOR(authPolicies)
+
+	public := &tpm2.NVPublic{
+		Index:      handle,
+		NameAlg:    nameAlg,
+		Attrs:      pcrPolicyCounterAttrs | tpm2.AttrNVWritten,
+		AuthPolicy: trial.GetDigest(),
+		Size:       8}
+	return public.Name()
+}
+
+// validatePcrPolicyCounter checks that the supplied public area of a PCR policy counter for a current key file corresponds to an
+// index created and initialized by createPcrPolicyCounter, with an authorization policy that only permits it to be incremented with
+// a signed authorization from the key associated with updateKeyName. This ensures that the index wasn't replaced by an index at
+// the same handle with a weaker authorization policy.
+func validatePcrPolicyCounter(public *tpm2.NVPublic, updateKeyName tpm2.Name) error {
+	if public.Attrs&^tpm2.AttrNVWritten != pcrPolicyCounterAttrs {
+		return errors.New("PCR policy counter has unexpected attributes")
+	}
+	if public.Attrs&tpm2.AttrNVWritten == 0 {
+		return errors.New("PCR policy counter has not been initialized")
+	}
+	if !public.NameAlg.Supported() {
+		return errors.New("PCR policy counter has an unsupported name algorithm")
+	}
+
+	authPolicies, err := computePcrPolicyCounterAuthPolicies(public.NameAlg, updateKeyName)
+	if err != nil {
+		return xerrors.Errorf("cannot compute expected authorization policy: %w", err)
+	}
+	trial, _ := tpm2.ComputeAuthPolicy(public.NameAlg)
+	trial.PolicyOR(authPolicies)
+	if !bytes.Equal(public.AuthPolicy, trial.GetDigest()) {
+		return errors.New("PCR policy counter has unexpected authorization policy")
+	}
+
+	return nil
+}
+
 // ensureSufficientORDigests turns a single digest in to a pair of identical digests. This is because TPM2_PolicyOR assertions
 // require more than one digest. This avoids having a separate policy sequence when there is only a single digest, without having
 // to store duplicate digests on disk.
@@ -534,36 +599,60 @@ func computeDynamicPolicy(version uint32, alg tpm2.HashAlgorithmId, input *dynam
 		return nil, errors.New("no PCR digests specified")
 	}
 
+	pcrOrData, authorizedPolicy := computeDynamicPolicyDigest(alg, input.pcrs, input.pcrDigests, input.policyCounterName, input.policyCount)
+
+	signature, err := signDynamicPolicy(version, input.signAlg, input.key, authorizedPolicy, input.policyCounterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamicPolicyData{
+		pcrSelection:              input.pcrs,
+		pcrOrData:                 pcrOrData,
+		policyCount:               input.policyCount,
+		authorizedPolicy:          authorizedPolicy,
+		authorizedPolicySignature: signature}, nil
+}
+
+// computeDynamicPolicyDigest computes the unsigned part of the PCR policy computed by computeDynamicPolicy, returning the
+// PolicyOR tree and the authorized policy digest.
+func computeDynamicPolicyDigest(alg tpm2.HashAlgorithmId, pcrs tpm2.PCRSelectionList, pcrDigests tpm2.DigestList, policyCounterName tpm2.Name,
+	policyCount uint64) (policyOrDataTree, tpm2.Digest) {
 	// Compute the policy digest that would result from a TPM2_PolicyPCR assertion for each condition
 	var pcrOrDigests tpm2.DigestList
-	for _, d := range input.pcrDigests {
+	for _, d := range pcrDigests {
 		trial, _ := tpm2.ComputeAuthPolicy(alg)
-		trial.PolicyPCR(d, input.pcrs)
+		trial.PolicyPCR(d, pcrs)
 		pcrOrDigests = append(pcrOrDigests, trial.GetDigest())
 	}
 
 	trial, _ := tpm2.ComputeAuthPolicy(alg)
 	pcrOrData := computePolicyORData(alg, trial, pcrOrDigests)
 
-	if len(input.policyCounterName) > 0 {
+	if len(policyCounterName) > 0 {
 		operandB := make([]byte, 8)
-		binary.BigEndian.PutUint64(operandB, input.policyCount)
-		trial.PolicyNV(input.policyCounterName, operandB, 0, tpm2.OpUnsignedLE)
+		binary.BigEndian.PutUint64(operandB, policyCount)
+		trial.PolicyNV(policyCounterName, operandB, 0, tpm2.OpUnsignedLE)
 	}
 
-	authorizedPolicy := trial.GetDigest()
+	return pcrOrData, trial.GetDigest()
+}
 
+// signDynamicPolicy signs the authorized policy digest computed by computeDynamicPolicyDigest with the supplied dynamic
+// authorization policy key.
+func signDynamicPolicy(version uint32, signAlg tpm2.HashAlgorithmId, key crypto.PrivateKey, authorizedPolicy tpm2.Digest,
+	policyCounterName tpm2.Name) (*tpm2.Signature, error) {
 	// Create a digest to sign
-	h := input.signAlg.NewHash()
+	h := signAlg.NewHash()
 	h.Write(authorizedPolicy)
 	if version > 0 {
-		h.Write(computePcrPolicyRefFromCounterName(input.policyCounterName))
+		h.Write(computePcrPolicyRefFromCounterName(policyCounterName))
 	}
 
 	// Sign the digest
 	var signature tpm2.Signature
 	if version == 0 {
-		sig, err := rsa.SignPSS(rand.Reader, input.key.(*rsa.PrivateKey), input.signAlg.GetHash(), h.Sum(nil),
+		sig, err := rsa.SignPSS(rand.Reader, key.(*rsa.PrivateKey), signAlg.GetHash(), h.Sum(nil),
 			&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
 		if err != nil {
 			return nil, xerrors.Errorf("cannot provide signature for initializing NV index: %w", err)
@@ -573,10 +662,10 @@ func computeDynamicPolicy(version uint32, alg tpm2.HashAlgorithmId, input *dynam
 			SigAlg: tpm2.SigSchemeAlgRSAPSS,
 			Signature: tpm2.SignatureU{
 				Data: &tpm2.SignatureRSAPSS{
-					Hash: input.signAlg,
+					Hash: signAlg,
 					Sig:  tpm2.PublicKeyRSA(sig)}}}
 	} else {
-		sigR, sigS, err := ecdsa.Sign(rand.Reader, input.key.(*ecdsa.PrivateKey), h.Sum(nil))
+		sigR, sigS, err := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), h.Sum(nil))
 		if err != nil {
 			return nil, xerrors.Errorf("cannot provide signature for initializing NV index: %w", err)
 		}
@@ -585,17 +674,12 @@ func computeDynamicPolicy(version uint32, alg tpm2.HashAlgorithmId, input *dynam
 			SigAlg: tpm2.SigSchemeAlgECDSA,
 			Signature: tpm2.SignatureU{
 				Data: &tpm2.SignatureECDSA{
-					Hash:       input.signAlg,
+					Hash:       signAlg,
 					SignatureR: sigR.Bytes(),
 					SignatureS: sigS.Bytes()}}}
 	}
 
-	return &dynamicPolicyData{
-		pcrSelection:              input.pcrs,
-		pcrOrData:                 pcrOrData,
-		policyCount:               input.policyCount,
-		authorizedPolicy:          authorizedPolicy,
-		authorizedPolicySignature: &signature}, nil
+	return &signature, nil
 }
 
 type staticPolicyDataError struct {
@@ -632,11 +716,31 @@ func isDynamicPolicyDataError(err error) bool {
 	return xerrors.As(err, &e)
 }
 
+// findPolicyORLeaf returns the index of the leaf node in the data produced by computePolicyORData that contains the supplied
+// digest, or -1 if there isn't one.
+func findPolicyORLeaf(data policyOrDataTree, digest tpm2.Digest) int {
+	if len(data) == 0 {
+		return -1
+	}
+
+	end := data[0].Next
+	if end == 0 {
+		end = 1
+	}
+
+	for i := 0; i < len(data) && i < int(end); i++ {
+		if digestListContains(data[i].Digests, digest) {
+			return i
+		}
+	}
+	return -1
+}
+
 // executePolicyORAssertions takes the data produced by computePolicyORData and executes a sequence of TPM2_PolicyOR assertions, in
 // order to support compound policies with more than 8 conditions.
-func executePolicyORAssertions(tpm *tpm2.TPMContext, session tpm2.SessionContext, data policyOrDataTree) error {
+func executePolicyORAssertions(tpm *tpm2.TPMContext, session tpm2.SessionContext, data policyOrDataTree, extraSessions ...tpm2.SessionContext) error {
 	// First of all, obtain the current digest of the session.
-	currentDigest, err := tpm.PolicyGetDigest(session)
+	currentDigest, err := tpm.PolicyGetDigest(session, extraSessions...)
 	if err != nil {
 		return xerrors.Errorf("cannot obtain current session digest: %w", err)
 	}
@@ -646,19 +750,7 @@ func executePolicyORAssertions(tpm *tpm2.TPMContext, session tpm2.SessionContext
 	}
 
 	// Find the leaf node that contains the current digest of the session.
-	index := -1
-	end := data[0].Next
-	if end == 0 {
-		end = 1
-	}
-
-	for i := 0; i < len(data) && i < int(end); i++ {
-		if digestListContains(data[i].Digests, currentDigest) {
-			// We've got a match!
-			index = i
-			break
-		}
-	}
+	index := findPolicyORLeaf(data, currentDigest)
 	if index == -1 {
 		return errors.New("current session digest not found in policy data")
 	}
@@ -667,7 +759,7 @@ func executePolicyORAssertions(tpm *tpm2.TPMContext, session tpm2.SessionContext
 	// TPM2_PolicyOR assertions along the way.
 	for lastIndex := -1; index > lastIndex && index < len(data); index += int(data[index].Next) {
 		lastIndex = index
-		if err := tpm.PolicyOR(session, ensureSufficientORDigests(data[index].Digests)); err != nil {
+		if err := tpm.PolicyOR(session, ensureSufficientORDigests(data[index].Digests), extraSessions...); err != nil {
 			return err
 		}
 		if data[index].Next == 0 {
@@ -679,14 +771,15 @@ func executePolicyORAssertions(tpm *tpm2.TPMContext, session tpm2.SessionContext
 }
 
 // executePolicySession executes an authorization policy session using the supplied metadata. On success, the supplied policy
-// session can be used for authorization.
+// session can be used for authorization. Any sessions supplied via the extraSessions argument are included in every command
+// executed on the TPM, which is used to support audit sessions.
 func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContext, version uint32, staticInput *staticPolicyData,
-	dynamicInput *dynamicPolicyData, pin string, hmacSession tpm2.SessionContext) error {
-	if err := tpm.PolicyPCR(policySession, nil, dynamicInput.pcrSelection); err != nil {
+	dynamicInput *dynamicPolicyData, pin []byte, hmacSession tpm2.SessionContext, extraSessions ...tpm2.SessionContext) error {
+	if err := tpm.PolicyPCR(policySession, nil, dynamicInput.pcrSelection, extraSessions...); err != nil {
 		return xerrors.Errorf("cannot execute PCR assertion: %w", err)
 	}
 
-	if err := executePolicyORAssertions(tpm, policySession, dynamicInput.pcrOrData); err != nil {
+	if err := executePolicyORAssertions(tpm, policySession, dynamicInput.pcrOrData, extraSessions...); err != nil {
 		switch {
 		case tpm2.IsTPMError(err, tpm2.AnyErrorCode, tpm2.CommandPolicyGetDigest):
 			return xerrors.Errorf("cannot execute OR assertions: %w", err)
@@ -705,7 +798,7 @@ func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContex
 	var policyCounter tpm2.ResourceContext
 	if pcrPolicyCounterHandle != tpm2.HandleNull {
 		var err error
-		policyCounter, err = tpm.CreateResourceContextFromTPM(pcrPolicyCounterHandle)
+		policyCounter, err = tpm.CreateResourceContextFromTPM(pcrPolicyCounterHandle, extraSessions...)
 		switch {
 		case tpm2.IsResourceUnavailableError(err, pcrPolicyCounterHandle):
 			// If there is no NV index at the expected handle then the key file is invalid and must be recreated.
@@ -716,7 +809,7 @@ func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContex
 
 		var revocationCheckSession tpm2.SessionContext
 		if version == 0 {
-			policyCounterPub, _, err := tpm.NVReadPublic(policyCounter)
+			policyCounterPub, _, err := tpm.NVReadPublic(policyCounter, extraSessions...)
 			if err != nil {
 				return xerrors.Errorf("cannot read public area for PCR policy counter: %w", err)
 			}
@@ -734,21 +827,35 @@ func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContex
 			// See the comment for computeV0PinNVIndexPostInitAuthPolicies for a description of the authorization policy
 			// for the v0 NV index. Because the v0 NV index was also used for the PIN, it needed an authorization policy to
 			// permit using the counter value in an assertion without knowing the authorization value of the index.
-			if err := tpm.PolicyCommandCode(revocationCheckSession, tpm2.CommandPolicyNV); err != nil {
+			if err := tpm.PolicyCommandCode(revocationCheckSession, tpm2.CommandPolicyNV, extraSessions...); err != nil {
 				return xerrors.Errorf("cannot execute assertion for PCR policy revocation check: %w", err)
 			}
-			if err := tpm.PolicyOR(revocationCheckSession, staticInput.v0PinIndexAuthPolicies); err != nil {
+			if err := tpm.PolicyOR(revocationCheckSession, staticInput.v0PinIndexAuthPolicies, extraSessions...); err != nil {
 				if tpm2.IsTPMParameterError(err, tpm2.ErrorValue, tpm2.CommandPolicyOR, 1) {
 					// staticInput.v0PinIndexAuthPolicies is invalid.
 					return staticPolicyDataError{errors.New("authorization policy metadata for PCR policy counter is invalid")}
 				}
 				return xerrors.Errorf("cannot execute assertion for PCR policy revocation check: %w", err)
 			}
+		} else {
+			// Make sure that the PCR policy counter is the one that was created and initialized by createPcrPolicyCounter
+			// rather than an index that was created at the same handle by someone else with a weaker authorization policy.
+			policyCounterPub, _, err := tpm.NVReadPublic(policyCounter, extraSessions...)
+			if err != nil {
+				return xerrors.Errorf("cannot read public area for PCR policy counter: %w", err)
+			}
+			authKeyName, err := staticInput.authPublicKey.Name()
+			if err != nil {
+				return staticPolicyDataError{xerrors.Errorf("cannot compute name of dynamic authorization policy key: %w", err)}
+			}
+			if err := validatePcrPolicyCounter(policyCounterPub, authKeyName); err != nil {
+				return staticPolicyDataError{err}
+			}
 		}
 
 		operandB := make([]byte, 8)
 		binary.BigEndian.PutUint64(operandB, dynamicInput.policyCount)
-		if err := tpm.PolicyNV(policyCounter, policyCounter, policySession, operandB, 0, tpm2.OpUnsignedLE, revocationCheckSession); err != nil {
+		if err := tpm.PolicyNV(policyCounter, policyCounter, policySession, operandB, 0, tpm2.OpUnsignedLE, revocationCheckSession, extraSessions...); err != nil {
 			switch {
 			case tpm2.IsTPMError(err, tpm2.ErrorPolicy, tpm2.CommandPolicyNV):
 				// The PCR policy has been revoked.
@@ -765,7 +872,7 @@ func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContex
 	if !authPublicKey.NameAlg.Supported() {
 		return staticPolicyDataError{errors.New("public area of dynamic authorization policy signing key has an unsupported name algorithm")}
 	}
-	authorizeKey, err := tpm.LoadExternal(nil, authPublicKey, tpm2.HandleOwner)
+	authorizeKey, err := tpm.LoadExternal(nil, authPublicKey, tpm2.HandleOwner, extraSessions...)
 	if err != nil {
 		if tpm2.IsTPMParameterError(err, tpm2.AnyErrorCode, tpm2.CommandLoadExternal, 2) {
 			// staticInput.AuthPublicKey is invalid
@@ -783,11 +890,23 @@ func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContex
 		pcrPolicyRef = computePcrPolicyRefFromCounterContext(policyCounter)
 	}
 
+	approvedPolicy := dynamicInput.authorizedPolicy
+	approvedPolicySignature := dynamicInput.authorizedPolicySignature
+	if dynamicInput.delegation != nil {
+		// The PCR policy is signed by an intermediate key. Authorize it with that key first, which leaves the session with a
+		// digest corresponding to the delegated policy that was signed by the dynamic authorization policy key.
+		approvedPolicy, err = executeDelegatedPolicyAuthorization(tpm, policySession, dynamicInput, pcrPolicyRef, policyCounter, extraSessions...)
+		if err != nil {
+			return err
+		}
+		approvedPolicySignature = dynamicInput.delegation.signature
+	}
+
 	h := authPublicKey.NameAlg.NewHash()
-	h.Write(dynamicInput.authorizedPolicy)
+	h.Write(approvedPolicy)
 	h.Write(pcrPolicyRef)
 
-	authorizeTicket, err := tpm.VerifySignature(authorizeKey, h.Sum(nil), dynamicInput.authorizedPolicySignature)
+	authorizeTicket, err := tpm.VerifySignature(authorizeKey, h.Sum(nil), approvedPolicySignature, extraSessions...)
 	if err != nil {
 		if tpm2.IsTPMParameterError(err, tpm2.AnyErrorCode, tpm2.CommandVerifySignature, 2) {
 			// dynamicInput.AuthorizedPolicySignature or the computed policy ref is invalid.
@@ -798,7 +917,7 @@ func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContex
 		return xerrors.Errorf("cannot verify PCR policy signature: %w", err)
 	}
 
-	if err := tpm.PolicyAuthorize(policySession, dynamicInput.authorizedPolicy, pcrPolicyRef, authorizeKey.Name(), authorizeTicket); err != nil {
+	if err := tpm.PolicyAuthorize(policySession, approvedPolicy, pcrPolicyRef, authorizeKey.Name(), authorizeTicket, extraSessions...); err != nil {
 		if tpm2.IsTPMParameterError(err, tpm2.ErrorValue, tpm2.CommandPolicyAuthorize, 1) {
 			// dynamicInput.AuthorizedPolicy is invalid.
 			return dynamicPolicyDataError{errors.New("the PCR policy is invalid")}
@@ -809,14 +928,14 @@ func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContex
 	if version == 0 {
 		// For metadata version 0, PIN support is implemented by asserting knowlege of the authorization value
 		// for the PCR policy counter.
-		policyCounter.SetAuthValue([]byte(pin))
-		if _, _, err := tpm.PolicySecret(policyCounter, policySession, nil, nil, 0, hmacSession); err != nil {
+		policyCounter.SetAuthValue(pin)
+		if _, _, err := tpm.PolicySecret(policyCounter, policySession, nil, nil, 0, hmacSession, extraSessions...); err != nil {
 			return xerrors.Errorf("cannot execute PolicySecret assertion: %w", err)
 		}
 	} else {
 		// For metadata versions > 0, PIN support is implemented by requiring knowlege of the authorization value for
 		// the sealed key object when this policy session is used to unseal it.
-		if err := tpm.PolicyAuthValue(policySession); err != nil {
+		if err := tpm.PolicyAuthValue(policySession, extraSessions...); err != nil {
 			return xerrors.Errorf("cannot execute PolicyAuthValue assertion: %w", err)
 		}
 	}
@@ -826,11 +945,11 @@ func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContex
 		// this is only here because the existing policy for v0 files requires it. It is not expected that
 		// this will fail unless the NV index has been removed or altered, at which point the key is
 		// non-recoverable anyway.
-		index, err := tpm.CreateResourceContextFromTPM(lockNVHandle)
+		index, err := tpm.CreateResourceContextFromTPM(lockNVHandle, extraSessions...)
 		if err != nil {
 			return xerrors.Errorf("cannot obtain context for lock NV index: %w", err)
 		}
-		if err := tpm.PolicyNV(index, index, policySession, nil, 0, tpm2.OpEq, nil); err != nil {
+		if err := tpm.PolicyNV(index, index, policySession, nil, 0, tpm2.OpEq, nil, extraSessions...); err != nil {
 			return xerrors.Errorf("policy lock check failed: %w", err)
 		}
 	}
@@ -846,8 +965,11 @@ func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContex
 // This acts as a barrier between the environment in which a sealed key should be permitted to be unsealed
 // (eg, the initramfs), and the environment in which a sealed key should not be permitted to be unsealed
 // (eg, the OS runtime).
+//
+// As the fence does not survive a TPM restart, it is removed when the system resumes from hibernation. Use
+// LockPCRProtectionPolicies instead to be able to detect this and re-arm the fence.
 func BlockPCRProtectionPolicies(tpm *TPMConnection, pcrs []int) error {
-	session := tpm.HmacSession()
+	session := tpm.currentHmacSession()
 
 	// The fence is a hash of uint32(0), which is the same as EV_SEPARATOR (which can be uint32(0) or uint32(-1))
 	fence := make([]byte, 4)
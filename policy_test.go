@@ -49,7 +49,7 @@ func TestIncrementPcrPolicyCounter(t *testing.T) {
 		t.Fatalf("Cannot compute key name: %v", err)
 	}
 
-	policyCounterPub, err := CreatePcrPolicyCounter(tpm.TPMContext, 0x0181ff00, keyName, tpm.HmacSession())
+	policyCounterPub, err := CreatePcrPolicyCounter(tpm.TPMContext, 0x0181ff00, tpm2.HashAlgorithmSHA256, keyName, tpm.HmacSession())
 	if err != nil {
 		t.Fatalf("CreatePcrPolicyCounter failed: %v", err)
 	}
@@ -101,7 +101,7 @@ func TestReadPcrPolicyCounter(t *testing.T) {
 		t.Fatalf("NVReadCounter failed: %v", err)
 	}
 
-	policyCounterPub, err := CreatePcrPolicyCounter(tpm.TPMContext, 0x0181ff00, nil, tpm.HmacSession())
+	policyCounterPub, err := CreatePcrPolicyCounter(tpm.TPMContext, 0x0181ff00, tpm2.HashAlgorithmSHA256, nil, tpm.HmacSession())
 	if err != nil {
 		t.Fatalf("CreatePcrPolicyCounter failed: %v", err)
 	}
@@ -780,7 +780,7 @@ func TestExecutePolicy(t *testing.T) {
 		t.Fatalf("Cannot compute key name: %v", err)
 	}
 
-	policyCounterPub, err := CreatePcrPolicyCounter(tpm.TPMContext, 0x0181ff00, keyName, tpm.HmacSession())
+	policyCounterPub, err := CreatePcrPolicyCounter(tpm.TPMContext, 0x0181ff00, tpm2.HashAlgorithmSHA256, keyName, tpm.HmacSession())
 	if err != nil {
 		t.Fatalf("CreatePcrPolicyCounter failed: %v", err)
 	}
@@ -848,7 +848,7 @@ func TestExecutePolicy(t *testing.T) {
 		}
 		defer flushContext(t, tpm, session)
 
-		policyErr := ExecutePolicySession(tpm.TPMContext, session, CurrentMetadataVersion, staticPolicyData, dynamicPolicyData, "", tpm.HmacSession())
+		policyErr := ExecutePolicySession(tpm.TPMContext, session, CurrentMetadataVersion, staticPolicyData, dynamicPolicyData, nil, tpm.HmacSession())
 		digest, err := tpm.PolicyGetDigest(session)
 		if err != nil {
 			t.Errorf("PolicyGetDigest failed: %v", err)
@@ -0,0 +1,337 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+
+	"golang.org/x/xerrors"
+)
+
+// pcrPolicyUpdatePackageVersion is the current version of the serialized PCR policy update package format.
+const pcrPolicyUpdatePackageVersion = 1
+
+// pcrPolicyUpdatePackageBodyRaw is the signed part of a serialized PCR policy update package.
+type pcrPolicyUpdatePackageBodyRaw struct {
+	KeyAuthPolicy             tpm2.Digest // The static authorization policy digest of the sealed key objects that the package applies to
+	CreationTime              uint64      // Seconds since the UNIX epoch, or zero if not set
+	Description               []byte
+	PCRs                      tpm2.PCRSelectionList
+	PCRDigests                tpm2.DigestList
+	PCRPolicyCounterName      tpm2.Name
+	PCRPolicyCount            uint64
+	AuthorizedPolicy          tpm2.Digest
+	AuthorizedPolicySignature *tpm2.Signature
+}
+
+// pcrPolicyUpdatePackageRaw is the serialized form of PCRPolicyUpdatePackage.
+type pcrPolicyUpdatePackageRaw struct {
+	Version   uint32
+	Body      pcrPolicyUpdatePackageBodyRaw
+	Signature *tpm2.Signature
+}
+
+// PCRPolicyUpdatePackage is a signed PCR policy that can be installed on a device with ApplyPCRPolicyUpdatePackage, without the
+// device having access to the dynamic authorization policy key. It is created by a signing service with NewPCRPolicyUpdatePackage
+// and is transferred to devices in the form returned from MarshalBinary.
+type PCRPolicyUpdatePackage struct {
+	Policy       *PrecomputedPCRPolicy // The signed PCR policy
+	Description  string                // A human readable description of the update
+	CreationTime time.Time             // The time that the package was created
+
+	keyAuthPolicy tpm2.Digest
+	signature     *tpm2.Signature
+}
+
+func (p *PCRPolicyUpdatePackage) body() *pcrPolicyUpdatePackageBodyRaw {
+	body := &pcrPolicyUpdatePackageBodyRaw{
+		KeyAuthPolicy:             p.keyAuthPolicy,
+		Description:               []byte(p.Description),
+		PCRs:                      p.Policy.PCRs,
+		PCRDigests:                p.Policy.PCRDigests,
+		PCRPolicyCounterName:      p.Policy.PCRPolicyCounterName,
+		PCRPolicyCount:            p.Policy.PCRPolicyCount,
+		AuthorizedPolicy:          p.Policy.AuthorizedPolicy,
+		AuthorizedPolicySignature: p.Policy.Signature}
+	if !p.CreationTime.IsZero() {
+		body.CreationTime = uint64(p.CreationTime.Unix())
+	}
+	return body
+}
+
+// computePCRPolicyUpdatePackageDigest computes the digest of the supplied package body that is signed by the dynamic authorization
+// policy key. The digest is domain separated from the digests of PCR policies signed with the same key.
+func computePCRPolicyUpdatePackageDigest(alg tpm2.HashAlgorithmId, body *pcrPolicyUpdatePackageBodyRaw) (tpm2.Digest, error) {
+	b, err := mu.MarshalToBytes(body)
+	if err != nil {
+		return nil, err
+	}
+
+	h := alg.NewHash()
+	h.Write([]byte("PCR-POLICY-UPDATE-PACKAGE"))
+	h.Write(b)
+	return h.Sum(nil), nil
+}
+
+// NewPCRPolicyUpdatePackage creates a signed package containing the supplied PCR policy, which must have been computed and signed
+// for the supplied sealed key object with ComputePCRPolicy and PrecomputedPCRPolicy.Sign or with PrecomputePCRPolicy. The package is
+// signed with the private part of the dynamic authorization policy key for the sealed key object, which is supplied via the authKey
+// argument. This does not require access to the TPM.
+//
+// The package can be installed on any related sealed key object with ApplyPCRPolicyUpdatePackage.
+func NewPCRPolicyUpdatePackage(k *SealedKeyObject, authKey TPMPolicyAuthKey, policy *PrecomputedPCRPolicy, description string) (*PCRPolicyUpdatePackage, error) {
+	if k.data.version < 1 {
+		return nil, errors.New("PCR policy update packages require a version 1 or later key data file")
+	}
+	if policy == nil || policy.Signature == nil {
+		return nil, errors.New("PCR policy is not signed")
+	}
+
+	authPublicKey := k.data.staticPolicyData.authPublicKey
+	key, err := createECDSAPrivateKeyFromTPM(authPublicKey, tpm2.ECCParameter(authKey))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create dynamic authorization policy key: %w", err)
+	}
+	if x, y := key.Curve.ScalarBaseMult(authKey); x.Cmp(key.X) != 0 || y.Cmp(key.Y) != 0 {
+		return nil, errors.New("dynamic authorization policy key does not correspond to the sealed key object")
+	}
+
+	pkg := &PCRPolicyUpdatePackage{
+		Policy:        policy,
+		Description:   description,
+		CreationTime:  time.Unix(timeNow().Unix(), 0),
+		keyAuthPolicy: k.data.keyPublic.AuthPolicy}
+
+	digest, err := computePCRPolicyUpdatePackageDigest(authPublicKey.NameAlg, pkg.body())
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute package digest: %w", err)
+	}
+	sigR, sigS, err := ecdsa.Sign(rand.Reader, key, digest)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot sign package: %w", err)
+	}
+	pkg.signature = &tpm2.Signature{
+		SigAlg: tpm2.SigSchemeAlgECDSA,
+		Signature: tpm2.SignatureU{
+			Data: &tpm2.SignatureECDSA{
+				Hash:       authPublicKey.NameAlg,
+				SignatureR: sigR.Bytes(),
+				SignatureS: sigS.Bytes()}}}
+
+	return pkg, nil
+}
+
+// MarshalBinary serializes this package so that it can be transferred to devices.
+func (p *PCRPolicyUpdatePackage) MarshalBinary() ([]byte, error) {
+	if p.Policy == nil || p.signature == nil {
+		return nil, errors.New("package is not signed")
+	}
+	return mu.MarshalToBytes(pcrPolicyUpdatePackageRaw{
+		Version:   pcrPolicyUpdatePackageVersion,
+		Body:      *p.body(),
+		Signature: p.signature})
+}
+
+// UnmarshalBinary deserializes a package that was serialized with MarshalBinary. The signature is not checked until the package
+// is applied with ApplyPCRPolicyUpdatePackage.
+func (p *PCRPolicyUpdatePackage) UnmarshalBinary(data []byte) error {
+	var raw pcrPolicyUpdatePackageRaw
+	if _, err := mu.UnmarshalFromBytes(data, &raw); err != nil {
+		return xerrors.Errorf("cannot unmarshal package: %w", err)
+	}
+	if raw.Version != pcrPolicyUpdatePackageVersion {
+		return fmt.Errorf("unsupported package version %d", raw.Version)
+	}
+
+	*p = PCRPolicyUpdatePackage{
+		Policy: &PrecomputedPCRPolicy{
+			PCRs:                 raw.Body.PCRs,
+			PCRDigests:           raw.Body.PCRDigests,
+			PCRPolicyCounterName: raw.Body.PCRPolicyCounterName,
+			PCRPolicyCount:       raw.Body.PCRPolicyCount,
+			AuthorizedPolicy:     raw.Body.AuthorizedPolicy,
+			Signature:            raw.Body.AuthorizedPolicySignature},
+		Description:   string(raw.Body.Description),
+		keyAuthPolicy: raw.Body.KeyAuthPolicy,
+		signature:     raw.Signature}
+	if raw.Body.CreationTime != 0 {
+		p.CreationTime = time.Unix(int64(raw.Body.CreationTime), 0)
+	}
+	return nil
+}
+
+// verifyECDSASignature verifies the supplied signature of digest with the public area of an ECC key.
+func verifyECDSASignature(public *tpm2.Public, digest []byte, signature *tpm2.Signature) bool {
+	if signature == nil || signature.SigAlg != tpm2.SigSchemeAlgECDSA || signature.Signature.ECDSA().Hash != public.NameAlg {
+		return false
+	}
+	key, err := createECDSAPublicKeyFromTPM(public)
+	if err != nil {
+		return false
+	}
+	return ecdsa.Verify(key, digest, new(big.Int).SetBytes(signature.Signature.ECDSA().SignatureR),
+		new(big.Int).SetBytes(signature.Signature.ECDSA().SignatureS))
+}
+
+// verify checks that this package is signed by the dynamic authorization policy key of the supplied key data, that it applies to
+// the key data, and that the PCR policy it contains is consistent and signed. On success, it returns the dynamic policy metadata
+// to install.
+func (p *PCRPolicyUpdatePackage) verify(data *keyData, counterName tpm2.Name) (*dynamicPolicyData, error) {
+	authPublicKey := data.staticPolicyData.authPublicKey
+
+	digest, err := computePCRPolicyUpdatePackageDigest(authPublicKey.NameAlg, p.body())
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute package digest: %w", err)
+	}
+	if !verifyECDSASignature(authPublicKey, digest, p.signature) {
+		return nil, errors.New("invalid package signature")
+	}
+
+	if !bytes.Equal(p.keyAuthPolicy, data.keyPublic.AuthPolicy) || !bytes.Equal(p.Policy.PCRPolicyCounterName, counterName) {
+		return nil, errors.New("package is not for the supplied key data files")
+	}
+
+	policyData, err := p.Policy.dynamicPolicyData(data.keyPublic.NameAlg)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid PCR policy: %w", err)
+	}
+
+	h := authPublicKey.NameAlg.NewHash()
+	h.Write(policyData.authorizedPolicy)
+	h.Write(computePcrPolicyRefFromCounterName(counterName))
+	if !verifyECDSASignature(authPublicKey, h.Sum(nil), policyData.authorizedPolicySignature) {
+		return nil, errors.New("invalid PCR policy signature")
+	}
+
+	return policyData, nil
+}
+
+// ApplyPCRPolicyUpdatePackage installs the PCR policy from the supplied package in to the related sealed keys at the specified
+// locations. The package signature and the signature of the PCR policy are verified with the dynamic authorization policy public
+// key stored in the sealed key objects, so the private part of that key is not required on the device.
+//
+// Because the PCR policy counter can only be incremented with the private part of the dynamic authorization policy key, installing
+// a package does not revoke the previous PCR policy. Previous policies can be revoked by updating the PCR policy with the key with
+// UpdateKeyPCRProtectionPolicyMultiple. A package containing a PCR policy with a count lower than the current value of the PCR
+// policy counter has been revoked and cannot be installed.
+//
+// If any location cannot be opened, the error returned from KeyLocation.Open will be returned wrapped. If any key data cannot be
+// deserialized correctly, validation fails or the package is not valid for the sealed keys, a InvalidKeyFileError error will be
+// returned.
+//
+// On success, the key data at each location is updated atomically with the PCR policy from the package.
+func ApplyPCRPolicyUpdatePackage(tpmConn *TPMConnection, keyLocations []KeyLocation, pkg *PCRPolicyUpdatePackage) error {
+	tpm := tpmConn.TPMContext
+	session, err := tpmConn.secretSession()
+	if err != nil {
+		return err
+	}
+
+	if len(keyLocations) == 0 {
+		return errors.New("no key files supplied")
+	}
+	if pkg == nil || pkg.Policy == nil {
+		return errors.New("no package supplied")
+	}
+
+	var datas []*keyData
+	var pcrPolicyCounterPub *tpm2.NVPublic
+	for i, l := range keyLocations {
+		keyFile, err := l.Open()
+		if err != nil {
+			return xerrors.Errorf("cannot open key data file: %w", err)
+		}
+		defer keyFile.Close()
+
+		data, _, counterPub, err := decodeAndValidateKeyData(tpm, keyFile, nil, session)
+		if err != nil {
+			if isKeyFileError(err) {
+				return InvalidKeyFileError{err.Error() + " (" + l.String() + ")"}
+			}
+			return xerrors.Errorf("cannot read and validate key data file: %w", err)
+		}
+		if data.version < 1 {
+			return InvalidKeyFileError{"PCR policy update packages require a version 1 or later key data file (" + l.String() + ")"}
+		}
+		if i == 0 {
+			pcrPolicyCounterPub = counterPub
+		} else if !bytes.Equal(data.keyPublic.AuthPolicy, datas[0].keyPublic.AuthPolicy) {
+			return InvalidKeyFileError{"key data file " + l.String() + " is not a related key file"}
+		}
+		datas = append(datas, data)
+	}
+
+	var counterName tpm2.Name
+	if pcrPolicyCounterPub != nil {
+		var err error
+		counterName, err = pcrPolicyCounterPub.Name()
+		if err != nil {
+			return xerrors.Errorf("cannot compute name of PCR policy counter: %w", err)
+		}
+	}
+
+	policyData, err := pkg.verify(datas[0], counterName)
+	if err != nil {
+		return InvalidKeyFileError{"the PCR policy update package is not valid for the supplied key data files: " + err.Error()}
+	}
+
+	if pcrPolicyCounterPub != nil {
+		count, err := readPcrPolicyCounter(tpm, datas[0].version, pcrPolicyCounterPub, nil, session)
+		if err != nil {
+			return xerrors.Errorf("cannot read PCR policy counter: %w", err)
+		}
+		if count > policyData.policyCount {
+			return InvalidKeyFileError{"the PCR policy in the update package has been revoked"}
+		}
+	}
+
+	var keyIDs []KeyID
+	for i, data := range datas {
+		data.dynamicPolicyData = policyData
+		if data.version >= 3 {
+			data.tpmFirmwareInfo = tpmConn.firmwareInfo
+			if data.identity == nil {
+				identity, err := newKeyIdentity()
+				if err != nil {
+					return xerrors.Errorf("cannot create key identity: %w", err)
+				}
+				data.identity = identity
+			} else {
+				data.identity.Generation++
+			}
+		}
+
+		if err := data.writeToLocation(keyLocations[i]); err != nil {
+			return xerrors.Errorf("cannot write key data file: %v", err)
+		}
+		keyIDs = append(keyIDs, data.keyIDs()...)
+	}
+
+	return tpmConn.recordAuditEvent(AuditEventReseal, keyIDs, fmt.Sprintf("PCR policy update package: %s", pkg.Description))
+}
@@ -0,0 +1,138 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	. "github.com/snapcore/secboot"
+)
+
+func TestPCRPolicyUpdatePackage(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestPCRPolicyUpdatePackage_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	// Seal the key to a PCR value that isn't the current one, so that it can only be unsealed once the update is installed.
+	initialProfile := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make(tpm2.Digest, 32))
+	authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: initialProfile, PCRPolicyCounterHandle: 0x01810000})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	_, values, err := tpm.PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}})
+	if err != nil {
+		t.Fatalf("PCRRead failed: %v", err)
+	}
+	profile := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, values[tpm2.HashAlgorithmSHA256][7])
+
+	// Create the package on the signing service and transfer it to the device.
+	createPackage := func(t *testing.T) *PCRPolicyUpdatePackage {
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		policy, err := PrecomputePCRPolicy(k, authKey, profile, nil)
+		if err != nil {
+			t.Fatalf("PrecomputePCRPolicy failed: %v", err)
+		}
+		pkg, err := NewPCRPolicyUpdatePackage(k, authKey, policy, "test update")
+		if err != nil {
+			t.Fatalf("NewPCRPolicyUpdatePackage failed: %v", err)
+		}
+
+		b, err := pkg.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary failed: %v", err)
+		}
+		var out PCRPolicyUpdatePackage
+		if err := out.UnmarshalBinary(b); err != nil {
+			t.Fatalf("UnmarshalBinary failed: %v", err)
+		}
+		if out.Description != "test update" {
+			t.Errorf("Unexpected description %q", out.Description)
+		}
+		return &out
+	}
+
+	t.Run("Tampered", func(t *testing.T) {
+		pkg := createPackage(t)
+		pkg.Description = "something else"
+		err := ApplyPCRPolicyUpdatePackage(tpm, []KeyLocation{FileKeyLocation(keyFile)}, pkg)
+		if err == nil || err.Error() != "invalid key data file: the PCR policy update package is not valid for the supplied key data "+
+			"files: invalid package signature" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Apply", func(t *testing.T) {
+		pkg := createPackage(t)
+		if err := ApplyPCRPolicyUpdatePackage(tpm, []KeyLocation{FileKeyLocation(keyFile)}, pkg); err != nil {
+			t.Fatalf("ApplyPCRPolicyUpdatePackage failed: %v", err)
+		}
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("Unexpected unsealed key")
+		}
+	})
+
+	t.Run("Revoked", func(t *testing.T) {
+		pkg := createPackage(t)
+
+		// Updating the policy with the key increments the PCR policy counter, which revokes the package.
+		if err := UpdateKeyPCRProtectionPolicy(tpm, keyFile, authKey, profile); err != nil {
+			t.Fatalf("UpdateKeyPCRProtectionPolicy failed: %v", err)
+		}
+
+		err := ApplyPCRPolicyUpdatePackage(tpm, []KeyLocation{FileKeyLocation(keyFile)}, pkg)
+		if err == nil || err.Error() != "invalid key data file: the PCR policy in the update package has been revoked" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,177 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// PCRPolicyComputeParams provides parameters to ComputePCRPolicy and PrecomputePCRPolicy.
+type PCRPolicyComputeParams struct {
+	// PCRPolicyCounterNameAlg is the name algorithm of the PCR policy counter of the sealed key object, which is required to
+	// compute its name without access to the TPM. See the PCRPolicyCounterNameAlg field of KeyCreationParams. If this is not
+	// set, tpm2.HashAlgorithmSHA256 is used.
+	PCRPolicyCounterNameAlg tpm2.HashAlgorithmId
+
+	// PCRPolicyCount is the value of the PCR policy counter for which the computed PCR policy is valid. The policy remains valid
+	// for as long as the counter has a value that is not greater than this. If this is zero, the count of the PCR policy that is
+	// currently recorded in the sealed key object is used, which is the current value of the counter unless the PCR policy of
+	// a related key has since been updated on the device.
+	PCRPolicyCount uint64
+}
+
+// PrecomputedPCRPolicy is a PCR policy for a sealed key object that has been computed without access to a TPM, by ComputePCRPolicy
+// or PrecomputePCRPolicy.
+type PrecomputedPCRPolicy struct {
+	PCRs                 tpm2.PCRSelectionList // The PCRs that the policy is bound to
+	PCRDigests           tpm2.DigestList       // The permitted PCR digests
+	PCRPolicyCounterName tpm2.Name             // The name of the PCR policy counter, or empty if the key doesn't have one
+	PCRPolicyCount       uint64                // The maximum value of the PCR policy counter for which the policy is valid
+	AuthorizedPolicy     tpm2.Digest           // The policy digest that is authorized by the dynamic authorization policy key
+	Signature            *tpm2.Signature       // The signature of AuthorizedPolicy, or nil if it hasn't been signed yet
+}
+
+// dynamicPolicyData returns the dynamic policy metadata for this PCR policy, recomputing the PolicyOR tree from the PCR digests.
+// The recomputed authorized policy digest must match the one that was signed.
+func (p *PrecomputedPCRPolicy) dynamicPolicyData(alg tpm2.HashAlgorithmId) (*dynamicPolicyData, error) {
+	if len(p.PCRDigests) == 0 {
+		return nil, errors.New("no PCR digests")
+	}
+	if p.Signature == nil {
+		return nil, errors.New("PCR policy is not signed")
+	}
+	pcrOrData, authorizedPolicy := computeDynamicPolicyDigest(alg, p.PCRs, p.PCRDigests, p.PCRPolicyCounterName, p.PCRPolicyCount)
+	if !bytes.Equal(authorizedPolicy, p.AuthorizedPolicy) {
+		return nil, errors.New("PCR digests do not correspond to the authorized policy digest")
+	}
+	return &dynamicPolicyData{
+		pcrSelection:              p.PCRs,
+		pcrOrData:                 pcrOrData,
+		policyCount:               p.PCRPolicyCount,
+		authorizedPolicy:          authorizedPolicy,
+		authorizedPolicySignature: p.Signature}, nil
+}
+
+// pcrPolicyCounterNameForOffline computes the name of the PCR policy counter of the supplied sealed key object without access to
+// the TPM.
+func (k *SealedKeyObject) pcrPolicyCounterNameForOffline(nameAlg tpm2.HashAlgorithmId) (tpm2.Name, error) {
+	handle := k.data.staticPolicyData.pcrPolicyCounterHandle
+	if handle == tpm2.HandleNull {
+		return nil, nil
+	}
+	if nameAlg == tpm2.HashAlgorithmId(0) || nameAlg == tpm2.HashAlgorithmNull {
+		nameAlg = tpm2.HashAlgorithmSHA256
+	}
+	authKeyName, err := k.data.staticPolicyData.authPublicKey.Name()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute name of dynamic authorization policy key: %w", err)
+	}
+	return computePcrPolicyCounterName(handle, nameAlg, authKeyName)
+}
+
+// ComputePCRPolicy computes an unsigned PCR policy for the supplied sealed key object and any other sealed key objects that are
+// related to it, from the supplied PCR protection profile. This does not require access to the TPM or to the device that the key
+// was sealed on, so it can be performed by a signing service. The profile must not contain values added with
+// PCRProtectionProfile.AddPCRValueFromTPM. The returned policy must be signed with PrecomputedPCRPolicy.Sign.
+//
+// Unlike UpdateKeyPCRProtectionPolicy, this doesn't check that the PCRs in the profile are supported by the TPM on the device.
+//
+// This is only supported for version 1 and later key data files.
+func ComputePCRPolicy(k *SealedKeyObject, pcrProfile *PCRProtectionProfile, params *PCRPolicyComputeParams) (*PrecomputedPCRPolicy, error) {
+	if k.data.version < 1 {
+		return nil, errors.New("offline PCR policy computation requires a version 1 or later key data file")
+	}
+	if params == nil {
+		params = &PCRPolicyComputeParams{}
+	}
+	if pcrProfile == nil {
+		pcrProfile = &PCRProtectionProfile{}
+	}
+
+	alg := k.data.keyPublic.NameAlg
+	pcrs, pcrDigests, err := pcrProfile.computePCRDigests(nil, alg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR digests from protection profile: %w", err)
+	}
+	if err := algorithmPolicy.checkPCRSelection(pcrs); err != nil {
+		return nil, err
+	}
+
+	counterName, err := k.pcrPolicyCounterNameForOffline(params.PCRPolicyCounterNameAlg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute name of PCR policy counter: %w", err)
+	}
+	policyCount := params.PCRPolicyCount
+	if policyCount == 0 {
+		policyCount = k.data.dynamicPolicyData.policyCount
+	}
+
+	_, authorizedPolicy := computeDynamicPolicyDigest(alg, pcrs, pcrDigests, counterName, policyCount)
+
+	return &PrecomputedPCRPolicy{
+		PCRs:                 pcrs,
+		PCRDigests:           pcrDigests,
+		PCRPolicyCounterName: counterName,
+		PCRPolicyCount:       policyCount,
+		AuthorizedPolicy:     authorizedPolicy}, nil
+}
+
+// Sign signs this PCR policy with the private part of the dynamic authorization policy key for the supplied sealed key object,
+// which must be the one that the policy was computed for. The key is the one returned from SealKeyToTPM.
+func (p *PrecomputedPCRPolicy) Sign(k *SealedKeyObject, authKey TPMPolicyAuthKey) error {
+	if k.data.version < 1 {
+		return errors.New("offline PCR policy computation requires a version 1 or later key data file")
+	}
+
+	authPublicKey := k.data.staticPolicyData.authPublicKey
+	key, err := createECDSAPrivateKeyFromTPM(authPublicKey, tpm2.ECCParameter(authKey))
+	if err != nil {
+		return xerrors.Errorf("cannot create dynamic authorization policy key: %w", err)
+	}
+	if x, y := key.Curve.ScalarBaseMult(authKey); x.Cmp(key.X) != 0 || y.Cmp(key.Y) != 0 {
+		return errors.New("dynamic authorization policy key does not correspond to the sealed key object")
+	}
+
+	signature, err := signDynamicPolicy(k.data.version, authPublicKey.NameAlg, key, p.AuthorizedPolicy, p.PCRPolicyCounterName)
+	if err != nil {
+		return err
+	}
+	p.Signature = signature
+	return nil
+}
+
+// PrecomputePCRPolicy computes and signs a PCR policy for the supplied sealed key object and any other sealed key objects that are
+// related to it, from the supplied PCR protection profile. It is equivalent to calling ComputePCRPolicy followed by
+// PrecomputedPCRPolicy.Sign, and doesn't require access to the TPM.
+func PrecomputePCRPolicy(k *SealedKeyObject, authKey TPMPolicyAuthKey, pcrProfile *PCRProtectionProfile, params *PCRPolicyComputeParams) (*PrecomputedPCRPolicy, error) {
+	policy, err := ComputePCRPolicy(k, pcrProfile, params)
+	if err != nil {
+		return nil, err
+	}
+	if err := policy.Sign(k, authKey); err != nil {
+		return nil, xerrors.Errorf("cannot sign PCR policy: %w", err)
+	}
+	return policy, nil
+}
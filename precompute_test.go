@@ -0,0 +1,129 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	. "github.com/snapcore/secboot"
+)
+
+func TestPrecomputePCRPolicy(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestPrecomputePCRPolicy_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	// Build a profile that doesn't need the TPM, as a signing service would.
+	_, values, err := tpm.PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}})
+	if err != nil {
+		t.Fatalf("PCRRead failed: %v", err)
+	}
+	profile := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, values[tpm2.HashAlgorithmSHA256][7])
+
+	authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: profile, PCRPolicyCounterHandle: 0x01810000})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	policy, err := PrecomputePCRPolicy(k, authKey, profile, nil)
+	if err != nil {
+		t.Fatalf("PrecomputePCRPolicy failed: %v", err)
+	}
+
+	// The same profile and policy count must produce the policy digest that was computed on the device.
+	if !bytes.Equal(policy.AuthorizedPolicy, k.AuthorizedPCRPolicy()) {
+		t.Errorf("Unexpected authorized policy digest")
+	}
+	if len(policy.PCRPolicyCounterName) == 0 {
+		t.Errorf("Missing PCR policy counter name")
+	}
+
+	// Check the signature.
+	var pub ecdsa.PublicKey
+	pub.Curve = elliptic.P256()
+	pub.X, pub.Y = pub.Curve.ScalarBaseMult(authKey)
+
+	h := sha256.New()
+	h.Write(policy.AuthorizedPolicy)
+	h.Write(ComputePcrPolicyRefFromCounterName(policy.PCRPolicyCounterName))
+	if !ecdsa.Verify(&pub, h.Sum(nil), new(big.Int).SetBytes(policy.Signature.Signature.ECDSA().SignatureR),
+		new(big.Int).SetBytes(policy.Signature.Signature.ECDSA().SignatureS)) {
+		t.Errorf("Invalid signature")
+	}
+
+	t.Run("WrongKey", func(t *testing.T) {
+		wrongKey := make(TPMPolicyAuthKey, 32)
+		rand.Read(wrongKey)
+		_, err := PrecomputePCRPolicy(k, wrongKey, profile, nil)
+		if err == nil || err.Error() != "cannot sign PCR policy: dynamic authorization policy key does not correspond to the sealed key object" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ProfileFromTPM", func(t *testing.T) {
+		_, err := ComputePCRPolicy(k, getTestPCRProfile(), nil)
+		if err == nil {
+			t.Errorf("Expected an error")
+		}
+	})
+
+	t.Run("ExplicitCount", func(t *testing.T) {
+		p, err := ComputePCRPolicy(k, profile, &PCRPolicyComputeParams{PCRPolicyCount: policy.PCRPolicyCount + 5})
+		if err != nil {
+			t.Fatalf("ComputePCRPolicy failed: %v", err)
+		}
+		if bytes.Equal(p.AuthorizedPolicy, k.AuthorizedPCRPolicy()) {
+			t.Errorf("Unexpected authorized policy digest")
+		}
+		if p.Signature != nil {
+			t.Errorf("Unexpected signature")
+		}
+	})
+}
@@ -0,0 +1,334 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+	"github.com/snapcore/secboot/internal/efi"
+
+	"golang.org/x/xerrors"
+)
+
+// PreInstallCheck identifies one of the checks performed by RunChecks.
+type PreInstallCheck int
+
+const (
+	// PreInstallCheckTPMPresent checks that there is a TPM2 device.
+	PreInstallCheckTPMPresent PreInstallCheck = iota
+
+	// PreInstallCheckTPMEnabled checks that the storage and endorsement hierarchies of the TPM have not been disabled by the
+	// platform firmware.
+	PreInstallCheckTPMEnabled
+
+	// PreInstallCheckTPMNotInLockout checks that the TPM's dictionary attack protection is not in lockout mode.
+	PreInstallCheckTPMNotInLockout
+
+	// PreInstallCheckPCRBank checks that the requested PCR bank is active.
+	PreInstallCheckPCRBank
+
+	// PreInstallCheckEventLog checks that the TCG event log can be parsed, contains digests for the requested PCR bank, and is
+	// consistent with the PCR values used by the profiles in this package.
+	PreInstallCheckEventLog
+
+	// PreInstallCheckSecureBootEnabled checks that the current boot was performed with UEFI secure boot enabled.
+	PreInstallCheckSecureBootEnabled
+
+	// PreInstallCheckShimValidationEnabled checks that the current boot was not performed with validation disabled in shim
+	// (MokSBState).
+	PreInstallCheckShimValidationEnabled
+
+	// PreInstallCheckOtherOSCoexistence checks for evidence that another operating system is using the TPM, using
+	// CheckTPMCoexistence. This check produces a warning rather than a failure.
+	PreInstallCheckOtherOSCoexistence
+)
+
+func (c PreInstallCheck) String() string {
+	switch c {
+	case PreInstallCheckTPMPresent:
+		return "tpm-present"
+	case PreInstallCheckTPMEnabled:
+		return "tpm-enabled"
+	case PreInstallCheckTPMNotInLockout:
+		return "tpm-not-in-lockout"
+	case PreInstallCheckPCRBank:
+		return "pcr-bank"
+	case PreInstallCheckEventLog:
+		return "event-log"
+	case PreInstallCheckSecureBootEnabled:
+		return "secure-boot-enabled"
+	case PreInstallCheckShimValidationEnabled:
+		return "shim-validation-enabled"
+	case PreInstallCheckOtherOSCoexistence:
+		return "other-os-coexistence"
+	default:
+		return fmt.Sprintf("%d", int(c))
+	}
+}
+
+// PreInstallCheckStatus is the outcome of a single check performed by RunChecks.
+type PreInstallCheckStatus int
+
+const (
+	PreInstallCheckPassed PreInstallCheckStatus = iota
+	PreInstallCheckFailed
+
+	// PreInstallCheckSkipped indicates that a check was not performed because a check that it depends on failed.
+	PreInstallCheckSkipped
+
+	// PreInstallCheckWarning indicates that a check found a condition that the user should be warned about, but which doesn't
+	// prevent installation.
+	PreInstallCheckWarning
+)
+
+// PreInstallCheckResult is the result of a single check performed by RunChecks.
+type PreInstallCheckResult struct {
+	Check  PreInstallCheck
+	Status PreInstallCheckStatus
+
+	// Message describes why the check failed or was skipped.
+	Message string
+
+	// Remediation is a hint describing how the failure might be fixed.
+	Remediation string
+}
+
+// PreInstallCheckResults is the list of results returned from RunChecks.
+type PreInstallCheckResults []*PreInstallCheckResult
+
+// Passed indicates whether all of the checks passed, ignoring warnings.
+func (r PreInstallCheckResults) Passed() bool {
+	for _, result := range r {
+		if result.Status != PreInstallCheckPassed && result.Status != PreInstallCheckWarning {
+			return false
+		}
+	}
+	return true
+}
+
+// PreInstallCheckParams provides the parameters to RunChecks.
+type PreInstallCheckParams struct {
+	// PCRAlgorithm is the PCR bank that will be used for sealing keys. If not set, this defaults to SHA-256.
+	PCRAlgorithm tpm2.HashAlgorithmId
+}
+
+type preInstallChecker struct {
+	results PreInstallCheckResults
+}
+
+func (c *preInstallChecker) pass(check PreInstallCheck) {
+	c.results = append(c.results, &PreInstallCheckResult{Check: check, Status: PreInstallCheckPassed})
+}
+
+func (c *preInstallChecker) fail(check PreInstallCheck, message, remediation string) {
+	c.results = append(c.results, &PreInstallCheckResult{Check: check, Status: PreInstallCheckFailed, Message: message, Remediation: remediation})
+}
+
+func (c *preInstallChecker) warn(check PreInstallCheck, message, remediation string) {
+	c.results = append(c.results, &PreInstallCheckResult{Check: check, Status: PreInstallCheckWarning, Message: message, Remediation: remediation})
+}
+
+func (c *preInstallChecker) skip(check PreInstallCheck, dependency PreInstallCheck) {
+	c.results = append(c.results, &PreInstallCheckResult{
+		Check:   check,
+		Status:  PreInstallCheckSkipped,
+		Message: fmt.Sprintf("skipped because the %s check did not pass", dependency)})
+}
+
+func (c *preInstallChecker) passed(check PreInstallCheck) bool {
+	for _, r := range c.results {
+		if r.Check == check {
+			return r.Status == PreInstallCheckPassed
+		}
+	}
+	return false
+}
+
+func (c *preInstallChecker) checkTPM(alg tpm2.HashAlgorithmId) {
+	tpm, err := ConnectToDefaultTPM()
+	var tpm12Err TPM12DeviceError
+	switch {
+	case xerrors.As(err, &tpm12Err):
+		c.fail(PreInstallCheckTPMPresent, fmt.Sprintf("only a TPM %s device is available, which is not supported", tpm12Err.TCGVersion),
+			"use passphrase-only encryption, or enable a TPM2 device in the platform firmware settings if the device supports one")
+	case err == ErrNoTPM2Device:
+		c.fail(PreInstallCheckTPMPresent, "no TPM2 device is available",
+			"enable the TPM in the platform firmware settings, or use a device with a TPM2 device")
+	case err != nil:
+		c.fail(PreInstallCheckTPMPresent, fmt.Sprintf("cannot connect to TPM: %v", err), "")
+	default:
+		defer tpm.Close()
+		c.pass(PreInstallCheckTPMPresent)
+	}
+	if tpm == nil {
+		c.skip(PreInstallCheckTPMEnabled, PreInstallCheckTPMPresent)
+		c.skip(PreInstallCheckTPMNotInLockout, PreInstallCheckTPMPresent)
+		c.skip(PreInstallCheckPCRBank, PreInstallCheckTPMPresent)
+		c.skip(PreInstallCheckEventLog, PreInstallCheckTPMPresent)
+		c.skip(PreInstallCheckOtherOSCoexistence, PreInstallCheckTPMPresent)
+		return
+	}
+
+	c.checkCoexistence(tpm)
+
+	if tpm.IsEnabled() {
+		c.pass(PreInstallCheckTPMEnabled)
+	} else {
+		c.fail(PreInstallCheckTPMEnabled, "the TPM has been disabled by the platform firmware",
+			"enable the TPM in the platform firmware settings")
+	}
+
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1, tpm.currentHmacSession().IncludeAttrs(tpm2.AttrAudit))
+	switch {
+	case err != nil || len(props) == 0:
+		c.fail(PreInstallCheckTPMNotInLockout, fmt.Sprintf("cannot fetch permanent properties: %v", err), "")
+	case tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrInLockout > 0:
+		c.fail(PreInstallCheckTPMNotInLockout, "the TPM is in dictionary attack lockout mode",
+			"wait for the lockout recovery time to expire, or clear the TPM using the platform firmware")
+	default:
+		c.pass(PreInstallCheckTPMNotInLockout)
+	}
+
+	pcrs, err := tpm.GetCapabilityPCRs(tpm.currentHmacSession().IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		c.fail(PreInstallCheckPCRBank, fmt.Sprintf("cannot determine active PCR banks: %v", err), "")
+	} else {
+		active := false
+		for _, s := range pcrs {
+			if s.Hash == alg && len(s.Select) > 0 {
+				active = true
+				break
+			}
+		}
+		if active {
+			c.pass(PreInstallCheckPCRBank)
+		} else {
+			c.fail(PreInstallCheckPCRBank, fmt.Sprintf("the %v PCR bank is not active", alg),
+				"enable the PCR bank in the platform firmware settings")
+		}
+	}
+
+	if !c.passed(PreInstallCheckPCRBank) {
+		c.skip(PreInstallCheckEventLog, PreInstallCheckPCRBank)
+		return
+	}
+	expected, current, err := readPCRsAndReplayEventLog(tpm, alg, []int{bootManagerCodePCR, secureBootPCR})
+	if err != nil {
+		c.fail(PreInstallCheckEventLog, err.Error(), "make sure that the TCG event log is available to the operating system")
+		return
+	}
+	for _, pcr := range []int{bootManagerCodePCR, secureBootPCR} {
+		if !bytes.Equal(expected[alg][pcr], current[alg][pcr]) {
+			c.fail(PreInstallCheckEventLog, fmt.Sprintf("the TCG event log is not consistent with the value of PCR %d", pcr),
+				"the platform firmware may need to be updated")
+			return
+		}
+	}
+	c.pass(PreInstallCheckEventLog)
+}
+
+func (c *preInstallChecker) checkCoexistence(tpm *TPMConnection) {
+	report, err := CheckTPMCoexistence(tpm)
+	switch {
+	case err != nil:
+		c.warn(PreInstallCheckOtherOSCoexistence, fmt.Sprintf("cannot check for other operating systems: %v", err), "")
+	case report.Compatible():
+		c.pass(PreInstallCheckOtherOSCoexistence)
+	default:
+		c.warn(PreInstallCheckOtherOSCoexistence,
+			fmt.Sprintf("another operating system appears to be using the TPM (BitLocker volumes: %v, persistent objects: %v, "+
+				"NV indices: %v)", report.BitLockerVolumes, report.ForeignPersistentObjects, report.ForeignNVIndices),
+			"make sure that recovery keys for other operating systems are backed up, and avoid clearing the TPM")
+	}
+}
+
+func (c *preInstallChecker) checkSecureBoot() {
+	f, err := os.Open(efi.EventLogPath)
+	if err != nil {
+		c.fail(PreInstallCheckSecureBootEnabled, fmt.Sprintf("cannot open TCG event log: %v", err), "")
+		c.skip(PreInstallCheckShimValidationEnabled, PreInstallCheckSecureBootEnabled)
+		return
+	}
+	defer f.Close()
+
+	log, err := tcglog.ParseLog(f, &tcglog.LogOptions{})
+	if err != nil {
+		c.fail(PreInstallCheckSecureBootEnabled, fmt.Sprintf("cannot parse TCG event log: %v", err), "")
+		c.skip(PreInstallCheckShimValidationEnabled, PreInstallCheckSecureBootEnabled)
+		return
+	}
+
+	sbEnabled := false
+	shimValidationDisabled := false
+	for _, event := range log.Events {
+		if event.PCRIndex != secureBootPCR {
+			continue
+		}
+		efiVarData, ok := event.Data.(*tcglog.EFIVariableData)
+		if !ok {
+			continue
+		}
+		switch {
+		case event.EventType == tcglog.EventTypeEFIVariableDriverConfig && efiVarData.VariableName == efiGlobalVariableGuid &&
+			efiVarData.UnicodeName == sbStateName:
+			sbEnabled = len(efiVarData.VariableData) > 0 && efiVarData.VariableData[0] != 0x00
+		case event.EventType == tcglog.EventTypeEFIVariableAuthority && efiVarData.VariableName == shimGuid &&
+			efiVarData.UnicodeName == mokSbStateName:
+			shimValidationDisabled = true
+		}
+	}
+
+	if sbEnabled {
+		c.pass(PreInstallCheckSecureBootEnabled)
+	} else {
+		c.fail(PreInstallCheckSecureBootEnabled, "the current boot was performed with secure boot disabled",
+			"enable secure boot in the platform firmware settings")
+	}
+
+	if shimValidationDisabled {
+		c.fail(PreInstallCheckShimValidationEnabled, "the current boot was performed with validation disabled in shim",
+			"re-enable validation in shim with \"mokutil --enable-validation\"")
+	} else {
+		c.pass(PreInstallCheckShimValidationEnabled)
+	}
+}
+
+// RunChecks evaluates whether full disk encryption with keys sealed to the TPM is viable on the current platform. It checks that
+// a TPM2 device is present, enabled and not in dictionary attack lockout mode, that the requested PCR bank is active, that the TCG
+// event log is consistent with the TPM's PCR values, that the current boot was performed with UEFI secure boot enabled, and that
+// validation was not disabled in shim. It also warns if there is evidence that another operating system is using the TPM.
+//
+// A result is returned for every check, containing a remediation hint for checks that fail. Checks that depend on the outcome of
+// another check that fails are reported as skipped.
+func RunChecks(params *PreInstallCheckParams) PreInstallCheckResults {
+	alg := tpm2.HashAlgorithmSHA256
+	if params != nil && params.PCRAlgorithm != 0 {
+		alg = params.PCRAlgorithm
+	}
+
+	var c preInstallChecker
+	c.checkTPM(alg)
+	c.checkSecureBoot()
+	return c.results
+}
@@ -0,0 +1,71 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type preinstallSuite struct{}
+
+var _ = Suite(&preinstallSuite{})
+
+func (s *preinstallSuite) resultFor(c *C, results PreInstallCheckResults, check PreInstallCheck) *PreInstallCheckResult {
+	for _, r := range results {
+		if r.Check == check {
+			return r
+		}
+	}
+	c.Fatalf("no result for check %v", check)
+	return nil
+}
+
+func (s *preinstallSuite) TestSecureBootChecksPass(c *C) {
+	restoreEventLogPath := testutil.MockEventLogPath("testdata/eventlog1.bin")
+	defer restoreEventLogPath()
+
+	results := RunChecks(nil)
+	c.Check(s.resultFor(c, results, PreInstallCheckSecureBootEnabled).Status, Equals, PreInstallCheckPassed)
+	c.Check(s.resultFor(c, results, PreInstallCheckShimValidationEnabled).Status, Equals, PreInstallCheckPassed)
+}
+
+func (s *preinstallSuite) TestShimValidationDisabled(c *C) {
+	restoreEventLogPath := testutil.MockEventLogPath("testdata/eventlog2.bin")
+	defer restoreEventLogPath()
+
+	results := RunChecks(nil)
+	c.Check(results.Passed(), Equals, false)
+	r := s.resultFor(c, results, PreInstallCheckShimValidationEnabled)
+	c.Check(r.Status, Equals, PreInstallCheckFailed)
+	c.Check(r.Message, Equals, "the current boot was performed with validation disabled in shim")
+	c.Check(r.Remediation, Not(Equals), "")
+}
+
+func (s *preinstallSuite) TestMissingEventLog(c *C) {
+	restoreEventLogPath := testutil.MockEventLogPath("testdata/nonexistent")
+	defer restoreEventLogPath()
+
+	results := RunChecks(nil)
+	c.Check(s.resultFor(c, results, PreInstallCheckSecureBootEnabled).Status, Equals, PreInstallCheckFailed)
+	c.Check(s.resultFor(c, results, PreInstallCheckShimValidationEnabled).Status, Equals, PreInstallCheckSkipped)
+}
@@ -0,0 +1,50 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+// ProgressFunc is a callback used to report the progress of long running operations, so that callers can provide feedback to the
+// user. The stage argument is a short, human readable description of the stage of the operation that is about to begin, and percent
+// is an estimate of how much of the operation has been completed so far, between 0 and 100. A final call with a percent value of
+// 100 is made when the operation completes successfully.
+type ProgressFunc func(stage string, percent int)
+
+// report calls the callback if it isn't nil.
+func (fn ProgressFunc) report(stage string, percent int) {
+	if fn == nil {
+		return
+	}
+	fn(stage, percent)
+}
+
+// reportStep calls the callback for step n of total steps of a stage that spans the specified range of percentages.
+func (fn ProgressFunc) reportStep(stage string, n, total, start, end int) {
+	if total == 0 {
+		fn.report(stage, start)
+		return
+	}
+	fn.report(stage, start+(end-start)*n/total)
+}
+
+// SetProgressFunc sets a callback used to report the progress of long running operations that use this connection. These are
+// EnsureProvisioned, UpdateKeyPCRProtectionPolicyV0, UpdateKeyPCRProtectionPolicy and UpdateKeyPCRProtectionPolicyMultiple. Set
+// this to nil to disable progress reporting.
+func (t *TPMConnection) SetProgressFunc(fn ProgressFunc) {
+	t.progress = fn
+}
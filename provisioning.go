@@ -23,6 +23,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/canonical/go-tpm2"
 	"github.com/snapcore/secboot/internal/tcg"
@@ -61,30 +62,44 @@ const (
 	ProvisionModeClear
 )
 
-func provisionPrimaryKey(tpm *tpm2.TPMContext, hierarchy tpm2.ResourceContext, template *tpm2.Public, handle tpm2.Handle, session tpm2.SessionContext) (tpm2.ResourceContext, error) {
-	obj, err := tpm.CreateResourceContextFromTPM(handle)
-	switch {
-	case err != nil && !tpm2.IsResourceUnavailableError(err, handle):
-		// Unexpected error
-		return nil, xerrors.Errorf("cannot create context to determine if persistent handle is already occupied: %w", err)
-	case tpm2.IsResourceUnavailableError(err, handle):
-		// No existing object to evict
-	default:
-		// Evict the current object
-		if _, err := tpm.EvictControl(tpm.OwnerHandleContext(), obj, handle, session); err != nil {
-			return nil, xerrors.Errorf("cannot evict existing object at persistent handle: %w", err)
+// provisionPrimaryKey creates a primary key from the supplied template and persists it at the specified handle, evicting any
+// existing object first. The actions are recorded in plan, and a nil context is returned if plan is a dry run.
+func provisionPrimaryKey(tpm *tpm2.TPMContext, hierarchy tpm2.ResourceContext, template *tpm2.Public, handle tpm2.Handle, name string,
+	session tpm2.SessionContext, plan *actionPlan) (tpm2.ResourceContext, error) {
+	if !plan.isCleared() {
+		obj, err := tpm.CreateResourceContextFromTPM(handle)
+		switch {
+		case err != nil && !tpm2.IsResourceUnavailableError(err, handle):
+			// Unexpected error
+			return nil, xerrors.Errorf("cannot create context to determine if persistent handle is already occupied: %w", err)
+		case tpm2.IsResourceUnavailableError(err, handle):
+			// No existing object to evict
+		default:
+			// Evict the current object
+			if err := plan.perform(func() error {
+				_, err := tpm.EvictControl(tpm.OwnerHandleContext(), obj, handle, session)
+				return err
+			}, PlannedAction{Type: PlannedActionDestroy, Target: persistentHandleTarget(handle), Description: "evict the existing object"}); err != nil {
+				return nil, xerrors.Errorf("cannot evict existing object at persistent handle: %w", err)
+			}
 		}
 	}
 
-	transientObj, _, _, _, _, err := tpm.CreatePrimary(hierarchy, nil, template, nil, nil, session)
-	if err != nil {
-		return nil, xerrors.Errorf("cannot create key: %w", err)
-	}
-	defer tpm.FlushContext(transientObj)
+	var obj tpm2.ResourceContext
+	if err := plan.perform(func() error {
+		transientObj, _, _, _, _, err := tpm.CreatePrimary(hierarchy, nil, template, nil, nil, session)
+		if err != nil {
+			return xerrors.Errorf("cannot create key: %w", err)
+		}
+		defer tpm.FlushContext(transientObj)
 
-	obj, err = tpm.EvictControl(tpm.OwnerHandleContext(), transientObj, handle, session)
-	if err != nil {
-		return nil, xerrors.Errorf("cannot make key persistent: %w", err)
+		obj, err = tpm.EvictControl(tpm.OwnerHandleContext(), transientObj, handle, session)
+		if err != nil {
+			return xerrors.Errorf("cannot make key persistent: %w", err)
+		}
+		return nil
+	}, PlannedAction{Type: PlannedActionCreate, Target: persistentHandleTarget(handle), Description: "create and persist a new " + name}); err != nil {
+		return nil, err
 	}
 
 	return obj, nil
@@ -121,7 +136,8 @@ func provisionPrimaryKey(tpm *tpm2.TPMContext, hierarchy tpm2.ResourceContext, t
 // storage and endorsement hierarchies. If mode is ProvisionModeFull or ProvisionModeWithoutLockout, then knowledge of the
 // authorization values for these hierarchies is required. Whilst these will be empty after clearing the TPM, if they have been set
 // since clearing the TPM then they will need to be provided by calling TPMConnection.EndorsementHandleContext().SetAuthValue() and
-// TPMConnection.OwnerHandleContext().SetAuthValue() prior to calling this function. If the wrong value is provided for either
+// TPMConnection.OwnerHandleContext().SetAuthValue() (or TPMConnection.SetHierarchyAuth) prior to calling this function, or
+// supplied on demand by a callback set with TPMConnection.SetHierarchyAuthFunc. If the wrong value is provided for either
 // authorization, then a AuthFailError error will be returned. If the correct authorization values are not known, then the only way
 // to recover from this is to clear the TPM either by calling this function with mode set to ProvisionModeClear (and providing the
 // correct authorization value for the lockout hierarchy), or by using the physical presence interface.
@@ -131,8 +147,94 @@ func provisionPrimaryKey(tpm *tpm2.TPMContext, hierarchy tpm2.ResourceContext, t
 // ErrTPMProvisioningRequiresLockout error will be returned. In this scenario, the function will complete all operations that can be
 // completed without using the lockout hierarchy, but the function should be called again either with mode set to ProvisionModeFull
 // (if the authorization value for the lockout hierarchy is known), or ProvisionModeClear.
-func (t *TPMConnection) EnsureProvisioned(mode ProvisionMode, newLockoutAuth []byte) error {
-	session := t.HmacSession()
+//
+// If TPMConnection.RequireVerifiedSession is enabled and the connection doesn't have a verified session, a ErrNoVerifiedSession
+// error will be returned before the authorization value for the lockout hierarchy is set.
+//
+// If either of the primary keys provisioned by this function is affected by a known key generation weakness, a wrapped WeakKeyError
+// error will be returned. In this case, the TPM's firmware must be updated before it can be used safely with this package.
+//
+// If the primary keys created by this function are not permitted by the algorithm policy installed with SetAlgorithmPolicy, a
+// AlgorithmPolicyError error will be returned before the TPM is modified.
+//
+// If an audit log has been set with SetAuditLog, a AuditEventProvision entry is recorded when this function succeeds.
+//
+// This function records a checkpoint after the TPM is cleared and after each primary key is provisioned and checked. If it is
+// interrupted, calling it again reuses the primary keys recorded in the checkpoint rather than recreating them, as long as the TPM
+// confirms that they are still the expected primary keys. If a call with ProvisionModeClear is interrupted after the TPM has been
+// cleared, calling it again with ProvisionModeClear doesn't clear the TPM again as long as the TPM's storage primary seed is the
+// one recorded after clearing it. In this case, the authorization values for the hierarchies that haven't been set since the
+// TPM was cleared are reset to empty, and the lockout hierarchy authorization value is assumed to be newLockoutAuth if the
+// interrupted call had already set it. The same newLockoutAuth must be supplied when resuming. Otherwise, a TPM is always cleared when mode is ProvisionModeClear. The checkpoint is removed when this
+// function succeeds, and can be discarded explicitly with TPMConnection.ClearProvisioningCheckpoint. See
+// TPMConnection.SetProvisioningCheckpointDir for where checkpoints are kept. An error is returned if a checkpoint can't be
+// recorded.
+func (t *TPMConnection) EnsureProvisioned(mode ProvisionMode, newLockoutAuth []byte) (err error) {
+	defer observeOperation(MetricsOperationProvision, time.Now(), &err)
+
+	err = t.runWithHierarchyAuth(func() error {
+		return t.ensureProvisioned(mode, newLockoutAuth, nil)
+	})
+	// Refresh the primary key status, as the primary keys may have changed even if provisioning didn't complete.
+	t.primaryKeysErr = t.VerifyPrimaryKeys()
+	if err != nil {
+		return err
+	}
+
+	var details string
+	switch mode {
+	case ProvisionModeWithoutLockout:
+		details = "mode: without-lockout"
+	case ProvisionModeFull:
+		details = "mode: full"
+	case ProvisionModeClear:
+		details = "mode: clear"
+	}
+	return t.recordAuditEvent(AuditEventProvision, nil, details)
+}
+
+// ensureProvisioned implements EnsureProvisioned. The mutations that it performs are recorded in plan, and if plan is a dry run,
+// they are not performed and neither the checkpoint nor the connection are updated.
+func (t *TPMConnection) ensureProvisioned(mode ProvisionMode, newLockoutAuth []byte, plan *actionPlan) error {
+	report := func(desc string, percent int) {
+		if !plan.isDryRun() {
+			t.progress.report(desc, percent)
+		}
+	}
+	writeCheckpoint := func(checkpoint *provisioningCheckpoint) error {
+		if plan.isDryRun() {
+			return nil
+		}
+		if err := checkpoint.write(); err != nil {
+			return xerrors.Errorf("cannot record provisioning checkpoint: %w", err)
+		}
+		return nil
+	}
+	removeCheckpoint := func(checkpoint *provisioningCheckpoint) error {
+		if plan.isDryRun() {
+			return nil
+		}
+		if err := checkpoint.remove(); err != nil {
+			return xerrors.Errorf("cannot remove provisioning checkpoint: %w", err)
+		}
+		return nil
+	}
+
+	report("checking TPM", 0)
+
+	for _, template := range []*tpm2.Public{tcg.EKTemplate, tcg.SRKTemplate} {
+		if err := algorithmPolicy.checkPublicArea(template); err != nil {
+			return err
+		}
+	}
+	if err := t.checkManufacturerPolicy(); err != nil {
+		return err
+	}
+
+	session := t.currentHmacSession()
+
+	// Resume from the last completed step of an interrupted call, if there was one.
+	checkpoint := t.readProvisioningCheckpoint()
 
 	props, err := t.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1, session.IncludeAttrs(tpm2.AttrAudit))
 	if err != nil {
@@ -141,56 +243,176 @@ func (t *TPMConnection) EnsureProvisioned(mode ProvisionMode, newLockoutAuth []b
 	if props[0].Property != tpm2.PropertyPermanent {
 		return errors.New("TPM returned value for the wrong property")
 	}
+	cleared := false
 	if mode == ProvisionModeClear {
+		cleared, err = checkpoint.clearedTPM(t.TPMContext, session)
+		if err != nil {
+			return xerrors.Errorf("cannot check if TPM was cleared by the previous call: %w", err)
+		}
+	}
+	switch {
+	case cleared:
+		// The TPM was cleared by an interrupted call. Clearing it again would fail because the lockout hierarchy authorization value
+		// supplied by the caller was reset by that clear, so skip it. Reset the authorization values in the same way that clearing
+		// the TPM does, unless they have been set since. The lockout hierarchy authorization value is only set by the last step of
+		// this function, so if it has been set, it was set to newLockoutAuth by the interrupted call.
+		report("reusing cleared TPM", 5)
+		if !plan.isDryRun() {
+			permanent := tpm2.PermanentAttributes(props[0].Value)
+			if permanent&tpm2.AttrLockoutAuthSet == 0 {
+				t.LockoutHandleContext().SetAuthValue(nil)
+			} else {
+				t.LockoutHandleContext().SetAuthValue(newLockoutAuth)
+			}
+			if permanent&tpm2.AttrOwnerAuthSet == 0 {
+				t.OwnerHandleContext().SetAuthValue(nil)
+			}
+			if permanent&tpm2.AttrEndorsementAuthSet == 0 {
+				t.EndorsementHandleContext().SetAuthValue(nil)
+			}
+		}
+	case mode == ProvisionModeClear:
 		if tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrDisableClear > 0 {
 			return ErrTPMClearRequiresPPI
 		}
 
-		if err := t.Clear(t.LockoutHandleContext(), session); err != nil {
-			switch {
-			case isAuthFailError(err, tpm2.CommandClear, 1):
-				return AuthFailError{tpm2.HandleLockout}
-			case tpm2.IsTPMWarning(err, tpm2.WarningLockout, tpm2.CommandClear):
-				return ErrTPMLockout
+		if plan.isDryRun() {
+			if err := plan.planClear(t, session.IncludeAttrs(tpm2.AttrAudit)); err != nil {
+				return err
+			}
+		}
+
+		report("clearing TPM", 5)
+		if err := plan.perform(func() error {
+			if err := t.Clear(t.LockoutHandleContext(), session); err != nil {
+				switch {
+				case isAuthFailError(err, tpm2.CommandClear, 1):
+					return AuthFailError{tpm2.HandleLockout}
+				case tpm2.IsTPMWarning(err, tpm2.WarningLockout, tpm2.CommandClear):
+					return ErrTPMLockout
+				}
+				return xerrors.Errorf("cannot clear the TPM: %w", err)
+			}
+			return nil
+		}, PlannedAction{
+			Type:   PlannedActionModify,
+			Target: "TPM",
+			Description: "clear the TPM, which changes the storage and endorsement primary seeds and resets the owner, endorsement " +
+				"and lockout hierarchy authorization values"}); err != nil {
+			return err
+		}
+		// Clearing the TPM discards the primary keys recorded by an earlier call. Record that the TPM has been cleared so that
+		// an interrupted call can be resumed without clearing it again.
+		checkpoint.reset()
+		if !plan.isDryRun() {
+			name, err := storagePrimarySeedName(t.TPMContext, session)
+			if err != nil {
+				return xerrors.Errorf("cannot determine storage primary seed after clearing the TPM: %w", err)
+			}
+			checkpoint.ClearedSeedName = name
+			if err := writeCheckpoint(checkpoint); err != nil {
+				return err
 			}
-			return xerrors.Errorf("cannot clear the TPM: %w", err)
+		}
+	}
+
+	// Make sure that there is space for the primary keys before evicting anything. This can't be determined by a dry run once it
+	// has cleared the TPM.
+	if !plan.isCleared() {
+		if err := t.CheckNVSpace(&NVSpaceRequirements{PersistentHandles: []tpm2.Handle{tcg.EKHandle, tcg.SRKHandle}}); err != nil {
+			return xerrors.Errorf("cannot provision TPM: %w", err)
 		}
 	}
 
 	// Provision an endorsement key
-	if _, err := provisionPrimaryKey(t.TPMContext, t.EndorsementHandleContext(), tcg.EKTemplate, tcg.EKHandle, session); err != nil {
-		switch {
-		case isAuthFailError(err, tpm2.CommandEvictControl, 1):
-			return AuthFailError{tpm2.HandleOwner}
-		case isAuthFailError(err, tpm2.AnyCommandCode, 1):
-			return AuthFailError{tpm2.HandleEndorsement}
-		default:
-			return xerrors.Errorf("cannot provision endorsement key: %w", err)
+	_, ok, err := provisionedPrimaryKey(t.TPMContext, t.EndorsementHandleContext(), tcg.EKHandle, tcg.EKTemplate, checkpoint.EKName, session)
+	if err != nil {
+		return xerrors.Errorf("cannot check endorsement key recorded in checkpoint: %w", err)
+	}
+	if ok {
+		report("reusing endorsement key", 15)
+	} else {
+		report("provisioning endorsement key", 15)
+		ek, err := provisionPrimaryKey(t.TPMContext, t.EndorsementHandleContext(), tcg.EKTemplate, tcg.EKHandle, "endorsement key", session, plan)
+		if err != nil {
+			switch {
+			case isAuthFailError(err, tpm2.CommandEvictControl, 1):
+				return AuthFailError{tpm2.HandleOwner}
+			case isAuthFailError(err, tpm2.AnyCommandCode, 1):
+				return AuthFailError{tpm2.HandleEndorsement}
+			default:
+				return xerrors.Errorf("cannot provision endorsement key: %w", err)
+			}
+		}
+		if ek != nil {
+			checkpoint.EKName = ek.Name()
+			checkpoint.PrimaryKeysChecked = false
+		}
+		if err := writeCheckpoint(checkpoint); err != nil {
+			return err
 		}
 	}
 
 	// Reinitialize the connection, which creates a new session that's salted with a value protected with the newly provisioned EK.
 	// This will have a symmetric algorithm for parameter encryption during HierarchyChangeAuth.
-	if err := t.init(); err != nil {
-		var verifyErr verificationError
-		if xerrors.As(err, &verifyErr) {
-			return TPMVerificationError{fmt.Sprintf("cannot reinitialize TPM connection after provisioning endorsement key: %v", err)}
+	if !plan.isDryRun() {
+		if err := t.init(); err != nil {
+			var verifyErr verificationError
+			if xerrors.As(err, &verifyErr) {
+				return TPMVerificationError{fmt.Sprintf("cannot reinitialize TPM connection after provisioning endorsement key: %v", err)}
+			}
+			return xerrors.Errorf("cannot reinitialize TPM connection after provisioning endorsement key: %w", err)
 		}
-		return xerrors.Errorf("cannot reinitialize TPM connection after provisioning endorsement key: %w", err)
+		session = t.currentHmacSession()
 	}
-	session = t.HmacSession()
 
 	// Provision a storage root key
-	srk, err := provisionPrimaryKey(t.TPMContext, t.OwnerHandleContext(), tcg.SRKTemplate, tcg.SRKHandle, session)
+	srk, ok, err := provisionedPrimaryKey(t.TPMContext, t.OwnerHandleContext(), tcg.SRKHandle, tcg.SRKTemplate, checkpoint.SRKName, session)
 	if err != nil {
-		switch {
-		case isAuthFailError(err, tpm2.AnyCommandCode, 1):
-			return AuthFailError{tpm2.HandleOwner}
-		default:
-			return xerrors.Errorf("cannot provision storage root key: %w", err)
+		return xerrors.Errorf("cannot check storage root key recorded in checkpoint: %w", err)
+	}
+	if ok {
+		report("reusing storage root key", 45)
+	} else {
+		report("provisioning storage root key", 45)
+		srk, err = provisionPrimaryKey(t.TPMContext, t.OwnerHandleContext(), tcg.SRKTemplate, tcg.SRKHandle, "storage root key", session, plan)
+		if err != nil {
+			switch {
+			case isAuthFailError(err, tpm2.AnyCommandCode, 1):
+				return AuthFailError{tpm2.HandleOwner}
+			default:
+				return xerrors.Errorf("cannot provision storage root key: %w", err)
+			}
+		}
+		if srk != nil {
+			checkpoint.SRKName = srk.Name()
+			checkpoint.PrimaryKeysChecked = false
+		}
+		if err := writeCheckpoint(checkpoint); err != nil {
+			return err
+		}
+	}
+	if !plan.isDryRun() {
+		t.provisionedSrk = srk
+	}
+
+	// Check that the newly created primary keys aren't affected by a known key generation weakness. A dry run doesn't create
+	// them, so there is nothing to check.
+	if !checkpoint.PrimaryKeysChecked && !plan.isDryRun() {
+		report("checking primary keys", 70)
+		if err := checkKeyNotWeak(t.TPMContext, srk, session); err != nil {
+			return xerrors.Errorf("cannot check storage root key: %w", err)
+		}
+		if t.ek != nil {
+			if err := checkKeyNotWeak(t.TPMContext, t.ek, session); err != nil {
+				return xerrors.Errorf("cannot check endorsement key: %w", err)
+			}
+		}
+		checkpoint.PrimaryKeysChecked = true
+		if err := writeCheckpoint(checkpoint); err != nil {
+			return err
 		}
 	}
-	t.provisionedSrk = srk
 
 	if mode == ProvisionModeWithoutLockout {
 		props, err := t.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1, session.IncludeAttrs(tpm2.AttrAudit))
@@ -216,33 +438,64 @@ func (t *TPMConnection) EnsureProvisioned(mode ProvisionMode, newLockoutAuth []b
 			return ErrTPMProvisioningRequiresLockout
 		}
 
+		if err := removeCheckpoint(checkpoint); err != nil {
+			return err
+		}
+		report("done", 100)
 		return nil
 	}
 
 	// Perform actions that require the lockout hierarchy authorization.
+	report("configuring lockout hierarchy", 85)
 
 	// Set the DA parameters.
-	if err := t.DictionaryAttackParameters(t.LockoutHandleContext(), maxTries, recoveryTime, lockoutRecovery, session); err != nil {
-		switch {
-		case isAuthFailError(err, tpm2.CommandDictionaryAttackParameters, 1):
-			return AuthFailError{tpm2.HandleLockout}
-		case tpm2.IsTPMWarning(err, tpm2.WarningLockout, tpm2.CommandDictionaryAttackParameters):
-			return ErrTPMLockout
+	if err := plan.perform(func() error {
+		if err := t.DictionaryAttackParameters(t.LockoutHandleContext(), maxTries, recoveryTime, lockoutRecovery, session); err != nil {
+			switch {
+			case isAuthFailError(err, tpm2.CommandDictionaryAttackParameters, 1):
+				return AuthFailError{tpm2.HandleLockout}
+			case tpm2.IsTPMWarning(err, tpm2.WarningLockout, tpm2.CommandDictionaryAttackParameters):
+				return ErrTPMLockout
+			}
+			return xerrors.Errorf("cannot configure dictionary attack parameters: %w", err)
 		}
-		return xerrors.Errorf("cannot configure dictionary attack parameters: %w", err)
+		return nil
+	}, PlannedAction{
+		Type:        PlannedActionModify,
+		Target:      "lockout hierarchy",
+		Description: fmt.Sprintf("set the dictionary attack parameters (max tries: %d, recovery time: %ds, lockout recovery: %ds)", maxTries, recoveryTime, lockoutRecovery)}); err != nil {
+		return err
 	}
 
 	// Disable owner clear
-	if err := t.ClearControl(t.LockoutHandleContext(), true, session); err != nil {
-		// Lockout auth failure or lockout mode would have been caught by DictionaryAttackParameters
-		return xerrors.Errorf("cannot disable owner clear: %w", err)
+	if err := plan.perform(func() error {
+		if err := t.ClearControl(t.LockoutHandleContext(), true, session); err != nil {
+			// Lockout auth failure or lockout mode would have been caught by DictionaryAttackParameters
+			return xerrors.Errorf("cannot disable owner clear: %w", err)
+		}
+		return nil
+	}, PlannedAction{Type: PlannedActionModify, Target: "lockout hierarchy", Description: "disable owner clear"}); err != nil {
+		return err
 	}
 
 	// Set the lockout hierarchy authorization.
-	if err := t.HierarchyChangeAuth(t.LockoutHandleContext(), newLockoutAuth, session.IncludeAttrs(tpm2.AttrCommandEncrypt)); err != nil {
-		return xerrors.Errorf("cannot set the lockout hierarchy authorization value: %w", err)
+	if err := plan.perform(func() error {
+		session, err := t.secretSession()
+		if err != nil {
+			return err
+		}
+		if err := t.HierarchyChangeAuth(t.LockoutHandleContext(), newLockoutAuth, session.IncludeAttrs(tpm2.AttrCommandEncrypt)); err != nil {
+			return xerrors.Errorf("cannot set the lockout hierarchy authorization value: %w", err)
+		}
+		return nil
+	}, PlannedAction{Type: PlannedActionModify, Target: "lockout hierarchy", Description: "set the authorization value"}); err != nil {
+		return err
 	}
 
+	if err := removeCheckpoint(checkpoint); err != nil {
+		return err
+	}
+	report("done", 100)
 	return nil
 }
 
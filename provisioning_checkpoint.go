@@ -0,0 +1,187 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/osutil/sys"
+
+	"golang.org/x/xerrors"
+)
+
+// SetProvisioningCheckpointDir sets the directory in which EnsureProvisioned records the steps that it has completed for this
+// connection, so that a call that is interrupted, eg, by a crash or power loss, can be resumed without repeating the slow steps.
+// By default, checkpoints are kept in /run and so only last for the current boot. A directory on persistent storage must be set
+// in order to resume provisioning after a reboot. The directory must only be writable by root.
+func (t *TPMConnection) SetProvisioningCheckpointDir(dir string) {
+	t.provisioningCheckpointDir = dir
+}
+
+// provisioningCheckpointPath returns the path of the file in which the provisioning checkpoint for this connection is kept.
+func (t *TPMConnection) provisioningCheckpointPath() string {
+	if t.provisioningCheckpointDir != "" {
+		return filepath.Join(t.provisioningCheckpointDir, "provisioning-checkpoint")
+	}
+	return filepath.Join(runDir, "secboot", "provisioning-checkpoint")
+}
+
+// provisioningCheckpoint records the steps of TPMConnection.EnsureProvisioned that have been completed. Nothing recorded in a
+// checkpoint is trusted on its own - each recorded step is only skipped if the TPM confirms that its result is still present.
+type provisioningCheckpoint struct {
+	path string
+
+	ClearedSeedName    tpm2.Name `json:"cleared-seed-name,omitempty"` // The storage primary seed name recorded after clearing the TPM
+	EKName             tpm2.Name `json:"ek-name,omitempty"`           // The name of the provisioned endorsement key
+	SRKName            tpm2.Name `json:"srk-name,omitempty"`          // The name of the provisioned storage root key
+	PrimaryKeysChecked bool      `json:"primary-keys-checked,omitempty"`
+}
+
+// readProvisioningCheckpoint returns the checkpoint for an interrupted call to TPMConnection.EnsureProvisioned on this connection.
+// An empty checkpoint is returned if there isn't one.
+func (t *TPMConnection) readProvisioningCheckpoint() *provisioningCheckpoint {
+	path := t.provisioningCheckpointPath()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return &provisioningCheckpoint{path: path}
+	}
+	defer f.Close()
+
+	cp := &provisioningCheckpoint{}
+	if err := json.NewDecoder(f).Decode(cp); err != nil {
+		cp = &provisioningCheckpoint{}
+	}
+	cp.path = path
+	return cp
+}
+
+// reset discards all of the steps recorded in this checkpoint.
+func (cp *provisioningCheckpoint) reset() {
+	*cp = provisioningCheckpoint{path: cp.path}
+}
+
+// write records the checkpoint atomically.
+func (cp *provisioningCheckpoint) write() error {
+	if err := os.MkdirAll(filepath.Dir(cp.path), 0700); err != nil {
+		return xerrors.Errorf("cannot create checkpoint directory: %w", err)
+	}
+
+	f, err := osutil.NewAtomicFile(cp.path, 0600, 0, sys.UserID(osutil.NoChown), sys.GroupID(osutil.NoChown))
+	if err != nil {
+		return xerrors.Errorf("cannot create new atomic file: %w", err)
+	}
+	defer f.Cancel()
+
+	if err := json.NewEncoder(f).Encode(cp); err != nil {
+		return xerrors.Errorf("cannot write to temporary file: %w", err)
+	}
+
+	if err := f.Commit(); err != nil {
+		return xerrors.Errorf("cannot atomically replace file: %w", err)
+	}
+	return nil
+}
+
+// remove removes the checkpoint file, if there is one.
+func (cp *provisioningCheckpoint) remove() error {
+	if err := os.Remove(cp.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// provisionedPrimaryKey returns a context for the persistent object at the specified handle if it is the primary key with the
+// specified name that was recorded in a checkpoint, and the TPM confirms that it is a primary key in the specified hierarchy created
+// from the specified template. It returns false if the key needs to be provisioned again.
+func provisionedPrimaryKey(tpm *tpm2.TPMContext, hierarchy tpm2.ResourceContext, handle tpm2.Handle, template *tpm2.Public,
+	name tpm2.Name, session tpm2.SessionContext) (tpm2.ResourceContext, bool, error) {
+	if len(name) == 0 {
+		return nil, false, nil
+	}
+	obj, err := tpm.CreateResourceContextFromTPM(handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		return nil, false, nil
+	case err != nil:
+		return nil, false, xerrors.Errorf("cannot create context for object: %w", err)
+	}
+	if !bytes.Equal(obj.Name(), name) {
+		return nil, false, nil
+	}
+
+	ok, err := isObjectPrimaryKeyWithTemplate(tpm, hierarchy, obj, template, session)
+	if err != nil {
+		return nil, false, xerrors.Errorf("cannot determine if object is a primary key with the expected template: %w", err)
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	return obj, true, nil
+}
+
+// storagePrimarySeedTemplate is the template of a primary object in the storage hierarchy that is used to identify the storage
+// primary seed. A primary object's name is derived from the seed of its hierarchy, and the seed is changed by TPM2_Clear. A data
+// object is used because it is quick to create.
+var storagePrimarySeedTemplate = &tpm2.Public{
+	Type:    tpm2.ObjectTypeKeyedHash,
+	NameAlg: tpm2.HashAlgorithmSHA256,
+	Attrs:   tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrNoDA,
+	Params:  tpm2.PublicParamsU{Data: &tpm2.KeyedHashParams{Scheme: tpm2.KeyedHashScheme{Scheme: tpm2.KeyedHashSchemeNull}}}}
+
+// storagePrimarySeedName returns a name that identifies the current storage primary seed, and which changes when the TPM is
+// cleared.
+func storagePrimarySeedName(tpm *tpm2.TPMContext, session tpm2.SessionContext) (tpm2.Name, error) {
+	obj, _, _, _, _, err := tpm.CreatePrimary(tpm.OwnerHandleContext(), nil, storagePrimarySeedTemplate, nil, nil, session)
+	if err != nil {
+		return nil, err
+	}
+	defer tpm.FlushContext(obj)
+	return obj.Name(), nil
+}
+
+// clearedTPM indicates whether the TPM was cleared by the call to TPMConnection.EnsureProvisioned that recorded this checkpoint,
+// and hasn't been cleared again since. This is the case if the storage primary seed is the one recorded after clearing the TPM.
+func (cp *provisioningCheckpoint) clearedTPM(tpm *tpm2.TPMContext, session tpm2.SessionContext) (bool, error) {
+	if len(cp.ClearedSeedName) == 0 {
+		return false, nil
+	}
+	name, err := storagePrimarySeedName(tpm, session)
+	switch {
+	case isAuthFailError(err, tpm2.CommandCreatePrimary, 1):
+		// The storage hierarchy authorization value has been set since the TPM was cleared.
+		return false, nil
+	case err != nil:
+		return false, xerrors.Errorf("cannot determine storage primary seed: %w", err)
+	}
+	return bytes.Equal(name, cp.ClearedSeedName), nil
+}
+
+// ClearProvisioningCheckpoint discards the record of the steps completed by an interrupted call to EnsureProvisioned on this
+// connection, so that the next call starts from the beginning.
+func (t *TPMConnection) ClearProvisioningCheckpoint() error {
+	cp := &provisioningCheckpoint{path: t.provisioningCheckpointPath()}
+	return cp.remove()
+}
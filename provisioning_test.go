@@ -21,6 +21,11 @@ package secboot_test
 
 import (
 	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/canonical/go-tpm2"
@@ -228,6 +233,202 @@ func TestProvisionNewTPM(t *testing.T) {
 	}
 }
 
+func TestProvisionProgress(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	var stages []string
+	var percents []int
+	tpm.SetProgressFunc(func(stage string, percent int) {
+		stages = append(stages, stage)
+		percents = append(percents, percent)
+	})
+	defer tpm.SetProgressFunc(nil)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeClear, nil); err != nil {
+		t.Fatalf("EnsureProvisioned failed: %v", err)
+	}
+
+	expectedStages := []string{"checking TPM", "clearing TPM", "provisioning endorsement key", "provisioning storage root key",
+		"checking primary keys", "configuring lockout hierarchy", "done"}
+	if len(stages) != len(expectedStages) {
+		t.Fatalf("Unexpected stages: %v", stages)
+	}
+	for i, stage := range expectedStages {
+		if stages[i] != stage {
+			t.Errorf("Unexpected stage %d: %s", i, stages[i])
+		}
+		if i > 0 && percents[i] <= percents[i-1] {
+			t.Errorf("Progress went backwards at stage %d: %v", i, percents)
+		}
+	}
+	if percents[len(percents)-1] != 100 {
+		t.Errorf("Unexpected final progress: %d", percents[len(percents)-1])
+	}
+}
+
+func TestProvisionCheckpoint(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	dir, err := ioutil.TempDir("", "secboot-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tpm.SetProvisioningCheckpointDir(dir)
+
+	checkpointPath := filepath.Join(dir, "provisioning-checkpoint")
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	// Provisioning without the lockout hierarchy can't complete on a cleared TPM, so the checkpoint should be retained.
+	if err := tpm.EnsureProvisioned(ProvisionModeWithoutLockout, nil); err != ErrTPMProvisioningRequiresLockout {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := os.Stat(checkpointPath); err != nil {
+		t.Errorf("Checkpoint wasn't recorded: %v", err)
+	}
+
+	ek, err := tpm.CreateResourceContextFromTPM(tcg.EKHandle)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	ekName := ek.Name()
+
+	// Resuming should reuse the primary keys provisioned by the previous call.
+	var stages []string
+	tpm.SetProgressFunc(func(stage string, percent int) {
+		stages = append(stages, stage)
+	})
+	defer tpm.SetProgressFunc(nil)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeWithoutLockout, nil); err != ErrTPMProvisioningRequiresLockout {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	validateEK(t, tpm.TPMContext)
+	validateSRK(t, tpm.TPMContext)
+
+	expectedStages := []string{"checking TPM", "reusing endorsement key", "reusing storage root key"}
+	if !reflect.DeepEqual(stages, expectedStages) {
+		t.Errorf("Unexpected stages: %v", stages)
+	}
+
+	// A checkpoint must not prevent the TPM from being cleared.
+	stages = nil
+	if err := tpm.EnsureProvisioned(ProvisionModeClear, nil); err != nil {
+		t.Fatalf("EnsureProvisioned failed: %v", err)
+	}
+	validateEK(t, tpm.TPMContext)
+	validateSRK(t, tpm.TPMContext)
+
+	if len(stages) < 2 || stages[1] != "clearing TPM" {
+		t.Errorf("Unexpected stages: %v", stages)
+	}
+	ek, err = tpm.CreateResourceContextFromTPM(tcg.EKHandle)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	if bytes.Equal(ek.Name(), ekName) {
+		t.Errorf("TPM wasn't cleared")
+	}
+	if _, err := os.Stat(checkpointPath); !os.IsNotExist(err) {
+		t.Errorf("Checkpoint wasn't removed on success: %v", err)
+	}
+
+	// Reset the TPM for the rest of the test, and record a new checkpoint.
+	clearTPMWithPlatformAuth(t, tpm)
+	if err := tpm.EnsureProvisioned(ProvisionModeWithoutLockout, nil); err != ErrTPMProvisioningRequiresLockout {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := tpm.ClearProvisioningCheckpoint(); err != nil {
+		t.Errorf("ClearProvisioningCheckpoint failed: %v", err)
+	}
+	if _, err := os.Stat(checkpointPath); !os.IsNotExist(err) {
+		t.Errorf("Checkpoint wasn't removed: %v", err)
+	}
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("EnsureProvisioned failed: %v", err)
+	}
+	validateEK(t, tpm.TPMContext)
+	validateSRK(t, tpm.TPMContext)
+	if _, err := os.Stat(checkpointPath); !os.IsNotExist(err) {
+		t.Errorf("Checkpoint wasn't removed on success: %v", err)
+	}
+}
+
+func TestProvisionCheckpointResumeClear(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	dir, err := ioutil.TempDir("", "secboot-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tpm.SetProvisioningCheckpointDir(dir)
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	lockoutAuth := []byte("1234")
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, lockoutAuth); err != nil {
+		t.Fatalf("EnsureProvisioned failed: %v", err)
+	}
+	tpm.LockoutHandleContext().SetAuthValue(lockoutAuth)
+
+	// Interrupt a call that clears the TPM after the clear has completed.
+	errInterrupted := errors.New("interrupted")
+	tpm.SetProgressFunc(func(stage string, percent int) {
+		if stage == "provisioning endorsement key" {
+			panic(errInterrupted)
+		}
+	})
+	func() {
+		defer func() {
+			if r := recover(); r != errInterrupted {
+				panic(r)
+			}
+		}()
+		tpm.EnsureProvisioned(ProvisionModeClear, lockoutAuth)
+		t.Errorf("EnsureProvisioned wasn't interrupted")
+	}()
+
+	// Resuming with the original lockout hierarchy authorization value should not attempt to clear the TPM again.
+	var stages []string
+	tpm.SetProgressFunc(func(stage string, percent int) {
+		stages = append(stages, stage)
+	})
+	defer tpm.SetProgressFunc(nil)
+
+	tpm.LockoutHandleContext().SetAuthValue(lockoutAuth)
+	if err := tpm.EnsureProvisioned(ProvisionModeClear, lockoutAuth); err != nil {
+		t.Fatalf("EnsureProvisioned failed: %v", err)
+	}
+	validateEK(t, tpm.TPMContext)
+	validateSRK(t, tpm.TPMContext)
+
+	if len(stages) < 2 || stages[1] != "reusing cleared TPM" {
+		t.Errorf("Unexpected stages: %v", stages)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "provisioning-checkpoint")); !os.IsNotExist(err) {
+		t.Errorf("Checkpoint wasn't removed on success: %v", err)
+	}
+
+	// Once provisioning has completed, the TPM is cleared again as normal.
+	stages = nil
+	tpm.LockoutHandleContext().SetAuthValue(lockoutAuth)
+	if err := tpm.EnsureProvisioned(ProvisionModeClear, lockoutAuth); err != nil {
+		t.Fatalf("EnsureProvisioned failed: %v", err)
+	}
+	if len(stages) < 2 || stages[1] != "clearing TPM" {
+		t.Errorf("Unexpected stages: %v", stages)
+	}
+}
+
 func TestProvisionErrorHandling(t *testing.T) {
 	tpm, _ := openTPMSimulatorForTesting(t)
 	defer func() {
@@ -379,6 +580,28 @@ func TestProvisionErrorHandling(t *testing.T) {
 	}
 }
 
+func TestPrimaryKeysStatus(t *testing.T) {
+	tpm, tcti := openTPMSimulatorForTesting(t)
+	defer func() {
+		closeTPM(t, tpm)
+	}()
+
+	// Reconnect after clearing the TPM so that the status is determined when the connection is initialized.
+	clearTPMWithPlatformAuth(t, tpm)
+	tpm, _ = resetTPMSimulator(t, tpm, tcti)
+
+	if err := tpm.PrimaryKeysStatus(); err != ErrTPMProvisioning {
+		t.Errorf("Unexpected status before provisioning: %v", err)
+	}
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("EnsureProvisioned failed: %v", err)
+	}
+	if err := tpm.PrimaryKeysStatus(); err != nil {
+		t.Errorf("Unexpected status after provisioning: %v", err)
+	}
+}
+
 func TestRecreateEK(t *testing.T) {
 	tpm, _ := openTPMSimulatorForTesting(t)
 	defer closeTPM(t, tpm)
@@ -0,0 +1,170 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// TPMQuirks is a set of workarounds for known defects or undesirable behaviour in specific TPM implementations, in particular
+// firmware TPMs. The quirks that apply to a TPM are determined from the manufacturer and firmware version properties when a
+// connection is initialized, by matching them against a set of rules that each apply to a range of firmware versions from a single
+// manufacturer. Additional rules can be registered with RegisterTPMQuirkRule. The active quirks can be queried with
+// TPMConnection.Quirks.
+//
+// Quirks never relax any of the security properties provided by this package.
+type TPMQuirks uint32
+
+const (
+	// TPMQuirkSlowGetRandom indicates that TPM2_GetRandom can take an excessive amount of time to complete and stall the system,
+	// as is the case on AMD firmware TPMs which access SPI flash in order to service it. When this quirk is active, the proof
+	// of ownership check for the endorsement key is performed with TPM2_GetCapability instead.
+	TPMQuirkSlowGetRandom TPMQuirks = 1 << iota
+
+	// TPMQuirkNVPublicReadback indicates that the TPM may not report the attributes of a NV index exactly as they are expected
+	// to be after it is defined and initialized. When this quirk is active, the public area of newly created NV indices is read
+	// back from the TPM rather than being computed locally. There are no built-in rules for this quirk, as no affected firmware
+	// versions are known. It is also activated on a connection if a mismatch is detected.
+	TPMQuirkNVPublicReadback
+)
+
+// TPMQuirkRule associates a set of quirks with a range of firmware versions from a single TPM manufacturer.
+type TPMQuirkRule struct {
+	Manufacturer tpm2.TPMManufacturer
+
+	// MinFirmwareVersion and MaxFirmwareVersion define the inclusive range of affected firmware versions, as reported by the
+	// TPM_PT_FIRMWARE_VERSION_1 (most significant 32 bits) and TPM_PT_FIRMWARE_VERSION_2 (least significant 32 bits) properties.
+	MinFirmwareVersion uint64
+	MaxFirmwareVersion uint64
+
+	Quirks TPMQuirks
+
+	// CommandTimeouts optionally specifies the default command timeouts for affected TPMs, which are applied to a connection
+	// unless they have already been set with TPMConnection.SetCommandTimeouts. See TPMCommandTimeouts for the limitations of
+	// these.
+	CommandTimeouts *TPMCommandTimeouts
+}
+
+func (r *TPMQuirkRule) appliesTo(manufacturer tpm2.TPMManufacturer, firmwareVersion uint64) bool {
+	return r.Manufacturer == manufacturer && firmwareVersion >= r.MinFirmwareVersion && firmwareVersion <= r.MaxFirmwareVersion
+}
+
+var (
+	tpmQuirkRulesMu sync.Mutex
+
+	// tpmQuirkRules contains the built-in rules followed by any registered with RegisterTPMQuirkRule.
+	tpmQuirkRules = []*TPMQuirkRule{
+		// AMD firmware TPMs with the SPI flash stall, using the same firmware ranges as the Linux kernel (see
+		// tpm_amd_is_rng_defective).
+		{
+			Manufacturer:       tpm2.TPMManufacturerAMD,
+			MinFirmwareVersion: 0x0003000000000000,
+			MaxFirmwareVersion: 0x0003005700000004,
+			Quirks:             TPMQuirkSlowGetRandom},
+		{
+			Manufacturer:       tpm2.TPMManufacturerAMD,
+			MinFirmwareVersion: 0x0006000000000000,
+			MaxFirmwareVersion: 0x0006000000180005,
+			Quirks:             TPMQuirkSlowGetRandom},
+	}
+)
+
+// RegisterTPMQuirkRule registers an additional rule for determining the quirks that apply to a TPM, for defects that aren't
+// covered by the built-in rules. It affects connections that are initialized after it is called. Rules must not be modified
+// once they have been registered. If more than one registered rule with command timeouts applies to a TPM, the most recently
+// registered one is used.
+func RegisterTPMQuirkRule(rule *TPMQuirkRule) error {
+	if rule.MinFirmwareVersion > rule.MaxFirmwareVersion {
+		return errors.New("invalid firmware version range")
+	}
+	tpmQuirkRulesMu.Lock()
+	defer tpmQuirkRulesMu.Unlock()
+	tpmQuirkRules = append(tpmQuirkRules, rule)
+	return nil
+}
+
+// UnregisterTPMQuirkRule removes a rule that was registered with RegisterTPMQuirkRule.
+func UnregisterTPMQuirkRule(rule *TPMQuirkRule) {
+	tpmQuirkRulesMu.Lock()
+	defer tpmQuirkRulesMu.Unlock()
+	for i, r := range tpmQuirkRules {
+		if r == rule {
+			tpmQuirkRules = append(tpmQuirkRules[:i], tpmQuirkRules[i+1:]...)
+			return
+		}
+	}
+}
+
+// lookupTPMQuirks returns the quirks and default command timeouts that apply to a TPM with the specified manufacturer and
+// firmware version. The returned timeouts are nil if there are no rules that specify them.
+func lookupTPMQuirks(manufacturer tpm2.TPMManufacturer, firmwareVersion uint64) (quirks TPMQuirks, timeouts *TPMCommandTimeouts) {
+	tpmQuirkRulesMu.Lock()
+	defer tpmQuirkRulesMu.Unlock()
+	for _, r := range tpmQuirkRules {
+		if !r.appliesTo(manufacturer, firmwareVersion) {
+			continue
+		}
+		quirks |= r.Quirks
+		if r.CommandTimeouts != nil {
+			timeouts = r.CommandTimeouts
+		}
+	}
+	return quirks, timeouts
+}
+
+// tpmFirmwareInfo contains the manufacturer and firmware version of a TPM.
+type tpmFirmwareInfo struct {
+	Manufacturer    tpm2.TPMManufacturer
+	FirmwareVersion uint64
+}
+
+// readTPMFirmwareInfo obtains the manufacturer and firmware version properties from the TPM.
+func readTPMFirmwareInfo(tpm *tpm2.TPMContext, sessions ...tpm2.SessionContext) (*tpmFirmwareInfo, error) {
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyManufacturer, 1, sessions...)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain manufacturer property: %w", err)
+	}
+	if len(props) == 0 || props[0].Property != tpm2.PropertyManufacturer {
+		return nil, errors.New("TPM returned value for the wrong property")
+	}
+	manufacturer := tpm2.TPMManufacturer(props[0].Value)
+
+	props, err = tpm.GetCapabilityTPMProperties(tpm2.PropertyFirmwareVersion1, 2, sessions...)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain firmware version properties: %w", err)
+	}
+	if len(props) != 2 || props[0].Property != tpm2.PropertyFirmwareVersion1 || props[1].Property != tpm2.PropertyFirmwareVersion2 {
+		return nil, errors.New("TPM returned values for the wrong properties")
+	}
+
+	return &tpmFirmwareInfo{
+		Manufacturer:    manufacturer,
+		FirmwareVersion: uint64(props[0].Value)<<32 | uint64(props[1].Value)}, nil
+}
+
+// Quirks returns the set of workarounds for known defects that are active for the TPM associated with this connection.
+func (t *TPMConnection) Quirks() TPMQuirks {
+	return t.quirks
+}
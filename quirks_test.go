@@ -0,0 +1,88 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"time"
+
+	"github.com/canonical/go-tpm2"
+
+	. "github.com/snapcore/secboot"
+
+	. "gopkg.in/check.v1"
+)
+
+type quirksSuite struct{}
+
+var _ = Suite(&quirksSuite{})
+
+func (s *quirksSuite) TestLookupAMDAffected(c *C) {
+	quirks, timeouts := LookupTPMQuirks(tpm2.TPMManufacturerAMD, 0x0003005700000004)
+	c.Check(quirks, Equals, TPMQuirkSlowGetRandom)
+	c.Check(timeouts, IsNil)
+
+	quirks, _ = LookupTPMQuirks(tpm2.TPMManufacturerAMD, 0x0006000000180005)
+	c.Check(quirks, Equals, TPMQuirkSlowGetRandom)
+}
+
+func (s *quirksSuite) TestLookupAMDFixed(c *C) {
+	quirks, _ := LookupTPMQuirks(tpm2.TPMManufacturerAMD, 0x0003005700000005)
+	c.Check(quirks, Equals, TPMQuirks(0))
+
+	quirks, _ = LookupTPMQuirks(tpm2.TPMManufacturerAMD, 0x0006000000180006)
+	c.Check(quirks, Equals, TPMQuirks(0))
+}
+
+func (s *quirksSuite) TestLookupINTC(c *C) {
+	quirks, _ := LookupTPMQuirks(tpm2.TPMManufacturerINTC, 0x000b000000000000)
+	c.Check(quirks, Equals, TPMQuirks(0))
+}
+
+func (s *quirksSuite) TestLookupNone(c *C) {
+	quirks, timeouts := LookupTPMQuirks(tpm2.TPMManufacturerIBM, 0x2019000000000000)
+	c.Check(quirks, Equals, TPMQuirks(0))
+	c.Check(timeouts, IsNil)
+}
+
+func (s *quirksSuite) TestRegisterRule(c *C) {
+	rule := &TPMQuirkRule{
+		Manufacturer:       tpm2.TPMManufacturerINTC,
+		MinFirmwareVersion: 0x000b000000000000,
+		MaxFirmwareVersion: 0x000bffffffffffff,
+		Quirks:             TPMQuirkNVPublicReadback,
+		CommandTimeouts:    &TPMCommandTimeouts{Short: 5 * time.Second, Long: 2 * time.Minute}}
+	c.Assert(RegisterTPMQuirkRule(rule), IsNil)
+	defer UnregisterTPMQuirkRule(rule)
+
+	quirks, timeouts := LookupTPMQuirks(tpm2.TPMManufacturerINTC, 0x000b000000000000)
+	c.Check(quirks, Equals, TPMQuirkNVPublicReadback)
+	c.Check(timeouts, DeepEquals, rule.CommandTimeouts)
+
+	quirks, timeouts = LookupTPMQuirks(tpm2.TPMManufacturerINTC, 0x000c000000000000)
+	c.Check(quirks, Equals, TPMQuirks(0))
+	c.Check(timeouts, IsNil)
+}
+
+func (s *quirksSuite) TestRegisterRuleInvalidRange(c *C) {
+	c.Check(RegisterTPMQuirkRule(&TPMQuirkRule{
+		Manufacturer:       tpm2.TPMManufacturerINTC,
+		MinFirmwareVersion: 2,
+		MaxFirmwareVersion: 1}), ErrorMatches, "invalid firmware version range")
+}
@@ -0,0 +1,213 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	rawKeyDataMagic      uint32 = 0x53424b44 // "SBKD"
+	rawKeyDataHeaderSize        = 20
+)
+
+// rawKeyDataHeader is the header at the start of each copy of the key data stored by RawPartitionKeyLocation. The CRC covers the
+// other header fields and the key data that follows the header.
+type rawKeyDataHeader struct {
+	Magic    uint32
+	Sequence uint64
+	Size     uint32
+	CRC      uint32
+}
+
+func (h *rawKeyDataHeader) computeCRC(data []byte) uint32 {
+	var b [16]byte
+	binary.BigEndian.PutUint32(b[0:], h.Magic)
+	binary.BigEndian.PutUint64(b[4:], h.Sequence)
+	binary.BigEndian.PutUint32(b[12:], h.Size)
+	crc := crc32.ChecksumIEEE(b[:])
+	return crc32.Update(crc, crc32.IEEETable, data)
+}
+
+// RawPartitionKeyLocation is a KeyLocation that stores key data at a fixed offset of an unformatted partition or other block device,
+// for systems that don't have a filesystem on which key data can be stored.
+//
+// Two copies of the key data are stored in adjacent slots of SlotSize bytes, starting at Offset. Each copy has a header containing a
+// sequence number and a CRC. The valid copy with the highest sequence number is used when reading. When writing, the copy that
+// isn't currently in use is overwritten first and then the other copy is updated, so that there is always at least one valid copy
+// of either the old or new key data if the write is interrupted.
+type RawPartitionKeyLocation struct {
+	DevicePath string // The path of the partition
+	Offset     int64  // The offset in bytes of the first slot
+	SlotSize   int64  // The size in bytes of each slot, including the header
+}
+
+// NewRawPartitionKeyLocation returns a new RawPartitionKeyLocation for the partition at the specified path, with slots of the
+// specified size starting at the specified offset. The region used is 2 * slotSize bytes long.
+func NewRawPartitionKeyLocation(devicePath string, offset, slotSize int64) *RawPartitionKeyLocation {
+	return &RawPartitionKeyLocation{DevicePath: devicePath, Offset: offset, SlotSize: slotSize}
+}
+
+func (l *RawPartitionKeyLocation) String() string {
+	return fmt.Sprintf("%s@%d", l.DevicePath, l.Offset)
+}
+
+func (l *RawPartitionKeyLocation) check() error {
+	if l.Offset < 0 {
+		return errors.New("invalid offset")
+	}
+	if l.SlotSize <= rawKeyDataHeaderSize {
+		return errors.New("invalid slot size")
+	}
+	return nil
+}
+
+// readSlot reads and validates the copy of the key data in the specified slot. It returns a nil header if the slot doesn't contain
+// a valid copy.
+func (l *RawPartitionKeyLocation) readSlot(f io.ReaderAt, slot int) (*rawKeyDataHeader, []byte, error) {
+	r := io.NewSectionReader(f, l.Offset+int64(slot)*l.SlotSize, l.SlotSize)
+
+	var hdr rawKeyDataHeader
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	if hdr.Magic != rawKeyDataMagic || int64(hdr.Size) > l.SlotSize-rawKeyDataHeaderSize {
+		return nil, nil, nil
+	}
+
+	data := make([]byte, hdr.Size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	if hdr.computeCRC(data) != hdr.CRC {
+		return nil, nil, nil
+	}
+
+	return &hdr, data, nil
+}
+
+// readCurrent returns the slot containing the current copy of the key data, along with its header and contents. If there is no
+// valid copy, it returns a slot of -1.
+func (l *RawPartitionKeyLocation) readCurrent(f io.ReaderAt) (slot int, hdr *rawKeyDataHeader, data []byte, err error) {
+	slot = -1
+	for i := 0; i < 2; i++ {
+		h, d, err := l.readSlot(f, i)
+		if err != nil {
+			return -1, nil, nil, xerrors.Errorf("cannot read slot %d: %w", i, err)
+		}
+		if h == nil {
+			continue
+		}
+		if hdr == nil || h.Sequence > hdr.Sequence {
+			slot, hdr, data = i, h, d
+		}
+	}
+	return slot, hdr, data, nil
+}
+
+// Open implements KeyLocation.Open.
+func (l *RawPartitionKeyLocation) Open() (io.ReadCloser, error) {
+	if err := l.check(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(l.DevicePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	_, hdr, data, err := l.readCurrent(f)
+	if err != nil {
+		return nil, err
+	}
+	if hdr == nil {
+		return nil, &os.PathError{Op: "open", Path: l.String(), Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// WriteAtomic implements KeyLocation.WriteAtomic.
+func (l *RawPartitionKeyLocation) WriteAtomic(fn func(w io.Writer) error) error {
+	if err := l.check(); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := fn(&buf); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if int64(len(data)) > l.SlotSize-rawKeyDataHeaderSize {
+		return fmt.Errorf("key data is too large for slot (%d bytes)", len(data))
+	}
+
+	f, err := os.OpenFile(l.DevicePath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	current, hdr, _, err := l.readCurrent(f)
+	if err != nil {
+		return err
+	}
+
+	newHdr := rawKeyDataHeader{Magic: rawKeyDataMagic, Size: uint32(len(data))}
+	if hdr != nil {
+		newHdr.Sequence = hdr.Sequence + 1
+	}
+	newHdr.CRC = newHdr.computeCRC(data)
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, &newHdr)
+	b.Write(data)
+
+	// Write the slot that isn't in use first, so that the current copy is only overwritten once there is a valid new copy.
+	first := 0
+	if current == 0 {
+		first = 1
+	}
+	for _, slot := range []int{first, 1 - first} {
+		if _, err := f.WriteAt(b.Bytes(), l.Offset+int64(slot)*l.SlotSize); err != nil {
+			return xerrors.Errorf("cannot write slot %d: %w", slot, err)
+		}
+		if err := f.Sync(); err != nil {
+			return xerrors.Errorf("cannot sync slot %d: %w", slot, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/snapcore/secboot"
+
+	. "gopkg.in/check.v1"
+)
+
+type rawKeyLocationSuite struct {
+	devicePath string
+}
+
+var _ = Suite(&rawKeyLocationSuite{})
+
+func (s *rawKeyLocationSuite) SetUpTest(c *C) {
+	s.devicePath = filepath.Join(c.MkDir(), "mtdblock2")
+	c.Assert(ioutil.WriteFile(s.devicePath, make([]byte, 8192), 0600), IsNil)
+}
+
+func (s *rawKeyLocationSuite) write(c *C, l KeyLocation, data string) {
+	c.Assert(l.WriteAtomic(func(w io.Writer) error {
+		_, err := io.WriteString(w, data)
+		return err
+	}), IsNil)
+}
+
+func (s *rawKeyLocationSuite) read(c *C, l KeyLocation) string {
+	r, err := l.Open()
+	c.Assert(err, IsNil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	return string(data)
+}
+
+func (s *rawKeyLocationSuite) corrupt(c *C, offset int64) {
+	f, err := os.OpenFile(s.devicePath, os.O_RDWR, 0)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	_, err = f.WriteAt([]byte{0xff}, offset)
+	c.Assert(err, IsNil)
+}
+
+func (s *rawKeyLocationSuite) TestString(c *C) {
+	c.Check(NewRawPartitionKeyLocation("/dev/mtdblock2", 4096, 1024).String(), Equals, "/dev/mtdblock2@4096")
+}
+
+func (s *rawKeyLocationSuite) TestOpenEmpty(c *C) {
+	_, err := NewRawPartitionKeyLocation(s.devicePath, 1024, 2048).Open()
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *rawKeyLocationSuite) TestWriteAndRead(c *C) {
+	l := NewRawPartitionKeyLocation(s.devicePath, 1024, 2048)
+	s.write(c, l, "foo")
+	c.Check(s.read(c, l), Equals, "foo")
+	s.write(c, l, "barbaz")
+	c.Check(s.read(c, l), Equals, "barbaz")
+
+	// Data outside of the region isn't modified.
+	data, err := ioutil.ReadFile(s.devicePath)
+	c.Assert(err, IsNil)
+	c.Check(data[:1024], DeepEquals, make([]byte, 1024))
+	c.Check(data[1024+2*2048:], DeepEquals, make([]byte, 8192-1024-2*2048))
+}
+
+func (s *rawKeyLocationSuite) TestReadWithCorruptCopy(c *C) {
+	l := NewRawPartitionKeyLocation(s.devicePath, 0, 2048)
+	s.write(c, l, "foo")
+
+	// Corrupt the key data in the first copy.
+	s.corrupt(c, 20)
+	c.Check(s.read(c, l), Equals, "foo")
+
+	// Both copies are rewritten on the next write.
+	s.write(c, l, "bar")
+	s.corrupt(c, 2048+20)
+	c.Check(s.read(c, l), Equals, "bar")
+}
+
+func (s *rawKeyLocationSuite) TestReadAfterInterruptedWrite(c *C) {
+	l := NewRawPartitionKeyLocation(s.devicePath, 0, 2048)
+	s.write(c, l, "foo")
+
+	// Simulate a write that was interrupted after writing the slot that wasn't in use (the second one), by restoring the
+	// first slot to its previous contents afterwards.
+	before, err := ioutil.ReadFile(s.devicePath)
+	c.Assert(err, IsNil)
+	s.write(c, l, "bar")
+	after, err := ioutil.ReadFile(s.devicePath)
+	c.Assert(err, IsNil)
+	copy(after[0:2048], before[0:2048])
+	c.Assert(ioutil.WriteFile(s.devicePath, after, 0600), IsNil)
+	c.Check(s.read(c, l), Equals, "bar")
+
+	// Corrupt the new copy, and the previous key data is used.
+	s.corrupt(c, 2048+20)
+	c.Check(s.read(c, l), Equals, "foo")
+}
+
+func (s *rawKeyLocationSuite) TestWriteTooLarge(c *C) {
+	l := NewRawPartitionKeyLocation(s.devicePath, 0, 32)
+	c.Check(l.WriteAtomic(func(w io.Writer) error {
+		_, err := w.Write(make([]byte, 13))
+		return err
+	}), ErrorMatches, "key data is too large for slot \\(13 bytes\\)")
+}
+
+func (s *rawKeyLocationSuite) TestInvalidSlotSize(c *C) {
+	_, err := NewRawPartitionKeyLocation(s.devicePath, 0, 20).Open()
+	c.Check(err, ErrorMatches, "invalid slot size")
+}
@@ -0,0 +1,203 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/osutil/sys"
+
+	"golang.org/x/xerrors"
+)
+
+// RecoveryMarker records that a volume had to be activated with the fallback recovery key because activation with the TPM sealed
+// key failed. ActivateVolumeWithTPMSealedKey creates one of these in /run when it falls back to the recovery key, so that it
+// survives the transition from the initramfs to the booted system. The booted system can use ReadRecoveryMarkers to discover that
+// recovery happened and prompt the user to reseal or investigate, and then remove the marker with ClearRecoveryMarker.
+type RecoveryMarker struct {
+	VolumeName       string                 `json:"volume-name"`        // The name of the device mapper mapping
+	SourceDevicePath string                 `json:"source-device-path"` // The path of the encrypted block device
+	KeyPath          string                 `json:"key-path"`           // The path of the TPM sealed key data file that couldn't be used
+	Reason           RecoveryKeyUsageReason `json:"reason"`             // The reason that the recovery key was used
+	TPMError         string                 `json:"tpm-error"`          // The error that occurred when activating with the TPM sealed key
+	Time             time.Time              `json:"time"`               // The time that the volume was activated
+}
+
+// recoveryMarkerDir returns the directory in which recovery markers are kept.
+func recoveryMarkerDir() string {
+	return filepath.Join(runDir, "secboot", "recovery")
+}
+
+// writeRecoveryMarker atomically writes the supplied marker, replacing any existing marker for the same volume.
+func writeRecoveryMarker(marker *RecoveryMarker) error {
+	if err := checkVolumeName(marker.VolumeName); err != nil {
+		return err
+	}
+
+	dir := recoveryMarkerDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return xerrors.Errorf("cannot create recovery marker directory: %w", err)
+	}
+
+	f, err := osutil.NewAtomicFile(filepath.Join(dir, marker.VolumeName), 0600, 0, sys.UserID(osutil.NoChown), sys.GroupID(osutil.NoChown))
+	if err != nil {
+		return xerrors.Errorf("cannot create new atomic file: %w", err)
+	}
+	defer f.Cancel()
+
+	if err := json.NewEncoder(f).Encode(marker); err != nil {
+		return xerrors.Errorf("cannot write to temporary file: %w", err)
+	}
+
+	if err := f.Commit(); err != nil {
+		return xerrors.Errorf("cannot atomically replace file: %w", err)
+	}
+	return nil
+}
+
+func readRecoveryMarker(volumeName string) (*RecoveryMarker, error) {
+	if err := checkVolumeName(volumeName); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(recoveryMarkerDir(), volumeName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var marker RecoveryMarker
+	if err := json.NewDecoder(f).Decode(&marker); err != nil {
+		return nil, xerrors.Errorf("cannot decode recovery marker: %w", err)
+	}
+	if marker.VolumeName != volumeName {
+		return nil, fmt.Errorf("recovery marker has unexpected volume name %q", marker.VolumeName)
+	}
+	return &marker, nil
+}
+
+// ReadRecoveryMarkers returns the recovery markers for all volumes that were activated with the fallback recovery key by
+// ActivateVolumeWithTPMSealedKey during this boot and that haven't been cleared with ClearRecoveryMarker, sorted by volume name.
+// If there are none, an empty list is returned.
+func ReadRecoveryMarkers() ([]*RecoveryMarker, error) {
+	dir, err := os.Open(recoveryMarkerDir())
+	switch {
+	case isStateNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, xerrors.Errorf("cannot open recovery marker directory: %w", err)
+	}
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read recovery marker directory: %w", err)
+	}
+	sort.Strings(names)
+
+	var out []*RecoveryMarker
+	for _, name := range names {
+		marker, err := readRecoveryMarker(name)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read recovery marker for %s: %w", name, err)
+		}
+		out = append(out, marker)
+	}
+	return out, nil
+}
+
+// ClearRecoveryMarker removes the recovery marker for the volume with the specified name, once the condition that required the
+// recovery key to be used has been remediated. It is not an error if there is no marker for the volume.
+func ClearRecoveryMarker(volumeName string) error {
+	if err := checkVolumeName(volumeName); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(recoveryMarkerDir(), volumeName)); err != nil && !isStateNotExist(err) {
+		return xerrors.Errorf("cannot remove recovery marker: %w", err)
+	}
+	return nil
+}
+
+// ResealAfterRecoveryOptions provides options to ResealAfterRecovery.
+type ResealAfterRecoveryOptions struct {
+	// AuthKey is the private part of the key used for authorizing PCR policy updates, which was returned when the keys were
+	// sealed. This is required, because it isn't made available by activation with the recovery key.
+	AuthKey TPMPolicyAuthKey
+
+	// KeyPaths specifies the TPM sealed key data files to update. These must be related, in the same way as for
+	// UpdateKeyPCRProtectionPolicyMultiple. If this is empty, the key data file recorded in the recovery marker is updated.
+	KeyPaths []string
+
+	// PCRProfile specifies the PCR protection profile to reseal the keys with. This is required. The current boot required the
+	// recovery key, so its PCR values aren't trusted - the profile should be computed from the boot components that are
+	// expected to be used (eg, with AddEFISecureBootPolicyProfile), rather than from the current PCR values.
+	PCRProfile *PCRProtectionProfile
+}
+
+// ResealAfterRecovery performs the common remediation after a boot in which the volume with the specified name had to be
+// activated with the fallback recovery key: it updates the PCR protection policy of the TPM sealed keys for the volume so that
+// they can be unsealed in the current boot configuration, and then clears the recovery marker for the volume.
+//
+// If there is no recovery marker for the volume, a ErrNoRecoveryMarker error is returned. If the recovery marker indicates that
+// the recovery key was used because the TPM was in DA lockout mode or wasn't correctly provisioned, an error is returned and the
+// marker is retained, because updating the PCR protection policy won't fix these conditions.
+//
+// If the PCR protection policy cannot be updated, the recovery marker is retained and the error is returned.
+func ResealAfterRecovery(tpm *TPMConnection, volumeName string, options *ResealAfterRecoveryOptions) error {
+	if options == nil || options.AuthKey == nil {
+		return errors.New("no auth key provided")
+	}
+	if options.PCRProfile == nil {
+		return errors.New("no PCR protection profile provided")
+	}
+
+	marker, err := readRecoveryMarker(volumeName)
+	switch {
+	case isStateNotExist(err):
+		return ErrNoRecoveryMarker
+	case err != nil:
+		return xerrors.Errorf("cannot read recovery marker: %w", err)
+	}
+
+	switch marker.Reason {
+	case RecoveryKeyUsageReasonTPMLockout:
+		return errors.New("cannot remediate recovery by resealing: the TPM was in DA lockout mode")
+	case RecoveryKeyUsageReasonTPMProvisioningError:
+		return errors.New("cannot remediate recovery by resealing: the TPM was not correctly provisioned")
+	}
+
+	keyPaths := options.KeyPaths
+	if len(keyPaths) == 0 {
+		keyPaths = []string{marker.KeyPath}
+	}
+
+	if err := UpdateKeyPCRProtectionPolicyMultiple(tpm, keyPaths, options.AuthKey, options.PCRProfile); err != nil {
+		return xerrors.Errorf("cannot update PCR protection policy: %w", err)
+	}
+
+	return ClearRecoveryMarker(volumeName)
+}
@@ -0,0 +1,142 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto/sha256"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type resealAfterRecoverySuite struct {
+	testutil.TPMSimulatorTestBase
+	keyFile string
+	authKey TPMPolicyAuthKey
+}
+
+var _ = Suite(&resealAfterRecoverySuite{})
+
+func (s *resealAfterRecoverySuite) SetUpTest(c *C) {
+	s.TPMSimulatorTestBase.SetUpTest(c)
+	s.AddCleanup(MockRunDir(c.MkDir()))
+
+	c.Assert(s.TPM.EnsureProvisioned(ProvisionModeFull, nil), IsNil)
+	s.ResetTPMSimulator(c)
+
+	s.keyFile = filepath.Join(c.MkDir(), "keydata")
+
+	// Seal the key with a PCR profile that doesn't match the current boot.
+	profile := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 23, make(tpm2.Digest, 32))
+	_, err := s.TPM.PCREvent(s.TPM.PCRHandleContext(23), []byte("foo"), nil)
+	c.Assert(err, IsNil)
+
+	pcrPolicyCounterHandle := tpm2.Handle(0x0181fff0)
+	authKey, err := SealKeyToTPM(s.TPM, make([]byte, 32), s.keyFile, &KeyCreationParams{PCRProfile: profile, PCRPolicyCounterHandle: pcrPolicyCounterHandle})
+	c.Assert(err, IsNil)
+	s.authKey = authKey
+	pcrPolicyCounter, err := s.TPM.CreateResourceContextFromTPM(pcrPolicyCounterHandle)
+	c.Assert(err, IsNil)
+	s.AddCleanupNVSpace(c, s.TPM.OwnerHandleContext(), pcrPolicyCounter)
+}
+
+func (s *resealAfterRecoverySuite) TestResealAfterRecovery(c *C) {
+	k, err := ReadSealedKeyObject(s.keyFile)
+	c.Assert(err, IsNil)
+	_, _, err = k.UnsealFromTPM(s.TPM, "")
+	c.Assert(err, NotNil)
+
+	c.Assert(WriteRecoveryMarker(&RecoveryMarker{
+		VolumeName:       "data",
+		SourceDevicePath: "/dev/sda1",
+		KeyPath:          s.keyFile,
+		Reason:           RecoveryKeyUsageReasonInvalidKeyFile}), IsNil)
+
+	// Compute the profile for the expected boot configuration rather than reading the current PCR values.
+	h := sha256.Sum256([]byte("foo"))
+	profile := NewPCRProtectionProfile().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 23, make(tpm2.Digest, 32)).
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 23, h[:])
+
+	c.Check(ResealAfterRecovery(s.TPM, "data", &ResealAfterRecoveryOptions{AuthKey: s.authKey, PCRProfile: profile}), IsNil)
+
+	k, err = ReadSealedKeyObject(s.keyFile)
+	c.Assert(err, IsNil)
+	_, _, err = k.UnsealFromTPM(s.TPM, "")
+	c.Check(err, IsNil)
+
+	markers, err := ReadRecoveryMarkers()
+	c.Check(err, IsNil)
+	c.Check(markers, HasLen, 0)
+}
+
+func (s *resealAfterRecoverySuite) TestResealAfterRecoveryWithProfile(c *C) {
+	c.Assert(WriteRecoveryMarker(&RecoveryMarker{
+		VolumeName:       "data",
+		SourceDevicePath: "/dev/sda1",
+		KeyPath:          s.keyFile,
+		Reason:           RecoveryKeyUsageReasonInvalidKeyFile}), IsNil)
+
+	profile := NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7)
+	c.Check(ResealAfterRecovery(s.TPM, "data", &ResealAfterRecoveryOptions{AuthKey: s.authKey, KeyPaths: []string{s.keyFile}, PCRProfile: profile}), IsNil)
+
+	k, err := ReadSealedKeyObject(s.keyFile)
+	c.Assert(err, IsNil)
+	_, _, err = k.UnsealFromTPM(s.TPM, "")
+	c.Check(err, IsNil)
+}
+
+func (s *resealAfterRecoverySuite) TestResealAfterRecoveryNoProfile(c *C) {
+	c.Assert(WriteRecoveryMarker(&RecoveryMarker{
+		VolumeName:       "data",
+		SourceDevicePath: "/dev/sda1",
+		KeyPath:          s.keyFile,
+		Reason:           RecoveryKeyUsageReasonInvalidKeyFile}), IsNil)
+
+	c.Check(ResealAfterRecovery(s.TPM, "data", &ResealAfterRecoveryOptions{AuthKey: s.authKey}), ErrorMatches,
+		"no PCR protection profile provided")
+
+	markers, err := ReadRecoveryMarkers()
+	c.Check(err, IsNil)
+	c.Check(markers, HasLen, 1)
+}
+
+func (s *resealAfterRecoverySuite) TestResealAfterRecoveryNoMarker(c *C) {
+	c.Check(ResealAfterRecovery(s.TPM, "data", &ResealAfterRecoveryOptions{AuthKey: s.authKey, PCRProfile: NewPCRProtectionProfile()}), Equals, ErrNoRecoveryMarker)
+}
+
+func (s *resealAfterRecoverySuite) TestResealAfterRecoveryLockout(c *C) {
+	c.Assert(WriteRecoveryMarker(&RecoveryMarker{
+		VolumeName:       "data",
+		SourceDevicePath: "/dev/sda1",
+		KeyPath:          s.keyFile,
+		Reason:           RecoveryKeyUsageReasonTPMLockout}), IsNil)
+
+	c.Check(ResealAfterRecovery(s.TPM, "data", &ResealAfterRecoveryOptions{AuthKey: s.authKey, PCRProfile: NewPCRProtectionProfile()}), ErrorMatches,
+		"cannot remediate recovery by resealing: the TPM was in DA lockout mode")
+
+	markers, err := ReadRecoveryMarkers()
+	c.Check(err, IsNil)
+	c.Check(markers, HasLen, 1)
+}
@@ -0,0 +1,366 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"errors"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// undefinePcrPolicyCounter undefines the PCR policy counter at the specified handle, if there is one. This requires knowledge of
+// the authorization value for the storage hierarchy.
+func undefinePcrPolicyCounter(tpm *TPMConnection, handle tpm2.Handle, session tpm2.SessionContext) error {
+	return tpm.runWithHierarchyAuth(func() error {
+		index, err := tpm.CreateResourceContextFromTPM(handle, session.IncludeAttrs(tpm2.AttrAudit))
+		switch {
+		case tpm2.IsResourceUnavailableError(err, handle):
+			return nil
+		case err != nil:
+			return xerrors.Errorf("cannot create context for PCR policy counter: %w", err)
+		}
+		err = tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
+		switch {
+		case isAuthFailError(err, tpm2.CommandNVUndefineSpace, 1):
+			return AuthFailError{tpm2.HandleOwner}
+		case err != nil:
+			return xerrors.Errorf("cannot undefine PCR policy counter: %w", err)
+		}
+		return nil
+	})
+}
+
+// resealKeyFiles unseals the related sealed keys at the specified paths and seals them again with the supplied parameters,
+// replacing the existing key data files. The new sealed keys are created with the supplied PIN, which must also be the PIN for
+// the existing sealed keys. If retainAuthKey is true and the AuthKey field of params is not set, the existing key for authorizing
+// PCR policy updates is used for the new sealed keys. If keys is not nil, it supplies the key sealed in each existing key data file,
+// in the same order as keyPaths, and the existing sealed keys aren't unsealed. In this case, the existing key for authorizing PCR
+// policy updates can't be retained unless it is supplied via the AuthKey field of params. The metadata, wrapped lockout hierarchy authorization values, disk identity,
+// integrity parameters, dm-verity root hashes and plain dm-crypt parameters of each existing key data file are retained unless the
+// corresponding fields of params are set.
+// The volume key derivation parameters of each existing key data file are always retained, and the VolumeKeyDerivation field of
+// params is ignored.
+//
+// The new key data files are all created before any existing file is replaced. If any existing file cannot be replaced, the files
+// that have already been replaced are restored and the newly created PCR policy counter is undefined, so that the existing keys
+// remain usable. Once all of the files have been replaced, the existing PCR policy counter is undefined. If this fails, the
+// new authorization key is returned along with the error. If keys is not nil and the existing sealed keys are no longer bound to the
+// index at the handle of the existing PCR policy counter, that index is left alone.
+func resealKeyFiles(tpm *TPMConnection, keyPaths []string, pin string, keys [][]byte, params *KeyCreationParams, retainAuthKey bool) (TPMPolicyAuthKey, error) {
+	if len(keyPaths) == 0 {
+		return nil, errors.New("no key files supplied")
+	}
+	if keys != nil && len(keys) != len(keyPaths) {
+		return nil, errors.New("the number of keys doesn't match the number of key files")
+	}
+	if params == nil {
+		return nil, errors.New("no KeyCreationParams provided")
+	}
+
+	var objects []*SealedKeyObject
+	var requests []*SealKeyRequest
+	var authKey TPMPolicyAuthKey
+	defer func() {
+		// Wipe the copies of the supplied or unsealed keys, and remove any new key data files that weren't renamed.
+		for _, r := range requests {
+			wipeBytes(r.Key)
+			os.Remove(r.Path)
+		}
+	}()
+
+	for i, p := range keyPaths {
+		k, err := ReadSealedKeyObject(p)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && !bytes.Equal(k.data.keyPublic.AuthPolicy, objects[0].data.keyPublic.AuthPolicy) {
+			return nil, InvalidKeyFileError{"key data file " + p + " is not a related key file"}
+		}
+
+		var key []byte
+		if keys != nil {
+			key = make([]byte, len(keys[i]))
+			copy(key, keys[i])
+		} else {
+			var a TPMPolicyAuthKey
+			key, a, err = k.UnsealFromTPM(tpm, pin)
+			if err != nil {
+				return nil, xerrors.Errorf("cannot unseal key from %s: %w", p, err)
+			}
+			if i == 0 {
+				authKey = a
+			}
+		}
+
+		tmpPath := p + ".reseal"
+		os.Remove(tmpPath)
+
+		objects = append(objects, k)
+		requests = append(requests, &SealKeyRequest{Key: key, Path: tmpPath})
+	}
+
+	oldHandle := objects[0].PCRPolicyCounterHandle()
+	if oldHandle != tpm2.HandleNull && params.PCRPolicyCounterHandle == oldHandle {
+		return nil, errors.New("new PCR policy counter handle must be different to the existing one")
+	}
+
+	undefineOldHandle := oldHandle != tpm2.HandleNull
+	if keys != nil && undefineOldHandle {
+		// The keys weren't unsealed, so there's no proof that the index at the existing handle is still the PCR policy counter
+		// that they are bound to. It may have been replaced by someone else.
+		_, err := objects[0].data.validate(tpm.TPMContext, nil, tpm.currentHmacSession())
+		switch {
+		case isKeyFileError(err):
+			undefineOldHandle = false
+		case err != nil:
+			return nil, xerrors.Errorf("cannot validate existing key data: %w", err)
+		}
+	}
+
+	newParams := *params
+	if retainAuthKey && newParams.AuthKey == nil && authKey != nil && objects[0].data.version > 0 {
+		var err error
+		newParams.AuthKey, err = createECDSAPrivateKeyFromTPM(objects[0].data.staticPolicyData.authPublicKey, tpm2.ECCParameter(authKey))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot create auth key: %w", err)
+		}
+	}
+
+	newAuthKey, err := sealKeyToTPMMultiple(tpm, requests, &newParams, pin)
+	var auditErr error
+	switch {
+	case err != nil && newAuthKey != nil:
+		// The keys were sealed, but the audit event couldn't be recorded. This mustn't abort the operation.
+		auditErr = err
+	case err != nil:
+		return nil, xerrors.Errorf("cannot seal keys: %w", err)
+	}
+
+	session, err := tpm.secretSession()
+	if err != nil {
+		return nil, err
+	}
+
+	var replaced []int
+	rollback := func() {
+		for _, i := range replaced {
+			objects[i].data.writeToFileAtomic(keyPaths[i])
+		}
+		if !newParams.NoPCRPolicyCounter && newParams.PCRPolicyCounterHandle != tpm2.HandleNull {
+			undefinePcrPolicyCounter(tpm, newParams.PCRPolicyCounterHandle, session)
+		}
+	}
+
+	// Retain the per-file data that isn't supplied by the caller.
+	for i, r := range requests {
+		f, err := os.Open(r.Path)
+		if err != nil {
+			rollback()
+			return nil, xerrors.Errorf("cannot open new key data file: %w", err)
+		}
+		data, err := decodeKeyData(f)
+		f.Close()
+		if err != nil {
+			rollback()
+			return nil, xerrors.Errorf("cannot read new key data file: %w", err)
+		}
+		old := objects[i].data
+		if params.Metadata == nil {
+			data.metadata = old.metadata
+		}
+		if params.LockoutAuth == nil {
+			// The existing copies of the lockout hierarchy authorization value remain valid because they are wrapped with the
+			// sealed key or the recovery key, neither of which change here.
+			data.lockoutAuth = old.lockoutAuth
+		}
+		if params.DiskIdentity == nil {
+			data.diskIdentity = old.diskIdentity
+		}
+		if params.Integrity == nil {
+			data.integrity = old.integrity
+		}
+		if params.DmVerityRootHashes == nil {
+			data.verityRootHashes = old.verityRootHashes
+		}
+		if params.PlainCrypt == nil {
+			data.plainCrypt = old.plainCrypt
+		}
+		// The sealed secret doesn't change, so the keys derived from it must not change either.
+		data.volumeKeyDerivation = old.volumeKeyDerivation
+		if err := data.writeToFileAtomic(r.Path); err != nil {
+			rollback()
+			return nil, xerrors.Errorf("cannot write new key data file: %w", err)
+		}
+	}
+
+	for i, r := range requests {
+		if err := os.Rename(r.Path, keyPaths[i]); err != nil {
+			rollback()
+			return nil, xerrors.Errorf("cannot replace key data file: %w", err)
+		}
+		replaced = append(replaced, i)
+	}
+
+	if undefineOldHandle {
+		if err := undefinePcrPolicyCounter(tpm, oldHandle, session); err != nil {
+			return newAuthKey, xerrors.Errorf("cannot undefine existing PCR policy counter: %w", err)
+		}
+	}
+
+	return newAuthKey, auditErr
+}
+
+// RotatePolicyAuthKey replaces the key used for authorizing PCR policy updates for the related sealed keys at the paths specified
+// by the keyPaths argument. The new key can be supplied via the AuthKey field of the params argument, else a new one is generated.
+// The key is bound to the static authorization policy of each sealed key object and to the authorization policy of its PCR policy
+// counter, so this is done by unsealing each key and sealing it again with a new static authorization policy, and creating a new
+// PCR policy counter at the handle specified by the PCRPolicyCounterHandle field of params. This must be different to the handle
+// of the existing PCR policy counter, which is undefined once all of the key data files have been replaced. Once this has
+// happened, PCR policies signed by the previous key can no longer be used with any copies of the previous key data files.
+//
+// The PCR protection policy of the keys must be satisfied by the current PCR values, and the current PIN must be supplied via the
+// pin argument if one is set. The new keys keep the same PIN. The PCR protection profile for the new keys must be supplied via the
+// PCRProfile field of params. The metadata, any stored copies of the lockout hierarchy authorization value and the disk identity
+// are retained unless the Metadata, LockoutAuth or DiskIdentity fields of params are set.
+//
+// The key data files are updated atomically as a set. If any key data file cannot be updated, the ones that have already been
+// updated are restored and the new PCR policy counter is removed, so that the existing keys and authorization key remain usable.
+//
+// This function requires knowledge of the authorization value for the storage hierarchy. The errors returned from this function
+// are the same as those returned from SealedKeyObject.UnsealFromTPM and SealKeyToTPMMultiple.
+//
+// On success, this function returns the private part of the new key for authorizing PCR policy updates. This is also returned if
+// the key data files were replaced but the existing PCR policy counter could not be undefined afterwards, along with an error.
+func RotatePolicyAuthKey(tpm *TPMConnection, keyPaths []string, pin string, params *KeyCreationParams) (TPMPolicyAuthKey, error) {
+	if params == nil {
+		return nil, errors.New("no KeyCreationParams provided")
+	}
+	return resealKeyFiles(tpm, keyPaths, pin, nil, params, false)
+}
+
+// RebindStaticPolicyOptions provides options to RebindStaticPolicy.
+type RebindStaticPolicyOptions struct {
+	// PIN is the current PIN for the sealed keys, if one is set. It is used to unseal the existing keys, and the new keys are
+	// created with the same PIN.
+	PIN string
+
+	// Keys optionally supplies the key sealed in each of the key data files, in the same order as the key paths. This permits
+	// the static policy to be rebound when the existing keys can no longer be unsealed, eg, after the volume has been activated
+	// with the recovery key. These must be the keys sealed in the key data files, rather than the volume keys derived from them.
+	// If this is nil, the keys are unsealed from the TPM.
+	Keys [][]byte
+
+	// KeyVolumes identifies the LUKS2 container that each of the keys supplied via Keys unlocks, in the same order. This is
+	// required if Keys is set, and each key is checked against its container before any key data file is replaced, so that a
+	// wrong key can't be sealed in place of the existing one.
+	KeyVolumes []RebindKeyVolume
+}
+
+// RebindKeyVolume identifies the LUKS2 container that a key supplied to RebindStaticPolicy unlocks.
+type RebindKeyVolume struct {
+	// DevicePath is the path of the LUKS2 container.
+	DevicePath string
+
+	// Keyslot is the keyslot that the key unlocks. If this is negative, any keyslot is accepted.
+	Keyslot int
+
+	// VolumeKeyLabel is the label used to derive the key for the container if the key data file derives volume keys (see
+	// SealedKeyObject.DerivesVolumeKeys). It is ignored otherwise.
+	VolumeKeyLabel string
+}
+
+// verifySuppliedKey checks that the supplied key, which is expected to be the key sealed in the key data file at the specified
+// path, unlocks the specified LUKS2 container.
+func verifySuppliedKey(path string, key []byte, volume *RebindKeyVolume) error {
+	k, err := ReadSealedKeyObject(path)
+	if err != nil {
+		return err
+	}
+
+	volumeKey := key
+	if k.DerivesVolumeKeys() {
+		if volume.VolumeKeyLabel == "" {
+			return errors.New("no volume key label supplied")
+		}
+		volumeKey, err = k.data.volumeKeyDerivation.deriveKey(key, volume.VolumeKeyLabel)
+		if err != nil {
+			return xerrors.Errorf("cannot derive volume key: %w", err)
+		}
+		defer wipeBytes(volumeKey)
+	}
+
+	if err := testLUKS2Key(volume.DevicePath, volume.Keyslot, volumeKey); err != nil {
+		return xerrors.Errorf("key does not unlock %s: %w", volume.DevicePath, err)
+	}
+	return nil
+}
+
+// RebindStaticPolicy recreates the static authorization policy of the related sealed keys at the paths specified by the
+// keyPaths argument, binding them to a new PCR policy counter created at the handle specified by the PCRPolicyCounterHandle field
+// of params and to no other NV indices. This is intended for when NV indices that the existing keys are bound to, such as the
+// PCR policy counter or the legacy lock NV index used by v0 key data files, have been removed or replaced, so that the keys don't
+// have to be re-enrolled from scratch. The static authorization policy is part of each sealed key object and can't be changed,
+// so this is done by sealing each key again and replacing the key data files with ones using the current metadata version.
+//
+// By default, the existing keys are unsealed from the TPM, which requires their PCR protection policy to be satisfied by the
+// current PCR values and the NV indices that they are bound to to still be valid. If this isn't possible, the keys can be
+// supplied via the Keys field of options instead, along with the LUKS2 container that each one unlocks via the KeyVolumes field.
+// Each supplied key is checked against its container before anything is modified. In this case, the existing key for authorizing
+// PCR policy updates can only be retained by supplying it via the AuthKey field of params, else a new one is generated. If the key
+// data files are no longer bound to the index at the handle of the existing PCR policy counter, that index is not undefined. The
+// copies of the supplied keys made by this function are wiped before it returns, but the caller is responsible for wiping the
+// supplied keys.
+//
+// The PCR protection profile for the new keys must be supplied via the PCRProfile field of params. The metadata, any stored
+// copies of the lockout hierarchy authorization value and the disk identity are retained unless the corresponding fields of
+// params are set. The key data files are updated atomically as a set, in the same way as RotatePolicyAuthKey.
+//
+// This function requires knowledge of the authorization value for the storage hierarchy. The errors returned from this function
+// are the same as those returned from SealedKeyObject.UnsealFromTPM and SealKeyToTPMMultiple.
+//
+// On success, this function returns the private part of the key for authorizing PCR policy updates for the new keys.
+func RebindStaticPolicy(tpm *TPMConnection, keyPaths []string, params *KeyCreationParams, options *RebindStaticPolicyOptions) (TPMPolicyAuthKey, error) {
+	if params == nil {
+		return nil, errors.New("no KeyCreationParams provided")
+	}
+	if options == nil {
+		options = &RebindStaticPolicyOptions{}
+	}
+
+	if options.Keys != nil {
+		if len(options.Keys) != len(keyPaths) {
+			return nil, errors.New("the number of keys doesn't match the number of key files")
+		}
+		if len(options.KeyVolumes) != len(options.Keys) {
+			return nil, errors.New("the number of key volumes doesn't match the number of keys")
+		}
+		for i, p := range keyPaths {
+			if err := verifySuppliedKey(p, options.Keys[i], &options.KeyVolumes[i]); err != nil {
+				return nil, xerrors.Errorf("cannot verify supplied key for %s: %w", p, err)
+			}
+		}
+	}
+
+	return resealKeyFiles(tpm, keyPaths, options.PIN, options.Keys, params, true)
+}
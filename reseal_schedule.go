@@ -0,0 +1,256 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/osutil/sys"
+
+	"golang.org/x/xerrors"
+)
+
+// ScheduledResealPhase describes how far a scheduled reseal has progressed.
+type ScheduledResealPhase string
+
+const (
+	// ScheduledResealPhasePendingBoot indicates that the sealed keys have been (or are being) updated with a PCR protection
+	// policy that permits both the current and the pending boot configuration, and that the system is waiting to boot the
+	// pending configuration.
+	ScheduledResealPhasePendingBoot ScheduledResealPhase = "pending-boot"
+
+	// ScheduledResealPhaseCompleting indicates that the pending boot configuration booted successfully and that the sealed
+	// keys are being updated with a PCR protection policy that only permits it.
+	ScheduledResealPhaseCompleting ScheduledResealPhase = "completing"
+
+	// ScheduledResealPhaseAborting indicates that the pending boot configuration was abandoned and that the sealed keys are
+	// being updated with a PCR protection policy that only permits the current boot configuration.
+	ScheduledResealPhaseAborting ScheduledResealPhase = "aborting"
+)
+
+// ScheduledResealState is the persistent state of a scheduled reseal, written by BeginScheduledReseal, CompleteScheduledReseal
+// and AbortScheduledReseal so that an interrupted update can be resumed.
+type ScheduledResealState struct {
+	ID       string               `json:"id"`        // The caller supplied identifier of the pending boot configuration
+	Phase    ScheduledResealPhase `json:"phase"`     // The current phase
+	KeyPaths []string             `json:"key-paths"` // The TPM sealed key data files being updated
+	Time     time.Time            `json:"time"`      // The time that the current phase was entered
+}
+
+func writeScheduledResealState(path string, state *ScheduledResealState) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return xerrors.Errorf("cannot create state directory: %w", err)
+	}
+
+	f, err := osutil.NewAtomicFile(path, 0600, 0, sys.UserID(osutil.NoChown), sys.GroupID(osutil.NoChown))
+	if err != nil {
+		return xerrors.Errorf("cannot create new atomic file: %w", err)
+	}
+	defer f.Cancel()
+
+	if err := json.NewEncoder(f).Encode(state); err != nil {
+		return xerrors.Errorf("cannot write to temporary file: %w", err)
+	}
+
+	if err := f.Commit(); err != nil {
+		return xerrors.Errorf("cannot atomically replace file: %w", err)
+	}
+	return nil
+}
+
+// ReadScheduledResealState returns the state of the scheduled reseal recorded in the file at the specified path. If there is
+// no scheduled reseal, nil is returned with no error.
+func ReadScheduledResealState(path string) (*ScheduledResealState, error) {
+	f, err := os.Open(path)
+	switch {
+	case isStateNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, xerrors.Errorf("cannot open state file: %w", err)
+	}
+	defer f.Close()
+
+	var state ScheduledResealState
+	if err := json.NewDecoder(f).Decode(&state); err != nil {
+		return nil, xerrors.Errorf("cannot decode state: %w", err)
+	}
+	switch state.Phase {
+	case ScheduledResealPhasePendingBoot, ScheduledResealPhaseCompleting, ScheduledResealPhaseAborting:
+	default:
+		return nil, fmt.Errorf("invalid scheduled reseal phase %q", state.Phase)
+	}
+	if len(state.KeyPaths) == 0 {
+		return nil, errors.New("no key data files recorded in scheduled reseal state")
+	}
+	return &state, nil
+}
+
+// BeginScheduledReseal performs the first phase of a two-phase reseal, and should be called before rebooting in to a new boot
+// configuration (eg, after installing new boot assets). It updates the PCR protection policy of the related TPM sealed key data
+// files at the paths specified by keyPaths to a profile that is the union of the current and pending profiles, so that the keys
+// can be unsealed in either boot configuration. The id argument identifies the pending boot configuration, and must be supplied
+// again to CompleteScheduledReseal.
+//
+// The progress of the update is recorded in the file at the path specified by statePath, which must be on persistent storage.
+// The state is written before the sealed key data files are updated, so if this function is interrupted it can be called again
+// with the same arguments to resume.
+//
+// If statePath records a different scheduled reseal that hasn't been completed, an error is returned, because the sealed keys
+// may have been updated with a policy for a boot configuration that the caller isn't aware of. If statePath records that the
+// scheduled reseal with the same identifier is already being completed, an error is also returned.
+//
+// The previous PCR policy is revoked if the sealed key data files were created with a PCR policy counter. The errors returned
+// from this function are the same as those returned from UpdateKeyPCRProtectionPolicyMultiple.
+func BeginScheduledReseal(tpm *TPMConnection, statePath, id string, keyPaths []string, authKey TPMPolicyAuthKey, current, pending *PCRProtectionProfile) error {
+	if len(keyPaths) == 0 {
+		return errors.New("no key files supplied")
+	}
+	if current == nil || pending == nil {
+		return errors.New("both the current and pending PCR protection profiles must be supplied")
+	}
+
+	state, err := ReadScheduledResealState(statePath)
+	if err != nil {
+		return xerrors.Errorf("cannot read scheduled reseal state: %w", err)
+	}
+	if state != nil {
+		if state.ID != id {
+			return fmt.Errorf("cannot begin scheduled reseal: scheduled reseal %q has not been completed", state.ID)
+		}
+		switch state.Phase {
+		case ScheduledResealPhaseCompleting:
+			return fmt.Errorf("cannot begin scheduled reseal: scheduled reseal %q is already being completed", state.ID)
+		case ScheduledResealPhaseAborting:
+			return fmt.Errorf("cannot begin scheduled reseal: scheduled reseal %q is being aborted", state.ID)
+		}
+	}
+
+	if err := writeScheduledResealState(statePath, &ScheduledResealState{
+		ID:       id,
+		Phase:    ScheduledResealPhasePendingBoot,
+		KeyPaths: keyPaths,
+		Time:     time.Now()}); err != nil {
+		return xerrors.Errorf("cannot write scheduled reseal state: %w", err)
+	}
+
+	union := NewPCRProtectionProfile().AddProfileOR(current, pending)
+	if err := UpdateKeyPCRProtectionPolicyMultiple(tpm, keyPaths, authKey, union); err != nil {
+		return xerrors.Errorf("cannot update PCR protection policy: %w", err)
+	}
+
+	return nil
+}
+
+// CompleteScheduledReseal performs the second phase of a two-phase reseal started by BeginScheduledReseal, and should be called
+// once the pending boot configuration identified by id has booted successfully. It updates the PCR protection policy of the
+// sealed key data files recorded in the file at statePath to the profile supplied via the pending argument, removing the
+// branches for the previous boot configuration and revoking the previous PCR policy if the sealed key data files were created
+// with a PCR policy counter. The state file is removed on success.
+//
+// If this function is interrupted, it can be called again with the same arguments to resume.
+//
+// If there is no scheduled reseal recorded in statePath, a ErrNoScheduledReseal error is returned. If the recorded scheduled
+// reseal has a different identifier, an error is returned and the state is retained.
+func CompleteScheduledReseal(tpm *TPMConnection, statePath, id string, authKey TPMPolicyAuthKey, pending *PCRProtectionProfile) error {
+	if pending == nil {
+		return errors.New("no PCR protection profile provided")
+	}
+
+	state, err := ReadScheduledResealState(statePath)
+	switch {
+	case err != nil:
+		return xerrors.Errorf("cannot read scheduled reseal state: %w", err)
+	case state == nil:
+		return ErrNoScheduledReseal
+	case state.ID != id:
+		return fmt.Errorf("cannot complete scheduled reseal: the recorded scheduled reseal is %q", state.ID)
+	case state.Phase == ScheduledResealPhaseAborting:
+		return fmt.Errorf("cannot complete scheduled reseal: scheduled reseal %q is being aborted", state.ID)
+	}
+
+	if state.Phase != ScheduledResealPhaseCompleting {
+		state.Phase = ScheduledResealPhaseCompleting
+		state.Time = time.Now()
+		if err := writeScheduledResealState(statePath, state); err != nil {
+			return xerrors.Errorf("cannot write scheduled reseal state: %w", err)
+		}
+	}
+
+	if err := UpdateKeyPCRProtectionPolicyMultiple(tpm, state.KeyPaths, authKey, pending); err != nil {
+		return xerrors.Errorf("cannot update PCR protection policy: %w", err)
+	}
+
+	if err := os.Remove(statePath); err != nil && !isStateNotExist(err) {
+		return xerrors.Errorf("cannot remove scheduled reseal state: %w", err)
+	}
+	return nil
+}
+
+// AbortScheduledReseal abandons a scheduled reseal started by BeginScheduledReseal, and should be called if the pending boot
+// configuration identified by id will not be booted (eg, because installing the new boot assets failed or was reverted). It
+// updates the PCR protection policy of the sealed key data files recorded in the file at statePath to the profile supplied via
+// the current argument, removing the branches for the pending boot configuration and revoking the previous PCR policy if the
+// sealed key data files were created with a PCR policy counter. The state file is removed on success.
+//
+// If this function is interrupted, it can be called again with the same arguments to resume.
+//
+// If there is no scheduled reseal recorded in statePath, a ErrNoScheduledReseal error is returned. If the recorded scheduled
+// reseal has a different identifier or is already being completed by CompleteScheduledReseal, an error is returned and the
+// state is retained.
+func AbortScheduledReseal(tpm *TPMConnection, statePath, id string, authKey TPMPolicyAuthKey, current *PCRProtectionProfile) error {
+	if current == nil {
+		return errors.New("no PCR protection profile provided")
+	}
+
+	state, err := ReadScheduledResealState(statePath)
+	switch {
+	case err != nil:
+		return xerrors.Errorf("cannot read scheduled reseal state: %w", err)
+	case state == nil:
+		return ErrNoScheduledReseal
+	case state.ID != id:
+		return fmt.Errorf("cannot abort scheduled reseal: the recorded scheduled reseal is %q", state.ID)
+	case state.Phase == ScheduledResealPhaseCompleting:
+		return fmt.Errorf("cannot abort scheduled reseal: scheduled reseal %q is already being completed", state.ID)
+	}
+
+	if state.Phase != ScheduledResealPhaseAborting {
+		state.Phase = ScheduledResealPhaseAborting
+		state.Time = time.Now()
+		if err := writeScheduledResealState(statePath, state); err != nil {
+			return xerrors.Errorf("cannot write scheduled reseal state: %w", err)
+		}
+	}
+
+	if err := UpdateKeyPCRProtectionPolicyMultiple(tpm, state.KeyPaths, authKey, current); err != nil {
+		return xerrors.Errorf("cannot update PCR protection policy: %w", err)
+	}
+
+	if err := os.Remove(statePath); err != nil && !isStateNotExist(err) {
+		return xerrors.Errorf("cannot remove scheduled reseal state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type scheduledResealSuite struct {
+	testutil.TPMSimulatorTestBase
+	keyFile   string
+	statePath string
+	authKey   TPMPolicyAuthKey
+}
+
+var _ = Suite(&scheduledResealSuite{})
+
+func (s *scheduledResealSuite) SetUpTest(c *C) {
+	s.TPMSimulatorTestBase.SetUpTest(c)
+
+	c.Assert(s.TPM.EnsureProvisioned(ProvisionModeFull, nil), IsNil)
+	s.ResetTPMSimulator(c)
+
+	dir := c.MkDir()
+	s.keyFile = filepath.Join(dir, "keydata")
+	s.statePath = filepath.Join(dir, "state", "reseal")
+
+	pcrPolicyCounterHandle := tpm2.Handle(0x0181fff0)
+	authKey, err := SealKeyToTPM(s.TPM, make([]byte, 32), s.keyFile, &KeyCreationParams{
+		PCRProfile:             s.currentProfile(),
+		PCRPolicyCounterHandle: pcrPolicyCounterHandle})
+	c.Assert(err, IsNil)
+	s.authKey = authKey
+	pcrPolicyCounter, err := s.TPM.CreateResourceContextFromTPM(pcrPolicyCounterHandle)
+	c.Assert(err, IsNil)
+	s.AddCleanupNVSpace(c, s.TPM.OwnerHandleContext(), pcrPolicyCounter)
+}
+
+func (s *scheduledResealSuite) currentProfile() *PCRProtectionProfile {
+	return NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 23, make(tpm2.Digest, 32))
+}
+
+func (s *scheduledResealSuite) pendingProfile() *PCRProtectionProfile {
+	return NewPCRProtectionProfile().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 23, make(tpm2.Digest, 32)).
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 23, testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "foo"))
+}
+
+func (s *scheduledResealSuite) checkUnseal(c *C, expectSuccess bool) {
+	k, err := ReadSealedKeyObject(s.keyFile)
+	c.Assert(err, IsNil)
+	_, _, err = k.UnsealFromTPM(s.TPM, "")
+	if expectSuccess {
+		c.Check(err, IsNil)
+	} else {
+		c.Check(err, NotNil)
+	}
+}
+
+func (s *scheduledResealSuite) bootPending(c *C) {
+	s.ResetTPMSimulator(c)
+	_, err := s.TPM.PCREvent(s.TPM.PCRHandleContext(23), []byte("foo"), nil)
+	c.Assert(err, IsNil)
+}
+
+func (s *scheduledResealSuite) TestScheduledReseal(c *C) {
+	c.Check(BeginScheduledReseal(s.TPM, s.statePath, "update1", []string{s.keyFile}, s.authKey, s.currentProfile(), s.pendingProfile()), IsNil)
+
+	state, err := ReadScheduledResealState(s.statePath)
+	c.Assert(err, IsNil)
+	c.Assert(state, NotNil)
+	c.Check(state.ID, Equals, "update1")
+	c.Check(state.Phase, Equals, ScheduledResealPhasePendingBoot)
+	c.Check(state.KeyPaths, DeepEquals, []string{s.keyFile})
+
+	// The key can be unsealed in both the current and pending boot configurations.
+	s.checkUnseal(c, true)
+	s.bootPending(c)
+	s.checkUnseal(c, true)
+
+	c.Check(CompleteScheduledReseal(s.TPM, s.statePath, "update1", s.authKey, s.pendingProfile()), IsNil)
+
+	state, err = ReadScheduledResealState(s.statePath)
+	c.Check(err, IsNil)
+	c.Check(state, IsNil)
+
+	// The key can only be unsealed in the new boot configuration.
+	s.checkUnseal(c, true)
+	s.ResetTPMSimulator(c)
+	s.checkUnseal(c, false)
+}
+
+func (s *scheduledResealSuite) TestBeginScheduledResealResume(c *C) {
+	c.Check(BeginScheduledReseal(s.TPM, s.statePath, "update1", []string{s.keyFile}, s.authKey, s.currentProfile(), s.pendingProfile()), IsNil)
+	c.Check(BeginScheduledReseal(s.TPM, s.statePath, "update1", []string{s.keyFile}, s.authKey, s.currentProfile(), s.pendingProfile()), IsNil)
+
+	s.bootPending(c)
+	s.checkUnseal(c, true)
+}
+
+func (s *scheduledResealSuite) TestBeginScheduledResealInProgress(c *C) {
+	c.Check(BeginScheduledReseal(s.TPM, s.statePath, "update1", []string{s.keyFile}, s.authKey, s.currentProfile(), s.pendingProfile()), IsNil)
+	c.Check(BeginScheduledReseal(s.TPM, s.statePath, "update2", []string{s.keyFile}, s.authKey, s.currentProfile(), s.pendingProfile()), ErrorMatches,
+		"cannot begin scheduled reseal: scheduled reseal \"update1\" has not been completed")
+}
+
+func (s *scheduledResealSuite) TestCompleteScheduledResealNoState(c *C) {
+	c.Check(CompleteScheduledReseal(s.TPM, s.statePath, "update1", s.authKey, s.pendingProfile()), Equals, ErrNoScheduledReseal)
+}
+
+func (s *scheduledResealSuite) TestCompleteScheduledResealWrongID(c *C) {
+	c.Check(BeginScheduledReseal(s.TPM, s.statePath, "update1", []string{s.keyFile}, s.authKey, s.currentProfile(), s.pendingProfile()), IsNil)
+	c.Check(CompleteScheduledReseal(s.TPM, s.statePath, "update2", s.authKey, s.pendingProfile()), ErrorMatches,
+		"cannot complete scheduled reseal: the recorded scheduled reseal is \"update1\"")
+
+	state, err := ReadScheduledResealState(s.statePath)
+	c.Check(err, IsNil)
+	c.Check(state, NotNil)
+}
+
+func (s *scheduledResealSuite) TestCompleteScheduledResealResume(c *C) {
+	c.Check(BeginScheduledReseal(s.TPM, s.statePath, "update1", []string{s.keyFile}, s.authKey, s.currentProfile(), s.pendingProfile()), IsNil)
+	s.bootPending(c)
+
+	// Simulate an interruption after the state was advanced but before the key was updated.
+	c.Check(CompleteScheduledReseal(s.TPM, s.statePath, "update1", make(TPMPolicyAuthKey, 32), s.pendingProfile()), NotNil)
+	state, err := ReadScheduledResealState(s.statePath)
+	c.Assert(err, IsNil)
+	c.Check(state.Phase, Equals, ScheduledResealPhaseCompleting)
+
+	c.Check(BeginScheduledReseal(s.TPM, s.statePath, "update1", []string{s.keyFile}, s.authKey, s.currentProfile(), s.pendingProfile()), ErrorMatches,
+		"cannot begin scheduled reseal: scheduled reseal \"update1\" is already being completed")
+
+	c.Check(CompleteScheduledReseal(s.TPM, s.statePath, "update1", s.authKey, s.pendingProfile()), IsNil)
+	s.checkUnseal(c, true)
+}
+
+func (s *scheduledResealSuite) TestAbortScheduledReseal(c *C) {
+	c.Check(BeginScheduledReseal(s.TPM, s.statePath, "update1", []string{s.keyFile}, s.authKey, s.currentProfile(), s.pendingProfile()), IsNil)
+	c.Check(AbortScheduledReseal(s.TPM, s.statePath, "update1", s.authKey, s.currentProfile()), IsNil)
+
+	state, err := ReadScheduledResealState(s.statePath)
+	c.Check(err, IsNil)
+	c.Check(state, IsNil)
+
+	// The key can only be unsealed in the current boot configuration.
+	s.checkUnseal(c, true)
+	s.bootPending(c)
+	s.checkUnseal(c, false)
+}
+
+func (s *scheduledResealSuite) TestAbortScheduledResealNoState(c *C) {
+	c.Check(AbortScheduledReseal(s.TPM, s.statePath, "update1", s.authKey, s.currentProfile()), Equals, ErrNoScheduledReseal)
+}
+
+func (s *scheduledResealSuite) TestAbortScheduledResealWrongID(c *C) {
+	c.Check(BeginScheduledReseal(s.TPM, s.statePath, "update1", []string{s.keyFile}, s.authKey, s.currentProfile(), s.pendingProfile()), IsNil)
+	c.Check(AbortScheduledReseal(s.TPM, s.statePath, "update2", s.authKey, s.currentProfile()), ErrorMatches,
+		"cannot abort scheduled reseal: the recorded scheduled reseal is \"update1\"")
+}
+
+func (s *scheduledResealSuite) TestAbortScheduledResealResume(c *C) {
+	c.Check(BeginScheduledReseal(s.TPM, s.statePath, "update1", []string{s.keyFile}, s.authKey, s.currentProfile(), s.pendingProfile()), IsNil)
+
+	// Simulate an interruption after the state was advanced but before the key was updated.
+	c.Check(AbortScheduledReseal(s.TPM, s.statePath, "update1", make(TPMPolicyAuthKey, 32), s.currentProfile()), NotNil)
+	state, err := ReadScheduledResealState(s.statePath)
+	c.Assert(err, IsNil)
+	c.Check(state.Phase, Equals, ScheduledResealPhaseAborting)
+
+	c.Check(BeginScheduledReseal(s.TPM, s.statePath, "update1", []string{s.keyFile}, s.authKey, s.currentProfile(), s.pendingProfile()), ErrorMatches,
+		"cannot begin scheduled reseal: scheduled reseal \"update1\" is being aborted")
+	c.Check(CompleteScheduledReseal(s.TPM, s.statePath, "update1", s.authKey, s.pendingProfile()), ErrorMatches,
+		"cannot complete scheduled reseal: scheduled reseal \"update1\" is being aborted")
+
+	c.Check(AbortScheduledReseal(s.TPM, s.statePath, "update1", s.authKey, s.currentProfile()), IsNil)
+	s.checkUnseal(c, true)
+}
+
+func (s *scheduledResealSuite) TestAbortScheduledResealCompleting(c *C) {
+	c.Check(BeginScheduledReseal(s.TPM, s.statePath, "update1", []string{s.keyFile}, s.authKey, s.currentProfile(), s.pendingProfile()), IsNil)
+	s.bootPending(c)
+	c.Check(CompleteScheduledReseal(s.TPM, s.statePath, "update1", make(TPMPolicyAuthKey, 32), s.pendingProfile()), NotNil)
+
+	c.Check(AbortScheduledReseal(s.TPM, s.statePath, "update1", s.authKey, s.currentProfile()), ErrorMatches,
+		"cannot abort scheduled reseal: scheduled reseal \"update1\" is already being completed")
+}
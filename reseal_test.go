@@ -0,0 +1,248 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestRotatePolicyAuthKey(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestRotatePolicyAuthKey_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key1 := make([]byte, 64)
+	rand.Read(key1)
+	key2 := make([]byte, 64)
+	rand.Read(key2)
+
+	keyFiles := []string{filepath.Join(tmpDir, "keydata1"), filepath.Join(tmpDir, "keydata2")}
+
+	authKey, err := SealKeyToTPMMultiple(tpm, []*SealKeyRequest{{Key: key1, Path: keyFiles[0]}, {Key: key2, Path: keyFiles[1]}},
+		&KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+	if err != nil {
+		t.Fatalf("SealKeyToTPMMultiple failed: %v", err)
+	}
+
+	newAuthKey, err := RotatePolicyAuthKey(tpm, keyFiles, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810001})
+	if err != nil {
+		undefineKeyNVSpace(t, tpm, keyFiles[0])
+		t.Fatalf("RotatePolicyAuthKey failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFiles[0])
+
+	if bytes.Equal(newAuthKey, authKey) {
+		t.Errorf("Expected a new auth key")
+	}
+	if _, err := tpm.CreateResourceContextFromTPM(0x01810000); !tpm2.IsResourceUnavailableError(err, 0x01810000) {
+		t.Errorf("Expected the old PCR policy counter to be undefined (err: %v)", err)
+	}
+
+	for i, p := range keyFiles {
+		if err := ValidateKeyDataFile(tpm.TPMContext, p, newAuthKey, tpm.HmacSession()); err != nil {
+			t.Errorf("ValidateKeyDataFile failed: %v", err)
+		}
+
+		k, err := ReadSealedKeyObject(p)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		if k.PCRPolicyCounterHandle() != 0x01810001 {
+			t.Errorf("Unexpected PCR policy counter handle: %v", k.PCRPolicyCounterHandle())
+		}
+
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(unsealedKey, [][]byte{key1, key2}[i]) {
+			t.Errorf("Unexpected unsealed key")
+		}
+	}
+
+	if err := UpdateKeyPCRProtectionPolicyMultiple(tpm, keyFiles, authKey, getTestPCRProfile()); err == nil {
+		t.Errorf("UpdateKeyPCRProtectionPolicyMultiple should fail with the old auth key")
+	}
+	if err := UpdateKeyPCRProtectionPolicyMultiple(tpm, keyFiles, newAuthKey, getTestPCRProfile()); err != nil {
+		t.Errorf("UpdateKeyPCRProtectionPolicyMultiple failed: %v", err)
+	}
+}
+
+func TestRotatePolicyAuthKeyUnrelatedKeys(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestRotatePolicyAuthKeyUnrelatedKeys_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	keyFiles := []string{filepath.Join(tmpDir, "keydata1"), filepath.Join(tmpDir, "keydata2")}
+
+	if _, err := SealKeyToTPM(tpm, key, keyFiles[0], &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFiles[0])
+	if _, err := SealKeyToTPM(tpm, key, keyFiles[1], &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810001}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFiles[1])
+
+	_, err = RotatePolicyAuthKey(tpm, keyFiles, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810002})
+	if _, ok := err.(InvalidKeyFileError); !ok {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+// mockCryptsetupTestPassphrase installs a cryptsetup that accepts the key read from stdin only if it matches the supplied key.
+func mockCryptsetupTestPassphrase(t *testing.T, key []byte) (restore func()) {
+	dir, err := ioutil.TempDir("", "_mockCryptsetup_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, key, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	script := fmt.Sprintf("#!/bin/sh\ncat > %[1]s.in\ncmp -s %[1]s %[1]s.in || exit 2\n", keyFile)
+	if err := ioutil.WriteFile(filepath.Join(dir, "cryptsetup"), []byte(script), 0755); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	origPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+":"+origPath)
+	return func() {
+		os.Setenv("PATH", origPath)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRebindStaticPolicyWithSuppliedKey(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestRebindStaticPolicyWithSuppliedKey_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	// Replace the PCR policy counter with an unrelated index, so that the existing key can no longer be unsealed.
+	undefineKeyNVSpace(t, tpm, keyFile)
+	public := tpm2.NVPublic{
+		Index:   0x01810000,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8}
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &public, nil)
+	if err != nil {
+		t.Fatalf("NVDefineSpace failed: %v", err)
+	}
+	defer tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, nil)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if _, _, err := k.UnsealFromTPM(tpm, ""); err == nil {
+		t.Fatalf("UnsealFromTPM should fail with a replaced PCR policy counter")
+	}
+
+	restore := mockCryptsetupTestPassphrase(t, key)
+	defer restore()
+
+	volumes := []RebindKeyVolume{{DevicePath: "/dev/sda1", Keyslot: 0}}
+
+	wrongKey := make([]byte, 64)
+	rand.Read(wrongKey)
+	if _, err := RebindStaticPolicy(tpm, []string{keyFile}, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810001},
+		&RebindStaticPolicyOptions{Keys: [][]byte{wrongKey}, KeyVolumes: volumes}); err == nil {
+		t.Fatalf("RebindStaticPolicy should fail with a key that doesn't unlock the volume")
+	}
+	if _, err := tpm.CreateResourceContextFromTPM(0x01810001); !tpm2.IsResourceUnavailableError(err, 0x01810001) {
+		t.Errorf("RebindStaticPolicy should not have created a new PCR policy counter (err: %v)", err)
+	}
+
+	authKey, err := RebindStaticPolicy(tpm, []string{keyFile}, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810001},
+		&RebindStaticPolicyOptions{Keys: [][]byte{key}, KeyVolumes: volumes})
+	if err != nil {
+		t.Fatalf("RebindStaticPolicy failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	if _, err := tpm.CreateResourceContextFromTPM(0x01810000); err != nil {
+		t.Errorf("The unrelated index should not be undefined: %v", err)
+	}
+
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, authKey, tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+
+	k, err = ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(unsealedKey, key) {
+		t.Errorf("Unexpected unsealed key")
+	}
+}
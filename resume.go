@@ -0,0 +1,139 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+
+	"golang.org/x/xerrors"
+)
+
+// replayEventLogPCRs computes the values of the specified PCRs from the supplied TCG event log.
+func replayEventLogPCRs(log *tcglog.Log, alg tpm2.HashAlgorithmId, pcrs []int) (tpm2.PCRValues, error) {
+	if !log.Algorithms.Contains(tcglog.AlgorithmId(alg)) {
+		return nil, errors.New("the TCG event log does not have the requested algorithm")
+	}
+
+	values := make(tpm2.PCRValues)
+	for _, pcr := range pcrs {
+		values.SetValue(alg, pcr, make(tpm2.Digest, alg.Size()))
+	}
+
+	for _, event := range log.Events {
+		if event.EventType == tcglog.EventTypeNoAction {
+			// EV_NO_ACTION events are informational and aren't extended to the TPM.
+			continue
+		}
+		value, ok := values[alg][int(event.PCRIndex)]
+		if !ok {
+			continue
+		}
+		h := alg.NewHash()
+		h.Write(value)
+		h.Write(event.Digests[tcglog.AlgorithmId(alg)])
+		values[alg][int(event.PCRIndex)] = h.Sum(nil)
+	}
+
+	return values, nil
+}
+
+// readPCRsAndReplayEventLog returns the values of the specified PCRs computed from the TCG event log, and the current values read
+// from the TPM.
+func readPCRsAndReplayEventLog(tpm *TPMConnection, alg tpm2.HashAlgorithmId, pcrs []int) (expected, current tpm2.PCRValues, err error) {
+	log, err := tpm.EventLog()
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot compute PCR values from event log: %w", err)
+	}
+	expected, err = replayEventLogPCRs(log, alg, pcrs)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot compute PCR values from event log: %w", err)
+	}
+
+	_, current, err = tpm.PCRRead(tpm2.PCRSelectionList{{Hash: alg, Select: pcrs}}, tpm.currentHmacSession().IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot read current PCR values: %w", err)
+	}
+
+	return expected, current, nil
+}
+
+// CheckPCRConsistencyWithEventLog compares the current values of the specified PCRs in the specified bank with the values computed
+// by replaying the TCG event log for the current boot, and returns the PCRs that are inconsistent.
+//
+// Some platform firmware re-measures components when resuming from S3 suspend without recording these measurements in the event
+// log, so the PCR values read from the TPM after a resume differ from those that will be present on the next boot. Calling this
+// after the system has resumed from suspend detects this behaviour. On affected platforms, PCR profiles should not be computed with
+// PCRProtectionProfile.AddPCRValueFromTPM after a resume - use AddPCRValuesWithResumeBranch instead.
+//
+// Note that the initial value of PCR 0 depends on the locality from which the TPM was started. This function assumes locality 0, so
+// PCR 0 will be reported as inconsistent on platforms with a H-CRTM or that start the TPM from another locality.
+func CheckPCRConsistencyWithEventLog(tpm *TPMConnection, alg tpm2.HashAlgorithmId, pcrs []int) ([]int, error) {
+	expected, current, err := readPCRsAndReplayEventLog(tpm, alg, pcrs)
+	if err != nil {
+		return nil, err
+	}
+
+	var inconsistent []int
+	for _, pcr := range pcrs {
+		if !bytes.Equal(expected[alg][pcr], current[alg][pcr]) {
+			inconsistent = append(inconsistent, pcr)
+		}
+	}
+	sort.Ints(inconsistent)
+	return inconsistent, nil
+}
+
+// AddPCRValuesWithResumeBranch adds values for the specified PCRs in the specified bank to the supplied profile, in a way that is
+// robust against platforms where the PCR values read from the TPM after resuming from S3 suspend differ from those that are
+// present after a cold boot.
+//
+// The values computed by replaying the TCG event log are always added, as these are the values that will be present on the next
+// boot. If the current values of any of the PCRs in the TPM are inconsistent with the event log, as detected by
+// CheckPCRConsistencyWithEventLog, a second branch containing the current values read from the TPM is added in addition, so that
+// the key can also be unsealed in the resumed state.
+func AddPCRValuesWithResumeBranch(profile *PCRProtectionProfile, tpm *TPMConnection, alg tpm2.HashAlgorithmId, pcrs []int) error {
+	expected, current, err := readPCRsAndReplayEventLog(tpm, alg, pcrs)
+	if err != nil {
+		return err
+	}
+
+	coldBoot := NewPCRProtectionProfile()
+	resumed := NewPCRProtectionProfile()
+	consistent := true
+	for _, pcr := range pcrs {
+		coldBoot.AddPCRValue(alg, pcr, expected[alg][pcr])
+		resumed.AddPCRValue(alg, pcr, current[alg][pcr])
+		if !bytes.Equal(expected[alg][pcr], current[alg][pcr]) {
+			consistent = false
+		}
+	}
+
+	if consistent {
+		profile.AddProfileOR(coldBoot)
+	} else {
+		profile.AddProfileOR(coldBoot, resumed)
+	}
+	return nil
+}
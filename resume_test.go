@@ -0,0 +1,57 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+func TestPCRConsistencyWithEventLog(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	restoreEventLogPath := testutil.MockEventLogPath("testdata/eventlog1.bin")
+	defer restoreEventLogPath()
+
+	// The simulator's PCRs don't correspond to the mock event log, so this looks like a platform that re-measures on resume.
+	inconsistent, err := CheckPCRConsistencyWithEventLog(tpm, tpm2.HashAlgorithmSHA256, []int{7})
+	if err != nil {
+		t.Fatalf("CheckPCRConsistencyWithEventLog failed: %v", err)
+	}
+	if len(inconsistent) != 1 || inconsistent[0] != 7 {
+		t.Errorf("Unexpected inconsistent PCRs: %v", inconsistent)
+	}
+
+	profile := NewPCRProtectionProfile()
+	if err := AddPCRValuesWithResumeBranch(profile, tpm, tpm2.HashAlgorithmSHA256, []int{7}); err != nil {
+		t.Fatalf("AddPCRValuesWithResumeBranch failed: %v", err)
+	}
+	_, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	if err != nil {
+		t.Fatalf("ComputePCRDigests failed: %v", err)
+	}
+	if len(digests) != 2 {
+		t.Errorf("Unexpected number of PCR digests: %d", len(digests))
+	}
+}
@@ -28,6 +28,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/canonical/go-tpm2"
 	"github.com/canonical/go-tpm2/mu"
@@ -64,6 +65,13 @@ func computeSealedKeyDynamicAuthPolicy(tpm *tpm2.TPMContext, version uint32, alg
 		}
 	}
 
+	return computeSealedKeyDynamicAuthPolicyWithCount(tpm, version, alg, signAlg, authKey, counterName, nextPolicyCount, pcrProfile, session)
+}
+
+// computeSealedKeyDynamicAuthPolicyWithCount computes a dynamic authorization policy for the supplied PCR protection profile that
+// is valid for as long as the PCR policy counter with the specified name has a value that is not greater than policyCount.
+func computeSealedKeyDynamicAuthPolicyWithCount(tpm *tpm2.TPMContext, version uint32, alg, signAlg tpm2.HashAlgorithmId, authKey crypto.PrivateKey,
+	counterName tpm2.Name, policyCount uint64, pcrProfile *PCRProtectionProfile, session tpm2.SessionContext) (*dynamicPolicyData, error) {
 	supportedPcrs, err := tpm.GetCapabilityPCRs(session.IncludeAttrs(tpm2.AttrAudit))
 	if err != nil {
 		return nil, xerrors.Errorf("cannot determine supported PCRs: %w", err)
@@ -74,6 +82,9 @@ func computeSealedKeyDynamicAuthPolicy(tpm *tpm2.TPMContext, version uint32, alg
 	if err != nil {
 		return nil, xerrors.Errorf("cannot compute PCR digests from protection profile: %w", err)
 	}
+	if err := algorithmPolicy.checkPCRSelection(pcrs); err != nil {
+		return nil, err
+	}
 
 	for _, p := range pcrs {
 		for _, s := range p.Select {
@@ -105,7 +116,7 @@ func computeSealedKeyDynamicAuthPolicy(tpm *tpm2.TPMContext, version uint32, alg
 		pcrs:              pcrs,
 		pcrDigests:        pcrDigests,
 		policyCounterName: counterName,
-		policyCount:       nextPolicyCount}
+		policyCount:       policyCount}
 
 	policyData, err := computeDynamicPolicy(version, alg, &policyParams)
 	if err != nil {
@@ -124,22 +135,101 @@ type KeyCreationParams struct {
 	// must either be tpm2.HandleNull (in which case, no NV index will be created and the sealed key will not benefit from dynamic
 	// authorization policy revocation support), or it must be a valid NV index handle (MSO == 0x01). The choice of handle should take
 	// in to consideration the reserved indices from the "Registry of reserved TPM 2.0 handles and localities" specification. It is
-	// recommended that the handle is in the block reserved for owner objects (0x01800000 - 0x01bfffff).
+	// recommended that the handle is in the block reserved for owner objects (0x01800000 - 0x01bfffff), and within that, in the range
+	// 0x01880000 - 0x0188ffff, which CheckTPMCoexistence recognizes as belonging to this package.
 	PCRPolicyCounterHandle tpm2.Handle
 
+	// NoPCRPolicyCounter explicitly requests that the key is sealed without a NV index for PCR policy revocation support, in which
+	// case PCRPolicyCounterHandle must be either zero or tpm2.HandleNull. This avoids using a NV index for each set of keys, which
+	// may be preferable on devices with little NV storage or where the key data is stored on read-only media, but every PCR policy
+	// created for the key remains valid for the lifetime of the key data file. Revocation then requires sealing a new key (eg, by
+	// reinstalling). The mode is recorded in the key data file and can be retrieved with SealedKeyObject.PCRPolicyRevocationMode.
+	NoPCRPolicyCounter bool
+
+	// PCRPolicyCounterNameAlg is the digest algorithm used to compute the name and authorization policy of the NV index created at
+	// PCRPolicyCounterHandle. This can be used on TPMs or in deployments where SHA-256 is not available or not permitted. If this
+	// is not set, tpm2.HashAlgorithmSHA256 is used.
+	PCRPolicyCounterNameAlg tpm2.HashAlgorithmId
+
 	// AuthKey can be set to chose an auhorisation key whose
 	// private part will be used for authorizing PCR policy
 	// updates with UpdateKeyPCRProtectionPolicy
 	// If set a key from elliptic.P256 must be used,
 	// if not set one is generated.
 	AuthKey *ecdsa.PrivateKey
+
+	// BindToEK specifies that the sealed key should be bound to the endorsement key of the TPM that it is sealed with. The name of
+	// the endorsement key is stored inside the sealed data, and SealedKeyObject.UnsealFromTPM will only return the key if the
+	// response from the TPM is protected by a session salted with the same endorsement key, which proves that the response came
+	// from the TPM that holds it. This requires a persistent endorsement key and a connection with a session that is salted with a
+	// verified endorsement key, such as one created with SecureConnectToDefaultTPM. The key can only be unsealed using a connection
+	// that has been verified in the same way.
+	BindToEK bool
+
+	// Metadata is optional metadata to store in the sealed key data files, which can be retrieved later on with
+	// SealedKeyObject.Metadata. The CreationTime field is ignored, and the current time is recorded instead.
+	Metadata *KeyMetadata
+
+	// LockoutAuth specifies that a copy of the lockout hierarchy authorization value should be stored in the sealed key data
+	// files, encrypted with the sealed key (and optionally a fallback recovery key). It can be recovered after a successful
+	// activation with SealedKeyObject.LockoutAuth. It is never added to the kernel keyring. If the lockout hierarchy
+	// authorization value changes, the stored copies can be updated with SealedKeyObject.RewrapLockoutAuth.
+	LockoutAuth *LockoutAuthParams
+
+	// VolumeKeyDerivation specifies that each key being sealed is a master secret from which the keys for individual volumes are
+	// derived with DeriveVolumeKey, rather than the key for a single volume. This means that adding a new encrypted volume doesn't
+	// require another sealing operation or another key data file. The keys for each volume can be obtained with
+	// SealedKeyObject.UnsealVolumeKeyFromTPM, or by setting the VolumeKeyLabel field of ActivateVolumeOptions.
+	VolumeKeyDerivation *VolumeKeyDerivationParams
+
+	// DiskIdentity identifies the disk and partitions that the keys are intended to unlock, and can be obtained with
+	// ReadDiskIdentity. If set, it is recorded in the key data files and ActivateVolumeWithTPMSealedKey verifies that the volume
+	// being activated is one of these partitions before unsealing the key. See the DiskIdentityCheck field of
+	// ActivateVolumeOptions.
+	DiskIdentity *DiskIdentity
+
+	// Integrity specifies the parameters of a standalone dm-integrity device beneath the volumes that the keys are for (see
+	// FormatIntegrityDevice). If set, it is recorded in the key data files so that ActivateVolumeWithTPMSealedKey can open the
+	// integrity device before activating the encrypted volume.
+	Integrity *IntegrityParams
+
+	// DmVerityRootHashes specifies the dm-verity root hashes of the immutable root filesystems that the keys may be used with. If
+	// set, they are recorded in the key data files and ActivateVolumeWithTPMSealedKey verifies that the root hash of the running
+	// root filesystem is one of them before unsealing the key. The recorded root hashes aren't integrity protected - to bind the
+	// keys to the root hashes cryptographically, the PCR protection profile should also include AddDmVerityProfile.
+	DmVerityRootHashes [][]byte
+
+	// PlainCrypt specifies the parameters of the plain dm-crypt volumes that the keys are for. If set, it is recorded in the key
+	// data files for information only - the recorded parameters aren't integrity protected, so they must also be supplied to
+	// ActivateVolumeWithTPMSealedKey via ActivateVolumeOptions.PlainCrypt. The sealed keys are used directly as the volume keys,
+	// so they must be PlainCrypt.KeySize bytes long.
+	PlainCrypt *PlainCryptParams
+
+	// Importable specifies that the sealed key objects are created outside of the TPM and wrapped so that they can be imported
+	// in to it as children of the storage root key, rather than being created by the TPM with TPM2_Create. The objects are
+	// imported each time that they are loaded. As they are not created with the fixedTPM and fixedParent attributes, they can be
+	// duplicated to another TPM with TPM2_Duplicate, but only by satisfying the same authorization policy that is required to
+	// unseal them. This means that a copy of the sealed key data can only be duplicated in circumstances where it could be
+	// unsealed anyway.
+	Importable bool
 }
 
 // SealKeyRequest corresponds to a key that should be sealed by SealKeyToTPMMultiple
-// to a file at the specified path.
+// to a file at the specified path, or to the specified location.
 type SealKeyRequest struct {
 	Key  []byte
 	Path string
+
+	// Location specifies where the sealed key data should be
+	// stored if it is not a file. Path is ignored if this is set.
+	Location KeyLocation
+}
+
+func (r *SealKeyRequest) location() KeyLocation {
+	if r.Location != nil {
+		return r.Location
+	}
+	return FileKeyLocation(r.Path)
 }
 
 // SealKeyToTPMMultiple seals the supplied disk encryption keys to the storage hierarchy of the TPM. The keys are specified by
@@ -148,8 +238,9 @@ type SealKeyRequest struct {
 // are written to files at the specifed paths.
 //
 // This function requires knowledge of the authorization value for the storage hierarchy, which must be provided by calling
-// TPMConnection.OwnerHandleContext().SetAuthValue() prior to calling this function. If the provided authorization value is incorrect,
-// a AuthFailError error will be returned.
+// TPMConnection.OwnerHandleContext().SetAuthValue() prior to calling this function. If the provided authorization value is incorrect
+// and a callback has been set with TPMConnection.SetHierarchyAuthFunc, a new value is requested from it. Otherwise, a
+// AuthFailError error will be returned.
 //
 // This function expects there to be no files at the specified paths. If the keys argument references a file that already exists, a
 // wrapped *os.PathError error will be returned with an underlying error of syscall.EEXIST. A wrapped *os.PathError error will be
@@ -163,7 +254,28 @@ type SealKeyRequest struct {
 // objects (0x01800000 - 0x01bfffff).
 //
 // All keys will be created with the same authorization policy, and will be protected with a PCR policy computed from the
-// PCRProtectionProfile supplied via the PCRProfile field of the params argument.
+// PCRProtectionProfile supplied via the PCRProfile field of the params argument. The static and dynamic authorization policies are
+// only computed once for the whole set of keys, so sealing several keys that share the same policy with a single call to this
+// function is considerably cheaper than sealing each of them with SealKeyToTPM. If the same path is specified for more than one key,
+// an error will be returned.
+//
+// If the Location field of a SealKeyRequest is set, the sealed key data is written to that KeyLocation instead of to a new file at
+// Path, such as a LUKS2TokenKeyLocation or a RawPartitionKeyLocation. KeyLocation.WriteAtomic is only called after all of the keys
+// have been sealed and the PCR policy counter has been initialized, and any existing key data at that location is replaced. If
+// writing to one location fails, locations that were already written are not restored.
+//
+// If the BindToEK field of the params argument is true and the TPM does not have a persistent endorsement key, a
+// ErrTPMProvisioning error will be returned. If it is true and the connection doesn't have a session that is salted with a verified
+// endorsement key, a ErrNoVerifiedSession error will be returned.
+//
+// If TPMConnection.RequireVerifiedSession is enabled and the connection doesn't have a verified session, a ErrNoVerifiedSession
+// error will be returned.
+//
+// If the objects created by this function or the PCR banks selected by the PCR protection profile are not permitted by the
+// algorithm policy installed with SetAlgorithmPolicy, then a (possibly wrapped) AlgorithmPolicyError error will be returned.
+//
+// If the storage root key, or the endorsement key when BindToEK is true, is affected by a known key generation weakness, a wrapped
+// WeakKeyError error will be returned.
 //
 // If any part of this function fails, no sealed keys will be created.
 //
@@ -175,6 +287,26 @@ type SealKeyRequest struct {
 // The authorization key can also be chosen and provided by setting
 // AuthKey in the params argument.
 func SealKeyToTPMMultiple(tpm *TPMConnection, keys []*SealKeyRequest, params *KeyCreationParams) (authKey TPMPolicyAuthKey, err error) {
+	return sealKeyToTPMMultiple(tpm, keys, params, "")
+}
+
+// sealKeyToTPMMultiple is the implementation of SealKeyToTPMMultiple. If pin is not empty, the sealed key objects are created with
+// it as their authorization value, in the same way as if it had been set afterwards with ChangePIN. If sealing fails because of an
+// incorrect owner hierarchy authorization value, it is attempted again with a value obtained from the HierarchyAuthFunc set on the
+// connection, if there is one.
+func sealKeyToTPMMultiple(tpm *TPMConnection, keys []*SealKeyRequest, params *KeyCreationParams, pin string) (authKey TPMPolicyAuthKey, err error) {
+	err = tpm.runWithHierarchyAuth(func() error {
+		var err error
+		authKey, err = trySealKeyToTPMMultiple(tpm, keys, params, pin)
+		return err
+	})
+	return authKey, err
+}
+
+// trySealKeyToTPMMultiple performs a single attempt at sealing the supplied keys for sealKeyToTPMMultiple.
+func trySealKeyToTPMMultiple(tpm *TPMConnection, keys []*SealKeyRequest, params *KeyCreationParams, pin string) (authKey TPMPolicyAuthKey, err error) {
+	defer observeOperation(MetricsOperationSeal, time.Now(), &err)
+
 	// params is mandatory.
 	if params == nil {
 		return nil, errors.New("no KeyCreationParams provided")
@@ -188,8 +320,140 @@ func SealKeyToTPMMultiple(tpm *TPMConnection, keys []*SealKeyRequest, params *Ke
 		return nil, errors.New("provided AuthKey must be from elliptic.P256, no other curve is supported")
 	}
 
+	volumeKeyDerivation, err := params.VolumeKeyDerivation.data()
+	if err != nil {
+		return nil, err
+	}
+	if params.Metadata != nil {
+		if err := params.Metadata.check(); err != nil {
+			return nil, xerrors.Errorf("invalid metadata: %w", err)
+		}
+	}
+	if err := checkDmVerityRootHashes(params.DmVerityRootHashes); err != nil {
+		return nil, xerrors.Errorf("invalid dm-verity root hashes: %w", err)
+	}
+	if params.Integrity != nil {
+		if err := params.Integrity.check(); err != nil {
+			return nil, xerrors.Errorf("invalid integrity parameters: %w", err)
+		}
+	}
+	if params.PlainCrypt != nil {
+		if err := params.PlainCrypt.check(); err != nil {
+			return nil, xerrors.Errorf("invalid plain dm-crypt parameters: %w", err)
+		}
+		if volumeKeyDerivation != nil {
+			if int(volumeKeyDerivation.KeySize) != params.PlainCrypt.KeySize {
+				return nil, errors.New("derived volume key size does not match plain dm-crypt key size")
+			}
+		} else {
+			for _, k := range keys {
+				if len(k.Key) != params.PlainCrypt.KeySize {
+					return nil, errors.New("key size does not match plain dm-crypt key size")
+				}
+			}
+		}
+	}
+
+	pcrPolicyCounterHandle := params.PCRPolicyCounterHandle
+	if params.NoPCRPolicyCounter {
+		switch pcrPolicyCounterHandle {
+		case tpm2.Handle(0), tpm2.HandleNull:
+			pcrPolicyCounterHandle = tpm2.HandleNull
+		default:
+			return nil, errors.New("PCRPolicyCounterHandle cannot be set when NoPCRPolicyCounter is true")
+		}
+	}
+
+	pcrPolicyCounterNameAlg := params.PCRPolicyCounterNameAlg
+	switch pcrPolicyCounterNameAlg {
+	case tpm2.HashAlgorithmId(0), tpm2.HashAlgorithmNull:
+		pcrPolicyCounterNameAlg = tpm2.HashAlgorithmSHA256
+	default:
+		if !pcrPolicyCounterNameAlg.Supported() {
+			return nil, fmt.Errorf("unsupported PCR policy counter name algorithm %v", pcrPolicyCounterNameAlg)
+		}
+	}
+
+	// Check that the objects that will be created or used are permitted by the algorithm policy.
+	if err := checkSealingAlgorithms(); err != nil {
+		return nil, err
+	}
+	if pcrPolicyCounterHandle != tpm2.HandleNull {
+		if err := algorithmPolicy.checkDigestAlgorithm(pcrPolicyCounterNameAlg); err != nil {
+			return nil, err
+		}
+	}
+
 	// Use the HMAC session created when the connection was opened rather than creating a new one.
-	session := tpm.HmacSession()
+	session, err := tpm.secretSession()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tpm.checkManufacturerPolicy(); err != nil {
+		return nil, err
+	}
+
+	succeeded := false
+
+	// Create all of the destination files before doing anything with the TPM, so that a bad path fails early and doesn't leave
+	// any TPM resources behind. Only files created here are removed on failure. Other locations are written atomically once the
+	// keys have been sealed.
+	files := make([]*os.File, len(keys))
+	defer func() {
+		for _, f := range files {
+			if f == nil {
+				continue
+			}
+			f.Close()
+			if !succeeded {
+				os.Remove(f.Name())
+			}
+		}
+	}()
+	seen := make(map[string]bool)
+	for i, key := range keys {
+		location := key.location().String()
+		if seen[location] {
+			return nil, fmt.Errorf("duplicate key data file path %s", location)
+		}
+		seen[location] = true
+
+		if key.Location != nil {
+			continue
+		}
+
+		f, err := os.OpenFile(key.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot create key data file %s: %w", key.Path, err)
+		}
+		files[i] = f
+	}
+
+	var ekName tpm2.Name
+	if params.BindToEK {
+		if tpm.ek == nil || len(tpm.hmacSessionEkName) == 0 {
+			return nil, ErrTPMProvisioning
+		}
+		// Binding to an endorsement key that hasn't been verified against its certificate proves nothing about the identity of
+		// the TPM.
+		if !tpm.hasVerifiedSession() {
+			return nil, ErrNoVerifiedSession
+		}
+		ekName = tpm.hmacSessionEkName
+	}
+
+	// Make sure that there is space for the persistent resources that might be created before creating any of them.
+	nvReq := &NVSpaceRequirements{}
+	if tpm.provisionedSrk == nil {
+		nvReq.PersistentHandles = append(nvReq.PersistentHandles, tcg.SRKHandle)
+	}
+	if pcrPolicyCounterHandle != tpm2.HandleNull {
+		nvReq.CounterHandles = append(nvReq.CounterHandles, pcrPolicyCounterHandle)
+	}
+	if err := tpm.CheckNVSpace(nvReq); err != nil {
+		return nil, err
+	}
 
 	// Obtain a context for the SRK now. If we're called immediately after ProvisionTPM without closing the TPMConnection, we use the
 	// context cached by ProvisionTPM, which corresponds to the object provisioned. If not, we just unconditionally provision a new
@@ -198,7 +462,7 @@ func SealKeyToTPMMultiple(tpm *TPMConnection, keys []*SealKeyRequest, params *Ke
 	srk := tpm.provisionedSrk
 	if srk == nil {
 		var err error
-		srk, err = provisionPrimaryKey(tpm.TPMContext, tpm.OwnerHandleContext(), tcg.SRKTemplate, tcg.SRKHandle, session)
+		srk, err = provisionPrimaryKey(tpm.TPMContext, tpm.OwnerHandleContext(), tcg.SRKTemplate, tcg.SRKHandle, "storage root key", session, nil)
 		switch {
 		case isAuthFailError(err, tpm2.AnyCommandCode, 1):
 			return nil, AuthFailError{tpm2.HandleOwner}
@@ -207,7 +471,15 @@ func SealKeyToTPMMultiple(tpm *TPMConnection, keys []*SealKeyRequest, params *Ke
 		}
 	}
 
-	succeeded := false
+	// Refuse to seal to primary keys that are affected by a known key generation weakness.
+	if err := checkKeyNotWeak(tpm.TPMContext, srk, session); err != nil {
+		return nil, xerrors.Errorf("cannot check storage root key: %w", err)
+	}
+	if params.BindToEK {
+		if err := checkKeyNotWeak(tpm.TPMContext, tpm.ek, session); err != nil {
+			return nil, xerrors.Errorf("cannot check endorsement key: %w", err)
+		}
+	}
 
 	// Compute metadata.
 
@@ -233,11 +505,11 @@ func SealKeyToTPMMultiple(tpm *TPMConnection, keys []*SealKeyRequest, params *Ke
 
 	// Create PCR policy counter, if requested.
 	var pcrPolicyCounterPub *tpm2.NVPublic
-	if params.PCRPolicyCounterHandle != tpm2.HandleNull {
-		pcrPolicyCounterPub, err = createPcrPolicyCounter(tpm.TPMContext, params.PCRPolicyCounterHandle, authKeyName, session)
+	if pcrPolicyCounterHandle != tpm2.HandleNull {
+		pcrPolicyCounterPub, err = createPcrPolicyCounter(tpm.TPMContext, pcrPolicyCounterHandle, pcrPolicyCounterNameAlg, authKeyName, session)
 		switch {
 		case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
-			return nil, TPMResourceExistsError{params.PCRPolicyCounterHandle}
+			return nil, TPMResourceExistsError{pcrPolicyCounterHandle}
 		case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
 			return nil, AuthFailError{tpm2.HandleOwner}
 		case err != nil:
@@ -253,9 +525,42 @@ func SealKeyToTPMMultiple(tpm *TPMConnection, keys []*SealKeyRequest, params *Ke
 			}
 			tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
 		}()
+
+		// Read back the public area reported by the TPM. If it doesn't match the one we computed, then the TPM has this quirk
+		// even though none of the rules matched it, so activate it for the rest of this connection.
+		index, err := tpm.CreateResourceContextFromTPM(pcrPolicyCounterHandle, session.IncludeAttrs(tpm2.AttrAudit))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot create context for dynamic authorization policy counter: %w", err)
+		}
+		expectedName, err := pcrPolicyCounterPub.Name()
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute name of dynamic authorization policy counter: %w", err)
+		}
+		if !bytes.Equal(index.Name(), expectedName) {
+			tpm.quirks |= TPMQuirkNVPublicReadback
+		}
+		if tpm.quirks&TPMQuirkNVPublicReadback != 0 {
+			// Use the public area reported by the TPM rather than the one we computed.
+			pub, _, err := tpm.NVReadPublic(index, session.IncludeAttrs(tpm2.AttrAudit))
+			if err != nil {
+				return nil, xerrors.Errorf("cannot read back public area of dynamic authorization policy counter: %w", err)
+			}
+			pcrPolicyCounterPub = pub
+		}
 	}
 
 	template := makeSealedKeyTemplate()
+	var srkPub *tpm2.Public
+	if params.Importable {
+		template = makeImportableSealedKeyTemplate()
+
+		// The sealed key objects are wrapped to the storage root key outside of the TPM. The public area is read with an audit
+		// session, so if the object at the handle we expect the SRK to reside at has a different name, this command will fail.
+		srkPub, _, _, err = tpm.ReadPublic(srk, session.IncludeAttrs(tpm2.AttrAudit))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read public area of storage root key: %w", err)
+		}
+	}
 
 	// Compute the static policy - this never changes for the lifetime of this key file
 	staticPolicyData, authPolicy, err := computeStaticPolicy(template.NameAlg, &staticPolicyComputeParams{
@@ -279,56 +584,84 @@ func SealKeyToTPMMultiple(tpm *TPMConnection, keys []*SealKeyRequest, params *Ke
 		return nil, xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
 	}
 
-	// Clean up files on failure.
-	defer func() {
-		if succeeded {
-			return
+	var metadata KeyMetadata
+	if params.Metadata != nil {
+		metadata = *params.Metadata
+	}
+	metadata.CreationTime = time.Now()
+
+	// Seal each key. The policies computed above are shared by all of the keys, so this only requires a single TPM2_Create
+	// command for each key.
+	var keyIDs []KeyID
+	var pending []keyData
+	for i, key := range keys {
+		// Create the sensitive data
+		sealedData, err := mu.MarshalToBytes(sealedData_v2{Key: key.Key, AuthPrivateKey: authKey, EKName: ekName})
+		if err != nil {
+			panic(fmt.Sprintf("cannot marshal sensitive data: %v", err))
 		}
-		for _, key := range keys {
-			os.Remove(key.Path)
+
+		var priv tpm2.Private
+		var pub *tpm2.Public
+		var importSymSeed tpm2.EncryptedSecret
+		if params.Importable {
+			priv, pub, importSymSeed, err = createImportableSealedObject(srkPub, template, sealedData, tpm2.Auth(pin))
+			wipeBytes(sealedData)
+			if err != nil {
+				return nil, xerrors.Errorf("cannot create importable sealed data object for key: %w", err)
+			}
+		} else {
+			sensitive := tpm2.SensitiveCreate{UserAuth: tpm2.Auth(pin), Data: sealedData}
+
+			// Now create the sealed key object. The command is integrity protected so if the object at the handle we expect the SRK to reside
+			// at has a different name (ie, if we're connected via a resource manager and somebody swapped the object with another one), this
+			// command will fail. We take advantage of parameter encryption here too.
+			priv, pub, _, _, _, err = tpm.Create(srk, &sensitive, template, nil, nil, session.IncludeAttrs(tpm2.AttrCommandEncrypt))
+			wipeBytes(sealedData)
+			wipeBytes(sensitive.UserAuth)
+			if err != nil {
+				return nil, xerrors.Errorf("cannot create sealed data object for key: %w", err)
+			}
 		}
-	}()
 
-	// Seal each key.
-	for _, key := range keys {
-		// Create the destination file
-		f, err := os.OpenFile(key.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
-		if err != nil {
-			return nil, xerrors.Errorf("cannot create key data file %s: %w", key.Path, err)
+		authModeHint := AuthModeNone
+		if pin != "" {
+			authModeHint = AuthModePIN
 		}
-		// We'll close this at the end of this loop, but make sure it is closed if the function
-		// returns early
-		defer f.Close()
 
-		// Create the sensitive data
-		sealedData, err := mu.MarshalToBytes(sealedData{Key: key.Key, AuthPrivateKey: authKey})
+		identity, err := newKeyIdentity()
 		if err != nil {
-			panic(fmt.Sprintf("cannot marshal sensitive data: %v", err))
+			return nil, xerrors.Errorf("cannot create key identity: %w", err)
 		}
-		sensitive := tpm2.SensitiveCreate{Data: sealedData}
 
-		// Now create the sealed key object. The command is integrity protected so if the object at the handle we expect the SRK to reside
-		// at has a different name (ie, if we're connected via a resource manager and somebody swapped the object with another one), this
-		// command will fail. We take advantage of parameter encryption here too.
-		priv, pub, _, _, _, err := tpm.Create(srk, &sensitive, template, nil, nil, session.IncludeAttrs(tpm2.AttrCommandEncrypt))
+		lockoutAuth, err := params.LockoutAuth.wrapForKey(key.Key)
 		if err != nil {
-			return nil, xerrors.Errorf("cannot create sealed data object for key: %w", err)
+			return nil, xerrors.Errorf("cannot wrap lockout hierarchy authorization value: %w", err)
 		}
 
 		// Marshal the entire object (sealed key object and auxiliary data) to disk
 		data := keyData{
-			version:           currentMetadataVersion,
-			keyPrivate:        priv,
-			keyPublic:         pub,
-			authModeHint:      AuthModeNone,
-			staticPolicyData:  staticPolicyData,
-			dynamicPolicyData: dynamicPolicyData}
-
-		if err := data.write(f); err != nil {
-			return nil, xerrors.Errorf("cannot write key data file: %w", err)
-		}
-
-		f.Close()
+			version:             currentMetadataVersion,
+			keyPrivate:          priv,
+			keyPublic:           pub,
+			importSymSeed:       importSymSeed,
+			authModeHint:        authModeHint,
+			staticPolicyData:    staticPolicyData,
+			dynamicPolicyData:   dynamicPolicyData,
+			tpmFirmwareInfo:     tpm.firmwareInfo,
+			deviceBinding:       tpm.deviceBinding(),
+			metadata:            &metadata,
+			identity:            identity,
+			lockoutAuth:         lockoutAuth,
+			revocationMode:      pcrPolicyRevocationModeForHandle(pcrPolicyCounterHandle),
+			volumeKeyDerivation: volumeKeyDerivation,
+			diskIdentity:        params.DiskIdentity,
+			integrity:           params.Integrity,
+			verityRootHashes:    params.DmVerityRootHashes,
+			plainCrypt:          params.PlainCrypt}
+
+		pending = append(pending, data)
+		keyIDs = append(keyIDs, identity.ID)
 	}
 
 	// Increment the PCR policy counter for the first time.
@@ -339,7 +672,26 @@ func SealKeyToTPMMultiple(tpm *TPMConnection, keys []*SealKeyRequest, params *Ke
 		}
 	}
 
+	// Only write the key data once every key has been created, so that a failure part way through doesn't replace existing key
+	// data at a KeyLocation with data for a key that is then discarded. The files created by this function are only committed
+	// on success, but a KeyLocation can't be rolled back.
+	for i, key := range keys {
+		var err error
+		if key.Location != nil {
+			err = pending[i].writeToLocation(key.Location)
+		} else {
+			err = pending[i].write(files[i])
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("cannot write key data file: %w", err)
+		}
+	}
+
+	// The keys have been sealed at this point, so a failure to record the audit event must not roll them back.
 	succeeded = true
+	if err := tpm.recordAuditEvent(AuditEventSeal, keyIDs, ""); err != nil {
+		return authKey, err
+	}
 	return authKey, nil
 }
 
@@ -348,8 +700,9 @@ func SealKeyToTPMMultiple(tpm *TPMConnection, keys []*SealKeyRequest, params *Ke
 // to a file at the path specified by keyPath.
 //
 // This function requires knowledge of the authorization value for the storage hierarchy, which must be provided by calling
-// TPMConnection.OwnerHandleContext().SetAuthValue() prior to calling this function. If the provided authorization value is incorrect,
-// a AuthFailError error will be returned.
+// TPMConnection.OwnerHandleContext().SetAuthValue() prior to calling this function. If the provided authorization value is incorrect
+// and a callback has been set with TPMConnection.SetHierarchyAuthFunc, a new value is requested from it. Otherwise, a
+// AuthFailError error will be returned.
 //
 // If the TPM is not correctly provisioned, a ErrTPMProvisioning error will be returned. In this case, ProvisionTPM must be called
 // before proceeding.
@@ -379,14 +732,45 @@ func SealKeyToTPM(tpm *TPMConnection, key []byte, keyPath string, params *KeyCre
 	return SealKeyToTPMMultiple(tpm, []*SealKeyRequest{{Key: key, Path: keyPath}}, params)
 }
 
-func updateKeyPCRProtectionPolicyCommon(tpm *tpm2.TPMContext, keyPaths []string, authData interface{}, pcrProfile *PCRProtectionProfile, session tpm2.SessionContext) error {
-	if len(keyPaths) == 0 {
+// SealKeyToTPMWithoutPCRBinding seals the supplied disk encryption keys to the storage hierarchy of the TPM without binding them
+// to any PCR values and without creating a PCR policy counter. In this mode, the TPM is only used as a key store - the keys can be
+// unsealed by anyone with access to this TPM, regardless of the software that is running and without any protection against
+// rollback of the key data files. The only additional protection available is a PIN, which can be set afterwards with ChangePIN.
+//
+// This is intended for devices whose firmware does not produce stable or predictable measurements, and where the reduced
+// guarantees are preferable to not using the TPM at all. SealKeyToTPMMultiple should be used wherever possible.
+//
+// This function behaves like SealKeyToTPMMultiple with an empty PCR protection profile and a PCRPolicyCounterHandle of
+// tpm2.HandleNull, and returns the same errors. The PCR protection policy of the sealed keys can be updated later on with
+// UpdateKeyPCRProtectionPolicyMultiple, although the keys will never have PCR policy revocation support.
+func SealKeyToTPMWithoutPCRBinding(tpm *TPMConnection, keys []*SealKeyRequest) (authKey TPMPolicyAuthKey, err error) {
+	return SealKeyToTPMMultiple(tpm, keys, &KeyCreationParams{PCRProfile: &PCRProtectionProfile{}, PCRPolicyCounterHandle: tpm2.HandleNull})
+}
+
+// updateKeyPCRProtectionPolicyCommon implements the UpdateKeyPCRProtectionPolicy functions. The mutations that it performs are
+// recorded in plan. If plan is a dry run, authData may be nil, in which case a new PCR policy isn't computed, and neither the key
+// data nor the TPM are modified.
+func updateKeyPCRProtectionPolicyCommon(tpmConn *TPMConnection, keyLocations []KeyLocation, authData interface{}, pcrProfile *PCRProtectionProfile,
+	plan *actionPlan) error {
+	tpm := tpmConn.TPMContext
+	session, err := tpmConn.secretSession()
+	if err != nil {
+		return err
+	}
+	progress := tpmConn.progress
+	if plan.isDryRun() {
+		progress = nil
+	}
+
+	if len(keyLocations) == 0 {
 		return errors.New("no key files supplied")
 	}
 
+	progress.report("validating key data files", 0)
+
 	var datas []*keyData
 	// Open the primary data file
-	keyFile, err := os.Open(keyPaths[0])
+	keyFile, err := keyLocations[0].Open()
 	if err != nil {
 		return xerrors.Errorf("cannot open key data file: %w", err)
 	}
@@ -404,8 +788,8 @@ func updateKeyPCRProtectionPolicyCommon(tpm *tpm2.TPMContext, keyPaths []string,
 	datas = append(datas, primaryData)
 
 	// Open and validate secondary files and make sure they are related
-	for _, p := range keyPaths[1:] {
-		keyFile, err := os.Open(p)
+	for _, p := range keyLocations[1:] {
+		keyFile, err := p.Open()
 		if err != nil {
 			return xerrors.Errorf("cannot open related key data file: %w", err)
 		}
@@ -414,7 +798,7 @@ func updateKeyPCRProtectionPolicyCommon(tpm *tpm2.TPMContext, keyPaths []string,
 		data, _, _, err := decodeAndValidateKeyData(tpm, keyFile, nil, session)
 		if err != nil {
 			if isKeyFileError(err) {
-				return InvalidKeyFileError{err.Error() + " (" + p + ")"}
+				return InvalidKeyFileError{err.Error() + " (" + p.String() + ")"}
 			}
 			// FIXME: Turn the missing lock NV index in to ErrProvisioning
 			return xerrors.Errorf("cannot read and validate related key data file: %w", err)
@@ -425,7 +809,7 @@ func updateKeyPCRProtectionPolicyCommon(tpm *tpm2.TPMContext, keyPaths []string,
 		// and dynamic authorization policy signing key, so this is the only check required to determine
 		// if 2 keys are related.
 		if !bytes.Equal(data.keyPublic.AuthPolicy, primaryData.keyPublic.AuthPolicy) {
-			return InvalidKeyFileError{"key data file " + p + " is not a related key file"}
+			return InvalidKeyFileError{"key data file " + p.String() + " is not a related key file"}
 		}
 		datas = append(datas, data)
 	}
@@ -434,33 +818,85 @@ func updateKeyPCRProtectionPolicyCommon(tpm *tpm2.TPMContext, keyPaths []string,
 	v0PinIndexAuthPolicies := primaryData.staticPolicyData.v0PinIndexAuthPolicies
 
 	// Compute a new dynamic authorization policy
+	progress.report("computing PCR policy", 20)
 	if pcrProfile == nil {
 		pcrProfile = &PCRProtectionProfile{}
 	}
-	policyData, err := computeSealedKeyDynamicAuthPolicy(tpm, primaryData.version, primaryData.keyPublic.NameAlg, authPublicKey.NameAlg, authKey,
-		pcrPolicyCounterPub, v0PinIndexAuthPolicies, pcrProfile, session)
-	if err != nil {
-		return xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
+	var policyData *dynamicPolicyData
+	if !plan.isDryRun() || authData != nil {
+		policyData, err = computeSealedKeyDynamicAuthPolicy(tpm, primaryData.version, primaryData.keyPublic.NameAlg, authPublicKey.NameAlg, authKey,
+			pcrPolicyCounterPub, v0PinIndexAuthPolicies, pcrProfile, session)
+		if err != nil {
+			return xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
+		}
 	}
 
 	// Atomically update the key data files
+	var keyIDs []KeyID
 	for i, data := range datas {
+		progress.reportStep("writing key data files", i, len(datas), 60, 90)
 		data.dynamicPolicyData = policyData
+		if data.version >= 3 {
+			// Record the firmware version of the TPM that the PCR policy was computed for.
+			data.tpmFirmwareInfo = tpmConn.firmwareInfo
+			if data.deviceBinding == nil {
+				// Record the TPM device for keys sealed before this was recorded.
+				data.deviceBinding = tpmConn.deviceBinding()
+			}
 
-		if err := data.writeToFileAtomic(keyPaths[i]); err != nil {
+			// Bump the PCR policy generation number. Keys sealed before this was recorded are assigned an ID here.
+			if data.identity == nil {
+				identity, err := newKeyIdentity()
+				if err != nil {
+					return xerrors.Errorf("cannot create key identity: %w", err)
+				}
+				data.identity = identity
+			} else {
+				data.identity.Generation++
+			}
+		}
+
+		if err := plan.perform(func() error {
+			return data.writeToLocation(keyLocations[i])
+		}, PlannedAction{
+			Type:        PlannedActionModify,
+			Target:      keyLocationTarget(keyLocations[i]),
+			Description: "atomically replace with an updated PCR policy"}); err != nil {
 			return xerrors.Errorf("cannot write key data file: %v", err)
 		}
+		keyIDs = append(keyIDs, data.keyIDs()...)
+	}
+
+	if pcrPolicyCounterPub != nil {
+		progress.report("revoking old PCR policies", 90)
+		if err := plan.perform(func() error {
+			return incrementPcrPolicyCounter(tpm, primaryData.version, pcrPolicyCounterPub, v0PinIndexAuthPolicies, authKey, authPublicKey, session)
+		}, PlannedAction{
+			Type:        PlannedActionModify,
+			Target:      nvIndexTarget(pcrPolicyCounterPub.Index),
+			Description: "increment the PCR policy counter to revoke the previous PCR policy"}); err != nil {
+			return xerrors.Errorf("cannot revoke old PCR policies: %w", err)
+		}
+		if !plan.isDryRun() {
+			tpmConn.notify(&SecurityEvent{Type: SecurityEventPCRPolicyRevoked, KeyIDs: keyIDs})
+		}
 	}
 
-	if pcrPolicyCounterPub == nil {
+	if plan.isDryRun() {
 		return nil
 	}
 
-	if err := incrementPcrPolicyCounter(tpm, primaryData.version, pcrPolicyCounterPub, v0PinIndexAuthPolicies, authKey, authPublicKey, session); err != nil {
-		return xerrors.Errorf("cannot revoke old PCR policies: %w", err)
+	// Only record the audit events once the old PCR policies have been revoked, so that a failure to record them can't prevent
+	// revocation.
+	auditErr := tpmConn.recordAuditEvent(AuditEventReseal, keyIDs, "")
+	if pcrPolicyCounterPub != nil {
+		if err := tpmConn.recordAuditEvent(AuditEventRevoke, keyIDs, fmt.Sprintf("PCR policy counter: 0x%08x", pcrPolicyCounterPub.Index)); err != nil && auditErr == nil {
+			auditErr = err
+		}
 	}
 
-	return nil
+	progress.report("done", 100)
+	return auditErr
 }
 
 // UpdateKeyPCRProtectionPolicyV0 updates the PCR protection policy for the sealed key at the path specified by the keyPath argument
@@ -480,7 +916,7 @@ func UpdateKeyPCRProtectionPolicyV0(tpm *TPMConnection, keyPath, policyUpdatePat
 	}
 	defer policyUpdateFile.Close()
 
-	return updateKeyPCRProtectionPolicyCommon(tpm.TPMContext, []string{keyPath}, policyUpdateFile, pcrProfile, tpm.HmacSession())
+	return updateKeyPCRProtectionPolicyCommon(tpm, []KeyLocation{FileKeyLocation(keyPath)}, policyUpdateFile, pcrProfile, nil)
 }
 
 // UpdateKeyPCRProtectionPolicy updates the PCR protection policy for the sealed key at the path specified by the keyPath argument
@@ -495,7 +931,7 @@ func UpdateKeyPCRProtectionPolicyV0(tpm *TPMConnection, keyPath, policyUpdatePat
 // computed from the supplied PCRProtectionProfile. If the sealed key data file was created with a PCR policy counter, the
 // previous PCR policy will be revoked.
 func UpdateKeyPCRProtectionPolicy(tpm *TPMConnection, keyPath string, authKey TPMPolicyAuthKey, pcrProfile *PCRProtectionProfile) error {
-	return updateKeyPCRProtectionPolicyCommon(tpm.TPMContext, []string{keyPath}, authKey, pcrProfile, tpm.HmacSession())
+	return updateKeyPCRProtectionPolicyCommon(tpm, []KeyLocation{FileKeyLocation(keyPath)}, authKey, pcrProfile, nil)
 }
 
 // UpdateKeyPCRProtectionPolicyMultiple updates the PCR protection policy for the sealed keys at the paths specified
@@ -513,5 +949,58 @@ func UpdateKeyPCRProtectionPolicy(tpm *TPMConnection, keyPath string, authKey TP
 // successfully. If any file is not updated successfully, the previous PCR policy will not be revoked and the associated
 // error will be returned.
 func UpdateKeyPCRProtectionPolicyMultiple(tpm *TPMConnection, keyPaths []string, authKey TPMPolicyAuthKey, pcrProfile *PCRProtectionProfile) error {
-	return updateKeyPCRProtectionPolicyCommon(tpm.TPMContext, keyPaths, authKey, pcrProfile, tpm.HmacSession())
+	return updateKeyPCRProtectionPolicyCommon(tpm, fileKeyLocations(keyPaths), authKey, pcrProfile, nil)
+}
+
+// UpdateKeyPCRProtectionPolicyAtLocations behaves the same as UpdateKeyPCRProtectionPolicyMultiple, but updates the sealed key data
+// stored at the specified locations. If any key data cannot be opened, the error returned from KeyLocation.Open is returned
+// wrapped.
+func UpdateKeyPCRProtectionPolicyAtLocations(tpm *TPMConnection, keyLocations []KeyLocation, authKey TPMPolicyAuthKey, pcrProfile *PCRProtectionProfile) error {
+	return updateKeyPCRProtectionPolicyCommon(tpm, keyLocations, authKey, pcrProfile, nil)
+}
+
+// MigratePCRPolicyCounter replaces the PCR policy counter associated with the related sealed keys at the paths specified by the
+// keyPaths argument with a new one, created at the handle and with the name algorithm specified by the PCRPolicyCounterHandle and
+// PCRPolicyCounterNameAlg fields of the params argument. This can be used to move existing keys to a counter that uses a different
+// digest algorithm (eg, for TPMs or deployments where SHA-256 is not permitted), or to migrate version 0 key files that use the
+// legacy PIN NV index.
+//
+// Related sealed keys created with a single call to SealKeyToTPMMultiple share a PCR policy counter, and the existing counter is
+// undefined once the migration has completed. Every key data file that shares the counter must therefore be supplied via the
+// keyPaths argument, because any key that is omitted will no longer be usable afterwards. All of the supplied key data files
+// must be related - if they are not, a InvalidKeyFileError error will be returned and nothing will be modified.
+//
+// The name of the PCR policy counter is bound to the static authorization policy of each sealed key object, so this can only be
+// done by unsealing the keys and sealing them again. The PCR protection policy of the keys must therefore be satisfied by the
+// current PCR values, and the current PIN must be supplied via the pin argument if one is set. The new keys keep the same PIN. The PCR
+// protection profile for the new key must be supplied via the PCRProfile field of params.
+//
+// The new handle must be different to the handle of the existing PCR policy counter, because the existing counter is only
+// undefined once the new sealed key data file has replaced the existing one. If the AuthKey field of params is not set, the
+// existing key for authorizing PCR policy updates is retained for version 1 and later key data files. If the Metadata or
+// LockoutAuth fields of params are not set, the existing values are retained.
+//
+// This function requires knowledge of the authorization value for the storage hierarchy. The errors returned from this function
+// are the same as those returned from SealedKeyObject.UnsealFromTPM and SealKeyToTPMMultiple.
+//
+// On success, this function returns the private part of the key used for authorizing PCR policy updates for the new keys. This is
+// also returned if the key data files were replaced but the existing PCR policy counter could not be undefined afterwards, along
+// with an error.
+func MigratePCRPolicyCounter(tpm *TPMConnection, keyPaths []string, pin string, params *KeyCreationParams) (TPMPolicyAuthKey, error) {
+	if params == nil {
+		return nil, errors.New("no KeyCreationParams provided")
+	}
+	if len(keyPaths) == 0 {
+		return nil, errors.New("no key files supplied")
+	}
+
+	k, err := ReadSealedKeyObject(keyPaths[0])
+	if err != nil {
+		return nil, err
+	}
+	if k.PCRPolicyCounterHandle() == tpm2.HandleNull {
+		return nil, errors.New("sealed key object does not have a PCR policy counter")
+	}
+
+	return resealKeyFiles(tpm, keyPaths, pin, nil, params, true)
 }
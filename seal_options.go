@@ -0,0 +1,342 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+)
+
+// sealKeyOptions accumulates the options supplied to SealKeyToTPMWithOptions.
+type sealKeyOptions struct {
+	params KeyCreationParams
+	pin    string
+	set    map[string]bool // The options that have been applied, to detect duplicates
+}
+
+func (o *sealKeyOptions) once(name string) error {
+	if o.set[name] {
+		return fmt.Errorf("%s specified more than once", name)
+	}
+	o.set[name] = true
+	return nil
+}
+
+// SealKeyOption is an option for SealKeyToTPMWithOptions. Options are created with the With* functions in this package.
+type SealKeyOption func(o *sealKeyOptions) error
+
+// WithPCRProfile specifies the profile used to generate the PCR protection policy for the sealed keys. If this option isn't
+// supplied, the keys are sealed with an empty PCR protection profile.
+func WithPCRProfile(profile *PCRProtectionProfile) SealKeyOption {
+	return func(o *sealKeyOptions) error {
+		if err := o.once("WithPCRProfile"); err != nil {
+			return err
+		}
+		if profile == nil {
+			return errors.New("WithPCRProfile requires a profile")
+		}
+		o.params.PCRProfile = profile
+		return nil
+	}
+}
+
+// WithCounter specifies the handle at which to create a NV index for PCR policy revocation support. See the PCRPolicyCounterHandle
+// field of KeyCreationParams. If this option isn't supplied, no NV index is created.
+func WithCounter(handle tpm2.Handle) SealKeyOption {
+	return func(o *sealKeyOptions) error {
+		if err := o.once("WithCounter"); err != nil {
+			return err
+		}
+		if o.set["WithoutCounter"] {
+			return errors.New("WithCounter cannot be combined with WithoutCounter")
+		}
+		if handle.Type() != tpm2.HandleTypeNVIndex {
+			return fmt.Errorf("WithCounter requires a NV index handle (got 0x%08x)", handle)
+		}
+		o.params.PCRPolicyCounterHandle = handle
+		return nil
+	}
+}
+
+// WithoutCounter specifies that the sealed keys should be created without a NV index for PCR policy revocation support, and that
+// this should be recorded in the key data files. See the NoPCRPolicyCounter field of KeyCreationParams. This cannot be combined
+// with WithCounter.
+func WithoutCounter() SealKeyOption {
+	return func(o *sealKeyOptions) error {
+		if err := o.once("WithoutCounter"); err != nil {
+			return err
+		}
+		if o.set["WithCounter"] {
+			return errors.New("WithoutCounter cannot be combined with WithCounter")
+		}
+		o.params.NoPCRPolicyCounter = true
+		return nil
+	}
+}
+
+// WithCounterNameAlg specifies the digest algorithm used for the name and authorization policy of the NV index created for PCR
+// policy revocation support. See the PCRPolicyCounterNameAlg field of KeyCreationParams. This has no effect unless WithCounter is
+// also supplied.
+func WithCounterNameAlg(alg tpm2.HashAlgorithmId) SealKeyOption {
+	return func(o *sealKeyOptions) error {
+		if err := o.once("WithCounterNameAlg"); err != nil {
+			return err
+		}
+		if !alg.Supported() {
+			return fmt.Errorf("WithCounterNameAlg requires a supported digest algorithm (got %v)", alg)
+		}
+		o.params.PCRPolicyCounterNameAlg = alg
+		return nil
+	}
+}
+
+// WithAuthKey specifies the key used for authorizing PCR policy updates. See the AuthKey field of KeyCreationParams. If this option
+// isn't supplied, a new key is generated.
+func WithAuthKey(key *ecdsa.PrivateKey) SealKeyOption {
+	return func(o *sealKeyOptions) error {
+		if err := o.once("WithAuthKey"); err != nil {
+			return err
+		}
+		if key == nil || key.Curve != elliptic.P256() {
+			return errors.New("WithAuthKey requires a key from elliptic.P256")
+		}
+		o.params.AuthKey = key
+		return nil
+	}
+}
+
+// WithBindToEK specifies that the sealed keys should be bound to the endorsement key of the TPM. See the BindToEK field of
+// KeyCreationParams.
+func WithBindToEK() SealKeyOption {
+	return func(o *sealKeyOptions) error {
+		if err := o.once("WithBindToEK"); err != nil {
+			return err
+		}
+		o.params.BindToEK = true
+		return nil
+	}
+}
+
+// WithImportable specifies that the sealed key objects should be created outside of the TPM and imported in to it each time that
+// they are loaded. See the Importable field of KeyCreationParams.
+func WithImportable() SealKeyOption {
+	return func(o *sealKeyOptions) error {
+		if err := o.once("WithImportable"); err != nil {
+			return err
+		}
+		o.params.Importable = true
+		return nil
+	}
+}
+
+// WithPIN specifies a PIN that must be supplied in order to unseal the sealed keys. This has the same effect as sealing the keys
+// without a PIN and then calling ChangePIN, but without the additional TPM commands and key data file updates.
+func WithPIN(pin string) SealKeyOption {
+	return func(o *sealKeyOptions) error {
+		if err := o.once("WithPIN"); err != nil {
+			return err
+		}
+		if pin == "" {
+			return errors.New("WithPIN requires a non-empty PIN")
+		}
+		o.pin = pin
+		return nil
+	}
+}
+
+// WithLockoutAuth specifies that a copy of the supplied lockout hierarchy authorization value should be stored in the sealed key
+// data files. See the LockoutAuth field of KeyCreationParams. If recoveryKey is not nil, an additional copy is stored that can be
+// recovered with the fallback recovery key.
+func WithLockoutAuth(auth []byte, recoveryKey *RecoveryKey) SealKeyOption {
+	return func(o *sealKeyOptions) error {
+		if err := o.once("WithLockoutAuth"); err != nil {
+			return err
+		}
+		if len(auth) == 0 {
+			return errors.New("WithLockoutAuth requires a non-empty authorization value")
+		}
+		o.params.LockoutAuth = &LockoutAuthParams{Auth: auth, RecoveryKey: recoveryKey}
+		return nil
+	}
+}
+
+// WithVolumeKeyDerivation specifies that the keys being sealed are master secrets from which the keys for individual volumes are
+// derived. See the VolumeKeyDerivation field of KeyCreationParams. If keySize is zero, 64 byte volume keys are derived.
+func WithVolumeKeyDerivation(keySize int) SealKeyOption {
+	return func(o *sealKeyOptions) error {
+		if err := o.once("WithVolumeKeyDerivation"); err != nil {
+			return err
+		}
+		if keySize < 0 || keySize > maxVolumeKeySize {
+			return fmt.Errorf("WithVolumeKeyDerivation requires a valid key size (got %d)", keySize)
+		}
+		o.params.VolumeKeyDerivation = &VolumeKeyDerivationParams{KeySize: keySize}
+		return nil
+	}
+}
+
+// WithDiskIdentity specifies the identity of the disk and partitions that the sealed keys are intended to unlock. See the
+// DiskIdentity field of KeyCreationParams.
+func WithDiskIdentity(identity *DiskIdentity) SealKeyOption {
+	return func(o *sealKeyOptions) error {
+		if err := o.once("WithDiskIdentity"); err != nil {
+			return err
+		}
+		if identity == nil || len(identity.PartitionGUIDs) == 0 {
+			return errors.New("WithDiskIdentity requires an identity with at least one partition")
+		}
+		o.params.DiskIdentity = identity
+		return nil
+	}
+}
+
+// WithIntegrity specifies the parameters of the standalone dm-integrity device beneath the volumes that the sealed keys are for.
+// See the Integrity field of KeyCreationParams.
+func WithIntegrity(params *IntegrityParams) SealKeyOption {
+	return func(o *sealKeyOptions) error {
+		if err := o.once("WithIntegrity"); err != nil {
+			return err
+		}
+		if params == nil {
+			return errors.New("WithIntegrity requires parameters")
+		}
+		if err := params.check(); err != nil {
+			return fmt.Errorf("WithIntegrity requires valid parameters: %v", err)
+		}
+		o.params.Integrity = params
+		return nil
+	}
+}
+
+// WithPlainCrypt specifies the parameters of the plain dm-crypt volumes that the sealed keys are for. See the PlainCrypt field of
+// KeyCreationParams.
+func WithPlainCrypt(params *PlainCryptParams) SealKeyOption {
+	return func(o *sealKeyOptions) error {
+		if err := o.once("WithPlainCrypt"); err != nil {
+			return err
+		}
+		if params == nil {
+			return errors.New("WithPlainCrypt requires parameters")
+		}
+		if err := params.check(); err != nil {
+			return fmt.Errorf("WithPlainCrypt requires valid parameters: %v", err)
+		}
+		o.params.PlainCrypt = params
+		return nil
+	}
+}
+
+// WithDmVerityRootHashes specifies the dm-verity root hashes of the root filesystems that the sealed keys may be used with. See
+// the DmVerityRootHashes field of KeyCreationParams.
+func WithDmVerityRootHashes(rootHashes ...[]byte) SealKeyOption {
+	return func(o *sealKeyOptions) error {
+		if err := o.once("WithDmVerityRootHashes"); err != nil {
+			return err
+		}
+		if len(rootHashes) == 0 {
+			return errors.New("WithDmVerityRootHashes requires at least one root hash")
+		}
+		for _, h := range rootHashes {
+			if len(h) == 0 {
+				return errors.New("WithDmVerityRootHashes requires non-empty root hashes")
+			}
+		}
+		if err := checkDmVerityRootHashes(rootHashes); err != nil {
+			return fmt.Errorf("WithDmVerityRootHashes: %v", err)
+		}
+		o.params.DmVerityRootHashes = rootHashes
+		return nil
+	}
+}
+
+func (o *sealKeyOptions) metadata() *KeyMetadata {
+	if o.params.Metadata == nil {
+		o.params.Metadata = new(KeyMetadata)
+	}
+	return o.params.Metadata
+}
+
+// WithRole specifies the role to record in the metadata of the sealed keys. See KeyMetadata.
+func WithRole(role string) SealKeyOption {
+	return func(o *sealKeyOptions) error {
+		if err := o.once("WithRole"); err != nil {
+			return err
+		}
+		o.metadata().Role = role
+		if err := o.metadata().check(); err != nil {
+			return fmt.Errorf("WithRole: %v", err)
+		}
+		return nil
+	}
+}
+
+// WithLabel specifies the human readable label to record in the metadata of the sealed keys. See KeyMetadata.
+func WithLabel(label string) SealKeyOption {
+	return func(o *sealKeyOptions) error {
+		if err := o.once("WithLabel"); err != nil {
+			return err
+		}
+		o.metadata().Label = label
+		if err := o.metadata().check(); err != nil {
+			return fmt.Errorf("WithLabel: %v", err)
+		}
+		return nil
+	}
+}
+
+// WithCallerData specifies opaque data to record in the metadata of the sealed keys. See KeyMetadata.
+func WithCallerData(data []byte) SealKeyOption {
+	return func(o *sealKeyOptions) error {
+		if err := o.once("WithCallerData"); err != nil {
+			return err
+		}
+		o.metadata().CallerData = data
+		if err := o.metadata().check(); err != nil {
+			return fmt.Errorf("WithCallerData: %v", err)
+		}
+		return nil
+	}
+}
+
+// SealKeyToTPMWithOptions seals the supplied disk encryption keys to the storage hierarchy of the TPM, in the same way as
+// SealKeyToTPMMultiple, but with the sealing parameters specified by a list of options rather than with a KeyCreationParams
+// structure. All of the options are validated before the TPM is used, and an error is returned if any option is invalid or is
+// specified more than once.
+//
+// Without any options, the keys are sealed with an empty PCR protection profile, without a PCR policy counter, without a PIN and
+// with a newly generated key for authorizing PCR policy updates.
+//
+// The errors returned from this function are the same as those returned from SealKeyToTPMMultiple.
+func SealKeyToTPMWithOptions(tpm *TPMConnection, keys []*SealKeyRequest, opts ...SealKeyOption) (authKey TPMPolicyAuthKey, err error) {
+	o := &sealKeyOptions{
+		params: KeyCreationParams{PCRPolicyCounterHandle: tpm2.HandleNull},
+		set:    make(map[string]bool)}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, fmt.Errorf("invalid option: %v", err)
+		}
+	}
+
+	return sealKeyToTPMMultiple(tpm, keys, &o.params, o.pin)
+}
@@ -0,0 +1,352 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestSealKeyToTPMWithOptionsInvalid(t *testing.T) {
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	for _, data := range []struct {
+		desc string
+		opts []SealKeyOption
+		err  string
+	}{
+		{
+			desc: "DuplicateCounter",
+			opts: []SealKeyOption{WithCounter(0x01810000), WithCounter(0x01810001)},
+			err:  "invalid option: WithCounter specified more than once",
+		},
+		{
+			desc: "InvalidCounterHandle",
+			opts: []SealKeyOption{WithCounter(0x81000001)},
+			err:  "invalid option: WithCounter requires a NV index handle (got 0x81000001)",
+		},
+		{
+			desc: "CounterAndWithoutCounter",
+			opts: []SealKeyOption{WithCounter(0x01810000), WithoutCounter()},
+			err:  "invalid option: WithoutCounter cannot be combined with WithCounter",
+		},
+		{
+			desc: "NilPCRProfile",
+			opts: []SealKeyOption{WithPCRProfile(nil)},
+			err:  "invalid option: WithPCRProfile requires a profile",
+		},
+		{
+			desc: "InvalidAuthKey",
+			opts: []SealKeyOption{WithAuthKey(p384Key)},
+			err:  "invalid option: WithAuthKey requires a key from elliptic.P256",
+		},
+		{
+			desc: "DuplicateRole",
+			opts: []SealKeyOption{WithRole("run"), WithRole("recovery")},
+			err:  "invalid option: WithRole specified more than once",
+		},
+		{
+			desc: "CallerDataTooLarge",
+			opts: []SealKeyOption{WithCallerData(make([]byte, 65536))},
+			err:  "invalid option: WithCallerData: caller data is too large (65536 bytes, maximum is 65535)",
+		},
+		{
+			desc: "MetadataTooLarge",
+			opts: []SealKeyOption{WithLabel(string(make([]byte, 40000))), WithCallerData(make([]byte, 30000))},
+			err:  "invalid option: WithCallerData: encoded metadata is too large (70014 bytes, maximum is 65535)",
+		},
+		{
+			desc: "DuplicateImportable",
+			opts: []SealKeyOption{WithImportable(), WithImportable()},
+			err:  "invalid option: WithImportable specified more than once",
+		},
+		{
+			desc: "EmptyPIN",
+			opts: []SealKeyOption{WithPIN("")},
+			err:  "invalid option: WithPIN requires a non-empty PIN",
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			// The options are validated before the TPM is used.
+			_, err := SealKeyToTPMWithOptions(nil, []*SealKeyRequest{{Key: make([]byte, 32), Path: "/nonexistent"}}, data.opts...)
+			if err == nil || err.Error() != data.err {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestSealKeyToTPMWithOptions(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMWithOptions_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	authKey, err := SealKeyToTPMWithOptions(tpm, []*SealKeyRequest{{Key: key, Path: keyFile}},
+		WithPCRProfile(getTestPCRProfile()), WithCounter(0x01810000), WithPIN("1234"), WithRole("run"), WithLabel("Run key"),
+		WithCallerData([]byte("foo")))
+	if err != nil {
+		t.Fatalf("SealKeyToTPMWithOptions failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, authKey, tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if k.AuthMode2F() != AuthModePIN {
+		t.Errorf("Unexpected auth mode: %v", k.AuthMode2F())
+	}
+	if k.PCRPolicyCounterHandle() != 0x01810000 {
+		t.Errorf("Unexpected PCR policy counter handle: 0x%08x", k.PCRPolicyCounterHandle())
+	}
+	if k.PCRPolicyRevocationMode() != PCRPolicyRevocationCounter {
+		t.Errorf("Unexpected PCR policy revocation mode: %v", k.PCRPolicyRevocationMode())
+	}
+	metadata := k.Metadata()
+	if metadata.Role != "run" || metadata.Label != "Run key" || !bytes.Equal(metadata.CallerData, []byte("foo")) {
+		t.Errorf("Unexpected metadata: %+v", metadata)
+	}
+
+	if _, _, err := k.UnsealFromTPM(tpm, ""); err != ErrPINFail {
+		t.Errorf("UnsealFromTPM without the PIN should have failed with ErrPINFail: %v", err)
+	}
+	if err := tpm.DictionaryAttackLockReset(tpm.LockoutHandleContext(), nil); err != nil {
+		t.Errorf("DictionaryAttackLockReset failed: %v", err)
+	}
+
+	keyUnsealed, authKeyUnsealed, err := k.UnsealFromTPM(tpm, "1234")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(keyUnsealed, key) {
+		t.Errorf("TPM returned the wrong key")
+	}
+	if !bytes.Equal(authKeyUnsealed, authKey) {
+		t.Errorf("TPM returned the wrong auth key")
+	}
+}
+
+func TestSealKeyToTPMWithOptionsDefaults(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMWithOptions_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	if _, err := SealKeyToTPMWithOptions(tpm, []*SealKeyRequest{{Key: make([]byte, 32), Path: keyFile}}); err != nil {
+		t.Fatalf("SealKeyToTPMWithOptions failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if k.AuthMode2F() != AuthModeNone {
+		t.Errorf("Unexpected auth mode: %v", k.AuthMode2F())
+	}
+	if k.PCRPolicyCounterHandle() != tpm2.HandleNull {
+		t.Errorf("Unexpected PCR policy counter handle: 0x%08x", k.PCRPolicyCounterHandle())
+	}
+	if k.PCRPolicyRevocationMode() != PCRPolicyRevocationNone {
+		t.Errorf("Unexpected PCR policy revocation mode: %v", k.PCRPolicyRevocationMode())
+	}
+}
+
+func TestSealKeyToTPMWithoutCounter(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMWithoutCounter_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	authKey, err := SealKeyToTPMWithOptions(tpm, []*SealKeyRequest{{Key: make([]byte, 32), Path: keyFile}},
+		WithPCRProfile(getTestPCRProfile()), WithoutCounter())
+	if err != nil {
+		t.Fatalf("SealKeyToTPMWithOptions failed: %v", err)
+	}
+
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, authKey, tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if k.PCRPolicyCounterHandle() != tpm2.HandleNull {
+		t.Errorf("Unexpected PCR policy counter handle: 0x%08x", k.PCRPolicyCounterHandle())
+	}
+	if k.PCRPolicyRevocationMode() != PCRPolicyRevocationNone {
+		t.Errorf("Unexpected PCR policy revocation mode: %v", k.PCRPolicyRevocationMode())
+	}
+
+	if err := UpdateKeyPCRProtectionPolicy(tpm, keyFile, authKey, getTestPCRProfile()); err != nil {
+		t.Errorf("UpdateKeyPCRProtectionPolicy failed: %v", err)
+	}
+	if _, _, err := k.UnsealFromTPM(tpm, ""); err != nil {
+		t.Errorf("UnsealFromTPM failed: %v", err)
+	}
+}
+
+func TestSealKeyToTPMWithPlainCrypt(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMWithPlainCrypt_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	params := &PlainCryptParams{Cipher: "aes-xts-plain64", KeySize: 64, Offset: 2048}
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	if _, err := SealKeyToTPMWithOptions(tpm, []*SealKeyRequest{{Key: make([]byte, 32), Path: keyFile}},
+		WithPlainCrypt(params)); err == nil || err.Error() != "key size does not match plain dm-crypt key size" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if _, err := SealKeyToTPMWithOptions(tpm, []*SealKeyRequest{{Key: make([]byte, 64), Path: keyFile}},
+		WithPlainCrypt(params)); err != nil {
+		t.Fatalf("SealKeyToTPMWithOptions failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if !reflect.DeepEqual(k.PlainCrypt(), params) {
+		t.Errorf("Unexpected plain dm-crypt parameters: %v", k.PlainCrypt())
+	}
+}
+
+func TestSealKeyToTPMWithImportable(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMWithImportable_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	authKey, err := SealKeyToTPMWithOptions(tpm, []*SealKeyRequest{{Key: key, Path: keyFile}},
+		WithPCRProfile(getTestPCRProfile()), WithoutCounter(), WithImportable())
+	if err != nil {
+		t.Fatalf("SealKeyToTPMWithOptions failed: %v", err)
+	}
+
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, authKey, tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if k.RequiredFeatures()&KeyDataFeatureImportable == 0 {
+		t.Errorf("Unexpected required features: %v", k.RequiredFeatures())
+	}
+
+	unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(unsealedKey, key) {
+		t.Errorf("Unexpected key")
+	}
+
+	// Changing the PIN replaces the duplication blob with a private area protected by the storage root key.
+	if err := ChangePIN(tpm, keyFile, "", "1234"); err != nil {
+		t.Fatalf("ChangePIN failed: %v", err)
+	}
+	k, err = ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if k.RequiredFeatures()&KeyDataFeatureImportable != 0 {
+		t.Errorf("Unexpected required features: %v", k.RequiredFeatures())
+	}
+	unsealedKey, _, err = k.UnsealFromTPM(tpm, "1234")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(unsealedKey, key) {
+		t.Errorf("Unexpected key")
+	}
+}
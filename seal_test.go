@@ -31,6 +31,7 @@ import (
 	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"golang.org/x/xerrors"
 
@@ -122,6 +123,13 @@ func TestSealKeyToTPM(t *testing.T) {
 		run(t, tpm, &KeyCreationParams{PCRPolicyCounterHandle: 0x01810000})
 	})
 
+	t.Run("SHA384PCRPolicyCounter", func(t *testing.T) {
+		tpm := openTPMForTesting(t)
+		defer closeTPM(t, tpm)
+		run(t, tpm, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000,
+			PCRPolicyCounterNameAlg: tpm2.HashAlgorithmSHA384})
+	})
+
 	t.Run("NoPCRPolicyCounterHandle", func(t *testing.T) {
 		tpm := openTPMForTesting(t)
 		defer closeTPM(t, tpm)
@@ -251,6 +259,75 @@ func TestSealKeyToTPMMultiple(t *testing.T) {
 	})
 }
 
+func TestSealKeyToTPMMultipleErrorHandling(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	run := func(t *testing.T, paths []string) error {
+		var keys []*SealKeyRequest
+		for _, p := range paths {
+			keys = append(keys, &SealKeyRequest{Key: key, Path: p})
+		}
+
+		_, err := SealKeyToTPMMultiple(tpm, keys, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+
+		if _, err := tpm.CreateResourceContextFromTPM(0x01810000); err == nil {
+			t.Errorf("SealKeyToTPMMultiple created a dynamic policy counter")
+		}
+		return err
+	}
+
+	t.Run("DuplicatePath", func(t *testing.T) {
+		tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMMultipleErrors_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		path := filepath.Join(tmpDir, "keydata")
+		err = run(t, []string{path, path})
+		if err == nil || err.Error() != "duplicate key data file path "+path {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if _, err := os.Stat(path); err == nil {
+			t.Errorf("SealKeyToTPMMultiple created a key file")
+		}
+	})
+
+	t.Run("SecondFileExists", func(t *testing.T) {
+		tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMMultipleErrors_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		path1 := filepath.Join(tmpDir, "keydata1")
+		path2 := filepath.Join(tmpDir, "keydata2")
+		if err := ioutil.WriteFile(path2, []byte("foo"), 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+
+		err = run(t, []string{path1, path2})
+		var e *os.PathError
+		if !xerrors.As(err, &e) || e.Path != path2 || e.Err != syscall.EEXIST {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if _, err := os.Stat(path1); err == nil {
+			t.Errorf("SealKeyToTPMMultiple didn't remove the key file that it created")
+		}
+		if data, err := ioutil.ReadFile(path2); err != nil || string(data) != "foo" {
+			t.Errorf("SealKeyToTPMMultiple modified the existing file")
+		}
+	})
+}
+
 func TestSealKeyToTPMErrorHandling(t *testing.T) {
 	tpm := openTPMForTesting(t)
 	defer closeTPM(t, tpm)
@@ -392,6 +469,56 @@ func TestSealKeyToTPMErrorHandling(t *testing.T) {
 			t.Errorf("Unexpected error: %v", err)
 		}
 	})
+	t.Run("NoVerifiedSession", func(t *testing.T) {
+		tpm.RequireVerifiedSession(true)
+		defer tpm.RequireVerifiedSession(false)
+
+		err := run(t, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+		if err != ErrNoVerifiedSession {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+	t.Run("AlgorithmPolicyECCKeyBits", func(t *testing.T) {
+		if err := SetAlgorithmPolicy(&AlgorithmPolicy{MinECCKeyBits: 384}); err != nil {
+			t.Fatalf("SetAlgorithmPolicy failed: %v", err)
+		}
+		defer SetAlgorithmPolicy(nil)
+
+		err := run(t, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+		if _, ok := err.(AlgorithmPolicyError); !ok {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+	t.Run("AlgorithmPolicyPCRBank", func(t *testing.T) {
+		if err := SetAlgorithmPolicy(&AlgorithmPolicy{ForbiddenDigestAlgorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1}}); err != nil {
+			t.Fatalf("SetAlgorithmPolicy failed: %v", err)
+		}
+		defer SetAlgorithmPolicy(nil)
+
+		err := run(t, "", &KeyCreationParams{
+			PCRProfile:             NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA1, 7, make([]byte, 20)),
+			PCRPolicyCounterHandle: 0x01810000})
+		var e AlgorithmPolicyError
+		if !xerrors.As(err, &e) {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
+func TestSetAlgorithmPolicyUnsatisfiable(t *testing.T) {
+	for _, policy := range []*AlgorithmPolicy{
+		{MinRSAKeyBits: 3072},
+		{ForbiddenDigestAlgorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}},
+	} {
+		err := SetAlgorithmPolicy(policy)
+		if _, ok := err.(AlgorithmPolicyError); !ok {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}
+	if err := SetAlgorithmPolicy(&AlgorithmPolicy{MinRSAKeyBits: 2048}); err != nil {
+		t.Errorf("SetAlgorithmPolicy failed: %v", err)
+	}
+	SetAlgorithmPolicy(nil)
 }
 
 func TestUpdateKeyPCRProtectionPolicy(t *testing.T) {
@@ -762,3 +889,403 @@ func TestUpdateKeyPCRProtectionPolicyMultipleUnrelated2(t *testing.T) {
 		t.Errorf("Unexpected error: %v", err)
 	}
 }
+
+func TestCheckTPMFirmware(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestCheckTPMFirmware_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: tpm2.HandleNull}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	if err := k.CheckTPMFirmware(tpm); err != nil {
+		t.Errorf("CheckTPMFirmware failed: %v", err)
+	}
+
+	k.SetTPMFirmwareVersion(0x1234)
+	if _, ok := k.CheckTPMFirmware(tpm).(TPMFirmwareChangedError); !ok {
+		t.Errorf("CheckTPMFirmware should have detected a firmware change")
+	}
+}
+
+func TestSetKeyMetadata(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestSetKeyMetadata_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	before := time.Now().Add(-time.Second)
+	authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		Metadata:               &KeyMetadata{Role: "run", Label: "foo"}})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	metadata := k.Metadata()
+	if metadata.Role != "run" || metadata.Label != "foo" || len(metadata.CallerData) > 0 {
+		t.Errorf("Unexpected metadata: %+v", metadata)
+	}
+	if metadata.CreationTime.Before(before) || metadata.CreationTime.After(time.Now()) {
+		t.Errorf("Unexpected creation time: %v", metadata.CreationTime)
+	}
+
+	if err := SetKeyMetadata(keyFile, &KeyMetadata{Role: "run", Label: "bar", CallerData: []byte{1, 2, 3}}); err != nil {
+		t.Fatalf("SetKeyMetadata failed: %v", err)
+	}
+
+	k, err = ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	updated := k.Metadata()
+	if updated.Role != "run" || updated.Label != "bar" || !bytes.Equal(updated.CallerData, []byte{1, 2, 3}) {
+		t.Errorf("Unexpected metadata: %+v", updated)
+	}
+	if !updated.CreationTime.Equal(metadata.CreationTime) {
+		t.Errorf("SetKeyMetadata didn't preserve the creation time")
+	}
+
+	// Updating the metadata shouldn't affect the ability to unseal the key.
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, authKey, tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+	keyUnsealed, _, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(keyUnsealed, key) {
+		t.Errorf("TPM returned the wrong key")
+	}
+}
+
+func TestKeyIdentityAndPCRPolicyGeneration(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestKeyIdentityAndPCRPolicyGeneration_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	keys := []*SealKeyRequest{
+		{Key: key, Path: filepath.Join(tmpDir, "keydata1")},
+		{Key: key, Path: filepath.Join(tmpDir, "keydata2")}}
+	authKey, err := SealKeyToTPMMultiple(tpm, keys, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+	if err != nil {
+		t.Fatalf("SealKeyToTPMMultiple failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keys[0].Path)
+
+	check := func(t *testing.T, path string, expectedGeneration uint64) KeyID {
+		k, err := ReadSealedKeyObject(path)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		id, ok := k.KeyID()
+		if !ok {
+			t.Fatalf("No key ID")
+		}
+		if id == (KeyID{}) {
+			t.Errorf("Unexpected zero key ID")
+		}
+		if k.PCRPolicyGeneration() != expectedGeneration {
+			t.Errorf("Unexpected PCR policy generation: %d", k.PCRPolicyGeneration())
+		}
+		return id
+	}
+
+	id1 := check(t, keys[0].Path, 1)
+	id2 := check(t, keys[1].Path, 1)
+	if id1 == id2 {
+		t.Errorf("Keys have the same ID (%s)", id1)
+	}
+
+	paths := []string{keys[0].Path, keys[1].Path}
+	for i := 0; i < 2; i++ {
+		if err := UpdateKeyPCRProtectionPolicyMultiple(tpm, paths, authKey, getTestPCRProfile()); err != nil {
+			t.Fatalf("UpdateKeyPCRProtectionPolicyMultiple failed: %v", err)
+		}
+	}
+
+	if id := check(t, keys[0].Path, 3); id != id1 {
+		t.Errorf("Key ID changed after updating PCR policy (%s != %s)", id, id1)
+	}
+	if id := check(t, keys[1].Path, 3); id != id2 {
+		t.Errorf("Key ID changed after updating PCR policy (%s != %s)", id, id2)
+	}
+}
+
+func TestMigratePCRPolicyCounter(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestMigratePCRPolicyCounter_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	newAuthKey, err := MigratePCRPolicyCounter(tpm, []string{keyFile}, "", &KeyCreationParams{
+		PCRProfile:              getTestPCRProfile(),
+		PCRPolicyCounterHandle:  0x01810001,
+		PCRPolicyCounterNameAlg: tpm2.HashAlgorithmSHA384})
+	if err != nil {
+		t.Fatalf("MigratePCRPolicyCounter failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	if !bytes.Equal(newAuthKey, authKey) {
+		t.Errorf("Expected the existing auth key to be retained")
+	}
+	if _, err := tpm.CreateResourceContextFromTPM(0x01810000); !tpm2.IsResourceUnavailableError(err, 0x01810000) {
+		t.Errorf("Expected the old PCR policy counter to be undefined (err: %v)", err)
+	}
+
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, newAuthKey, tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if k.PCRPolicyCounterHandle() != 0x01810001 {
+		t.Errorf("Unexpected PCR policy counter handle: %v", k.PCRPolicyCounterHandle())
+	}
+	index, err := tpm.CreateResourceContextFromTPM(0x01810001)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	pub, _, err := tpm.NVReadPublic(index)
+	if err != nil {
+		t.Fatalf("NVReadPublic failed: %v", err)
+	}
+	if pub.NameAlg != tpm2.HashAlgorithmSHA384 {
+		t.Errorf("Unexpected PCR policy counter name algorithm: %v", pub.NameAlg)
+	}
+
+	unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(unsealedKey, key) {
+		t.Errorf("Unexpected unsealed key")
+	}
+}
+
+func TestMigratePCRPolicyCounterMultiple(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestMigratePCRPolicyCounterMultiple_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var requests []*SealKeyRequest
+	var keyFiles []string
+	for _, name := range []string{"keydata1", "keydata2"} {
+		key := make([]byte, 64)
+		rand.Read(key)
+		requests = append(requests, &SealKeyRequest{Key: key, Path: filepath.Join(tmpDir, name)})
+		keyFiles = append(keyFiles, filepath.Join(tmpDir, name))
+	}
+
+	if _, err := SealKeyToTPMMultiple(tpm, requests, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPMMultiple failed: %v", err)
+	}
+
+	if _, err := MigratePCRPolicyCounter(tpm, keyFiles, "", &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: 0x01810001}); err != nil {
+		t.Fatalf("MigratePCRPolicyCounter failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFiles[0])
+
+	if _, err := tpm.CreateResourceContextFromTPM(0x01810000); !tpm2.IsResourceUnavailableError(err, 0x01810000) {
+		t.Errorf("Expected the old PCR policy counter to be undefined (err: %v)", err)
+	}
+
+	// Every key that shared the old counter must still be usable.
+	for i, r := range requests {
+		k, err := ReadSealedKeyObject(keyFiles[i])
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		if k.PCRPolicyCounterHandle() != 0x01810001 {
+			t.Errorf("Unexpected PCR policy counter handle: %v", k.PCRPolicyCounterHandle())
+		}
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(unsealedKey, r.Key) {
+			t.Errorf("Unexpected unsealed key")
+		}
+	}
+}
+
+func TestReadSealedKeyObjectUnsupportedFeatures(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestReadSealedKeyObjectUnsupportedFeatures_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: tpm2.HandleNull}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if k.RequiredFeatures() != 0 {
+		t.Errorf("Unexpected required features: %v", k.RequiredFeatures())
+	}
+
+	// Features supported by this version don't prevent the key from being used.
+	if err := WriteKeyDataWithRequiredFeatures(keyFile, KeyDataFeatureDiskIdentity); err != nil {
+		t.Fatalf("WriteKeyDataWithRequiredFeatures failed: %v", err)
+	}
+	if _, err := ReadSealedKeyObject(keyFile); err != nil {
+		t.Errorf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	if err := WriteKeyDataWithRequiredFeatures(keyFile, KeyDataFeatureDiskIdentity|KeyDataFeatures(1<<40)); err != nil {
+		t.Fatalf("WriteKeyDataWithRequiredFeatures failed: %v", err)
+	}
+	_, err = ReadSealedKeyObject(keyFile)
+	var e *KeyDataUnsupportedError
+	if !xerrors.As(err, &e) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if e.MissingFeatures != KeyDataFeatures(1<<40) {
+		t.Errorf("Unexpected missing features: %v", e.MissingFeatures)
+	}
+	if err.Error() != "key data was created by a newer version of secboot: features unknown(0x10000000000) required" {
+		t.Errorf("Unexpected error message: %v", err)
+	}
+}
+
+func TestReadSealedKeyObjectNewerVersion(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "_TestReadSealedKeyObjectNewerVersion_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	data := []byte{0x55, 0x53, 0x4b, 0x24, 0x00, 0x00, 0x00, 0x63, 0xde, 0xad, 0xbe, 0xef}
+	if err := ioutil.WriteFile(keyFile, data, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	_, err = ReadSealedKeyObject(keyFile)
+	var e *KeyDataUnsupportedError
+	if !xerrors.As(err, &e) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if e.Version != 99 || e.MissingFeatures != 0 {
+		t.Errorf("Unexpected error: %+v", e)
+	}
+	if err.Error() != "key data was created by a newer version of secboot: version 99 required" {
+		t.Errorf("Unexpected error message: %v", err)
+	}
+}
+
+func TestKeyDataFeaturesString(t *testing.T) {
+	for _, data := range []struct {
+		features KeyDataFeatures
+		expected string
+	}{
+		{0, "none"},
+		{KeyDataFeatureVolumeKeyDerivation, "volume-key-derivation"},
+		{KeyDataFeaturePolicyAuthDelegation | KeyDataFeaturePlainCrypt, "policy-auth-delegation, plain-crypt"},
+		{KeyDataFeatureIntegrity | KeyDataFeatures(1<<63), "integrity, unknown(0x8000000000000000)"},
+	} {
+		if s := data.features.String(); s != data.expected {
+			t.Errorf("Unexpected string %q (expected %q)", s, data.expected)
+		}
+	}
+
+	if SupportedKeyDataFeatures()&KeyDataFeatureDmVerityRootHashes == 0 {
+		t.Errorf("Unexpected supported features: %v", SupportedKeyDataFeatures())
+	}
+}
@@ -0,0 +1,78 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"runtime"
+)
+
+// wipeBytes overwrites the contents of the supplied slice with zeroes.
+func wipeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	// Make sure that the compiler doesn't optimize away the writes to a slice that is never read again.
+	runtime.KeepAlive(b)
+}
+
+// SecretBuffer is a container for sensitive data such as unsealed disk encryption keys, PINs and private keys used for
+// authorizing PCR policy updates. Unlike a plain byte slice, which remains in memory until it is garbage collected and
+// possibly overwritten, the contents of a SecretBuffer can be explicitly wiped once they are no longer needed.
+//
+// Note that this is only able to wipe the memory that it owns. Any copies of the data created by the caller will need to
+// be wiped separately.
+type SecretBuffer struct {
+	data []byte
+}
+
+// NewSecretBuffer creates a new SecretBuffer that takes ownership of the supplied slice. The slice is not copied, and the
+// caller should not retain any references to it.
+func NewSecretBuffer(data []byte) *SecretBuffer {
+	return &SecretBuffer{data: data}
+}
+
+// Bytes returns the contents of this buffer. The returned slice references the memory owned by this buffer, and is only
+// valid until Wipe or Close is called.
+func (b *SecretBuffer) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.data
+}
+
+// Len returns the length of the contents of this buffer.
+func (b *SecretBuffer) Len() int {
+	return len(b.Bytes())
+}
+
+// Wipe overwrites the contents of this buffer with zeroes and releases it. It is safe to call this more than once.
+func (b *SecretBuffer) Wipe() {
+	if b == nil {
+		return
+	}
+	wipeBytes(b.data)
+	b.data = nil
+}
+
+// Close wipes the contents of this buffer. It implements io.Closer so that a SecretBuffer can be wiped with a deferred call.
+func (b *SecretBuffer) Close() error {
+	b.Wipe()
+	return nil
+}
@@ -0,0 +1,64 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	. "github.com/snapcore/secboot"
+
+	. "gopkg.in/check.v1"
+)
+
+type secretSuite struct{}
+
+var _ = Suite(&secretSuite{})
+
+func (s *secretSuite) TestSecretBufferDoesNotCopy(c *C) {
+	data := []byte("foo")
+	b := NewSecretBuffer(data)
+	c.Check(b.Bytes(), DeepEquals, []byte("foo"))
+	c.Check(b.Len(), Equals, 3)
+	c.Check(&b.Bytes()[0], Equals, &data[0])
+}
+
+func (s *secretSuite) TestSecretBufferWipe(c *C) {
+	data := []byte("foo")
+	b := NewSecretBuffer(data)
+	b.Wipe()
+	c.Check(data, DeepEquals, []byte{0, 0, 0})
+	c.Check(b.Bytes(), IsNil)
+	c.Check(b.Len(), Equals, 0)
+
+	// Wiping more than once is safe.
+	b.Wipe()
+}
+
+func (s *secretSuite) TestSecretBufferClose(c *C) {
+	data := []byte("bar")
+	b := NewSecretBuffer(data)
+	c.Check(b.Close(), IsNil)
+	c.Check(data, DeepEquals, []byte{0, 0, 0})
+}
+
+func (s *secretSuite) TestNilSecretBuffer(c *C) {
+	var b *SecretBuffer
+	c.Check(b.Bytes(), IsNil)
+	c.Check(b.Len(), Equals, 0)
+	b.Wipe()
+}
@@ -22,6 +22,8 @@ package secboot
 import (
 	"bufio"
 	"bytes"
+	"crypto"
+	_ "crypto/sha1"
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/binary"
@@ -33,9 +35,11 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"unicode/utf16"
 
 	"github.com/canonical/go-tpm2"
 	"github.com/canonical/tcglog-parser"
+	sbefi "github.com/snapcore/secboot/efi"
 	"github.com/snapcore/secboot/internal/efi"
 	"github.com/snapcore/secboot/internal/pe1.14"
 	"github.com/snapcore/snapd/osutil"
@@ -55,10 +59,15 @@ const (
 	mokSbStateName = "MokSBState" // Unicode variable name for the shim secure boot configuration (validation enabled/disabled)
 	shimName       = "Shim"       // Unicode variable name used for recording events when shim's vendor certificate is used for verification
 
-	kekFilename     = "KEK-8be4df61-93ca-11d2-aa0d-00e098032b8c"       // Filename in efivarfs for accessing the KEK database
-	dbFilename      = "db-d719b2cb-3d3a-4596-a3bc-dad00e67656f"        // Filename in efivarfs for accessing the EFI authorized signature database
-	dbxFilename     = "dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f"       // Filename in efivarfs for accessing the EFI forbidden signature database
-	mokListFilename = "MokListRT-605dab50-e046-4300-abb6-3dd810dd8b23" // Filename in efivarfs for accessing a runtime copy of the shim MOK database
+	shimVendorDbName  = "vendor_db"  // Unicode variable name used for recording events when shim's vendor_db is used for verification
+	shimVendorDbxName = "vendor_dbx" // Unicode variable name for shim's built-in forbidden signature database
+
+	pkFilename        = "PK-8be4df61-93ca-11d2-aa0d-00e098032b8c"        // Filename in efivarfs for accessing the EFI platform key
+	setupModeFilename = "SetupMode-8be4df61-93ca-11d2-aa0d-00e098032b8c" // Filename in efivarfs for accessing the EFI setup mode state
+	kekFilename       = "KEK-8be4df61-93ca-11d2-aa0d-00e098032b8c"       // Filename in efivarfs for accessing the KEK database
+	dbFilename        = "db-d719b2cb-3d3a-4596-a3bc-dad00e67656f"        // Filename in efivarfs for accessing the EFI authorized signature database
+	dbxFilename       = "dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f"       // Filename in efivarfs for accessing the EFI forbidden signature database
+	mokListFilename   = "MokListRT-605dab50-e046-4300-abb6-3dd810dd8b23" // Filename in efivarfs for accessing a runtime copy of the shim MOK database
 
 	uefiDriverPCR = 2 // UEFI Drivers and UEFI Applications PCR
 	secureBootPCR = 7 // Secure Boot Policy Measurements PCR
@@ -67,390 +76,121 @@ const (
 
 	sbKeySyncExe = "sbkeysync"
 
-	winCertTypePKCSSignedData uint16 = 0x0002 // WIN_CERT_TYPE_PKCS_SIGNED_DATA
-	winCertTypeEfiGuid        uint16 = 0x0EF1 // WIN_CERT_TYPE_EFI_GUID
+	// sbKeySyncUpdateAttrs are the attributes that sbkeysync supplies to SetVariable when appending a signature database update
+	// (EFI_VARIABLE_NON_VOLATILE | EFI_VARIABLE_BOOTSERVICE_ACCESS | EFI_VARIABLE_RUNTIME_ACCESS |
+	// EFI_VARIABLE_TIME_BASED_AUTHENTICATED_WRITE_ACCESS | EFI_VARIABLE_APPEND_WRITE). These are covered by the signature of
+	// the update.
+	sbKeySyncUpdateAttrs uint32 = 0x67
+
+	// enhancedAuthUpdateAttrs are the attributes used when appending a signature database update that begins with a
+	// EFI_VARIABLE_AUTHENTICATION_3 descriptor, which replace EFI_VARIABLE_TIME_BASED_AUTHENTICATED_WRITE_ACCESS with
+	// EFI_VARIABLE_ENHANCED_AUTHENTICATED_ACCESS.
+	enhancedAuthUpdateAttrs uint32 = 0xc7
 )
 
 var (
 	shimGuid                     = tcglog.MakeEFIGUID(0x605dab50, 0xe046, 0x4300, 0xabb6, [...]uint8{0x3d, 0xd8, 0x10, 0xdd, 0x8b, 0x23}) // SHIM_LOCK_GUID
-	efiGlobalVariableGuid        = tcglog.MakeEFIGUID(0x8be4df61, 0x93ca, 0x11d2, 0xaa0d, [...]uint8{0x00, 0xe0, 0x98, 0x03, 0x2b, 0x8c}) // EFI_GLOBAL_VARIABLE
-	efiImageSecurityDatabaseGuid = tcglog.MakeEFIGUID(0xd719b2cb, 0x3d3a, 0x4596, 0xa3bc, [...]uint8{0xda, 0xd0, 0x0e, 0x67, 0x65, 0x6f}) // EFI_IMAGE_SECURITY_DATABASE_GUID
+	efiGlobalVariableGuid        = sbefi.GlobalVariableGuid
+	efiImageSecurityDatabaseGuid = sbefi.ImageSecurityDatabaseGuid
 
-	efiCertX509Guid      = tcglog.MakeEFIGUID(0xa5c059a1, 0x94e4, 0x4aa7, 0x87b5, [...]uint8{0xab, 0x15, 0x5c, 0x2b, 0xf0, 0x72}) // EFI_CERT_X509_GUID
-	efiCertTypePkcs7Guid = tcglog.MakeEFIGUID(0x4aafd29d, 0x68df, 0x49ee, 0x8aa9, [...]uint8{0x34, 0x7d, 0x37, 0x56, 0x65, 0xa7}) // EFI_CERT_TYPE_PKCS7_GUID
+	efiCertX509Guid   = sbefi.CertX509Guid
+	efiCertSHA1Guid   = sbefi.CertSHA1Guid
+	efiCertSHA256Guid = sbefi.CertSHA256Guid
 
-	oidSha256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSha256     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
 
 	efivarsPath = "/sys/firmware/efi/efivars" // Default mount point for efivarfs
 )
 
-type winCertificate interface {
-	wCertificateType() uint16
-}
-
-// winCertificateUefiGuid corresponds to the WIN_CERTIFICATE_UEFI_GUID type.
-type winCertificateUefiGuid struct {
-	CertType tcglog.EFIGUID // CertType
-	Data     []byte         // CertData
-}
-
-func (c *winCertificateUefiGuid) wCertificateType() uint16 {
-	return winCertTypeEfiGuid
-}
-
-type winCertificateAuthenticode struct {
-	Data []byte
-}
-
-func (c *winCertificateAuthenticode) wCertificateType() uint16 {
-	return winCertTypePKCSSignedData
-}
-
-// decodeWinCertificate decodes the WIN_CERTIFICATE implementation from r. Currently supported types are WIN_CERT_TYPE_PKCS_SIGNED_DATA
-// and WIN_CERT_TYPE_EFI_GUID.
-func decodeWinCertificate(r io.Reader) (cert winCertificate, length int, err error) {
-	var hdr struct {
-		Length          uint32
-		Revision        uint16
-		CertificateType uint16
-	}
-	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
-		return nil, 0, xerrors.Errorf("cannot read WIN_CERTIFICATE header fields: %w", err)
-	}
-	if hdr.Revision != 0x200 {
-		return nil, 0, fmt.Errorf("invalid wRevision value (0x%04x)", hdr.Revision)
-	}
-
-	switch hdr.CertificateType {
-	case winCertTypePKCSSignedData:
-		out := &winCertificateAuthenticode{}
-		out.Data = make([]byte, int(hdr.Length)-binary.Size(hdr))
-		if _, err := io.ReadFull(r, out.Data); err != nil {
-			return nil, 0, xerrors.Errorf("cannot read WIN_CERTIFICATE.bCertificate: %w", err)
-		}
-		return out, int(hdr.Length), nil
-	case winCertTypeEfiGuid:
-		out := &winCertificateUefiGuid{}
-		if _, err := io.ReadFull(r, out.CertType[:]); err != nil {
-			return nil, 0, xerrors.Errorf("cannot read WIN_CERTIFICATE_UEFI_GUID.CertType: %w", err)
-		}
-		out.Data = make([]byte, int(hdr.Length)-binary.Size(hdr)-binary.Size(out.CertType))
-		if _, err := io.ReadFull(r, out.Data); err != nil {
-			return nil, 0, xerrors.Errorf("cannot read WIN_CERTIFICATE_UEFI_GUID.CertData: %w", err)
-		}
-		return out, int(hdr.Length), nil
-	default:
-		return nil, 0, fmt.Errorf("cannot decode unrecognized type (0x%04x)", hdr.CertificateType)
-	}
-}
-
-// readShimVendorCert obtains the DER encoded built-in vendor certificate from the shim executable accessed via r.
-func readShimVendorCert(r io.ReaderAt) ([]byte, error) {
+// readShimCertTable obtains the contents of the vendor_authorized and vendor_deauthorized fields of the .vendor_cert section
+// of the shim executable accessed via r. Depending on how shim was built, vendor_authorized contains either a single DER encoded
+// certificate or a EFI signature database. vendor_deauthorized contains a EFI signature database.
+func readShimCertTable(r io.ReaderAt) (authorized, deauthorized []byte, err error) {
 	pefile, err := pe.NewFile(r)
 	if err != nil {
-		return nil, xerrors.Errorf("cannot decode PE binary: %w", err)
+		return nil, nil, xerrors.Errorf("cannot decode PE binary: %w", err)
 	}
 
 	// Shim's vendor certificate is in the .vendor_cert section.
 	section := pefile.Section(".vendor_cert")
 	if section == nil {
-		return nil, errors.New("missing .vendor_cert section")
+		return nil, nil, errors.New("missing .vendor_cert section")
 	}
 
 	// Shim's .vendor_cert section starts with a cert_table struct (see shim.c in the shim source)
-	sr := io.NewSectionReader(section, 0, 16)
-
-	// Read vendor_cert_size field
-	var certSize uint32
-	if err := binary.Read(sr, binary.LittleEndian, &certSize); err != nil {
-		return nil, xerrors.Errorf("cannot read vendor cert size: %w", err)
+	var table struct {
+		AuthorizedSize     uint32
+		DeauthorizedSize   uint32
+		AuthorizedOffset   uint32
+		DeauthorizedOffset uint32
 	}
-
-	// A size of zero is valid
-	if certSize == 0 {
-		return nil, nil
-	}
-
-	// Skip vendor_dbx_size
-	sr.Seek(4, io.SeekCurrent)
-
-	// Read vendor_cert_offset
-	var certOffset uint32
-	if err := binary.Read(sr, binary.LittleEndian, &certOffset); err != nil {
-		return nil, xerrors.Errorf("cannot read vendor cert offset: %w", err)
+	if err := binary.Read(io.NewSectionReader(section, 0, 16), binary.LittleEndian, &table); err != nil {
+		return nil, nil, xerrors.Errorf("cannot read cert table: %w", err)
 	}
 
-	sr = io.NewSectionReader(section, int64(certOffset), int64(certSize))
-	certData, err := ioutil.ReadAll(sr)
-	if err != nil {
-		return nil, xerrors.Errorf("cannot read vendor cert data: %w", err)
-	}
-
-	return certData, nil
-}
-
-// secureBootDbIterator provides a mechanism to iterate over a set of EFI_SIGNATURE_LIST entries in a EFI signature database.
-type secureBootDbIterator struct {
-	r io.ReadSeeker
-}
-
-// nextSignatureList returns the SignatureType, SignatureHeader and EFI_SIGNATURE_DATA entries associated with the next
-// EFI_SIGNATURE_LIST.
-func (d *secureBootDbIterator) nextSignatureList() (tcglog.EFIGUID, []byte, [][]byte, error) {
-	start, _ := d.r.Seek(0, io.SeekCurrent)
-
-	// Decode EFI_SIGNATURE_LIST.SignatureType
-	var signatureType tcglog.EFIGUID
-	if _, err := io.ReadFull(d.r, signatureType[:]); err != nil {
-		if err == io.EOF {
-			return tcglog.EFIGUID{}, nil, nil, err
+	// A size of zero is valid
+	if table.AuthorizedSize > 0 {
+		authorized, err = ioutil.ReadAll(io.NewSectionReader(section, int64(table.AuthorizedOffset), int64(table.AuthorizedSize)))
+		if err != nil {
+			return nil, nil, xerrors.Errorf("cannot read vendor cert data: %w", err)
 		}
-		return tcglog.EFIGUID{}, nil, nil, xerrors.Errorf("cannot read EFI_SIGNATURE_LIST.SignatureType: %w", err)
 	}
-
-	// Decode EFI_SIGNATURE_LIST.SignatureListSize, which indicates the size of the entire EFI_SIGNATURE_LIST,
-	// including all of the EFI_SIGNATURE_DATA entries.
-	var signatureListSize uint32
-	if err := binary.Read(d.r, binary.LittleEndian, &signatureListSize); err != nil {
-		return tcglog.EFIGUID{}, nil, nil, xerrors.Errorf("cannot read EFI_SIGNATURE_LIST.SignatureListSize: %w", err)
-	}
-
-	// Decode EFI_SIGNATURE_LIST.SignatureHeaderSize, which indicates the size of the optional header data between
-	// the core EFI_SIGNATURE_LIST fields and the EFI_SIGNATURE_DATA entries.
-	// Always zero for the signature types we care about.
-	var signatureHeaderSize uint32
-	if err := binary.Read(d.r, binary.LittleEndian, &signatureHeaderSize); err != nil {
-		return tcglog.EFIGUID{}, nil, nil, xerrors.Errorf("cannot read EFI_SIGNATURE_LIST.SignatureHeaderSize: %w", err)
-	}
-
-	// Decode EFI_SIGNATURE_LIST.SignatureSize, which indicates the size of each EFI_SIGNATURE_DATA entry.
-	var signatureSize uint32
-	if err := binary.Read(d.r, binary.LittleEndian, &signatureSize); err != nil {
-		return tcglog.EFIGUID{}, nil, nil, xerrors.Errorf("cannot read EFI_SIGNATURE_LIST.SignatureSize: %w", err)
-	}
-	if signatureSize < 16 {
-		return tcglog.EFIGUID{}, nil, nil, errors.New("EFI_SIGNATURE_LIST.SignatureSize is invalid")
-	}
-
-	signatureHeader := make([]byte, signatureHeaderSize)
-	if _, err := io.ReadFull(d.r, signatureHeader); err != nil {
-		return tcglog.EFIGUID{}, nil, nil, xerrors.Errorf("cannot read EFI_SIGNATURE_LIST.SignatureHeader: %w", err)
-	}
-
-	// Calculate the number of EFI_SIGNATURE_DATA entries
-	endOfHeader, _ := d.r.Seek(0, io.SeekCurrent)
-	signatureDataSize := int64(signatureListSize) - endOfHeader + start
-	if signatureDataSize%int64(signatureSize) != 0 {
-		return tcglog.EFIGUID{}, nil, nil, errors.New("EFI_SIGNATURE_LIST has inconsistent SignatureListSize, SignatureHeaderSize and SignatureSize fields")
-	}
-	numOfSignatures := signatureDataSize / int64(signatureSize)
-
-	var signatures [][]byte
-
-	// Iterate over each EFI_SIGNATURE_DATA entry
-	for i := int64(0); i < numOfSignatures; i++ {
-		signature := make([]byte, signatureSize)
-		if _, err := io.ReadFull(d.r, signature); err != nil {
-			return tcglog.EFIGUID{}, nil, nil, xerrors.Errorf("cannot read EFI_SIGNATURE_DATA entry at index %d: %w", i, err)
+	if table.DeauthorizedSize > 0 {
+		deauthorized, err = ioutil.ReadAll(io.NewSectionReader(section, int64(table.DeauthorizedOffset), int64(table.DeauthorizedSize)))
+		if err != nil {
+			return nil, nil, xerrors.Errorf("cannot read vendor dbx data: %w", err)
 		}
-		signatures = append(signatures, signature)
 	}
 
-	return signatureType, signatureHeader, signatures, nil
+	return authorized, deauthorized, nil
 }
 
-// efiSignatureData corresponds to a EFI_SIGNATURE_DATA entry from a secure boot database, with the inclusion of the SignatureType
-// field of the EFI_SIGNATURE_LIST that the the signature was obtained from.
-type efiSignatureData struct {
-	signatureType tcglog.EFIGUID
-	owner         tcglog.EFIGUID
-	data          []byte
-}
-
-func (e *efiSignatureData) encode(buf io.Writer) error {
-	if _, err := buf.Write(e.owner[:]); err != nil {
-		return fmt.Errorf("cannot write signature owner: %v", err)
-	}
-	if _, err := buf.Write(e.data); err != nil {
-		return fmt.Errorf("cannot write signature data: %v", err)
+// readShimVendorCert obtains the DER encoded built-in vendor certificate from the shim executable accessed via r.
+func readShimVendorCert(r io.ReaderAt) ([]byte, error) {
+	authorized, _, err := readShimCertTable(r)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return authorized, nil
 }
 
-// decodeSecureBootDb parses a EFI signature database from r and returns a list of efiSignatureData structures corresponding to
-// all of the EFI_SIGNATURE_DATA entries.
-func decodeSecureBootDb(r io.ReadSeeker) ([]*efiSignatureData, error) {
-	var out []*efiSignatureData
-
-	iter := &secureBootDbIterator{r}
-	for i := 0; ; i++ {
-		sigType, _, sigs, err := iter.nextSignatureList()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, xerrors.Errorf("cannot obtain signature list at %d: %w", i, err)
-		}
-
-		for j, sig := range sigs {
-			sr := bytes.NewReader(sig)
-
-			// Decode EFI_SIGNATURE_DATA.SignatureOwner
-			var signatureOwner tcglog.EFIGUID
-			if _, err := io.ReadFull(sr, signatureOwner[:]); err != nil {
-				return nil, xerrors.Errorf("cannot decode EFI_SIGNATURE_DATA.SignatureOwner for signature at index %d in list index %d: %w", j, i, err)
-			}
+// readShimVendorDbs obtains the built-in vendor authorized and forbidden signature databases from the shim executable accessed via
+// r. Shim can be built either with a single vendor certificate, in which case the returned authorized database contains a single
+// X509 certificate that will be measured as "Shim" when used for verification, or with a vendor_db, in which case the returned
+// authorized database contains all of the entries from it and entries that are used for verification will be measured as
+// "vendor_db". The returned forbidden database contains the entries from shim's vendor_dbx. Any image digests in it are applied
+// to images loaded by shim, which will refuse to load them.
+func readShimVendorDbs(r io.ReaderAt) (db, dbx *secureBootDb, err error) {
+	authorized, deauthorized, err := readShimCertTable(r)
+	if err != nil {
+		return nil, nil, err
+	}
 
-			data, err := ioutil.ReadAll(sr)
+	db = &secureBootDb{variableName: shimGuid, unicodeName: shimName}
+	if len(authorized) > 0 {
+		if _, err := x509.ParseCertificate(authorized); err == nil {
+			db.signatures = append(db.signatures, &sbefi.SignatureData{Type: efiCertX509Guid, Data: authorized})
+		} else {
+			sigs, err := sbefi.DecodeSignatureDatabase(bytes.NewReader(authorized))
 			if err != nil {
-				return nil, xerrors.Errorf("cannot obtain EFI_SIGNATURE_DATA.SignatureData for signature at index %d in list index %d: %w", j, i, err)
+				return nil, nil, xerrors.Errorf("cannot decode vendor_db: %w", err)
 			}
-
-			out = append(out, &efiSignatureData{signatureType: sigType, owner: signatureOwner, data: data})
+			db.unicodeName = shimVendorDbName
+			db.signatures = sigs
 		}
 	}
 
-	return out, nil
-}
-
-type sigDbUpdateQuirkMode int
-
-const (
-	sigDbUpdateQuirkModeNone = iota
-
-	// sigDbUpdateQuirkModeDedupIgnoresOwner enables a mode to compute signature database updates where the firmware
-	// doesn't consider 2 EFI_SIGNATURE_DATA entries where only the SignatureOwner fields differ to be unique.
-	sigDbUpdateQuirkModeDedupIgnoresOwner
-)
-
-// computeDbUpdate appends the EFI signature database update supplied via update to the signature database supplied via orig, filtering
-// out EFI_SIGNATURE_DATA entries that are already in orig and then returning the result.
-func computeDbUpdate(orig io.ReaderAt, update io.ReadSeeker, quirkMode sigDbUpdateQuirkMode) ([]byte, error) {
-	// Skip over EFI_VARIABLE_AUTHENTICATION_2.TimeStamp
-	update.Seek(16, io.SeekCurrent)
-
-	var cert *winCertificateUefiGuid
-	if c, _, err := decodeWinCertificate(update); err != nil {
-		return nil, xerrors.Errorf("cannot decode EFI_VARIABLE_AUTHENTICATION_2.AuthInfo field from update: %w", err)
-	} else if c.wCertificateType() != winCertTypeEfiGuid {
-		return nil, fmt.Errorf("update has invalid EFI_VARIABLE_AUTHENTICATION_2.AuthInfo.Hdr.wCertificateType (0x%04x)", c.wCertificateType())
-	} else {
-		cert = c.(*winCertificateUefiGuid)
-	}
-
-	if cert.CertType != efiCertTypePkcs7Guid {
-		return nil, fmt.Errorf("update has invalid value for EFI_VARIABLE_AUTHENTICATION_2.AuthInfo.CertType (%s)", cert.CertType)
-	}
-
-	filteredUpdate := new(bytes.Buffer)
-
-	updateIter := &secureBootDbIterator{update}
-	for i := 0; ; i++ {
-		updateSigType, updateSigHeader, updateSigs, err := updateIter.nextSignatureList()
+	dbx = &secureBootDb{variableName: shimGuid, unicodeName: shimVendorDbxName}
+	if len(deauthorized) > 0 {
+		sigs, err := sbefi.DecodeSignatureDatabase(bytes.NewReader(deauthorized))
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, xerrors.Errorf("cannot obtain signature list from update at index %d: %w", i, err)
+			return nil, nil, xerrors.Errorf("cannot decode vendor_dbx: %w", err)
 		}
-
-		var newSigs bytes.Buffer
-		var updateSigSize int
-
-		for _, updateSig := range updateSigs {
-			isNewSig := true
-
-			iter := &secureBootDbIterator{io.NewSectionReader(orig, 0, (1<<63)-1)}
-			for j := 0; ; j++ {
-				sigType, _, sigs, err := iter.nextSignatureList()
-				if err != nil {
-					if err == io.EOF {
-						break
-					}
-					return nil, xerrors.Errorf("cannot obtain signature list from target at index %d: %w", j, err)
-				}
-				if sigType != updateSigType {
-					// EFI_SIGNATURE_LIST.SignatureType doesn't match
-					continue
-				}
-				for _, sig := range sigs {
-					switch quirkMode {
-					case sigDbUpdateQuirkModeNone:
-						if bytes.Equal(sig, updateSig) {
-							isNewSig = false
-						}
-					case sigDbUpdateQuirkModeDedupIgnoresOwner:
-						if bytes.Equal(sig[16:], updateSig[16:]) {
-							isNewSig = false
-						}
-					}
-					if !isNewSig {
-						break
-					}
-				}
-				if !isNewSig {
-					break
-				}
-			}
-
-			if isNewSig {
-				updateSigSize = len(updateSig)
-				if _, err := newSigs.Write(updateSig); err != nil {
-					return nil, xerrors.Errorf("cannot write new signature to temporary buffer: %w", err)
-				}
-			}
-		}
-
-		if newSigs.Len() == 0 {
-			continue
-		}
-
-		// This EFI_SIGNATURE_LIST has new signatures, so encode them to filteredSrc
-
-		// Encode EFI_SIGNATURE_LIST.SignatureType
-		if err := binary.Write(filteredUpdate, binary.LittleEndian, updateSigType); err != nil {
-			return nil, xerrors.Errorf("cannot encode new EFI_SIGNATURE_LIST.SignatureType: %w", err)
-		}
-
-		// Calculate and encode EFI_SIGNATURE_LIST.SignatureListSize. This includes EFI_SIGNATURE_LIST.SignatureType (16 bytes),
-		// EFI_SIGNATURE_LIST.SignatureListSize (4 bytes), EFI_SIGNATURE_LIST.SignatureHeaderSize (4 bytes),
-		// EFI_SIGNATURE_LIST.SignatureSize (4 bytes), EFI_SIGNATURE_LIST.SignatureHeader and EFI_SIGNATURE_LIST.Signatures.
-		signatureListSize := uint32(binary.Size(tcglog.EFIGUID{})) + 12 + uint32(len(updateSigHeader)) + uint32(newSigs.Len())
-		if err := binary.Write(filteredUpdate, binary.LittleEndian, uint32(signatureListSize)); err != nil {
-			return nil, xerrors.Errorf("cannot write new EFI_SIGNATURE_LIST.SignatureListSize: %w", err)
-		}
-
-		// Encode EFI_SIGNATURE_LIST.SignatureHeaderSize
-		if err := binary.Write(filteredUpdate, binary.LittleEndian, uint32(len(updateSigHeader))); err != nil {
-			return nil, xerrors.Errorf("cannot write new EFI_SIGNATURE_LIST.SignatureHeaderSize: %w", err)
-		}
-
-		// Encode EFI_SIGNATURE_LIST.SignatureSize
-		if err := binary.Write(filteredUpdate, binary.LittleEndian, uint32(updateSigSize)); err != nil {
-			return nil, xerrors.Errorf("cannot write new EFI_SIGNATURE_LIST.SignatureSize: %w", err)
-		}
-
-		// Write EFI_SIGNATURE_LIST.SignatureHeader
-		if _, err := filteredUpdate.Write(updateSigHeader); err != nil {
-			return nil, xerrors.Errorf("cannot write new EFI_SIGNATURE_LIST.SignatureHeader: %w", err)
-		}
-
-		// Write the saved EFI_SIGNATURE_DATA entries for this list
-		if _, err := filteredUpdate.ReadFrom(&newSigs); err != nil {
-			return nil, xerrors.Errorf("cannot write new EFI_SIGNATURE_DATA entries: %w", err)
-		}
-	}
-
-	res := new(bytes.Buffer)
-
-	if _, err := res.ReadFrom(io.NewSectionReader(orig, 0, (1<<63)-1)); err != nil {
-		return nil, xerrors.Errorf("cannot write original database to target: %w", err)
-	}
-	if _, err := res.ReadFrom(filteredUpdate); err != nil {
-		return nil, xerrors.Errorf("cannot write filtered update to target: %w", err)
+		dbx.signatures = sigs
 	}
 
-	return res.Bytes(), nil
+	return db, dbx, nil
 }
 
 // secureBootDbUpdate corresponds to an on-disk EFI signature database update.
@@ -461,16 +201,16 @@ type secureBootDbUpdate struct {
 
 // buildSignatureDbUpdateList builds a list of EFI signature database updates that will be applied by sbkeysync when executed with
 // the provided key stores.
-func buildSignatureDbUpdateList(keystores []string) ([]*secureBootDbUpdate, error) {
+func buildSignatureDbUpdateList(efivarsPath string, keystores []string) ([]*secureBootDbUpdate, error) {
 	if len(keystores) == 0 {
 		// Nothing to do
 		return nil, nil
 	}
 
 	// Run sbkeysync in dry run mode to build a list of updates it will try to append. It will only try to append an update that
-	// contains keys which don't currently exist in the firmware database.
-	// FIXME: This isn't a guarantee that the update is actually applicable because it could fail a signature check. We should
-	// probably filter updates out if they obviously won't apply.
+	// contains keys which don't currently exist in the firmware database. This isn't a guarantee that the update is actually
+	// applicable because it could fail a signature check, so the updates are checked in checkSignatureDbUpdatesAreAuthorized
+	// afterwards.
 	var updates []*secureBootDbUpdate
 
 	sbKeySync, err := exec.LookPath(sbKeySyncExe)
@@ -478,7 +218,7 @@ func buildSignatureDbUpdateList(keystores []string) ([]*secureBootDbUpdate, erro
 		return nil, xerrors.Errorf("lookup failed %s: %w", sbKeySyncExe, err)
 	}
 
-	args := []string{"--dry-run", "--verbose", "--no-default-keystores", "--efivars-path", efi.EFIVarsPath}
+	args := []string{"--dry-run", "--verbose", "--no-default-keystores", "--efivars-path", efivarsPath}
 	for _, ks := range keystores {
 		args = append(args, "--keystore", ks)
 	}
@@ -512,9 +252,183 @@ func buildSignatureDbUpdateList(keystores []string) ([]*secureBootDbUpdate, erro
 		}
 	}
 
+	if err := checkSignatureDbUpdatesAreAuthorized(efivarsPath, updates); err != nil {
+		return nil, err
+	}
+
 	return updates, nil
 }
 
+// readEFISignatureDbVariable reads the EFI signature database stored in the EFI variable with the specified efivarfs filename,
+// with the leading attribute field removed. A variable that doesn't exist is treated as an empty database.
+func readEFISignatureDbVariable(efivarsPath, filename string) ([]byte, error) {
+	db, err := ioutil.ReadFile(filepath.Join(efivarsPath, filename))
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	case len(db) < 4:
+		return nil, errors.New("variable data is too short")
+	}
+	// Skip over the 4-byte attribute field
+	return db[4:], nil
+}
+
+// parseAuthVarSignedData decodes the PKCS#7 signature from the CertData field of the EFI_VARIABLE_AUTHENTICATION_2.AuthInfo
+// field of a signed variable update. The UEFI specification requires this to be a DER encoded SignedData structure without the
+// outer ContentInfo, but some tools include it anyway and the firmware accepts both.
+func parseAuthVarSignedData(data []byte) (*pkcs7.PKCS7, error) {
+	if p7, err := pkcs7.Parse(data); err == nil {
+		return p7, nil
+	}
+
+	ci, err := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: data}})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot construct ContentInfo: %w", err)
+	}
+	return pkcs7.Parse(ci)
+}
+
+// verifySignatureDbUpdate verifies the authentication descriptor of the EFI signature database update read from r, in the same
+// way that the firmware does when the update is appended to the variable with the specified GUID and name. The update must be
+// signed by a key that is trusted by one of the X.509 certificates in the supplied authority databases. On success, the signature
+// database contained in the update is returned.
+func verifySignatureDbUpdate(r io.ReadSeeker, guid tcglog.EFIGUID, name string, authorities ...[]byte) ([]byte, error) {
+	auth, err := sbefi.DecodeVariableAuthentication(r)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode authentication descriptor: %w", err)
+	}
+	if auth.NewCert != nil {
+		return nil, errors.New("EFI_VARIABLE_AUTHENTICATION_3 certificate updates are not supported")
+	}
+
+	payload, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read signature database: %w", err)
+	}
+
+	p7, err := parseAuthVarSignedData(auth.SigningCert.Data)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode signature: %w", err)
+	}
+
+	attrs := sbKeySyncUpdateAttrs
+	if auth.Enhanced {
+		attrs = enhancedAuthUpdateAttrs
+	}
+
+	// The signature covers the variable name (without the NULL terminator), the vendor GUID, the attributes, the timestamp or
+	// nonce and the new variable contents.
+	signed := new(bytes.Buffer)
+	binary.Write(signed, binary.LittleEndian, utf16.Encode([]rune(name)))
+	signed.Write(guid[:])
+	binary.Write(signed, binary.LittleEndian, attrs)
+	signed.Write(auth.Timestamp)
+	signed.Write(auth.Nonce)
+	signed.Write(payload)
+	p7.Content = signed.Bytes()
+
+	if err := p7.Verify(); err != nil {
+		return nil, xerrors.Errorf("invalid signature: %w", err)
+	}
+
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		return nil, errors.New("cannot obtain signer certificate from signature")
+	}
+
+	for _, db := range authorities {
+		sigs, err := sbefi.DecodeSignatureDatabase(bytes.NewReader(db))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decode authority database: %w", err)
+		}
+		for _, sig := range sigs {
+			if sig.Type != efiCertX509Guid {
+				continue
+			}
+			ca, err := x509.ParseCertificate(sig.Data)
+			if err != nil {
+				continue
+			}
+			// XXX: As with secureBootPolicyGenBranch.findAuthority, this doesn't handle intermediate certificates.
+			if bytes.Equal(ca.Raw, signer.Raw) || signer.CheckSignatureFrom(ca) == nil {
+				return payload, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("signer certificate \"%s\" is not trusted", signer.Subject)
+}
+
+// checkSignatureDbUpdatesAreAuthorized checks that the firmware will accept each of the supplied EFI signature database updates
+// when they are applied in order by sbkeysync. Updates to KEK must be signed by the platform key, and updates to the authorized and
+// forbidden signature databases must be signed by a key in KEK (including keys added by earlier updates in the list) or by the
+// platform key. If the firmware is in setup mode, then all updates are accepted.
+//
+// If any update would be rejected by the firmware, a SignatureDbUpdateRejectedError error is returned.
+func checkSignatureDbUpdatesAreAuthorized(efivarsPath string, updates []*secureBootDbUpdate) error {
+	if len(updates) == 0 {
+		return nil
+	}
+
+	setupMode, err := ioutil.ReadFile(filepath.Join(efivarsPath, setupModeFilename))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return xerrors.Errorf("cannot read SetupMode variable: %w", err)
+	case len(setupMode) == 5 && setupMode[4] == 1:
+		// No signature checks are performed in setup mode
+		return nil
+	}
+
+	pk, err := readEFISignatureDbVariable(efivarsPath, pkFilename)
+	if err != nil {
+		return xerrors.Errorf("cannot read PK variable: %w", err)
+	}
+	kek, err := readEFISignatureDbVariable(efivarsPath, kekFilename)
+	if err != nil {
+		return xerrors.Errorf("cannot read KEK variable: %w", err)
+	}
+
+	for _, u := range updates {
+		var guid tcglog.EFIGUID
+		var authorities [][]byte
+		switch u.db {
+		case kekName:
+			guid = efiGlobalVariableGuid
+			authorities = [][]byte{pk}
+		case dbName, dbxName:
+			guid = efiImageSecurityDatabaseGuid
+			authorities = [][]byte{kek, pk}
+		default:
+			return SignatureDbUpdateRejectedError{Path: u.path, Db: u.db, msg: "unsupported signature database"}
+		}
+
+		f, err := os.Open(u.path)
+		if err != nil {
+			return xerrors.Errorf("cannot open signature DB update: %w", err)
+		}
+		payload, err := verifySignatureDbUpdate(f, guid, u.db, authorities...)
+		f.Close()
+		if err != nil {
+			return SignatureDbUpdateRejectedError{Path: u.path, Db: u.db, msg: err.Error()}
+		}
+
+		if u.db == kekName {
+			// Keys added to KEK can authorize subsequent updates to the other databases.
+			kek = append(kek, payload...)
+		}
+	}
+
+	return nil
+}
+
 // secureBootVerificationEvent corresponds to a EV_EFI_VARIABLE_AUTHORITY event and an indicator of whether the event
 // was recorded before the transition to OS-present.
 type secureBootVerificationEvent struct {
@@ -525,32 +439,27 @@ type secureBootVerificationEvent struct {
 // identifyInitialOSLaunchVerificationEvent finds the secure boot verification event associated with the verification of the initial
 // OS EFI image.
 func identifyInitialOSLaunchVerificationEvent(events []*tcglog.Event) (*secureBootVerificationEvent, error) {
+	platform := detectEFIPlatform(events)
+
 	preOS := true
 	var lastEvent *tcglog.Event
 	var lastEventIsPreOS bool
 
 	for _, e := range events {
-		if e.EventType == tcglog.EventTypeSeparator && e.PCRIndex != secureBootPCR {
+		switch {
+		case platform.isOSPresentTransition(e):
 			preOS = false
-			continue
-		}
-
-		switch e.PCRIndex {
-		case bootManagerCodePCR:
-			if e.EventType != tcglog.EventTypeEFIBootServicesApplication {
-				continue
-			}
-			if preOS {
+		case platform.isImageLoadEvent(e):
+			// On platforms that measure the initial OS image before the transition to OS-present, this is the first image
+			// loaded by the boot manager. Otherwise, images loaded before the transition are system preparation applications.
+			if preOS && !platform.imageLoadPrecedesSeparators {
 				continue
 			}
 			if lastEvent == nil {
 				return nil, errors.New("boot manager image load event occurred without a preceding verification event")
 			}
-			return &secureBootVerificationEvent{lastEvent, lastEventIsPreOS}, nil
-		case secureBootPCR:
-			if e.EventType != tcglog.EventTypeEFIVariableAuthority {
-				continue
-			}
+			return &secureBootVerificationEvent{lastEvent, lastEventIsPreOS && !platform.imageLoadPrecedesSeparators}, nil
+		case isVerificationEvent(e):
 			lastEvent = e
 			lastEventIsPreOS = preOS
 		}
@@ -596,6 +505,17 @@ func isVerificationEvent(event *tcglog.Event) bool {
 	return event.PCRIndex == secureBootPCR && event.EventType == tcglog.EventTypeEFIVariableAuthority
 }
 
+// isRecognizedSecureBootPolicyEvent determines if the specified event is one of the types that the "TCG PC Client Platform Firmware
+// Profile Specification" defines for measuring the secure boot policy to PCR 7.
+func isRecognizedSecureBootPolicyEvent(event *tcglog.Event) bool {
+	switch event.EventType {
+	case tcglog.EventTypeSeparator, tcglog.EventTypeEFIAction, tcglog.EventTypeEFIVariableDriverConfig, tcglog.EventTypeEFIVariableAuthority:
+		return true
+	default:
+		return false
+	}
+}
+
 // isShimExecutable determines if the EFI executable read from r looks like a valid shim binary (ie, it has a ".vendor_cert" section.
 func isShimExecutable(r io.ReaderAt) (bool, error) {
 	pefile, err := pe.NewFile(r)
@@ -618,24 +538,176 @@ type EFISecureBootPolicyProfileParams struct {
 	// SignatureDbUpdateKeystores is a list of directories containing EFI signature database updates for which to compute PCR digests
 	// for. These directories are passed to sbkeysync using the --keystore option.
 	SignatureDbUpdateKeystores []string
+
+	// UnrecognizedEventHandler is called for each event in PCR 7 that isn't defined by the "TCG PC Client Platform Firmware Profile
+	// Specification", such as vendor-specific events, in order to determine how it should be handled. If this is nil, these events
+	// are included in the profile as they appear in the TCG event log.
+	UnrecognizedEventHandler SecureBootPolicyEventHandler
+
+	// MaxBranches is the maximum number of branches that the computed profile is permitted to contain. The number of branches
+	// grows with the product of the number of pending signature database updates and the number of paths through LoadSequences,
+	// so large keystores or load sequences can produce very large profiles. If this is zero, no limit is applied.
+	MaxBranches int
+
+	// TPM is an optional connection to the TPM. If this is set, the TCG event log cached on it is used rather than reading and
+	// parsing the log again. See TPMConnection.EventLog.
+	TPM *TPMConnection
+
+	// Snapshot is an optional snapshot of a system, captured with CaptureSystemSnapshot. If this is set, the profile is computed
+	// from the EFI variables and TCG event log in the snapshot rather than from the current system, and TPM is ignored.
+	Snapshot *SystemSnapshot
+
+	// Progress is an optional callback used to report the progress of the profile computation.
+	Progress ProgressFunc
+}
+
+// EFISecureBootPolicyProfileStats contains statistics about the complexity of the secure boot policy profile that would be computed
+// by AddEFISecureBootPolicyProfile.
+type EFISecureBootPolicyProfileStats struct {
+	SignatureDbUpdates int // The number of pending signature database updates
+	LoadPaths          int // The number of distinct paths through the supplied image load sequences
+	Branches           int // The number of branches in the profile
+}
+
+func isSecureBootPolicyBranchLimitError(err error) bool {
+	_, ok := err.(SecureBootPolicyBranchLimitError)
+	return ok
+}
+
+// countEFIImageLoadPaths returns the number of distinct paths through the supplied image load sequences.
+func countEFIImageLoadPaths(events []*EFIImageLoadEvent) (n int) {
+	for _, e := range events {
+		if len(e.Next) == 0 {
+			n++
+			continue
+		}
+		n += countEFIImageLoadPaths(e.Next)
+	}
+	return
+}
+
+func newEFISecureBootPolicyProfileStats(loadSequences []*EFIImageLoadEvent, sigDbUpdates []*secureBootDbUpdate) *EFISecureBootPolicyProfileStats {
+	stats := &EFISecureBootPolicyProfileStats{
+		SignatureDbUpdates: len(sigDbUpdates),
+		LoadPaths:          countEFIImageLoadPaths(loadSequences)}
+	// There is a branch for each load path with each pending signature database update applied in turn, computed once for each
+	// of the supported signature database update quirk modes.
+	stats.Branches = (stats.SignatureDbUpdates + 1) * stats.LoadPaths * 2
+	return stats
 }
 
-// secureBootDb corresponds to a EFI signature database.
+// ComputeEFISecureBootPolicyProfileStats returns statistics about the complexity of the secure boot policy profile that would be
+// computed by AddEFISecureBootPolicyProfile with the supplied parameters, without computing the profile. This can be used to detect
+// combinations of signature database updates and image load sequences that would produce an excessively large profile.
+//
+// The returned branch count is the number of branches expected for images that are verified with a single, unambiguous chain of
+// trust. The actual number of branches may be larger if any images can be verified by more than one authority in the signature
+// database.
+//
+// The pending signature database updates are checked in the same way as they are by AddEFISecureBootPolicyProfile.
+func ComputeEFISecureBootPolicyProfileStats(params *EFISecureBootPolicyProfileParams) (*EFISecureBootPolicyProfileStats, error) {
+	efivarsPath, cleanup, err := params.Snapshot.efiVarsPath()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain EFI variables: %w", err)
+	}
+	defer cleanup()
+
+	sigDbUpdates, err := buildSignatureDbUpdateList(efivarsPath, params.SignatureDbUpdateKeystores)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot build list of UEFI signature DB updates: %w", err)
+	}
+	return newEFISecureBootPolicyProfileStats(params.LoadSequences, sigDbUpdates), nil
+}
+
+// SecureBootPolicyEventAction describes how an unrecognized event in PCR 7 should be handled when computing a secure boot policy
+// profile.
+type SecureBootPolicyEventAction int
+
+const (
+	// ReproduceSecureBootPolicyEvent indicates that the event will be measured with the same digest on future boots, and should be
+	// included in the profile as it appears in the TCG event log.
+	ReproduceSecureBootPolicyEvent SecureBootPolicyEventAction = iota
+
+	// IgnoreSecureBootPolicyEvent indicates that the event won't be measured on future boots, and should be omitted from the
+	// profile.
+	IgnoreSecureBootPolicyEvent
+
+	// RejectSecureBootPolicyEvent indicates that the future measurement of the event can't be predicted, and that computation of
+	// the profile should fail.
+	RejectSecureBootPolicyEvent
+)
+
+// SecureBootPolicyEventHandler is a callback used to classify events in PCR 7 that aren't understood by
+// AddEFISecureBootPolicyProfile and AddEFICurrentBootSecureBootPolicyProfile.
+type SecureBootPolicyEventHandler func(event *tcglog.Event) SecureBootPolicyEventAction
+
+// secureBootDb corresponds to a EFI signature database. Instances may be shared between branches and must not be modified once
+// created.
 type secureBootDb struct {
 	variableName tcglog.EFIGUID
 	unicodeName  string
-	signatures   []*efiSignatureData
+	signatures   []*sbefi.SignatureData
+}
+
+// containsX509Certificate determines whether this database contains the supplied DER encoded X509 certificate.
+func (d *secureBootDb) containsX509Certificate(cert []byte) bool {
+	if d == nil {
+		return false
+	}
+	for _, sig := range d.signatures {
+		if sig.Type == efiCertX509Guid && bytes.Equal(sig.Data, cert) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsImageDigest determines whether this database contains the Authenticode digest of the image with the supplied digests.
+// Only the SHA-1 and SHA-256 digests are considered, as these are the only ones that shim checks.
+func (d *secureBootDb) containsImageDigest(digests *peImageDigests) bool {
+	if d == nil || digests == nil {
+		return false
+	}
+	for _, sig := range d.signatures {
+		switch {
+		case sig.Type == efiCertSHA1Guid && bytes.Equal(sig.Data, digests.sha1):
+			return true
+		case sig.Type == efiCertSHA256Guid && bytes.Equal(sig.Data, digests.sha256):
+			return true
+		}
+	}
+	return false
+}
+
+// hasImageDigests determines whether this database contains any Authenticode image digests.
+func (d *secureBootDb) hasImageDigests() bool {
+	if d == nil {
+		return false
+	}
+	for _, sig := range d.signatures {
+		if sig.Type == efiCertSHA1Guid || sig.Type == efiCertSHA256Guid {
+			return true
+		}
+	}
+	return false
+}
+
+// peImageDigests contains the Authenticode digests of a PE image.
+type peImageDigests struct {
+	sha1   []byte
+	sha256 []byte
 }
 
 // secureBootDbSet corresponds to a set of EFI signature databases.
 type secureBootDbSet struct {
-	uefiDb *secureBootDb
-	mokDb  *secureBootDb
-	shimDb *secureBootDb
+	uefiDb  *secureBootDb
+	mokDb   *secureBootDb
+	shimDb  *secureBootDb
+	shimDbx *secureBootDb
 }
 
 type secureBootAuthority struct {
-	signature *efiSignatureData
+	signature *sbefi.SignatureData
 	source    *secureBootDb
 }
 
@@ -651,8 +723,100 @@ type secureBootPolicyGen struct {
 	loadSequences []*EFIImageLoadEvent
 
 	events                     []*tcglog.Event
+	platform                   *efiPlatform // The conventions used by the firmware that produced events
 	initialOSVerificationEvent *secureBootVerificationEvent
 	sigDbUpdates               []*secureBootDbUpdate
+
+	unrecognizedEventHandler SecureBootPolicyEventHandler
+
+	efivarsPath string
+
+	sigDbCache map[sigDbCacheKey]*sigDbCacheEntry
+
+	maxBranches int                              // The maximum number of branches, or zero for no limit
+	stats       *EFISecureBootPolicyProfileStats // Reported if the limit is exceeded
+}
+
+// sigDbCacheKey identifies the contents of an EFI signature database with some pending updates applied.
+type sigDbCacheKey struct {
+	name      string
+	level     int // the number of entries from secureBootPolicyGen.sigDbUpdates that have been considered
+	quirkMode sbefi.DbUpdateQuirkMode
+}
+
+// sigDbCacheEntry contains the contents of an EFI signature database with some pending updates applied, along with its
+// measurement digest and decoded signatures once these have been computed. Entries are shared between all branches that
+// measure the same contents, and between consecutive levels if an update doesn't modify the database, so they must not be
+// modified once the digest or decoded signatures have been computed.
+type sigDbCacheEntry struct {
+	data   []byte
+	digest tpm2.Digest
+	db     *secureBootDb
+}
+
+// decode returns the signatures in this database, decoding them the first time that it is called.
+func (e *sigDbCacheEntry) decode(variableName tcglog.EFIGUID, unicodeName string) (*secureBootDb, error) {
+	if e.db != nil {
+		return e.db, nil
+	}
+
+	sigs, err := sbefi.DecodeSignatureDatabase(bytes.NewReader(e.data))
+	if err != nil {
+		return nil, err
+	}
+	e.db = &secureBootDb{variableName: variableName, unicodeName: unicodeName, signatures: sigs}
+	return e.db, nil
+}
+
+// signatureDbContents returns the contents of the specified EFI signature database with the first level pending updates from
+// sigDbUpdates applied. Each level is computed from the previous one and the results are cached, so that each update is only
+// applied once for each database and quirk mode rather than once for every branch that includes it.
+func (g *secureBootPolicyGen) signatureDbContents(name, filename string, level int, quirkMode sbefi.DbUpdateQuirkMode) (*sigDbCacheEntry, error) {
+	key := sigDbCacheKey{name: name, level: level, quirkMode: quirkMode}
+	if e, ok := g.sigDbCache[key]; ok {
+		return e, nil
+	}
+
+	var e *sigDbCacheEntry
+	if level == 0 {
+		db, err := ioutil.ReadFile(filepath.Join(g.efivarsPath, filename))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, xerrors.Errorf("cannot read current variable: %w", err)
+		}
+		if len(db) > 0 {
+			if len(db) < 4 {
+				return nil, errors.New("current variable data is too short")
+			}
+			// Skip over the 4-byte attribute field
+			db = db[4:]
+		}
+		e = &sigDbCacheEntry{data: db}
+	} else {
+		prev, err := g.signatureDbContents(name, filename, level-1, quirkMode)
+		if err != nil {
+			return nil, err
+		}
+		e = prev
+
+		if u := g.sigDbUpdates[level-1]; u.db == name {
+			f, err := os.Open(u.path)
+			if err != nil {
+				return nil, xerrors.Errorf("cannot open signature DB update: %w", err)
+			}
+			defer f.Close()
+			db, err := sbefi.ComputeDbUpdate(bytes.NewReader(prev.data), f, quirkMode)
+			if err != nil {
+				return nil, xerrors.Errorf("cannot compute signature DB update for %s: %w", u.path, err)
+			}
+			e = &sigDbCacheEntry{data: db}
+		}
+	}
+
+	if g.sigDbCache == nil {
+		g.sigDbCache = make(map[sigDbCacheKey]*sigDbCacheEntry)
+	}
+	g.sigDbCache[key] = e
+	return e, nil
 }
 
 // secureBootPolicyGenBranch represents a branch of a PCRProtectionProfile. It contains its own PCRProtectionProfile in to which
@@ -664,6 +828,7 @@ type secureBootPolicyGenBranch struct {
 	subBranches []*secureBootPolicyGenBranch // Sub-branches, if this has been branched
 
 	dbUpdateLevel              int             // The number of EFI signature database updates applied in this branch
+	pendingSeparator           tpm2.Digest     // The PCR 7 EV_SEPARATOR digest to extend after the initial OS verification event, if any
 	dbSet                      secureBootDbSet // The signature database set associated with this branch
 	firmwareVerificationEvents tpm2.DigestList // The verification events recorded by firmware in this branch
 	shimVerificationEvents     tpm2.DigestList // The verification events recorded by shim in this branch
@@ -678,6 +843,7 @@ func (b *secureBootPolicyGenBranch) branch() *secureBootPolicyGenBranch {
 
 	// Preserve the context associated with this branch
 	c.dbUpdateLevel = b.dbUpdateLevel
+	c.pendingSeparator = b.pendingSeparator
 	c.dbSet = b.dbSet
 	c.firmwareVerificationEvents = make(tpm2.DigestList, len(b.firmwareVerificationEvents))
 	copy(c.firmwareVerificationEvents, b.firmwareVerificationEvents)
@@ -715,59 +881,56 @@ func (b *secureBootPolicyGenBranch) extendFirmwareVerificationMeasurement(digest
 	b.extendVerificationMeasurement(digest, Firmware)
 }
 
-// omputeAndExtendVariableMeasurement computes a EFI variable measurement from the supplied arguments and extends that to
-// this branch.
-func (b *secureBootPolicyGenBranch) computeAndExtendVariableMeasurement(varName tcglog.EFIGUID, unicodeName string, varData []byte) error {
+// computeVariableMeasurement computes a EFI variable measurement from the supplied arguments.
+func (b *secureBootPolicyGenBranch) computeVariableMeasurement(varName tcglog.EFIGUID, unicodeName string, varData []byte) (tpm2.Digest, error) {
 	data := tcglog.EFIVariableData{
 		VariableName: varName,
 		UnicodeName:  unicodeName,
 		VariableData: varData}
 	h := b.gen.pcrAlgorithm.NewHash()
 	if err := data.EncodeMeasuredBytes(h); err != nil {
-		return xerrors.Errorf("cannot encode EFI_VARIABLE_DATA: %w", err)
+		return nil, xerrors.Errorf("cannot encode EFI_VARIABLE_DATA: %w", err)
+	}
+	return h.Sum(nil), nil
+}
+
+// computeAndExtendVariableMeasurement computes a EFI variable measurement from the supplied arguments and extends that to
+// this branch.
+func (b *secureBootPolicyGenBranch) computeAndExtendVariableMeasurement(varName tcglog.EFIGUID, unicodeName string, varData []byte) error {
+	digest, err := b.computeVariableMeasurement(varName, unicodeName, varData)
+	if err != nil {
+		return err
 	}
-	b.extendMeasurement(h.Sum(nil))
+	b.extendMeasurement(digest)
 	return nil
 }
 
 // processSignatureDbMeasurementEvent computes a EFI signature database measurement for the specified database and with the supplied
 // updates, and then extends that in to this branch.
-func (b *secureBootPolicyGenBranch) processSignatureDbMeasurementEvent(guid tcglog.EFIGUID, name, filename string, updates []*secureBootDbUpdate, updateQuirkMode sigDbUpdateQuirkMode) ([]byte, error) {
-	db, err := ioutil.ReadFile(filepath.Join(efi.EFIVarsPath, filename))
-	if err != nil && !os.IsNotExist(err) {
-		return nil, xerrors.Errorf("cannot read current variable: %w", err)
-	}
-	if len(db) > 0 {
-		if len(db) < 4 {
-			return nil, errors.New("current variable data is too short")
-		}
-		// Skip over the 4-byte attribute field
-		db = db[4:]
+//
+// The supplied updates must be a prefix of secureBootPolicyGen.sigDbUpdates. The database contents and measurement are shared with
+// other branches that apply the same updates.
+func (b *secureBootPolicyGenBranch) processSignatureDbMeasurementEvent(guid tcglog.EFIGUID, name, filename string, updates []*secureBootDbUpdate, updateQuirkMode sbefi.DbUpdateQuirkMode) (*sigDbCacheEntry, error) {
+	e, err := b.gen.signatureDbContents(name, filename, len(updates), updateQuirkMode)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, u := range updates {
-		if u.db != name {
-			continue
-		}
-		if f, err := os.Open(u.path); err != nil {
-			return nil, xerrors.Errorf("cannot open signature DB update: %w", err)
-		} else if d, err := computeDbUpdate(bytes.NewReader(db), f, updateQuirkMode); err != nil {
-			return nil, xerrors.Errorf("cannot compute signature DB update for %s: %w", u.path, err)
-		} else {
-			db = d
+	if e.digest == nil {
+		digest, err := b.computeVariableMeasurement(guid, name, e.data)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute and extend measurement: %w", err)
 		}
+		e.digest = digest
 	}
+	b.extendMeasurement(e.digest)
 
-	if err := b.computeAndExtendVariableMeasurement(guid, name, db); err != nil {
-		return nil, xerrors.Errorf("cannot compute and extend measurement: %w", err)
-	}
-
-	return db, nil
+	return e, nil
 }
 
 // processKEKMeasurementEvent computes a measurement of KEK with the supplied udates applied and then extends that in to
 // this branch.
-func (b *secureBootPolicyGenBranch) processKEKMeasurementEvent(updates []*secureBootDbUpdate, updateQuirkMode sigDbUpdateQuirkMode) error {
+func (b *secureBootPolicyGenBranch) processKEKMeasurementEvent(updates []*secureBootDbUpdate, updateQuirkMode sbefi.DbUpdateQuirkMode) error {
 	if _, err := b.processSignatureDbMeasurementEvent(efiGlobalVariableGuid, kekName, kekFilename, updates, updateQuirkMode); err != nil {
 		return err
 	}
@@ -778,25 +941,25 @@ func (b *secureBootPolicyGenBranch) processKEKMeasurementEvent(updates []*secure
 // then extends that in to this branch. The branch context is then updated to contain a list of signatures associated with the
 // resulting authorized signature database contents, which is used later on when computing verification events in
 // secureBootPolicyGen.computeAndExtendVerificationMeasurement.
-func (b *secureBootPolicyGenBranch) processDbMeasurementEvent(updates []*secureBootDbUpdate, updateQuirkMode sigDbUpdateQuirkMode) error {
-	db, err := b.processSignatureDbMeasurementEvent(efiImageSecurityDatabaseGuid, dbName, dbFilename, updates, updateQuirkMode)
+func (b *secureBootPolicyGenBranch) processDbMeasurementEvent(updates []*secureBootDbUpdate, updateQuirkMode sbefi.DbUpdateQuirkMode) error {
+	e, err := b.processSignatureDbMeasurementEvent(efiImageSecurityDatabaseGuid, dbName, dbFilename, updates, updateQuirkMode)
 	if err != nil {
 		return err
 	}
 
-	sigs, err := decodeSecureBootDb(bytes.NewReader(db))
+	// The decoded database is shared with every other branch that measures the same contents.
+	db, err := e.decode(efiImageSecurityDatabaseGuid, dbName)
 	if err != nil {
 		return xerrors.Errorf("cannot decode DB contents: %w", err)
 	}
-
-	b.dbSet.uefiDb = &secureBootDb{variableName: efiImageSecurityDatabaseGuid, unicodeName: dbName, signatures: sigs}
+	b.dbSet.uefiDb = db
 
 	return nil
 }
 
 // processDbxMeasurementEvent computes a measurement of the EFI forbidden signature database with the supplied updates applied and
 // then extends that in to this branch.
-func (b *secureBootPolicyGenBranch) processDbxMeasurementEvent(updates []*secureBootDbUpdate, updateQuirkMode sigDbUpdateQuirkMode) error {
+func (b *secureBootPolicyGenBranch) processDbxMeasurementEvent(updates []*secureBootDbUpdate, updateQuirkMode sbefi.DbUpdateQuirkMode) error {
 	if _, err := b.processSignatureDbMeasurementEvent(efiImageSecurityDatabaseGuid, dbxName, dbxFilename, updates, updateQuirkMode); err != nil {
 		return err
 	}
@@ -809,7 +972,7 @@ func (b *secureBootPolicyGenBranch) processDbxMeasurementEvent(updates []*secure
 //
 // Processing of the list of events stops when the verification event associated with the loading of the initial OS EFI executable
 // is encountered.
-func (b *secureBootPolicyGenBranch) processPreOSEvents(events []*tcglog.Event, initialOSVerificationEvent *secureBootVerificationEvent, sigDbUpdates []*secureBootDbUpdate, sigDbUpdateQuirkMode sigDbUpdateQuirkMode) error {
+func (b *secureBootPolicyGenBranch) processPreOSEvents(events []*tcglog.Event, initialOSVerificationEvent *secureBootVerificationEvent, sigDbUpdates []*secureBootDbUpdate, sigDbUpdateQuirkMode sbefi.DbUpdateQuirkMode) error {
 	for len(events) > 0 && events[0] != initialOSVerificationEvent.Event {
 		e := events[0]
 		events = events[1:]
@@ -828,7 +991,13 @@ func (b *secureBootPolicyGenBranch) processPreOSEvents(events []*tcglog.Event, i
 			}
 		case isVerificationEvent(e):
 			b.extendFirmwareVerificationMeasurement(tpm2.Digest(e.Digests[tcglog.AlgorithmId(b.gen.pcrAlgorithm)]))
-		case e.PCRIndex == secureBootPCR:
+		case e.PCRIndex != secureBootPCR || e.EventType == tcglog.EventTypeNoAction:
+			// Not measured to PCR 7
+		case !isRecognizedSecureBootPolicyEvent(e):
+			if err := b.processUnrecognizedEvent(e); err != nil {
+				return xerrors.Errorf("cannot process unrecognized event: %w", err)
+			}
+		default:
 			b.extendMeasurement(tpm2.Digest(e.Digests[tcglog.AlgorithmId(b.gen.pcrAlgorithm)]))
 		}
 	}
@@ -837,6 +1006,17 @@ func (b *secureBootPolicyGenBranch) processPreOSEvents(events []*tcglog.Event, i
 		return nil
 	}
 
+	if b.gen.platform.secureBootSeparatorDeferred {
+		// The PCR 7 EV_SEPARATOR event is recorded after the verification of the initial OS image, so it needs to be extended
+		// after the verification event for the first image in each load sequence has been computed.
+		for _, e := range events[1:] {
+			if b.gen.platform.isSecureBootSeparator(e) {
+				b.pendingSeparator = tpm2.Digest(e.Digests[tcglog.AlgorithmId(b.gen.pcrAlgorithm)])
+				break
+			}
+		}
+	}
+
 	if !initialOSVerificationEvent.measuredInPreOS {
 		return nil
 	}
@@ -848,13 +1028,30 @@ func (b *secureBootPolicyGenBranch) processPreOSEvents(events []*tcglog.Event, i
 	return nil
 }
 
-// processShimExecutableLaunch updates the context in this branch with the supplied shim vendor certificate so that it can be used
+// processUnrecognizedEvent handles an event in PCR 7 that isn't defined by the "TCG PC Client Platform Firmware Profile
+// Specification", according to the handler supplied by the caller. By default, the event is extended to this branch as it
+// appears in the TCG event log.
+func (b *secureBootPolicyGenBranch) processUnrecognizedEvent(e *tcglog.Event) error {
+	action := ReproduceSecureBootPolicyEvent
+	if b.gen.unrecognizedEventHandler != nil {
+		action = b.gen.unrecognizedEventHandler(e)
+	}
+
+	switch action {
+	case ReproduceSecureBootPolicyEvent:
+		b.extendMeasurement(tpm2.Digest(e.Digests[tcglog.AlgorithmId(b.gen.pcrAlgorithm)]))
+	case IgnoreSecureBootPolicyEvent:
+	default:
+		return fmt.Errorf("%v event was rejected", e.EventType)
+	}
+	return nil
+}
+
+// processShimExecutableLaunch updates the context in this branch with the supplied shim vendor databases so that they can be used
 // later on when computing verification events in secureBootPolicyGenBranch.computeAndExtendVerificationMeasurement.
-func (b *secureBootPolicyGenBranch) processShimExecutableLaunch(vendorCert []byte) {
-	b.dbSet.shimDb = &secureBootDb{variableName: shimGuid, unicodeName: shimName}
-	if vendorCert != nil {
-		b.dbSet.shimDb.signatures = append(b.dbSet.shimDb.signatures, &efiSignatureData{signatureType: efiCertX509Guid, data: vendorCert})
-	}
+func (b *secureBootPolicyGenBranch) processShimExecutableLaunch(vendorDb, vendorDbx *secureBootDb) {
+	b.dbSet.shimDb = vendorDb
+	b.dbSet.shimDbx = vendorDbx
 	b.shimVerificationEvents = nil
 }
 
@@ -876,83 +1073,85 @@ func (b *secureBootPolicyGenBranch) hasVerificationEventBeenMeasuredBy(digest tp
 	return false
 }
 
-// computeAndExtendVerificationMeasurement computes a measurement for the the authentication of an EFI image using the supplied
-// signatures and extends that in to this branch. If the computed measurement has already been measured by the specified source, then
-// it will not be measured again.
-//
-// In order to compute the measurement, the CA certificate that will be used to authenticate the image using the supplied signatures,
-// and the source of that certificate, needs to be determined. If the image is not signed with an authority that is trusted by a CA
-// certificate that exists in this branch, then this branch will be marked as unbootable and it will be omitted from the final PCR
-// profile.
-func (b *secureBootPolicyGenBranch) computeAndExtendVerificationMeasurement(sigs []*authenticodeSignerAndIntermediates, source EFIImageLoadEventSource) error {
-	if b.profile == nil {
-		// This branch is going to be excluded because it is unbootable.
-		return nil
-	}
+// findAuthority determines the CA certificate that will be used to authenticate an image with the supplied signatures, from the
+// supplied databases. If sigsFirst is true, this assumes that the signatures are iterated over in the order in which they appear in
+// the binary in an outer loop, with iteration over the CA certificates occurring in an inner loop. This behaviour isn't defined in
+// the UEFI specification but it matches EDK2 and the firmware on the Intel NUC. If sigsFirst is false, this assumes that the CA
+// certificates are iterated over in an outer loop instead.
+func (b *secureBootPolicyGenBranch) findAuthority(sigs []*authenticodeSignerAndIntermediates, dbs []*secureBootDb, source EFIImageLoadEventSource, sigsFirst bool) *secureBootAuthority {
+	isTrustedBy := func(sig *authenticodeSignerAndIntermediates, caSig *sbefi.SignatureData) bool {
+		// Ignore signatures that aren't X509 certificates
+		if caSig.Type != efiCertX509Guid {
+			return false
+		}
 
-	dbs := []*secureBootDb{b.dbSet.uefiDb}
-	if source == Shim {
-		if b.dbSet.shimDb == nil {
-			return errors.New("shim specified as event source without a shim executable appearing in preceding events")
+		if source == Shim && (b.dbSet.shimDbx.containsX509Certificate(sig.signer.Raw) || b.dbSet.shimDbx.containsX509Certificate(caSig.Data)) {
+			// Shim won't authenticate an image with a signer or CA that is in its vendor_dbx.
+			return false
+		}
+
+		ca, err := x509.ParseCertificate(caSig.Data)
+		if err != nil {
+			return false
 		}
-		dbs = append(dbs, b.dbSet.mokDb, b.dbSet.shimDb)
-	}
 
-	var authority *secureBootAuthority
+		// XXX: This doesn't work if there isn't a direct relationship between the
+		// signing certificate and the CA (ie, there are intermediates). Ideally we
+		// would use x509.Certificate.Verify here, but there is no way to turn off
+		// time checking and UEFI doesn't consider expired certificates invalid.
+		if bytes.Equal(ca.Raw, sig.signer.Raw) {
+			// The signer certificate is the CA
+			return true
+		}
+		if err := sig.signer.CheckSignatureFrom(ca); err == nil {
+			// The signer certificate is directly trusted by the CA
+			return true
+		}
+		return false
+	}
 
-	// To determine what CA certificate will be used to authenticate this image, iterate over the signatures in the order in which they
-	// appear in the binary in this outer loop. Iterating over the CA certificates occurs in an inner loop. This behaviour isn't defined
-	// in the UEFI specification but it matches EDK2 and the firmware on the Intel NUC. If an implementation iterates over the CA
-	// certificates in an outer loop and the signatures in an inner loop, then this may produce the wrong result.
-Outer:
-	for _, sig := range sigs {
+	if sigsFirst {
+		for _, sig := range sigs {
+			for _, db := range dbs {
+				if db == nil {
+					continue
+				}
+				for _, caSig := range db.signatures {
+					if isTrustedBy(sig, caSig) {
+						return &secureBootAuthority{signature: caSig, source: db}
+					}
+				}
+			}
+		}
+	} else {
 		for _, db := range dbs {
 			if db == nil {
 				continue
 			}
-
 			for _, caSig := range db.signatures {
-				// Ignore signatures that aren't X509 certificates
-				if caSig.signatureType != efiCertX509Guid {
-					continue
-				}
-
-				ca, err := x509.ParseCertificate(caSig.data)
-				if err != nil {
-					continue
-				}
-
-				// XXX: This doesn't work if there isn't a direct relationship between the
-				// signing certificate and the CA (ie, there are intermediates). Ideally we
-				// would use x509.Certificate.Verify here, but there is no way to turn off
-				// time checking and UEFI doesn't consider expired certificates invalid.
-				if bytes.Equal(ca.Raw, sig.signer.Raw) {
-					// The signer certificate is the CA
-					authority = &secureBootAuthority{signature: caSig, source: db}
-					break Outer
-				}
-				if err := sig.signer.CheckSignatureFrom(ca); err == nil {
-					// The signer certificate is directly trusted by the CA
-					authority = &secureBootAuthority{signature: caSig, source: db}
-					break Outer
+				for _, sig := range sigs {
+					if isTrustedBy(sig, caSig) {
+						return &secureBootAuthority{signature: caSig, source: db}
+					}
 				}
 			}
 		}
 	}
 
-	if authority == nil {
-		// Mark this branch as unbootable by clearing its PCR profile
-		b.profile = nil
-		return nil
-	}
+	return nil
+}
 
+// extendAuthorityMeasurement computes a measurement for the authentication of an EFI image by the supplied authority and extends
+// that in to this branch. If the computed measurement has already been measured by the specified source, then it will not be
+// measured again.
+func (b *secureBootPolicyGenBranch) extendAuthorityMeasurement(authority *secureBootAuthority, source EFIImageLoadEventSource) error {
 	// Serialize authority certificate for measurement
 	var varData *bytes.Buffer
 	switch source {
 	case Firmware:
 		// Firmware measures the entire EFI_SIGNATURE_DATA, including the SignatureOwner
 		varData = new(bytes.Buffer)
-		if err := authority.signature.encode(varData); err != nil {
+		if err := authority.signature.Encode(varData); err != nil {
 			return xerrors.Errorf("cannot encode EFI_SIGNATURE_DATA for authority: %w", err)
 		}
 	case Shim:
@@ -972,13 +1171,84 @@ Outer:
 	digest := h.Sum(nil)
 
 	// Don't measure events that have already been measured
-	if b.hasVerificationEventBeenMeasuredBy(digest, source) {
-		return nil
+	if !b.hasVerificationEventBeenMeasuredBy(digest, source) {
+		b.extendVerificationMeasurement(digest, source)
+	}
+
+	if b.pendingSeparator != nil {
+		b.extendMeasurement(b.pendingSeparator)
+		b.pendingSeparator = nil
 	}
-	b.extendVerificationMeasurement(digest, source)
 	return nil
 }
 
+// computeAndExtendVerificationMeasurement computes a measurement for the the authentication of an EFI image using the supplied
+// signatures and extends that in to this branch. If the computed measurement has already been measured by the specified source, then
+// it will not be measured again.
+//
+// In order to compute the measurement, the CA certificate that will be used to authenticate the image using the supplied signatures,
+// and the source of that certificate, needs to be determined. If the image is not signed with an authority that is trusted by a CA
+// certificate that exists in this branch, then this branch will be marked as unbootable and it will be omitted from the final PCR
+// profile.
+//
+// If the image has multiple signatures (eg, it has been dual-signed during a CA transition) and the CA certificate that will be used
+// depends on the order in which the implementation iterates over the signatures and the CA certificates, then this branch is
+// branched and a measurement is computed for each possible CA certificate in its own sub-branch.
+//
+// If the image is loaded by shim and its digest is in shim's vendor_dbx, then this branch will be marked as unbootable. The digests
+// argument may be nil if none of the branches have a vendor_dbx that contains image digests.
+//
+// On success, the branches that subsequent events should be applied to are returned. This is either this branch, or its new
+// sub-branches.
+func (b *secureBootPolicyGenBranch) computeAndExtendVerificationMeasurement(sigs []*authenticodeSignerAndIntermediates, digests *peImageDigests,
+	source EFIImageLoadEventSource) ([]*secureBootPolicyGenBranch, error) {
+	if b.profile == nil {
+		// This branch is going to be excluded because it is unbootable.
+		return []*secureBootPolicyGenBranch{b}, nil
+	}
+
+	if source == Shim && b.dbSet.shimDbx.containsImageDigest(digests) {
+		// Shim won't load an image with a digest that is in its vendor_dbx, so mark this branch as unbootable.
+		b.profile = nil
+		return []*secureBootPolicyGenBranch{b}, nil
+	}
+
+	dbs := []*secureBootDb{b.dbSet.uefiDb}
+	if source == Shim {
+		if b.dbSet.shimDb == nil {
+			return nil, errors.New("shim specified as event source without a shim executable appearing in preceding events")
+		}
+		dbs = append(dbs, b.dbSet.mokDb, b.dbSet.shimDb)
+	}
+
+	authority := b.findAuthority(sigs, dbs, source, true)
+	if authority == nil {
+		// Mark this branch as unbootable by clearing its PCR profile
+		b.profile = nil
+		return []*secureBootPolicyGenBranch{b}, nil
+	}
+
+	if len(sigs) > 1 {
+		if alt := b.findAuthority(sigs, dbs, source, false); alt.signature != authority.signature {
+			// The CA certificate used to authenticate this image is ambiguous.
+			var out []*secureBootPolicyGenBranch
+			for _, a := range []*secureBootAuthority{authority, alt} {
+				sb := b.branch()
+				if err := sb.extendAuthorityMeasurement(a, source); err != nil {
+					return nil, err
+				}
+				out = append(out, sb)
+			}
+			return out, nil
+		}
+	}
+
+	if err := b.extendAuthorityMeasurement(authority, source); err != nil {
+		return nil, err
+	}
+	return []*secureBootPolicyGenBranch{b}, nil
+}
+
 // sbLoadEventAndBranches binds together a EFIImageLoadEvent and the branches that the event needs to be applied to.
 type sbLoadEventAndBranches struct {
 	event    *EFIImageLoadEvent
@@ -1003,11 +1273,18 @@ func (e *sbLoadEventAndBranches) branch(event *EFIImageLoadEvent) *sbLoadEventAn
 // In order to compute the measurement for each branch, the CA certificate that will be used to authenticate the image and the
 // source of that certificate needs to be determined. If the image is not signed with an authority that is trusted by a CA
 // certificate for a particular branch, then that branch will be marked as unbootable and it will be omitted from the final PCR
-// profile.
-func (g *secureBootPolicyGen) computeAndExtendVerificationMeasurement(branches []*secureBootPolicyGenBranch, r io.ReaderAt, source EFIImageLoadEventSource) error {
+// profile. If the CA certificate is ambiguous for a particular branch, then that branch will be branched (see
+// secureBootPolicyGenBranch.computeAndExtendVerificationMeasurement).
+//
+// If the image is loaded by shim, its Authenticode digests are computed and branches with a vendor_dbx that contains one of them
+// are marked as unbootable, as shim won't load the image.
+//
+// On success, the branches that subsequent events should be applied to are returned.
+func (g *secureBootPolicyGen) computeAndExtendVerificationMeasurement(branches []*secureBootPolicyGenBranch, r io.ReaderAt, size int64,
+	source EFIImageLoadEventSource) ([]*secureBootPolicyGenBranch, error) {
 	pefile, err := pe.NewFile(r)
 	if err != nil {
-		return xerrors.Errorf("cannot decode PE binary: %w", err)
+		return nil, xerrors.Errorf("cannot decode PE binary: %w", err)
 	}
 
 	// Obtain security directory entry from optional header
@@ -1018,11 +1295,11 @@ func (g *secureBootPolicyGen) computeAndExtendVerificationMeasurement(branches [
 	case *pe.OptionalHeader64:
 		dd = oh.DataDirectory[0:oh.NumberOfRvaAndSizes]
 	default:
-		return errors.New("cannot obtain security directory entry from PE binary: no optional header")
+		return nil, errors.New("cannot obtain security directory entry from PE binary: no optional header")
 	}
 
 	if len(dd) <= certTableIndex {
-		return errors.New("cannot obtain security directory entry from PE binary: invalid number of data directories")
+		return nil, errors.New("cannot obtain security directory entry from PE binary: invalid number of data directories")
 	}
 
 	// Create a reader for the security directory entry, which points to a WIN_CERTIFICATE struct
@@ -1044,32 +1321,32 @@ func (g *secureBootPolicyGen) computeAndExtendVerificationMeasurement(branches [
 			break
 		}
 
-		c, n, err := decodeWinCertificate(certReader)
+		c, n, err := sbefi.DecodeWinCertificate(certReader)
 		switch {
 		case err != nil:
-			return xerrors.Errorf("cannot decode WIN_CERTIFICATE from security directory entry of PE binary: %w", err)
-		case c.wCertificateType() != winCertTypePKCSSignedData:
-			return fmt.Errorf("unexpected value for WIN_CERTIFICATE.wCertificateType (0x%04x): not an Authenticode signature", c.wCertificateType())
+			return nil, xerrors.Errorf("cannot decode WIN_CERTIFICATE from security directory entry of PE binary: %w", err)
+		case c.CertificateType() != sbefi.WinCertTypePKCSSignedData:
+			return nil, fmt.Errorf("unexpected value for WIN_CERTIFICATE.wCertificateType (0x%04x): not an Authenticode signature", c.CertificateType())
 		}
 
 		read += n
 
 		// Decode the signature
-		p7, err := pkcs7.Parse(c.(*winCertificateAuthenticode).Data)
+		p7, err := pkcs7.Parse(c.(*sbefi.WinCertificateAuthenticode).Data)
 		if err != nil {
-			return xerrors.Errorf("cannot decode signature: %w", err)
+			return nil, xerrors.Errorf("cannot decode signature: %w", err)
 		}
 
 		// Grab the certificate of the signer
 		signer := p7.GetOnlySigner()
 		if signer == nil {
-			return errors.New("cannot obtain signer certificate from signature")
+			return nil, errors.New("cannot obtain signer certificate from signature")
 		}
 
 		// Reject any signature with a digest algorithm other than SHA256, as that's the only algorithm used for binaries we're
 		// expected to support, and therefore required by the UEFI implementation.
 		if !p7.Signers[0].DigestAlgorithm.Algorithm.Equal(oidSha256) {
-			return errors.New("signature has unexpected digest algorithm")
+			return nil, errors.New("signature has unexpected digest algorithm")
 		}
 
 		// Grab all of the certificates in the signature and populate an intermediates pool
@@ -1082,30 +1359,51 @@ func (g *secureBootPolicyGen) computeAndExtendVerificationMeasurement(branches [
 	}
 
 	if len(sigs) == 0 {
-		return errors.New("no Authenticode signatures")
+		return nil, errors.New("no Authenticode signatures")
+	}
+
+	// Only compute the image digests if they are needed, as this requires hashing the whole image.
+	var digests *peImageDigests
+	if source == Shim {
+		for _, b := range branches {
+			if !b.dbSet.shimDbx.hasImageDigests() {
+				continue
+			}
+			digests = new(peImageDigests)
+			if digests.sha1, err = sbefi.ComputePeImageDigest(crypto.SHA1, r, size); err != nil {
+				return nil, xerrors.Errorf("cannot compute SHA-1 digest of PE binary: %w", err)
+			}
+			if digests.sha256, err = sbefi.ComputePeImageDigest(crypto.SHA256, r, size); err != nil {
+				return nil, xerrors.Errorf("cannot compute SHA-256 digest of PE binary: %w", err)
+			}
+			break
+		}
 	}
 
+	var out []*secureBootPolicyGenBranch
 	for _, b := range branches {
-		if err := b.computeAndExtendVerificationMeasurement(sigs, source); err != nil {
-			return err
+		bs, err := b.computeAndExtendVerificationMeasurement(sigs, digests, source)
+		if err != nil {
+			return nil, err
 		}
+		out = append(out, bs...)
 	}
 
-	return nil
+	return out, nil
 }
 
-// processShimExecutableLaunch extracts the vendor certificate from the shim executable read from r, and then updates the specified
-// branches to contain a reference to the vendor certificate so that it can be used later on when computing verification events in
-// secureBootPolicyGen.computeAndExtendVerificationMeasurement for images that are authenticated by shim.
+// processShimExecutableLaunch extracts the vendor certificate or vendor_db and the vendor_dbx from the shim executable read from r,
+// and then updates the specified branches to contain a reference to them so that they can be used later on when computing
+// verification events in secureBootPolicyGen.computeAndExtendVerificationMeasurement for images that are authenticated by shim.
 func (g *secureBootPolicyGen) processShimExecutableLaunch(branches []*secureBootPolicyGenBranch, r io.ReaderAt) error {
-	// Extract this shim's vendor cert
-	vendorCert, err := readShimVendorCert(r)
+	// Extract this shim's vendor databases
+	vendorDb, vendorDbx, err := readShimVendorDbs(r)
 	if err != nil {
 		return xerrors.Errorf("cannot extract vendor certificate: %w", err)
 	}
 
 	for _, b := range branches {
-		b.processShimExecutableLaunch(vendorCert)
+		b.processShimExecutableLaunch(vendorDb, vendorDbx)
 	}
 
 	return nil
@@ -1113,43 +1411,60 @@ func (g *secureBootPolicyGen) processShimExecutableLaunch(branches []*secureBoot
 
 // processOSLoadEvent computes a measurement associated with the supplied image load event and extends this to the specified branches.
 // If the image load corresponds to shim, then some additional processing is performed to extract the included vendor certificate
-// (see secureBootPolicyGen.processShimExecutableLaunch).
-func (g *secureBootPolicyGen) processOSLoadEvent(branches []*secureBootPolicyGenBranch, event *EFIImageLoadEvent) error {
+// (see secureBootPolicyGen.processShimExecutableLaunch). On success, the branches that subsequent events should be applied to are
+// returned.
+func (g *secureBootPolicyGen) processOSLoadEvent(branches []*secureBootPolicyGenBranch, event *EFIImageLoadEvent) ([]*secureBootPolicyGenBranch, error) {
 	r, err := event.Image.Open()
 	if err != nil {
-		return xerrors.Errorf("cannot open image: %w", err)
+		return nil, xerrors.Errorf("cannot open image: %w", err)
 	}
 	defer r.Close()
 
 	isShim, err := isShimExecutable(r)
 	if err != nil {
-		return xerrors.Errorf("cannot determine image type: %w", err)
+		return nil, xerrors.Errorf("cannot determine image type: %w", err)
 	}
 
-	if err := g.computeAndExtendVerificationMeasurement(branches, r, event.Source); err != nil {
-		return xerrors.Errorf("cannot compute load verification event: %w", err)
+	branches, err = g.computeAndExtendVerificationMeasurement(branches, r, r.Size(), event.Source)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute load verification event: %w", err)
 	}
 
 	if !isShim {
-		return nil
+		return branches, nil
 	}
 
 	if err := g.processShimExecutableLaunch(branches, r); err != nil {
-		return xerrors.Errorf("cannot process shim executable: %w", err)
+		return nil, xerrors.Errorf("cannot process shim executable: %w", err)
 	}
 
-	return nil
+	return branches, nil
+}
+
+// checkBranchLimit returns a SecureBootPolicyBranchLimitError error if the specified number of branches exceeds the limit.
+func (g *secureBootPolicyGen) checkBranchLimit(branches int) error {
+	if g.maxBranches <= 0 || branches <= g.maxBranches {
+		return nil
+	}
+	stats := *g.stats
+	stats.Branches = branches
+	return SecureBootPolicyBranchLimitError{Stats: stats, Limit: g.maxBranches}
 }
 
-// run takes a TCG event log and builds a PCR profile from the supplied configuration (see EFISecureBootPolicyProfileParams)
-func (g *secureBootPolicyGen) run(profile *PCRProtectionProfile, sigDbUpdateQuirkMode sigDbUpdateQuirkMode) error {
+// run takes a TCG event log and builds a PCR profile from the supplied configuration (see EFISecureBootPolicyProfileParams). The
+// prevBranches argument is the number of branches in profiles computed by previous runs, which count towards the branch limit.
+func (g *secureBootPolicyGen) run(profile *PCRProtectionProfile, sigDbUpdateQuirkMode sbefi.DbUpdateQuirkMode, prevBranches int) (int, error) {
+	// Cached signature database contents are never shared between quirk modes, so release them once this profile has been
+	// computed rather than keeping them alive for the next run.
+	defer func() { g.sigDbCache = nil }()
+
 	// Process the pre-OS events for the current signature DB and then with each pending update applied
 	// in turn.
 	var roots []*secureBootPolicyGenBranch
 	for i := 0; i <= len(g.sigDbUpdates); i++ {
 		branch := &secureBootPolicyGenBranch{gen: g, profile: NewPCRProtectionProfile(), dbUpdateLevel: i}
 		if err := branch.processPreOSEvents(g.events, g.initialOSVerificationEvent, g.sigDbUpdates[0:i], sigDbUpdateQuirkMode); err != nil {
-			return xerrors.Errorf("cannot process pre-OS events from event log: %w", err)
+			return 0, xerrors.Errorf("cannot process pre-OS events from event log: %w", err)
 		}
 		roots = append(roots, branch)
 	}
@@ -1159,6 +1474,7 @@ func (g *secureBootPolicyGen) run(profile *PCRProtectionProfile, sigDbUpdateQuir
 
 	var loadEvents []*sbLoadEventAndBranches
 	var nextLoadEvents []*sbLoadEventAndBranches
+	completed := 0 // The number of bootable branches for complete load paths
 
 	if len(g.loadSequences) == 1 {
 		loadEvents = append(loadEvents, &sbLoadEventAndBranches{event: g.loadSequences[0], branches: roots})
@@ -1177,9 +1493,15 @@ func (g *secureBootPolicyGen) run(profile *PCRProtectionProfile, sigDbUpdateQuir
 		e := loadEvents[0]
 		loadEvents = loadEvents[1:]
 
-		if err := g.processOSLoadEvent(e.branches, e.event); err != nil {
-			return xerrors.Errorf("cannot process OS load event for %s: %w", e.event.Image, err)
+		branches, err := g.processOSLoadEvent(e.branches, e.event)
+		if err != nil {
+			return 0, xerrors.Errorf("cannot process OS load event for %s: %w", e.event.Image, err)
 		}
+		// Any branches created because of an ambiguous verification event need adding to the list of all branches.
+		for _, b := range e.branches {
+			allBranches = append(allBranches, b.subBranches...)
+		}
+		e.branches = branches
 
 		if len(e.event.Next) == 1 {
 			nextLoadEvents = append(nextLoadEvents, &sbLoadEventAndBranches{event: e.event.Next[0], branches: e.branches})
@@ -1191,17 +1513,45 @@ func (g *secureBootPolicyGen) run(profile *PCRProtectionProfile, sigDbUpdateQuir
 			}
 		}
 
+		// Enforce the branch limit as the profile is built rather than after, so that an ambiguous authority can't make this
+		// consume an unbounded amount of memory. Each bootable branch that hasn't been completed yet results in at least one
+		// branch in the final profile.
+		if len(e.event.Next) == 0 {
+			for _, b := range e.branches {
+				if b.profile != nil {
+					completed++
+				}
+			}
+		}
+		pending := prevBranches + completed
+		for _, events := range [][]*sbLoadEventAndBranches{loadEvents, nextLoadEvents} {
+			for _, le := range events {
+				for _, b := range le.branches {
+					if b.profile != nil {
+						pending++
+					}
+				}
+			}
+		}
+		if err := g.checkBranchLimit(pending); err != nil {
+			return 0, err
+		}
+
 		if len(loadEvents) == 0 {
 			loadEvents = nextLoadEvents
 			nextLoadEvents = nil
 		}
 	}
 
+	leaves := 0
 	for i := len(allBranches) - 1; i >= 0; i-- {
 		b := allBranches[i]
 
 		if len(b.subBranches) == 0 {
 			// This is a leaf branch
+			if b.profile != nil {
+				leaves++
+			}
 			continue
 		}
 
@@ -1237,12 +1587,76 @@ func (g *secureBootPolicyGen) run(profile *PCRProtectionProfile, sigDbUpdateQuir
 	}
 
 	if !validPathsForCurrentDb {
-		return errors.New("no bootable paths with current EFI signature database")
+		return 0, errors.New("no bootable paths with current EFI signature database")
 	}
 
 	profile.AddProfileOR(subProfiles...)
 
-	return nil
+	return leaves, nil
+}
+
+// readAndCheckSecureBootPolicyEventLog reads the TCG event log for the current boot and makes sure that it is suitable for computing
+// a secure boot policy profile for the specified PCR algorithm. If snapshot is not nil, the event log captured in it is used.
+// Otherwise, if tpm is not nil, the event log cached on it is used.
+func readAndCheckSecureBootPolicyEventLog(tpm *TPMConnection, snapshot *SystemSnapshot, alg tpm2.HashAlgorithmId) (*tcglog.Log, error) {
+	log, err := snapshot.readEventLog(tpm)
+	if err != nil {
+		return nil, err
+	}
+
+	if !log.Algorithms.Contains(tcglog.AlgorithmId(alg)) {
+		return nil, errors.New("cannot compute secure boot policy profile: the TCG event log does not have the requested algorithm")
+	}
+
+	platform := detectEFIPlatform(log.Events)
+
+	// Make sure that the current boot is sane.
+	for _, event := range log.Events {
+		switch event.PCRIndex {
+		case bootManagerCodePCR:
+			if event.EventType == tcglog.EventTypeEFIAction && event.Data.String() == returningFromEfiApplicationEvent {
+				// Firmware should record this event if an EFI application returns to the boot manager. Bail out if this happened because the policy might not make sense.
+				return nil, errors.New("cannot compute secure boot policy profile: the current boot was preceeded by a boot attempt to an EFI " +
+					"application that returned to the boot manager, without a reboot in between")
+			}
+		case secureBootPCR:
+			switch event.EventType {
+			case tcglog.EventTypeEFIVariableDriverConfig:
+				if err, isErr := event.Data.(error); isErr {
+					return nil, fmt.Errorf("%s secure boot policy event has invalid event data: %v", event.EventType, err)
+				}
+				efiVarData := event.Data.(*tcglog.EFIVariableData)
+				if efiVarData.VariableName == efiGlobalVariableGuid && efiVarData.UnicodeName == sbStateName {
+					if event.Index > 0 {
+						// The spec says that secure boot policy must be measured again if the system supports changing it before ExitBootServices
+						// without a reboot. But the policy we create won't make sense, so bail out
+						return nil, errors.New("cannot compute secure boot policy profile: secure boot configuration was modified after the initial " +
+							"configuration was measured, without performing a reboot")
+					}
+					enabled, err := platform.secureBootEnabled(efiVarData.VariableData)
+					switch {
+					case err != nil:
+						return nil, fmt.Errorf("%s secure boot policy event has invalid event data: %v", event.EventType, err)
+					case !enabled:
+						return nil, errors.New("cannot compute secure boot policy profile: the current boot was performed with secure boot disabled in firmware")
+					}
+				}
+			case tcglog.EventTypeEFIVariableAuthority:
+				if err, isErr := event.Data.(error); isErr {
+					return nil, fmt.Errorf("%s secure boot policy event has invalid event data: %v", event.EventType, err)
+				}
+				efiVarData := event.Data.(*tcglog.EFIVariableData)
+				if efiVarData.VariableName == shimGuid && efiVarData.UnicodeName == mokSbStateName {
+					// MokSBState is set to 0x01 if secure boot enforcement is disabled in shim. The variable is deleted when secure boot enforcement
+					// is enabled, so don't bother looking at the value here. It doesn't make a lot of sense to create a policy if secure boot
+					// enforcement is disabled in shim
+					return nil, errors.New("cannot compute secure boot policy profile: the current boot was performed with validation disabled in Shim")
+				}
+			}
+		}
+	}
+
+	return log, nil
 }
 
 // AddEFISecureBootPolicyProfile adds the UEFI secure boot policy profile to the provided PCR protection profile, in order to generate
@@ -1280,13 +1694,12 @@ func (g *secureBootPolicyGen) run(profile *PCRProtectionProfile, sigDbUpdateQuir
 // incorrect for binaries that have a signature that can be authenticated by more than one CA certificate. Note that the structure of
 // the signature database means that it can only really be iterated in one direction anyway.
 //
-// For images with multiple Authenticode signatures, this function assumes that the device's firmware will iterate over the signatures
-// in the order in which they appear in the binary's certificate table in an outer loop during image authentication (ie, for each
-// signature, attempt to authenticate the binary using one of the CA certificates). If a device's firmware iterates over the
-// authorized signature database in an outer loop instead (ie, for each CA certificate, attempt to authenticate the binary using one
-// of its signatures), then this function may generate a PCR profile that is incorrect for binaries that have multiple signatures
-// where both signers have a chain of trust to a different CA certificate but the signatures appear in a different order to which
-// their CA certificates are enrolled.
+// For images with multiple Authenticode signatures (eg, images that are dual-signed during a CA transition), the CA certificate used
+// for authentication depends on whether the device's firmware (or shim) iterates over the signatures in the order in which they
+// appear in the binary's certificate table in an outer loop (ie, for each signature, attempt to authenticate the binary using one of
+// the CA certificates), or whether it iterates over the signature databases in an outer loop (ie, for each CA certificate, attempt to
+// authenticate the binary using one of its signatures). Where these produce a different result, this function generates a PCR
+// profile that is valid for both.
 //
 // This function does not consider the contents of the forbidden signature database. This is most relevant for images with multiple
 // signatures. If an image has more than one signature where the signing certificates have chains of trust to different CA
@@ -1307,96 +1720,153 @@ func (g *secureBootPolicyGen) run(profile *PCRProtectionProfile, sigDbUpdateQuir
 // the SignatureDbUpdateKeystores field of the params argument. This function assumes that sbkeysync is executed with the
 // "--no-default-keystores" option. When there are pending updates in the specified directories, this function will generate a PCR
 // policy that is compatible with the current database contents and the database contents computed for each individual update.
-// Note that sbkeysync ignores errors when applying updates - if any of the pending updates don't apply for some reason, the generated
-// PCR profile will be invalid.
+// Note that sbkeysync ignores errors when applying updates. In order to avoid generating a PCR profile for updates that will never
+// apply, the authentication header of each pending update is verified against the current platform key and KEK database in the
+// same way that the firmware does, and a SignatureDbUpdateRejectedError error is returned if any of them would be rejected.
 //
 // For the most common case where there are no signature database updates pending in the specified keystore directories and each image
 // load event sequence corresponds to loads of images that are all verified with the same chain of trust, this is a complicated way of
 // adding a single PCR digest to the provided PCRProtectionProfile.
 func AddEFISecureBootPolicyProfile(profile *PCRProtectionProfile, params *EFISecureBootPolicyProfileParams) error {
-	// Load event log
-	eventLog, err := os.Open(efi.EventLogPath)
-	if err != nil {
-		return xerrors.Errorf("cannot open TCG event log: %w", err)
-	}
-	log, err := tcglog.ParseLog(eventLog, &tcglog.LogOptions{})
+	params.Progress.report("reading TCG event log", 0)
+	log, err := readAndCheckSecureBootPolicyEventLog(params.TPM, params.Snapshot, params.PCRAlgorithm)
 	if err != nil {
-		return xerrors.Errorf("cannot parse TCG event log: %w", err)
-	}
-
-	if !log.Algorithms.Contains(tcglog.AlgorithmId(params.PCRAlgorithm)) {
-		return errors.New("cannot compute secure boot policy profile: the TCG event log does not have the requested algorithm")
+		return err
 	}
 
-	// Make sure that the current boot is sane.
-	for _, event := range log.Events {
-		switch event.PCRIndex {
-		case bootManagerCodePCR:
-			if event.EventType == tcglog.EventTypeEFIAction && event.Data.String() == returningFromEfiApplicationEvent {
-				// Firmware should record this event if an EFI application returns to the boot manager. Bail out if this happened because the policy might not make sense.
-				return errors.New("cannot compute secure boot policy profile: the current boot was preceeded by a boot attempt to an EFI " +
-					"application that returned to the boot manager, without a reboot in between")
-			}
-		case secureBootPCR:
-			switch event.EventType {
-			case tcglog.EventTypeEFIVariableDriverConfig:
-				if err, isErr := event.Data.(error); isErr {
-					return fmt.Errorf("%s secure boot policy event has invalid event data: %v", event.EventType, err)
-				}
-				efiVarData := event.Data.(*tcglog.EFIVariableData)
-				if efiVarData.VariableName == efiGlobalVariableGuid && efiVarData.UnicodeName == sbStateName {
-					switch {
-					case event.Index > 0:
-						// The spec says that secure boot policy must be measured again if the system supports changing it before ExitBootServices
-						// without a reboot. But the policy we create won't make sense, so bail out
-						return errors.New("cannot compute secure boot policy profile: secure boot configuration was modified after the initial " +
-							"configuration was measured, without performing a reboot")
-					case efiVarData.VariableData[0] == 0x00:
-						return errors.New("cannot compute secure boot policy profile: the current boot was performed with secure boot disabled in firmware")
-					}
-				}
-			case tcglog.EventTypeEFIVariableAuthority:
-				if err, isErr := event.Data.(error); isErr {
-					return fmt.Errorf("%s secure boot policy event has invalid event data: %v", event.EventType, err)
-				}
-				efiVarData := event.Data.(*tcglog.EFIVariableData)
-				if efiVarData.VariableName == shimGuid && efiVarData.UnicodeName == mokSbStateName {
-					// MokSBState is set to 0x01 if secure boot enforcement is disabled in shim. The variable is deleted when secure boot enforcement
-					// is enabled, so don't bother looking at the value here. It doesn't make a lot of sense to create a policy if secure boot
-					// enforcement is disabled in shim
-					return errors.New("cannot compute secure boot policy profile: the current boot was performed with validation disabled in Shim")
-				}
-			}
-		}
+	efivarsPath, cleanup, err := params.Snapshot.efiVarsPath()
+	if err != nil {
+		return xerrors.Errorf("cannot obtain EFI variables: %w", err)
 	}
+	defer cleanup()
 
 	// Initialize the secure boot PCR to 0
 	profile.AddPCRValue(params.PCRAlgorithm, secureBootPCR, make(tpm2.Digest, params.PCRAlgorithm.Size()))
 
 	// Compute a list of pending EFI signature DB updates.
-	sigDbUpdates, err := buildSignatureDbUpdateList(params.SignatureDbUpdateKeystores)
+	params.Progress.report("checking signature database updates", 10)
+	sigDbUpdates, err := buildSignatureDbUpdateList(efivarsPath, params.SignatureDbUpdateKeystores)
 	if err != nil {
 		return xerrors.Errorf("cannot build list of UEFI signature DB updates: %w", err)
 	}
 
+	stats := newEFISecureBootPolicyProfileStats(params.LoadSequences, sigDbUpdates)
+	if params.MaxBranches > 0 && stats.Branches > params.MaxBranches {
+		return SecureBootPolicyBranchLimitError{Stats: *stats, Limit: params.MaxBranches}
+	}
+
 	// Find the verification event corresponding to the load of the first OS binary.
 	initialOSVerificationEvent, err := identifyInitialOSLaunchVerificationEvent(log.Events)
 	if err != nil {
 		return xerrors.Errorf("cannot identify initial OS launch verification event: %w", err)
 	}
 
-	gen := &secureBootPolicyGen{params.PCRAlgorithm, params.LoadSequences, log.Events, initialOSVerificationEvent, sigDbUpdates}
+	gen := &secureBootPolicyGen{params.PCRAlgorithm, params.LoadSequences, log.Events, detectEFIPlatform(log.Events),
+		initialOSVerificationEvent, sigDbUpdates, params.UnrecognizedEventHandler, efivarsPath, nil, params.MaxBranches, stats}
 
+	// Images with ambiguous authorities can create additional branches, so the limit is also checked while the profile is computed.
+	params.Progress.report("computing profile", 30)
 	profile1 := NewPCRProtectionProfile()
-	if err := gen.run(profile1, sigDbUpdateQuirkModeNone); err != nil {
+	branches1, err := gen.run(profile1, sbefi.DbUpdateQuirkModeNone, 0)
+	switch {
+	case isSecureBootPolicyBranchLimitError(err):
+		return err
+	case err != nil:
 		return xerrors.Errorf("cannot compute secure boot policy profile: %w", err)
 	}
 
+	params.Progress.report("computing profile", 65)
 	profile2 := NewPCRProtectionProfile()
-	if err := gen.run(profile2, sigDbUpdateQuirkModeDedupIgnoresOwner); err != nil {
+	branches2, err := gen.run(profile2, sbefi.DbUpdateQuirkModeDedupIgnoresOwner, branches1)
+	switch {
+	case isSecureBootPolicyBranchLimitError(err):
+		return err
+	case err != nil:
 		return xerrors.Errorf("cannot compute secure boot policy profile: %w", err)
 	}
 
+	stats.Branches = branches1 + branches2
+	if err := gen.checkBranchLimit(stats.Branches); err != nil {
+		return err
+	}
+
 	profile.AddProfileOR(profile1, profile2)
+	params.Progress.report("done", 100)
+	return nil
+}
+
+// EFICurrentBootSecureBootPolicyProfileParams provide the arguments to AddEFICurrentBootSecureBootPolicyProfile.
+type EFICurrentBootSecureBootPolicyProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// UnrecognizedEventHandler is called for each event in PCR 7 that isn't defined by the "TCG PC Client Platform Firmware Profile
+	// Specification". See EFISecureBootPolicyProfileParams.UnrecognizedEventHandler.
+	UnrecognizedEventHandler SecureBootPolicyEventHandler
+
+	// TPM is an optional connection to the TPM, from which the cached TCG event log is obtained. See
+	// EFISecureBootPolicyProfileParams.TPM.
+	TPM *TPMConnection
+
+	// Snapshot is an optional snapshot of a system from which to compute the profile. See EFISecureBootPolicyProfileParams.Snapshot.
+	Snapshot *SystemSnapshot
+}
+
+// AddEFICurrentBootSecureBootPolicyProfile adds a UEFI secure boot policy profile for PCR 7 to the provided PCR protection profile,
+// computed only from the current contents of the EFI signature database variables and the TCG event log for the current boot. Unlike
+// AddEFISecureBootPolicyProfile, this does not require any EFI image load sequences to be supplied - the verification events
+// recorded in the event log for the current boot are assumed to be the ones that will be recorded on subsequent boots.
+//
+// This is intended for simple deployments where PCR 7 is the only PCR used and the firmware is responsible for managing the secure
+// boot configuration. The generated profile is only valid for the boot chain and signature databases in use at the time that it
+// is computed, so the sealed key will need to be resealed after any update to the bootloader that changes the authorities used to
+// verify it, and after any update to the EFI signature databases.
+//
+// The same restrictions on the current boot apply as for AddEFISecureBootPolicyProfile. An error will be returned if the current
+// boot was performed with secure boot disabled.
+func AddEFICurrentBootSecureBootPolicyProfile(profile *PCRProtectionProfile, params *EFICurrentBootSecureBootPolicyProfileParams) error {
+	log, err := readAndCheckSecureBootPolicyEventLog(params.TPM, params.Snapshot, params.PCRAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	efivarsPath, cleanup, err := params.Snapshot.efiVarsPath()
+	if err != nil {
+		return xerrors.Errorf("cannot obtain EFI variables: %w", err)
+	}
+	defer cleanup()
+
+	// Initialize the secure boot PCR to 0
+	profile.AddPCRValue(params.PCRAlgorithm, secureBootPCR, make(tpm2.Digest, params.PCRAlgorithm.Size()))
+
+	gen := &secureBootPolicyGen{pcrAlgorithm: params.PCRAlgorithm, events: log.Events, platform: detectEFIPlatform(log.Events),
+		unrecognizedEventHandler: params.UnrecognizedEventHandler, efivarsPath: efivarsPath}
+	branch := &secureBootPolicyGenBranch{gen: gen, profile: profile}
+
+	for _, e := range log.Events {
+		switch {
+		case isKEKMeasurementEvent(e):
+			if err := branch.processKEKMeasurementEvent(nil, sbefi.DbUpdateQuirkModeNone); err != nil {
+				return xerrors.Errorf("cannot process KEK measurement event: %w", err)
+			}
+		case isDbMeasurementEvent(e):
+			if err := branch.processDbMeasurementEvent(nil, sbefi.DbUpdateQuirkModeNone); err != nil {
+				return xerrors.Errorf("cannot process db measurement event: %w", err)
+			}
+		case isDbxMeasurementEvent(e):
+			if err := branch.processDbxMeasurementEvent(nil, sbefi.DbUpdateQuirkModeNone); err != nil {
+				return xerrors.Errorf("cannot process dbx measurement event: %w", err)
+			}
+		case e.PCRIndex != secureBootPCR || e.EventType == tcglog.EventTypeNoAction:
+			// Not measured to PCR 7
+		case !isRecognizedSecureBootPolicyEvent(e):
+			if err := branch.processUnrecognizedEvent(e); err != nil {
+				return xerrors.Errorf("cannot process unrecognized event: %w", err)
+			}
+		default:
+			branch.extendMeasurement(tpm2.Digest(e.Digests[tcglog.AlgorithmId(params.PCRAlgorithm)]))
+		}
+	}
+
 	return nil
 }
@@ -24,11 +24,11 @@ import (
 	"crypto"
 	_ "crypto/sha1"
 	_ "crypto/sha256"
-	"crypto/x509"
 	"encoding/binary"
-	"io"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"testing"
@@ -36,52 +36,61 @@ import (
 	"github.com/canonical/go-tpm2"
 	"github.com/canonical/tcglog-parser"
 	. "github.com/snapcore/secboot"
+	sbefi "github.com/snapcore/secboot/efi"
 	"github.com/snapcore/secboot/internal/testutil"
 )
 
-func TestDecodeWinCertificate(t *testing.T) {
+func TestShimDbxContainsImageDigest(t *testing.T) {
+	f, err := os.Open("testdata/mockgrub1.efi.signed.shim")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+
+	sha1Digest, err := sbefi.ComputePeImageDigest(crypto.SHA1, f, fi.Size())
+	if err != nil {
+		t.Fatalf("ComputePeImageDigest failed: %v", err)
+	}
+	sha256Digest, err := sbefi.ComputePeImageDigest(crypto.SHA256, f, fi.Size())
+	if err != nil {
+		t.Fatalf("ComputePeImageDigest failed: %v", err)
+	}
+	other := make([]byte, len(sha256Digest))
+
 	for _, data := range []struct {
-		desc            string
-		path            string
-		offset          int64
-		expectedType    uint16
-		efiGuidCertType tcglog.EFIGUID
+		desc     string
+		sigs     []*sbefi.SignatureData
+		expected bool
 	}{
 		{
-			desc:            "AuthenticatedVariable",
-			path:            "testdata/updates1/dbx/MS-2016-08-08.bin",
-			offset:          16,
-			expectedType:    WinCertTypeEfiGuid,
-			efiGuidCertType: EFICertTypePkcs7Guid,
+			desc:     "SHA256",
+			sigs:     []*sbefi.SignatureData{{Type: sbefi.CertSHA256Guid, Data: other}, {Type: sbefi.CertSHA256Guid, Data: sha256Digest}},
+			expected: true,
+		},
+		{
+			desc:     "SHA1",
+			sigs:     []*sbefi.SignatureData{{Type: sbefi.CertSHA1Guid, Data: sha1Digest}},
+			expected: true,
+		},
+		{
+			desc: "NoMatch",
+			sigs: []*sbefi.SignatureData{{Type: sbefi.CertSHA256Guid, Data: other}},
+		},
+		{
+			desc: "WrongType",
+			sigs: []*sbefi.SignatureData{{Type: sbefi.CertX509Guid, Data: sha256Digest}},
+		},
+		{
+			desc: "Empty",
 		},
-		// TODO: Add test with signed EFI executable
 	} {
 		t.Run(data.desc, func(t *testing.T) {
-			f, err := os.Open(data.path)
-			if err != nil {
-				t.Fatalf("Open failed: %v", err)
-			}
-			defer f.Close()
-
-			f.Seek(data.offset, io.SeekStart)
-
-			cert, _, err := DecodeWinCertificate(f)
-			if err != nil {
-				t.Fatalf("DecodeWinCertificate failed: %v", err)
-			}
-
-			certType := GetWinCertificateType(cert)
-			if certType != data.expectedType {
-				t.Errorf("Unexpected type: %v", certType)
-			}
-
-			switch certType {
-			case WinCertTypePKCSSignedData:
-			case WinCertTypeEfiGuid:
-				c := cert.(*WinCertificateUefiGuid)
-				if c.CertType != data.efiGuidCertType {
-					t.Errorf("Unexpected WIN_CERTIFICATE_UEFI_GUID type: %v", c.CertType)
-				}
+			if ShimDbxContainsImageDigest(data.sigs, sha1Digest, sha256Digest) != data.expected {
+				t.Errorf("Unexpected result")
 			}
 		})
 	}
@@ -146,164 +155,56 @@ func TestReadShimVendorCert(t *testing.T) {
 	}
 }
 
-func TestDecodeSecureBootDb(t *testing.T) {
-	var (
-		microsoftOwnerGuid = tcglog.MakeEFIGUID(0x77fa9abd, 0x0359, 0x4d32, 0xbd60, [...]uint8{0x28, 0xf4, 0xe7, 0x8f, 0x78, 0x4b})
-
-		microsoftRootCAName = "CN=Microsoft Root Certificate Authority 2010,O=Microsoft Corporation,L=Redmond,ST=Washington,C=US"
-		microsoftPCASubject = "CN=Microsoft Windows Production PCA 2011,O=Microsoft Corporation,L=Redmond,ST=Washington,C=US"
-		microsoftPCASerial  = decodeHexStringT(t, "61077656000000000008")
-
-		microsoftThirdPartyRootCAName = "CN=Microsoft Corporation Third Party Marketplace Root,O=Microsoft Corporation,L=Redmond,ST=Washington,C=US"
-		microsoftCASubject            = "CN=Microsoft Corporation UEFI CA 2011,O=Microsoft Corporation,L=Redmond,ST=Washington,C=US"
-		microsoftCASerial             = decodeHexStringT(t, "6108d3c4000000000004")
-
-		testOwnerGuid = tcglog.MakeEFIGUID(0xd1b37b32, 0x172d, 0x4d2a, 0x909f, [...]uint8{0xc7, 0x80, 0x81, 0x50, 0x17, 0x86})
-	)
-
-	type certId struct {
-		issuer  string
-		subject string
-		serial  []byte
-		owner   tcglog.EFIGUID
+func TestReadShimVendorDbs(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.SkipNow()
 	}
+
 	for _, data := range []struct {
-		desc       string
-		path       string
-		certs      []certId
-		signatures int
+		desc     string
+		path     string
+		certHash []byte
 	}{
 		{
-			desc: "db1",
-			path: "testdata/efivars1/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
-			certs: []certId{
-				{
-					issuer:  microsoftRootCAName,
-					subject: microsoftPCASubject,
-					serial:  microsoftPCASerial,
-					owner:   microsoftOwnerGuid,
-				},
-				{
-					issuer:  microsoftThirdPartyRootCAName,
-					subject: microsoftCASubject,
-					serial:  microsoftCASerial,
-					owner:   microsoftOwnerGuid,
-				},
-			},
-			signatures: 2,
-		},
-		{
-			desc: "db2",
-			path: "testdata/efivars2/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
-			certs: []certId{
-				{
-					issuer:  microsoftRootCAName,
-					subject: microsoftPCASubject,
-					serial:  microsoftPCASerial,
-					owner:   microsoftOwnerGuid,
-				},
-				{
-					issuer:  microsoftThirdPartyRootCAName,
-					subject: microsoftCASubject,
-					serial:  microsoftCASerial,
-					owner:   microsoftOwnerGuid,
-				},
-				{
-					issuer:  "CN=Test Key Exchange Key",
-					subject: "CN=Test UEFI CA",
-					serial:  decodeHexStringT(t, "01"),
-					owner:   testOwnerGuid,
-				},
-			},
-			signatures: 3,
-		},
-		{
-			desc: "db3",
-			path: "testdata/efivars3/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
-			certs: []certId{
-				{
-					issuer:  microsoftRootCAName,
-					subject: microsoftPCASubject,
-					serial:  microsoftPCASerial,
-					owner:   microsoftOwnerGuid,
-				},
-				{
-					issuer:  microsoftThirdPartyRootCAName,
-					subject: microsoftCASubject,
-					serial:  microsoftCASerial,
-					owner:   microsoftOwnerGuid,
-				},
-				{
-					issuer:  "CN=Test Key Exchange Key",
-					subject: "CN=Test UEFI CA",
-					serial:  decodeHexStringT(t, "01"),
-					owner:   testOwnerGuid,
-				},
-				{
-					issuer:  "CN=Test Key Exchange Key",
-					subject: "CN=Test UEFI CA 2",
-					serial:  decodeHexStringT(t, "02"),
-					owner:   testOwnerGuid,
-				},
-			},
-			signatures: 4,
-		},
-		{
-			desc: "dbx1",
-			path: "testdata/efivars1/dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
-			certs: []certId{
-				{
-					issuer:  microsoftRootCAName,
-					subject: "CN=Microsoft Windows PCA 2010,O=Microsoft Corporation,L=Redmond,ST=Washington,C=US",
-					serial:  decodeHexStringT(t, "610c6a19000000000004"),
-					owner:   tcglog.MakeEFIGUID(0x00000000, 0x0000, 0x0000, 0x0000, [...]uint8{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}),
-				},
-			},
-			signatures: 78,
+			desc:     "WithVendorCert",
+			path:     "testdata/mockshim1.efi.signed.2",
+			certHash: decodeHexStringT(t, "9fc46ec43288967b862a5c12f13142325a6357746dd8195392fe1bf167e8b7ed"),
 		},
 		{
-			desc:       "dbx2",
-			path:       "testdata/efivars2/dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
-			signatures: 1,
+			desc: "NoVendorCert",
+			path: "testdata/mockshim.efi.signed.2",
 		},
 	} {
 		t.Run(data.desc, func(t *testing.T) {
-			d, err := ioutil.ReadFile(data.path)
+			f, err := os.Open(data.path)
 			if err != nil {
-				t.Fatalf("ReadFile failed: %v", err)
+				t.Fatalf("Open failed: %v", err)
 			}
+			defer f.Close()
 
-			signatures, err := DecodeSecureBootDb(bytes.NewReader(d[4:]))
+			name, dbSigs, dbxSigs, err := ReadShimVendorDbs(f)
 			if err != nil {
-				t.Fatalf("decodeSecureBootDb failed: %v", err)
+				t.Fatalf("ReadShimVendorDbs failed: %v", err)
 			}
-			if len(signatures) != data.signatures {
-				t.Fatalf("Unexpected number of signatures (got %d, expected %d)", len(signatures), data.signatures)
+			if name != "Shim" {
+				t.Errorf("Unexpected name: %s", name)
 			}
-			i := 0
-			for _, sig := range signatures {
-				if sig.SignatureType() != EFICertX509Guid {
-					continue
-				}
-
-				c, err := x509.ParseCertificate(sig.Data())
-				if err != nil {
-					t.Errorf("ParseCertificate failed: %v", err)
-				}
-
-				if sig.Owner() != data.certs[i].owner {
-					t.Errorf("Unexpected owner (got %s, expected %s)", sig.Owner(), data.certs[i].owner)
-				}
-				if c.Issuer.String() != data.certs[i].issuer {
-					t.Errorf("Unexpected issuer: %s", c.Issuer)
-				}
-				if c.Subject.String() != data.certs[i].subject {
-					t.Errorf("Unexpected subject: %s", c.Subject.String())
-				}
-				if !bytes.Equal(c.SerialNumber.Bytes(), data.certs[i].serial) {
-					t.Errorf("Unexpected serial number (got %x, expected %x)", c.SerialNumber.Bytes(), data.certs[i].serial)
+			if len(dbxSigs) > 0 {
+				t.Errorf("Unexpected vendor_dbx entries")
+			}
+			if data.certHash == nil {
+				if len(dbSigs) > 0 {
+					t.Errorf("ReadShimVendorDbs should have returned no signatures")
 				}
-				i++
+				return
+			}
+			if len(dbSigs) != 1 {
+				t.Fatalf("Unexpected number of signatures: %d", len(dbSigs))
+			}
+			h := crypto.SHA256.New()
+			h.Write(dbSigs[0])
+			if !bytes.Equal(h.Sum(nil), data.certHash) {
+				t.Errorf("Unexpected certificate hash (got %x)", h.Sum(nil))
 			}
 		})
 	}
@@ -368,123 +269,54 @@ func TestIdentifyInitialOSLaunchVerificationEvent(t *testing.T) {
 	}
 }
 
-func TestComputeDbUpdate(t *testing.T) {
-	for _, data := range []struct {
-		desc          string
-		orig          string
-		update        string
-		quirkMode     SigDbUpdateQuirkMode
-		sha1hash      []byte
-		newSignatures int
-	}{
-		{
-			desc:          "AppendOneCertToDb",
-			orig:          "testdata/efivars3/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
-			update:        "testdata/updates2/db/1.bin",
-			quirkMode:     SigDbUpdateQuirkModeNone,
-			sha1hash:      decodeHexStringT(t, "12669d032dd0c15a157a7af0df7b86f2e174344b"),
-			newSignatures: 1,
-		},
-		{
-			desc:      "AppendExistingCertToDb",
-			orig:      "testdata/efivars5/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
-			update:    "testdata/updates2/db/1.bin",
-			quirkMode: SigDbUpdateQuirkModeNone,
-			sha1hash:  decodeHexStringT(t, "12669d032dd0c15a157a7af0df7b86f2e174344b"),
-		},
-		{
-			desc:          "AppendMsDbxUpdate/1",
-			orig:          "testdata/efivars2/dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
-			update:        "testdata/updates1/dbx/MS-2016-08-08.bin",
-			quirkMode:     SigDbUpdateQuirkModeNone,
-			sha1hash:      decodeHexStringT(t, "96f7dc104ee34a0ce8425aac20f29e2b2aba9d7e"),
-			newSignatures: 77,
-		},
-		{
-			desc:          "AppendMsDbxUpdate/2",
-			orig:          "testdata/efivars2/dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
-			update:        "testdata/updates1/dbx/MS-2016-08-08.bin",
-			quirkMode:     SigDbUpdateQuirkModeDedupIgnoresOwner,
-			sha1hash:      decodeHexStringT(t, "96f7dc104ee34a0ce8425aac20f29e2b2aba9d7e"),
-			newSignatures: 77,
-		},
-		{
-			desc:          "AppendDbxUpdateWithDuplicateSignatures/1",
-			orig:          "testdata/efivars4/dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
-			update:        "testdata/updates3/dbx/1.bin",
-			quirkMode:     SigDbUpdateQuirkModeNone,
-			sha1hash:      decodeHexStringT(t, "b49564b2daee39b01b524bef75cf9cde2c3a2a0d"),
-			newSignatures: 2,
-		},
-		{
-			desc:          "AppendDbxUpdateWithDuplicateSignatures/2",
-			orig:          "testdata/efivars4/dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
-			update:        "testdata/updates3/dbx/1.bin",
-			quirkMode:     SigDbUpdateQuirkModeDedupIgnoresOwner,
-			sha1hash:      decodeHexStringT(t, "d2af590925046adc61b250a71f00b7b38d0eb3d1"),
-			newSignatures: 1,
-		},
-	} {
-		t.Run(data.desc, func(t *testing.T) {
-			orig, err := os.Open(data.orig)
-			if err != nil {
-				t.Fatalf("Open failed: %v", err)
-			}
-			defer orig.Close()
-			origReader := io.NewSectionReader(orig, 4, (1<<63)-5)
-			origSignatures, err := DecodeSecureBootDb(origReader)
-			if err != nil {
-				t.Errorf("DecodeSecureBootDb failed: %v", err)
-			}
-
-			update, err := os.Open(data.update)
-			if err != nil {
-				t.Fatalf("Open failed: %v", err)
-			}
-			defer update.Close()
-
-			db, err := ComputeDbUpdate(origReader, update, data.quirkMode)
-			if err != nil {
-				t.Fatalf("ComputeDbUpdate failed: %v", err)
-			}
-
-			// Ensure that an append was performed (ie, the original contents are unmofified)
-			origReader.Seek(0, io.SeekStart)
-			origDb, err := ioutil.ReadAll(origReader)
-			if err != nil {
-				t.Fatalf("ReadAll failed: %v", err)
-			}
-
-			if !bytes.Equal(origDb, db[:len(origDb)]) {
-				t.Errorf("ComputeDbUpdate didn't perform an append")
-			}
+func TestIdentifyInitialOSLaunchVerificationEventImageLoadBeforeSeparators(t *testing.T) {
+	f, err := os.Open("testdata/eventlog1.bin")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
 
-			// Ensure that the result is well formed
-			signatures, err := DecodeSecureBootDb(bytes.NewReader(db))
-			if err != nil {
-				t.Errorf("DecodeSecureBootDb failed: %v", err)
-			}
+	log, err := tcglog.ParseLog(f, &tcglog.LogOptions{})
+	if err != nil {
+		t.Fatalf("NewLog failed: %v", err)
+	}
 
-			// Check we got the expected number of new signatures
-			if (len(signatures) - len(origSignatures)) != data.newSignatures {
-				t.Errorf("Incorrect number of new signatures (got %d, expected %d)", len(signatures)-len(origSignatures), data.newSignatures)
-			}
+	// Reorder the events from eventlog1.bin so that the initial OS image and its verification are measured before the transition
+	// to OS-present, which is what U-Boot does.
+	verification := log.Events[24]
+	var load *tcglog.Event
+	for _, e := range log.Events {
+		if e.PCRIndex == 4 && e.EventType == tcglog.EventTypeEFIBootServicesApplication {
+			load = e
+			break
+		}
+	}
+	if load == nil {
+		t.Fatalf("No image load event")
+	}
 
-			// Lastly, verify the contents against a known good digest
-			h := crypto.SHA1.New()
-			var attrs uint32
-			if err := binary.Read(orig, binary.LittleEndian, &attrs); err != nil {
-				t.Fatalf("binary.Read failed: %v", err)
-			}
-			if err := binary.Write(h, binary.LittleEndian, attrs); err != nil {
-				t.Fatalf("binary.Write failed: %v", err)
-			}
-			h.Write(db)
+	var events []*tcglog.Event
+	inserted := false
+	for _, e := range log.Events {
+		if e == verification || e == load {
+			continue
+		}
+		if !inserted && e.EventType == tcglog.EventTypeSeparator {
+			events = append(events, verification, load)
+			inserted = true
+		}
+		events = append(events, e)
+	}
 
-			if !bytes.Equal(data.sha1hash, h.Sum(nil)) {
-				t.Errorf("Unexpected updated contents (sha1 got %x, expected %x)", h.Sum(nil), data.sha1hash)
-			}
-		})
+	event, err := IdentifyInitialOSLaunchVerificationEvent(events)
+	if err != nil {
+		t.Fatalf("IdentifyInitialOSLaunchVerificationEvent failed: %v", err)
+	}
+	if event.Event != verification {
+		t.Errorf("incorrect event detected")
+	}
+	if event.MeasuredInPreOS() {
+		t.Errorf("Detected pre-OS event")
 	}
 }
 
@@ -1443,3 +1275,521 @@ func TestAddEFISecureBootPolicyProfile(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckSignatureDbUpdatesAreAuthorized(t *testing.T) {
+	for _, data := range []struct {
+		desc    string
+		efivars string
+		updates map[string]string
+		err     string
+	}{
+		{
+			desc:    "DbxSignedByMicrosoftKEK",
+			efivars: "testdata/efivars2",
+			updates: map[string]string{"dbx": "testdata/updates1/dbx/MS-2016-08-08.bin"},
+		},
+		{
+			desc:    "DbSignedByTestKEK",
+			efivars: "testdata/efivars2",
+			updates: map[string]string{"db": "testdata/updates2/db/1.bin"},
+		},
+		{
+			desc:    "DbAuth3SignedByTestKEK",
+			efivars: "testdata/efivars2",
+			updates: map[string]string{"db": "testdata/updates6/db/1.bin"},
+		},
+		{
+			desc:    "Multiple",
+			efivars: "testdata/efivars2",
+			updates: map[string]string{
+				"db":  "testdata/updates4/db/1.bin",
+				"dbx": "testdata/updates4/dbx/MS-2016-08-08.bin"},
+		},
+		{
+			desc:    "DbSignedByUntrustedKey",
+			efivars: "testdata/efivars2",
+			updates: map[string]string{"db": "testdata/updates5/db/1.bin"},
+			err: "the update testdata/updates5/db/1.bin to db would be rejected by the firmware: signer certificate " +
+				"\"CN=Test UEFI CA\" is not trusted",
+		},
+		{
+			// The update is signed by a key in KEK, but KEK updates must be signed by the platform key.
+			desc:    "KEKSignedByKEK",
+			efivars: "testdata/efivars2",
+			updates: map[string]string{"KEK": "testdata/updates2/db/1.bin"},
+			err: "the update testdata/updates2/db/1.bin to KEK would be rejected by the firmware: invalid signature: " +
+				"crypto/rsa: verification error",
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			restoreEfivarsPath := testutil.MockEFIVarsPath(data.efivars)
+			defer restoreEfivarsPath()
+
+			err := CheckSignatureDbUpdatesAreAuthorized(data.updates)
+			if data.err != "" {
+				if err == nil {
+					t.Fatalf("Expected CheckSignatureDbUpdatesAreAuthorized to fail")
+				}
+				if _, ok := err.(SignatureDbUpdateRejectedError); !ok {
+					t.Errorf("Unexpected error type: %T", err)
+				}
+				if err.Error() != data.err {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("CheckSignatureDbUpdatesAreAuthorized failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestSignatureDbCacheIsNotModified(t *testing.T) {
+	efivars := "testdata/efivars2"
+	updates := []SignatureDbUpdate{
+		{Db: "dbx", Path: "testdata/updates1/dbx/MS-2016-08-08.bin"},
+		{Db: "db", Path: "testdata/updates2/db/1.bin"},
+		{Db: "dbx", Path: "testdata/updates3/dbx/1.bin"}}
+
+	for _, quirkMode := range []sbefi.DbUpdateQuirkMode{sbefi.DbUpdateQuirkModeNone, sbefi.DbUpdateQuirkModeDedupIgnoresOwner} {
+		for _, db := range []struct {
+			name     string
+			filename string
+		}{
+			{name: "db", filename: "db-d719b2cb-3d3a-4596-a3bc-dad00e67656f"},
+			{name: "dbx", filename: "dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f"},
+		} {
+			t.Run(fmt.Sprintf("%s/%d", db.name, quirkMode), func(t *testing.T) {
+				// Compute the contents of the database at each level without sharing anything between levels.
+				data, err := ioutil.ReadFile(filepath.Join(efivars, db.filename))
+				if err != nil {
+					t.Fatalf("ReadFile failed: %v", err)
+				}
+				data = data[4:]
+				expected := [][]byte{data}
+				for _, u := range updates {
+					if u.Db == db.name {
+						f, err := os.Open(u.Path)
+						if err != nil {
+							t.Fatalf("Open failed: %v", err)
+						}
+						data, err = sbefi.ComputeDbUpdate(bytes.NewReader(data), f, quirkMode)
+						f.Close()
+						if err != nil {
+							t.Fatalf("ComputeDbUpdate failed: %v", err)
+						}
+					}
+					expected = append(expected, data)
+				}
+
+				var expectedSigs [][]*sbefi.SignatureData
+				for _, data := range expected {
+					sigs, err := sbefi.DecodeSignatureDatabase(bytes.NewReader(data))
+					if err != nil {
+						t.Fatalf("DecodeSignatureDatabase failed: %v", err)
+					}
+					expectedSigs = append(expectedSigs, sigs)
+				}
+
+				cache := NewSignatureDbCache(efivars, updates)
+
+				check := func() {
+					// Request the highest level first, so that each lower level is computed from and shared with the one below it.
+					for i := len(updates); i >= 0; i-- {
+						contents, err := cache.Contents(db.name, db.filename, i, quirkMode)
+						if err != nil {
+							t.Fatalf("Contents failed: %v", err)
+						}
+						if !bytes.Equal(contents, expected[i]) {
+							t.Errorf("Unexpected contents at level %d", i)
+						}
+
+						sigs, err := cache.Signatures(db.name, db.filename, i, quirkMode)
+						if err != nil {
+							t.Fatalf("Signatures failed: %v", err)
+						}
+						if !reflect.DeepEqual(sigs, expectedSigs[i]) {
+							t.Errorf("Unexpected signatures at level %d", i)
+						}
+					}
+				}
+
+				// Check twice, so that the second pass checks that shared entries weren't modified by computing the others.
+				check()
+				check()
+			})
+		}
+	}
+}
+
+func TestAddEFICurrentBootSecureBootPolicyProfile(t *testing.T) {
+	restoreEventLogPath := testutil.MockEventLogPath("testdata/eventlog1.bin")
+	defer restoreEventLogPath()
+	restoreEfivarsPath := testutil.MockEFIVarsPath("testdata/efivars2")
+	defer restoreEfivarsPath()
+
+	// The signature databases in efivars2 correspond to the ones measured in eventlog1.bin, so the computed value should match the
+	// value obtained by replaying the event log.
+	f, err := os.Open("testdata/eventlog1.bin")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	log, err := tcglog.ParseLog(f, &tcglog.LogOptions{})
+	if err != nil {
+		t.Fatalf("ParseLog failed: %v", err)
+	}
+	expected := make(tpm2.Digest, tpm2.HashAlgorithmSHA256.Size())
+	for _, e := range log.Events {
+		if e.PCRIndex != 7 || e.EventType == tcglog.EventTypeNoAction {
+			continue
+		}
+		h := crypto.SHA256.New()
+		h.Write(expected)
+		h.Write(e.Digests[tcglog.AlgorithmId(tpm2.HashAlgorithmSHA256)])
+		expected = h.Sum(nil)
+	}
+	expectedDigest, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}},
+		tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {7: expected}})
+
+	profile := NewPCRProtectionProfile()
+	if err := AddEFICurrentBootSecureBootPolicyProfile(profile, &EFICurrentBootSecureBootPolicyProfileParams{PCRAlgorithm: tpm2.HashAlgorithmSHA256}); err != nil {
+		t.Fatalf("AddEFICurrentBootSecureBootPolicyProfile failed: %v", err)
+	}
+
+	_, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	if err != nil {
+		t.Fatalf("ComputePCRDigests failed: %v", err)
+	}
+	if !reflect.DeepEqual(digests, tpm2.DigestList{expectedDigest}) {
+		t.Errorf("ComputePCRDigests returned unexpected values")
+		t.Logf("Profile:\n%s", profile)
+	}
+}
+
+// appendEventToLog writes a copy of the crypto-agile TCG event log at src, which must contain SHA-1 and SHA-256 digests, to the
+// specified directory with an additional event appended, and returns the path of the copy.
+func appendEventToLog(t *testing.T, dir, src string, pcr uint32, eventType tcglog.EventType, data []byte) string {
+	log, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	buf := bytes.NewBuffer(log)
+	binary.Write(buf, binary.LittleEndian, pcr)
+	binary.Write(buf, binary.LittleEndian, uint32(eventType))
+	binary.Write(buf, binary.LittleEndian, uint32(2))
+	for _, alg := range []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256} {
+		h := alg.NewHash()
+		h.Write(data)
+		binary.Write(buf, binary.LittleEndian, alg)
+		buf.Write(h.Sum(nil))
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+
+	path := filepath.Join(dir, "eventlog.bin")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return path
+}
+
+func TestAddEFICurrentBootSecureBootPolicyProfileUnrecognizedEvent(t *testing.T) {
+	const vendorEventType tcglog.EventType = 0x800000f0
+	vendorEventData := []byte("vendor specific event")
+
+	dir, err := ioutil.TempDir("", "secboot-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPath := appendEventToLog(t, dir, "testdata/eventlog1.bin", 7, vendorEventType, vendorEventData)
+
+	restoreEventLogPath := testutil.MockEventLogPath(logPath)
+	defer restoreEventLogPath()
+	restoreEfivarsPath := testutil.MockEFIVarsPath("testdata/efivars2")
+	defer restoreEfivarsPath()
+
+	// Compute the expected PCR 7 value without the vendor event, from the unmodified log.
+	f, err := os.Open("testdata/eventlog1.bin")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	log, err := tcglog.ParseLog(f, &tcglog.LogOptions{})
+	if err != nil {
+		t.Fatalf("ParseLog failed: %v", err)
+	}
+	withoutEvent := make(tpm2.Digest, tpm2.HashAlgorithmSHA256.Size())
+	for _, e := range log.Events {
+		if e.PCRIndex != 7 || e.EventType == tcglog.EventTypeNoAction {
+			continue
+		}
+		h := crypto.SHA256.New()
+		h.Write(withoutEvent)
+		h.Write(e.Digests[tcglog.AlgorithmId(tpm2.HashAlgorithmSHA256)])
+		withoutEvent = h.Sum(nil)
+	}
+	h := crypto.SHA256.New()
+	h.Write(vendorEventData)
+	eventDigest := h.Sum(nil)
+	h = crypto.SHA256.New()
+	h.Write(withoutEvent)
+	h.Write(eventDigest)
+	withEvent := h.Sum(nil)
+
+	for _, data := range []struct {
+		desc     string
+		handler  SecureBootPolicyEventHandler
+		expected tpm2.Digest
+		err      string
+	}{
+		{
+			desc:     "Default",
+			expected: withEvent,
+		},
+		{
+			desc:     "Reproduce",
+			handler:  func(*tcglog.Event) SecureBootPolicyEventAction { return ReproduceSecureBootPolicyEvent },
+			expected: withEvent,
+		},
+		{
+			desc:     "Ignore",
+			handler:  func(*tcglog.Event) SecureBootPolicyEventAction { return IgnoreSecureBootPolicyEvent },
+			expected: withoutEvent,
+		},
+		{
+			desc:    "Reject",
+			handler: func(*tcglog.Event) SecureBootPolicyEventAction { return RejectSecureBootPolicyEvent },
+			err:     fmt.Sprintf("cannot process unrecognized event: %v event was rejected", vendorEventType),
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			var handled []*tcglog.Event
+			var handler SecureBootPolicyEventHandler
+			if data.handler != nil {
+				handler = func(e *tcglog.Event) SecureBootPolicyEventAction {
+					handled = append(handled, e)
+					return data.handler(e)
+				}
+			}
+
+			profile := NewPCRProtectionProfile()
+			err := AddEFICurrentBootSecureBootPolicyProfile(profile, &EFICurrentBootSecureBootPolicyProfileParams{
+				PCRAlgorithm:             tpm2.HashAlgorithmSHA256,
+				UnrecognizedEventHandler: handler})
+			if data.handler != nil {
+				if len(handled) != 1 || handled[0].EventType != vendorEventType {
+					t.Errorf("Unexpected events passed to handler")
+				}
+			}
+			if data.err != "" {
+				if err == nil {
+					t.Fatalf("Expected AddEFICurrentBootSecureBootPolicyProfile to fail")
+				}
+				if err.Error() != data.err {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AddEFICurrentBootSecureBootPolicyProfile failed: %v", err)
+			}
+
+			expectedDigest, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}},
+				tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {7: data.expected}})
+			_, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+			if err != nil {
+				t.Fatalf("ComputePCRDigests failed: %v", err)
+			}
+			if !reflect.DeepEqual(digests, tpm2.DigestList{expectedDigest}) {
+				t.Errorf("ComputePCRDigests returned unexpected values")
+				t.Logf("Profile:\n%s", profile)
+			}
+		})
+	}
+}
+
+func TestAddEFISecureBootPolicyProfileAmbiguousAuthority(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.SkipNow()
+	}
+
+	restoreEventLogPath := testutil.MockEventLogPath("testdata/eventlog1.bin")
+	defer restoreEventLogPath()
+	restoreEfivarsPath := testutil.MockEFIVarsPath("testdata/efivars3")
+	defer restoreEfivarsPath()
+
+	// mockshim2.efi.signed.12 is signed by certs/TestUefiSigning2.key first and certs/TestUefiSigning.key second, but the
+	// corresponding CAs are enrolled in the opposite order in efivars3. The authority used to verify it depends on the order in which
+	// the firmware iterates over the signatures and the CA certificates, so the profile should contain a branch for each.
+	profile := NewPCRProtectionProfile()
+	if err := AddEFISecureBootPolicyProfile(profile, &EFISecureBootPolicyProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		LoadSequences: []*EFIImageLoadEvent{
+			{
+				Source: Firmware,
+				Image:  FileEFIImage("testdata/mockshim2.efi.signed.12"),
+				Next: []*EFIImageLoadEvent{
+					{
+						Source: Shim,
+						Image:  FileEFIImage("testdata/mockgrub1.efi.signed.2"),
+						Next: []*EFIImageLoadEvent{
+							{
+								Source: Shim,
+								Image:  FileEFIImage("testdata/mockkernel1.efi.signed.2"),
+							},
+							{
+								Source: Shim,
+								Image:  FileEFIImage("testdata/mockgrub1.efi.signed.2"),
+								Next: []*EFIImageLoadEvent{
+									{
+										Source: Shim,
+										Image:  FileEFIImage("testdata/mockkernel1.efi.signed.2"),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}); err != nil {
+		t.Fatalf("AddEFISecureBootPolicyProfile failed: %v", err)
+	}
+
+	_, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	if err != nil {
+		t.Fatalf("ComputePCRDigests failed: %v", err)
+	}
+	if len(digests) != 2 {
+		t.Logf("Values:\n%s", profile.DumpValues(nil))
+		t.Fatalf("Unexpected number of digests (%d)", len(digests))
+	}
+
+	// One of the branches corresponds to the CA-first ordering (verified with TestUefiCA), which is the same as for
+	// mockshim2.efi.signed.21. The other corresponds to the signature-first ordering (verified with TestUefiCA2).
+	expected, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}},
+		tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {7: decodeHexStringT(t, "6d13b267035194ddd12fd9ec817ad7f8e5919e481cb2b4e3b54ec00a226dcb1a")}})
+	if !bytes.Equal(digests[0], expected) && !bytes.Equal(digests[1], expected) {
+		t.Errorf("Missing branch for CA-first ordering")
+		t.Logf("Values:\n%s", profile.DumpValues(nil))
+	}
+}
+
+func TestComputeEFISecureBootPolicyProfileStats(t *testing.T) {
+	stats, err := ComputeEFISecureBootPolicyProfileStats(&EFISecureBootPolicyProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		LoadSequences: []*EFIImageLoadEvent{
+			{
+				Source: Firmware,
+				Image:  FileEFIImage("testdata/mockshim1.efi.signed.2"),
+				Next: []*EFIImageLoadEvent{
+					{
+						Source: Shim,
+						Image:  FileEFIImage("testdata/mockgrub1.efi.signed.2"),
+						Next: []*EFIImageLoadEvent{
+							{
+								Source: Shim,
+								Image:  FileEFIImage("testdata/mockkernel1.efi.signed.2"),
+							},
+							{
+								Source: Shim,
+								Image:  FileEFIImage("testdata/mockkernel2.efi.signed.2"),
+							},
+						},
+					},
+				},
+			},
+			{
+				Source: Firmware,
+				Image:  FileEFIImage("testdata/mockshim1.efi.signed.2"),
+				Next: []*EFIImageLoadEvent{
+					{
+						Source: Shim,
+						Image:  FileEFIImage("testdata/mockkernel1.efi.signed.2"),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("ComputeEFISecureBootPolicyProfileStats failed: %v", err)
+	}
+	expected := EFISecureBootPolicyProfileStats{SignatureDbUpdates: 0, LoadPaths: 3, Branches: 6}
+	if *stats != expected {
+		t.Errorf("Unexpected stats: %+v", *stats)
+	}
+}
+
+func TestAddEFISecureBootPolicyProfileBranchLimit(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.SkipNow()
+	}
+
+	restoreEventLogPath := testutil.MockEventLogPath("testdata/eventlog1.bin")
+	defer restoreEventLogPath()
+	restoreEfivarsPath := testutil.MockEFIVarsPath("testdata/efivars3")
+	defer restoreEfivarsPath()
+
+	for _, data := range []struct {
+		desc     string
+		image    string
+		limit    int
+		expected EFISecureBootPolicyProfileStats
+	}{
+		{
+			// The limit is exceeded by the estimated number of branches, before the profile is computed.
+			desc:     "Estimated",
+			image:    "testdata/mockshim1.efi.signed.2",
+			limit:    3,
+			expected: EFISecureBootPolicyProfileStats{SignatureDbUpdates: 0, LoadPaths: 2, Branches: 4},
+		},
+		{
+			// The estimated number of branches is within the limit, but mockshim2.efi.signed.12 has an ambiguous authority
+			// which doubles the number of branches in the computed profile. The computation stops as soon as the branches
+			// created for the shim's ambiguous authority exceed the limit.
+			desc:     "Ambiguous",
+			image:    "testdata/mockshim2.efi.signed.12",
+			limit:    4,
+			expected: EFISecureBootPolicyProfileStats{SignatureDbUpdates: 0, LoadPaths: 2, Branches: 8},
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			err := AddEFISecureBootPolicyProfile(NewPCRProtectionProfile(), &EFISecureBootPolicyProfileParams{
+				PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+				LoadSequences: []*EFIImageLoadEvent{
+					{
+						Source: Firmware,
+						Image:  FileEFIImage(data.image),
+						Next: []*EFIImageLoadEvent{
+							{
+								Source: Shim,
+								Image:  FileEFIImage("testdata/mockkernel1.efi.signed.2"),
+							},
+							{
+								Source: Shim,
+								Image:  FileEFIImage("testdata/mockgrub1.efi.signed.2"),
+							},
+						},
+					},
+				},
+				MaxBranches: data.limit,
+			})
+			if err == nil {
+				t.Fatalf("AddEFISecureBootPolicyProfile should have failed")
+			}
+			e, ok := err.(SecureBootPolicyBranchLimitError)
+			if !ok {
+				t.Fatalf("Unexpected error type: %v", err)
+			}
+			if e.Limit != data.limit {
+				t.Errorf("Unexpected limit: %d", e.Limit)
+			}
+			if e.Stats != data.expected {
+				t.Errorf("Unexpected stats: %+v", e.Stats)
+			}
+		})
+	}
+}
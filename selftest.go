@@ -0,0 +1,137 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// Response codes used during self test handling, from section 6.6 of part 2 of the TPM Library Specification.
+	rcSuccess   tpm2.ResponseCode = 0x000 // TPM_RC_SUCCESS
+	rcFailure   tpm2.ResponseCode = 0x101 // TPM_RC_FAILURE
+	rcNeedsTest tpm2.ResponseCode = 0x153 // TPM_RC_NEEDS_TEST
+	rcTesting   tpm2.ResponseCode = 0x90a // TPM_RC_TESTING
+
+	maxResponseSize = 4096
+
+	testingRetryDelay = 100 * time.Millisecond
+	testingMaxRetries = 50
+)
+
+var (
+	selfTestOnConnect bool
+	timeSleep         = time.Sleep
+)
+
+// SetSelfTestOnConnect configures whether ConnectToDefaultTPM and SecureConnectToDefaultTPM should ensure that the TPM has
+// completed its self test before returning a connection. When enabled, TPM2_GetTestResult is used to determine the self test
+// status, and TPM2_SelfTest is used to start testing any algorithms that haven't been tested yet. If the TPM reports a self test
+// failure, a TPMSelfTestError error is returned. If the self test doesn't complete in a reasonable time, a ErrTPMSelfTestIncomplete
+// error is returned. This should be called before any other function in this package, and is not safe to call concurrently with
+// other functions in this package.
+func SetSelfTestOnConnect(enable bool) {
+	selfTestOnConnect = enable
+}
+
+// testingRetryTcti wraps another TCTI and transparently resubmits commands that fail with TPM_RC_TESTING, which some firmware TPMs
+// return for some time after a cold boot whilst they are performing self tests in the background.
+type testingRetryTcti struct {
+	tcti io.ReadWriteCloser
+	cmd  []byte
+	rsp  *bytes.Reader
+}
+
+func (t *testingRetryTcti) Write(data []byte) (int, error) {
+	t.cmd = append(t.cmd[:0], data...)
+	t.rsp = nil
+	return t.tcti.Write(data)
+}
+
+func (t *testingRetryTcti) Read(data []byte) (int, error) {
+	if t.rsp == nil {
+		for retries := 0; ; retries++ {
+			rsp := make([]byte, maxResponseSize)
+			n, err := t.tcti.Read(rsp)
+			if err != nil {
+				return 0, err
+			}
+			rsp = rsp[:n]
+
+			if n < 10 || tpm2.ResponseCode(binary.BigEndian.Uint32(rsp[6:10])) != rcTesting || retries >= testingMaxRetries {
+				t.rsp = bytes.NewReader(rsp)
+				break
+			}
+
+			timeSleep(testingRetryDelay)
+			if _, err := t.tcti.Write(t.cmd); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return t.rsp.Read(data)
+}
+
+func (t *testingRetryTcti) Close() error {
+	return t.tcti.Close()
+}
+
+// ensureSelfTestComplete checks the self test status of the TPM, starting any outstanding tests and waiting for them to complete.
+func ensureSelfTestComplete(tpm *tpm2.TPMContext) error {
+	startedTest := false
+	for retries := 0; ; retries++ {
+		_, result, err := tpm.GetTestResult()
+		if err != nil {
+			return xerrors.Errorf("cannot obtain self test result: %w", err)
+		}
+
+		switch result {
+		case rcSuccess:
+			return nil
+		case rcNeedsTest, rcTesting:
+			// Testing is incomplete.
+		default:
+			return TPMSelfTestError{result}
+		}
+
+		if retries >= testingMaxRetries {
+			return ErrTPMSelfTestIncomplete
+		}
+
+		if !startedTest {
+			// Test any algorithms that haven't been tested yet. This may return TPM_RC_TESTING if testing is already in progress,
+			// which is retried by testingRetryTcti.
+			if err := tpm.SelfTest(false); err != nil && !tpm2.IsTPMWarning(err, tpm2.WarningTesting, tpm2.CommandSelfTest) {
+				return xerrors.Errorf("cannot start self test: %w", err)
+			}
+			startedTest = true
+			continue
+		}
+
+		timeSleep(testingRetryDelay)
+	}
+}
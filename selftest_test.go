@@ -0,0 +1,110 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	. "github.com/snapcore/secboot"
+
+	. "gopkg.in/check.v1"
+)
+
+// mockTcti returns a canned sequence of responses and records the commands written to it.
+type mockTcti struct {
+	responses [][]byte
+	commands  [][]byte
+}
+
+func (t *mockTcti) Write(data []byte) (int, error) {
+	t.commands = append(t.commands, append([]byte(nil), data...))
+	return len(data), nil
+}
+
+func (t *mockTcti) Read(data []byte) (int, error) {
+	rsp := t.responses[0]
+	t.responses = t.responses[1:]
+	return copy(data, rsp), nil
+}
+
+func (t *mockTcti) Close() error {
+	return nil
+}
+
+func makeMockResponse(rc uint32) []byte {
+	rsp := make([]byte, 10)
+	binary.BigEndian.PutUint16(rsp[0:], 0x8001)
+	binary.BigEndian.PutUint32(rsp[2:], 10)
+	binary.BigEndian.PutUint32(rsp[6:], rc)
+	return rsp
+}
+
+type selfTestSuite struct {
+	sleeps int
+}
+
+var _ = Suite(&selfTestSuite{})
+
+func (s *selfTestSuite) SetUpTest(c *C) {
+	s.sleeps = 0
+}
+
+func (s *selfTestSuite) mockSleep(time.Duration) {
+	s.sleeps++
+}
+
+func (s *selfTestSuite) TestRetryOnTesting(c *C) {
+	restore := MockTimeSleep(s.mockSleep)
+	defer restore()
+
+	mock := &mockTcti{responses: [][]byte{makeMockResponse(0x90a), makeMockResponse(0x90a), makeMockResponse(0)}}
+	tcti := NewTestingRetryTcti(mock)
+
+	cmd := []byte{0x80, 0x01, 0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x01, 0x7b, 0x00, 0x14}
+	_, err := tcti.Write(cmd)
+	c.Assert(err, IsNil)
+
+	rsp := make([]byte, 4096)
+	n, err := tcti.Read(rsp)
+	c.Assert(err, IsNil)
+	c.Check(rsp[:n], DeepEquals, makeMockResponse(0))
+	c.Check(mock.commands, DeepEquals, [][]byte{cmd, cmd, cmd})
+	c.Check(s.sleeps, Equals, 2)
+}
+
+func (s *selfTestSuite) TestNoRetryOnOtherErrors(c *C) {
+	restore := MockTimeSleep(s.mockSleep)
+	defer restore()
+
+	mock := &mockTcti{responses: [][]byte{makeMockResponse(0x101)}}
+	tcti := NewTestingRetryTcti(mock)
+
+	_, err := tcti.Write([]byte{0x80, 0x01, 0x00, 0x00, 0x00, 0x0a, 0x00, 0x00, 0x01, 0x7c})
+	c.Assert(err, IsNil)
+
+	var rsp bytes.Buffer
+	_, err = rsp.ReadFrom(tcti)
+	c.Assert(err, IsNil)
+	c.Check(rsp.Bytes(), DeepEquals, makeMockResponse(0x101))
+	c.Check(mock.commands, HasLen, 1)
+	c.Check(s.sleeps, Equals, 0)
+}
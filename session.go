@@ -0,0 +1,87 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// ReuseSessions specifies whether policy sessions started by operations on this connection should be kept open and reused by
+// subsequent operations, rather than being started for each operation and flushed afterwards. Starting a session requires a round
+// trip to the TPM, which is relatively expensive on discrete TPMs, so enabling this can speed up sequences of operations such as
+// unsealing the keys for several volumes during early boot. A reused session is reset with TPM2_PolicyRestart before each use.
+//
+// Retained sessions occupy session slots on the TPM until this is set back to false or the connection is closed.
+//
+// This only applies to policy sessions. Operations on this connection that require a HMAC session already share the connection's
+// salted HMAC session (see HmacSession) for the lifetime of the connection, so there is no per-command cost to avoid.
+func (t *TPMConnection) ReuseSessions(reuse bool) {
+	t.reuseSessions = reuse
+	if !reuse {
+		t.flushPolicySessions()
+	}
+}
+
+// flushPolicySessions flushes all of the policy sessions retained for reuse.
+func (t *TPMConnection) flushPolicySessions() {
+	for alg, session := range t.policySessions {
+		t.FlushContext(session)
+		delete(t.policySessions, alg)
+	}
+}
+
+// startPolicySession returns a policy session with the specified digest algorithm. If session reuse is enabled with ReuseSessions,
+// a previously retained session is reset and returned if one is available. Callers should include tpm2.AttrContinueSession when
+// using the returned session for authorization so that it isn't flushed by the TPM, and must call the returned function when they
+// have finished with it.
+func (t *TPMConnection) startPolicySession(alg tpm2.HashAlgorithmId) (tpm2.SessionContext, func(), error) {
+	if t.reuseSessions {
+		if session, ok := t.policySessions[alg]; ok {
+			// Take the session whilst it is in use so that nested callers get their own.
+			delete(t.policySessions, alg)
+			if err := t.PolicyRestart(session); err == nil {
+				return session, func() { t.releasePolicySession(alg, session) }, nil
+			}
+			// The session is unusable, so discard it and start a new one.
+			t.FlushContext(session)
+		}
+	}
+
+	session, err := t.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, alg)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot start policy session: %w", err)
+	}
+	return session, func() { t.releasePolicySession(alg, session) }, nil
+}
+
+// releasePolicySession retains the supplied session for reuse if session reuse is enabled and there isn't already a session
+// retained for the same algorithm, else it flushes it.
+func (t *TPMConnection) releasePolicySession(alg tpm2.HashAlgorithmId, session tpm2.SessionContext) {
+	if _, exists := t.policySessions[alg]; t.reuseSessions && !exists && session.Handle() != tpm2.HandleUnassigned {
+		if t.policySessions == nil {
+			t.policySessions = make(map[tpm2.HashAlgorithmId]tpm2.SessionContext)
+		}
+		t.policySessions[alg] = session
+		return
+	}
+	t.FlushContext(session)
+}
@@ -0,0 +1,84 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// IsPCRPolicySatisfiedBy indicates whether the PCR policy of this sealed key object would be satisfied if the TPM's PCRs contained
+// the supplied values, without requiring access to the TPM. The supplied values must contain a value for every PCR selected by the
+// PCR policy, else an error is returned. Values for other PCRs are ignored.
+//
+// This only simulates the PCR assertions of the policy. It doesn't detect whether the PCR policy has been revoked by a subsequent
+// policy update for a related key, or whether the TPM has been cleared since the key was sealed.
+func (k *SealedKeyObject) IsPCRPolicySatisfiedBy(values tpm2.PCRValues) (bool, error) {
+	alg := k.data.keyPublic.NameAlg
+	pcrs := k.data.dynamicPolicyData.pcrSelection
+
+	pcrDigest, err := tpm2.ComputePCRDigest(alg, pcrs, values)
+	if err != nil {
+		return false, xerrors.Errorf("cannot compute PCR digest: %w", err)
+	}
+
+	trial, err := tpm2.ComputeAuthPolicy(alg)
+	if err != nil {
+		return false, xerrors.Errorf("cannot compute policy digest: %w", err)
+	}
+	trial.PolicyPCR(pcrDigest, pcrs)
+
+	return findPolicyORLeaf(k.data.dynamicPolicyData.pcrOrData, trial.GetDigest()) >= 0, nil
+}
+
+// CheckPCRProtectionProfile determines whether the PCR policy of this sealed key object would be satisfied by each combination of
+// PCR values permitted by the supplied profile, without modifying the key. This can be used by update tooling to check that a
+// device will still be able to unseal this key after rebooting in to a new boot configuration, by passing a profile computed for
+// that configuration.
+//
+// The tpm argument is only used to read the current PCR values for profiles created with
+// PCRProtectionProfile.AddPCRValueFromTPM, and may be nil otherwise.
+//
+// The combinations of PCR values from the profile that would not satisfy the policy are returned. If this is empty, every boot
+// configuration described by the profile is permitted. See IsPCRPolicySatisfiedBy for the limitations of this check.
+func (k *SealedKeyObject) CheckPCRProtectionProfile(tpm *TPMConnection, profile *PCRProtectionProfile) ([]tpm2.PCRValues, error) {
+	var tpmContext *tpm2.TPMContext
+	if tpm != nil {
+		tpmContext = tpm.TPMContext
+	}
+
+	values, err := profile.computePCRValues(tpmContext)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR values from protection profile: %w", err)
+	}
+
+	var unsatisfied []tpm2.PCRValues
+	for _, v := range values {
+		ok, err := k.IsPCRPolicySatisfiedBy(v)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			unsatisfied = append(unsatisfied, v)
+		}
+	}
+	return unsatisfied, nil
+}
@@ -0,0 +1,123 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+func TestSimulatePCRPolicy(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestSimulatePCRPolicy_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	digestA := testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")
+	digestB := testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "bar")
+	digestC := testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "baz")
+
+	profile := NewPCRProtectionProfile().AddProfileOR(
+		NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, digestA),
+		NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, digestB))
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: profile, PCRPolicyCounterHandle: tpm2.HandleNull}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	for _, data := range []struct {
+		desc     string
+		digest   tpm2.Digest
+		expected bool
+	}{
+		{desc: "A", digest: digestA, expected: true},
+		{desc: "B", digest: digestB, expected: true},
+		{desc: "C", digest: digestC, expected: false},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			values := tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {7: data.digest, 8: digestC}}
+			ok, err := k.IsPCRPolicySatisfiedBy(values)
+			if err != nil {
+				t.Fatalf("IsPCRPolicySatisfiedBy failed: %v", err)
+			}
+			if ok != data.expected {
+				t.Errorf("Unexpected result: %v", ok)
+			}
+		})
+	}
+
+	t.Run("MissingValue", func(t *testing.T) {
+		if _, err := k.IsPCRPolicySatisfiedBy(tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {8: digestA}}); err == nil {
+			t.Errorf("IsPCRPolicySatisfiedBy should fail if the values don't include a selected PCR")
+		}
+	})
+
+	t.Run("Profile", func(t *testing.T) {
+		newProfile := NewPCRProtectionProfile().AddProfileOR(
+			NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, digestB),
+			NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, digestC))
+		unsatisfied, err := k.CheckPCRProtectionProfile(nil, newProfile)
+		if err != nil {
+			t.Fatalf("CheckPCRProtectionProfile failed: %v", err)
+		}
+		expected := []tpm2.PCRValues{{tpm2.HashAlgorithmSHA256: {7: digestC}}}
+		if !reflect.DeepEqual(unsatisfied, expected) {
+			t.Errorf("Unexpected unsatisfied values: %v", unsatisfied)
+		}
+
+		unsatisfied, err = k.CheckPCRProtectionProfile(nil, profile)
+		if err != nil {
+			t.Fatalf("CheckPCRProtectionProfile failed: %v", err)
+		}
+		if len(unsatisfied) > 0 {
+			t.Errorf("Unexpected unsatisfied values: %v", unsatisfied)
+		}
+	})
+
+	t.Run("ProfileFromTPMWithoutTPM", func(t *testing.T) {
+		if _, err := k.CheckPCRProtectionProfile(nil, getTestPCRProfile()); err == nil {
+			t.Errorf("CheckPCRProtectionProfile should fail without a TPM for a profile that reads PCR values from it")
+		}
+	})
+}
@@ -140,7 +140,7 @@ func AddSnapModelProfile(profile *PCRProtectionProfile, params *SnapModelProfile
 }
 
 func measureSnapPropertyToTPM(tpm *TPMConnection, pcrIndex int, computeDigest func(tpm2.HashAlgorithmId) (tpm2.Digest, error)) error {
-	pcrSelection, err := tpm.GetCapabilityPCRs(tpm.HmacSession().IncludeAttrs(tpm2.AttrAudit))
+	pcrSelection, err := tpm.GetCapabilityPCRs(tpm.currentHmacSession().IncludeAttrs(tpm2.AttrAudit))
 	if err != nil {
 		return xerrors.Errorf("cannot determine supported PCR banks: %w", err)
 	}
@@ -162,7 +162,7 @@ func measureSnapPropertyToTPM(tpm *TPMConnection, pcrIndex int, computeDigest fu
 		digests = append(digests, tpm2.TaggedHash{HashAlg: s.Hash, Digest: digest})
 	}
 
-	return tpm.PCRExtend(tpm.PCRHandleContext(pcrIndex), digests, tpm.HmacSession())
+	return tpm.PCRExtend(tpm.PCRHandleContext(pcrIndex), digests, tpm.currentHmacSession())
 }
 
 // MeasureSnapSystemEpochToTPM measures a digest of uint32(0) to the specified PCR for all supported PCR banks. See the documentation
@@ -0,0 +1,196 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+	"github.com/snapcore/secboot/internal/efi"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/osutil/sys"
+
+	"golang.org/x/xerrors"
+)
+
+// snapshotEFIVarFilenames is the list of efivarfs filenames that are captured in a SystemSnapshot. These are the variables that
+// are read by the PCR profile builders in this package.
+var snapshotEFIVarFilenames = []string{
+	pkFilename,
+	setupModeFilename,
+	kekFilename,
+	dbFilename,
+	dbxFilename,
+	mokListFilename,
+}
+
+// SystemSnapshot contains a copy of the system state that is used to compute PCR protection profiles - the EFI variables
+// containing the secure boot configuration, the TCG event log for the current boot and the properties of the TPM. A snapshot can
+// be captured on one system with CaptureSystemSnapshot, saved with WriteToFile, and then supplied to the profile builders in this
+// package on another system in order to reproduce the profile computation offline.
+type SystemSnapshot struct {
+	Time time.Time `json:"time"`
+
+	// EFIVars contains the captured EFI variables in the format exposed by efivarfs (the 4-byte attribute field followed by the
+	// variable data), keyed by efivarfs filename. Variables that did not exist when the snapshot was captured are omitted.
+	EFIVars map[string][]byte `json:"efivars"`
+
+	// EventLog contains the TCG event log for the boot during which the snapshot was captured, in binary form.
+	EventLog []byte `json:"event-log"`
+
+	// TPMProperties contains the fixed and variable properties of the TPM. It is empty if the snapshot was captured without a TPM
+	// connection.
+	TPMProperties tpm2.TaggedTPMPropertyList `json:"tpm-properties,omitempty"`
+}
+
+// CaptureSystemSnapshot captures a snapshot of the current system state. If tpm is not nil, the properties of the TPM are included
+// in the snapshot.
+func CaptureSystemSnapshot(tpm *TPMConnection) (*SystemSnapshot, error) {
+	s, err := newSystemSnapshotFromPaths(efi.EFIVarsPath, efi.EventLogPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if tpm != nil {
+		for _, p := range []tpm2.Property{tpm2.PropertyFixed, tpm2.PropertyVar} {
+			props, err := tpm.GetCapabilityTPMProperties(p, tpm2.CapabilityMaxProperties)
+			if err != nil {
+				return nil, xerrors.Errorf("cannot fetch properties from TPM: %w", err)
+			}
+			for _, prop := range props {
+				// GetCapability returns properties starting from the requested one, which means that the fixed properties
+				// request also returns the variable properties.
+				if prop.Property&0xffffff00 != p {
+					continue
+				}
+				s.TPMProperties = append(s.TPMProperties, prop)
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// newSystemSnapshotFromPaths creates a snapshot from the EFI variables in the efivarfs format directory at efivarsPath and the
+// TCG event log at eventLogPath.
+func newSystemSnapshotFromPaths(efivarsPath, eventLogPath string) (*SystemSnapshot, error) {
+	s := &SystemSnapshot{Time: time.Now().UTC(), EFIVars: make(map[string][]byte)}
+
+	for _, name := range snapshotEFIVarFilenames {
+		data, err := ioutil.ReadFile(filepath.Join(efivarsPath, name))
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return nil, xerrors.Errorf("cannot read EFI variable %s: %w", name, err)
+		}
+		s.EFIVars[name] = data
+	}
+
+	eventLog, err := ioutil.ReadFile(eventLogPath)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read TCG event log: %w", err)
+	}
+	s.EventLog = eventLog
+
+	return s, nil
+}
+
+// ReadSystemSnapshot reads a snapshot previously saved with SystemSnapshot.WriteToFile from the file at the specified path.
+func ReadSystemSnapshot(path string) (*SystemSnapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read snapshot: %w", err)
+	}
+
+	var s SystemSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, xerrors.Errorf("cannot decode snapshot: %w", err)
+	}
+	return &s, nil
+}
+
+// WriteToFile saves this snapshot atomically to the file at the specified path.
+func (s *SystemSnapshot) WriteToFile(path string) error {
+	f, err := osutil.NewAtomicFile(path, 0600, 0, sys.UserID(osutil.NoChown), sys.GroupID(osutil.NoChown))
+	if err != nil {
+		return xerrors.Errorf("cannot create new atomic file: %w", err)
+	}
+	defer f.Cancel()
+
+	if err := json.NewEncoder(f).Encode(s); err != nil {
+		return xerrors.Errorf("cannot encode snapshot: %w", err)
+	}
+
+	if err := f.Commit(); err != nil {
+		return xerrors.Errorf("cannot atomically replace file: %w", err)
+	}
+
+	return nil
+}
+
+// readEventLog returns the TCG event log captured in this snapshot. If s is nil, the TCG event log for the current boot is returned
+// instead, using the cache associated with the supplied connection if it isn't nil.
+func (s *SystemSnapshot) readEventLog(tpm *TPMConnection) (*tcglog.Log, error) {
+	if s == nil {
+		return readEventLogWithCache(tpm)
+	}
+
+	log, err := tcglog.ParseLog(bytes.NewReader(s.EventLog), &tcglog.LogOptions{})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot parse TCG event log from snapshot: %w", err)
+	}
+	return log, nil
+}
+
+// efiVarsPath returns the path of a directory containing the EFI variables captured in this snapshot, in the format used by
+// efivarfs. A directory is required rather than in-memory copies of the variables because the path is passed to sbkeysync. The
+// returned function must be called to remove the directory once it is no longer required. If s is nil, the path of efivarfs for
+// the current system is returned.
+func (s *SystemSnapshot) efiVarsPath() (path string, cleanup func(), err error) {
+	if s == nil {
+		return efi.EFIVarsPath, func() {}, nil
+	}
+
+	dir, err := ioutil.TempDir("", "secboot-efivars-")
+	if err != nil {
+		return "", nil, xerrors.Errorf("cannot create temporary directory: %w", err)
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+
+	for name, data := range s.EFIVars {
+		if filepath.Base(name) != name {
+			cleanup()
+			return "", nil, xerrors.Errorf("invalid EFI variable name %q in snapshot", name)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			cleanup()
+			return "", nil, xerrors.Errorf("cannot write EFI variable: %w", err)
+		}
+	}
+
+	return dir, cleanup, nil
+}
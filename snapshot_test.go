@@ -0,0 +1,165 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+func TestCaptureSystemSnapshot(t *testing.T) {
+	restoreEventLogPath := testutil.MockEventLogPath("testdata/eventlog1.bin")
+	defer restoreEventLogPath()
+	restoreEfivarsPath := testutil.MockEFIVarsPath("testdata/efivars2")
+	defer restoreEfivarsPath()
+
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	snapshot, err := CaptureSystemSnapshot(tpm)
+	if err != nil {
+		t.Fatalf("CaptureSystemSnapshot failed: %v", err)
+	}
+
+	eventLog, err := ioutil.ReadFile("testdata/eventlog1.bin")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.Equal(snapshot.EventLog, eventLog) {
+		t.Errorf("Unexpected event log")
+	}
+
+	for _, name := range []string{"KEK-8be4df61-93ca-11d2-aa0d-00e098032b8c", "db-d719b2cb-3d3a-4596-a3bc-dad00e67656f",
+		"dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata/efivars2", name))
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if !bytes.Equal(snapshot.EFIVars[name], data) {
+			t.Errorf("Unexpected contents for %s", name)
+		}
+	}
+
+	if len(snapshot.TPMProperties) == 0 {
+		t.Errorf("No TPM properties")
+	}
+	for _, p := range snapshot.TPMProperties {
+		if p.Property < tpm2.PropertyFixed || p.Property >= tpm2.PropertyVar+0x100 {
+			t.Errorf("Unexpected property %v", p.Property)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "_TestCaptureSystemSnapshot_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot")
+	if err := snapshot.WriteToFile(path); err != nil {
+		t.Fatalf("WriteToFile failed: %v", err)
+	}
+	snapshot2, err := ReadSystemSnapshot(path)
+	if err != nil {
+		t.Fatalf("ReadSystemSnapshot failed: %v", err)
+	}
+	if !snapshot2.Time.Equal(snapshot.Time) {
+		t.Errorf("Unexpected time")
+	}
+	snapshot2.Time = snapshot.Time
+	if !reflect.DeepEqual(snapshot2, snapshot) {
+		t.Errorf("ReadSystemSnapshot returned an unexpected snapshot")
+	}
+}
+
+func TestAddEFISecureBootPolicyProfileFromSnapshot(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.SkipNow()
+	}
+
+	restoreEventLogPath := testutil.MockEventLogPath("testdata/eventlog1.bin")
+	defer restoreEventLogPath()
+	restoreEfivarsPath := testutil.MockEFIVarsPath("testdata/efivars2")
+	defer restoreEfivarsPath()
+
+	snapshot, err := CaptureSystemSnapshot(nil)
+	if err != nil {
+		t.Fatalf("CaptureSystemSnapshot failed: %v", err)
+	}
+	if len(snapshot.TPMProperties) > 0 {
+		t.Errorf("Unexpected TPM properties")
+	}
+
+	// Make sure that the current system isn't used.
+	restoreEventLogPath2 := testutil.MockEventLogPath("testdata/nonexistent")
+	defer restoreEventLogPath2()
+	restoreEfivarsPath2 := testutil.MockEFIVarsPath("testdata/efivars3")
+	defer restoreEfivarsPath2()
+
+	profile := NewPCRProtectionProfile()
+	if err := AddEFISecureBootPolicyProfile(profile, &EFISecureBootPolicyProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		LoadSequences: []*EFIImageLoadEvent{
+			{
+				Source: Firmware,
+				Image:  FileEFIImage("testdata/mockshim1.efi.signed.1"),
+				Next: []*EFIImageLoadEvent{
+					{
+						Source: Shim,
+						Image:  FileEFIImage("testdata/mockgrub1.efi.signed.shim"),
+						Next: []*EFIImageLoadEvent{
+							{
+								Source: Shim,
+								Image:  FileEFIImage("testdata/mockkernel1.efi.signed.shim"),
+							},
+						},
+					},
+				},
+			},
+		},
+		Snapshot: snapshot}); err != nil {
+		t.Fatalf("AddEFISecureBootPolicyProfile failed: %v", err)
+	}
+
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}
+	expectedDigest, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, tpm2.PCRValues{
+		tpm2.HashAlgorithmSHA256: {
+			7: decodeHexStringT(t, "d9ea13718ff09d8ade8e570656f4ac3d93d121d4fe784dee966b38e3fcddaf87"),
+		},
+	})
+
+	_, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	if err != nil {
+		t.Fatalf("ComputePCRDigests failed: %v", err)
+	}
+	if !reflect.DeepEqual(digests, tpm2.DigestList{expectedDigest}) {
+		t.Errorf("ComputePCRDigests returned unexpected values")
+		t.Logf("Profile:\n%s", profile)
+	}
+}
@@ -0,0 +1,361 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/snapcore/secboot/internal/efi"
+	"github.com/snapcore/snapd/asserts"
+
+	"golang.org/x/xerrors"
+)
+
+// MeasurementTestVectorImage describes an EFI image load event in a MeasurementTestVector, and corresponds to EFIImageLoadEvent.
+type MeasurementTestVectorImage struct {
+	Source string                        `json:"source"` // "firmware" or "shim"
+	Image  string                        `json:"image"`  // Path of the image, relative to the test vector file
+	Next   []*MeasurementTestVectorImage `json:"next,omitempty"`
+}
+
+// MeasurementTestVectorSecureBoot enables the secure boot policy profile in a MeasurementTestVector. See
+// AddEFISecureBootPolicyProfile.
+type MeasurementTestVectorSecureBoot struct {
+	SignatureDbUpdateKeystores []string `json:"signature-db-update-keystores,omitempty"` // Paths relative to the test vector file
+}
+
+// MeasurementTestVectorBootManager enables the UEFI boot manager profile in a MeasurementTestVector. See AddEFIBootManagerProfile.
+type MeasurementTestVectorBootManager struct{}
+
+// MeasurementTestVectorSystemdEFIStub enables the systemd EFI stub profile in a MeasurementTestVector. See AddSystemdEFIStubProfile.
+type MeasurementTestVectorSystemdEFIStub struct {
+	PCR            int      `json:"pcr"`
+	KernelCmdlines []string `json:"kernel-cmdlines"`
+}
+
+// MeasurementTestVectorSnapModel enables the snap model profile in a MeasurementTestVector. See AddSnapModelProfile.
+type MeasurementTestVectorSnapModel struct {
+	PCR    int      `json:"pcr"`
+	Models []string `json:"models"` // Paths of model assertions, relative to the test vector file
+}
+
+// MeasurementTestVectorInputs describes the inputs to a MeasurementTestVector. Each of the profile fields that is set adds the
+// corresponding profile, in the order that they are declared here.
+type MeasurementTestVectorInputs struct {
+	EventLog      string                        `json:"event-log,omitempty"` // Path of the TCG event log, relative to the test vector file
+	EFIVars       string                        `json:"efivars,omitempty"`   // Path of a directory of efivarfs format variables, relative to the test vector file
+	LoadSequences []*MeasurementTestVectorImage `json:"load-sequences,omitempty"`
+
+	SecureBoot     *MeasurementTestVectorSecureBoot     `json:"secure-boot,omitempty"`
+	BootManager    *MeasurementTestVectorBootManager    `json:"boot-manager,omitempty"`
+	SystemdEFIStub *MeasurementTestVectorSystemdEFIStub `json:"systemd-efi-stub,omitempty"`
+	SnapModel      *MeasurementTestVectorSnapModel      `json:"snap-model,omitempty"`
+}
+
+// MeasurementTestVector is a conformance test vector for the measurements predicted by this package. It describes a set of inputs
+// (EFI variables, TCG event log, EFI images, kernel commandlines and snap models) and the PCR values that the corresponding
+// profiles are expected to produce. Maintainers of the components that perform the measurements can use these to validate their
+// implementations against the predictions made by this package.
+//
+// Test vectors are stored as JSON. Paths in the inputs are relative to the directory containing the test vector file.
+type MeasurementTestVector struct {
+	Name         string                      `json:"name"`
+	Description  string                      `json:"description,omitempty"`
+	PCRAlgorithm string                      `json:"pcr-algorithm"` // "sha1", "sha256", "sha384" or "sha512"
+	Inputs       MeasurementTestVectorInputs `json:"inputs"`
+
+	// Expected contains the expected PCR values, one entry per branch of the computed profile. Each entry maps a PCR index to a
+	// hex encoded digest.
+	Expected []map[int]string `json:"expected"`
+
+	dir string
+}
+
+// ReadMeasurementTestVector reads the test vector from the JSON file at the specified path.
+func ReadMeasurementTestVector(path string) (*MeasurementTestVector, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read test vector: %w", err)
+	}
+
+	var v MeasurementTestVector
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, xerrors.Errorf("cannot decode test vector: %w", err)
+	}
+	v.dir = filepath.Dir(path)
+	return &v, nil
+}
+
+func (v *MeasurementTestVector) path(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(v.dir, p)
+}
+
+func (v *MeasurementTestVector) pcrAlgorithm() (tpm2.HashAlgorithmId, error) {
+	switch v.PCRAlgorithm {
+	case "sha1":
+		return tpm2.HashAlgorithmSHA1, nil
+	case "sha256":
+		return tpm2.HashAlgorithmSHA256, nil
+	case "sha384":
+		return tpm2.HashAlgorithmSHA384, nil
+	case "sha512":
+		return tpm2.HashAlgorithmSHA512, nil
+	}
+	return tpm2.HashAlgorithmNull, fmt.Errorf("unsupported PCR algorithm %q", v.PCRAlgorithm)
+}
+
+func (v *MeasurementTestVector) loadSequences(in []*MeasurementTestVectorImage) ([]*EFIImageLoadEvent, error) {
+	var out []*EFIImageLoadEvent
+	for _, i := range in {
+		var source EFIImageLoadEventSource
+		switch i.Source {
+		case "firmware":
+			source = Firmware
+		case "shim":
+			source = Shim
+		default:
+			return nil, fmt.Errorf("invalid image source %q", i.Source)
+		}
+		next, err := v.loadSequences(i.Next)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &EFIImageLoadEvent{Source: source, Image: FileEFIImage(v.path(i.Image)), Next: next})
+	}
+	return out, nil
+}
+
+func (v *MeasurementTestVector) snapModels() ([]SnapModel, error) {
+	var models []SnapModel
+	for _, p := range v.Inputs.SnapModel.Models {
+		data, err := ioutil.ReadFile(v.path(p))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read model assertion: %w", err)
+		}
+		a, err := asserts.Decode(data)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decode model assertion %s: %w", p, err)
+		}
+		model, ok := a.(*asserts.Model)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a model assertion", p)
+		}
+		models = append(models, model)
+	}
+	return models, nil
+}
+
+// Compute computes the PCR values for the inputs of this test vector using the profile builders in this package, without
+// comparing them to the expected values. This can be used to generate the expected values for a new test vector.
+//
+// If the test vector doesn't supply a TCG event log or EFI variables, those from the current system are used instead.
+func (v *MeasurementTestVector) Compute() ([]map[int]string, error) {
+	alg, err := v.pcrAlgorithm()
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot *SystemSnapshot
+	if v.Inputs.EventLog != "" || v.Inputs.EFIVars != "" {
+		efivarsPath := efi.EFIVarsPath
+		if v.Inputs.EFIVars != "" {
+			efivarsPath = v.path(v.Inputs.EFIVars)
+		}
+		eventLogPath := efi.EventLogPath
+		if v.Inputs.EventLog != "" {
+			eventLogPath = v.path(v.Inputs.EventLog)
+		}
+		snapshot, err = newSystemSnapshotFromPaths(efivarsPath, eventLogPath)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read inputs: %w", err)
+		}
+	}
+
+	loadSequences, err := v.loadSequences(v.Inputs.LoadSequences)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid load sequences: %w", err)
+	}
+
+	profile := NewPCRProtectionProfile()
+
+	if sb := v.Inputs.SecureBoot; sb != nil {
+		var keystores []string
+		for _, k := range sb.SignatureDbUpdateKeystores {
+			keystores = append(keystores, v.path(k))
+		}
+		if err := AddEFISecureBootPolicyProfile(profile, &EFISecureBootPolicyProfileParams{
+			PCRAlgorithm:               alg,
+			LoadSequences:              loadSequences,
+			SignatureDbUpdateKeystores: keystores,
+			Snapshot:                   snapshot}); err != nil {
+			return nil, xerrors.Errorf("cannot add secure boot policy profile: %w", err)
+		}
+	}
+	if v.Inputs.BootManager != nil {
+		if err := AddEFIBootManagerProfile(profile, &EFIBootManagerProfileParams{
+			PCRAlgorithm:  alg,
+			LoadSequences: loadSequences,
+			Snapshot:      snapshot}); err != nil {
+			return nil, xerrors.Errorf("cannot add boot manager profile: %w", err)
+		}
+	}
+	if stub := v.Inputs.SystemdEFIStub; stub != nil {
+		if err := AddSystemdEFIStubProfile(profile, &SystemdEFIStubProfileParams{
+			PCRAlgorithm:   alg,
+			PCRIndex:       stub.PCR,
+			KernelCmdlines: stub.KernelCmdlines}); err != nil {
+			return nil, xerrors.Errorf("cannot add systemd EFI stub profile: %w", err)
+		}
+	}
+	if v.Inputs.SnapModel != nil {
+		models, err := v.snapModels()
+		if err != nil {
+			return nil, err
+		}
+		if err := AddSnapModelProfile(profile, &SnapModelProfileParams{
+			PCRAlgorithm: alg,
+			PCRIndex:     v.Inputs.SnapModel.PCR,
+			Models:       models}); err != nil {
+			return nil, xerrors.Errorf("cannot add snap model profile: %w", err)
+		}
+	}
+
+	values, err := profile.computePCRValues(nil)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR values: %w", err)
+	}
+
+	var out []map[int]string
+	for _, branch := range values {
+		m := make(map[int]string)
+		for pcr, digest := range branch[alg] {
+			m[pcr] = hex.EncodeToString(digest)
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// MeasurementTestVectorResult is the result of evaluating a MeasurementTestVector.
+type MeasurementTestVectorResult struct {
+	Missing    []map[int]string // Expected PCR values that were not computed
+	Unexpected []map[int]string // Computed PCR values that were not expected
+}
+
+// Passed indicates whether the computed PCR values match the expected values.
+func (r *MeasurementTestVectorResult) Passed() bool {
+	return len(r.Missing) == 0 && len(r.Unexpected) == 0
+}
+
+// pcrValuesKey returns a canonical representation of the supplied PCR values for comparison.
+func pcrValuesKey(values map[int]string) (string, error) {
+	var pcrs []int
+	for pcr := range values {
+		pcrs = append(pcrs, pcr)
+	}
+	sort.Ints(pcrs)
+
+	var buf bytes.Buffer
+	for _, pcr := range pcrs {
+		d, err := hex.DecodeString(values[pcr])
+		if err != nil {
+			return "", xerrors.Errorf("invalid digest for PCR %d: %w", pcr, err)
+		}
+		fmt.Fprintf(&buf, "%d:%x;", pcr, d)
+	}
+	return buf.String(), nil
+}
+
+// Evaluate computes the PCR values for the inputs of this test vector and compares them with the expected values. The order of
+// the branches is not significant. See Compute for details of how the inputs are used.
+func (v *MeasurementTestVector) Evaluate() (*MeasurementTestVectorResult, error) {
+	if len(v.Expected) == 0 {
+		return nil, errors.New("test vector has no expected values")
+	}
+
+	computed, err := v.Compute()
+	if err != nil {
+		return nil, err
+	}
+
+	computedKeys := make(map[string]bool)
+	for _, c := range computed {
+		k, _ := pcrValuesKey(c)
+		computedKeys[k] = true
+	}
+	expectedKeys := make(map[string]bool)
+
+	result := new(MeasurementTestVectorResult)
+	for _, e := range v.Expected {
+		k, err := pcrValuesKey(e)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid expected values: %w", err)
+		}
+		expectedKeys[k] = true
+		if !computedKeys[k] {
+			result.Missing = append(result.Missing, e)
+		}
+	}
+	for _, c := range computed {
+		k, _ := pcrValuesKey(c)
+		if !expectedKeys[k] {
+			result.Unexpected = append(result.Unexpected, c)
+		}
+	}
+	return result, nil
+}
+
+// EvaluateMeasurementTestVectors reads and evaluates all of the test vectors with a .json extension in the specified directory,
+// returning the results keyed by file name.
+func EvaluateMeasurementTestVectors(dir string) (map[string]*MeasurementTestVectorResult, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, xerrors.Errorf("no test vectors in %s: %w", dir, os.ErrNotExist)
+	}
+
+	results := make(map[string]*MeasurementTestVectorResult)
+	for _, p := range paths {
+		v, err := ReadMeasurementTestVector(p)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read %s: %w", filepath.Base(p), err)
+		}
+		r, err := v.Evaluate()
+		if err != nil {
+			return nil, xerrors.Errorf("cannot evaluate %s: %w", filepath.Base(p), err)
+		}
+		results[filepath.Base(p)] = r
+	}
+	return results, nil
+}
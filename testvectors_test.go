@@ -0,0 +1,93 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	. "github.com/snapcore/secboot"
+
+	"golang.org/x/xerrors"
+)
+
+func TestEvaluateMeasurementTestVectors(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.SkipNow()
+	}
+
+	results, err := EvaluateMeasurementTestVectors("testdata/vectors")
+	if err != nil {
+		t.Fatalf("EvaluateMeasurementTestVectors failed: %v", err)
+	}
+	if len(results) == 0 {
+		t.Fatalf("No results")
+	}
+	for name, r := range results {
+		if !r.Passed() {
+			t.Errorf("Test vector %s failed (missing: %v, unexpected: %v)", name, r.Missing, r.Unexpected)
+		}
+	}
+}
+
+func TestEvaluateMeasurementTestVectorMismatch(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.SkipNow()
+	}
+
+	v, err := ReadMeasurementTestVector("testdata/vectors/classic.json")
+	if err != nil {
+		t.Fatalf("ReadMeasurementTestVector failed: %v", err)
+	}
+	computed, err := v.Compute()
+	if err != nil {
+		t.Fatalf("Compute failed: %v", err)
+	}
+
+	v.Expected = []map[int]string{{7: "0000000000000000000000000000000000000000000000000000000000000000"}}
+	r, err := v.Evaluate()
+	if err != nil {
+		t.Fatalf("Evaluate failed: %v", err)
+	}
+	if r.Passed() {
+		t.Errorf("Evaluate should have failed")
+	}
+	if len(r.Missing) != 1 || r.Missing[0][7] != v.Expected[0][7] {
+		t.Errorf("Unexpected missing values: %v", r.Missing)
+	}
+	if len(r.Unexpected) != 1 || r.Unexpected[0][7] != computed[0][7] {
+		t.Errorf("Unexpected unexpected values: %v", r.Unexpected)
+	}
+}
+
+func TestEvaluateMeasurementTestVectorsNoVectors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_TestEvaluateMeasurementTestVectorsNoVectors_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = EvaluateMeasurementTestVectors(dir)
+	if !xerrors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
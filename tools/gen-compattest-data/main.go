@@ -140,6 +140,8 @@ func run() int {
 		return 1
 	}
 	defer tpm.Close()
+	// The simulator has no EK certificate, so the data has to be generated using an unverified connection.
+	tpm.RequireVerifiedSession(false)
 
 	caCertRaw, caKey, err := testutil.CreateTestCA()
 	if err != nil {
@@ -20,6 +20,7 @@
 package secboot
 
 import (
+	"bufio"
 	"bytes"
 	"crypto"
 	"crypto/rsa"
@@ -33,11 +34,14 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/canonical/go-tpm2"
 	"github.com/canonical/go-tpm2/mu"
+	"github.com/canonical/tcglog-parser"
 	"github.com/snapcore/secboot/internal/tcg"
 	"github.com/snapcore/secboot/internal/tcti"
 	"github.com/snapcore/secboot/internal/truststore"
@@ -58,18 +62,39 @@ type TPMDeviceAttributes struct {
 // TPMConnection corresponds to a connection to a TPM device, and is a wrapper around *tpm2.TPMContext.
 type TPMConnection struct {
 	*tpm2.TPMContext
-	verifiedEkCertChain      []*x509.Certificate
-	verifiedDeviceAttributes *TPMDeviceAttributes
-	ek                       tpm2.ResourceContext
-	provisionedSrk           tpm2.ResourceContext
-	hmacSession              tpm2.SessionContext
+	verifiedEkCertChain       []*x509.Certificate
+	verifiedDeviceAttributes  *TPMDeviceAttributes
+	ek                        tpm2.ResourceContext
+	provisionedSrk            tpm2.ResourceContext
+	hmacSession               tpm2.SessionContext
+	hmacSessionEkName         tpm2.Name // Name of the EK used to salt hmacSession, if it is salted
+	requireVerifiedSession    bool
+	firmwareInfo              *tpmFirmwareInfo
+	quirks                    TPMQuirks
+	eventLog                  *tcglog.Log // Cached TCG event log, see EventLog
+	eventLogPath              string      // The path that eventLog was read from
+	progress                  ProgressFunc
+	reuseSessions             bool
+	policySessions            map[tpm2.HashAlgorithmId]tpm2.SessionContext // Policy sessions retained for reuse, see ReuseSessions
+	auditLog                  *AuditLog
+	eventSink                 SecurityEventSink
+	hierarchyAuthFn           HierarchyAuthFunc
+	device                    TPMDevice // The device that this connection was opened from, if known
+	deferredEkCertData        []byte    // EK certificate data to verify on first use, see SecureConnectToDefaultTPMLazy
+	deferredVerifyErr         error     // The error from a failed deferred verification
+	ekCertificateVerifier     EKCertificateVerifyFunc
+	provisioningCheckpointDir string // See SetProvisioningCheckpointDir
+	ekCert                    *x509.Certificate
+	fixedProperties           map[tpm2.Property]uint32
+	timeoutTcti               *commandTimeoutTcti // See SetCommandTimeouts
+	primaryKeysErr            error               // The result of VerifyPrimaryKeys, see PrimaryKeysStatus
 }
 
 // IsEnabled indicates whether the TPM is enabled or whether it has been disabled by the platform firmware. A TPM device can be
 // disabled by the platform firmware by disabling the storage and endorsement hierarchies, but still remain visible to the operating
 // system.
 func (t *TPMConnection) IsEnabled() bool {
-	props, err := t.GetCapabilityTPMProperties(tpm2.PropertyStartupClear, 1, t.HmacSession().IncludeAttrs(tpm2.AttrAudit))
+	props, err := t.GetCapabilityTPMProperties(tpm2.PropertyStartupClear, 1, t.currentHmacSession().IncludeAttrs(tpm2.AttrAudit))
 	if err != nil || len(props) == 0 {
 		return false
 	}
@@ -78,7 +103,8 @@ func (t *TPMConnection) IsEnabled() bool {
 }
 
 // VerifiedEKCertChain returns the verified certificate chain for the endorsement key certificate obtained from this TPM. It was
-// verified using one of the built-in TPM manufacturer root CA certificates.
+// verified using one of the built-in TPM manufacturer root CA certificates. For connections created with
+// SecureConnectToDefaultTPMLazy, this is nil until verification has completed.
 func (t *TPMConnection) VerifiedEKCertChain() []*x509.Certificate {
 	return t.verifiedEkCertChain
 }
@@ -88,6 +114,64 @@ func (t *TPMConnection) VerifiedDeviceAttributes() *TPMDeviceAttributes {
 	return t.verifiedDeviceAttributes
 }
 
+// EKCertificate returns the endorsement key certificate for this TPM. If the connection has been verified, this is the leaf of the
+// chain returned from VerifiedEKCertChain. Otherwise, it is read from the standard NV index on the TPM, and it has not been
+// verified. The result is cached for the lifetime of the connection.
+func (t *TPMConnection) EKCertificate() (*x509.Certificate, error) {
+	if len(t.verifiedEkCertChain) > 0 {
+		return t.verifiedEkCertChain[0], nil
+	}
+	if t.ekCert != nil {
+		return t.ekCert, nil
+	}
+
+	data, err := readEkCertFromTPM(t.TPMContext)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain endorsement key certificate from TPM: %w", err)
+	}
+	cert, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot parse endorsement key certificate: %w", err)
+	}
+	t.ekCert = cert
+	return cert, nil
+}
+
+// EKCertificateDeviceAttributes returns the TPM manufacturer, model and firmware version encoded in the subject alternative name
+// of the endorsement key certificate returned from EKCertificate. If the connection has been verified, this is the same as
+// VerifiedDeviceAttributes. Otherwise, the attributes have not been verified.
+func (t *TPMConnection) EKCertificateDeviceAttributes() (*TPMDeviceAttributes, error) {
+	if t.verifiedDeviceAttributes != nil {
+		return t.verifiedDeviceAttributes, nil
+	}
+
+	cert, err := t.EKCertificate()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range cert.Extensions {
+		if !e.Id.Equal(tcg.OIDExtensionSubjectAltName) {
+			continue
+		}
+		attrs, _, err := parseTPMDeviceAttributesFromSAN(e.Value)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot parse TPM device attributes: %w", err)
+		}
+		return attrs, nil
+	}
+	return nil, errNoTPMDeviceAttributes
+}
+
+// errNoTPMDeviceAttributes is returned from TPMConnection.EKCertificateDeviceAttributes if the EK certificate doesn't have a SAN
+// extension.
+var errNoTPMDeviceAttributes = errors.New("endorsement key certificate has no SAN extension")
+
+// Device returns the TPM device that this connection was opened from. This is nil for connections created with
+// ConnectToTPMOverStream or SecureConnectToTPMOverStream.
+func (t *TPMConnection) Device() TPMDevice {
+	return t.device
+}
+
 // EndorsementKey returns a reference to the TPM's persistent endorsement key, if one exists. If the endorsement key certificate has
 // been verified, the returned ResourceContext will correspond to the object for which the certificate was issued and can safely be
 // used to share secrets with the TPM.
@@ -106,14 +190,62 @@ func (t *TPMConnection) EndorsementKey() (tpm2.ResourceContext, error) {
 // for which the endorsement certificate was issued. If the connection was created with ConnectToDefaultTPM, the session may be
 // salted with a value protected by the public part of the endorsement key if one exists or one is able to be created, but as the key
 // is not associated with a verified credential, there is no guarantee that only the TPM is able to retrieve the session key.
+//
+// If the connection was created with SecureConnectToDefaultTPMLazy, this completes the deferred verification before returning the
+// session. If verification fails, the returned session isn't salted with a value protected by a verified endorsement key, and the
+// error is returned from CompleteVerification. Callers that use this session to transfer secrets to or from the TPM on such a
+// connection must call CompleteVerification first and check the error.
 func (t *TPMConnection) HmacSession() tpm2.SessionContext {
+	t.CompleteVerification()
+	return t.currentHmacSession()
+}
+
+// currentHmacSession returns the current HMAC session without completing any deferred verification. Operations that transfer
+// secrets to or from the TPM must use secretSession instead.
+func (t *TPMConnection) currentHmacSession() tpm2.SessionContext {
 	if t.hmacSession == nil {
 		return nil
 	}
 	return t.hmacSession.WithAttrs(tpm2.AttrContinueSession)
 }
 
+// RequireVerifiedSession specifies whether operations that transfer secrets to or from the TPM must be protected by parameter
+// encryption with a session that is salted with a value protected by a verified endorsement key. These operations are sealing
+// keys, unsealing keys, updating PCR protection policies, changing PINs and changing hierarchy authorization values. This also
+// applies to reading the TPM properties returned from TPMConnection.FixedProperties,
+// TPMConnection.Capabilities and used by TPMConnection.CheckNVSpace, which are audited with the same session. Parameter encryption
+// is always used for these
+// operations, but if the connection was created with ConnectToDefaultTPM then the session may not be salted, or may be salted with
+// a value protected by a key that isn't known to belong to the TPM. In this case, the secrets may be recoverable by an adversary
+// that is able to interpose the communication between the host CPU and the TPM.
+//
+// If this is set to true and the connection doesn't have a verified session, those operations will fail with a
+// ErrNoVerifiedSession error. This is the default for all connections. Connections created with ConnectToDefaultTPM,
+// ConnectToTPMDevice or ConnectToTPMOverStream never have a verified session, so callers that intend to perform these operations
+// on an unverified connection must opt out explicitly by calling this with require set to false.
+func (t *TPMConnection) RequireVerifiedSession(require bool) {
+	t.requireVerifiedSession = require
+}
+
+// hasVerifiedSession indicates whether the HMAC session is salted with a value protected by an endorsement key that has been
+// verified against the endorsement key certificate.
+func (t *TPMConnection) hasVerifiedSession() bool {
+	return len(t.verifiedEkCertChain) > 0 && len(t.hmacSessionEkName) > 0
+}
+
+// secretSession returns the session that should be used for parameter encryption when transferring secrets to or from the TPM.
+func (t *TPMConnection) secretSession() (tpm2.SessionContext, error) {
+	if err := t.CompleteVerification(); err != nil && t.requireVerifiedSession {
+		return nil, err
+	}
+	if t.requireVerifiedSession && !t.hasVerifiedSession() {
+		return nil, ErrNoVerifiedSession
+	}
+	return t.currentHmacSession(), nil
+}
+
 func (t *TPMConnection) Close() error {
+	t.flushPolicySessions()
 	t.FlushContext(t.hmacSession)
 	return t.TPMContext.Close()
 }
@@ -199,6 +331,18 @@ func (t *TPMConnection) init() error {
 	}
 	t.ek = nil
 	t.provisionedSrk = nil
+	t.hmacSessionEkName = nil
+
+	firmwareInfo, err := readTPMFirmwareInfo(t.TPMContext)
+	if err != nil {
+		return xerrors.Errorf("cannot determine TPM firmware version: %w", err)
+	}
+	t.firmwareInfo = firmwareInfo
+	quirks, timeouts := lookupTPMQuirks(firmwareInfo.Manufacturer, firmwareInfo.FirmwareVersion)
+	t.quirks = quirks
+	if timeouts != nil && t.CommandTimeouts() == (TPMCommandTimeouts{}) {
+		t.SetCommandTimeouts(*timeouts)
+	}
 
 	secureMode := len(t.verifiedEkCertChain) > 0
 
@@ -300,9 +444,15 @@ func (t *TPMConnection) init() error {
 	}()
 
 	if secureMode {
-		_, err = t.GetRandom(20, session.WithAttrs(tpm2.AttrContinueSession|tpm2.AttrAudit))
+		command := tpm2.CommandGetRandom
+		if t.quirks&TPMQuirkSlowGetRandom != 0 {
+			command = tpm2.CommandGetCapability
+			_, err = t.GetCapabilityTPMProperties(tpm2.PropertyManufacturer, 1, session.WithAttrs(tpm2.AttrContinueSession|tpm2.AttrAudit))
+		} else {
+			_, err = t.GetRandom(20, session.WithAttrs(tpm2.AttrContinueSession|tpm2.AttrAudit))
+		}
 		if err != nil {
-			if isAuthFailError(err, tpm2.CommandGetRandom, 1) {
+			if isAuthFailError(err, command, 1) {
 				return verificationError{errors.New("endorsement key proof of ownership check failed")}
 			}
 			return xerrors.Errorf("cannot execute command to complete EK proof of ownership check: %w", err)
@@ -314,7 +464,14 @@ func (t *TPMConnection) init() error {
 	if ekIsPersistent() {
 		t.ek = ek
 	}
+	if ek != nil {
+		t.hmacSessionEkName = ek.Name()
+	}
 	t.hmacSession = session
+
+	// Check the primary keys now so that a TPM with a weak or unexpected SRK or EK is detected when connecting. This doesn't
+	// fail the connection, as it may be needed in order to reprovision the TPM.
+	t.primaryKeysErr = t.VerifyPrimaryKeys()
 	return nil
 }
 
@@ -339,28 +496,85 @@ func readEkCertFromTPM(tpm *tpm2.TPMContext) ([]byte, error) {
 	return cert, nil
 }
 
+var tpmSysfsPath = "/sys/class/tpm/tpm0" // sysfs path for the default TPM device
+
+// readTPM12DeviceInfo obtains the details of the default TPM device from sysfs, after it has been determined to be a TPM 1.2 device.
+func readTPM12DeviceInfo() TPM12DeviceError {
+	return readTPM12DeviceInfoFromSysfs(tpmSysfsPath)
+}
+
+// readTPM12DeviceInfoFromSysfs obtains the details of the TPM 1.2 device with the specified sysfs path.
+func readTPM12DeviceInfoFromSysfs(sysPath string) TPM12DeviceError {
+	e := TPM12DeviceError{TCGVersion: "1.2"}
+
+	f, err := os.Open(filepath.Join(sysPath, "device", "caps"))
+	if err != nil {
+		return e
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(fields[1])
+		switch fields[0] {
+		case "Manufacturer":
+			e.Manufacturer = value
+		case "TCG version":
+			e.TCGVersion = value
+		case "Firmware version":
+			e.FirmwareVersion = value
+		}
+	}
+	return e
+}
+
 // connectToDefaultTPM opens a connection to the default TPM device.
-func connectToDefaultTPM() (*tpm2.TPMContext, error) {
+func connectToDefaultTPM() (*tpm2.TPMContext, *commandTimeoutTcti, error) {
 	tcti, err := tcti.OpenDefault()
 	if err != nil {
 		if isPathError(err) {
-			return nil, ErrNoTPM2Device
+			return nil, nil, ErrNoTPM2Device
 		}
-		return nil, xerrors.Errorf("cannot open TPM device: %w", err)
+		return nil, nil, xerrors.Errorf("cannot open TPM device: %w", err)
 	}
 
-	tpm, _ := tpm2.NewTPMContext(tcti)
+	tpm, timeoutTcti, err := connectToTPM(tcti)
+	if err == errNotTPM2Device {
+		return nil, nil, readTPM12DeviceInfo()
+	}
+	return tpm, timeoutTcti, err
+}
+
+// errNotTPM2Device is returned from connectToTPM if the TPM is not a TPM2 device.
+var errNotTPM2Device = errors.New("not a TPM2 device")
+
+// connectToTPM opens a connection to the TPM via the supplied TCTI. The TCTI is closed on failure. On success, it also returns
+// the TCTI wrapper that applies the command timeouts for the connection.
+func connectToTPM(tcti io.ReadWriteCloser) (*tpm2.TPMContext, *commandTimeoutTcti, error) {
+	timeoutTcti := &commandTimeoutTcti{tcti: tcti}
+	tpm, _ := tpm2.NewTPMContext(&testingRetryTcti{tcti: timeoutTcti})
 	isTpm2, err := tpm.IsTPM2()
 	if err != nil {
 		tpm.Close()
-		return nil, xerrors.Errorf("cannot determine if TPM is a TPM2 device: %w", err)
+		return nil, nil, xerrors.Errorf("cannot determine if TPM is a TPM2 device: %w", err)
 	}
 	if !isTpm2 {
 		tpm.Close()
-		return nil, ErrNoTPM2Device
+		return nil, nil, errNotTPM2Device
+	}
+
+	if selfTestOnConnect {
+		if err := ensureSelfTestComplete(tpm); err != nil {
+			tpm.Close()
+			return nil, nil, err
+		}
 	}
 
-	return tpm, nil
+	return tpm, timeoutTcti, nil
 }
 
 func isExtKeyUsageAny(usage []x509.ExtKeyUsage) bool {
@@ -544,11 +758,13 @@ type ekCertData struct {
 }
 
 // verifyEkCertificate verifies the provided certificate and intermediate certificates against the built-in roots, and verifies
-// that the certificate is a valid EK certificate, according to the "TCG EK Credential Profile" specification.
+// that the certificate is a valid EK certificate, according to the "TCG EK Credential Profile" specification. If profile is not
+// nil, the certificate is verified against the roots from the profile instead, and the profile may relax some of the requirements
+// of the TCG specification.
 //
 // On success, it returns a verified certificate chain. This function will also return success if there is no certificate and
 // it is executed inside a guest VM, in order to support fallback to a non-secure connection when using swtpm in a guest VM.
-func verifyEkCertificate(data *ekCertData) ([]*x509.Certificate, *TPMDeviceAttributes, error) {
+func verifyEkCertificate(data *ekCertData, profile *EKVerificationProfile, verify EKCertificateVerifyFunc) ([]*x509.Certificate, *TPMDeviceAttributes, error) {
 	// Parse EK cert
 	cert, err := x509.ParseCertificate(data.Cert)
 	if err != nil {
@@ -558,14 +774,22 @@ func verifyEkCertificate(data *ekCertData) ([]*x509.Certificate, *TPMDeviceAttri
 	// Parse other certs, building root and intermediates store
 	roots := x509.NewCertPool()
 	intermediates := x509.NewCertPool()
+	if profile != nil {
+		for _, c := range profile.Roots {
+			roots.AddCert(c)
+		}
+	}
 	for _, d := range data.Parents {
 		c, err := x509.ParseCertificate(d)
 		if err != nil {
 			return nil, nil, xerrors.Errorf("cannot parse certificate: %w", err)
 		}
-		if isCertificateTrustedCA(c) {
+		switch {
+		case profile != nil && profile.isRoot(c):
+			// Already added
+		case profile == nil && isCertificateTrustedCA(c):
 			roots.AddCert(c)
-		} else {
+		default:
 			intermediates.AddCert(c)
 		}
 	}
@@ -591,6 +815,10 @@ func verifyEkCertificate(data *ekCertData) ([]*x509.Certificate, *TPMDeviceAttri
 			attrs, attrsRDN, err = parseTPMDeviceAttributesFromSAN(e.Value)
 			// SubjectAltName MUST include TPM manufacturer, model and firmware version
 			if err != nil {
+				if profile != nil && profile.DeviceAttributesOptional {
+					attrs = nil
+					break
+				}
 				return nil, nil, xerrors.Errorf("cannot parse TPM device attributes: %w", err)
 			}
 			if len(cert.Subject.Names) == 0 {
@@ -603,7 +831,7 @@ func verifyEkCertificate(data *ekCertData) ([]*x509.Certificate, *TPMDeviceAttri
 	}
 
 	// SubjectAltName MUST exist. If it does exist but doesn't contain the correct TPM device attributes, we would have returned earlier.
-	if attrs == nil {
+	if attrs == nil && (profile == nil || !profile.DeviceAttributesOptional) {
 		return nil, nil, errors.New("certificate has no SAN extension")
 	}
 
@@ -627,7 +855,12 @@ func verifyEkCertificate(data *ekCertData) ([]*x509.Certificate, *TPMDeviceAttri
 		Intermediates: intermediates,
 		Roots:         roots,
 		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
-	candidates, err := cert.Verify(opts)
+	if verify == nil {
+		verify = func(cert *x509.Certificate, opts x509.VerifyOptions) ([][]*x509.Certificate, error) {
+			return cert.Verify(opts)
+		}
+	}
+	candidates, err := verify(cert, opts)
 	if err != nil {
 		return nil, nil, xerrors.Errorf("certificate verification failed: %w", err)
 	}
@@ -635,7 +868,10 @@ func verifyEkCertificate(data *ekCertData) ([]*x509.Certificate, *TPMDeviceAttri
 	// Extended Key Usage MUST contain tcg-kp-EKCertificate (and also require that the usage is nested)
 	var chain []*x509.Certificate
 	for _, c := range candidates {
-		if checkChainForEkCertUsage(c) {
+		if len(c) == 0 || !bytes.Equal(c[0].Raw, cert.Raw) {
+			continue
+		}
+		if (profile != nil && profile.EKUsageOptional) || checkChainForEkCertUsage(c) {
 			chain = c
 			break
 		}
@@ -827,16 +1063,35 @@ func EncodeEKCertificateChain(ekCert *x509.Certificate, parents []*x509.Certific
 // ConnectToDefaultTPM will attempt to connect to the default TPM. It makes no attempt to verify the authenticity of the TPM. This
 // function is useful for connecting to a device that isn't correctly provisioned and for which the endorsement hierarchy
 // authorization value is unknown (so that it can be cleared), or for connecting to a device in order to execute
-// FetchAndSaveEKCertificateChain. It should not be used in any other scenario.
+// FetchAndSaveEKCertificateChain. It should not be used in any other scenario. Operations that transfer secrets to or from the TPM
+// will fail with a ErrNoVerifiedSession error on the returned connection unless TPMConnection.RequireVerifiedSession is called
+// to opt out of verified sessions.
 //
-// If no TPM2 device is available, then a ErrNoTPM2Device error will be returned.
-func ConnectToDefaultTPM() (*TPMConnection, error) {
-	tpm, err := connectToDefaultTPM()
+// If no TPM2 device is available, then a ErrNoTPM2Device error will be returned. If the only TPM device is a TPM 1.2 device, then a
+// TPM12DeviceError error will be returned, which wraps ErrNoTPM2Device.
+//
+// If self test on connect has been enabled with SetSelfTestOnConnect, this function will return a TPMSelfTestError error if the
+// TPM's self test fails, or a ErrTPMSelfTestIncomplete error if it doesn't complete in a reasonable time.
+func ConnectToDefaultTPM() (_ *TPMConnection, err error) {
+	defer observeOperation(MetricsOperationConnect, time.Now(), &err)
+
+	tpm, timeoutTcti, err := connectToDefaultTPM()
 	if err != nil {
 		return nil, err
 	}
 
-	t := &TPMConnection{TPMContext: tpm}
+	t, err := newUnverifiedTPMConnection(tpm, timeoutTcti)
+	if err != nil {
+		return nil, err
+	}
+	t.device = DefaultTPMDevice()
+	return t, nil
+}
+
+// newUnverifiedTPMConnection creates a new TPMConnection for the supplied TPM context without verifying the authenticity of the
+// TPM. The TPM context is closed on failure.
+func newUnverifiedTPMConnection(tpm *tpm2.TPMContext, timeoutTcti *commandTimeoutTcti) (*TPMConnection, error) {
+	t := &TPMConnection{TPMContext: tpm, timeoutTcti: timeoutTcti, requireVerifiedSession: true}
 
 	succeeded := false
 	defer func() {
@@ -885,16 +1140,60 @@ func ConnectToDefaultTPM() (*TPMConnection, error) {
 // endorsement key certificate was issued, and creation of a transient endorsement key fails because the correct endorsement hierarchy
 // authorization value hasn't been provided via the endorsementAuth argument.
 //
-// If no TPM2 device is available, then a ErrNoTPM2Device error will be returned.
+// If a directory has been set with SetEKVerificationCacheDir, a previously cached result of verifying the endorsement key
+// certificate is used if it is still valid for the TPM's persistent endorsement key and the supplied data.
+//
+// If no TPM2 device is available, then a ErrNoTPM2Device error will be returned. If the only TPM device is a TPM 1.2 device, then a
+// TPM12DeviceError error will be returned, which wraps ErrNoTPM2Device.
+//
+// If self test on connect has been enabled with SetSelfTestOnConnect, this function will return a TPMSelfTestError error if the
+// TPM's self test fails, or a ErrTPMSelfTestIncomplete error if it doesn't complete in a reasonable time.
 func SecureConnectToDefaultTPM(ekCertDataReader io.Reader, endorsementAuth []byte) (*TPMConnection, error) {
+	return SecureConnectToDefaultTPMWithOptions(ekCertDataReader, endorsementAuth, nil)
+}
+
+// SecureConnectToDefaultTPMWithOptions behaves like SecureConnectToDefaultTPM, but the opts argument can be used to customize
+// verification of the endorsement key certificate (see SecureConnectOptions). It may be nil, in which case the built-in
+// verification is used.
+func SecureConnectToDefaultTPMWithOptions(ekCertDataReader io.Reader, endorsementAuth []byte, opts *SecureConnectOptions) (_ *TPMConnection, err error) {
+	defer observeOperation(MetricsOperationConnect, time.Now(), &err)
+
 	if ekCertDataReader == nil {
 		return nil, errors.New("no EK certificate data was provided")
 	}
 
-	tpm, err := connectToDefaultTPM()
+	tpm, timeoutTcti, err := connectToDefaultTPM()
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := newVerifiedTPMConnection(tpm, timeoutTcti, ekCertDataReader, endorsementAuth, opts)
 	if err != nil {
 		return nil, err
 	}
+	t.device = DefaultTPMDevice()
+	return t, nil
+}
+
+// SecureConnectOptions contains options for SecureConnectToDefaultTPMWithOptions and the other secure connection functions.
+type SecureConnectOptions struct {
+	// EKCertificateVerifier is used to verify the endorsement key certificate in place of the built-in verification, eg, to
+	// enforce CRL or OCSP checks. Cached verification results (see SetEKVerificationCacheDir) are not used when this is set, so
+	// that it is consulted on every connection.
+	EKCertificateVerifier EKCertificateVerifyFunc
+}
+
+// applySecureConnectOptions applies the supplied options to this connection.
+func (t *TPMConnection) applySecureConnectOptions(opts *SecureConnectOptions) {
+	if opts == nil {
+		return
+	}
+	t.ekCertificateVerifier = opts.EKCertificateVerifier
+}
+
+// newVerifiedTPMConnection creates a new TPMConnection for the supplied TPM context, after verifying the authenticity of the TPM
+// using the EK certificate data read from ekCertDataReader. See SecureConnectToDefaultTPM. The TPM context is closed on failure.
+func newVerifiedTPMConnection(tpm *tpm2.TPMContext, timeoutTcti *commandTimeoutTcti, ekCertDataReader io.Reader, endorsementAuth []byte, opts *SecureConnectOptions) (*TPMConnection, error) {
 	tpm.EndorsementHandleContext().SetAuthValue(endorsementAuth)
 
 	succeeded := false
@@ -905,25 +1204,55 @@ func SecureConnectToDefaultTPM(ekCertDataReader io.Reader, endorsementAuth []byt
 		tpm.Close()
 	}()
 
-	t := &TPMConnection{TPMContext: tpm}
+	t := &TPMConnection{TPMContext: tpm, timeoutTcti: timeoutTcti, requireVerifiedSession: true}
+	t.applySecureConnectOptions(opts)
+	if err := t.verify(ekCertDataReader, t.persistentEKVerificationCache()); err != nil {
+		return nil, err
+	}
 
+	succeeded = true
+	return t, nil
+}
+
+// verify verifies the EK certificate data read from ekCertDataReader and then reinitializes this connection with a session
+// that is salted with a value protected by the verified endorsement key. If cache is not nil, it is used to avoid verifying the
+// same certificate data more than once.
+func (t *TPMConnection) verify(ekCertDataReader io.Reader, cache *ekVerificationCache) error {
 	var certData *ekCertData
 	// Unmarshal supplied EK cert data
 	if _, err := mu.UnmarshalFromReader(ekCertDataReader, &certData); err != nil {
-		return nil, EKCertVerificationError{fmt.Sprintf("cannot unmarshal supplied EK certificate data: %v", err)}
+		return EKCertVerificationError{fmt.Sprintf("cannot unmarshal supplied EK certificate data: %v", err)}
 	}
 	if len(certData.Cert) == 0 {
 		// The supplied data only contains parent certificates. Retrieve the EK cert from the TPM.
-		if cert, err := readEkCertFromTPM(tpm); err != nil {
-			return nil, EKCertVerificationError{fmt.Sprintf("cannot obtain endorsement key certificate from TPM: %v", err)}
+		if cert, err := readEkCertFromTPM(t.TPMContext); err != nil {
+			return EKCertVerificationError{fmt.Sprintf("cannot obtain endorsement key certificate from TPM: %v", err)}
 		} else {
 			certData.Cert = cert
 		}
 	}
 
-	chain, attrs, err := verifyEkCertificate(certData)
-	if err != nil {
-		return nil, EKCertVerificationError{err.Error()}
+	if t.ekCertificateVerifier != nil {
+		// The result of a caller supplied verification may change over time (eg, if a certificate is revoked).
+		cache = nil
+	}
+
+	var profile *EKVerificationProfile
+	if info, err := readTPMFirmwareInfo(t.TPMContext); err == nil {
+		profile = lookupEKVerificationProfile(info.Manufacturer, func() bool {
+			env, err := t.Environment()
+			return err == nil && env.Class == TPMEnvironmentVirtual
+		})
+	}
+
+	chain, attrs, ok := cache.lookup(certData, profile)
+	if !ok {
+		var err error
+		chain, attrs, err = verifyEkCertificate(certData, profile, t.ekCertificateVerifier)
+		if err != nil {
+			return EKCertVerificationError{err.Error() + virtualTPMEKCertHint(t.TPMContext)}
+		}
+		cache.store(certData, profile, chain, attrs)
 	}
 
 	t.verifiedEkCertChain = chain
@@ -931,15 +1260,291 @@ func SecureConnectToDefaultTPM(ekCertDataReader io.Reader, endorsementAuth []byt
 
 	if err := t.init(); err != nil {
 		if tpm2.IsResourceUnavailableError(err, tpm2.AnyHandle) {
-			return nil, ErrTPMProvisioning
+			return ErrTPMProvisioning
 		}
 		var verifyErr verificationError
 		if xerrors.As(err, &verifyErr) {
-			return nil, TPMVerificationError{err.Error()}
+			return TPMVerificationError{err.Error()}
 		}
-		return nil, xerrors.Errorf("cannot initialize TPM connection: %w", err)
+		return xerrors.Errorf("cannot initialize TPM connection: %w", err)
 	}
 
-	succeeded = true
+	return nil
+}
+
+// SecureConnectToDefaultTPMLazy connects to the default TPM in the same way as SecureConnectToDefaultTPM, but defers verification
+// of the EK certificate and the TPM until the first operation that transfers secrets to or from the TPM (see
+// RequireVerifiedSession), until HmacSession is called, or until CompleteVerification is called. This avoids the cost of
+// verification during boots that don't need a verified session.
+//
+// If the TPM has a persistent EK, the result of verifying the EK certificate data is cached in the runtime state directory set
+// with SetStateDir, which is /run by default and so only lasts for the current boot, or in the directory set with
+// SetEKVerificationCacheDir if there is one, so that subsequent connections don't need to repeat the X.509 certificate
+// verification. Cached results are discarded if the name of the persistent EK changes. The TPM is still required to prove that it
+// is the device for which the cached EK certificate was issued each time. The state directory must only be writable by root.
+//
+// The ekCertDataReader argument is read in full before this function returns. The errors that would be returned from
+// SecureConnectToDefaultTPM because of a verification failure are instead returned from the first operation that requires a
+// verified session, and from CompleteVerification. Until verification completes, VerifiedEKCertChain and
+// VerifiedDeviceAttributes return nil. If verification fails, HmacSession returns a session that isn't salted with a verified
+// endorsement key.
+func SecureConnectToDefaultTPMLazy(ekCertDataReader io.Reader, endorsementAuth []byte) (*TPMConnection, error) {
+	return SecureConnectToDefaultTPMLazyWithOptions(ekCertDataReader, endorsementAuth, nil)
+}
+
+// SecureConnectToDefaultTPMLazyWithOptions behaves like SecureConnectToDefaultTPMLazy, but accepts options in the same way as
+// SecureConnectToDefaultTPMWithOptions.
+func SecureConnectToDefaultTPMLazyWithOptions(ekCertDataReader io.Reader, endorsementAuth []byte, opts *SecureConnectOptions) (_ *TPMConnection, err error) {
+	defer observeOperation(MetricsOperationConnect, time.Now(), &err)
+
+	if ekCertDataReader == nil {
+		return nil, errors.New("no EK certificate data was provided")
+	}
+	data, err := ioutil.ReadAll(ekCertDataReader)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read EK certificate data: %w", err)
+	}
+
+	tpm, timeoutTcti, err := connectToDefaultTPM()
+	if err != nil {
+		return nil, err
+	}
+	tpm.EndorsementHandleContext().SetAuthValue(endorsementAuth)
+
+	t, err := newUnverifiedTPMConnection(tpm, timeoutTcti)
+	if err != nil {
+		return nil, err
+	}
+	t.device = DefaultTPMDevice()
+	t.applySecureConnectOptions(opts)
+	t.deferredEkCertData = data
+	return t, nil
+}
+
+// CompleteVerification completes the deferred verification of a connection created with SecureConnectToDefaultTPMLazy. It
+// returns the same errors that SecureConnectToDefaultTPM would return if verification fails, in which case the connection
+// remains usable for operations that don't require a verified session and the same error is returned from subsequent calls. If
+// an unverified session can't be restored after a failure, an error that wraps the reason is returned and the connection
+// should be closed.
+// It does nothing for connections that weren't created with SecureConnectToDefaultTPMLazy or that have already been verified.
+func (t *TPMConnection) CompleteVerification() error {
+	if t.deferredVerifyErr != nil {
+		return t.deferredVerifyErr
+	}
+	if t.deferredEkCertData == nil {
+		return nil
+	}
+
+	data := t.deferredEkCertData
+	t.deferredEkCertData = nil
+
+	cache := t.persistentEKVerificationCache()
+	if cache == nil {
+		cache = t.ekVerificationCacheAt(ekVerificationCachePath())
+	}
+	if err := t.verify(bytes.NewReader(data), cache); err != nil {
+		if t.verifiedEkCertChain == nil {
+			// Verification failed before the connection was reinitialized, so the unverified session is still intact.
+			t.deferredVerifyErr = err
+			return err
+		}
+
+		// Reinitializing the connection with the verified EK failed, which flushes the unverified session. Restore an
+		// unverified session so that the connection is still usable.
+		t.verifiedEkCertChain = nil
+		t.verifiedDeviceAttributes = nil
+		if initErr := t.init(); initErr != nil {
+			err = xerrors.Errorf("cannot restore unverified session after verification failed with \"%v\": %w", err, initErr)
+		}
+		t.deferredVerifyErr = err
+		return err
+	}
+	return nil
+}
+
+// ConnectToTPMOverStream will attempt to connect to a TPM over the supplied stream, such as a SSH channel to a remote device. The
+// remote end of the stream must pass each command to the TPM and write back the response, which can be done with
+// ServeTPMOverStream. Like ConnectToDefaultTPM, this makes no attempt to verify the authenticity of the TPM. The stream is closed
+// when the returned connection is closed, or if this function fails.
+//
+// If the remote TPM is not a TPM2 device, a ErrNoTPM2Device error will be returned.
+//
+// If self test on connect has been enabled with SetSelfTestOnConnect, this function will return a TPMSelfTestError error if the
+// TPM's self test fails, or a ErrTPMSelfTestIncomplete error if it doesn't complete in a reasonable time.
+func ConnectToTPMOverStream(stream io.ReadWriteCloser) (_ *TPMConnection, err error) {
+	defer observeOperation(MetricsOperationConnect, time.Now(), &err)
+
+	tpm, timeoutTcti, err := connectToTPM(tcti.NewStream(stream))
+	if err == errNotTPM2Device {
+		return nil, ErrNoTPM2Device
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newUnverifiedTPMConnection(tpm, timeoutTcti)
+}
+
+// SecureConnectToTPMOverStream will attempt to connect to a TPM over the supplied stream, such as a SSH channel to a remote device,
+// and then verify the authenticity of the TPM in the same way as SecureConnectToDefaultTPM. The remote end of the stream must pass
+// each command to the TPM and write back the response, which can be done with ServeTPMOverStream. The stream is closed when the
+// returned connection is closed, or if this function fails.
+//
+// The stream must still be trusted to some degree. Commands that use the session salted with the endorsement key of the verified
+// TPM benefit from parameter encryption and response integrity protection, so secrets sealed to or unsealed from the TPM are
+// protected from the stream. However, not every command uses this session - eg, commands that read capabilities, PCR values or
+// public areas without an audit session are sent unprotected, and their responses can be observed and modified by the stream. The
+// supplied endorsementAuth is also sent in the clear if the endorsement key needs to be created before the session can be
+// established. The stream can always deny service by dropping or delaying commands.
+//
+// If the remote TPM is not a TPM2 device, a ErrNoTPM2Device error will be returned. See SecureConnectToDefaultTPM for a
+// description of the other errors that can be returned.
+func SecureConnectToTPMOverStream(stream io.ReadWriteCloser, ekCertDataReader io.Reader, endorsementAuth []byte) (*TPMConnection, error) {
+	return SecureConnectToTPMOverStreamWithOptions(stream, ekCertDataReader, endorsementAuth, nil)
+}
+
+// SecureConnectToTPMOverStreamWithOptions behaves like SecureConnectToTPMOverStream, but accepts options in the same way as
+// SecureConnectToDefaultTPMWithOptions.
+func SecureConnectToTPMOverStreamWithOptions(stream io.ReadWriteCloser, ekCertDataReader io.Reader, endorsementAuth []byte, opts *SecureConnectOptions) (_ *TPMConnection, err error) {
+	defer observeOperation(MetricsOperationConnect, time.Now(), &err)
+
+	if ekCertDataReader == nil {
+		stream.Close()
+		return nil, errors.New("no EK certificate data was provided")
+	}
+
+	tpm, timeoutTcti, err := connectToTPM(tcti.NewStream(stream))
+	if err == errNotTPM2Device {
+		return nil, ErrNoTPM2Device
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newVerifiedTPMConnection(tpm, timeoutTcti, ekCertDataReader, endorsementAuth, opts)
+}
+
+// ServeTPMOverStream provides access to the default TPM to a remote host connected via the supplied stream. It reads commands from
+// the stream, submits them to the TPM and writes the responses back to the stream until the stream is closed by the remote host.
+// The remote host connects using ConnectToTPMOverStream or SecureConnectToTPMOverStream.
+//
+// This is intended to be run on a device from a SSH session or agent, with its standard input and output connected to the stream.
+// It does not authenticate the remote host - access should be restricted by the transport.
+//
+// If no TPM2 device is available, then a ErrNoTPM2Device error will be returned.
+func ServeTPMOverStream(stream io.ReadWriter) error {
+	device, err := tcti.OpenDefault()
+	if err != nil {
+		if isPathError(err) {
+			return ErrNoTPM2Device
+		}
+		return xerrors.Errorf("cannot open TPM device: %w", err)
+	}
+	defer device.Close()
+
+	return tcti.Serve(stream, device)
+}
+
+// TPMDevice corresponds to a TPM device that can be connected to with ConnectToTPMDevice or SecureConnectToTPMDevice.
+type TPMDevice interface {
+	// Open opens the device and returns a TCTI for communicating with it.
+	Open() (io.ReadWriteCloser, error)
+
+	String() string
+}
+
+// DefaultTPMDevice returns the default TPM device for the current platform. This is the TPM character device on Linux and the TPM
+// Base Services interface on Windows.
+func DefaultTPMDevice() TPMDevice {
+	return tcti.DefaultDevice
+}
+
+// NewCharTPMDevice returns a TPMDevice corresponding to the TPM character device at the specified path, such as /dev/tpm0 or
+// /dev/tpmrm0 on Linux.
+func NewCharTPMDevice(path string) TPMDevice {
+	return tcti.CharDevice{Path: path}
+}
+
+// NewTBSTPMDevice returns a TPMDevice corresponding to the TPM Base Services interface on Windows. Opening the returned device
+// fails on other platforms.
+func NewTBSTPMDevice() TPMDevice {
+	return tcti.TBSDevice{}
+}
+
+// NewSimulatorTPMDevice returns a TPMDevice corresponding to a TPM simulator that implements the Microsoft TPM2 simulator interface,
+// listening on the specified host and port. An empty host means the local host. The platform interface is expected to be on the port
+// following the supplied one.
+func NewSimulatorTPMDevice(host string, port uint) TPMDevice {
+	return tcti.SimulatorDevice{Host: host, Port: port}
+}
+
+// connectToTPMDevice opens a connection to the specified TPM device.
+func connectToTPMDevice(device TPMDevice) (*tpm2.TPMContext, *commandTimeoutTcti, error) {
+	t, err := device.Open()
+	if err != nil {
+		if isPathError(err) {
+			return nil, nil, ErrNoTPM2Device
+		}
+		return nil, nil, xerrors.Errorf("cannot open TPM device %s: %w", device, err)
+	}
+
+	tpm, timeoutTcti, err := connectToTPM(t)
+	if err == errNotTPM2Device {
+		return nil, nil, ErrNoTPM2Device
+	}
+	return tpm, timeoutTcti, err
+}
+
+// ConnectToTPMDevice will attempt to connect to the specified TPM device. It makes no attempt to verify the authenticity of the TPM.
+// See ConnectToDefaultTPM for the scenarios in which this is appropriate.
+//
+// If the device is not available or is not a TPM2 device, then a ErrNoTPM2Device error will be returned.
+//
+// If self test on connect has been enabled with SetSelfTestOnConnect, this function will return a TPMSelfTestError error if the
+// TPM's self test fails, or a ErrTPMSelfTestIncomplete error if it doesn't complete in a reasonable time.
+func ConnectToTPMDevice(device TPMDevice) (_ *TPMConnection, err error) {
+	defer observeOperation(MetricsOperationConnect, time.Now(), &err)
+
+	tpm, timeoutTcti, err := connectToTPMDevice(device)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := newUnverifiedTPMConnection(tpm, timeoutTcti)
+	if err != nil {
+		return nil, err
+	}
+	t.device = device
+	return t, nil
+}
+
+// SecureConnectToTPMDevice will attempt to connect to the specified TPM device and then verify the authenticity of the TPM in the
+// same way as SecureConnectToDefaultTPM.
+//
+// If the device is not available or is not a TPM2 device, then a ErrNoTPM2Device error will be returned. See
+// SecureConnectToDefaultTPM for a description of the other errors that can be returned.
+func SecureConnectToTPMDevice(device TPMDevice, ekCertDataReader io.Reader, endorsementAuth []byte) (*TPMConnection, error) {
+	return SecureConnectToTPMDeviceWithOptions(device, ekCertDataReader, endorsementAuth, nil)
+}
+
+// SecureConnectToTPMDeviceWithOptions behaves like SecureConnectToTPMDevice, but accepts options in the same way as
+// SecureConnectToDefaultTPMWithOptions.
+func SecureConnectToTPMDeviceWithOptions(device TPMDevice, ekCertDataReader io.Reader, endorsementAuth []byte, opts *SecureConnectOptions) (_ *TPMConnection, err error) {
+	defer observeOperation(MetricsOperationConnect, time.Now(), &err)
+
+	if ekCertDataReader == nil {
+		return nil, errors.New("no EK certificate data was provided")
+	}
+
+	tpm, timeoutTcti, err := connectToTPMDevice(device)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := newVerifiedTPMConnection(tpm, timeoutTcti, ekCertDataReader, endorsementAuth, opts)
+	if err != nil {
+		return nil, err
+	}
+	t.device = device
 	return t, nil
 }
@@ -0,0 +1,58 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/snapcore/secboot"
+
+	"golang.org/x/xerrors"
+
+	. "gopkg.in/check.v1"
+)
+
+type tpm12Suite struct{}
+
+var _ = Suite(&tpm12Suite{})
+
+func (s *tpm12Suite) TestReadTPM12DeviceInfo(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(dir, "device"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "device", "caps"),
+		[]byte("Manufacturer: 0x49465800\nTCG version: 1.2\nFirmware version: 6.40\n"), 0644), IsNil)
+
+	restore := MockTPMSysfsPath(dir)
+	defer restore()
+
+	err := ReadTPM12DeviceInfo()
+	c.Check(err, DeepEquals, TPM12DeviceError{Manufacturer: "0x49465800", TCGVersion: "1.2", FirmwareVersion: "6.40"})
+	c.Check(xerrors.Is(err, ErrNoTPM2Device), Equals, true)
+	c.Check(err.Error(), Equals, "no TPM2 device is available (found a TPM 1.2 device)")
+}
+
+func (s *tpm12Suite) TestReadTPM12DeviceInfoNoCaps(c *C) {
+	restore := MockTPMSysfsPath(c.MkDir())
+	defer restore()
+
+	c.Check(ReadTPM12DeviceInfo(), DeepEquals, TPM12DeviceError{TCGVersion: "1.2"})
+}
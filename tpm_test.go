@@ -22,15 +22,23 @@ package secboot_test
 import (
 	"bytes"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"syscall"
 	"testing"
 
 	"github.com/canonical/go-tpm2"
 	. "github.com/snapcore/secboot"
 	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/tcti"
 	"github.com/snapcore/secboot/internal/testutil"
 )
 
@@ -192,6 +200,41 @@ func TestConnectToDefaultTPM(t *testing.T) {
 	})
 }
 
+func TestConnectToDefaultTPMRequiresVerifiedSession(t *testing.T) {
+	if !testutil.UseMssim {
+		t.SkipNow()
+	}
+
+	restore := testutil.MockOpenDefaultTctiFn(func() (io.ReadWriteCloser, error) {
+		return tpm2.OpenMssim("", testutil.MssimPort, testutil.MssimPort+1)
+	})
+	defer restore()
+
+	tpm, err := ConnectToDefaultTPM()
+	if err != nil {
+		t.Fatalf("ConnectToDefaultTPM failed: %v", err)
+	}
+	defer closeTPM(t, tpm)
+
+	tmpDir, err := ioutil.TempDir("", "_TestConnectToDefaultTPMRequiresVerifiedSession_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	params := &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: tpm2.HandleNull}
+
+	if _, err := SealKeyToTPM(tpm, key, filepath.Join(tmpDir, "keydata1"), params); err != ErrNoVerifiedSession {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	tpm.RequireVerifiedSession(false)
+	if _, err := SealKeyToTPM(tpm, key, filepath.Join(tmpDir, "keydata2"), params); err != nil {
+		t.Errorf("SealKeyToTPM failed: %v", err)
+	}
+}
+
 func TestConnectToDefaultTPMNoTPM(t *testing.T) {
 	restore := testutil.MockOpenDefaultTctiFn(func() (io.ReadWriteCloser, error) {
 		return nil, &os.PathError{Op: "open", Path: "/dev/tpm0", Err: syscall.ENOENT}
@@ -207,6 +250,87 @@ func TestConnectToDefaultTPMNoTPM(t *testing.T) {
 	}
 }
 
+func TestConnectToTPMOverStream(t *testing.T) {
+	if !testutil.UseMssim {
+		t.SkipNow()
+	}
+
+	device, err := tpm2.OpenMssim("", testutil.MssimPort, testutil.MssimPort+1)
+	if err != nil {
+		t.Fatalf("OpenMssim failed: %v", err)
+	}
+	defer device.Close()
+
+	client, server := net.Pipe()
+
+	serveErr := make(chan error)
+	go func() {
+		serveErr <- tcti.Serve(server, device)
+	}()
+
+	tpm, err := ConnectToTPMOverStream(client)
+	if err != nil {
+		t.Fatalf("ConnectToTPMOverStream failed: %v", err)
+	}
+
+	session := tpm.HmacSession()
+	if session == nil || session.Handle().Type() != tpm2.HandleTypeHMACSession {
+		t.Errorf("TPMConnection.HmacSession returned invalid session context")
+	}
+	if _, err := tpm.GetRandom(16); err != nil {
+		t.Errorf("GetRandom failed: %v", err)
+	}
+
+	closeTPM(t, tpm)
+
+	if err := <-serveErr; err != nil {
+		t.Errorf("Serve failed: %v", err)
+	}
+}
+
+func TestServeTPMOverStreamNoTPM(t *testing.T) {
+	restore := testutil.MockOpenDefaultTctiFn(func() (io.ReadWriteCloser, error) {
+		return nil, &os.PathError{Op: "open", Path: "/dev/tpm0", Err: syscall.ENOENT}
+	})
+	defer restore()
+
+	if err := ServeTPMOverStream(new(bytes.Buffer)); err != ErrNoTPM2Device {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestConnectToTPMDevice(t *testing.T) {
+	if !testutil.UseMssim {
+		t.SkipNow()
+	}
+
+	device := NewSimulatorTPMDevice("", testutil.MssimPort)
+	if device.String() != fmt.Sprintf("mssim:localhost:%d", testutil.MssimPort) {
+		t.Errorf("Unexpected device name: %s", device)
+	}
+
+	tpm, err := ConnectToTPMDevice(device)
+	if err != nil {
+		t.Fatalf("ConnectToTPMDevice failed: %v", err)
+	}
+	defer closeTPM(t, tpm)
+
+	session := tpm.HmacSession()
+	if session == nil || session.Handle().Type() != tpm2.HandleTypeHMACSession {
+		t.Errorf("TPMConnection.HmacSession returned invalid session context")
+	}
+}
+
+func TestConnectToTPMDeviceNoTPM(t *testing.T) {
+	tpm, err := ConnectToTPMDevice(NewCharTPMDevice("/dev/nonexistent-tpm"))
+	if tpm != nil {
+		t.Errorf("ConnectToTPMDevice should have failed")
+	}
+	if err != ErrNoTPM2Device {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
 func TestSecureConnectToDefaultTPM(t *testing.T) {
 	if !testutil.UseMssim {
 		t.SkipNow()
@@ -433,6 +557,62 @@ func TestSecureConnectToDefaultTPM(t *testing.T) {
 		}
 	})
 
+	t.Run("EkCertVerificationProfile", func(t *testing.T) {
+		// Test that an EK cert from an issuer that isn't trusted by default is accepted with a registered profile
+		func() {
+			tpm := connectAndClear(t)
+			defer closeTPM(t, tpm)
+		}()
+
+		caCertRaw, caKey, err := testutil.CreateTestCA()
+		if err != nil {
+			t.Fatalf("createTestCA failed: %v", err)
+		}
+		caCert, _ := x509.ParseCertificate(caCertRaw)
+
+		certData := func() io.Reader {
+			tpm, err := ConnectToDefaultTPM()
+			if err != nil {
+				t.Fatalf("ConnectToDefaultTPM failed: %v", err)
+			}
+			defer closeTPM(t, tpm)
+
+			certRaw, err := testutil.CreateTestEKCert(tpm.TPMContext, caCertRaw, caKey)
+			if err != nil {
+				t.Fatalf("createTestEkCert failed: %v", err)
+			}
+			cert, _ := x509.ParseCertificate(certRaw)
+
+			b := new(bytes.Buffer)
+			if err := EncodeEKCertificateChain(cert, []*x509.Certificate{caCert}, b); err != nil {
+				t.Fatalf("EncodeEKCertificateChain failed: %v", err)
+			}
+			return b
+		}()
+
+		profile := &EKVerificationProfile{
+			Name:          "test",
+			Manufacturers: []tpm2.TPMManufacturer{tpm2.TPMManufacturerIBM},
+			Roots:         []*x509.Certificate{caCert}}
+		if err := RegisterEKVerificationProfile(profile); err != nil {
+			t.Fatalf("RegisterEKVerificationProfile failed: %v", err)
+		}
+		defer UnregisterEKVerificationProfile(profile)
+
+		tpm, err := SecureConnectToDefaultTPM(certData, nil)
+		if err != nil {
+			t.Fatalf("SecureConnectToDefaultTPM failed: %v", err)
+		}
+		defer closeTPM(t, tpm)
+
+		if len(tpm.VerifiedEKCertChain()) != 2 {
+			t.Fatalf("Unexpected number of certificates in chain")
+		}
+		if !bytes.Equal(tpm.VerifiedEKCertChain()[1].Raw, caCertRaw) {
+			t.Errorf("Unexpected root certificate")
+		}
+	})
+
 	t.Run("IncorrectPersistentEK", func(t *testing.T) {
 		// Test that we verify successfully using a transient EK if the persistent EK doesn't match the certificate
 		func() {
@@ -524,3 +704,459 @@ func TestSecureConnectToDefaultTPM(t *testing.T) {
 		}
 	})
 }
+
+func TestSecureConnectToDefaultTPMLazy(t *testing.T) {
+	if !testutil.UseMssim {
+		t.SkipNow()
+	}
+
+	restore := testutil.MockOpenDefaultTctiFn(func() (io.ReadWriteCloser, error) {
+		return tpm2.OpenMssim("", testutil.MssimPort, testutil.MssimPort+1)
+	})
+	defer restore()
+
+	func() {
+		tpm, _ := openTPMSimulatorForTesting(t)
+		defer closeTPM(t, tpm)
+		clearTPMWithPlatformAuth(t, tpm)
+		if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+			t.Fatalf("EnsureProvisioned failed: %v", err)
+		}
+	}()
+	defer func() {
+		tpm, _ := openTPMSimulatorForTesting(t)
+		defer closeTPM(t, tpm)
+		clearTPMWithPlatformAuth(t, tpm)
+	}()
+
+	dir, err := ioutil.TempDir("", "secboot-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer MockRunDir(dir)()
+
+	cachePath := filepath.Join(dir, "secboot", "ek-verification")
+
+	t.Run("Deferred", func(t *testing.T) {
+		tpm, err := SecureConnectToDefaultTPMLazy(bytes.NewReader(testutil.EncodedTPMSimulatorEKCertChain), nil)
+		if err != nil {
+			t.Fatalf("SecureConnectToDefaultTPMLazy failed: %v", err)
+		}
+		defer closeTPM(t, tpm)
+
+		if tpm.VerifiedEKCertChain() != nil {
+			t.Errorf("Verification should have been deferred")
+		}
+		if _, err := os.Stat(cachePath); !os.IsNotExist(err) {
+			t.Errorf("Unexpected cache file: %v", err)
+		}
+
+		if err := tpm.CompleteVerification(); err != nil {
+			t.Fatalf("CompleteVerification failed: %v", err)
+		}
+		if len(tpm.VerifiedEKCertChain()) != 2 {
+			t.Fatalf("Unexpected number of certificates in chain")
+		}
+		if !bytes.Equal(tpm.VerifiedEKCertChain()[0].Raw, testEkCert) {
+			t.Errorf("Unexpected leaf certificate")
+		}
+		if tpm.VerifiedDeviceAttributes() == nil || tpm.VerifiedDeviceAttributes().Model != "FakeTPM" {
+			t.Errorf("Unexpected verified device attributes")
+		}
+		if _, err := os.Stat(cachePath); err != nil {
+			t.Errorf("Verification result should have been cached: %v", err)
+		}
+
+		// The cached result should be tied to the persistent EK.
+		f, err := os.Open(cachePath)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer f.Close()
+		var entry struct {
+			EKName tpm2.Name `json:"ek-name"`
+		}
+		if err := json.NewDecoder(f).Decode(&entry); err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		ek, err := tpm.CreateResourceContextFromTPM(tcg.EKHandle)
+		if err != nil {
+			t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(entry.EKName, ek.Name()) {
+			t.Errorf("Unexpected EK name in cache entry")
+		}
+
+		// A second call should be a no-op
+		if err := tpm.CompleteVerification(); err != nil {
+			t.Errorf("CompleteVerification failed: %v", err)
+		}
+	})
+
+	t.Run("Cached", func(t *testing.T) {
+		// Test that a subsequent connection uses the cached result rather than rewriting the cache.
+		fi1, err := os.Stat(cachePath)
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+
+		tpm, err := SecureConnectToDefaultTPMLazy(bytes.NewReader(testutil.EncodedTPMSimulatorEKCertChain), nil)
+		if err != nil {
+			t.Fatalf("SecureConnectToDefaultTPMLazy failed: %v", err)
+		}
+		defer closeTPM(t, tpm)
+
+		if err := tpm.CompleteVerification(); err != nil {
+			t.Fatalf("CompleteVerification failed: %v", err)
+		}
+		if len(tpm.VerifiedEKCertChain()) != 2 {
+			t.Fatalf("Unexpected number of certificates in chain")
+		}
+
+		fi2, err := os.Stat(cachePath)
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		if !os.SameFile(fi1, fi2) {
+			t.Errorf("Cache file should not have been rewritten")
+		}
+	})
+
+	t.Run("EKNameMismatch", func(t *testing.T) {
+		// Test that a cached result for a different EK is discarded.
+		data, err := ioutil.ReadFile(cachePath)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		entry["ek-name"] = []byte{0x00, 0x0b, 0x01, 0x02, 0x03}
+		data, err = json.Marshal(entry)
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		if err := ioutil.WriteFile(cachePath, data, 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		fi1, err := os.Stat(cachePath)
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+
+		tpm, err := SecureConnectToDefaultTPMLazy(bytes.NewReader(testutil.EncodedTPMSimulatorEKCertChain), nil)
+		if err != nil {
+			t.Fatalf("SecureConnectToDefaultTPMLazy failed: %v", err)
+		}
+		defer closeTPM(t, tpm)
+
+		if err := tpm.CompleteVerification(); err != nil {
+			t.Fatalf("CompleteVerification failed: %v", err)
+		}
+
+		fi2, err := os.Stat(cachePath)
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		if os.SameFile(fi1, fi2) {
+			t.Errorf("Cache file should have been rewritten")
+		}
+	})
+
+	t.Run("HmacSession", func(t *testing.T) {
+		// Test that callers of HmacSession get a session salted with the verified EK.
+		tpm, err := SecureConnectToDefaultTPMLazy(bytes.NewReader(testutil.EncodedTPMSimulatorEKCertChain), nil)
+		if err != nil {
+			t.Fatalf("SecureConnectToDefaultTPMLazy failed: %v", err)
+		}
+		defer closeTPM(t, tpm)
+
+		if tpm.HmacSession() == nil {
+			t.Fatalf("No HMAC session")
+		}
+		if len(tpm.VerifiedEKCertChain()) != 2 {
+			t.Errorf("HmacSession should have completed verification")
+		}
+	})
+
+	t.Run("InvalidEkCert", func(t *testing.T) {
+		certData := []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+		tpm, err := SecureConnectToDefaultTPMLazy(bytes.NewReader(certData), nil)
+		if err != nil {
+			t.Fatalf("SecureConnectToDefaultTPMLazy failed: %v", err)
+		}
+		defer closeTPM(t, tpm)
+
+		err = tpm.CompleteVerification()
+		if _, ok := err.(EKCertVerificationError); !ok {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		// The error should be sticky
+		if err2 := tpm.CompleteVerification(); err2 != err {
+			t.Errorf("Unexpected error: %v", err2)
+		}
+		if tpm.VerifiedEKCertChain() != nil {
+			t.Errorf("Connection should not be verified")
+		}
+		if tpm.HmacSession() == nil {
+			t.Errorf("Connection should still be usable")
+		}
+	})
+}
+
+func TestSecureConnectToDefaultTPMWithEKVerificationCache(t *testing.T) {
+	if !testutil.UseMssim {
+		t.SkipNow()
+	}
+
+	restore := testutil.MockOpenDefaultTctiFn(func() (io.ReadWriteCloser, error) {
+		return tpm2.OpenMssim("", testutil.MssimPort, testutil.MssimPort+1)
+	})
+	defer restore()
+
+	func() {
+		tpm, _ := openTPMSimulatorForTesting(t)
+		defer closeTPM(t, tpm)
+		clearTPMWithPlatformAuth(t, tpm)
+		if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+			t.Fatalf("EnsureProvisioned failed: %v", err)
+		}
+	}()
+	defer func() {
+		tpm, _ := openTPMSimulatorForTesting(t)
+		defer closeTPM(t, tpm)
+		clearTPMWithPlatformAuth(t, tpm)
+	}()
+
+	dir, err := ioutil.TempDir("", "secboot-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	SetEKVerificationCacheDir(dir)
+	defer SetEKVerificationCacheDir("")
+
+	cachePath := filepath.Join(dir, "ek-verification")
+
+	connect := func(t *testing.T) {
+		tpm, err := SecureConnectToDefaultTPM(bytes.NewReader(testutil.EncodedTPMSimulatorEKCertChain), nil)
+		if err != nil {
+			t.Fatalf("SecureConnectToDefaultTPM failed: %v", err)
+		}
+		defer closeTPM(t, tpm)
+
+		if len(tpm.VerifiedEKCertChain()) != 2 {
+			t.Fatalf("Unexpected number of certificates in chain")
+		}
+		if !bytes.Equal(tpm.VerifiedEKCertChain()[0].Raw, testEkCert) {
+			t.Errorf("Unexpected leaf certificate")
+		}
+		if tpm.VerifiedDeviceAttributes() == nil || tpm.VerifiedDeviceAttributes().Model != "FakeTPM" {
+			t.Errorf("Unexpected verified device attributes")
+		}
+	}
+
+	connect(t)
+	fi1, err := os.Stat(cachePath)
+	if err != nil {
+		t.Fatalf("Verification result should have been cached: %v", err)
+	}
+
+	t.Run("Cached", func(t *testing.T) {
+		connect(t)
+		fi2, err := os.Stat(cachePath)
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		if !os.SameFile(fi1, fi2) {
+			t.Errorf("Cache file should not have been rewritten")
+		}
+	})
+
+	// tamperCache modifies the cached entry in place and checks that the next connection doesn't
+	// trust it and rewrites the cache.
+	tamperCache := func(t *testing.T, fn func(entry map[string]interface{})) {
+		b, err := ioutil.ReadFile(cachePath)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal(b, &entry); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		fn(entry)
+		b, err = json.Marshal(entry)
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		if err := ioutil.WriteFile(cachePath, b, 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		fi2, err := os.Stat(cachePath)
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+
+		connect(t)
+		fi3, err := os.Stat(cachePath)
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		if os.SameFile(fi2, fi3) {
+			t.Errorf("Cache file should have been rewritten")
+		}
+		fi1 = fi3
+	}
+
+	t.Run("UntrustedChain", func(t *testing.T) {
+		// Drop the root so that the cached chain no longer terminates at a trusted CA.
+		tamperCache(t, func(entry map[string]interface{}) {
+			entry["chain"] = entry["chain"].([]interface{})[:1]
+		})
+	})
+
+	t.Run("TrustChanged", func(t *testing.T) {
+		tamperCache(t, func(entry map[string]interface{}) {
+			entry["trust-digest"] = base64.StdEncoding.EncodeToString(make([]byte, 32))
+		})
+	})
+
+	t.Run("EKChanged", func(t *testing.T) {
+		func() {
+			tpm, _ := openTPMSimulatorForTesting(t)
+			defer closeTPM(t, tpm)
+
+			ek, err := tpm.CreateResourceContextFromTPM(tcg.EKHandle)
+			if err != nil {
+				t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+			}
+			if _, err := tpm.EvictControl(tpm.OwnerHandleContext(), ek, ek.Handle(), nil); err != nil {
+				t.Fatalf("EvictControl failed: %v", err)
+			}
+
+			// This produces a primary key that doesn't match the certificate created in TestMain
+			sensitive := tpm2.SensitiveCreate{Data: []byte("foo")}
+			ekContext, _, _, _, _, err := tpm.CreatePrimary(tpm.EndorsementHandleContext(), &sensitive, tcg.EKTemplate, nil, nil, nil)
+			if err != nil {
+				t.Fatalf("CreatePrimary failed: %v", err)
+			}
+			defer tpm.FlushContext(ekContext)
+			if _, err := tpm.EvictControl(tpm.OwnerHandleContext(), ekContext, tcg.EKHandle, nil); err != nil {
+				t.Fatalf("EvictControl failed: %v", err)
+			}
+		}()
+
+		connect(t)
+		fi2, err := os.Stat(cachePath)
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		if os.SameFile(fi1, fi2) {
+			t.Errorf("Cache file should have been rewritten")
+		}
+	})
+}
+
+func TestSecureConnectToDefaultTPMWithEKCertificateVerifier(t *testing.T) {
+	if !testutil.UseMssim {
+		t.SkipNow()
+	}
+
+	restore := testutil.MockOpenDefaultTctiFn(func() (io.ReadWriteCloser, error) {
+		return tpm2.OpenMssim("", testutil.MssimPort, testutil.MssimPort+1)
+	})
+	defer restore()
+
+	func() {
+		tpm, _ := openTPMSimulatorForTesting(t)
+		defer closeTPM(t, tpm)
+		clearTPMWithPlatformAuth(t, tpm)
+	}()
+
+	t.Run("Good", func(t *testing.T) {
+		var called int
+		opts := &SecureConnectOptions{
+			EKCertificateVerifier: func(cert *x509.Certificate, opts x509.VerifyOptions) ([][]*x509.Certificate, error) {
+				called++
+				if !bytes.Equal(cert.Raw, testEkCert) {
+					t.Errorf("Unexpected certificate")
+				}
+				return cert.Verify(opts)
+			}}
+
+		tpm, err := SecureConnectToDefaultTPMWithOptions(bytes.NewReader(testutil.EncodedTPMSimulatorEKCertChain), nil, opts)
+		if err != nil {
+			t.Fatalf("SecureConnectToDefaultTPM failed: %v", err)
+		}
+		defer closeTPM(t, tpm)
+
+		if called != 1 {
+			t.Errorf("Unexpected number of calls to verifier: %d", called)
+		}
+		if len(tpm.VerifiedEKCertChain()) != 2 {
+			t.Fatalf("Unexpected number of certificates in chain")
+		}
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		opts := &SecureConnectOptions{
+			EKCertificateVerifier: func(cert *x509.Certificate, opts x509.VerifyOptions) ([][]*x509.Certificate, error) {
+				return nil, errors.New("certificate is revoked")
+			}}
+
+		_, err := SecureConnectToDefaultTPMWithOptions(bytes.NewReader(testutil.EncodedTPMSimulatorEKCertChain), nil, opts)
+		if err == nil {
+			t.Fatalf("SecureConnectToDefaultTPM should have failed")
+		}
+		if _, ok := err.(EKCertVerificationError); !ok {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("WrongLeaf", func(t *testing.T) {
+		// Test that chains which don't start with the EK certificate are ignored
+		opts := &SecureConnectOptions{
+			EKCertificateVerifier: func(cert *x509.Certificate, opts x509.VerifyOptions) ([][]*x509.Certificate, error) {
+				caCert, _ := x509.ParseCertificate(testCACert)
+				return [][]*x509.Certificate{{caCert}}, nil
+			}}
+
+		_, err := SecureConnectToDefaultTPMWithOptions(bytes.NewReader(testutil.EncodedTPMSimulatorEKCertChain), nil, opts)
+		if err == nil {
+			t.Fatalf("SecureConnectToDefaultTPM should have failed")
+		}
+		if _, ok := err.(EKCertVerificationError); !ok {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Lazy", func(t *testing.T) {
+		// Test that the verifier supplied to a lazy connection is used when verification completes, and that it doesn't
+		// affect other connections.
+		opts := &SecureConnectOptions{
+			EKCertificateVerifier: func(cert *x509.Certificate, opts x509.VerifyOptions) ([][]*x509.Certificate, error) {
+				return nil, errors.New("certificate is revoked")
+			}}
+
+		tpm, err := SecureConnectToDefaultTPMLazyWithOptions(bytes.NewReader(testutil.EncodedTPMSimulatorEKCertChain), nil, opts)
+		if err != nil {
+			t.Fatalf("SecureConnectToDefaultTPMLazy failed: %v", err)
+		}
+		defer closeTPM(t, tpm)
+
+		other, err := SecureConnectToDefaultTPM(bytes.NewReader(testutil.EncodedTPMSimulatorEKCertChain), nil)
+		if err != nil {
+			t.Fatalf("SecureConnectToDefaultTPM failed: %v", err)
+		}
+		closeTPM(t, other)
+
+		err = tpm.CompleteVerification()
+		if _, ok := err.(EKCertVerificationError); !ok {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,254 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/snapcore/secboot/internal/tcti"
+
+	"golang.org/x/xerrors"
+)
+
+var sysClassTPMPath = "/sys/class/tpm"
+
+var tpmDeviceNameRe = regexp.MustCompile(`^tpm[0-9]+$`)
+
+// TPMDeviceInfo describes a TPM device found by EnumerateTPMDevices.
+type TPMDeviceInfo struct {
+	Name                string    // The kernel name of the device, eg, "tpm0"
+	Path                string    // The path of the TPM character device, eg, /dev/tpm0
+	ResourceManagerPath string    // The path of the in-kernel resource manager device, eg, /dev/tpmrm0, if there is one
+	MajorVersion        int       // The TPM major version reported by the kernel (1 or 2), or 0 if this isn't known
+	Description         string    // The description of the device from the platform firmware, if there is one
+	Device              TPMDevice // The device to pass to ConnectToTPMDevice or SecureConnectToTPMDevice
+}
+
+func readSysfsAttr(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// EnumerateTPMDevices returns all of the TPM devices on the system, sorted by name, so that the caller can choose which one to
+// connect to on systems with more than one TPM (eg, with both a discrete TPM and a firmware TPM). The Device field of each
+// entry uses the resource manager device if there is one, and the TPM character device otherwise. If there are no TPM devices,
+// an empty list is returned.
+func EnumerateTPMDevices() ([]*TPMDeviceInfo, error) {
+	entries, err := ioutil.ReadDir(sysClassTPMPath)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, xerrors.Errorf("cannot read TPM device class directory: %w", err)
+	}
+
+	var out []*TPMDeviceInfo
+	for _, entry := range entries {
+		name := entry.Name()
+		if !tpmDeviceNameRe.MatchString(name) {
+			continue
+		}
+		sysPath := filepath.Join(sysClassTPMPath, name)
+
+		info := &TPMDeviceInfo{
+			Name:        name,
+			Path:        filepath.Join(devPath, name),
+			Description: readSysfsAttr(filepath.Join(sysPath, "device", "description"))}
+		if v, err := strconv.Atoi(readSysfsAttr(filepath.Join(sysPath, "tpm_version_major"))); err == nil {
+			info.MajorVersion = v
+		}
+
+		rmPath := filepath.Join(devPath, "tpmrm"+strings.TrimPrefix(name, "tpm"))
+		if _, err := os.Stat(rmPath); err == nil {
+			info.ResourceManagerPath = rmPath
+			info.Device = NewCharTPMDevice(rmPath)
+		} else {
+			info.Device = NewCharTPMDevice(info.Path)
+		}
+
+		out = append(out, info)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		ni, _ := strconv.Atoi(strings.TrimPrefix(out[i].Name, "tpm"))
+		nj, _ := strconv.Atoi(strings.TrimPrefix(out[j].Name, "tpm"))
+		return ni < nj
+	})
+	return out, nil
+}
+
+// TPMDeviceType describes how a TPM device is accessed.
+type TPMDeviceType uint8
+
+const (
+	// TPMDeviceTypeUnknown indicates that the type of the device isn't known, eg, because it was a simulator.
+	TPMDeviceTypeUnknown TPMDeviceType = iota
+
+	// TPMDeviceTypeChar indicates a TPM character device or in-kernel resource manager device on Linux.
+	TPMDeviceTypeChar
+
+	// TPMDeviceTypeTBS indicates the TPM Base Services interface on Windows.
+	TPMDeviceTypeTBS
+)
+
+// TPMDeviceBinding identifies the TPM device that a key was sealed with. It doesn't record a path, so that key data can't
+// direct ConnectToTPMDeviceForKey to open an arbitrary file.
+type TPMDeviceBinding struct {
+	// DeviceType describes how the device that the key was sealed with was accessed.
+	DeviceType TPMDeviceType
+
+	// KernelName is the kernel name of the device that the key was sealed with (eg, "tpm0") if it is a TPMDeviceTypeChar
+	// device. This is only a hint, because device numbering isn't guaranteed to be stable across boots.
+	KernelName string
+
+	// EKName is the name of the endorsement key of the TPM that the key was sealed with, if it had a persistent endorsement
+	// key. This identifies the TPM regardless of how it is enumerated.
+	EKName tpm2.Name
+}
+
+type tpmDeviceBindingRaw struct {
+	DeviceType TPMDeviceType
+	KernelName []byte
+	EKName     tpm2.Name
+}
+
+func makeTPMDeviceBindingRaw(b *TPMDeviceBinding) *tpmDeviceBindingRaw {
+	return &tpmDeviceBindingRaw{DeviceType: b.DeviceType, KernelName: []byte(b.KernelName), EKName: b.EKName}
+}
+
+func (r *tpmDeviceBindingRaw) data() *TPMDeviceBinding {
+	return &TPMDeviceBinding{DeviceType: r.DeviceType, KernelName: string(r.KernelName), EKName: r.EKName}
+}
+
+// tpmDeviceTypeAndKernelName returns the type and, for character devices, the kernel name of the supplied device.
+func tpmDeviceTypeAndKernelName(device TPMDevice) (TPMDeviceType, string) {
+	switch d := device.(type) {
+	case tcti.CharDevice:
+		// Both /dev/tpmN and /dev/tpmrmN correspond to the kernel device tpmN.
+		name := strings.Replace(filepath.Base(d.Path), "tpmrm", "tpm", 1)
+		if !tpmDeviceNameRe.MatchString(name) {
+			name = ""
+		}
+		return TPMDeviceTypeChar, name
+	case tcti.TBSDevice:
+		return TPMDeviceTypeTBS, ""
+	default:
+		return TPMDeviceTypeUnknown, ""
+	}
+}
+
+// deviceBinding returns the TPMDeviceBinding that identifies the TPM associated with this connection, or nil if neither the
+// device nor the endorsement key is known.
+func (t *TPMConnection) deviceBinding() *TPMDeviceBinding {
+	var b TPMDeviceBinding
+	if t.device != nil {
+		b.DeviceType, b.KernelName = tpmDeviceTypeAndKernelName(t.device)
+	}
+	if t.ek != nil {
+		b.EKName = t.ek.Name()
+	}
+	if b.DeviceType == TPMDeviceTypeUnknown && len(b.EKName) == 0 {
+		return nil
+	}
+	return &b
+}
+
+// Matches indicates whether the TPM associated with the supplied connection is the one identified by this binding. If the
+// binding records an endorsement key name, this is compared with the name of the endorsement key of the TPM. Otherwise, the
+// device type and kernel name are compared with those of the device that the connection was opened from.
+func (b *TPMDeviceBinding) Matches(tpm *TPMConnection) bool {
+	if len(b.EKName) > 0 {
+		return tpm.ek != nil && bytes.Equal(tpm.ek.Name(), b.EKName)
+	}
+	if tpm.device == nil || b.DeviceType == TPMDeviceTypeUnknown {
+		return false
+	}
+	deviceType, kernelName := tpmDeviceTypeAndKernelName(tpm.device)
+	return deviceType == b.DeviceType && kernelName == b.KernelName
+}
+
+// TPMDeviceBinding returns the binding that identifies the TPM device that this key was sealed with. This is only recorded for
+// version 3 and later key data files created by a version of secboot that supports it, and is nil otherwise.
+func (k *SealedKeyObject) TPMDeviceBinding() *TPMDeviceBinding {
+	return k.data.deviceBinding
+}
+
+// ConnectToTPMDeviceForKey connects to the TPM device that the supplied sealed key object was sealed with, using the binding
+// returned from SealedKeyObject.TPMDeviceBinding. Like ConnectToTPMDevice, this makes no attempt to verify the authenticity
+// of the TPM.
+//
+// If the key data doesn't record a binding, this connects to the default TPM device in the same way as ConnectToDefaultTPM.
+// Otherwise, only devices discovered by this function are tried - paths are never taken from the key data. For a
+// TPMDeviceTypeChar binding, the TPM2 devices returned from EnumerateTPMDevices are tried, starting with the one with the
+// recorded kernel name. For a TPMDeviceTypeTBS binding, the TPM Base Services interface is tried. If none of them match, a
+// ErrNoMatchingTPMDevice error is returned.
+func ConnectToTPMDeviceForKey(k *SealedKeyObject) (*TPMConnection, error) {
+	binding := k.TPMDeviceBinding()
+	if binding == nil {
+		return ConnectToDefaultTPM()
+	}
+
+	var devices []TPMDevice
+	switch binding.DeviceType {
+	case TPMDeviceTypeTBS:
+		devices = append(devices, NewTBSTPMDevice())
+	default:
+		infos, err := EnumerateTPMDevices()
+		if err != nil {
+			return nil, xerrors.Errorf("cannot enumerate TPM devices: %w", err)
+		}
+		var others []TPMDevice
+		for _, info := range infos {
+			switch {
+			case info.MajorVersion == 1:
+				continue
+			case info.Name == binding.KernelName:
+				devices = append(devices, info.Device)
+			default:
+				others = append(others, info.Device)
+			}
+		}
+		devices = append(devices, others...)
+	}
+
+	for _, device := range devices {
+		tpm, err := ConnectToTPMDevice(device)
+		if err != nil {
+			continue
+		}
+		if binding.Matches(tpm) {
+			return tpm, nil
+		}
+		tpm.Close()
+	}
+
+	return nil, ErrNoMatchingTPMDevice
+}
@@ -0,0 +1,151 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type enumerateTPMDevicesSuite struct {
+	snapd_testutil.BaseTest
+	sysClassTPM string
+	dev         string
+}
+
+var _ = Suite(&enumerateTPMDevicesSuite{})
+
+func (s *enumerateTPMDevicesSuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+	s.sysClassTPM = c.MkDir()
+	s.dev = c.MkDir()
+	s.AddCleanup(MockSysClassTPMPath(s.sysClassTPM))
+	s.AddCleanup(MockBlockDevicePaths(c.MkDir(), s.dev))
+}
+
+func (s *enumerateTPMDevicesSuite) addDevice(c *C, name, version, description string, rm bool) {
+	dir := filepath.Join(s.sysClassTPM, name)
+	c.Assert(os.MkdirAll(filepath.Join(dir, "device"), 0755), IsNil)
+	if version != "" {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, "tpm_version_major"), []byte(version+"\n"), 0644), IsNil)
+	}
+	if description != "" {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, "device", "description"), []byte(description+"\n"), 0644), IsNil)
+	}
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dev, name), nil, 0644), IsNil)
+	if rm {
+		c.Assert(ioutil.WriteFile(filepath.Join(s.dev, "tpmrm"+name[3:]), nil, 0644), IsNil)
+	}
+}
+
+func (s *enumerateTPMDevicesSuite) TestEnumerate(c *C) {
+	s.addDevice(c, "tpm10", "2", "", true)
+	s.addDevice(c, "tpm0", "2", "TPM 2.0 Device", true)
+	s.addDevice(c, "tpm1", "1", "", false)
+	c.Assert(os.Mkdir(filepath.Join(s.sysClassTPM, "other"), 0755), IsNil)
+
+	devices, err := EnumerateTPMDevices()
+	c.Assert(err, IsNil)
+	c.Assert(devices, HasLen, 3)
+
+	c.Check(devices[0].Name, Equals, "tpm0")
+	c.Check(devices[0].Path, Equals, filepath.Join(s.dev, "tpm0"))
+	c.Check(devices[0].ResourceManagerPath, Equals, filepath.Join(s.dev, "tpmrm0"))
+	c.Check(devices[0].MajorVersion, Equals, 2)
+	c.Check(devices[0].Description, Equals, "TPM 2.0 Device")
+	c.Check(devices[0].Device.String(), Equals, filepath.Join(s.dev, "tpmrm0"))
+
+	c.Check(devices[1].Name, Equals, "tpm1")
+	c.Check(devices[1].ResourceManagerPath, Equals, "")
+	c.Check(devices[1].MajorVersion, Equals, 1)
+	c.Check(devices[1].Device.String(), Equals, filepath.Join(s.dev, "tpm1"))
+
+	c.Check(devices[2].Name, Equals, "tpm10")
+	c.Check(devices[2].Device.String(), Equals, filepath.Join(s.dev, "tpmrm10"))
+}
+
+func (s *enumerateTPMDevicesSuite) TestEnumerateNoDevices(c *C) {
+	s.AddCleanup(MockSysClassTPMPath(filepath.Join(s.sysClassTPM, "nonexistent")))
+
+	devices, err := EnumerateTPMDevices()
+	c.Check(err, IsNil)
+	c.Check(devices, HasLen, 0)
+}
+
+func (s *enumerateTPMDevicesSuite) TestDeviceTypeAndKernelName(c *C) {
+	for _, t := range []struct {
+		device     TPMDevice
+		deviceType TPMDeviceType
+		name       string
+	}{
+		{NewCharTPMDevice("/dev/tpm0"), TPMDeviceTypeChar, "tpm0"},
+		{NewCharTPMDevice("/dev/tpmrm1"), TPMDeviceTypeChar, "tpm1"},
+		{NewCharTPMDevice("/tmp/foo"), TPMDeviceTypeChar, ""},
+		{NewTBSTPMDevice(), TPMDeviceTypeTBS, ""},
+		{NewSimulatorTPMDevice("", 2321), TPMDeviceTypeUnknown, ""},
+	} {
+		deviceType, name := TPMDeviceTypeAndKernelName(t.device)
+		c.Check(deviceType, Equals, t.deviceType, Commentf("device: %s", t.device))
+		c.Check(name, Equals, t.name, Commentf("device: %s", t.device))
+	}
+}
+
+type tpmDeviceBindingSuite struct {
+	testutil.TPMSimulatorTestBase
+}
+
+var _ = Suite(&tpmDeviceBindingSuite{})
+
+func (s *tpmDeviceBindingSuite) TestSealRecordsBinding(c *C) {
+	c.Assert(s.TPM.EnsureProvisioned(ProvisionModeFull, nil), IsNil)
+	s.ResetTPMSimulator(c)
+
+	keyFile := filepath.Join(c.MkDir(), "keydata")
+	pcrPolicyCounterHandle := tpm2.Handle(0x0181fff0)
+	_, err := SealKeyToTPM(s.TPM, make([]byte, 32), keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: pcrPolicyCounterHandle})
+	c.Assert(err, IsNil)
+	pcrPolicyCounter, err := s.TPM.CreateResourceContextFromTPM(pcrPolicyCounterHandle)
+	c.Assert(err, IsNil)
+	s.AddCleanupNVSpace(c, s.TPM.OwnerHandleContext(), pcrPolicyCounter)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	c.Assert(err, IsNil)
+	binding := k.TPMDeviceBinding()
+	c.Assert(binding, NotNil)
+
+	ek, err := s.TPM.EndorsementKey()
+	c.Assert(err, IsNil)
+	c.Check(binding.EKName, DeepEquals, ek.Name())
+	c.Check(binding.DeviceType, Equals, TPMDeviceTypeUnknown)
+	c.Check(binding.KernelName, Equals, "")
+	c.Check(binding.Matches(s.TPM), Equals, true)
+
+	other := &TPMDeviceBinding{EKName: append(tpm2.Name{}, ek.Name()...)}
+	other.EKName[len(other.EKName)-1] ^= 0xff
+	c.Check(other.Matches(s.TPM), Equals, false)
+}
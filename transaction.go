@@ -0,0 +1,448 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/osutil/sys"
+
+	"golang.org/x/xerrors"
+)
+
+// TransactionStepFunc is the type of the functions that perform and undo a step of a Transaction.
+type TransactionStepFunc func() error
+
+type transactionStepState string
+
+const (
+	transactionStepPending transactionStepState = "pending"
+	transactionStepStarted transactionStepState = "started"
+	transactionStepDone    transactionStepState = "done"
+)
+
+type transactionJournalStep struct {
+	Name  string               `json:"name"`
+	State transactionStepState `json:"state"`
+}
+
+// transactionJournal is the persistent record of the progress of a Transaction.
+type transactionJournal struct {
+	Name        string                   `json:"name"`
+	RollingBack bool                     `json:"rolling-back"`
+	Steps       []transactionJournalStep `json:"steps"`
+}
+
+type transactionStep struct {
+	name string
+	do   TransactionStepFunc
+	undo TransactionStepFunc
+}
+
+// Transaction groups a sequence of steps that make up a compound operation, such as provisioning the TPM, sealing a key,
+// adding a keyslot to a LUKS2 container and writing the sealed key data to its final location, so that the operation either
+// completes or is undone. The progress of the transaction is recorded in a journal file so that if the process is interrupted
+// (eg, because of a crash or power loss), the transaction can be resumed with Run or undone with Rollback.
+//
+// Each step consists of a function that performs it and an optional function that undoes it. Because a step may be
+// interrupted part way through, both functions must be idempotent: the function that performs a step may be called again
+// after it partially or fully completed, and the function that undoes a step may be called after the step only partially
+// completed.
+type Transaction struct {
+	name        string
+	journalPath string
+	steps       []transactionStep
+}
+
+// NewTransaction creates a new transaction with the specified name, which records its progress in the journal file at the
+// path specified by journalPath. This path must be on persistent storage if the transaction is expected to survive a reboot.
+func NewTransaction(name, journalPath string) *Transaction {
+	return &Transaction{name: name, journalPath: journalPath}
+}
+
+// AddStep appends a step with the specified name to this transaction. The do function performs the step and the undo function,
+// which may be nil, undoes it. Step names must be unique within a transaction.
+func (t *Transaction) AddStep(name string, do, undo TransactionStepFunc) *Transaction {
+	t.steps = append(t.steps, transactionStep{name: name, do: do, undo: undo})
+	return t
+}
+
+func (t *Transaction) newJournal() *transactionJournal {
+	j := &transactionJournal{Name: t.name}
+	for _, s := range t.steps {
+		j.Steps = append(j.Steps, transactionJournalStep{Name: s.name, State: transactionStepPending})
+	}
+	return j
+}
+
+func (t *Transaction) readJournal() (*transactionJournal, error) {
+	f, err := os.Open(t.journalPath)
+	switch {
+	case isStateNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, xerrors.Errorf("cannot open journal: %w", err)
+	}
+	defer f.Close()
+
+	var j transactionJournal
+	if err := json.NewDecoder(f).Decode(&j); err != nil {
+		return nil, xerrors.Errorf("cannot decode journal: %w", err)
+	}
+
+	if j.Name != t.name {
+		return nil, fmt.Errorf("journal belongs to a different transaction (%q)", j.Name)
+	}
+	if len(j.Steps) != len(t.steps) {
+		return nil, errors.New("journal has an unexpected number of steps")
+	}
+	for i, s := range j.Steps {
+		if s.Name != t.steps[i].name {
+			return nil, fmt.Errorf("journal has an unexpected step at index %d (%q)", i, s.Name)
+		}
+		switch s.State {
+		case transactionStepPending, transactionStepStarted, transactionStepDone:
+		default:
+			return nil, fmt.Errorf("journal has an invalid state for step %q", s.Name)
+		}
+	}
+
+	return &j, nil
+}
+
+func (t *Transaction) writeJournal(j *transactionJournal) error {
+	if err := os.MkdirAll(filepath.Dir(t.journalPath), 0700); err != nil {
+		return xerrors.Errorf("cannot create journal directory: %w", err)
+	}
+
+	f, err := osutil.NewAtomicFile(t.journalPath, 0600, 0, sys.UserID(osutil.NoChown), sys.GroupID(osutil.NoChown))
+	if err != nil {
+		return xerrors.Errorf("cannot create new atomic file: %w", err)
+	}
+	defer f.Cancel()
+
+	if err := json.NewEncoder(f).Encode(j); err != nil {
+		return xerrors.Errorf("cannot write to temporary file: %w", err)
+	}
+
+	if err := f.Commit(); err != nil {
+		return xerrors.Errorf("cannot atomically replace file: %w", err)
+	}
+	return nil
+}
+
+func (t *Transaction) removeJournal() error {
+	if err := os.Remove(t.journalPath); err != nil && !isStateNotExist(err) {
+		return xerrors.Errorf("cannot remove journal: %w", err)
+	}
+	return nil
+}
+
+// rollback undoes the started and completed steps recorded in the supplied journal in reverse order, and then removes the
+// journal. If a step cannot be undone, the journal is retained.
+func (t *Transaction) rollback(j *transactionJournal) error {
+	if !j.RollingBack {
+		j.RollingBack = true
+		if err := t.writeJournal(j); err != nil {
+			return xerrors.Errorf("cannot update journal: %w", err)
+		}
+	}
+
+	for i := len(j.Steps) - 1; i >= 0; i-- {
+		if j.Steps[i].State == transactionStepPending {
+			continue
+		}
+		if undo := t.steps[i].undo; undo != nil {
+			if err := undo(); err != nil {
+				return xerrors.Errorf("cannot undo step %q: %w", j.Steps[i].Name, err)
+			}
+		}
+		j.Steps[i].State = transactionStepPending
+		if err := t.writeJournal(j); err != nil {
+			return xerrors.Errorf("cannot update journal: %w", err)
+		}
+	}
+
+	return t.removeJournal()
+}
+
+// Run performs the steps of this transaction in order. If the journal records a previous attempt that was interrupted, the
+// steps that were completed are skipped and the transaction resumes from the step that was interrupted. If the journal records
+// a rollback that was interrupted, the rollback is completed first and the transaction is then performed from the start.
+//
+// If a step fails, the steps that were started are undone in reverse order and a *TransactionError is returned. The journal is
+// removed once the transaction completes or is rolled back successfully.
+//
+// If the journal belongs to a different transaction or records a different sequence of steps, an error is returned and nothing
+// is performed.
+func (t *Transaction) Run() error {
+	j, err := t.readJournal()
+	if err != nil {
+		return xerrors.Errorf("cannot read journal: %w", err)
+	}
+	if j != nil && j.RollingBack {
+		if err := t.rollback(j); err != nil {
+			return xerrors.Errorf("cannot complete interrupted rollback: %w", err)
+		}
+		j = nil
+	}
+	if j == nil {
+		j = t.newJournal()
+		if err := t.writeJournal(j); err != nil {
+			return xerrors.Errorf("cannot create journal: %w", err)
+		}
+	}
+
+	for i, s := range t.steps {
+		if j.Steps[i].State == transactionStepDone {
+			continue
+		}
+
+		j.Steps[i].State = transactionStepStarted
+		if err := t.writeJournal(j); err != nil {
+			return xerrors.Errorf("cannot update journal: %w", err)
+		}
+
+		if err := s.do(); err != nil {
+			return &TransactionError{Step: s.name, Err: err, RollbackErr: t.rollback(j)}
+		}
+
+		j.Steps[i].State = transactionStepDone
+		if err := t.writeJournal(j); err != nil {
+			return xerrors.Errorf("cannot update journal: %w", err)
+		}
+	}
+
+	return t.removeJournal()
+}
+
+// Rollback undoes the steps of an interrupted attempt to perform this transaction that are recorded in the journal, in
+// reverse order. It is not an error if there is no journal.
+func (t *Transaction) Rollback() error {
+	j, err := t.readJournal()
+	if err != nil {
+		return xerrors.Errorf("cannot read journal: %w", err)
+	}
+	if j == nil {
+		return nil
+	}
+	return t.rollback(j)
+}
+
+// Pending indicates whether the journal records an interrupted attempt to perform or roll back this transaction.
+func (t *Transaction) Pending() (bool, error) {
+	j, err := t.readJournal()
+	if err != nil {
+		return false, xerrors.Errorf("cannot read journal: %w", err)
+	}
+	return j != nil, nil
+}
+
+// EnrolmentTransactionParams contains the parameters for NewEnrolmentTransaction.
+type EnrolmentTransactionParams struct {
+	// ProvisionMode and LockoutAuth are passed to TPMConnection.EnsureProvisioned.
+	ProvisionMode ProvisionMode
+	LockoutAuth   []byte
+
+	// KeyCreationParams contains the parameters used to seal Key to the TPM.
+	KeyCreationParams *KeyCreationParams
+
+	// Key is the new key, which is sealed to the TPM and added to the LUKS2 container.
+	Key []byte
+
+	// ExistingKey is a key that is already enrolled in the LUKS2 container, which is required in order to add Key to it.
+	ExistingKey []byte
+
+	// DevicePath is the path of the LUKS2 container.
+	DevicePath string
+
+	// Keyslot is the keyslot that Key is added to. This must not already be in use.
+	Keyslot int
+
+	// TokenID is the ID of the LUKS2 token that the sealed key data is written to.
+	TokenID int
+
+	// StagingPath is the path of the file that the sealed key data is written to before it is imported in to the LUKS2 token.
+	// This must be on persistent storage if the transaction is expected to survive a reboot.
+	StagingPath string
+}
+
+// NewEnrolmentTransaction returns a Transaction that enrols a new TPM sealed key for the LUKS2 container at
+// params.DevicePath, recording its progress in the journal file at the path specified by journalPath.
+//
+// The "provision" step provisions the TPM with TPMConnection.EnsureProvisioned. It is not undone, as the previous state of the
+// TPM can't be restored, but it can be safely resumed. The "seal" step seals params.Key with SealKeyToTPM to a key data file at
+// params.StagingPath, and is undone by undefining the PCR policy counter of the sealed key and removing the key data file. The
+// "add-keyslot" step adds params.Key to params.Keyslot of the LUKS2 container, and is undone by removing the keyslot if it
+// contains params.Key. The "write-token" step imports the sealed key data in to the LUKS2 token with the ID params.TokenID, and
+// is undone by removing the token. Finally, the "remove-staged-key-data" step removes the key data file at params.StagingPath,
+// and is undone by restoring it from the LUKS2 token.
+//
+// If the process is interrupted during the "seal" step after the PCR policy counter was created but before the key data file
+// was written, resuming the transaction will fail with a TPMResourceExistsError error and the counter will not be undefined by
+// rolling it back, as it can't be distinguished from a counter that belongs to another key. The caller must undefine it.
+//
+// The key for authorizing PCR policy updates isn't returned by the transaction, but can be obtained afterwards with
+// SealedKeyObject.UnsealFromTPM.
+func NewEnrolmentTransaction(tpm *TPMConnection, journalPath string, params *EnrolmentTransactionParams) *Transaction {
+	location := NewLUKS2TokenKeyLocation(params.DevicePath, params.TokenID, params.Keyslot)
+
+	return NewTransaction("enrol", journalPath).
+		AddStep("provision", func() error {
+			return tpm.EnsureProvisioned(params.ProvisionMode, params.LockoutAuth)
+		}, nil).
+		AddStep("seal", func() error {
+			return sealStagedEnrolmentKey(tpm, params)
+		}, func() error {
+			return removeStagedEnrolmentKey(tpm, params)
+		}).
+		AddStep("add-keyslot", func() error {
+			return addEnrolmentKeyslot(params)
+		}, func() error {
+			return removeEnrolmentKeyslot(params)
+		}).
+		AddStep("write-token", func() error {
+			return writeEnrolmentToken(location, params)
+		}, func() error {
+			return removeEnrolmentToken(location, params)
+		}).
+		AddStep("remove-staged-key-data", func() error {
+			if err := os.Remove(params.StagingPath); err != nil && !os.IsNotExist(err) {
+				return xerrors.Errorf("cannot remove staged key data file: %w", err)
+			}
+			return nil
+		}, func() error {
+			return restoreStagedEnrolmentKey(location, params)
+		})
+}
+
+func sealStagedEnrolmentKey(tpm *TPMConnection, params *EnrolmentTransactionParams) error {
+	// A previous attempt may have written the key data file before it was interrupted.
+	if _, err := ReadSealedKeyObject(params.StagingPath); err == nil {
+		return nil
+	}
+	_, err := SealKeyToTPM(tpm, params.Key, params.StagingPath, params.KeyCreationParams)
+	return err
+}
+
+func removeStagedEnrolmentKey(tpm *TPMConnection, params *EnrolmentTransactionParams) error {
+	k, err := ReadSealedKeyObject(params.StagingPath)
+	switch {
+	case xerrors.Is(err, os.ErrNotExist):
+		return nil
+	case err != nil:
+		return xerrors.Errorf("cannot read staged key data file: %w", err)
+	}
+
+	if handle := k.PCRPolicyCounterHandle(); handle != tpm2.HandleNull {
+		session, err := tpm.secretSession()
+		if err != nil {
+			return err
+		}
+		if err := undefinePcrPolicyCounter(tpm, handle, session); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(params.StagingPath); err != nil && !os.IsNotExist(err) {
+		return xerrors.Errorf("cannot remove staged key data file: %w", err)
+	}
+	return nil
+}
+
+func addEnrolmentKeyslot(params *EnrolmentTransactionParams) error {
+	// A previous attempt may have added the key before it was interrupted.
+	if err := testLUKS2Key(params.DevicePath, params.Keyslot, params.Key); err == nil {
+		return nil
+	}
+	return addKeyToLUKS2Container(params.DevicePath, params.ExistingKey, params.Key, append(minimumCostPBKDFArgs(),
+		"--key-slot", strconv.Itoa(params.Keyslot)))
+}
+
+func removeEnrolmentKeyslot(params *EnrolmentTransactionParams) error {
+	// Only remove the keyslot if it contains the new key, as adding the key may have failed because the keyslot was already in
+	// use.
+	if err := testLUKS2Key(params.DevicePath, params.Keyslot, params.Key); err != nil {
+		return nil
+	}
+
+	cmd := exec.Command("cryptsetup", "luksKillSlot", "--key-file", "-", params.DevicePath, strconv.Itoa(params.Keyslot))
+	cmd.Stdin = bytes.NewReader(params.ExistingKey)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return xerrors.Errorf("cannot remove keyslot: %w", osutil.OutputErr(output, err))
+	}
+	return nil
+}
+
+func writeEnrolmentToken(location *LUKS2TokenKeyLocation, params *EnrolmentTransactionParams) error {
+	data, err := ioutil.ReadFile(params.StagingPath)
+	if err != nil {
+		return xerrors.Errorf("cannot read staged key data file: %w", err)
+	}
+	return location.WriteAtomic(func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func removeEnrolmentToken(location *LUKS2TokenKeyLocation, params *EnrolmentTransactionParams) error {
+	r, err := location.Open()
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return xerrors.Errorf("cannot read LUKS2 token: %w", err)
+	}
+	r.Close()
+
+	cmd := exec.Command("cryptsetup", "token", "remove", "--token-id", strconv.Itoa(params.TokenID), params.DevicePath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return xerrors.Errorf("cannot remove LUKS2 token: %w", osutil.OutputErr(output, err))
+	}
+	return nil
+}
+
+func restoreStagedEnrolmentKey(location *LUKS2TokenKeyLocation, params *EnrolmentTransactionParams) error {
+	if _, err := os.Stat(params.StagingPath); err == nil {
+		return nil
+	}
+
+	r, err := location.Open()
+	if err != nil {
+		return xerrors.Errorf("cannot read LUKS2 token: %w", err)
+	}
+	defer r.Close()
+
+	return FileKeyLocation(params.StagingPath).WriteAtomic(func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
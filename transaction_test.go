@@ -0,0 +1,293 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type transactionSuite struct {
+	journalPath string
+	log         []string
+}
+
+var _ = Suite(&transactionSuite{})
+
+func (s *transactionSuite) SetUpTest(c *C) {
+	s.journalPath = filepath.Join(c.MkDir(), "journal")
+	s.log = nil
+}
+
+func (s *transactionSuite) step(name string, err error) TransactionStepFunc {
+	return func() error {
+		s.log = append(s.log, name)
+		return err
+	}
+}
+
+func (s *transactionSuite) crashingStep(name string) TransactionStepFunc {
+	return func() error {
+		s.log = append(s.log, name)
+		panic("crash")
+	}
+}
+
+func (s *transactionSuite) runAndCrash(c *C, t *Transaction) {
+	defer func() {
+		c.Check(recover(), Equals, "crash")
+	}()
+	t.Run()
+}
+
+func (s *transactionSuite) checkNoJournal(c *C) {
+	_, err := os.Stat(s.journalPath)
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *transactionSuite) TestRun(c *C) {
+	t := NewTransaction("enrol", s.journalPath).
+		AddStep("provision", s.step("do-provision", nil), s.step("undo-provision", nil)).
+		AddStep("seal", s.step("do-seal", nil), s.step("undo-seal", nil)).
+		AddStep("add-keyslot", s.step("do-add-keyslot", nil), nil)
+	c.Check(t.Run(), IsNil)
+	c.Check(s.log, DeepEquals, []string{"do-provision", "do-seal", "do-add-keyslot"})
+	s.checkNoJournal(c)
+
+	pending, err := t.Pending()
+	c.Check(err, IsNil)
+	c.Check(pending, Equals, false)
+}
+
+func (s *transactionSuite) TestRunStepFails(c *C) {
+	t := NewTransaction("enrol", s.journalPath).
+		AddStep("provision", s.step("do-provision", nil), s.step("undo-provision", nil)).
+		AddStep("seal", s.step("do-seal", nil), s.step("undo-seal", nil)).
+		AddStep("add-keyslot", s.step("do-add-keyslot", errors.New("some error")), s.step("undo-add-keyslot", nil)).
+		AddStep("write-token", s.step("do-write-token", nil), s.step("undo-write-token", nil))
+	err := t.Run()
+	c.Check(err, ErrorMatches, "transaction step \"add-keyslot\" failed \\(some error\\) and was rolled back")
+	c.Assert(err, FitsTypeOf, &TransactionError{})
+	c.Check(err.(*TransactionError).Step, Equals, "add-keyslot")
+	c.Check(s.log, DeepEquals, []string{"do-provision", "do-seal", "do-add-keyslot", "undo-add-keyslot", "undo-seal", "undo-provision"})
+	s.checkNoJournal(c)
+}
+
+func (s *transactionSuite) TestRunRollbackFails(c *C) {
+	undoSealErr := errors.New("undo error")
+	newTransaction := func() *Transaction {
+		return NewTransaction("enrol", s.journalPath).
+			AddStep("provision", s.step("do-provision", nil), s.step("undo-provision", nil)).
+			AddStep("seal", s.step("do-seal", nil), func() error {
+				s.log = append(s.log, "undo-seal")
+				return undoSealErr
+			}).
+			AddStep("add-keyslot", s.step("do-add-keyslot", errors.New("some error")), s.step("undo-add-keyslot", nil))
+	}
+
+	err := newTransaction().Run()
+	c.Check(err, ErrorMatches, "transaction step \"add-keyslot\" failed \\(some error\\) and rollback failed \\(cannot undo step \"seal\": undo error\\)")
+	c.Check(s.log, DeepEquals, []string{"do-provision", "do-seal", "do-add-keyslot", "undo-add-keyslot", "undo-seal"})
+
+	pending, err := newTransaction().Pending()
+	c.Check(err, IsNil)
+	c.Check(pending, Equals, true)
+
+	// Retry the rollback once the underlying problem is fixed.
+	undoSealErr = nil
+	s.log = nil
+	c.Check(newTransaction().Rollback(), IsNil)
+	c.Check(s.log, DeepEquals, []string{"undo-seal", "undo-provision"})
+	s.checkNoJournal(c)
+}
+
+func (s *transactionSuite) TestRunResume(c *C) {
+	s.runAndCrash(c, NewTransaction("enrol", s.journalPath).
+		AddStep("provision", s.step("do-provision", nil), s.step("undo-provision", nil)).
+		AddStep("seal", s.crashingStep("do-seal"), s.step("undo-seal", nil)).
+		AddStep("add-keyslot", s.step("do-add-keyslot", nil), nil))
+	c.Check(s.log, DeepEquals, []string{"do-provision", "do-seal"})
+
+	s.log = nil
+	c.Check(NewTransaction("enrol", s.journalPath).
+		AddStep("provision", s.step("do-provision", nil), s.step("undo-provision", nil)).
+		AddStep("seal", s.step("do-seal", nil), s.step("undo-seal", nil)).
+		AddStep("add-keyslot", s.step("do-add-keyslot", nil), nil).Run(), IsNil)
+	c.Check(s.log, DeepEquals, []string{"do-seal", "do-add-keyslot"})
+	s.checkNoJournal(c)
+}
+
+func (s *transactionSuite) TestRollbackInterrupted(c *C) {
+	s.runAndCrash(c, NewTransaction("enrol", s.journalPath).
+		AddStep("provision", s.step("do-provision", nil), s.step("undo-provision", nil)).
+		AddStep("seal", s.crashingStep("do-seal"), s.step("undo-seal", nil)))
+
+	s.log = nil
+	c.Check(NewTransaction("enrol", s.journalPath).
+		AddStep("provision", s.step("do-provision", nil), s.step("undo-provision", nil)).
+		AddStep("seal", s.step("do-seal", nil), s.step("undo-seal", nil)).Rollback(), IsNil)
+	c.Check(s.log, DeepEquals, []string{"undo-seal", "undo-provision"})
+	s.checkNoJournal(c)
+}
+
+func (s *transactionSuite) TestRollbackNoJournal(c *C) {
+	c.Check(NewTransaction("enrol", s.journalPath).
+		AddStep("provision", s.step("do-provision", nil), s.step("undo-provision", nil)).Rollback(), IsNil)
+	c.Check(s.log, HasLen, 0)
+}
+
+func (s *transactionSuite) TestRunMismatchedJournal(c *C) {
+	s.runAndCrash(c, NewTransaction("enrol", s.journalPath).
+		AddStep("provision", s.crashingStep("do-provision"), nil))
+
+	s.log = nil
+	c.Check(NewTransaction("other", s.journalPath).
+		AddStep("provision", s.step("do-provision", nil), nil).Run(), ErrorMatches,
+		"cannot read journal: journal belongs to a different transaction \\(\"enrol\"\\)")
+	c.Check(NewTransaction("enrol", s.journalPath).
+		AddStep("seal", s.step("do-seal", nil), nil).Run(), ErrorMatches,
+		"cannot read journal: journal has an unexpected step at index 0 \\(\"provision\"\\)")
+	c.Check(s.log, HasLen, 0)
+}
+
+// enrolmentCryptsetupBottom implements just enough of cryptsetup to store a single token and a single keyslot. Adding a key fails
+// if the file at the third path exists.
+const enrolmentCryptsetupBottom = `
+case "$1" in
+luksDump)
+	if [ -f %[1]s ]; then
+		printf '{"tokens":{"3":'
+		cat %[1]s
+		printf '}}'
+	else
+		echo '{"tokens":{}}'
+	fi
+	;;
+token)
+	case "$2" in
+	import)
+		cat > %[1]s
+		;;
+	remove)
+		rm -f %[1]s
+		;;
+	esac
+	;;
+open)
+	[ -f %[2]s ]
+	;;
+luksAddKey)
+	cat "$3" > /dev/null
+	if [ -f %[3]s ]; then
+		exit 1
+	fi
+	touch %[2]s
+	;;
+luksKillSlot)
+	rm -f %[2]s
+	;;
+esac
+`
+
+type enrolmentTransactionSuite struct {
+	testutil.TPMSimulatorTestBase
+	dir            string
+	mockCryptsetup *snapd_testutil.MockCmd
+	params         *EnrolmentTransactionParams
+}
+
+var _ = Suite(&enrolmentTransactionSuite{})
+
+func (s *enrolmentTransactionSuite) SetUpTest(c *C) {
+	s.TPMSimulatorTestBase.SetUpTest(c)
+
+	s.dir = c.MkDir()
+	s.mockCryptsetup = snapd_testutil.MockCommand(c, "cryptsetup", fmt.Sprintf(enrolmentCryptsetupBottom,
+		filepath.Join(s.dir, "token"), filepath.Join(s.dir, "keyslot"), filepath.Join(s.dir, "fail")))
+	s.AddCleanup(s.mockCryptsetup.Restore)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+	s.params = &EnrolmentTransactionParams{
+		ProvisionMode:     ProvisionModeFull,
+		KeyCreationParams: &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x0181fff0},
+		Key:               key,
+		ExistingKey:       make([]byte, 64),
+		DevicePath:        "/dev/sda1",
+		Keyslot:           1,
+		TokenID:           3,
+		StagingPath:       filepath.Join(s.dir, "keydata")}
+}
+
+func (s *enrolmentTransactionSuite) checkCounterDefined(c *C, defined bool) {
+	index, err := s.TPM.CreateResourceContextFromTPM(s.params.KeyCreationParams.PCRPolicyCounterHandle)
+	if !defined {
+		c.Check(tpm2.IsResourceUnavailableError(err, s.params.KeyCreationParams.PCRPolicyCounterHandle), Equals, true)
+		return
+	}
+	c.Assert(err, IsNil)
+	s.AddCleanupNVSpace(c, s.TPM.OwnerHandleContext(), index)
+}
+
+func (s *enrolmentTransactionSuite) TestRun(c *C) {
+	t := NewEnrolmentTransaction(s.TPM, filepath.Join(s.dir, "journal"), s.params)
+	c.Assert(t.Run(), IsNil)
+	s.checkCounterDefined(c, true)
+
+	_, err := os.Stat(s.params.StagingPath)
+	c.Check(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(filepath.Join(s.dir, "keyslot"))
+	c.Check(err, IsNil)
+
+	k, err := ReadSealedKeyObjectFromLocation(NewLUKS2TokenKeyLocation(s.params.DevicePath, s.params.TokenID, s.params.Keyslot))
+	c.Assert(err, IsNil)
+	key, _, err := k.UnsealFromTPM(s.TPM, "")
+	c.Check(err, IsNil)
+	c.Check(bytes.Equal(key, s.params.Key), Equals, true)
+}
+
+func (s *enrolmentTransactionSuite) TestRollback(c *C) {
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, "fail"), nil, 0644), IsNil)
+
+	t := NewEnrolmentTransaction(s.TPM, filepath.Join(s.dir, "journal"), s.params)
+	err := t.Run()
+	c.Assert(err, FitsTypeOf, &TransactionError{})
+	c.Check(err.(*TransactionError).Step, Equals, "add-keyslot")
+	c.Check(err.(*TransactionError).RollbackErr, IsNil)
+
+	// The sealed key and its PCR policy counter are removed, and the LUKS2 container is untouched.
+	s.checkCounterDefined(c, false)
+	for _, name := range []string{"keydata", "keyslot", "token", "journal"} {
+		_, err := os.Stat(filepath.Join(s.dir, name))
+		c.Check(os.IsNotExist(err), Equals, true, Commentf("%s", name))
+	}
+}
@@ -20,6 +20,11 @@
 package secboot
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/canonical/go-tpm2"
 	"github.com/canonical/go-tpm2/mu"
 	"github.com/snapcore/secboot/internal/tcg"
@@ -66,9 +71,173 @@ import (
 // condition can also occur as the result of an incorrectly provisioned TPM, which will be detected during a subsequent call to
 // SealKeyToTPM.
 //
+// If TPMConnection.RequireVerifiedSession is enabled and the connection doesn't have a verified session, a ErrNoVerifiedSession
+// error will be returned.
+//
+// If PCR protection policies were locked with LockPCRProtectionPolicies and the TPM has since been restarted or reset, eg,
+// because the system resumed from hibernation, a ErrPCRProtectionPoliciesLockLost error will be returned.
+//
+// If the key file was created with the BindToEK option and the connection doesn't have a session that is salted with a verified
+// endorsement key, then a ErrNoVerifiedSession error will be returned. If the TPM cannot prove that it holds the endorsement key
+// that the key file is bound to, then a ErrTPMIdentityMismatch error will be returned.
+//
 // On success, the unsealed cleartext key is returned as the first return value, and the private part of the key used for
-// authorizing PCR policy updates with UpdateKeyPCRProtectionPolicy is returned as the second return value.
+// authorizing PCR policy updates with UpdateKeyPCRProtectionPolicy is returned as the second return value. These are ordinary byte
+// slices, and it is the caller's responsibility to wipe them. Use UnsealFromTPMWithResult to obtain them in SecretBuffers instead.
 func (k *SealedKeyObject) UnsealFromTPM(tpm *TPMConnection, pin string) (key []byte, authKey TPMPolicyAuthKey, err error) {
+	result, err := k.UnsealFromTPMWithResult(tpm, pin)
+	if err != nil {
+		return nil, nil, err
+	}
+	return result.Key.Bytes(), result.AuthKey.Bytes(), nil
+}
+
+// UnsealResult is returned from SealedKeyObject.UnsealFromTPMWithResult. As well as the unsealed key, it contains the information
+// about the sealed key object that callers commonly need in order to reseal the key or to store it in the kernel keyring, so that
+// they don't need to read the key data file again.
+type UnsealResult struct {
+	Key     *SecretBuffer // The unsealed cleartext key
+	AuthKey *SecretBuffer // The private part of the key used for authorizing PCR policy updates, see TPMPolicyAuthKey
+
+	KeyID               *KeyID // The unique ID of the key, or nil if none was recorded
+	PCRPolicyGeneration uint64 // The generation of the PCR policy that was used to unseal the key, or zero if not recorded
+
+	// Name is the name of the sealed key object that protects the key, which identifies the protector independently of the
+	// metadata. It changes whenever the key is resealed.
+	Name tpm2.Name
+
+	// Location is the location that the sealed key object was read from, or nil if it isn't known (eg, if it was imported
+	// with ImportKeyData).
+	Location KeyLocation
+
+	Version                uint32      // The version of the key data
+	AuthMode               AuthMode    // The 2nd-factor authentication type of the key
+	PCRPolicyCounterHandle tpm2.Handle // The handle of the PCR policy counter, or tpm2.HandleNull if there isn't one
+	Metadata               KeyMetadata // The metadata stored with the key, if any
+}
+
+// Close wipes the unsealed key and the private part of the key used for authorizing PCR policy updates.
+func (r *UnsealResult) Close() error {
+	r.Key.Wipe()
+	r.AuthKey.Wipe()
+	return nil
+}
+
+// UnsealFromTPMWithResult behaves the same as UnsealFromTPM, but on success it returns the unsealed key and the private part of
+// the key used for authorizing PCR policy updates as part of a UnsealResult, along with details of this sealed key object. The
+// secrets are returned in SecretBuffers, and the caller should call UnsealResult.Close once it has finished with them. The
+// errors returned from this function are the same as those returned from UnsealFromTPM.
+func (k *SealedKeyObject) UnsealFromTPMWithResult(tpm *TPMConnection, pin string) (*UnsealResult, error) {
+	pinBytes := []byte(pin)
+	defer wipeBytes(pinBytes)
+	return k.unsealFromTPMWithResult(tpm, pinBytes, nil)
+}
+
+// unsealFromTPMWithResult implements UnsealFromTPMWithResult. The time spent in each phase is also added to parentPhases if it
+// isn't nil.
+func (k *SealedKeyObject) unsealFromTPMWithResult(tpm *TPMConnection, pin []byte, parentPhases *metricsPhases) (*UnsealResult, error) {
+	name, err := k.data.keyPublic.Name()
+	if err != nil {
+		return nil, InvalidKeyFileError{fmt.Sprintf("cannot compute name of sealed key object: %v", err)}
+	}
+
+	key, authKey, err := k.unsealFromTPM(tpm, pin, nil, parentPhases)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &UnsealResult{
+		Key:                    NewSecretBuffer(key),
+		AuthKey:                NewSecretBuffer(authKey),
+		PCRPolicyGeneration:    k.PCRPolicyGeneration(),
+		Name:                   name,
+		Location:               k.location,
+		Version:                k.Version(),
+		AuthMode:               k.AuthMode2F(),
+		PCRPolicyCounterHandle: k.PCRPolicyCounterHandle(),
+		Metadata:               k.Metadata()}
+	if id, ok := k.KeyID(); ok {
+		result.KeyID = &id
+	}
+	return result, nil
+}
+
+// UnsealFromTPMWithAudit behaves the same as UnsealFromTPM, but the commands used to execute the authorization policy and unseal
+// the key are also executed with an audit session that uses the digest algorithm specified by the auditAlg argument. On success,
+// the audit digest for this session is obtained from the TPM and returned as the third return value. This permits a caller to
+// verify after the fact that the TPM executed the expected sequence of commands with the expected parameters, by comparing the
+// returned value with a digest computed from the expected command and response parameters.
+//
+// Obtaining the audit digest requires the use of the endorsement hierarchy as the privacy administrator. If the endorsement
+// hierarchy has an authorization value, it must be provided by calling TPMConnection.EndorsementHandleContext().SetAuthValue()
+// prior to calling this function, or supplied on demand by a callback set with TPMConnection.SetHierarchyAuthFunc. The returned
+// digest is not signed, but the command used to obtain it is integrity protected with the connection's HMAC session.
+//
+// The errors returned from this function are the same as those returned from UnsealFromTPM. If auditAlg is not permitted by the
+// algorithm policy installed with SetAlgorithmPolicy, a AlgorithmPolicyError error will be returned.
+func (k *SealedKeyObject) UnsealFromTPMWithAudit(tpm *TPMConnection, pin string, auditAlg tpm2.HashAlgorithmId) (key []byte, authKey TPMPolicyAuthKey, auditDigest tpm2.Digest, err error) {
+	if err := algorithmPolicy.checkDigestAlgorithm(auditAlg); err != nil {
+		return nil, nil, nil, err
+	}
+	if !auditAlg.Supported() {
+		return nil, nil, nil, errors.New("unsupported audit digest algorithm")
+	}
+
+	auditSession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypeHMAC, nil, auditAlg)
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot start audit session: %w", err)
+	}
+	defer tpm.FlushContext(auditSession)
+
+	pinBytes := []byte(pin)
+	defer wipeBytes(pinBytes)
+	key, authKey, err = k.unsealFromTPM(tpm, pinBytes, auditSession.WithAttrs(tpm2.AttrContinueSession|tpm2.AttrAudit), nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var auditInfo *tpm2.Attest
+	if err := tpm.runWithHierarchyAuth(func() error {
+		var err error
+		auditInfo, _, err = tpm.GetSessionAuditDigest(tpm.EndorsementHandleContext(), nil, auditSession, nil, nil,
+			tpm.currentHmacSession(), nil)
+		switch {
+		case isAuthFailError(err, tpm2.CommandGetSessionAuditDigest, 1):
+			return AuthFailError{tpm2.HandleEndorsement}
+		case err != nil:
+			return xerrors.Errorf("cannot obtain session audit digest: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return nil, nil, nil, err
+	}
+
+	attest, err := auditInfo.Decode()
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot decode session audit digest: %w", err)
+	}
+	if attest.Type != tpm2.TagAttestSessionAudit {
+		return nil, nil, nil, errors.New("TPM returned the wrong type of attestation structure")
+	}
+
+	return key, authKey, attest.Attested.SessionAudit().SessionDigest, nil
+}
+
+// unsealFromTPM unseals the key. The time spent in each phase is reported with the unseal operation metrics, and is also added
+// to parentPhases if it isn't nil.
+func (k *SealedKeyObject) unsealFromTPM(tpm *TPMConnection, pin []byte, auditSession tpm2.SessionContext, parentPhases *metricsPhases) (key []byte, authKey TPMPolicyAuthKey, err error) {
+	phases := new(metricsPhases)
+	defer observeOperationPhases(MetricsOperationUnseal, time.Now(), &err, nil, phases)
+	defer parentPhases.merge(phases)
+	defer func() {
+		tpm.notifyForError(k.data.keyIDs(), err)
+	}()
+
+	var extraSessions []tpm2.SessionContext
+	if auditSession != nil {
+		extraSessions = append(extraSessions, auditSession)
+	}
+
 	// Check if the TPM is in lockout mode
 	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
 	if err != nil {
@@ -79,11 +248,22 @@ func (k *SealedKeyObject) UnsealFromTPM(tpm *TPMConnection, pin string) (key []b
 		return nil, nil, ErrTPMLockout
 	}
 
+	// Refuse to unseal if the OS believes that access to sealed keys is locked but the fence has been removed by a TPM restart
+	// or reset, eg, after resuming from hibernation.
+	if _, err := checkPCRPolicyLock(tpm); err != nil {
+		return nil, nil, err
+	}
+
 	// Use the HMAC session created when the connection was opened for parameter encryption rather than creating a new one.
-	hmacSession := tpm.HmacSession()
+	hmacSession, err := tpm.secretSession()
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Load the key data
+	start := time.Now()
 	keyObject, err := k.data.load(tpm.TPMContext, hmacSession)
+	phases.observe(MetricsPhaseLoad, start)
 	switch {
 	case isKeyFileError(err):
 		// A keyFileError can be as a result of an improperly provisioned TPM - detect if the object at tcg.SRKHandle is a valid primary key
@@ -97,7 +277,7 @@ func (k *SealedKeyObject) UnsealFromTPM(tpm *TPMConnection, pin string) (key []b
 		case err2 != nil:
 			return nil, nil, xerrors.Errorf("cannot create context for SRK: %w", err2)
 		}
-		ok, err2 := isObjectPrimaryKeyWithTemplate(tpm.TPMContext, tpm.OwnerHandleContext(), srk, tcg.SRKTemplate, tpm.HmacSession())
+		ok, err2 := isObjectPrimaryKeyWithTemplate(tpm.TPMContext, tpm.OwnerHandleContext(), srk, tcg.SRKTemplate, tpm.currentHmacSession())
 		switch {
 		case err2 != nil:
 			return nil, nil, xerrors.Errorf("cannot determine if object at 0x%08x is a primary key in the storage hierarchy: %w", tcg.SRKHandle, err2)
@@ -115,13 +295,17 @@ func (k *SealedKeyObject) UnsealFromTPM(tpm *TPMConnection, pin string) (key []b
 	defer tpm.FlushContext(keyObject)
 
 	// Begin and execute policy session
-	policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, k.data.keyPublic.NameAlg)
+	start = time.Now()
+	policySession, releasePolicySession, err := tpm.startPolicySession(k.data.keyPublic.NameAlg)
 	if err != nil {
-		return nil, nil, xerrors.Errorf("cannot start policy session: %w", err)
+		phases.observe(MetricsPhasePolicySession, start)
+		return nil, nil, err
 	}
-	defer tpm.FlushContext(policySession)
+	defer releasePolicySession()
 
-	if err := executePolicySession(tpm.TPMContext, policySession, k.data.version, k.data.staticPolicyData, k.data.dynamicPolicyData, pin, hmacSession); err != nil {
+	err = executePolicySession(tpm.TPMContext, policySession, k.data.version, k.data.staticPolicyData, k.data.dynamicPolicyData, pin, hmacSession, extraSessions...)
+	phases.observe(MetricsPhasePolicySession, start)
+	if err != nil {
 		err = xerrors.Errorf("cannot complete authorization policy assertions: %w", err)
 		switch {
 		case isDynamicPolicyDataError(err):
@@ -133,16 +317,24 @@ func (k *SealedKeyObject) UnsealFromTPM(tpm *TPMConnection, pin string) (key []b
 			return nil, nil, ErrPINFail
 		case tpm2.IsResourceUnavailableError(err, lockNVHandle):
 			return nil, nil, InvalidKeyFileError{"required legacy lock NV index is not present"}
+		case k.data.version == 0 && tpm2.IsTPMError(err, tpm2.ErrorNVLocked, tpm2.CommandPolicyNV):
+			// The legacy lock NV index has been read locked, which blocks access to version 0 keys until the next TPM reset.
+			// Other TPM2_PolicyNV failures, such as a revoked PCR policy or a malformed NV index, are not a blocked unseal.
+			tpm.notify(&SecurityEvent{Type: SecurityEventUnsealBlocked, KeyIDs: k.data.keyIDs()})
 		}
 		return nil, nil, err
 	}
 
 	// For metadata version > 0, the PIN is the auth value for the sealed key object, and the authorization
 	// policy asserts that this value is known when the policy session is used.
-	keyObject.SetAuthValue([]byte(pin))
+	authValue := append([]byte(nil), pin...)
+	defer wipeBytes(authValue)
+	keyObject.SetAuthValue(authValue)
 
 	// Unseal
-	keyData, err := tpm.Unseal(keyObject, policySession, hmacSession.IncludeAttrs(tpm2.AttrResponseEncrypt))
+	start = time.Now()
+	keyData, err := tpm.Unseal(keyObject, policySession.IncludeAttrs(tpm2.AttrContinueSession), append([]tpm2.SessionContext{hmacSession.IncludeAttrs(tpm2.AttrResponseEncrypt)}, extraSessions...)...)
+	phases.observe(MetricsPhaseUnseal, start)
 	switch {
 	case tpm2.IsTPMSessionError(err, tpm2.ErrorPolicyFail, tpm2.CommandUnseal, 1):
 		return nil, nil, InvalidKeyFileError{"the authorization policy check failed during unsealing"}
@@ -156,10 +348,34 @@ func (k *SealedKeyObject) UnsealFromTPM(tpm *TPMConnection, pin string) (key []b
 		return keyData, nil, nil
 	}
 
-	var sealedData sealedData
+	// The sealed key and authorization key are copied out of the unsealed data when it is unmarshalled, so make sure that
+	// the unsealed data is wiped.
+	defer wipeBytes(keyData)
+
+	if k.data.version == 1 {
+		var sealedData sealedData
+		if _, err := mu.UnmarshalFromBytes(keyData, &sealedData); err != nil {
+			return nil, nil, InvalidKeyFileError{err.Error()}
+		}
+		return sealedData.Key, sealedData.AuthPrivateKey, nil
+	}
+
+	var sealedData sealedData_v2
 	if _, err := mu.UnmarshalFromBytes(keyData, &sealedData); err != nil {
 		return nil, nil, InvalidKeyFileError{err.Error()}
 	}
 
+	// If the sealed key object is bound to an endorsement key, the unsealed data must have been returned via a session that is
+	// salted with that key. Only the TPM that holds the private part of it can compute a valid response HMAC for that session, but
+	// this is only meaningful if the endorsement key has been verified against its certificate.
+	if len(sealedData.EKName) > 0 {
+		if !tpm.hasVerifiedSession() {
+			return nil, nil, ErrNoVerifiedSession
+		}
+		if !bytes.Equal(sealedData.EKName, tpm.hmacSessionEkName) {
+			return nil, nil, ErrTPMIdentityMismatch
+		}
+	}
+
 	return sealedData.Key, sealedData.AuthPrivateKey, nil
 }
@@ -21,6 +21,7 @@ package secboot_test
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io"
 	"io/ioutil"
 	"math/rand"
@@ -31,6 +32,7 @@ import (
 	"github.com/canonical/go-tpm2"
 	. "github.com/snapcore/secboot"
 	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/testutil"
 )
 
 func TestUnsealWithNo2FA(t *testing.T) {
@@ -88,6 +90,475 @@ func TestUnsealWithNo2FA(t *testing.T) {
 	t.Run("NoPCRPolicyCounterHandle", func(t *testing.T) {
 		run(t, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: tpm2.HandleNull})
 	})
+
+	t.Run("BindToEK", func(t *testing.T) {
+		if len(tpm.VerifiedEKCertChain()) == 0 {
+			t.SkipNow()
+		}
+		run(t, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x0181fff0, BindToEK: true})
+	})
+}
+
+func TestUnsealBoundToEKErrorHandling(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if len(tpm.VerifiedEKCertChain()) == 0 {
+		t.SkipNow()
+	}
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealBoundToEKErrorHandling_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x0181fff0, BindToEK: true}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	t.Run("EKNameMismatch", func(t *testing.T) {
+		restore := tpm.MockHmacSessionEkName(append(tpm2.Name{0x00, 0x0b}, make([]byte, 32)...))
+		defer restore()
+
+		_, _, err := k.UnsealFromTPM(tpm, "")
+		if err != ErrTPMIdentityMismatch {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Unverified", func(t *testing.T) {
+		restore := tpm.MockUnverified()
+		defer restore()
+
+		_, _, err := k.UnsealFromTPM(tpm, "")
+		if err != ErrNoVerifiedSession {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("SealUnverified", func(t *testing.T) {
+		restore := tpm.MockUnverified()
+		defer restore()
+
+		_, err := SealKeyToTPM(tpm, key, tmpDir+"/keydata2", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: tpm2.HandleNull, BindToEK: true})
+		if err != ErrNoVerifiedSession {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
+func TestUnsealWithoutPCRBinding(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealWithoutPCRBinding_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	authKey, err := SealKeyToTPMWithoutPCRBinding(tpm, []*SealKeyRequest{{Key: key, Path: keyFile}})
+	if err != nil {
+		t.Fatalf("SealKeyToTPMWithoutPCRBinding failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if k.IsPCRBound() {
+		t.Errorf("IsPCRBound should return false")
+	}
+	if k.PCRPolicyCounterHandle() != tpm2.HandleNull {
+		t.Errorf("Unexpected PCR policy counter handle: %v", k.PCRPolicyCounterHandle())
+	}
+
+	// Changing PCR values should not affect the ability to unseal the key.
+	if _, err := tpm.PCREvent(tpm.PCRHandleContext(7), []byte("foo"), nil); err != nil {
+		t.Fatalf("PCREvent failed: %v", err)
+	}
+
+	keyUnsealed, authKeyUnsealed, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+	if !bytes.Equal(authKey, authKeyUnsealed) {
+		t.Errorf("TPM returned the wrong auth key")
+	}
+}
+
+// recordingTcti records the commands sent to and the responses received from the TPM.
+type recordingTcti struct {
+	tcti     io.ReadWriteCloser
+	commands []*recordedCommand
+}
+
+type recordedCommand struct {
+	cmd []byte
+	rsp []byte
+}
+
+func (t *recordingTcti) Write(data []byte) (int, error) {
+	t.commands = append(t.commands, &recordedCommand{cmd: append([]byte(nil), data...)})
+	return t.tcti.Write(data)
+}
+
+func (t *recordingTcti) Read(data []byte) (int, error) {
+	n, err := t.tcti.Read(data)
+	if len(t.commands) > 0 {
+		c := t.commands[len(t.commands)-1]
+		c.rsp = append(c.rsp, data[:n]...)
+	}
+	return n, err
+}
+
+func (t *recordingTcti) Close() error {
+	return t.tcti.Close()
+}
+
+func openRecordingTPMSimulatorForTesting(t *testing.T) (*TPMConnection, *recordingTcti) {
+	if !testutil.UseMssim {
+		t.SkipNow()
+	}
+
+	var tcti *recordingTcti
+	restore := testutil.MockOpenDefaultTctiFn(func() (io.ReadWriteCloser, error) {
+		mssim, err := tpm2.OpenMssim("", testutil.MssimPort, testutil.MssimPort+1)
+		if err != nil {
+			return nil, err
+		}
+		tcti = &recordingTcti{tcti: mssim}
+		return tcti, nil
+	})
+	defer restore()
+
+	tpm, err := ConnectToDefaultTPM()
+	if err != nil {
+		t.Fatalf("ConnectToDefaultTPM failed: %v", err)
+	}
+	tpm.RequireVerifiedSession(false)
+	return tpm, tcti
+}
+
+// auditHandleCounts is the number of handles in the command handle area of the commands that may be sent with sessions while
+// unsealing a key, and the number of handles in the response handle area.
+var auditHandleCounts = map[tpm2.CommandCode][2]int{
+	tpm2.CommandNVReadPublic:          {1, 0},
+	tpm2.CommandReadPublic:            {1, 0},
+	tpm2.CommandNVRead:                {2, 0},
+	tpm2.CommandLoad:                  {1, 1},
+	tpm2.CommandLoadExternal:          {0, 1},
+	tpm2.CommandVerifySignature:       {1, 0},
+	tpm2.CommandUnseal:                {1, 0},
+	tpm2.CommandPolicyPCR:             {1, 0},
+	tpm2.CommandPolicyOR:              {1, 0},
+	tpm2.CommandPolicyAuthorize:       {1, 0},
+	tpm2.CommandPolicyAuthValue:       {1, 0},
+	tpm2.CommandPolicyCommandCode:     {1, 0},
+	tpm2.CommandPolicyGetDigest:       {1, 0},
+	tpm2.CommandPolicyNV:              {3, 0},
+	tpm2.CommandPolicySecret:          {2, 0},
+	tpm2.CommandStartAuthSession:      {2, 1},
+	tpm2.CommandGetSessionAuditDigest: {3, 0},
+}
+
+func splitTPM2B(t *testing.T, b []byte) (data, rest []byte) {
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+		t.Fatalf("truncated sized buffer")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	return b[2 : 2+n], b[2+n:]
+}
+
+// computeSessionAuditDigest computes the expected digest of the audit session used by the last TPM2_GetSessionAuditDigest
+// command in the supplied commands, from the command and response parameters of the commands that were executed with it. It also
+// returns the codes of the audited commands.
+func computeSessionAuditDigest(t *testing.T, alg tpm2.HashAlgorithmId, commands []*recordedCommand) (tpm2.Digest, []tpm2.CommandCode) {
+	const sessionsTag = 0x8002
+	const sessionAttrAudit = 0x80 // The audit bit of TPMA_SESSION
+
+	// Find the audit session, which is the third handle of TPM2_GetSessionAuditDigest.
+	var auditSession tpm2.Handle
+	for _, c := range commands {
+		if tpm2.CommandCode(binary.BigEndian.Uint32(c.cmd[6:10])) == tpm2.CommandGetSessionAuditDigest {
+			auditSession = tpm2.Handle(binary.BigEndian.Uint32(c.cmd[18:22]))
+		}
+	}
+	if auditSession == 0 {
+		t.Fatalf("no TPM2_GetSessionAuditDigest command")
+	}
+
+	names := make(map[tpm2.Handle]tpm2.Name)
+	digest := make(tpm2.Digest, alg.Size())
+	var audited []tpm2.CommandCode
+
+	for _, c := range commands {
+		cmdTag := binary.BigEndian.Uint16(c.cmd[0:2])
+		code := tpm2.CommandCode(binary.BigEndian.Uint32(c.cmd[6:10]))
+		if len(c.rsp) < 10 || binary.BigEndian.Uint32(c.rsp[6:10]) != 0 {
+			// Unsuccessful commands aren't audited.
+			continue
+		}
+		if cmdTag != sessionsTag {
+			continue
+		}
+		counts, ok := auditHandleCounts[code]
+		if !ok {
+			t.Fatalf("unexpected command with sessions: %v", code)
+		}
+
+		// Decode the command handle area, authorization area and parameter area.
+		cmd := c.cmd[10:]
+		var handles []tpm2.Handle
+		for i := 0; i < counts[0]; i++ {
+			handles = append(handles, tpm2.Handle(binary.BigEndian.Uint32(cmd)))
+			cmd = cmd[4:]
+		}
+		authSize := binary.BigEndian.Uint32(cmd)
+		authArea := cmd[4 : 4+authSize]
+		cpBytes := cmd[4+authSize:]
+
+		isAudited := false
+		for len(authArea) > 0 {
+			handle := tpm2.Handle(binary.BigEndian.Uint32(authArea))
+			_, authArea = splitTPM2B(t, authArea[4:])
+			attrs := authArea[0]
+			_, authArea = splitTPM2B(t, authArea[1:])
+			if handle == auditSession && attrs&sessionAttrAudit != 0 {
+				isAudited = true
+			}
+		}
+
+		// Decode the response handle area and parameter area.
+		rsp := c.rsp[10:]
+		var rspHandles []tpm2.Handle
+		for i := 0; i < counts[1]; i++ {
+			rspHandles = append(rspHandles, tpm2.Handle(binary.BigEndian.Uint32(rsp)))
+			rsp = rsp[4:]
+		}
+		rpBytes := rsp[4 : 4+binary.BigEndian.Uint32(rsp)]
+
+		// Track the names of the entities that are referenced by handle.
+		switch code {
+		case tpm2.CommandLoad, tpm2.CommandLoadExternal:
+			name, _ := splitTPM2B(t, rpBytes)
+			names[rspHandles[0]] = name
+		case tpm2.CommandNVReadPublic, tpm2.CommandReadPublic:
+			_, rest := splitTPM2B(t, rpBytes)
+			name, _ := splitTPM2B(t, rest)
+			names[handles[0]] = name
+		}
+
+		if !isAudited {
+			continue
+		}
+		audited = append(audited, code)
+
+		cpHash := alg.NewHash()
+		binary.Write(cpHash, binary.BigEndian, code)
+		for _, h := range handles {
+			switch h.Type() {
+			case tpm2.HandleTypeNVIndex, tpm2.HandleTypeTransient, tpm2.HandleTypePersistent:
+				name, ok := names[h]
+				if !ok {
+					t.Fatalf("no name for handle 0x%08x", h)
+				}
+				cpHash.Write(name)
+			default:
+				binary.Write(cpHash, binary.BigEndian, h)
+			}
+		}
+		cpHash.Write(cpBytes)
+
+		rpHash := alg.NewHash()
+		binary.Write(rpHash, binary.BigEndian, uint32(0))
+		binary.Write(rpHash, binary.BigEndian, code)
+		rpHash.Write(rpBytes)
+
+		h := alg.NewHash()
+		h.Write(digest)
+		h.Write(cpHash.Sum(nil))
+		h.Write(rpHash.Sum(nil))
+		digest = h.Sum(nil)
+	}
+
+	return digest, audited
+}
+
+func TestUnsealWithAudit(t *testing.T) {
+	tpm, tcti := openRecordingTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealWithAudit_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x0181fff0})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	tcti.commands = nil
+	keyUnsealed, authKeyUnsealed, auditDigest, err := k.UnsealFromTPMWithAudit(tpm, "", tpm2.HashAlgorithmSHA256)
+	if err != nil {
+		t.Fatalf("UnsealFromTPMWithAudit failed: %v", err)
+	}
+
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+	if !bytes.Equal(authKey, authKeyUnsealed) {
+		t.Errorf("TPM returned the wrong auth key")
+	}
+
+	// Verify the audit digest against the commands that were actually sent to the TPM.
+	expectedDigest, audited := computeSessionAuditDigest(t, tpm2.HashAlgorithmSHA256, tcti.commands)
+	if !bytes.Equal(auditDigest, expectedDigest) {
+		t.Errorf("Unexpected audit digest (got %x, expected %x)", auditDigest, expectedDigest)
+	}
+	if len(audited) == 0 || audited[0] == tpm2.CommandUnseal || audited[len(audited)-1] != tpm2.CommandUnseal {
+		t.Errorf("Unexpected audited commands: %v", audited)
+	}
+	for _, code := range []tpm2.CommandCode{tpm2.CommandPolicyPCR, tpm2.CommandPolicyAuthorize, tpm2.CommandPolicyNV} {
+		found := false
+		for _, a := range audited {
+			if a == code {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("Command %v was not audited", code)
+		}
+	}
+}
+
+func TestUnsealWithResult(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealWithResult_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: 0x0181fff0,
+		Metadata:               &KeyMetadata{Role: "run", Label: "test"}})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	result, err := k.UnsealFromTPMWithResult(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPMWithResult failed: %v", err)
+	}
+
+	if !bytes.Equal(key, result.Key.Bytes()) {
+		t.Errorf("TPM returned the wrong key")
+	}
+	if !bytes.Equal(authKey, result.AuthKey.Bytes()) {
+		t.Errorf("TPM returned the wrong auth key")
+	}
+	id, ok := k.KeyID()
+	if !ok {
+		t.Fatalf("No key ID recorded")
+	}
+	if result.KeyID == nil || *result.KeyID != id {
+		t.Errorf("Unexpected key ID")
+	}
+	if result.PCRPolicyGeneration != 1 {
+		t.Errorf("Unexpected PCR policy generation: %d", result.PCRPolicyGeneration)
+	}
+	if result.Version != CurrentMetadataVersion {
+		t.Errorf("Unexpected version: %d", result.Version)
+	}
+	if result.AuthMode != AuthModeNone {
+		t.Errorf("Unexpected auth mode: %v", result.AuthMode)
+	}
+	if result.PCRPolicyCounterHandle != 0x0181fff0 {
+		t.Errorf("Unexpected PCR policy counter handle: %v", result.PCRPolicyCounterHandle)
+	}
+	if result.Metadata.Role != "run" || result.Metadata.Label != "test" {
+		t.Errorf("Unexpected metadata: %v", result.Metadata)
+	}
+	if result.Location != FileKeyLocation(keyFile) {
+		t.Errorf("Unexpected location: %v", result.Location)
+	}
+	expectedName, err := k.SealedObjectName()
+	if err != nil {
+		t.Fatalf("SealedObjectName failed: %v", err)
+	}
+	if !bytes.Equal(result.Name, expectedName) {
+		t.Errorf("Unexpected name: %x", result.Name)
+	}
+
+	result.Close()
+	if result.Key.Len() != 0 || result.AuthKey.Len() != 0 {
+		t.Errorf("Close didn't wipe the secrets")
+	}
 }
 
 func TestUnsealRelated(t *testing.T) {
@@ -137,6 +608,72 @@ func TestUnsealRelated(t *testing.T) {
 	}
 }
 
+func TestUnsealWithSessionReuse(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealWithSessionReuse_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keys := []*SealKeyRequest{
+		{Key: make([]byte, 64), Path: filepath.Join(tmpDir, "keydata1")},
+		{Key: make([]byte, 64), Path: filepath.Join(tmpDir, "keydata2")}}
+	for _, k := range keys {
+		rand.Read(k.Key)
+	}
+
+	if _, err := SealKeyToTPMMultiple(tpm, keys, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x0181fff0}); err != nil {
+		t.Fatalf("SealKeyToTPMMultiple failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keys[0].Path)
+
+	countSessions := func() int {
+		handles, err := tpm.GetCapabilityHandles(tpm2.HandleTypeLoadedSession.BaseHandle(), tpm2.CapabilityMaxProperties)
+		if err != nil {
+			t.Fatalf("GetCapability failed: %v", err)
+		}
+		return len(handles)
+	}
+	origSessions := countSessions()
+
+	tpm.ReuseSessions(true)
+	defer tpm.ReuseSessions(false)
+
+	// Unseal each key twice, to make sure that a retained session can be used more than once.
+	for i := 0; i < 2; i++ {
+		for _, key := range keys {
+			k, err := ReadSealedKeyObject(key.Path)
+			if err != nil {
+				t.Fatalf("ReadSealedKeyObject failed: %v", err)
+			}
+
+			keyUnsealed, _, err := k.UnsealFromTPM(tpm, "")
+			if err != nil {
+				t.Fatalf("UnsealFromTPM failed: %v", err)
+			}
+			if !bytes.Equal(keyUnsealed, key.Key) {
+				t.Errorf("TPM returned the wrong key")
+			}
+
+			if n := countSessions(); n != origSessions+1 {
+				t.Errorf("Unexpected number of loaded sessions (%d)", n)
+			}
+		}
+	}
+
+	tpm.ReuseSessions(false)
+	if n := countSessions(); n != origSessions {
+		t.Errorf("ReuseSessions(false) didn't flush the retained session (%d loaded sessions)", n)
+	}
+}
+
 func TestUnsealWithPIN(t *testing.T) {
 	tpm := openTPMForTesting(t)
 	defer closeTPM(t, tpm)
@@ -329,6 +866,30 @@ func TestUnsealErrorHandling(t *testing.T) {
 		}
 	})
 
+	t.Run("ReplacedPCRPolicyCounter", func(t *testing.T) {
+		err := run(t, func(tpm *TPMConnection, keyFile string, _ []byte) {
+			undefineKeyNVSpace(t, tpm, keyFile)
+
+			// Create a counter at the same handle that can be incremented by anyone.
+			public := tpm2.NVPublic{
+				Index:   0x0181fff0,
+				NameAlg: tpm2.HashAlgorithmSHA256,
+				Attrs:   tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+				Size:    8}
+			index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &public, nil)
+			if err != nil {
+				t.Fatalf("NVDefineSpace failed: %v", err)
+			}
+			if err := tpm.NVIncrement(index, index, nil); err != nil {
+				t.Fatalf("NVIncrement failed: %v", err)
+			}
+		})
+		if _, ok := err.(InvalidKeyFileError); !ok || err.Error() != "invalid key data file: cannot complete authorization policy "+
+			"assertions: PCR policy counter has unexpected attributes" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
 	t.Run("PINFail", func(t *testing.T) {
 		err := run(t, func(tpm *TPMConnection, keyFile string, _ []byte) {
 			if err := ChangePIN(tpm, keyFile, "", "1234"); err != nil {
@@ -23,6 +23,8 @@ import (
 	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/hmac"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math/big"
@@ -167,7 +169,8 @@ func createTPMPublicAreaForECDSAKey(key *ecdsa.PublicKey) *tpm2.Public {
 				Y: bigIntToBytesZeroExtended(key.Y, key.Params().BitSize/8)}}}
 }
 
-func createECDSAPrivateKeyFromTPM(public *tpm2.Public, private tpm2.ECCParameter) (*ecdsa.PrivateKey, error) {
+// createECDSAPublicKeyFromTPM creates a go *ecdsa.PublicKey from the public area of an ECC object.
+func createECDSAPublicKeyFromTPM(public *tpm2.Public) (*ecdsa.PublicKey, error) {
 	if public.Type != tpm2.ObjectTypeECC {
 		return nil, errors.New("unsupported type")
 	}
@@ -186,12 +189,18 @@ func createECDSAPrivateKeyFromTPM(public *tpm2.Public, private tpm2.ECCParameter
 		return nil, errors.New("unsupported curve")
 	}
 
-	return &ecdsa.PrivateKey{
-		PublicKey: ecdsa.PublicKey{
-			Curve: curve,
-			X:     new(big.Int).SetBytes(public.Unique.ECC().X),
-			Y:     new(big.Int).SetBytes(public.Unique.ECC().Y)},
-		D: new(big.Int).SetBytes(private)}, nil
+	return &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(public.Unique.ECC().X),
+		Y:     new(big.Int).SetBytes(public.Unique.ECC().Y)}, nil
+}
+
+func createECDSAPrivateKeyFromTPM(public *tpm2.Public, private tpm2.ECCParameter) (*ecdsa.PrivateKey, error) {
+	pub, err := createECDSAPublicKeyFromTPM(public)
+	if err != nil {
+		return nil, err
+	}
+	return &ecdsa.PrivateKey{PublicKey: *pub, D: new(big.Int).SetBytes(private)}, nil
 }
 
 // digestListContains indicates whether the specified digest is present in the list of digests.
@@ -203,3 +212,19 @@ func digestListContains(list tpm2.DigestList, digest tpm2.Digest) bool {
 	}
 	return false
 }
+
+// kdfa implements the KDFa key derivation function from the TPM 2.0 Library Specification Part 1, section 11.4.10.2.
+func kdfa(alg tpm2.HashAlgorithmId, key []byte, label string, contextU, contextV []byte, sizeInBits int) []byte {
+	var out []byte
+	for counter := uint32(1); len(out) < (sizeInBits+7)/8; counter++ {
+		h := hmac.New(alg.NewHash, key)
+		binary.Write(h, binary.BigEndian, counter)
+		h.Write([]byte(label))
+		h.Write([]byte{0})
+		h.Write(contextU)
+		h.Write(contextV)
+		binary.Write(h, binary.BigEndian, uint32(sizeInBits))
+		out = h.Sum(out)
+	}
+	return out[:(sizeInBits+7)/8]
+}
@@ -0,0 +1,157 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+var procCmdlinePath = "/proc/cmdline"
+
+// dmVerityRootHashCmdlineParam is the kernel command line parameter used by systemd-veritysetup-generator to specify the root hash
+// of the dm-verity protected root filesystem.
+const dmVerityRootHashCmdlineParam = "roothash"
+
+func computeDmVerityRootHashDigest(alg tpm2.HashAlgorithmId, rootHash []byte) tpm2.Digest {
+	h := alg.NewHash()
+	h.Write(rootHash)
+	return h.Sum(nil)
+}
+
+// DmVerityProfileParams provides the parameters to AddDmVerityProfile.
+type DmVerityProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
+	// (PTP) Specification" Level 00, Revision 01.03 v22, May 22 2017 are required to support tpm2.HashAlgorithmSHA1 and
+	// tpm2.HashAlgorithmSHA256. Support for other digest algorithms is optional.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// PCRIndex is the PCR that the bootloader measures the root hash to.
+	PCRIndex int
+
+	// RootHashes is the set of dm-verity root hashes to add to the PCR profile. More than one root hash can be supplied so that
+	// a key can be used with both the current and the updated root filesystem during an A/B update.
+	RootHashes [][]byte
+}
+
+// AddDmVerityProfile adds the dm-verity root hash profile to the PCR protection profile, in order to generate a PCR policy that is
+// bound to a specific set of immutable root filesystem images. This is for image-based systems where the bootloader measures the
+// dm-verity root hash of the root filesystem that it is about to boot before passing it to the kernel, and dm-verity guarantees
+// that the root filesystem matches it.
+//
+// The profile consists of a single measurement, computed as follows (where H is the digest algorithm supplied via
+// params.PCRAlgorithm):
+//  digestRootHash = H(root-hash)
+// The root hash is hashed in its binary form. This can be measured with MeasureDmVerityRootHashToTPM.
+//
+// The PCR index that the bootloader measures the root hash to can be specified via the PCRIndex field of params.
+//
+// The set of root hashes to add to the PCRProtectionProfile is specified via the RootHashes field of params.
+func AddDmVerityProfile(profile *PCRProtectionProfile, params *DmVerityProfileParams) error {
+	if params.PCRIndex < 0 {
+		return errors.New("invalid PCR index")
+	}
+	if len(params.RootHashes) == 0 {
+		return errors.New("no root hashes provided")
+	}
+
+	var subProfiles []*PCRProtectionProfile
+	for _, rootHash := range params.RootHashes {
+		if len(rootHash) == 0 {
+			return errors.New("empty root hash")
+		}
+		subProfiles = append(subProfiles, NewPCRProtectionProfile().ExtendPCR(params.PCRAlgorithm, params.PCRIndex,
+			computeDmVerityRootHashDigest(params.PCRAlgorithm, rootHash)))
+	}
+
+	profile.AddProfileOR(subProfiles...)
+	return nil
+}
+
+// MeasureDmVerityRootHashToTPM measures a digest of the supplied dm-verity root hash to the specified PCR for all supported PCR
+// banks. See the documentation for AddDmVerityProfile for details of how the digest is computed.
+func MeasureDmVerityRootHashToTPM(tpm *TPMConnection, pcrIndex int, rootHash []byte) error {
+	return measureSnapPropertyToTPM(tpm, pcrIndex, func(alg tpm2.HashAlgorithmId) (tpm2.Digest, error) {
+		return computeDmVerityRootHashDigest(alg, rootHash), nil
+	})
+}
+
+// ReadDmVerityRootHashFromKernelCmdline returns the dm-verity root hash of the root filesystem, as specified on the kernel command
+// line with the "roothash=" parameter. If the parameter isn't present, nil is returned.
+func ReadDmVerityRootHashFromKernelCmdline() ([]byte, error) {
+	cmdline, err := ioutil.ReadFile(procCmdlinePath)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read kernel command line: %w", err)
+	}
+
+	for _, param := range strings.Fields(string(cmdline)) {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 || kv[0] != dmVerityRootHashCmdlineParam {
+			continue
+		}
+		rootHash, err := hex.DecodeString(kv[1])
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decode root hash: %w", err)
+		}
+		return rootHash, nil
+	}
+
+	return nil, nil
+}
+
+// DmVerityRootHashes returns the dm-verity root hashes of the root filesystems that this sealed key object may be used with, or
+// nil if none were recorded.
+func (k *SealedKeyObject) DmVerityRootHashes() [][]byte {
+	return k.data.verityRootHashes
+}
+
+// CheckDmVerityRootHash verifies that the supplied dm-verity root hash is one of the root hashes recorded in this sealed key
+// object. If no root hashes were recorded, this returns nil. If rootHash is nil, the root hash is read from the kernel command
+// line. If the root hash doesn't match, ErrDmVerityRootHashMismatch is returned.
+//
+// Note that the recorded root hashes aren't integrity protected by the TPM. To cryptographically bind a sealed key to a set of
+// root hashes, the bootloader must measure the root hash and the PCR protection profile must include AddDmVerityProfile.
+func (k *SealedKeyObject) CheckDmVerityRootHash(rootHash []byte) error {
+	if len(k.data.verityRootHashes) == 0 {
+		return nil
+	}
+
+	if rootHash == nil {
+		var err error
+		rootHash, err = ReadDmVerityRootHashFromKernelCmdline()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, h := range k.data.verityRootHashes {
+		if bytes.Equal(h, rootHash) {
+			return nil
+		}
+	}
+	return ErrDmVerityRootHashMismatch
+}
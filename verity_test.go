@@ -0,0 +1,179 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type dmVeritySuite struct{}
+
+var _ = Suite(&dmVeritySuite{})
+
+func (s *dmVeritySuite) computeExpectedPCRValue(c *C, alg tpm2.HashAlgorithmId, rootHash []byte) tpm2.Digest {
+	h := alg.NewHash()
+	h.Write(rootHash)
+	digest := h.Sum(nil)
+
+	h = alg.NewHash()
+	h.Write(make([]byte, alg.Size()))
+	h.Write(digest)
+	return h.Sum(nil)
+}
+
+func (s *dmVeritySuite) testAddDmVerityProfile(c *C, params *DmVerityProfileParams) {
+	expectedPcrs := tpm2.PCRSelectionList{{Hash: params.PCRAlgorithm, Select: []int{params.PCRIndex}}}
+	var expectedDigests tpm2.DigestList
+	for _, rootHash := range params.RootHashes {
+		v := tpm2.PCRValues{params.PCRAlgorithm: {params.PCRIndex: s.computeExpectedPCRValue(c, params.PCRAlgorithm, rootHash)}}
+		d, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, expectedPcrs, v)
+		expectedDigests = append(expectedDigests, d)
+	}
+
+	profile := NewPCRProtectionProfile()
+	c.Check(AddDmVerityProfile(profile, params), IsNil)
+	pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+	c.Check(pcrs.Equal(expectedPcrs), Equals, true)
+	c.Check(digests, DeepEquals, expectedDigests)
+	if c.Failed() {
+		c.Logf("Profile:\n%s", profile)
+		c.Logf("Values:\n%s", profile.DumpValues(nil))
+	}
+}
+
+func (s *dmVeritySuite) TestAddDmVerityProfile1(c *C) {
+	s.testAddDmVerityProfile(c, &DmVerityProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		PCRIndex:     12,
+		RootHashes:   [][]byte{testutil.DecodeHexString(c, "4a8ce7e2b1e4a9b7d4e0f5d6c3a2b1908f7e6d5c4b3a29180f1e2d3c4b5a6978")}})
+}
+
+func (s *dmVeritySuite) TestAddDmVerityProfile2(c *C) {
+	s.testAddDmVerityProfile(c, &DmVerityProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		PCRIndex:     12,
+		RootHashes: [][]byte{
+			testutil.DecodeHexString(c, "4a8ce7e2b1e4a9b7d4e0f5d6c3a2b1908f7e6d5c4b3a29180f1e2d3c4b5a6978"),
+			testutil.DecodeHexString(c, "8d0a4e3c2b1f9e8d7c6b5a49382716f5e4d3c2b1a09f8e7d6c5b4a3928170605")}})
+}
+
+func (s *dmVeritySuite) TestAddDmVerityProfileSHA1(c *C) {
+	s.testAddDmVerityProfile(c, &DmVerityProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA1,
+		PCRIndex:     14,
+		RootHashes:   [][]byte{testutil.DecodeHexString(c, "4a8ce7e2b1e4a9b7d4e0f5d6c3a2b1908f7e6d5c4b3a29180f1e2d3c4b5a6978")}})
+}
+
+func (s *dmVeritySuite) TestAddDmVerityProfileNoRootHashes(c *C) {
+	c.Check(AddDmVerityProfile(NewPCRProtectionProfile(), &DmVerityProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		PCRIndex:     12}), ErrorMatches, "no root hashes provided")
+}
+
+func (s *dmVeritySuite) TestReadDmVerityRootHashFromKernelCmdline(c *C) {
+	cmdline := filepath.Join(c.MkDir(), "cmdline")
+	restore := MockProcCmdlinePath(cmdline)
+	defer restore()
+
+	c.Assert(ioutil.WriteFile(cmdline, []byte("console=ttyS0 roothash=4a8ce7e2b1e4a9b7d4e0f5d6c3a2b1908f7e6d5c4b3a29180f1e2d3c4b5a6978 quiet\n"), 0644), IsNil)
+	rootHash, err := ReadDmVerityRootHashFromKernelCmdline()
+	c.Check(err, IsNil)
+	c.Check(rootHash, DeepEquals, testutil.DecodeHexString(c, "4a8ce7e2b1e4a9b7d4e0f5d6c3a2b1908f7e6d5c4b3a29180f1e2d3c4b5a6978"))
+}
+
+func (s *dmVeritySuite) TestReadDmVerityRootHashFromKernelCmdlineMissing(c *C) {
+	cmdline := filepath.Join(c.MkDir(), "cmdline")
+	restore := MockProcCmdlinePath(cmdline)
+	defer restore()
+
+	c.Assert(ioutil.WriteFile(cmdline, []byte("console=ttyS0 quiet\n"), 0644), IsNil)
+	rootHash, err := ReadDmVerityRootHashFromKernelCmdline()
+	c.Check(err, IsNil)
+	c.Check(rootHash, IsNil)
+}
+
+func (s *dmVeritySuite) TestReadDmVerityRootHashFromKernelCmdlineInvalid(c *C) {
+	cmdline := filepath.Join(c.MkDir(), "cmdline")
+	restore := MockProcCmdlinePath(cmdline)
+	defer restore()
+
+	c.Assert(ioutil.WriteFile(cmdline, []byte("roothash=foo\n"), 0644), IsNil)
+	_, err := ReadDmVerityRootHashFromKernelCmdline()
+	c.Check(err, ErrorMatches, "cannot decode root hash: .*")
+}
+
+func TestCheckDmVerityRootHash(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestCheckDmVerityRootHash_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	rootHash1 := decodeHexStringT(t, "4a8ce7e2b1e4a9b7d4e0f5d6c3a2b1908f7e6d5c4b3a29180f1e2d3c4b5a6978")
+	rootHash2 := decodeHexStringT(t, "8d0a4e3c2b1f9e8d7c6b5a49382716f5e4d3c2b1a09f8e7d6c5b4a3928170605")
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	if _, err := SealKeyToTPMWithOptions(tpm, []*SealKeyRequest{{Key: make([]byte, 32), Path: keyFile}},
+		WithDmVerityRootHashes(rootHash1)); err != nil {
+		t.Fatalf("SealKeyToTPMWithOptions failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if len(k.DmVerityRootHashes()) != 1 {
+		t.Errorf("Unexpected root hashes: %x", k.DmVerityRootHashes())
+	}
+
+	if err := k.CheckDmVerityRootHash(rootHash1); err != nil {
+		t.Errorf("CheckDmVerityRootHash failed: %v", err)
+	}
+	if err := k.CheckDmVerityRootHash(rootHash2); err != ErrDmVerityRootHashMismatch {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	cmdline := filepath.Join(tmpDir, "cmdline")
+	restore := MockProcCmdlinePath(cmdline)
+	defer restore()
+	if err := ioutil.WriteFile(cmdline, []byte("roothash=4a8ce7e2b1e4a9b7d4e0f5d6c3a2b1908f7e6d5c4b3a29180f1e2d3c4b5a6978\n"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := k.CheckDmVerityRootHash(nil); err != nil {
+		t.Errorf("CheckDmVerityRootHash failed: %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// defaultVolumeKeySize is the size of keys derived from a sealed master secret if no size is specified.
+	defaultVolumeKeySize = 64
+
+	// maxVolumeKeySize is the maximum size of a key that can be derived with HKDF-SHA256.
+	maxVolumeKeySize = 255 * sha256.Size
+)
+
+// volumeKeyDerivationContext is prepended to the label of each volume to form the HKDF info parameter, so that keys derived from a
+// master secret for this purpose can't collide with keys derived from the same secret for any other purpose.
+var volumeKeyDerivationContext = []byte("SECBOOT-VOLUME-KEY:")
+
+// volumeKeyDerivation indicates that the key sealed in a key data file is a master secret from which the keys for individual volumes
+// are derived. It is stored in the keyDataExtensionVolumeKeyDerivation extension of version 3 and later key data files.
+type volumeKeyDerivation struct {
+	Alg     tpm2.HashAlgorithmId // The digest algorithm used with HKDF. Only tpm2.HashAlgorithmSHA256 is currently supported
+	KeySize uint16               // The size of the derived keys in bytes
+}
+
+// VolumeKeyDerivationParams specifies that the key being sealed is a master secret from which the keys for individual volumes are
+// derived, rather than the key for a single volume. See the VolumeKeyDerivation field of KeyCreationParams.
+type VolumeKeyDerivationParams struct {
+	// KeySize is the size of each derived volume key in bytes. If this is zero, 64 byte keys are derived.
+	KeySize int
+}
+
+func (p *VolumeKeyDerivationParams) data() (*volumeKeyDerivation, error) {
+	if p == nil {
+		return nil, nil
+	}
+	size := p.KeySize
+	switch {
+	case size == 0:
+		size = defaultVolumeKeySize
+	case size < 0 || size > maxVolumeKeySize:
+		return nil, fmt.Errorf("invalid volume key size %d", size)
+	}
+	return &volumeKeyDerivation{Alg: tpm2.HashAlgorithmSHA256, KeySize: uint16(size)}, nil
+}
+
+// hkdfSHA256 implements HKDF as defined in RFC 5869, using HMAC-SHA256.
+func hkdfSHA256(secret, salt, info []byte, size int) []byte {
+	if len(salt) == 0 {
+		salt = make([]byte, sha256.Size)
+	}
+
+	// Extract
+	h := hmac.New(sha256.New, salt)
+	h.Write(secret)
+	prk := h.Sum(nil)
+	defer wipeBytes(prk)
+
+	// Expand
+	var out []byte
+	var t []byte
+	for i := byte(1); len(out) < size; i++ {
+		h = hmac.New(sha256.New, prk)
+		h.Write(t)
+		h.Write(info)
+		h.Write([]byte{i})
+		t = h.Sum(nil)
+		out = append(out, t...)
+	}
+	wipeBytes(t)
+	return out[:size]
+}
+
+func (d *volumeKeyDerivation) deriveKey(masterKey []byte, label string) ([]byte, error) {
+	if d.Alg != tpm2.HashAlgorithmSHA256 {
+		return nil, fmt.Errorf("unsupported volume key derivation algorithm %v", d.Alg)
+	}
+	if d.KeySize == 0 || d.KeySize > maxVolumeKeySize {
+		return nil, fmt.Errorf("invalid volume key size %d", d.KeySize)
+	}
+	return deriveVolumeKey(masterKey, label, int(d.KeySize)), nil
+}
+
+func deriveVolumeKey(masterKey []byte, label string, size int) []byte {
+	info := make([]byte, 0, len(volumeKeyDerivationContext)+len(label))
+	info = append(info, volumeKeyDerivationContext...)
+	info = append(info, label...)
+	return hkdfSHA256(masterKey, nil, info, size)
+}
+
+// DeriveVolumeKey derives the key for the volume identified by label from the supplied master secret, using HKDF-SHA256. The
+// label can be any string that uniquely identifies the volume, such as its partition UUID or its role. The size argument specifies
+// the size of the derived key in bytes, and must be the same as the KeySize field of the VolumeKeyDerivationParams that the master
+// secret was sealed with (or 64 if that was zero).
+//
+// This is used at installation time to compute the key for each encrypted volume, which can then be passed to
+// InitializeLUKS2Container. Adding a new encrypted volume only requires deriving another key from the master secret - it doesn't
+// require another sealing operation or another key data file.
+func DeriveVolumeKey(masterKey []byte, label string, size int) ([]byte, error) {
+	if len(masterKey) == 0 {
+		return nil, errors.New("no master key supplied")
+	}
+	if label == "" {
+		return nil, errors.New("no label supplied")
+	}
+	if size <= 0 || size > maxVolumeKeySize {
+		return nil, fmt.Errorf("invalid volume key size %d", size)
+	}
+	return deriveVolumeKey(masterKey, label, size), nil
+}
+
+// DerivesVolumeKeys indicates whether the key sealed in this object is a master secret from which the keys for individual volumes
+// are derived, in which case the keys should be obtained with UnsealVolumeKeyFromTPM rather than UnsealFromTPM.
+func (k *SealedKeyObject) DerivesVolumeKeys() bool {
+	return k.data.volumeKeyDerivation != nil
+}
+
+// UnsealVolumeKeyFromTPM unseals the master secret from this sealed key object in the same way as UnsealFromTPM, and then derives
+// the key for the volume identified by label from it, in the same way as DeriveVolumeKey. The errors returned from this function
+// are the same as those returned from UnsealFromTPM.
+//
+// If this sealed key object doesn't contain a master secret, an error is returned.
+//
+// On success, the derived volume key is returned, along with the private part of the key used for authorizing PCR policy updates.
+func (k *SealedKeyObject) UnsealVolumeKeyFromTPM(tpm *TPMConnection, pin, label string) (key []byte, authKey TPMPolicyAuthKey, err error) {
+	if k.data.volumeKeyDerivation == nil {
+		return nil, nil, errors.New("sealed key object does not contain a master secret")
+	}
+	if label == "" {
+		return nil, nil, errors.New("no label supplied")
+	}
+
+	masterKey, authKey, err := k.UnsealFromTPM(tpm, pin)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipeBytes(masterKey)
+
+	key, err = k.data.volumeKeyDerivation.deriveKey(masterKey, label)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot derive volume key: %w", err)
+	}
+	return key, authKey, nil
+}
@@ -0,0 +1,145 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/snapcore/secboot"
+)
+
+func TestHkdfSHA256(t *testing.T) {
+	// Test vectors from RFC 5869, appendix A.
+	for _, data := range []struct {
+		desc   string
+		secret []byte
+		salt   []byte
+		info   []byte
+		okm    []byte
+	}{
+		{
+			desc:   "1",
+			secret: decodeHexStringT(t, "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b"),
+			salt:   decodeHexStringT(t, "000102030405060708090a0b0c"),
+			info:   decodeHexStringT(t, "f0f1f2f3f4f5f6f7f8f9"),
+			okm:    decodeHexStringT(t, "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865"),
+		},
+		{
+			desc:   "3",
+			secret: decodeHexStringT(t, "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b"),
+			okm:    decodeHexStringT(t, "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8"),
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			okm := HkdfSHA256(data.secret, data.salt, data.info, len(data.okm))
+			if !bytes.Equal(okm, data.okm) {
+				t.Errorf("Unexpected output: %x", okm)
+			}
+		})
+	}
+}
+
+func TestDeriveVolumeKey(t *testing.T) {
+	masterKey := make([]byte, 32)
+	rand.Read(masterKey)
+
+	key1, err := DeriveVolumeKey(masterKey, "data", 64)
+	if err != nil {
+		t.Fatalf("DeriveVolumeKey failed: %v", err)
+	}
+	if len(key1) != 64 {
+		t.Errorf("Unexpected key length: %d", len(key1))
+	}
+	key2, err := DeriveVolumeKey(masterKey, "data", 64)
+	if err != nil {
+		t.Fatalf("DeriveVolumeKey failed: %v", err)
+	}
+	if !bytes.Equal(key1, key2) {
+		t.Errorf("Derivation should be deterministic")
+	}
+	key3, err := DeriveVolumeKey(masterKey, "save", 64)
+	if err != nil {
+		t.Fatalf("DeriveVolumeKey failed: %v", err)
+	}
+	if bytes.Equal(key1, key3) {
+		t.Errorf("Keys for different labels should differ")
+	}
+
+	if _, err := DeriveVolumeKey(masterKey, "", 64); err == nil || err.Error() != "no label supplied" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := DeriveVolumeKey(masterKey, "data", 0); err == nil || err.Error() != "invalid volume key size 0" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := DeriveVolumeKey(masterKey, "data", 8161); err == nil || err.Error() != "invalid volume key size 8161" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestUnsealVolumeKeyFromTPM(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealVolumeKeyFromTPM_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	masterKey := make([]byte, 32)
+	rand.Read(masterKey)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	if _, err := SealKeyToTPMWithOptions(tpm, []*SealKeyRequest{{Key: masterKey, Path: keyFile}}, WithPCRProfile(getTestPCRProfile()),
+		WithVolumeKeyDerivation(32)); err != nil {
+		t.Fatalf("SealKeyToTPMWithOptions failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if !k.DerivesVolumeKeys() {
+		t.Errorf("Sealed key object should contain a master secret")
+	}
+
+	for _, label := range []string{"data", "save"} {
+		expected, err := DeriveVolumeKey(masterKey, label, 32)
+		if err != nil {
+			t.Fatalf("DeriveVolumeKey failed: %v", err)
+		}
+		key, _, err := k.UnsealVolumeKeyFromTPM(tpm, "", label)
+		if err != nil {
+			t.Fatalf("UnsealVolumeKeyFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(key, expected) {
+			t.Errorf("Unexpected volume key for %s", label)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"math/big"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/snapcore/secboot/internal/tcg"
+
+	"golang.org/x/xerrors"
+)
+
+// rocaPrimes are the small primes used to fingerprint RSA moduli generated by the flawed Infineon key generation algorithm
+// (CVE-2017-15361, "ROCA"). See "The Return of Coppersmith's Attack: Practical Factorization of Widely Used RSA Moduli",
+// Nemec et al, 2017.
+var rocaPrimes = []int64{3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53, 59, 61, 67, 71, 73, 79, 83, 89, 97, 101, 103,
+	107, 109, 113, 127, 131, 137, 139, 149, 151, 157, 163, 167}
+
+// isROCAVulnerableModulus determines whether the supplied RSA modulus has the structure of one generated by the flawed Infineon
+// key generation algorithm. Affected moduli are of the form k*M + (65537^a mod M), where M is the primorial of the first n primes,
+// so the modulus reduced by each of these small primes is always a member of the multiplicative subgroup generated by 65537.
+// An unaffected modulus fails this test with overwhelming probability.
+func isROCAVulnerableModulus(n *big.Int) bool {
+	for _, p := range rocaPrimes {
+		r := new(big.Int).Mod(n, big.NewInt(p)).Int64()
+		g := 65537 % p
+
+		found := false
+		x := int64(1)
+		for {
+			if x == r {
+				found = true
+				break
+			}
+			x = (x * g) % p
+			if x == 1 {
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// isWeakKey determines whether the supplied public area is for a key that is affected by a known key generation weakness.
+func isWeakKey(pub *tpm2.Public) bool {
+	if pub.Type != tpm2.ObjectTypeRSA {
+		return false
+	}
+	return isROCAVulnerableModulus(new(big.Int).SetBytes(pub.Unique.RSA()))
+}
+
+// checkKeyNotWeak reads the public area of the specified key from the TPM and returns a WeakKeyError error if it is affected by a
+// known key generation weakness.
+func checkKeyNotWeak(tpm *tpm2.TPMContext, key tpm2.ResourceContext, session tpm2.SessionContext) error {
+	pub, _, _, err := tpm.ReadPublic(key, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return xerrors.Errorf("cannot read public area: %w", err)
+	}
+	if isWeakKey(pub) {
+		return WeakKeyError{key.Handle()}
+	}
+	return nil
+}
+
+// VerifyPrimaryKeys checks the state of the persistent primary keys used by this package. It verifies that the storage root key
+// exists and that its public area matches the expected template, and that neither the storage root key or the endorsement key (if
+// it exists) are affected by a known key generation weakness, such as the flawed RSA key generation in some Infineon TPMs
+// (CVE-2017-15361).
+//
+// If the storage root key does not exist or does not match the expected template, a ErrTPMProvisioning error will be returned.
+//
+// If either primary key is affected by a known weakness, a WeakKeyError error will be returned. In this case, the TPM's firmware
+// must be updated and the TPM must be cleared before it can be used safely with this package.
+//
+// This is performed automatically when a connection is initialized and after the TPM is provisioned with
+// TPMConnection.EnsureProvisioned, and the result is available from TPMConnection.PrimaryKeysStatus.
+func (t *TPMConnection) VerifyPrimaryKeys() error {
+	session := t.currentHmacSession()
+
+	srk, err := t.CreateResourceContextFromTPM(tcg.SRKHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, tcg.SRKHandle):
+		return ErrTPMProvisioning
+	case err != nil:
+		return xerrors.Errorf("cannot create context for SRK: %w", err)
+	}
+
+	ok, err := isObjectPrimaryKeyWithTemplate(t.TPMContext, t.OwnerHandleContext(), srk, tcg.SRKTemplate, session)
+	switch {
+	case err != nil:
+		return xerrors.Errorf("cannot determine if SRK is a primary key with the expected template: %w", err)
+	case !ok:
+		return ErrTPMProvisioning
+	}
+
+	if err := checkKeyNotWeak(t.TPMContext, srk, session); err != nil {
+		return err
+	}
+
+	if t.ek == nil {
+		return nil
+	}
+	return checkKeyNotWeak(t.TPMContext, t.ek, session)
+}
+
+// PrimaryKeysStatus returns the result of the VerifyPrimaryKeys check that was performed when this connection was initialized,
+// or when the TPM was last provisioned with TPMConnection.EnsureProvisioned. This avoids the cost of repeating the check when
+// determining whether the TPM is ready for use, eg, before sealing keys.
+func (t *TPMConnection) PrimaryKeysStatus() error {
+	return t.primaryKeysErr
+}
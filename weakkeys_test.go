@@ -0,0 +1,53 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"math/big"
+
+	. "github.com/snapcore/secboot"
+
+	. "gopkg.in/check.v1"
+)
+
+type weakKeysSuite struct{}
+
+var _ = Suite(&weakKeysSuite{})
+
+func (s *weakKeysSuite) TestROCAVulnerableModulus(c *C) {
+	// Construct a modulus with the same structure as one generated by the flawed algorithm - ie, one that is congruent
+	// to a power of 65537 modulo the primorial of the fingerprint primes.
+	m := big.NewInt(1)
+	for _, p := range []int64{3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53, 59, 61, 67, 71, 73, 79, 83, 89, 97, 101,
+		103, 107, 109, 113, 127, 131, 137, 139, 149, 151, 157, 163, 167} {
+		m.Mul(m, big.NewInt(p))
+	}
+	n := new(big.Int).Exp(big.NewInt(65537), big.NewInt(12345), m)
+	n.Add(n, new(big.Int).Mul(m, big.NewInt(987654321)))
+	c.Check(IsROCAVulnerableModulus(n), Equals, true)
+}
+
+func (s *weakKeysSuite) TestGoodModulus(c *C) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	c.Check(IsROCAVulnerableModulus(key.N), Equals, false)
+}
@@ -0,0 +1,117 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/xerrors"
+)
+
+// zbootHeader corresponds to the header at the start of a EFI zboot image, which is a PE image containing a small decompressor
+// and a compressed kernel image (see drivers/firmware/efi/libstub/zboot-header.S in the Linux source).
+type zbootHeader struct {
+	MZMagic         [4]byte
+	ImageType       [4]byte
+	PayloadOffset   uint32
+	PayloadSize     uint32
+	Reserved        [8]byte
+	CompressionType [32]byte
+}
+
+var zbootImageType = [4]byte{'z', 'i', 'm', 'g'}
+
+// readZBootHeader reads the EFI zboot header from r. If r doesn't correspond to a EFI zboot image, it returns nil.
+func readZBootHeader(r io.ReaderAt) (*zbootHeader, error) {
+	var hdr zbootHeader
+	if err := binary.Read(io.NewSectionReader(r, 0, int64(binary.Size(hdr))), binary.LittleEndian, &hdr); err != nil {
+		return nil, xerrors.Errorf("cannot read header: %w", err)
+	}
+	if hdr.MZMagic[0] != 'M' || hdr.MZMagic[1] != 'Z' || hdr.ImageType != zbootImageType {
+		return nil, nil
+	}
+	return &hdr, nil
+}
+
+func (h *zbootHeader) compressionType() string {
+	return string(bytes.TrimRight(h.CompressionType[:], "\x00"))
+}
+
+// ZBootPayloadEFIImage corresponds to the kernel image that is compressed inside of the EFI zboot image specified by the Image field.
+// EFI zboot images are used by ARM64 kernels. The zboot image is verified and measured when it is loaded, and it then decompresses
+// the kernel image. Depending on the kernel version, the decompressed kernel image may then be loaded with the firmware's
+// EFI_BOOT_SERVICES.LoadImage(), in which case it is verified and measured again. In this case, a load event for this image with a
+// source of Firmware should be added as the next event after the load event for the zboot image, so that the PCR profiles computed
+// from the load sequence are correct.
+//
+// Only gzip compressed payloads are currently supported.
+type ZBootPayloadEFIImage struct {
+	Image EFIImage
+}
+
+func (i ZBootPayloadEFIImage) String() string {
+	return i.Image.String() + ":zboot-payload"
+}
+
+func (i ZBootPayloadEFIImage) Open() (interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}, error) {
+	r, err := i.Image.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	hdr, err := readZBootHeader(r)
+	switch {
+	case err != nil:
+		return nil, xerrors.Errorf("cannot read zboot header: %w", err)
+	case hdr == nil:
+		return nil, errors.New("not a EFI zboot image")
+	}
+
+	if int64(hdr.PayloadOffset)+int64(hdr.PayloadSize) > r.Size() {
+		return nil, errors.New("invalid payload offset or size")
+	}
+	payload := io.NewSectionReader(r, int64(hdr.PayloadOffset), int64(hdr.PayloadSize))
+
+	switch hdr.compressionType() {
+	case "gzip":
+		gr, err := gzip.NewReader(payload)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decompress payload: %w", err)
+		}
+		data, err := ioutil.ReadAll(gr)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decompress payload: %w", err)
+		}
+		return &bytesEFIImageHandle{bytes.NewReader(data)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression type \"%s\"", hdr.compressionType())
+	}
+}